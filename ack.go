@@ -0,0 +1,190 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//An AsyncSink accepts a notification now and acknowledges its delivery later, ie: a BufferedSink
+type AsyncSink interface {
+	Sink
+	SendAck(ctx context.Context, notification *pq.Notification, ack func(err error)) error
+}
+
+//A CheckpointFunc persists the position of the latest notification on a channel that every required sink has acknowledged, along with every notification before it.
+//A failed checkpoint is superseded by the next one, since each advance covers every notification before it
+type CheckpointFunc func(ctx context.Context, notification *pq.Notification) error
+
+type optionalSink struct {
+	Sink
+}
+
+//Optional marks a sink whose acknowledgement a pipeline's checkpoint does not wait for
+func Optional(sink Sink) Sink {
+	return optionalSink{Sink: sink}
+}
+
+func isOptional(sink Sink) bool {
+	switch sink.(type) {
+	case optionalSink, *ShadowSink:
+		return true
+	}
+	return false
+}
+
+//Checkpoint enables acknowledgement-based flow control: the checkpoint only advances past a notification once every required sink it was delivered to has acked it.
+//A notification that a required sink fails to deliver holds the checkpoint back, so a restarted consumer resumes from before it, until it is redelivered,
+//ie: retried by the client, and succeeds
+func (p *Pipeline) Checkpoint(checkpoint CheckpointFunc) *Pipeline {
+	p.acks = newAckTracker(checkpoint)
+	return p
+}
+
+//PendingAcks returns the number of notifications per channel waiting on acknowledgements before the checkpoint can advance past them
+func (p *Pipeline) PendingAcks() map[string]int {
+	if p.acks == nil {
+		return map[string]int{}
+	}
+	return p.acks.pending()
+}
+
+type ackKey struct{}
+
+//ackEvent counts the acknowledgements a notification is waiting on, plus one held while the pipeline is still processing it
+type ackEvent struct {
+	tracker      *ackTracker
+	ctx          context.Context
+	notification *pq.Notification
+	mu           sync.Mutex
+	outstanding  int
+	failed       bool
+	complete     bool
+	//seq is the event's position among the tracker's notifications, and covers the number of notifications it stands for once completed ones are compacted
+	seq    uint64
+	covers int
+}
+
+func (e *ackEvent) add() {
+	e.mu.Lock()
+	e.outstanding++
+	e.mu.Unlock()
+}
+
+func (e *ackEvent) ack(err error) {
+	e.mu.Lock()
+	if err != nil {
+		e.failed = true
+	}
+	e.outstanding--
+	done := e.outstanding == 0 && !e.failed
+	e.complete = done
+	e.mu.Unlock()
+	if done {
+		e.tracker.advance(e.notification.Channel)
+	}
+}
+
+func (e *ackEvent) isComplete() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.complete
+}
+
+func ackFrom(ctx context.Context) *ackEvent {
+	e, _ := ctx.Value(ackKey{}).(*ackEvent)
+	return e
+}
+
+//redrive restarts a failed event for a redelivery of its notification, reporting false if it is still being delivered or hasn't failed
+func (e *ackEvent) redrive(ctx context.Context, n *pq.Notification) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.failed || e.outstanding > 0 || e.notification.Extra != n.Extra {
+		return false
+	}
+	e.ctx, e.notification, e.failed, e.outstanding = ctx, n, false, 1
+	return true
+}
+
+//ackTracker orders a channel's notifications so the checkpoint only moves over a fully acknowledged prefix. Completed notifications held back by a failed
+//one are compacted into the last of them, so a failure holds back a bounded number of entries however many notifications follow it
+type ackTracker struct {
+	checkpoint CheckpointFunc
+	mu         sync.Mutex
+	queues     map[string][]*ackEvent
+	next       uint64
+	//checkpointing serializes checkpoints, outside mu, so a slow one doesn't block deliveries and an earlier one never overwrites a later one
+	checkpointing sync.Mutex
+	checkpointed  map[string]uint64
+}
+
+func newAckTracker(checkpoint CheckpointFunc) *ackTracker {
+	return &ackTracker{
+		checkpoint:   checkpoint,
+		queues:       map[string][]*ackEvent{},
+		checkpointed: map[string]uint64{},
+	}
+}
+
+//begin tracks a notification, taking over the failed entry of an earlier delivery of it if there is one, so its redelivery can release the checkpoint
+func (t *ackTracker) begin(ctx context.Context, n *pq.Notification) (*ackEvent, context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range t.queues[n.Channel] {
+		if e.redrive(detach(ctx), n) {
+			return e, context.WithValue(ctx, ackKey{}, e)
+		}
+	}
+	t.next++
+	e := &ackEvent{tracker: t, ctx: detach(ctx), notification: n, outstanding: 1, seq: t.next, covers: 1}
+	t.queues[n.Channel] = append(t.queues[n.Channel], e)
+	return e, context.WithValue(ctx, ackKey{}, e)
+}
+
+func (t *ackTracker) advance(channel string) {
+	t.mu.Lock()
+	queue := t.queues[channel]
+	var last *ackEvent
+	for len(queue) > 0 && queue[0].isComplete() {
+		last = queue[0]
+		queue = queue[1:]
+	}
+	//completed notifications behind a pending one only matter as the furthest the checkpoint can then move
+	compacted := queue[:0]
+	for _, e := range queue {
+		if n := len(compacted); n > 0 && e.isComplete() && compacted[n-1].isComplete() {
+			e.covers += compacted[n-1].covers
+			compacted[n-1] = e
+			continue
+		}
+		compacted = append(compacted, e)
+	}
+	for i := len(compacted); i < len(queue); i++ {
+		queue[i] = nil
+	}
+	t.queues[channel] = compacted
+	t.mu.Unlock()
+	if last == nil || IsReadOnly(last.ctx) {
+		return
+	}
+	t.checkpointing.Lock()
+	defer t.checkpointing.Unlock()
+	if last.seq <= t.checkpointed[channel] {
+		return
+	}
+	t.checkpointed[channel] = last.seq
+	_ = t.checkpoint(last.ctx, last.notification)
+}
+
+func (t *ackTracker) pending() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]int{}
+	for channel, queue := range t.queues {
+		for _, e := range queue {
+			out[channel] += e.covers
+		}
+	}
+	return out
+}
@@ -0,0 +1,24 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestAckTrackerCompactsBehindFailure(t *testing.T) {
+	tracker := newAckTracker(func(ctx context.Context, n *pq.Notification) error { return nil })
+	head, _ := tracker.begin(context.Background(), &pq.Notification{Channel: "users", Extra: "1"})
+	head.ack(errors.New("down"))
+	for i := 0; i < 1000; i++ {
+		e, _ := tracker.begin(context.Background(), &pq.Notification{Channel: "users", Extra: "2"})
+		e.ack(nil)
+	}
+	if queued := len(tracker.queues["users"]); queued != 2 {
+		t.Fatalf("expected the completed notifications to be compacted, got %d entries", queued)
+	}
+	if pending := tracker.pending()["users"]; pending != 1001 {
+		t.Fatalf("expected 1001 pending acks, got %d", pending)
+	}
+}
@@ -0,0 +1,120 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAckCheckpoint(t *testing.T) {
+	var mu sync.Mutex
+	var checkpoints []string
+	release := make(chan struct{})
+	slowRequired := pqstream.NewBufferedSink(pqstream.NewSink("warehouse", func(ctx context.Context, n *pq.Notification) error {
+		<-release
+		return nil
+	}), pqstream.BufferOptions{Drop: pqstream.Block})
+	failing := pqstream.NewSink("metrics", func(ctx context.Context, n *pq.Notification) error {
+		return errors.New("down")
+	})
+	p := pqstream.NewPipeline().
+		FanOut(slowRequired, pqstream.Optional(failing)).
+		OnError(pqstream.ErrorPolicy{Ignore: true}).
+		Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			checkpoints = append(checkpoints, n.Extra)
+			return nil
+		})
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	mu.Lock()
+	if len(checkpoints) != 0 {
+		t.Fatalf("checkpoint advanced before the required sink acked: %v", checkpoints)
+	}
+	mu.Unlock()
+	if pending := p.PendingAcks()["users"]; pending != 3 {
+		t.Fatalf("expected 3 pending acks, got %d", pending)
+	}
+	close(release)
+	if err := slowRequired.Close(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.PendingAcks()["users"] != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(checkpoints) == 0 || checkpoints[len(checkpoints)-1] != "3" {
+		t.Fatalf("expected checkpoint to reach the last notification, got: %v", checkpoints)
+	}
+}
+
+func TestAckCheckpointHeldByFailure(t *testing.T) {
+	var checkpoints []string
+	fail := true
+	p := pqstream.NewPipeline().
+		FanOut(pqstream.NewSink("db", func(ctx context.Context, n *pq.Notification) error {
+			if fail {
+				return errors.New("down")
+			}
+			return nil
+		})).
+		Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+			checkpoints = append(checkpoints, n.Extra)
+			return nil
+		})
+	if err := p.Process(&pq.Notification{Channel: "users", Extra: "1"}); err == nil {
+		t.Fatal("expected required sink failure")
+	}
+	fail = false
+	if err := p.Process(&pq.Notification{Channel: "users", Extra: "2"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(checkpoints) != 0 || p.PendingAcks()["users"] != 2 {
+		t.Fatalf("expected the failed notification to hold the checkpoint, got: %v", checkpoints)
+	}
+}
+
+func TestAckCheckpointRedrivesFailure(t *testing.T) {
+	var checkpoints []string
+	fail := true
+	p := pqstream.NewPipeline().
+		FanOut(pqstream.NewSink("db", func(ctx context.Context, n *pq.Notification) error {
+			if fail && n.Extra == "1" {
+				return errors.New("down")
+			}
+			return nil
+		})).
+		Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+			checkpoints = append(checkpoints, n.Extra)
+			return nil
+		})
+	failed := &pq.Notification{Channel: "users", Extra: "1"}
+	if err := p.Process(failed); err == nil {
+		t.Fatal("expected required sink failure")
+	}
+	for i := 0; i < 1000; i++ {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: "2"}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if pending := p.PendingAcks()["users"]; pending != 1001 {
+		t.Fatalf("expected 1001 pending acks, got %d", pending)
+	}
+	fail = false
+	if err := p.Process(failed); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(checkpoints) != 1 || checkpoints[0] != "2" || p.PendingAcks()["users"] != 0 {
+		t.Fatalf("expected the redelivery to release the checkpoint, got: %v", checkpoints)
+	}
+}
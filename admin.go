@@ -0,0 +1,352 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//maxDeadLetterPayload bounds the size of a dead letter payload the admin API accepts
+const maxDeadLetterPayload = 1 << 20
+
+//AdminHeader must be set, to any value, on the admin API's POST, PUT and DELETE requests. Browsers only send a custom header to another site after a CORS
+//preflight, which the admin API never answers, so a page the operator visits can't pause, requeue or delete anything
+const AdminHeader = "X-Pqstream-Admin"
+
+//AdminOptions configures an AdminHandler
+type AdminOptions struct {
+	//Authorize decides whether a request may use the admin API, ie: checking a bearer token. It is required: a handler without it refuses every request.
+	//AuthorizeAnyAdmin allows every request, for handlers only reachable by trusted callers, ie: behind mTLS
+	Authorize func(r *http.Request) error
+	//Origins are the origins of the web pages allowed to call the admin API from another site, see StreamOptions.Origins
+	Origins []string
+	//Redact masks the payloads GET /tap and /deadletters serve, ie: a DashboardHandler's. Nil serves them as they are
+	Redact func(payload string) string
+}
+
+func (o AdminOptions) redact(payload string) string {
+	if o.Redact == nil {
+		return payload
+	}
+	return o.Redact(payload)
+}
+
+func (o AdminOptions) redactLetters(letters []DeadLetter) []DeadLetter {
+	for i := range letters {
+		letters[i].Payload = o.redact(letters[i].Payload)
+	}
+	return letters
+}
+
+//AuthorizeAnyAdmin is an AdminOptions.Authorize allowing every request
+func AuthorizeAnyAdmin(r *http.Request) error {
+	return nil
+}
+
+func (o AdminOptions) authorize(r *http.Request) error {
+	if o.Authorize == nil {
+		return errors.New("admin handler has no AdminOptions.Authorize")
+	}
+	if !allowOrigin(r, o.Origins) {
+		return fmt.Errorf("origin not allowed: %s", r.Header.Get("Origin"))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(AdminHeader) == "" {
+		return fmt.Errorf("the %s header is required to change the client", AdminHeader)
+	}
+	return o.Authorize(r)
+}
+
+//AdminHandler returns an http.Handler exposing the client's admin API. GET /stats serves the client's Stats and GET /listeners the state of each channel's listener as JSON.
+//POST /promote promotes a standby client to active. GET /tap?channel=users&n=10&timeout=30s returns up to n live notifications as Records, waiting at most timeout (default 10s).
+//GET /topology?format=dot|mermaid renders the client's handlers and pipelines as a graph and GET /capabilities the features detected on the server.
+//POST /debug?channel=users&for=10m enables rate limited debug logging for a channel, DELETE /debug?channel=users disables it and GET /debug lists the channels being debugged.
+//GET /config serves the client's EffectiveConfig. POST /pause?channel=users&for=10m holds back a channel's notifications, DELETE /pause?channel=users resumes it
+//and GET /pause lists the paused channels and when each pause ends. GET /deadletters?channel=users&handler=h&id=1&limit=100 lists dead letters,
+//PUT /deadletters?id=1 replaces a dead letter's payload with the request body, DELETE /deadletters discards the dead letters matching the same filters
+//and POST /deadletters/requeue requeues them. Bulk operations without a filter require all=true.
+//GET /openapi.json serves the API's OpenAPI definition, see AdminClient for a typed Go client. Every request is checked by opts.Authorize, and changes require AdminHeader
+func AdminHandler(c *Client, opts AdminOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.Stats())
+	})
+	mux.HandleFunc("/listeners", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.ListenersSnapshot())
+	})
+	mux.HandleFunc("/tap", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, timeout := 10, 10*time.Second
+		if v := r.URL.Query().Get("n"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+			n = parsed
+		}
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = parsed
+		}
+		tapped, cancel := c.Tap(r.URL.Query().Get("channel"), n)
+		defer cancel()
+		deadline := c.config.Clock.After(timeout)
+		records := []Record{}
+		for {
+			select {
+			case notification, ok := <-tapped:
+				if !ok {
+					writeJSON(w, records)
+					return
+				}
+				record := NewRecord(notification, c.config.Clock.Now())
+				record.Payload = opts.redact(record.Payload)
+				records = append(records, record)
+			case <-deadline:
+				writeJSON(w, records)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.EffectiveConfig())
+	})
+	mux.HandleFunc("/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		caps := c.Capabilities()
+		if caps == nil {
+			http.Error(w, "not connected", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, caps)
+	})
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			w.Write([]byte(c.DOT()))
+		case "mermaid":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(c.Mermaid()))
+		default:
+			http.Error(w, "invalid format", http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		channel := r.URL.Query().Get("channel")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			d := 10 * time.Minute
+			if v := r.URL.Query().Get("for"); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil || parsed <= 0 {
+					http.Error(w, "invalid for", http.StatusBadRequest)
+					return
+				}
+				d = parsed
+			}
+			if channel == "" {
+				http.Error(w, "empty channel", http.StatusBadRequest)
+				return
+			}
+			c.EnableDebug(channel, d)
+		case http.MethodDelete:
+			c.DisableDebug(channel)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.DebugChannels())
+	})
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		channel := r.URL.Query().Get("channel")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			d := 10 * time.Minute
+			if v := r.URL.Query().Get("for"); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil || parsed <= 0 {
+					http.Error(w, "invalid for", http.StatusBadRequest)
+					return
+				}
+				d = parsed
+			}
+			if channel == "" {
+				http.Error(w, "empty channel", http.StatusBadRequest)
+				return
+			}
+			c.Pause(channel, d)
+		case http.MethodDelete:
+			c.Resume(channel)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.Paused())
+	})
+	mux.HandleFunc("/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.Promote()
+		writeJSON(w, c.Stats().Member)
+	})
+	mux.HandleFunc("/deadletters", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := deadLetterFilter(r, r.Method == http.MethodGet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			letters, err := c.DeadLetters(r.Context(), filter)
+			if err != nil {
+				deadLetterError(w, err)
+				return
+			}
+			writeJSON(w, opts.redactLetters(letters))
+		case http.MethodPut:
+			if len(filter.IDs) != 1 {
+				http.Error(w, "exactly one id is required", http.StatusBadRequest)
+				return
+			}
+			payload, err := io.ReadAll(io.LimitReader(r.Body, maxDeadLetterPayload+1))
+			if err != nil || len(payload) > maxDeadLetterPayload {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := c.EditDeadLetter(r.Context(), filter.IDs[0], string(payload)); err != nil {
+				deadLetterError(w, err)
+				return
+			}
+			letters, err := c.DeadLetters(r.Context(), DeadLetterFilter{IDs: filter.IDs})
+			if err != nil || len(letters) == 0 {
+				deadLetterError(w, errors.Join(err, ErrDeadLetterNotFound))
+				return
+			}
+			writeJSON(w, opts.redactLetters(letters)[0])
+		case http.MethodDelete:
+			deleted, err := c.DeleteDeadLetters(r.Context(), filter)
+			if err != nil {
+				deadLetterError(w, err)
+				return
+			}
+			writeJSON(w, map[string]int64{"deleted": deleted})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/deadletters/requeue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filter, err := deadLetterFilter(r, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := c.Requeue(r.Context(), filter)
+		if err != nil {
+			deadLetterError(w, err)
+			return
+		}
+		writeJSON(w, result)
+	})
+	mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(OpenAPI)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := opts.authorize(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+//deadLetterFilter parses a DeadLetterFilter from the id, channel, handler and limit query parameters. Listing defaults to the oldest 100 dead letters,
+//and other operations on every dead letter require all=true so an empty filter never changes them all by accident
+func deadLetterFilter(r *http.Request, list bool) (DeadLetterFilter, error) {
+	query := r.URL.Query()
+	filter := DeadLetterFilter{Channel: query.Get("channel"), Handler: query.Get("handler")}
+	for _, v := range query["id"] {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid id %s", v)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	if list {
+		filter.Limit = 100
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return filter, errors.New("invalid limit")
+		}
+		filter.Limit = limit
+	}
+	if !list && filter.IsZero() && query.Get("all") != "true" {
+		return filter, errors.New("an id, channel or handler filter, or all=true, is required")
+	}
+	return filter, nil
+}
+
+func deadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNoDeadLetters):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, ErrDeadLetterNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
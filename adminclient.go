@@ -0,0 +1,226 @@
+package pqstream
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//OpenAPI is the OpenAPI 3 definition of the admin API served by AdminHandler, for generating clients in other languages
+//
+//go:embed admin.openapi.json
+var OpenAPI []byte
+
+//An AdminClient is a typed client for the admin API of a running client, one method per operation in OpenAPI
+type AdminClient struct {
+	//URL is the base url the AdminHandler is served at, ie: http://localhost:8080
+	URL string
+	//HTTPClient sends the requests. Defaults to http.DefaultClient
+	HTTPClient *http.Client
+	//Header is added to every request, ie: an Authorization header checked by AdminOptions.Authorize
+	Header http.Header
+}
+
+//NewAdminClient returns an AdminClient for the admin API served at a base url
+func NewAdminClient(baseURL string) *AdminClient {
+	return &AdminClient{URL: baseURL}
+}
+
+func (a *AdminClient) httpClient() *http.Client {
+	if a.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return a.HTTPClient
+}
+
+//do sends a request to an admin API path and decodes its JSON response into v, or copies it into v if it is an io.Writer
+func (a *AdminClient) do(ctx context.Context, method, path string, query url.Values, v interface{}) error {
+	return a.send(ctx, method, path, query, nil, v)
+}
+
+//send is do with a request body
+func (a *AdminClient) send(ctx context.Context, method, path string, query url.Values, body io.Reader, v interface{}) error {
+	u := strings.TrimSuffix(a.URL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range a.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set(AdminHeader, "1")
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if text := strings.TrimSpace(string(msg)); text != "" {
+			return fmt.Errorf("admin API returned %s: %s", resp.Status, text)
+		}
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	if w, ok := v.(io.Writer); ok {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode admin API response! %s", err.Error())
+	}
+	return nil
+}
+
+//Stats returns the client's Stats
+func (a *AdminClient) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := a.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
+
+//Listeners returns the state of each channel's listener
+func (a *AdminClient) Listeners(ctx context.Context) ([]ListenerState, error) {
+	var listeners []ListenerState
+	err := a.do(ctx, http.MethodGet, "/listeners", nil, &listeners)
+	return listeners, err
+}
+
+//Tap returns up to n live notifications on a channel, or every channel if it is empty, waiting at most timeout, or the server's default of 10s if it is zero
+func (a *AdminClient) Tap(ctx context.Context, channel string, n int, timeout time.Duration) ([]Record, error) {
+	query := url.Values{"n": {strconv.Itoa(n)}}
+	if channel != "" {
+		query.Set("channel", channel)
+	}
+	if timeout > 0 {
+		query.Set("timeout", timeout.String())
+	}
+	var records []Record
+	err := a.do(ctx, http.MethodGet, "/tap", query, &records)
+	return records, err
+}
+
+//Config returns the client's EffectiveConfig
+func (a *AdminClient) Config(ctx context.Context) (EffectiveConfig, error) {
+	var effective EffectiveConfig
+	err := a.do(ctx, http.MethodGet, "/config", nil, &effective)
+	return effective, err
+}
+
+//Capabilities returns the features detected on the server the client is connected to
+func (a *AdminClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	caps := &Capabilities{}
+	if err := a.do(ctx, http.MethodGet, "/capabilities", nil, caps); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+//Topology returns the client's handlers and pipelines as a graph in the dot or mermaid format
+func (a *AdminClient) Topology(ctx context.Context, format string) (string, error) {
+	b := &strings.Builder{}
+	err := a.do(ctx, http.MethodGet, "/topology", url.Values{"format": {format}}, b)
+	return b.String(), err
+}
+
+//DebugChannels returns the channels being debugged and when debugging each ends
+func (a *AdminClient) DebugChannels(ctx context.Context) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodGet, "/debug", nil)
+}
+
+//EnableDebug enables rate limited debug logging for a channel for a duration, returning the channels being debugged
+func (a *AdminClient) EnableDebug(ctx context.Context, channel string, d time.Duration) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodPost, "/debug", url.Values{"channel": {channel}, "for": {d.String()}})
+}
+
+//DisableDebug disables debug logging for a channel, returning the channels still being debugged
+func (a *AdminClient) DisableDebug(ctx context.Context, channel string) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodDelete, "/debug", url.Values{"channel": {channel}})
+}
+
+//Paused returns the paused channels and when each pause ends
+func (a *AdminClient) Paused(ctx context.Context) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodGet, "/pause", nil)
+}
+
+//Pause holds back a channel's notifications for a duration, returning the paused channels
+func (a *AdminClient) Pause(ctx context.Context, channel string, d time.Duration) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodPost, "/pause", url.Values{"channel": {channel}, "for": {d.String()}})
+}
+
+//Resume resumes a paused channel, returning the channels still paused
+func (a *AdminClient) Resume(ctx context.Context, channel string) (map[string]time.Time, error) {
+	return a.channelTimes(ctx, http.MethodDelete, "/pause", url.Values{"channel": {channel}})
+}
+
+func (a *AdminClient) channelTimes(ctx context.Context, method, path string, query url.Values) (map[string]time.Time, error) {
+	channels := map[string]time.Time{}
+	err := a.do(ctx, method, path, query, &channels)
+	return channels, err
+}
+
+//Promote promotes a standby client to active, returning its Member
+func (a *AdminClient) Promote(ctx context.Context) (Member, error) {
+	var member Member
+	err := a.do(ctx, http.MethodPost, "/promote", nil, &member)
+	return member, err
+}
+
+//DeadLetters returns the dead letters matching a filter, oldest first. A zero Limit returns the server's default of 100
+func (a *AdminClient) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := a.do(ctx, http.MethodGet, "/deadletters", deadLetterQuery(filter), &letters)
+	return letters, err
+}
+
+//EditDeadLetter replaces a dead letter's payload, returning the edited dead letter
+func (a *AdminClient) EditDeadLetter(ctx context.Context, id int64, payload string) (DeadLetter, error) {
+	var letter DeadLetter
+	err := a.send(ctx, http.MethodPut, "/deadletters", deadLetterQuery(DeadLetterFilter{IDs: []int64{id}}), strings.NewReader(payload), &letter)
+	return letter, err
+}
+
+//DeleteDeadLetters discards the dead letters matching a filter, or every dead letter if it is zero, returning the number discarded
+func (a *AdminClient) DeleteDeadLetters(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+	var deleted struct {
+		Deleted int64 `json:"deleted"`
+	}
+	err := a.do(ctx, http.MethodDelete, "/deadletters", deadLetterQuery(filter), &deleted)
+	return deleted.Deleted, err
+}
+
+//Requeue runs the dead letters matching a filter, or every dead letter if it is zero, through the client's handlers again
+func (a *AdminClient) Requeue(ctx context.Context, filter DeadLetterFilter) (RequeueResult, error) {
+	var result RequeueResult
+	err := a.do(ctx, http.MethodPost, "/deadletters/requeue", deadLetterQuery(filter), &result)
+	return result, err
+}
+
+func deadLetterQuery(filter DeadLetterFilter) url.Values {
+	query := url.Values{}
+	for _, id := range filter.IDs {
+		query.Add("id", strconv.FormatInt(id, 10))
+	}
+	if filter.Channel != "" {
+		query.Set("channel", filter.Channel)
+	}
+	if filter.Handler != "" {
+		query.Set("handler", filter.Handler)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	if filter.IsZero() {
+		query.Set("all", "true")
+	}
+	return query
+}
@@ -0,0 +1,179 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminClient(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{InstanceID: "a"}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer srv.Close()
+	admin := pqstream.NewAdminClient(srv.URL)
+	ctx := context.Background()
+
+	client.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+	stats, err := admin.Stats(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Member.InstanceID != "a" || stats.Channels["users"].Received != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	effective, err := admin.Config(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if effective.InstanceID != "a" {
+		t.Fatalf("unexpected config: %+v", effective)
+	}
+	if _, err := admin.Listeners(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	records, err := admin.Tap(ctx, "users", 1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 0 {
+		t.Fatalf("expected no records, got: %v", records)
+	}
+	graph, err := admin.Topology(ctx, "mermaid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(graph, "users") {
+		t.Fatalf("expected the topology to include the channel, got: %s", graph)
+	}
+	if _, err := admin.Topology(ctx, "svg"); err == nil || !strings.Contains(err.Error(), "invalid format") {
+		t.Fatalf("expected an invalid format error, got: %v", err)
+	}
+	if _, err := admin.Capabilities(ctx); err == nil {
+		t.Fatal("expected an error from a client that isn't connected")
+	}
+
+	paused, err := admin.Pause(ctx, "users", time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := paused["users"]; !ok {
+		t.Fatalf("expected the channel to be paused, got: %v", paused)
+	}
+	if paused, err = admin.Resume(ctx, "users"); err != nil || len(paused) != 0 {
+		t.Fatalf("expected the channel to be resumed, got: %v %v", paused, err)
+	}
+	debugging, err := admin.EnableDebug(ctx, "users", time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := debugging["users"]; !ok {
+		t.Fatalf("expected the channel to be debugged, got: %v", debugging)
+	}
+	if debugging, err = admin.DisableDebug(ctx, "users"); err != nil || len(debugging) != 0 {
+		t.Fatalf("expected debugging to be disabled, got: %v %v", debugging, err)
+	}
+	if _, err := admin.Promote(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(pqstream.OpenAPI, &spec); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("unexpected openapi version: %s", spec.OpenAPI)
+	}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin})
+	//every operation in the definition is served by the handler
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			req := httptest.NewRequest(strings.ToUpper(method), path+"?channel=users&timeout=1ms", nil)
+			req.Header.Set(pqstream.AdminHeader, "1")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code == http.StatusNotFound || w.Code == http.StatusMethodNotAllowed {
+				t.Fatalf("%s %s isn't served, got: %d", method, path, w.Code)
+			}
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Body.String() != string(pqstream.OpenAPI) {
+		t.Fatal("expected the handler to serve the definition")
+	}
+}
+
+func TestAdminHandlerAuthorize(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	authorize := func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+	for _, test := range []struct {
+		name   string
+		opts   pqstream.AdminOptions
+		method string
+		header map[string]string
+		code   int
+	}{
+		{name: "no authorize", method: http.MethodGet, code: http.StatusForbidden},
+		{name: "unauthorized", opts: pqstream.AdminOptions{Authorize: authorize}, method: http.MethodGet, code: http.StatusForbidden},
+		{name: "authorized", opts: pqstream.AdminOptions{Authorize: authorize}, method: http.MethodGet, header: map[string]string{"Authorization": "Bearer secret"}, code: http.StatusOK},
+		{name: "simple mutation", opts: pqstream.AdminOptions{Authorize: authorize}, method: http.MethodPost, header: map[string]string{"Authorization": "Bearer secret"}, code: http.StatusForbidden},
+		{name: "mutation", opts: pqstream.AdminOptions{Authorize: authorize}, method: http.MethodPost, header: map[string]string{"Authorization": "Bearer secret", pqstream.AdminHeader: "1"}, code: http.StatusOK},
+		{name: "other origin", opts: pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}, method: http.MethodGet, header: map[string]string{"Origin": "https://evil.example.com"}, code: http.StatusForbidden},
+		{name: "allowed origin", opts: pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin, Origins: []string{"https://ops.example.com"}}, method: http.MethodGet, header: map[string]string{"Origin": "https://ops.example.com"}, code: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/pause?channel=users&for=1m", nil)
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			pqstream.AdminHandler(client, test.opts).ServeHTTP(w, req)
+			if w.Code != test.code {
+				t.Fatalf("expected %d, got %d: %s", test.code, w.Code, w.Body.String())
+			}
+		})
+	}
+	srv := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: authorize}))
+	defer srv.Close()
+	admin := pqstream.NewAdminClient(srv.URL)
+	admin.Header = http.Header{"Authorization": {"Bearer secret"}}
+	if _, err := admin.Resume(context.Background(), "users"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,207 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+//An Aggregate is a Handler maintaining per group counts and sums of a source table in a summary table, applying each change event as a delta:
+//inserts add a row to their group, deletes remove one and updates move the old row's contribution to the new one, which requires the event to carry the old row.
+//The summary table has a column named after each GroupBy column, with a unique constraint over them, plus CountColumn and a numeric column per sum.
+//Deltas can drift from the source when events are lost or replayed, so Run periodically reconciles the summary table with the source
+type Aggregate struct {
+	DB Execer
+	//Source is the optionally schema qualified source table. Change events are matched against it or its bare table name
+	Source string
+	//Table is the optionally schema qualified summary table
+	Table string
+	//GroupBy is the source columns rows are grouped by
+	GroupBy []string
+	//CountColumn is the summary column counting each group's rows. Defaults to count
+	CountColumn string
+	//Sums maps a summary column to the source column it sums
+	Sums map[string]string
+	//Interval is how often Run reconciles the summary table. Defaults to 1h
+	Interval time.Duration
+	//Clock is the source of time for reconciliation. Defaults to SystemClock
+	Clock Clock
+}
+
+func (a *Aggregate) countColumn() string {
+	if a.CountColumn == "" {
+		return "count"
+	}
+	return a.CountColumn
+}
+
+func (a *Aggregate) validate() error {
+	if a.DB == nil {
+		return errors.New("aggregate requires a db")
+	}
+	if a.Source == "" || a.Table == "" || len(a.GroupBy) == 0 {
+		return errors.New("aggregate requires a source, table and group")
+	}
+	return nil
+}
+
+//Name returns the handler's name
+func (a *Aggregate) Name() string {
+	return "aggregate:" + a.Table
+}
+
+//Process applies a change event to the summary table
+func (a *Aggregate) Process(notification *pq.Notification) error {
+	return a.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext applies a change event to the summary table. Payloads that aren't change events, events of other tables and updates that change neither a group nor a summed column are ignored
+func (a *Aggregate) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	e, err := ParseChange(notification)
+	if err != nil || (e.Table != a.Source && e.QualifiedTable() != a.Source) {
+		return nil
+	}
+	source := append(append([]string{}, a.GroupBy...), a.sumColumns()...)
+	if e.Op == OpUpdate && !e.Changed(source...) {
+		return nil
+	}
+	if skipDryRun(ctx, a.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if e.Op == OpUpdate && e.Old == nil {
+		return fmt.Errorf("aggregate %s requires the old row of updates", a.Table)
+	}
+	if e.Op != OpInsert && e.Old != nil {
+		if err := a.apply(ctx, e.Old, -1); err != nil {
+			return err
+		}
+	}
+	if e.Op != OpDelete && e.New != nil {
+		return a.apply(ctx, e.New, 1)
+	}
+	return nil
+}
+
+func (a *Aggregate) sumColumns() []string {
+	columns := make([]string, 0, len(a.Sums))
+	for _, target := range sortedKeys(a.Sums) {
+		columns = append(columns, a.Sums[target])
+	}
+	return columns
+}
+
+//apply adds a row's contribution to its group, or subtracts it when sign is negative
+func (a *Aggregate) apply(ctx context.Context, row Row, sign int) error {
+	var (
+		columns, placeholders, set []string
+		args                       []interface{}
+	)
+	add := func(column, placeholder string, arg interface{}) {
+		args = append(args, arg)
+		columns = append(columns, pq.QuoteIdentifier(column))
+		placeholders = append(placeholders, fmt.Sprintf(placeholder, len(args)))
+	}
+	for _, column := range a.GroupBy {
+		add(column, "$%d", sqlArg(row[column]))
+	}
+	table := quoteQualified(a.Table)
+	negate := ""
+	if sign < 0 {
+		negate = "-"
+	}
+	add(a.countColumn(), "$%d::bigint", sign)
+	set = append(set, fmt.Sprintf("%s = %s.%s + EXCLUDED.%s", columns[len(columns)-1], table, columns[len(columns)-1], columns[len(columns)-1]))
+	for _, target := range sortedKeys(a.Sums) {
+		var value interface{} = "0"
+		if v := sqlArg(row[a.Sums[target]]); v != nil {
+			value = v
+		}
+		add(target, negate+"$%d::numeric", value)
+		quoted := pq.QuoteIdentifier(target)
+		set = append(set, fmt.Sprintf("%s = %s.%s + EXCLUDED.%s", quoted, table, quoted, quoted))
+	}
+	group := make([]string, len(a.GroupBy))
+	for i, column := range a.GroupBy {
+		group[i] = pq.QuoteIdentifier(column)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		table, strings.Join(columns, ", "), strings.Join(placeholders, ", "), strings.Join(group, ", "), strings.Join(set, ", "))
+	if _, err := a.DB.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to update aggregate %s! %s", a.Table, err.Error())
+	}
+	return nil
+}
+
+//Reconcile recomputes every group from the source table, overwriting drifted groups and deleting those without source rows.
+//Events processed while it runs that were already committed when it read the source are counted twice until the next reconciliation
+func (a *Aggregate) Reconcile(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if err := a.validate(); err != nil {
+		return err
+	}
+	table, source := quoteQualified(a.Table), quoteQualified(a.Source)
+	group := make([]string, len(a.GroupBy))
+	matches := make([]string, len(a.GroupBy))
+	for i, column := range a.GroupBy {
+		group[i] = pq.QuoteIdentifier(column)
+		matches[i] = fmt.Sprintf("s.%s IS NOT DISTINCT FROM a.%s", group[i], group[i])
+	}
+	columns := append(append([]string{}, group...), pq.QuoteIdentifier(a.countColumn()))
+	selects := append(append([]string{}, group...), "count(*)")
+	set := []string{fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(a.countColumn()), pq.QuoteIdentifier(a.countColumn()))}
+	for _, target := range sortedKeys(a.Sums) {
+		quoted := pq.QuoteIdentifier(target)
+		columns = append(columns, quoted)
+		selects = append(selects, fmt.Sprintf("coalesce(sum(%s), 0)", pq.QuoteIdentifier(a.Sums[target])))
+		set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s GROUP BY %s ON CONFLICT (%s) DO UPDATE SET %s",
+		table, strings.Join(columns, ", "), strings.Join(selects, ", "), source, strings.Join(group, ", "), strings.Join(group, ", "), strings.Join(set, ", "))
+	if _, err := a.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to reconcile aggregate %s! %s", a.Table, err.Error())
+	}
+	query = fmt.Sprintf("DELETE FROM %s a WHERE NOT EXISTS (SELECT 1 FROM %s s WHERE %s)", table, source, strings.Join(matches, " AND "))
+	if _, err := a.DB.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to delete empty groups of aggregate %s! %s", a.Table, err.Error())
+	}
+	return nil
+}
+
+//Run reconciles the summary table every Interval until the context is done, reporting failures to the client's ErrorHandler
+func (a *Aggregate) Run(ctx context.Context, c *Client) error {
+	if err := checkReadOnly(ctx, c); err != nil {
+		return err
+	}
+	if err := a.validate(); err != nil {
+		return err
+	}
+	interval := a.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	clock := clockOr(a.Clock)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+		}
+		if err := a.Reconcile(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.handlers.ErrorHandler(err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	db := &execRecorder{}
+	aggregate := &pqstream.Aggregate{
+		DB:      db,
+		Source:  "orders",
+		Table:   "order_totals",
+		GroupBy: []string{"customer_id"},
+		Sums:    map[string]string{"total": "amount"},
+	}
+	for _, payload := range []string{
+		`{"table": "orders", "op": "INSERT", "new": {"id": 1, "customer_id": 7, "amount": 10.5}}`,
+		`{"table": "orders", "op": "UPDATE", "old": {"id": 1, "customer_id": 7, "amount": 10.5, "note": "a"}, "new": {"id": 1, "customer_id": 7, "amount": 10.5, "note": "b"}}`,
+		`{"table": "orders", "op": "UPDATE", "old": {"id": 1, "customer_id": 7, "amount": 10.5}, "new": {"id": 1, "customer_id": 8, "amount": 10.5}}`,
+		`{"table": "orders", "op": "DELETE", "old": {"id": 1, "customer_id": 8}}`,
+		`{"table": "customers", "op": "INSERT", "new": {"id": 7}}`,
+	} {
+		if err := aggregate.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(db.queries) != 4 {
+		t.Fatalf("unexpected queries: %v", db.queries)
+	}
+	want := `INSERT INTO "order_totals" ("customer_id", "count", "total") VALUES ($1, $2::bigint, $3::numeric) ON CONFLICT ("customer_id") DO UPDATE SET "count" = "order_totals"."count" + EXCLUDED."count", "total" = "order_totals"."total" + EXCLUDED."total"`
+	if db.queries[0] != want || db.queries[2] != want {
+		t.Fatalf("unexpected increment: %s", db.queries[0])
+	}
+	if !strings.Contains(db.queries[1], "-$3::numeric") {
+		t.Fatalf("unexpected decrement: %s", db.queries[1])
+	}
+	for i, want := range [][]interface{}{{"7", 1, "10.5"}, {"7", -1, "10.5"}, {"8", 1, "10.5"}, {"8", -1, "0"}} {
+		for j := range want {
+			if db.args[i][j] != want[j] {
+				t.Fatalf("unexpected args %d: %v", i, db.args[i])
+			}
+		}
+	}
+	if err := aggregate.Process(&pq.Notification{Extra: `{"table": "orders", "op": "UPDATE", "new": {"id": 1, "customer_id": 9}}`}); err == nil {
+		t.Fatal("expected an error for an update without its old row")
+	}
+}
+
+func TestAggregateReconcile(t *testing.T) {
+	db := &execRecorder{}
+	aggregate := &pqstream.Aggregate{
+		DB:      db,
+		Source:  "public.orders",
+		Table:   "order_totals",
+		GroupBy: []string{"customer_id"},
+		Sums:    map[string]string{"total": "amount"},
+	}
+	if err := aggregate.Reconcile(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := []string{
+		`INSERT INTO "order_totals" ("customer_id", "count", "total") SELECT "customer_id", count(*), coalesce(sum("amount"), 0) FROM "public"."orders" GROUP BY "customer_id" ON CONFLICT ("customer_id") DO UPDATE SET "count" = EXCLUDED."count", "total" = EXCLUDED."total"`,
+		`DELETE FROM "order_totals" a WHERE NOT EXISTS (SELECT 1 FROM "public"."orders" s WHERE s."customer_id" IS NOT DISTINCT FROM a."customer_id")`,
+	}
+	if len(db.queries) != 2 || db.queries[0] != want[0] || db.queries[1] != want[1] {
+		t.Fatalf("unexpected queries: %v", db.queries)
+	}
+}
@@ -0,0 +1,119 @@
+package pqstream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//defaultAliasDedupSize is the number of recent notifications per aliased channel remembered for deduplication when Config.AliasDedupSize is unset
+const defaultAliasDedupSize = 10000
+
+//aliases maps the alternate names of a channel to the logical channel its handlers see, and drops a notification already received under another of its names,
+//ie: while a producer mid-rename sends each event on both its old and new channel
+type aliases struct {
+	logical map[string]string
+	size    int
+	mu      sync.Mutex
+	recent  map[string]*aliasWindow
+}
+
+//aliasWindow is a logical channel's recently received notifications, keyed by envelope ID or payload hash, with the name each arrived on
+type aliasWindow struct {
+	names map[string]string
+	order []string
+}
+
+func newAliases(channels map[string][]string, size int) *aliases {
+	if size <= 0 {
+		size = defaultAliasDedupSize
+	}
+	a := &aliases{logical: map[string]string{}, size: size, recent: map[string]*aliasWindow{}}
+	for channel, names := range channels {
+		for _, name := range names {
+			if name != channel {
+				a.logical[name] = channel
+			}
+		}
+		a.recent[channel] = &aliasWindow{names: map[string]string{}}
+	}
+	return a
+}
+
+//names returns the channels along with every alias of them, in order and without repeats
+func (a *aliases) names(channels []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for _, ch := range channels {
+		add(ch)
+	}
+	for _, ch := range channels {
+		for _, name := range sortedKeys(a.logical) {
+			if a.logical[name] == ch {
+				add(name)
+			}
+		}
+	}
+	return out
+}
+
+//resolve returns the notification under its logical channel, or false if it duplicates one received under another name of the same channel
+func (a *aliases) resolve(n *pq.Notification) (*pq.Notification, bool) {
+	received := n.Channel
+	channel, aliased := a.logical[received]
+	if !aliased {
+		channel = received
+	}
+	a.mu.Lock()
+	window, ok := a.recent[channel]
+	if !ok {
+		a.mu.Unlock()
+		return n, true
+	}
+	key := aliasKey(n)
+	if name, seen := window.names[key]; seen && name != received {
+		window.forget(key)
+		a.mu.Unlock()
+		return nil, false
+	}
+	if _, seen := window.names[key]; !seen {
+		if len(window.order) >= a.size {
+			delete(window.names, window.order[0])
+			window.order = window.order[1:]
+		}
+		window.order = append(window.order, key)
+	}
+	window.names[key] = received
+	a.mu.Unlock()
+	if !aliased {
+		return n, true
+	}
+	return &pq.Notification{BePid: n.BePid, Channel: channel, Extra: n.Extra}, true
+}
+
+//forget drops a key from the window, so a stale entry is neither evicted later in place of a newer one nor counted against its size
+func (w *aliasWindow) forget(key string) {
+	delete(w.names, key)
+	for i, k := range w.order {
+		if k == key {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			return
+		}
+	}
+}
+
+//aliasKey identifies a notification across channel names by its envelope ID, or the hash of its payload if it has none
+func aliasKey(n *pq.Notification) string {
+	if e := envelopeOf(n); e != nil && e.ID != "" {
+		return "id:" + e.ID
+	}
+	sum := sha256.Sum256([]byte(n.Extra))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAliases(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, n.Channel+"="+n.Extra)
+		return nil
+	})
+	c, err := NewClient([]string{"orders"}, &Config{Aliases: map[string][]string{"orders": {"orders_v1", "orders"}}}, &HandlerSet{Handlers: []Handler{handler}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if names := c.aliases.names(c.channels); strings.Join(names, ",") != "orders,orders_v1" {
+		t.Fatalf("unexpected listened channels: %v", names)
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	for _, n := range []*pq.Notification{
+		{Channel: "orders_v1", Extra: `{"id":"1"}`},
+		{Channel: "orders", Extra: `{"id":"1"}`},
+		{Channel: "orders", Extra: "a"},
+		{Channel: "orders", Extra: "a"},
+		{Channel: "orders_v1", Extra: "b"},
+	} {
+		notify <- n
+	}
+	close(notify)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch didn't return")
+	}
+	if got := strings.Join(seen, " "); got != `orders={"id":"1"} orders=a orders=a orders=b` {
+		t.Fatalf("unexpected notifications: %s", got)
+	}
+}
+
+func TestAliasesForgetDuplicates(t *testing.T) {
+	a := newAliases(map[string][]string{"orders": {"orders_v1"}}, 2)
+	for i, test := range []struct {
+		channel string
+		extra   string
+		fresh   bool
+	}{
+		{channel: "orders_v1", extra: "a", fresh: true},
+		{channel: "orders", extra: "a"},
+		{channel: "orders_v1", extra: "a", fresh: true},
+		{channel: "orders_v1", extra: "b", fresh: true},
+		{channel: "orders", extra: "a"},
+	} {
+		if _, fresh := a.resolve(&pq.Notification{Channel: test.channel, Extra: test.extra}); fresh != test.fresh {
+			t.Fatalf("notification %d: expected fresh to be %v", i, test.fresh)
+		}
+	}
+	if window := a.recent["orders"]; len(window.order) != len(window.names) {
+		t.Fatalf("expected the window's order to match its names, got %v and %v", window.order, window.names)
+	}
+}
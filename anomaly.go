@@ -0,0 +1,160 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//AnomalyKind is the way a channel's event rate departed from its baseline
+type AnomalyKind string
+
+const (
+	//AnomalySpike is reported when a channel's rate jumps well above its baseline, ie: a runaway producer
+	AnomalySpike AnomalyKind = "spike"
+	//AnomalySilence is reported when a channel with a steady baseline receives nothing, ie: a broken trigger
+	AnomalySilence AnomalyKind = "silence"
+)
+
+//An Anomaly is an interval in which a channel's event count departed from its baseline
+type Anomaly struct {
+	Channel  string      `json:"channel"`
+	Kind     AnomalyKind `json:"kind"`
+	Count    uint64      `json:"count"`
+	Baseline float64     `json:"baseline"`
+	At       time.Time   `json:"at"`
+}
+
+//A RateDetector is a Handler that tracks each channel's event count per interval as an exponentially weighted moving average, and calls OnAnomaly
+//when an interval spikes above or falls silent against that baseline
+type RateDetector struct {
+	//Interval is the length of each counting interval. Defaults to 10s
+	Interval time.Duration
+	//Alpha is the weight of the latest interval in the moving average. Defaults to 0.3
+	Alpha float64
+	//SpikeFactor is how many times the baseline an interval's count must exceed to be a spike. Defaults to 3
+	SpikeFactor float64
+	//MinBaseline is the baseline below which a channel is too quiet for spikes or silence to be reported. Defaults to 1
+	MinBaseline float64
+	//Warmup is the number of intervals observed before anomalies are reported. Defaults to 3
+	Warmup int
+	//OnAnomaly is called with every anomaly detected
+	OnAnomaly func(a Anomaly)
+	//Clock is the source of time for intervals. Defaults to SystemClock
+	Clock Clock
+
+	mu       sync.Mutex
+	channels map[string]*channelRate
+}
+
+type channelRate struct {
+	count     uint64
+	baseline  float64
+	intervals int
+}
+
+//Name returns the handler's name
+func (d *RateDetector) Name() string {
+	return "rate_detector"
+}
+
+//Process counts a notification against its channel's current interval
+func (d *RateDetector) Process(notification *pq.Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rate(notification.Channel).count++
+	return nil
+}
+
+//Watch tracks a channel before its first notification, so it can be reported silent if it never receives one
+func (d *RateDetector) Watch(channels ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ch := range channels {
+		d.rate(ch)
+	}
+}
+
+//Baselines returns each channel's moving average count per interval
+func (d *RateDetector) Baselines() map[string]float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]float64, len(d.channels))
+	for ch, r := range d.channels {
+		out[ch] = r.baseline
+	}
+	return out
+}
+
+//Run closes an interval every Interval until the context is done
+func (d *RateDetector) Run(ctx context.Context) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	clock := clockOr(d.Clock)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+			d.Tick()
+		}
+	}
+}
+
+//Tick closes the current interval: each channel's count is checked against its baseline, then folded into it
+func (d *RateDetector) Tick() {
+	alpha, factor, min, warmup := d.Alpha, d.SpikeFactor, d.MinBaseline, d.Warmup
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+	if factor <= 1 {
+		factor = 3
+	}
+	if min <= 0 {
+		min = 1
+	}
+	if warmup <= 0 {
+		warmup = 3
+	}
+	now := clockOr(d.Clock).Now()
+	var anomalies []Anomaly
+	d.mu.Lock()
+	for ch, r := range d.channels {
+		if r.intervals >= warmup && r.baseline >= min {
+			switch {
+			case r.count == 0:
+				anomalies = append(anomalies, Anomaly{Channel: ch, Kind: AnomalySilence, Baseline: r.baseline, At: now})
+			case float64(r.count) > factor*r.baseline:
+				anomalies = append(anomalies, Anomaly{Channel: ch, Kind: AnomalySpike, Count: r.count, Baseline: r.baseline, At: now})
+			}
+		}
+		if r.intervals == 0 {
+			r.baseline = float64(r.count)
+		} else {
+			r.baseline = alpha*float64(r.count) + (1-alpha)*r.baseline
+		}
+		r.intervals++
+		r.count = 0
+	}
+	d.mu.Unlock()
+	if d.OnAnomaly != nil {
+		for _, a := range anomalies {
+			d.OnAnomaly(a)
+		}
+	}
+}
+
+func (d *RateDetector) rate(channel string) *channelRate {
+	if d.channels == nil {
+		d.channels = map[string]*channelRate{}
+	}
+	r, ok := d.channels[channel]
+	if !ok {
+		r = &channelRate{}
+		d.channels[channel] = r
+	}
+	return r
+}
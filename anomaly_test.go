@@ -0,0 +1,43 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestRateDetector(t *testing.T) {
+	var anomalies []pqstream.Anomaly
+	d := &pqstream.RateDetector{OnAnomaly: func(a pqstream.Anomaly) {
+		anomalies = append(anomalies, a)
+	}}
+	d.Watch("users", "orders")
+	send := func(channel string, n int) {
+		for i := 0; i < n; i++ {
+			d.Process(&pq.Notification{Channel: channel})
+		}
+	}
+	for i := 0; i < 5; i++ {
+		send("users", 10)
+		send("orders", 10)
+		d.Tick()
+	}
+	if len(anomalies) != 0 {
+		t.Fatalf("expected a steady rate not to be anomalous, got: %+v", anomalies)
+	}
+	send("users", 100)
+	d.Tick()
+	if len(anomalies) != 2 {
+		t.Fatalf("expected a spike and a silence, got: %+v", anomalies)
+	}
+	kinds := map[string]pqstream.AnomalyKind{}
+	for _, a := range anomalies {
+		kinds[a.Channel] = a.Kind
+	}
+	if kinds["users"] != pqstream.AnomalySpike || kinds["orders"] != pqstream.AnomalySilence {
+		t.Fatalf("unexpected anomalies: %+v", anomalies)
+	}
+	if b := d.Baselines()["users"]; b <= 10 {
+		t.Fatalf("expected the spike to raise the baseline, got %f", b)
+	}
+}
@@ -0,0 +1,427 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//StreamState is the declarative description of a database's streaming setup, ie: checked into git as streams.yaml and reconciled by a Reconciler on every deploy.
+//Channels have no state of their own in postgres, so they are declared by the triggers notifying them
+//
+//	triggers:
+//	  - table: public.users
+//	    channel: users
+//	    operations: [INSERT, UPDATE]
+//	outboxes:
+//	  - table: pqstream_outbox
+type StreamState struct {
+	Triggers []TriggerSpec `json:"triggers,omitempty"`
+	Outboxes []OutboxSpec  `json:"outboxes,omitempty"`
+}
+
+//ParseStreamState decodes a stream state written in YAML or JSON, rejecting unknown fields so typos fail loudly
+func ParseStreamState(data []byte) (*StreamState, error) {
+	encoded, err := yamlToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stream state! %s", err.Error())
+	}
+	dec := json.NewDecoder(strings.NewReader(string(encoded)))
+	dec.DisallowUnknownFields()
+	state := &StreamState{}
+	if err := dec.Decode(state); err != nil {
+		return nil, fmt.Errorf("failed to parse stream state! %s", err.Error())
+	}
+	return state, nil
+}
+
+//An OutboxSpec declares an outbox table, with the checkpoint table its consumers record their positions in and the counters assigning its positions, see Outbox
+type OutboxSpec struct {
+	//Table is the optionally schema qualified outbox table. Defaults to pqstream_outbox
+	Table string `json:"table,omitempty"`
+	//CheckpointTable defaults to pqstream_checkpoints
+	CheckpointTable string `json:"checkpoint_table,omitempty"`
+	//SequenceTable defaults to pqstream_sequences
+	SequenceTable string `json:"sequence_table,omitempty"`
+}
+
+func (s OutboxSpec) options() MigrationOptions {
+	return MigrationOptions{OutboxTable: s.Table, CheckpointTable: s.CheckpointTable, SequenceTable: s.SequenceTable}
+}
+
+func (s OutboxSpec) migration() Migration {
+	for _, m := range Migrations(s.options()) {
+		if m.Name == "pqstream_outbox" {
+			return m
+		}
+	}
+	panic("pqstream_outbox migration is missing")
+}
+
+//Up returns the SQL creating the outbox, its checkpoint table and the counter table its trigger assigns positions from
+func (s OutboxSpec) Up() string {
+	seq := s.options().sequenceTable()
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	channel text PRIMARY KEY,
+	seq bigint NOT NULL
+);
+%s`, quoteQualified(seq), s.migration().Up)
+}
+
+//Down returns the SQL dropping the outbox, with every row in it, and its trigger function. The checkpoint and counter tables are kept, since other
+//outboxes and durable consumers share them
+func (s OutboxSpec) Down() string {
+	outbox, notify := s.options().outbox()
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;\nDROP FUNCTION IF EXISTS %s()", quoteQualified(outbox), quoteQualified(notify))
+}
+
+//PlanAction is what a Reconciler does to a resource
+type PlanAction string
+
+const (
+	//PlanCreate installs a resource missing from the database
+	PlanCreate PlanAction = "create"
+	//PlanUpdate replaces a resource whose declaration changed
+	PlanUpdate PlanAction = "update"
+	//PlanDrop removes a resource the Reconciler installed that is no longer declared
+	PlanDrop PlanAction = "drop"
+)
+
+//A PlanChange is a single change a Reconciler makes, with its reason and the SQL it runs
+type PlanChange struct {
+	Action PlanAction `json:"action"`
+	//Kind is trigger or outbox
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	SQL    string `json:"sql"`
+}
+
+//A Plan is the changes reconciling a database with a StreamState, in the order they are made: drops first, then outboxes before the triggers
+type Plan []PlanChange
+
+//String renders the plan for review, one change per line, followed by a summary
+func (p Plan) String() string {
+	if len(p) == 0 {
+		return "No changes. The database matches the state.\n"
+	}
+	signs := map[PlanAction]string{PlanCreate: "+", PlanUpdate: "~", PlanDrop: "-"}
+	counts := map[PlanAction]int{}
+	b := &strings.Builder{}
+	for _, change := range p {
+		counts[change.Action]++
+		fmt.Fprintf(b, "%s %s %s %s (%s)\n", signs[change.Action], change.Action, change.Kind, change.Name, change.Reason)
+	}
+	fmt.Fprintf(b, "Plan: %d to create, %d to update, %d to drop.\n", counts[PlanCreate], counts[PlanUpdate], counts[PlanDrop])
+	return b.String()
+}
+
+//A Reconciler applies a StreamState to a database, GitOps style: it plans the triggers and outboxes to create, update and drop, then applies the plan in a single transaction.
+//What it installs is recorded in a state table, so only resources it manages are ever dropped, and a recorded resource missing from the database is recreated.
+//Prune removes the orphans it doesn't manage
+type Reconciler struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified state table. Defaults to pqstream_state
+	Table string
+}
+
+func (r *Reconciler) table() string {
+	if r.Table == "" {
+		return "pqstream_state"
+	}
+	return r.Table
+}
+
+//Setup creates the state table if it doesn't exist
+func (r *Reconciler) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if r.DB == nil {
+		return errors.New("reconciler requires a db")
+	}
+	if _, err := r.DB.ExecContext(ctx, r.ddl()); err != nil {
+		return fmt.Errorf("failed to create state table! %s", err.Error())
+	}
+	return nil
+}
+
+func (r *Reconciler) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	kind text NOT NULL,
+	name text NOT NULL,
+	spec json NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (kind, name)
+)`, quoteQualified(r.table()))
+}
+
+//Plan returns the changes Apply would make, without making them
+func (r *Reconciler) Plan(ctx context.Context, state *StreamState) (Plan, error) {
+	if r.DB == nil {
+		return nil, errors.New("reconciler requires a db")
+	}
+	tx, err := r.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return r.plan(ctx, tx, state)
+}
+
+//Apply reconciles the database with the state, returning the changes it made. Either every change is made or none is
+func (r *Reconciler) Apply(ctx context.Context, state *StreamState) (Plan, error) {
+	if err := r.Setup(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	//concurrent applies, ie: from two deploys, are serialized rather than planned against the same recorded state
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", quoteQualified(r.table()))); err != nil {
+		return nil, fmt.Errorf("failed to lock state table! %s", err.Error())
+	}
+	plan, err := r.plan(ctx, tx, state)
+	if err != nil {
+		return nil, err
+	}
+	upsert := fmt.Sprintf(`INSERT INTO %s (kind, name, spec) VALUES ($1, $2, $3)
+ON CONFLICT (kind, name) DO UPDATE SET spec = EXCLUDED.spec, applied_at = now()`, quoteQualified(r.table()))
+	remove := fmt.Sprintf("DELETE FROM %s WHERE kind = $1 AND name = $2", quoteQualified(r.table()))
+	specs := state.resources()
+	for _, change := range plan {
+		if _, err := tx.ExecContext(ctx, change.SQL); err != nil {
+			return nil, fmt.Errorf("failed to %s %s %s! %s", change.Action, change.Kind, change.Name, err.Error())
+		}
+		if change.Action == PlanDrop {
+			_, err = tx.ExecContext(ctx, remove, change.Kind, change.Name)
+		} else {
+			_, err = tx.ExecContext(ctx, upsert, change.Kind, change.Name, string(specs[resourceKey{change.Kind, change.Name}].spec))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to record %s %s! %s", change.Kind, change.Name, err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+type resourceKey struct {
+	kind, name string
+}
+
+//resource is a trigger or outbox declared in a state or recorded in the state table
+type resource struct {
+	kind, name string
+	spec       []byte
+	trigger    *TriggerSpec
+	outbox     *OutboxSpec
+}
+
+func newResource(kind string, spec []byte) (resource, error) {
+	res := resource{kind: kind, spec: spec}
+	switch kind {
+	case "trigger":
+		res.trigger = &TriggerSpec{}
+		if err := json.Unmarshal(spec, res.trigger); err != nil {
+			return res, err
+		}
+		res.name = res.trigger.name() + " on " + res.trigger.Table
+	case "outbox":
+		res.outbox = &OutboxSpec{}
+		if err := json.Unmarshal(spec, res.outbox); err != nil {
+			return res, err
+		}
+		res.name, _ = res.outbox.options().outbox()
+	default:
+		return res, fmt.Errorf("unknown resource kind: %s", kind)
+	}
+	return res, nil
+}
+
+//resources returns the state's resources by kind and name
+func (s *StreamState) resources() map[resourceKey]resource {
+	resources := map[resourceKey]resource{}
+	add := func(kind string, spec any) {
+		encoded, _ := json.Marshal(spec)
+		res, _ := newResource(kind, encoded)
+		resources[resourceKey{res.kind, res.name}] = res
+	}
+	for _, spec := range s.Triggers {
+		add("trigger", spec)
+	}
+	for _, spec := range s.Outboxes {
+		add("outbox", spec)
+	}
+	return resources
+}
+
+func (s *StreamState) validate() error {
+	seen := map[resourceKey]bool{}
+	for i, spec := range s.Triggers {
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("triggers[%d]: %s", i, err.Error())
+		}
+		key := resourceKey{"trigger", spec.name() + " on " + spec.Table}
+		if seen[key] {
+			return fmt.Errorf("triggers[%d]: duplicate trigger %s", i, key.name)
+		}
+		seen[key] = true
+	}
+	for i, spec := range s.Outboxes {
+		table, _ := spec.options().outbox()
+		key := resourceKey{"outbox", table}
+		if seen[key] {
+			return fmt.Errorf("outboxes[%d]: duplicate outbox %s", i, table)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+//exists reports whether the resource's trigger or outbox table is in the database
+func (res resource) exists(ctx context.Context, tx *sql.Tx) (bool, error) {
+	var exists bool
+	var err error
+	if res.trigger != nil {
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($1) AND tgname = $2)",
+			quoteQualified(res.trigger.Table), res.trigger.name()).Scan(&exists)
+	} else {
+		table, _ := res.outbox.options().outbox()
+		err = tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", quoteQualified(table)).Scan(&exists)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s %s! %s", res.kind, res.name, err.Error())
+	}
+	return exists, nil
+}
+
+//up returns the SQL installing the resource. Triggers without a key or types fall back to their table's primary key and column types, as with EnsureTriggers
+func (res resource) up(ctx context.Context, tx *sql.Tx) (string, error) {
+	if res.outbox != nil {
+		return res.outbox.Up(), nil
+	}
+	spec := *res.trigger
+	if len(spec.Key) == 0 {
+		key, err := primaryKey(ctx, tx, spec.Table)
+		if err != nil {
+			return "", err
+		}
+		spec.Key = key
+	}
+	spec, err := spec.withTypes(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	return spec.Up(), nil
+}
+
+func (res resource) down() string {
+	if res.outbox != nil {
+		return res.outbox.Down()
+	}
+	return res.trigger.Down()
+}
+
+//recorded returns the resources in the state table, which may not exist yet
+func (r *Reconciler) recorded(ctx context.Context, tx *sql.Tx) (map[resourceKey]resource, error) {
+	recorded := map[resourceKey]resource{}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", quoteQualified(r.table())).Scan(&exists); err != nil || !exists {
+		return recorded, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT kind, name, spec::text FROM %s", quoteQualified(r.table())))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state table! %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, name, spec string
+		if err := rows.Scan(&kind, &name, &spec); err != nil {
+			return nil, err
+		}
+		res, err := newResource(kind, []byte(spec))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode recorded %s %s! %s", kind, name, err.Error())
+		}
+		res.name = name
+		recorded[resourceKey{kind, name}] = res
+	}
+	return recorded, rows.Err()
+}
+
+func (r *Reconciler) plan(ctx context.Context, tx *sql.Tx, state *StreamState) (Plan, error) {
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+	recorded, err := r.recorded(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	desired := state.resources()
+	var triggerDrops, outboxDrops, outboxes, triggers Plan
+	for _, key := range sortedResources(recorded) {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		change := PlanChange{Action: PlanDrop, Kind: key.kind, Name: key.name, Reason: "no longer declared", SQL: recorded[key].down()}
+		if key.kind == "trigger" {
+			triggerDrops = append(triggerDrops, change)
+		} else {
+			outboxDrops = append(outboxDrops, change)
+		}
+	}
+	for _, key := range sortedResources(desired) {
+		res := desired[key]
+		exists, err := res.exists(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		change := PlanChange{Kind: key.kind, Name: key.name}
+		prior, ok := recorded[key]
+		switch {
+		case !ok && exists:
+			change.Action, change.Reason = PlanUpdate, "exists but isn't managed yet"
+		case !ok:
+			change.Action, change.Reason = PlanCreate, "declared"
+		case !exists:
+			change.Action, change.Reason = PlanCreate, "missing from the database"
+		case string(prior.spec) != string(res.spec):
+			change.Action, change.Reason = PlanUpdate, "declaration changed"
+		default:
+			continue
+		}
+		if change.SQL, err = res.up(ctx, tx); err != nil {
+			return nil, err
+		}
+		if key.kind == "trigger" {
+			triggers = append(triggers, change)
+		} else {
+			outboxes = append(outboxes, change)
+		}
+	}
+	plan := append(triggerDrops, outboxDrops...)
+	return append(append(plan, outboxes...), triggers...), nil
+}
+
+func sortedResources(resources map[resourceKey]resource) []resourceKey {
+	keys := make([]resourceKey, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
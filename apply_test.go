@@ -0,0 +1,60 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"strings"
+	"testing"
+)
+
+func TestParseStreamState(t *testing.T) {
+	state, err := pqstream.ParseStreamState([]byte(`
+triggers:
+  - table: public.users
+    channel: users
+    operations: [INSERT, UPDATE]
+    payload_columns: [id, email]
+outboxes:
+  - table: ops.outbox
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(state.Triggers) != 1 || state.Triggers[0].Table != "public.users" || len(state.Triggers[0].Operations) != 2 || state.Triggers[0].Operations[1] != pqstream.OpUpdate {
+		t.Fatalf("unexpected triggers: %+v", state.Triggers)
+	}
+	if len(state.Outboxes) != 1 || state.Outboxes[0].Table != "ops.outbox" {
+		t.Fatalf("unexpected outboxes: %+v", state.Outboxes)
+	}
+	if !strings.Contains(state.Outboxes[0].Up(), `CREATE TABLE IF NOT EXISTS "ops"."outbox"`) || !strings.Contains(state.Outboxes[0].Down(), `DROP TABLE IF EXISTS "ops"."outbox"`) ||
+		strings.Contains(state.Outboxes[0].Down(), "checkpoints") {
+		t.Fatalf("unexpected outbox sql: %s", state.Outboxes[0].Up())
+	}
+
+	json, err := pqstream.ParseStreamState([]byte(`{"triggers": [{"table": "users"}]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(json.Triggers) != 1 || json.Triggers[0].Table != "users" {
+		t.Fatalf("expected a JSON state to parse, got: %+v", json)
+	}
+	if _, err := pqstream.ParseStreamState([]byte("triggers:\n  - tabel: users\n")); err == nil || !strings.Contains(err.Error(), "tabel") {
+		t.Fatalf("expected an unknown field error, got: %v", err)
+	}
+}
+
+func TestPlanString(t *testing.T) {
+	plan := pqstream.Plan{
+		{Action: pqstream.PlanDrop, Kind: "trigger", Name: "pqstream_orders_orders on orders", Reason: "no longer declared"},
+		{Action: pqstream.PlanCreate, Kind: "trigger", Name: "pqstream_users_users on users", Reason: "declared"},
+	}
+	out := plan.String()
+	if !strings.Contains(out, "- drop trigger pqstream_orders_orders on orders (no longer declared)") || !strings.Contains(out, "+ create trigger pqstream_users_users on users") {
+		t.Fatalf("unexpected plan: %s", out)
+	}
+	if !strings.Contains(out, "Plan: 1 to create, 0 to update, 1 to drop.") {
+		t.Fatalf("unexpected summary: %s", out)
+	}
+	if pqstream.Plan(nil).String() != "No changes. The database matches the state.\n" {
+		t.Fatalf("unexpected empty plan: %s", pqstream.Plan(nil))
+	}
+}
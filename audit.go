@@ -0,0 +1,206 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+//An AuditSink records every notification it receives in a table natively partitioned by day (PARTITION BY RANGE). It creates partitions ahead of time
+//and satisfies the Pruner interface by detaching and dropping partitions that fall entirely outside the retention window, so it can be registered with a Retention
+type AuditSink struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified parent table. Defaults to pqstream_audit
+	Table string
+	//PartitionDays is the number of days covered by each partition. Defaults to 1
+	PartitionDays int
+	//Premake is the number of future partitions kept ahead of the current one. Defaults to 3
+	Premake int
+	//Clock is the source of time for choosing the current partition. Defaults to SystemClock
+	Clock Clock
+	//IDs generates the id recorded for notifications that aren't enveloped with one. Enveloped notifications keep their envelope's ID. Defaults to recording none
+	IDs IDGenerator
+}
+
+//Partition is a single range partition of the audit table
+type Partition struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+//Name returns the sink's name
+func (a *AuditSink) Name() string {
+	return "audit"
+}
+
+func (a *AuditSink) table() string {
+	if a.Table == "" {
+		return "pqstream_audit"
+	}
+	return a.Table
+}
+
+func (a *AuditSink) span() time.Duration {
+	if a.PartitionDays <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(a.PartitionDays) * 24 * time.Hour
+}
+
+//Partitions returns the partitions that should exist at the given time: the current one plus Premake future ones
+func (a *AuditSink) Partitions(now time.Time) []Partition {
+	premake := a.Premake
+	if premake <= 0 {
+		premake = 3
+	}
+	span := a.span()
+	from := now.UTC().Truncate(span)
+	partitions := make([]Partition, 0, premake+1)
+	for i := 0; i <= premake; i++ {
+		partitions = append(partitions, a.partition(from))
+		from = from.Add(span)
+	}
+	return partitions
+}
+
+func (a *AuditSink) partition(from time.Time) Partition {
+	parts := strings.Split(a.table(), ".")
+	parts[len(parts)-1] = fmt.Sprintf("%s_p%s", parts[len(parts)-1], from.Format("20060102"))
+	return Partition{Name: strings.Join(parts, "."), From: from, To: from.Add(a.span())}
+}
+
+//Setup creates the partitioned parent table if it doesn't exist, then its current and future partitions
+func (a *AuditSink) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if a.DB == nil {
+		return errors.New("audit sink requires a db")
+	}
+	if _, err := a.DB.ExecContext(ctx, a.ddl()+";\n"+a.idDDL()); err != nil {
+		return fmt.Errorf("failed to create audit table! %s", err.Error())
+	}
+	return a.EnsurePartitions(ctx, clockOr(a.Clock).Now())
+}
+
+func (a *AuditSink) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	channel text NOT NULL,
+	pid integer NOT NULL,
+	payload text NOT NULL,
+	received_at timestamptz NOT NULL DEFAULT now()
+) PARTITION BY RANGE (received_at)`, quoteQualified(a.table()))
+}
+
+//idDDL adds the id column to tables created before it was recorded
+func (a *AuditSink) idDDL() string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS id text", quoteQualified(a.table()))
+}
+
+//id returns the id recorded for a notification: its envelope's ID, or one from IDs
+func (a *AuditSink) id(notification *pq.Notification) (sql.NullString, error) {
+	if e := envelopeOf(notification); e != nil && e.ID != "" {
+		return sql.NullString{String: e.ID, Valid: true}, nil
+	}
+	if a.IDs == nil {
+		return sql.NullString{}, nil
+	}
+	id, err := a.IDs.NewID()
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to generate audit id! %s", err.Error())
+	}
+	return sql.NullString{String: id, Valid: true}, nil
+}
+
+//EnsurePartitions creates any missing current and future partitions
+func (a *AuditSink) EnsurePartitions(ctx context.Context, now time.Time) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	for _, p := range a.Partitions(now) {
+		ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			quoteQualified(p.Name), quoteQualified(a.table()), p.From.Format(time.RFC3339), p.To.Format(time.RFC3339))
+		if _, err := a.DB.ExecContext(ctx, ddl); err != nil {
+			return fmt.Errorf("failed to create audit partition %s! %s", p.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+//Send records a notification
+func (a *AuditSink) Send(ctx context.Context, notification *pq.Notification) error {
+	if skipDryRun(ctx, a.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	id, err := a.id(notification)
+	if err != nil {
+		return err
+	}
+	_, err = a.DB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, channel, pid, payload) VALUES ($1, $2, $3, $4)", quoteQualified(a.table())),
+		id, notification.Channel, notification.BePid, notification.Extra)
+	return err
+}
+
+//Prune detaches and drops every partition ending at or before the cutoff, returning the number of rows they held. It also creates upcoming partitions,
+//so running it periodically through a Retention is all the maintenance the table needs
+func (a *AuditSink) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if err := a.EnsurePartitions(ctx, clockOr(a.Clock).Now()); err != nil {
+		return 0, err
+	}
+	partitions, err := a.attached(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var pruned int64
+	for _, p := range partitions {
+		if p.To.After(before) {
+			continue
+		}
+		var rows int64
+		if err := a.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s", quoteQualified(p.Name))).Scan(&rows); err != nil {
+			return pruned, err
+		}
+		if _, err := a.DB.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", quoteQualified(a.table()), quoteQualified(p.Name))); err != nil {
+			return pruned, fmt.Errorf("failed to detach audit partition %s! %s", p.Name, err.Error())
+		}
+		if _, err := a.DB.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", quoteQualified(p.Name))); err != nil {
+			return pruned, fmt.Errorf("failed to drop audit partition %s! %s", p.Name, err.Error())
+		}
+		pruned += rows
+	}
+	return pruned, nil
+}
+
+//attached lists the partitions currently attached to the audit table that follow its naming scheme
+func (a *AuditSink) attached(ctx context.Context) ([]Partition, error) {
+	rows, err := a.DB.QueryContext(ctx, `SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass`, quoteQualified(a.table()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var partitions []Partition
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		idx := strings.LastIndex(name, "_p")
+		if idx < 0 {
+			continue
+		}
+		from, err := time.Parse("20060102", name[idx+2:])
+		if err != nil {
+			continue
+		}
+		partitions = append(partitions, a.partition(from))
+	}
+	return partitions, rows.Err()
+}
@@ -0,0 +1,27 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"testing"
+	"time"
+)
+
+func TestAuditPartitions(t *testing.T) {
+	sink := &pqstream.AuditSink{Table: "ops.audit", Premake: 2}
+	now := time.Date(2020, 3, 30, 15, 4, 5, 0, time.UTC)
+	partitions := sink.Partitions(now)
+	if len(partitions) != 3 {
+		t.Fatalf("expected current and 2 future partitions, got %d", len(partitions))
+	}
+	first, last := partitions[0], partitions[2]
+	if first.Name != "ops.audit_p20200330" || !first.From.Equal(time.Date(2020, 3, 30, 0, 0, 0, 0, time.UTC)) || !first.To.Equal(partitions[1].From) {
+		t.Fatalf("unexpected first partition: %+v", first)
+	}
+	if last.Name != "ops.audit_p20200401" {
+		t.Fatalf("unexpected last partition: %+v", last)
+	}
+	weekly := &pqstream.AuditSink{PartitionDays: 7, Premake: 1}
+	if p := weekly.Partitions(now)[0]; p.Name[:len("pqstream_audit_p")] != "pqstream_audit_p" || p.To.Sub(p.From) != 7*24*time.Hour {
+		t.Fatalf("unexpected weekly partition: %+v", p)
+	}
+}
@@ -0,0 +1,156 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaultTokenLeeway is how long before its expiry a ClientCredentials token is refreshed
+const defaultTokenLeeway = 30 * time.Second
+
+//An Authenticator adds credentials to the requests of HTTP based sinks
+type Authenticator interface {
+	Authorize(ctx context.Context, req *http.Request) error
+}
+
+//An invalidator is an Authenticator with cached credentials that can be dropped after the server rejects them
+type invalidator interface {
+	Invalidate()
+}
+
+//BearerToken authenticates with a static bearer token, ie: a long lived JWT
+type BearerToken string
+
+//Authorize sets the Authorization header
+func (t BearerToken) Authorize(ctx context.Context, req *http.Request) error {
+	if t == "" {
+		return errors.New("empty bearer token")
+	}
+	req.Header.Set("Authorization", "Bearer "+string(t))
+	return nil
+}
+
+//HeaderAuth authenticates with a custom header, ie: X-Api-Key
+type HeaderAuth struct {
+	Name  string
+	Value string
+}
+
+//Authorize sets the header
+func (h HeaderAuth) Authorize(ctx context.Context, req *http.Request) error {
+	if h.Name == "" {
+		return errors.New("empty auth header name")
+	}
+	req.Header.Set(h.Name, h.Value)
+	return nil
+}
+
+//ClientCredentials authenticates with an OAuth2 access token obtained through the client credentials flow. The token is cached and refreshed shortly before it expires,
+//using the refresh token if the server issued one, and dropped when a sink's request is rejected with 401 so the next attempt fetches a new one
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	//Client sends the token requests. Defaults to a client timing out after 30s
+	Client *http.Client
+	//Clock is the source of time for token expiry. Defaults to SystemClock
+	Clock Clock
+
+	mu      sync.Mutex
+	token   string
+	refresh string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+//Authorize sets the Authorization header, fetching a token first if none is cached or it's about to expire
+func (c *ClientCredentials) Authorize(ctx context.Context, req *http.Request) error {
+	token, err := c.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+//Token returns a valid access token
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clockOr(c.Clock).Now()
+	if c.token != "" && (c.expires.IsZero() || now.Before(c.expires.Add(-defaultTokenLeeway))) {
+		return c.token, nil
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if c.refresh != "" {
+		form = url.Values{"grant_type": {"refresh_token"}, "refresh_token": {c.refresh}}
+	}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	resp, err := c.request(ctx, form)
+	if err != nil && c.refresh != "" {
+		c.refresh = ""
+		form.Set("grant_type", "client_credentials")
+		form.Del("refresh_token")
+		resp, err = c.request(ctx, form)
+	}
+	if err != nil {
+		return "", err
+	}
+	c.token, c.refresh, c.expires = resp.AccessToken, resp.RefreshToken, time.Time{}
+	if resp.ExpiresIn > 0 {
+		c.expires = now.Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return c.token, nil
+}
+
+func (c *ClientCredentials) request(ctx context.Context, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	client := c.Client
+	if client == nil {
+		client = outboundClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch access token! %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch access token! %s", resp.Status)
+	}
+	token := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("failed to decode access token! %s", err.Error())
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("failed to fetch access token! empty access_token")
+	}
+	return token, nil
+}
+
+//Invalidate drops the cached token
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
@@ -0,0 +1,79 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientCredentials(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		grants []string
+	)
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if id != "app" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		grants = append(grants, r.Form.Get("grant_type"))
+		n := len(grants)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token-` + string(rune('0'+n)) + `", "expires_in": 60, "refresh_token": "refresh"}`))
+	}))
+	defer tokens.Close()
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	creds := &pqstream.ClientCredentials{TokenURL: tokens.URL, ClientID: "app", ClientSecret: "s3cret", Scopes: []string{"events:write"}, Clock: clock}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if token, err := creds.Token(ctx); err != nil || token != "token-1" {
+			t.Fatalf("expected the cached token, got %s %v", token, err)
+		}
+	}
+	clock.Advance(31 * time.Second)
+	if token, _ := creds.Token(ctx); token != "token-2" || grants[1] != "refresh_token" {
+		t.Fatalf("expected the token to be refreshed before it expires, got %s %v", token, grants)
+	}
+
+	var authorizations []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer token-3" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer api.Close()
+	sink := &pqstream.WebhookSink{URL: api.URL, Auth: creds, Clock: clock}
+	done := make(chan error)
+	go func() { done <- sink.Send(ctx, &pq.Notification{Channel: "orders", Extra: "{}"}) }()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(authorizations) != 2 || authorizations[0] != "Bearer token-2" {
+		t.Fatalf("expected a rejected token to be replaced, got %v", authorizations)
+	}
+
+	header := &pqstream.WebhookSink{URL: api.URL, Auth: pqstream.HeaderAuth{Name: "Authorization", Value: "Bearer token-3"}}
+	if err := header.Send(ctx, &pq.Notification{Channel: "orders", Extra: "{}"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	static := &pqstream.WebhookSink{URL: api.URL, Auth: pqstream.BearerToken("stale"), Retries: -1}
+	if err := static.Send(ctx, &pq.Notification{Channel: "orders", Extra: "{}"}); err == nil {
+		t.Fatal("expected a rejected static token to fail")
+	}
+}
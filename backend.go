@@ -0,0 +1,175 @@
+package pqstream
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//A Backend is the postgres session that sent a notification, from pg_stat_activity, so consumers can attribute changes to the service that made them
+type Backend struct {
+	PID int `json:"pid"`
+	//ApplicationName is the session's application_name, ie: set by the producing service in its connection string
+	ApplicationName string `json:"application_name,omitempty"`
+	//User is the role the session is logged in as
+	User string `json:"user,omitempty"`
+	//ClientAddr is the address the session connected from, empty for unix sockets
+	ClientAddr   string    `json:"client_addr,omitempty"`
+	BackendStart time.Time `json:"backend_start"`
+}
+
+//BackendLookupFunc looks up a backend by its pid, returning nil if it no longer exists
+type BackendLookupFunc func(ctx context.Context, pid int) (*Backend, error)
+
+//A BackendResolver looks up the backend that sent each notification, by its BePid, in pg_stat_activity. Lookups are cached per pid, bounded by CacheSize
+//and TTL, since a service's pooled sessions send many notifications each. A backend that has disconnected by the time its notification is resolved,
+//ie: a short lived connection, can't be resolved. Set as Config.Backends, handlers find the backend in their context, see BackendFrom.
+//Reading other roles' sessions' application_name requires pg_read_all_stats or superuser
+type BackendResolver struct {
+	DB *sql.DB
+	//Lookup looks up backends. Defaults to selecting from pg_stat_activity in DB
+	Lookup BackendLookupFunc
+	//CacheSize is the number of backends cached. Defaults to 1024
+	CacheSize int
+	//TTL is how long a backend is cached before it is looked up again, since postgres reuses pids. Defaults to 1 minute
+	TTL time.Duration
+	//Clock is the source of time for cache expiry. Defaults to SystemClock
+	Clock Clock
+
+	once  sync.Once
+	mu    sync.Mutex
+	cache map[int]*list.Element
+	lru   *list.List
+}
+
+type cachedBackend struct {
+	pid     int
+	backend *Backend
+	expires time.Time
+}
+
+//Resolve returns the backend with a pid, or nil if it no longer exists. Missing backends are cached too, so a burst from a closed session is looked up once
+func (r *BackendResolver) Resolve(ctx context.Context, pid int) (*Backend, error) {
+	r.once.Do(func() {
+		r.cache = map[int]*list.Element{}
+		r.lru = list.New()
+	})
+	clock := clockOr(r.Clock)
+	r.mu.Lock()
+	if el, ok := r.cache[pid]; ok {
+		cached := el.Value.(*cachedBackend)
+		if clock.Now().Before(cached.expires) {
+			r.lru.MoveToFront(el)
+			r.mu.Unlock()
+			return cached.backend, nil
+		}
+		r.lru.Remove(el)
+		delete(r.cache, pid)
+	}
+	r.mu.Unlock()
+	lookup := r.Lookup
+	if lookup == nil {
+		lookup = r.lookup
+	}
+	backend, err := lookup(ctx, pid)
+	if err != nil {
+		return nil, err
+	}
+	ttl, size := r.TTL, r.CacheSize
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	if size <= 0 {
+		size = 1024
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if el, ok := r.cache[pid]; ok {
+		r.lru.Remove(el)
+	}
+	r.cache[pid] = r.lru.PushFront(&cachedBackend{pid: pid, backend: backend, expires: clock.Now().Add(ttl)})
+	for r.lru.Len() > size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cachedBackend).pid)
+	}
+	return backend, nil
+}
+
+func (r *BackendResolver) lookup(ctx context.Context, pid int) (*Backend, error) {
+	if r.DB == nil {
+		return nil, errors.New("backend resolver requires a db")
+	}
+	b := &Backend{PID: pid}
+	var user, addr sql.NullString
+	var start sql.NullTime
+	err := r.DB.QueryRowContext(ctx, `SELECT application_name, usename, host(client_addr), backend_start FROM pg_stat_activity WHERE pid = $1`, pid).
+		Scan(&b.ApplicationName, &user, &addr, &start)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up backend %d! %s", pid, err.Error())
+	}
+	b.User, b.ClientAddr, b.BackendStart = user.String, addr.String, start.Time
+	return b, nil
+}
+
+//Transform returns a pipeline transform embedding the backend of notifications whose payload is a JSON object under "backend", for sinks downstream.
+//Other payloads, and those whose backend can't be resolved, pass unchanged
+func (r *BackendResolver) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		return r.Enrich(context.Background(), notification)
+	}
+}
+
+//Enrich returns a copy of the notification with its backend embedded in its payload under "backend", as Transform does
+func (r *BackendResolver) Enrich(ctx context.Context, notification *pq.Notification) (*pq.Notification, error) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil || payload == nil {
+		return notification, nil
+	}
+	backend, err := r.Resolve(ctx, notification.BePid)
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return notification, nil
+	}
+	if payload["backend"], err = json.Marshal(backend); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(encoded)}, nil
+}
+
+type backendKey struct{}
+
+//BackendFrom returns the backend that sent the notification a handler's context is processing. It reports false unless the client has Config.Backends
+//and the backend could be resolved
+func BackendFrom(ctx context.Context) (*Backend, bool) {
+	b, ok := ctx.Value(backendKey{}).(*Backend)
+	return b, ok && b != nil
+}
+
+//withBackend resolves the notification's backend into the context. A failed lookup is reported to the error handler but doesn't hold the notification up
+func (c *Client) withBackend(ctx context.Context, n *pq.Notification) context.Context {
+	backend, err := c.config.Backends.Resolve(ctx, n.BePid)
+	if err != nil {
+		c.handlers.ErrorHandler(err)
+		return ctx
+	}
+	if backend == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, backendKey{}, backend)
+}
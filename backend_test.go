@@ -0,0 +1,81 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+	"time"
+)
+
+type backendRecorder struct {
+	backends []*pqstream.Backend
+}
+
+func (h *backendRecorder) Process(n *pq.Notification) error {
+	return h.ProcessContext(context.Background(), n)
+}
+
+func (h *backendRecorder) ProcessContext(ctx context.Context, n *pq.Notification) error {
+	backend, _ := pqstream.BackendFrom(ctx)
+	h.backends = append(h.backends, backend)
+	return nil
+}
+
+func TestBackendResolver(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	lookups := map[int]int{}
+	resolver := &pqstream.BackendResolver{
+		Clock: clock,
+		TTL:   time.Minute,
+		Lookup: func(ctx context.Context, pid int) (*pqstream.Backend, error) {
+			lookups[pid]++
+			switch pid {
+			case 42:
+				return &pqstream.Backend{PID: pid, ApplicationName: "billing", User: "billing_rw"}, nil
+			case 13:
+				return nil, errors.New("permission denied")
+			}
+			return nil, nil
+		},
+	}
+	recorder := &backendRecorder{}
+	var errs []error
+	handlers := &pqstream.HandlerSet{
+		Handlers:     []pqstream.Handler{recorder},
+		ErrorHandler: func(err error) { errs = append(errs, err) },
+	}
+	client, err := pqstream.NewClient([]string{"orders"}, &pqstream.Config{Backends: resolver, Clock: clock}, handlers)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, pid := range []int{42, 42, 7, 7, 13} {
+		client.Process(&pq.Notification{Channel: "orders", BePid: pid, Extra: `{}`})
+	}
+	got := recorder.backends
+	if len(got) != 5 || got[0] == nil || got[0].ApplicationName != "billing" || got[1] != got[0] || got[2] != nil || got[4] != nil {
+		t.Fatalf("expected handlers to see the sending backend, got: %+v", got)
+	}
+	if lookups[42] != 1 || lookups[7] != 1 {
+		t.Fatalf("expected backends, and missing ones, to be cached, got: %v", lookups)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "permission denied") {
+		t.Fatalf("expected the failed lookup to be reported without failing the notification, got: %v", errs)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := resolver.Resolve(context.Background(), 42); err != nil || lookups[42] != 2 {
+		t.Fatalf("expected an expired backend to be looked up again, got: %v %v", lookups, err)
+	}
+
+	enriched, err := resolver.Enrich(context.Background(), &pq.Notification{Channel: "orders", BePid: 42, Extra: `{"id": 1}`})
+	if err != nil || !strings.Contains(enriched.Extra, `"backend":{"pid":42,"application_name":"billing","user":"billing_rw"`) || !strings.Contains(enriched.Extra, `"id":1`) {
+		t.Fatalf("expected the backend to be embedded, got: %s %v", enriched.Extra, err)
+	}
+	for _, n := range []*pq.Notification{{BePid: 42, Extra: `plain`}, {BePid: 7, Extra: `{"id": 1}`}} {
+		if out, err := resolver.Enrich(context.Background(), n); err != nil || out != n {
+			t.Fatalf("expected %q to pass unchanged, got: %v %v", n.Extra, out, err)
+		}
+	}
+}
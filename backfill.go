@@ -0,0 +1,164 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//ErrBackfillBufferFull is returned for a live event of a key being backfilled once a BackfillCoordinator holds MaxBuffered events
+var ErrBackfillBufferFull = errors.New("backfill buffer full")
+
+//A BackfillFunc reads the current rows of keys being backfilled, as change events passed to the coordinator's handler
+type BackfillFunc func(ctx context.Context) ([]*pq.Notification, error)
+
+//A BackfillCoordinator is a Handler keeping per key order between a backfill and the live stream feeding the same handler. While a batch of keys is backfilled,
+//live change events for them are held back and only passed on after the batch's rows, so an older backfilled row never overwrites a newer live one.
+//Events of other keys and payloads that aren't change events pass straight through
+type BackfillCoordinator struct {
+	Handler Handler
+	Keys    *KeyRegistry
+	//MaxBuffered is the number of live events held back across all keys being backfilled. Defaults to 10000
+	MaxBuffered int
+
+	mu       sync.Mutex
+	claimed  map[string][]backfillEvent
+	buffered int
+}
+
+type backfillEvent struct {
+	ctx          context.Context
+	notification *pq.Notification
+}
+
+func (b *BackfillCoordinator) maxBuffered() int {
+	if b.MaxBuffered <= 0 {
+		return 10000
+	}
+	return b.MaxBuffered
+}
+
+//Name returns the handler's name
+func (b *BackfillCoordinator) Name() string {
+	return nameOf(b.Handler, "backfill", 0)
+}
+
+//Process passes a live event to the handler, or holds it back if its key is being backfilled
+func (b *BackfillCoordinator) Process(notification *pq.Notification) error {
+	return b.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext passes a live event to the handler, or holds it back if its key is being backfilled
+func (b *BackfillCoordinator) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if key, ok := b.keyOf(notification); ok {
+		b.mu.Lock()
+		if events, claimed := b.claimed[key]; claimed {
+			if b.buffered >= b.maxBuffered() {
+				b.mu.Unlock()
+				return ErrBackfillBufferFull
+			}
+			b.claimed[key] = append(events, backfillEvent{ctx: ctx, notification: notification})
+			b.buffered++
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+	}
+	return b.handle(ctx, notification)
+}
+
+//Backfill claims the keys of a table, reads their rows and passes them to the handler, then releases the keys, passing on the live events held back meanwhile.
+//Table is the bare table name and keys are formatted as KeyRegistry.Key formats them. Read runs after the keys are claimed, so every change it misses arrives as a live event after its rows
+func (b *BackfillCoordinator) Backfill(ctx context.Context, table string, keys []string, read BackfillFunc) error {
+	if b.Handler == nil || b.Keys == nil {
+		return errors.New("backfill coordinator requires a handler and key registry")
+	}
+	claimed := make([]string, len(keys))
+	for i, key := range keys {
+		claimed[i] = table + ":" + key
+	}
+	if err := b.claim(claimed); err != nil {
+		return err
+	}
+	rows, err := read(ctx)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to read backfill of %s! %s", table, err.Error()), b.release(claimed))
+	}
+	var errs []error
+	for _, row := range rows {
+		if err := b.handle(ctx, row); err != nil {
+			errs = append(errs, fmt.Errorf("failed to backfill %s! %s", table, err.Error()))
+		}
+	}
+	return errors.Join(append(errs, b.release(claimed))...)
+}
+
+//Backfilling returns the number of keys currently claimed by backfills
+func (b *BackfillCoordinator) Backfilling() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.claimed)
+}
+
+func (b *BackfillCoordinator) claim(keys []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.claimed == nil {
+		b.claimed = map[string][]backfillEvent{}
+	}
+	for _, key := range keys {
+		if _, ok := b.claimed[key]; ok {
+			return fmt.Errorf("key %s is already being backfilled", key)
+		}
+	}
+	for _, key := range keys {
+		b.claimed[key] = nil
+	}
+	return nil
+}
+
+//release passes on each key's held back events until none are left, then unclaims it. Events arriving while a key is flushed are held back until it is released
+func (b *BackfillCoordinator) release(keys []string) error {
+	var errs []error
+	for _, key := range keys {
+		for {
+			b.mu.Lock()
+			events := b.claimed[key]
+			if len(events) == 0 {
+				delete(b.claimed, key)
+				b.mu.Unlock()
+				break
+			}
+			b.claimed[key] = nil
+			b.buffered -= len(events)
+			b.mu.Unlock()
+			for _, e := range events {
+				if err := b.handle(e.ctx, e.notification); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *BackfillCoordinator) keyOf(notification *pq.Notification) (string, bool) {
+	e, err := ParseChange(notification)
+	if err != nil {
+		return "", false
+	}
+	key, err := b.Keys.Key(e)
+	if err != nil {
+		return "", false
+	}
+	return e.Table + ":" + key, true
+}
+
+func (b *BackfillCoordinator) handle(ctx context.Context, notification *pq.Notification) error {
+	if h, ok := b.Handler.(ContextHandler); ok {
+		return h.ProcessContext(ctx, notification)
+	}
+	return b.Handler.Process(notification)
+}
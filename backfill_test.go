@@ -0,0 +1,51 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestBackfillCoordinator(t *testing.T) {
+	var seen []string
+	coordinator := &pqstream.BackfillCoordinator{
+		Handler: pqstream.HandlerFunc(func(n *pq.Notification) error {
+			seen = append(seen, n.Extra)
+			return nil
+		}),
+		Keys:        pqstream.NewKeyRegistry().Register("users", "id"),
+		MaxBuffered: 1,
+	}
+	live := func(id, name string) *pq.Notification {
+		return &pq.Notification{Channel: "users", Extra: `{"table": "users", "op": "UPDATE", "new": {"id": ` + id + `, "name": "` + name + `"}}`}
+	}
+	err := coordinator.Backfill(context.Background(), "users", []string{"1"}, func(ctx context.Context) ([]*pq.Notification, error) {
+		if err := coordinator.Process(live("1", "live")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := coordinator.Process(live("1", "overflow")); err != pqstream.ErrBackfillBufferFull {
+			t.Fatalf("expected a full buffer, got: %v", err)
+		}
+		if err := coordinator.Process(live("2", "other")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if coordinator.Backfilling() != 1 {
+			t.Fatal("expected a claimed key")
+		}
+		return []*pq.Notification{{Channel: "users", Extra: `{"table": "users", "op": "INSERT", "new": {"id": 1, "name": "backfill"}}`}}, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(seen) != 3 || !strings.Contains(seen[0], "other") || !strings.Contains(seen[1], "backfill") || !strings.Contains(seen[2], "live") {
+		t.Fatalf("expected the live event after the backfilled row, got: %v", seen)
+	}
+	if coordinator.Backfilling() != 0 {
+		t.Fatal("expected the key to be released")
+	}
+	if err := coordinator.Process(live("1", "after")); err != nil || !strings.Contains(seen[3], "after") {
+		t.Fatalf("expected released keys to pass through, got: %v %v", err, seen)
+	}
+}
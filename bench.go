@@ -0,0 +1,202 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//BenchOptions configures a load generation run
+type BenchOptions struct {
+	//Channel is the channel traffic is published to and listened on. Defaults to pqstream_bench
+	Channel string
+	//Rate is the target number of notifications per second. Defaults to 1000
+	Rate int
+	//PayloadSize is the approximate size in bytes of each payload. Defaults to 256
+	PayloadSize int
+	//Duration is how long traffic is produced for. Defaults to 10 seconds
+	Duration time.Duration
+	//Handler optionally runs on every received notification so its cost is included in the measured latency
+	Handler Handler
+}
+
+//LatencySummary describes a distribution of latencies
+type LatencySummary struct {
+	Count int           `json:"count"`
+	Min   time.Duration `json:"min"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+//Summarize computes percentiles over a set of latencies
+func Summarize(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	return LatencySummary{
+		Count: len(sorted),
+		Min:   sorted[0],
+		P50:   at(0.50),
+		P90:   at(0.90),
+		P99:   at(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+//String formats the summary for a terminal
+func (l LatencySummary) String() string {
+	return fmt.Sprintf("n=%d min=%s p50=%s p90=%s p99=%s max=%s", l.Count, l.Min, l.P50, l.P90, l.P99, l.Max)
+}
+
+//BenchReport is the result of a load generation run
+type BenchReport struct {
+	Sent       int            `json:"sent"`
+	Received   int            `json:"received"`
+	Elapsed    time.Duration  `json:"elapsed"`
+	Throughput float64        `json:"throughput"`
+	Latency    LatencySummary `json:"latency"`
+}
+
+//String formats the report for a terminal
+func (b *BenchReport) String() string {
+	return fmt.Sprintf("sent=%d received=%d elapsed=%s throughput=%.1f/s latency: %s", b.Sent, b.Received, b.Elapsed, b.Throughput, b.Latency)
+}
+
+//Bench produces synthetic NOTIFY traffic at a target rate and payload size, listens for it, and reports end-to-end throughput and latency percentiles
+func Bench(ctx context.Context, config *Config, opts BenchOptions) (*BenchReport, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if opts.Channel == "" {
+		opts.Channel = "pqstream_bench"
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = 1000
+	}
+	if opts.PayloadSize <= 0 {
+		opts.PayloadSize = 256
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Second
+	}
+	db, err := sql.Open("postgres", config.ConnInfo())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open with connection info! %s", err.Error())
+	}
+	defer db.Close()
+	listener := pq.NewListener(config.ConnInfo(), 10*time.Second, time.Minute, nil)
+	defer listener.Close()
+	if err := listener.Listen(opts.Channel); err != nil {
+		return nil, fmt.Errorf("failed to listen on channel : %s! %s", opts.Channel, err.Error())
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	received := make(chan struct{}, opts.Rate)
+	listenCtx, stopListening := context.WithCancel(ctx)
+	defer stopListening()
+	go func() {
+		for {
+			select {
+			case <-listenCtx.Done():
+				return
+			case n := <-listener.Notify:
+				if n == nil {
+					continue
+				}
+				if opts.Handler != nil {
+					_ = opts.Handler.Process(n)
+				}
+				if e := envelopeOf(n); e != nil && !e.EmittedAt.IsZero() {
+					mu.Lock()
+					latencies = append(latencies, time.Since(e.EmittedAt))
+					mu.Unlock()
+				}
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	start := time.Now()
+	sent, err := produce(ctx, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(latencies)
+	}
+	drain := time.NewTimer(5 * time.Second)
+	defer drain.Stop()
+wait:
+	for count() < sent {
+		select {
+		case <-received:
+		case <-drain.C:
+			break wait
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	elapsed := time.Since(start)
+	stopListening()
+	mu.Lock()
+	defer mu.Unlock()
+	return &BenchReport{
+		Sent:       sent,
+		Received:   len(latencies),
+		Elapsed:    elapsed,
+		Throughput: float64(len(latencies)) / elapsed.Seconds(),
+		Latency:    Summarize(latencies),
+	}, nil
+}
+
+//produce publishes enveloped notifications at the target rate for the configured duration
+func produce(ctx context.Context, db *sql.DB, opts BenchOptions) (int, error) {
+	const tick = 10 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	deadline := time.Now().Add(opts.Duration)
+	perTick := float64(opts.Rate) * tick.Seconds()
+	padding := strings.Repeat("x", opts.PayloadSize)
+	var budget float64
+	sent := 0
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case <-ticker.C:
+		}
+		budget += perTick
+		for ; budget >= 1; budget-- {
+			payload, err := json.Marshal(Envelope{ID: strconv.Itoa(sent), EmittedAt: time.Now(), Data: json.RawMessage(strconv.Quote(padding))})
+			if err != nil {
+				return sent, err
+			}
+			if _, err := db.ExecContext(ctx, "SELECT pg_notify($1, $2)", opts.Channel, string(payload)); err != nil {
+				return sent, fmt.Errorf("failed to notify channel : %s! %s", opts.Channel, err.Error())
+			}
+			sent++
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,24 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	s := pqstream.Summarize(latencies)
+	if s.Count != 100 || s.Min != time.Millisecond || s.Max != 100*time.Millisecond {
+		t.Fatalf("unexpected summary bounds: %s", s)
+	}
+	if s.P50 != 50*time.Millisecond || s.P99 != 99*time.Millisecond {
+		t.Fatalf("unexpected percentiles: %s", s)
+	}
+	if empty := pqstream.Summarize(nil); empty.Count != 0 {
+		t.Fatalf("unexpected empty summary: %s", empty)
+	}
+}
@@ -0,0 +1,197 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+)
+
+//ErrBinaryTooLarge is returned by a BinaryStage for content larger than its MaxSize
+var ErrBinaryTooLarge = errors.New("binary content exceeds the stage's max size")
+
+//A BinaryRef stands in for the content of a bytea or large object column in a change event, see TriggerSpec.BinaryColumns. A bytea column is fetched
+//from its row by Key, a large object by its OID
+type BinaryRef struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Key    Row    `json:"key,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	OID    uint32 `json:"oid,omitempty"`
+}
+
+//binaryRefOf returns the reference a change event row holds for a column, if it holds one
+func binaryRefOf(row Row, column string) (*BinaryRef, bool) {
+	value, ok := row[column].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	raw, ok := value["$binary"]
+	if !ok {
+		return nil, false
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false
+	}
+	ref := &BinaryRef{}
+	if err := json.Unmarshal(encoded, ref); err != nil || ref.Column == "" {
+		return nil, false
+	}
+	return ref, true
+}
+
+//BinaryRef returns the reference the event's new row, or old row for deletes, holds in place of a binary column's content
+func (e *ChangeEvent) BinaryRef(column string) (*BinaryRef, bool) {
+	row := e.New
+	if row == nil {
+		row = e.Old
+	}
+	return binaryRefOf(row, column)
+}
+
+//A BinaryStage fetches the binary content change events reference instead of carrying, only when it's asked for: a handler calls Load for the columns it needs,
+//or a pipeline resolves every reference up front with Transform
+type BinaryStage struct {
+	DB *sql.DB
+	//MaxSize refuses to fetch content larger than it, in bytes, with ErrBinaryTooLarge. Zero fetches content of any size
+	MaxSize int64
+}
+
+//Fetch returns the content a reference stands in for
+func (s *BinaryStage) Fetch(ctx context.Context, ref *BinaryRef) ([]byte, error) {
+	if s.MaxSize > 0 && ref.Size > s.MaxSize {
+		return nil, fmt.Errorf("%w: %s.%s is %d bytes", ErrBinaryTooLarge, ref.Table, ref.Column, ref.Size)
+	}
+	table := ref.Table
+	if ref.Schema != "" {
+		table = ref.Schema + "." + ref.Table
+	}
+	var content []byte
+	if ref.OID != 0 {
+		if err := s.DB.QueryRowContext(ctx, "SELECT lo_get($1)", int64(ref.OID)).Scan(&content); err != nil {
+			return nil, fmt.Errorf("failed to fetch large object %d of %s.%s! %s", ref.OID, table, ref.Column, err.Error())
+		}
+		return s.limit(ref, content)
+	}
+	query, key, err := ref.query()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.DB.QueryRowContext(ctx, query, key).Scan(&content); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s.%s! %s", table, ref.Column, err.Error())
+	}
+	return s.limit(ref, content)
+}
+
+//query returns the SQL selecting a bytea column from the row its key identifies, and the key as its argument. The key is decoded into the table's own row type,
+//so it's compared with the key columns' types and can use their index
+func (r *BinaryRef) query() (string, string, error) {
+	if len(r.Key) == 0 {
+		return "", "", fmt.Errorf("binary ref to %s.%s has no key", r.Table, r.Column)
+	}
+	key, err := json.Marshal(r.Key)
+	if err != nil {
+		return "", "", err
+	}
+	table := r.Table
+	if r.Schema != "" {
+		table = r.Schema + "." + r.Table
+	}
+	columns := make([]string, 0, len(r.Key))
+	for col := range r.Key {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	conditions := make([]string, len(columns))
+	for i, col := range columns {
+		conditions[i] = fmt.Sprintf("t.%[1]s = k.%[1]s", pq.QuoteIdentifier(col))
+	}
+	return fmt.Sprintf("SELECT t.%s FROM %s AS t, json_populate_record(NULL::%s, $1::json) AS k WHERE %s",
+		pq.QuoteIdentifier(r.Column), quoteQualified(table), quoteQualified(table), strings.Join(conditions, " AND ")), string(key), nil
+}
+
+func (s *BinaryStage) limit(ref *BinaryRef, content []byte) ([]byte, error) {
+	if s.MaxSize > 0 && int64(len(content)) > s.MaxSize {
+		return nil, fmt.Errorf("%w: %s.%s is %d bytes", ErrBinaryTooLarge, ref.Table, ref.Column, len(content))
+	}
+	return content, nil
+}
+
+//Load returns a binary column's content from a change event, fetching it if the event carries a reference and decoding it if the event carries it inline,
+//as postgres encodes bytea in JSON. A column that is null, or missing from the event, returns nil
+func (s *BinaryStage) Load(ctx context.Context, notification *pq.Notification, column string) ([]byte, error) {
+	event, err := Decoded[*ChangeEvent](ctx, notification)
+	if err != nil {
+		return nil, err
+	}
+	if ref, ok := event.BinaryRef(column); ok {
+		return s.Fetch(ctx, ref)
+	}
+	row := event.New
+	if row == nil {
+		row = event.Old
+	}
+	return decodeBytea(row[column])
+}
+
+//decodeBytea decodes a bytea value in postgres' hex format, ie: "\\x0102"
+func decodeBytea(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if !strings.HasPrefix(v, `\x`) {
+			return nil, fmt.Errorf("column isn't a bytea in hex format")
+		}
+		return hex.DecodeString(v[2:])
+	}
+	return nil, fmt.Errorf("column isn't a bytea, got %T", value)
+}
+
+//Resolve returns a copy of the notification with every binary reference in its change event replaced by the content, in postgres' hex format,
+//as if the trigger had sent it. Notifications that aren't change events pass unchanged
+func (s *BinaryStage) Resolve(ctx context.Context, notification *pq.Notification) (*pq.Notification, error) {
+	event, err := ParseChange(notification)
+	if err != nil {
+		return notification, nil
+	}
+	resolved := false
+	for _, row := range []Row{event.Old, event.New} {
+		for column := range row {
+			ref, ok := binaryRefOf(row, column)
+			if !ok {
+				continue
+			}
+			content, err := s.Fetch(ctx, ref)
+			if err != nil {
+				return nil, err
+			}
+			row[column] = `\x` + hex.EncodeToString(content)
+			resolved = true
+		}
+	}
+	if !resolved {
+		return notification, nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	out := *notification
+	out.Extra = string(payload)
+	return &out, nil
+}
+
+//Transform returns a pipeline transform resolving binary references
+func (s *BinaryStage) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		return s.Resolve(context.Background(), notification)
+	}
+}
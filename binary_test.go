@@ -0,0 +1,60 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestBinaryTriggerSQL(t *testing.T) {
+	up := pqstream.TriggerSpec{
+		Table:              "app.files",
+		Key:                []string{"id"},
+		BinaryColumns:      []string{"content"},
+		LargeObjectColumns: []string{"blob"},
+	}.Up()
+	for _, want := range []string{
+		`row_to_json(NEW)::jsonb || jsonb_build_object('content', CASE WHEN NEW."content" IS NOT NULL THEN jsonb_build_object('$binary'`,
+		`'column', 'content', 'key', json_build_object('id', NEW."id"), 'size', octet_length(NEW."content")`,
+		`'column', 'blob', 'oid', NEW."blob"`,
+	} {
+		if !strings.Contains(up, want) {
+			t.Fatalf("expected trigger sql to contain %s, got:\n%s", want, up)
+		}
+	}
+}
+
+func TestBinaryStage(t *testing.T) {
+	ctx := context.Background()
+	n := &pq.Notification{Channel: "files", Extra: `{"table": "files", "schema": "app", "op": "INSERT", "new": {"id": 7, "small": "\\x0102ff", "empty": null,
+		"content": {"$binary": {"schema": "app", "table": "files", "column": "content", "key": {"id": 7}, "size": 2048}}}}`}
+	event, err := pqstream.ParseChange(n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ref, ok := event.BinaryRef("content")
+	if !ok || ref.Table != "files" || ref.Schema != "app" || ref.Size != 2048 || ref.Key["id"] == nil {
+		t.Fatalf("expected a binary ref, got: %+v", ref)
+	}
+	if _, ok := event.BinaryRef("small"); ok {
+		t.Fatal("expected an inline bytea not to be a ref")
+	}
+	stage := &pqstream.BinaryStage{MaxSize: 1024}
+	small, err := stage.Load(ctx, n, "small")
+	if err != nil || string(small) != "\x01\x02\xff" {
+		t.Fatalf("expected an inline bytea to be decoded, got: %v %v", small, err)
+	}
+	if empty, err := stage.Load(ctx, n, "empty"); err != nil || empty != nil {
+		t.Fatalf("expected a null column to load nothing, got: %v %v", empty, err)
+	}
+	//refs larger than the stage's max size are refused before they're fetched
+	if _, err := stage.Load(ctx, n, "content"); !errors.Is(err, pqstream.ErrBinaryTooLarge) {
+		t.Fatalf("expected ErrBinaryTooLarge, got: %v", err)
+	}
+	if out, err := stage.Resolve(ctx, &pq.Notification{Channel: "files", Extra: "plain"}); err != nil || out.Extra != "plain" {
+		t.Fatalf("expected a notification that isn't a change event to pass unchanged, got: %v %v", out, err)
+	}
+}
@@ -0,0 +1,232 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"net"
+	"sync"
+	"time"
+)
+
+//ErrBudgetExhausted is returned opening a connection when a ConnectionBudget is spent and none closed within its Wait
+var ErrBudgetExhausted = errors.New("connection budget exhausted")
+
+//listenerBudgetUser is the user the client's listener connections are counted under
+const listenerBudgetUser = "listener"
+
+//A ConnectionBudget caps the postgres connections the library holds open at once, so a fleet of consumers can't exhaust the server's max_connections.
+//Set as Config.Budget, it admits every connection the client opens: its query pool, write pool, trigger installs, failover probes and listener.
+//Open DBs for publishers, enrichers and sinks with Open to draw on the same budget. It is a soft quota: the listener, which the stream can't run without,
+//is always admitted and counted, so it may take the budget over Max by one connection, which delays everything else until it is back under
+type ConnectionBudget struct {
+	//Max is the number of connections held open at once across every user of the budget
+	Max int
+	//Wait is how long a connection waits for another to close once the budget is spent, before failing with ErrBudgetExhausted. Zero fails straight away
+	Wait time.Duration
+
+	mu       sync.Mutex
+	open     map[string]int
+	total    int
+	waiting  int
+	waits    uint64
+	rejected uint64
+	freed    chan struct{}
+}
+
+//BudgetStats describe a ConnectionBudget's use. Pressure is the share of the budget in use, which reaching 1 means new connections wait or fail
+type BudgetStats struct {
+	Max      int            `json:"max"`
+	Open     int            `json:"open"`
+	Users    map[string]int `json:"users"`
+	Waiting  int            `json:"waiting"`
+	Waits    uint64         `json:"waits"`
+	Rejected uint64         `json:"rejected"`
+	Pressure float64        `json:"pressure"`
+}
+
+//NewConnectionBudget returns a budget of max connections, failing connections over it straight away
+func NewConnectionBudget(max int) *ConnectionBudget {
+	return &ConnectionBudget{Max: max}
+}
+
+//Open returns a DB whose connections are admitted by the budget and counted under user, ie: "enricher", in the budget's stats.
+//Its MaxOpenConns is capped at Max, and a query that needs a connection once the budget is spent waits for one as Wait says
+func (b *ConnectionBudget) Open(user, connInfo string) (*sql.DB, error) {
+	if _, err := pq.NewConnector(connInfo); err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(&budgetConnector{budget: b, user: user, connInfo: connInfo})
+	if b.Max > 0 {
+		db.SetMaxOpenConns(b.Max)
+	}
+	return db, nil
+}
+
+//Dialer returns a dialer for lib/pq whose connections are admitted by the budget and counted under user, ie: for pq.NewDialListener
+func (b *ConnectionBudget) Dialer(user string) pq.Dialer {
+	return &budgetDialer{budget: b, user: user, ctx: context.Background()}
+}
+
+//Stats returns the budget's use
+func (b *ConnectionBudget) Stats() BudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	users := make(map[string]int, len(b.open))
+	for user, n := range b.open {
+		if n > 0 {
+			users[user] = n
+		}
+	}
+	s := BudgetStats{Max: b.Max, Open: b.total, Users: users, Waiting: b.waiting, Waits: b.waits, Rejected: b.rejected}
+	if b.Max > 0 {
+		s.Pressure = float64(b.total) / float64(b.Max)
+	}
+	return s
+}
+
+//acquire admits a connection for a user, waiting for another to close while the budget is spent. The listener is admitted regardless
+func (b *ConnectionBudget) acquire(ctx context.Context, user string) error {
+	b.mu.Lock()
+	if b.open == nil {
+		b.open = map[string]int{}
+	}
+	var timeout <-chan time.Time
+	for b.Max > 0 && b.total >= b.Max && user != listenerBudgetUser {
+		if timeout == nil {
+			if b.Wait <= 0 {
+				b.rejected++
+				b.mu.Unlock()
+				return fmt.Errorf("failed to open a connection for %s! %w: %d of %d open", user, ErrBudgetExhausted, b.total, b.Max)
+			}
+			b.waits++
+			timer := time.NewTimer(b.Wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		if b.freed == nil {
+			b.freed = make(chan struct{})
+		}
+		freed := b.freed
+		b.waiting++
+		b.mu.Unlock()
+		var err error
+		select {
+		case <-freed:
+		case <-timeout:
+			err = ErrBudgetExhausted
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		b.mu.Lock()
+		b.waiting--
+		if err != nil {
+			b.rejected++
+			total := b.total
+			b.mu.Unlock()
+			return fmt.Errorf("failed to open a connection for %s! %w: %d of %d open", user, err, total, b.Max)
+		}
+	}
+	b.open[user]++
+	b.total++
+	b.mu.Unlock()
+	return nil
+}
+
+//release frees a user's connection, waking the connections waiting on the budget
+func (b *ConnectionBudget) release(user string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open[user]--
+	b.total--
+	if b.freed != nil {
+		close(b.freed)
+		b.freed = nil
+	}
+}
+
+//budgetConnector opens a DB's connections through the budget, honoring the context database/sql connects with
+type budgetConnector struct {
+	budget   *ConnectionBudget
+	user     string
+	connInfo string
+}
+
+func (c *budgetConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return pq.DialOpen(&budgetDialer{budget: c.budget, user: c.user, ctx: ctx}, c.connInfo)
+}
+
+func (c *budgetConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+//budgetDialer dials connections admitted by the budget, each releasing its admission when it closes
+type budgetDialer struct {
+	budget *ConnectionBudget
+	user   string
+	ctx    context.Context
+	dialer net.Dialer
+}
+
+func (d *budgetDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+func (d *budgetDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+//DialContext waits for admission with the context database/sql connects with, since lib/pq dials with a background one
+func (d *budgetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := d.budget.acquire(d.ctx, d.user); err != nil {
+		return nil, err
+	}
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		d.budget.release(d.user)
+		return nil, err
+	}
+	return &budgetConn{Conn: conn, release: func() { d.budget.release(d.user) }}, nil
+}
+
+//budgetConn releases its admission once closed
+type budgetConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *budgetConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+//openDB opens a DB for the client, through its Budget when it has one
+func (c *Config) openDB(user, connInfo string) (*sql.DB, error) {
+	if c.Budget == nil {
+		return sql.Open("postgres", connInfo)
+	}
+	return c.Budget.Open(user, connInfo)
+}
+
+//newListener returns a listener for the client, admitted by its Budget when it has one
+func (c *Config) newListener(connInfo string, min, max time.Duration, callback pq.EventCallbackType) *pq.Listener {
+	if c.Budget == nil {
+		return pq.NewListener(connInfo, min, max, callback)
+	}
+	return pq.NewDialListener(c.Budget.Dialer(listenerBudgetUser), connInfo, min, max, callback)
+}
+
+//budgetStats returns the stats of the client's Budget, or nil without one
+func (c *Client) budgetStats() *BudgetStats {
+	if c.config.Budget == nil {
+		return nil
+	}
+	s := c.config.Budget.Stats()
+	return &s
+}
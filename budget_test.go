@@ -0,0 +1,75 @@
+package pqstream_test
+
+import (
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionBudget(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := server.Addr().String()
+	budget := pqstream.NewConnectionBudget(2)
+	enricher := budget.Dialer("enricher")
+	a, err := enricher.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := budget.Dialer("publisher").Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := enricher.Dial("tcp", addr); !errors.Is(err, pqstream.ErrBudgetExhausted) {
+		t.Fatalf("expected a connection over the budget to be refused, got %v", err)
+	}
+	listener, err := budget.Dialer("listener").Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the listener to be admitted over the budget, got %v", err)
+	}
+	if s := budget.Stats(); s.Open != 3 || s.Users["enricher"] != 1 || s.Rejected != 1 || s.Pressure != 1.5 {
+		t.Fatalf("unexpected budget stats: %+v", s)
+	}
+	listener.Close()
+	budget.Wait = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a.Close()
+		a.Close()
+	}()
+	c, err := enricher.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected a waiting connection to be admitted once one closed, got %v", err)
+	}
+	budget.Wait = 10 * time.Millisecond
+	if _, err := enricher.Dial("tcp", addr); !errors.Is(err, pqstream.ErrBudgetExhausted) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	c.Close()
+	b.Close()
+	if s := budget.Stats(); s.Open != 0 || s.Waits != 2 || s.Rejected != 2 || len(s.Users) != 0 {
+		t.Fatalf("expected every admission released once, got %+v", s)
+	}
+
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Budget: budget}, &pqstream.HandlerSet{Handlers: []pqstream.Handler{namedHandler{}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := client.Stats(); s.Budget == nil || s.Budget.Max != 2 || client.EffectiveConfig().ConnectionBudget != 2 {
+		t.Fatalf("expected the client to report its budget, got %+v", s.Budget)
+	}
+}
@@ -0,0 +1,216 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ErrBufferFull is returned by a BufferedSink using DropNewest when its buffer has no room
+var ErrBufferFull = errors.New("sink buffer full")
+
+//ErrBufferClosed is returned by a BufferedSink after Close
+var ErrBufferClosed = errors.New("sink buffer closed")
+
+//DropPolicy decides what a BufferedSink does with a notification when its buffer is full
+type DropPolicy int
+
+const (
+	//DropNewest rejects the incoming notification with ErrBufferFull
+	DropNewest DropPolicy = iota
+	//DropOldest discards the oldest buffered notification to make room
+	DropOldest
+	//Block waits for room in the buffer, applying backpressure to the pipeline
+	Block
+)
+
+//BufferOptions configures a BufferedSink
+type BufferOptions struct {
+	//Size is the number of notifications buffered ahead of the sink. Defaults to 1024
+	Size int
+	//Retries is how many times a failed send is retried before the notification is given up on
+	Retries int
+	//Backoff is the delay before the first retry, doubling after each attempt
+	Backoff time.Duration
+	//Drop decides what happens when the buffer is full
+	Drop DropPolicy
+	//OnError is called with sends that failed after all retries, and with dropped notifications. Defaults to discarding them
+	OnError ErrHandlerFunc
+	//Clock is the source of time for retry backoff. Defaults to SystemClock
+	Clock Clock
+}
+
+//BufferStats are a BufferedSink's counters
+type BufferStats struct {
+	Queued    int    `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Failed    uint64 `json:"failed"`
+}
+
+//A BufferedSink decouples a sink from the pipeline feeding it: Send only enqueues, and a dedicated worker delivers with its own retries, so a slow or failing sink
+//doesn't stall the other sinks it is fanned out alongside
+type BufferedSink struct {
+	sink      Sink
+	opts      BufferOptions
+	queue     chan bufferedNotification
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	delivered uint64
+	dropped   uint64
+	failed    uint64
+}
+
+type bufferedNotification struct {
+	ctx          context.Context
+	notification *pq.Notification
+	ack          func(err error)
+}
+
+//NewBufferedSink starts a worker delivering buffered notifications to the sink
+func NewBufferedSink(sink Sink, opts BufferOptions) *BufferedSink {
+	if opts.Size <= 0 {
+		opts.Size = 1024
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {}
+	}
+	opts.Clock = clockOr(opts.Clock)
+	b := &BufferedSink{
+		sink:  sink,
+		opts:  opts,
+		queue: make(chan bufferedNotification, opts.Size),
+		done:  make(chan struct{}),
+	}
+	go b.work()
+	return b
+}
+
+//Name returns the wrapped sink's name
+func (b *BufferedSink) Name() string {
+	return b.sink.Name()
+}
+
+//Send enqueues a notification for delivery, applying the drop policy when the buffer is full
+func (b *BufferedSink) Send(ctx context.Context, notification *pq.Notification) error {
+	return b.SendAck(ctx, notification, nil)
+}
+
+//SendAck enqueues a notification for delivery. ack is called once the notification is delivered, fails after all retries, or is dropped
+func (b *BufferedSink) SendAck(ctx context.Context, notification *pq.Notification, ack func(err error)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBufferClosed
+	}
+	if ack == nil {
+		ack = func(error) {}
+	}
+	item := bufferedNotification{ctx: detach(ctx), notification: notification, ack: ack}
+	switch b.opts.Drop {
+	case Block:
+		select {
+		case b.queue <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case DropOldest:
+		for {
+			select {
+			case b.queue <- item:
+				return nil
+			default:
+			}
+			select {
+			case old := <-b.queue:
+				b.drop(old.notification)
+				old.ack(ErrBufferFull)
+			default:
+			}
+		}
+	default:
+		select {
+		case b.queue <- item:
+			return nil
+		default:
+			b.drop(notification)
+			return ErrBufferFull
+		}
+	}
+}
+
+//Stats returns the buffer's counters
+func (b *BufferedSink) Stats() BufferStats {
+	return BufferStats{
+		Queued:    len(b.queue),
+		Delivered: atomic.LoadUint64(&b.delivered),
+		Dropped:   atomic.LoadUint64(&b.dropped),
+		Failed:    atomic.LoadUint64(&b.failed),
+	}
+}
+
+//Close stops accepting notifications and waits for the buffered ones to be delivered or the context to expire
+func (b *BufferedSink) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *BufferedSink) work() {
+	defer close(b.done)
+	for item := range b.queue {
+		err := sendWithRetry(item.ctx, b.opts.Clock, b.sink, item.notification, b.opts.Retries, b.opts.Backoff)
+		item.ack(err)
+		if err != nil {
+			atomic.AddUint64(&b.failed, 1)
+			b.opts.OnError(fmt.Errorf("sink %s failed to deliver notification! pid: %d, channel: %s error: %w", b.sink.Name(), item.notification.BePid, item.notification.Channel, err))
+			continue
+		}
+		atomic.AddUint64(&b.delivered, 1)
+	}
+}
+
+func (b *BufferedSink) drop(n *pq.Notification) {
+	atomic.AddUint64(&b.dropped, 1)
+	b.opts.OnError(fmt.Errorf("sink %s buffer full, dropped notification! pid: %d, channel: %s", b.sink.Name(), n.BePid, n.Channel))
+}
+
+//detached keeps a context's values but not its deadline or cancellation, for work that outlives the handler that queued it
+type detached struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detached{parent: ctx}
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
+
+func (d detached) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,73 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestBufferedSinkIsolation(t *testing.T) {
+	release := make(chan struct{})
+	slow := pqstream.NewBufferedSink(pqstream.NewSink("slow", func(ctx context.Context, n *pq.Notification) error {
+		<-release
+		return nil
+	}), pqstream.BufferOptions{Size: 1})
+	fast := &recordingSink{name: "fast"}
+	p := pqstream.NewPipeline().FanOut(slow, fast)
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for _, payload := range []string{"1", "2", "3"} {
+			if e := p.Process(&pq.Notification{Channel: "users", Extra: payload}); e != nil {
+				err = e
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the full slow buffer to reject a notification")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow sink stalled the pipeline")
+	}
+	if got := fast.payloads(); len(got) != 3 {
+		t.Fatalf("expected fast sink to receive every notification, got: %v", got)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := slow.Close(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats := slow.Stats()
+	if stats.Dropped == 0 || stats.Delivered+stats.Dropped != 3 {
+		t.Fatalf("unexpected buffer stats: %+v", stats)
+	}
+	if err := slow.Send(context.Background(), &pq.Notification{}); err != pqstream.ErrBufferClosed {
+		t.Fatalf("expected ErrBufferClosed, got: %v", err)
+	}
+}
+
+func TestBufferedSinkRetries(t *testing.T) {
+	failures := make(chan error, 1)
+	attempts := 0
+	b := pqstream.NewBufferedSink(pqstream.NewSink("flaky", func(ctx context.Context, n *pq.Notification) error {
+		attempts++
+		return errors.New("down")
+	}), pqstream.BufferOptions{Retries: 2, Drop: pqstream.Block, OnError: func(err error) { failures <- err }})
+	if err := b.Send(context.Background(), &pq.Notification{Channel: "users"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts != 3 || len(failures) != 1 || b.Stats().Failed != 1 {
+		t.Fatalf("expected 3 attempts and 1 failure, got %d attempts, %+v", attempts, b.Stats())
+	}
+}
@@ -0,0 +1,206 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+//defaultBulkheadQueue is the number of notifications a bulkhead holds when BulkheadOptions.Queue is unset
+const defaultBulkheadQueue = 100
+
+//ErrBulkheadFull is returned by a Bulkhead whose queue is full, so a saturated handler fails fast instead of holding back the channel
+var ErrBulkheadFull = errors.New("bulkhead queue full")
+
+//ErrBulkheadClosed is returned by a Bulkhead once it has been closed
+var ErrBulkheadClosed = errors.New("bulkhead closed")
+
+//BulkheadOptions sizes a Bulkhead
+type BulkheadOptions struct {
+	//Workers is the number of goroutines running the handler. Defaults to 1
+	Workers int
+	//Queue is the number of notifications waiting for a worker before new ones are rejected with ErrBulkheadFull. Defaults to 100
+	Queue int
+	//ErrorHandler receives the errors the handler returns, which happen after Process has returned. Defaults to logging them
+	ErrorHandler ErrHandlerFunc
+}
+
+//BulkheadStats describes the load on a Bulkhead
+type BulkheadStats struct {
+	Workers   int    `json:"workers"`
+	Busy      int64  `json:"busy"`
+	Queued    int    `json:"queued"`
+	Processed uint64 `json:"processed"`
+	Failed    uint64 `json:"failed"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+//A Bulkhead runs a handler on its own bounded queue and workers, isolating it from the other handlers: Process only queues the notification and returns,
+//so a slow or failing handler, ie: a webhook to a struggling service, saturates its own queue while the rest of the stream is processed in real time.
+//Because the handler runs after Process returns, its errors go to the bulkhead's ErrorHandler, and a queued notification counts as handled, so a client
+//with Config.Bulkheads can't have an Outbox. The handler's context keeps the values of the one the notification was queued with, but not its cancellation
+type Bulkhead struct {
+	handler   Handler
+	name      string
+	workers   int
+	report    func(notification *pq.Notification, err error)
+	mu        sync.RWMutex
+	closed    bool
+	queue     chan bulkheadTask
+	wg        sync.WaitGroup
+	busy      int64
+	processed uint64
+	failed    uint64
+	rejected  uint64
+}
+
+type bulkheadTask struct {
+	ctx          context.Context
+	notification *pq.Notification
+}
+
+//NewBulkhead starts the workers of a bulkhead around a handler. Close stops them
+func NewBulkhead(handler Handler, opts BulkheadOptions) *Bulkhead {
+	report := func(notification *pq.Notification, err error) {
+		log.Printf("[%s] error: bulkhead failed to process notification on channel: %s! %s", pkg, notification.Channel, err.Error())
+	}
+	if opts.ErrorHandler != nil {
+		report = func(notification *pq.Notification, err error) {
+			opts.ErrorHandler(err)
+		}
+	}
+	return newBulkhead(handler, nameOf(handler, "bulkhead", 0), opts, report)
+}
+
+func newBulkhead(handler Handler, name string, opts BulkheadOptions, report func(notification *pq.Notification, err error)) *Bulkhead {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = defaultBulkheadQueue
+	}
+	b := &Bulkhead{
+		handler: handler,
+		name:    name,
+		workers: opts.Workers,
+		report:  report,
+		queue:   make(chan bulkheadTask, opts.Queue),
+	}
+	b.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go b.work()
+	}
+	return b
+}
+
+func (b *Bulkhead) work() {
+	defer b.wg.Done()
+	for task := range b.queue {
+		atomic.AddInt64(&b.busy, 1)
+		var err error
+		if h, ok := b.handler.(ContextHandler); ok {
+			err = h.ProcessContext(task.ctx, task.notification)
+		} else {
+			err = b.handler.Process(task.notification)
+		}
+		atomic.AddInt64(&b.busy, -1)
+		atomic.AddUint64(&b.processed, 1)
+		if err != nil {
+			atomic.AddUint64(&b.failed, 1)
+			b.report(task.notification, fmt.Errorf("%s pid: %d, channel: %s error: %w", b.name, task.notification.BePid, task.notification.Channel, err))
+		}
+	}
+}
+
+func (b *Bulkhead) Name() string {
+	return b.name
+}
+
+func (b *Bulkhead) Process(notification *pq.Notification) error {
+	return b.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext queues the notification for the handler, failing with ErrBulkheadFull if its queue is full
+func (b *Bulkhead) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBulkheadClosed
+	}
+	select {
+	case b.queue <- bulkheadTask{ctx: detach(ctx), notification: notification}:
+		return nil
+	default:
+		atomic.AddUint64(&b.rejected, 1)
+		return ErrBulkheadFull
+	}
+}
+
+//Stats returns a snapshot of the bulkhead's queue and counters
+func (b *Bulkhead) Stats() BulkheadStats {
+	return BulkheadStats{
+		Workers:   b.workers,
+		Busy:      atomic.LoadInt64(&b.busy),
+		Queued:    len(b.queue),
+		Processed: atomic.LoadUint64(&b.processed),
+		Failed:    atomic.LoadUint64(&b.failed),
+		Rejected:  atomic.LoadUint64(&b.rejected),
+	}
+}
+
+//Close stops accepting notifications and waits for the queued ones to be processed
+func (b *Bulkhead) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+//bulkheads wraps each of a client's handlers in its own Bulkhead, reporting their errors against the notification's channel
+func (c *Client) bulkheads(opts BulkheadOptions) {
+	handlers := make([]Handler, len(c.handlers.Handlers))
+	for i, h := range c.handlers.Handlers {
+		name := nameOf(h, "main", i)
+		handlers[i] = newBulkhead(h, name, opts, func(notification *pq.Notification, err error) {
+			c.events.publish(Event{Type: EventHandlerFailed, Channel: notification.Channel, Time: c.config.Clock.Now(), Handler: name, Error: err.Error()})
+			c.handleErr(notification.Channel, err)
+		})
+	}
+	c.handlers.Handlers = handlers
+}
+
+//closeBulkheads drains the bulkheads created for the client's handlers
+func (c *Client) closeBulkheads() {
+	if c.config.Bulkheads == nil {
+		return
+	}
+	for _, h := range c.mainHandlers() {
+		if b, ok := h.(*Bulkhead); ok {
+			b.Close()
+		}
+	}
+}
+
+//bulkheadStats returns the stats of every Bulkhead among the client's handlers by name, or nil if there are none
+func (c *Client) bulkheadStats() map[string]BulkheadStats {
+	var out map[string]BulkheadStats
+	for _, handlers := range [][]Handler{c.handlers.PreHandlers, c.mainHandlers(), c.handlers.PostHandlers} {
+		for _, h := range handlers {
+			if b, ok := h.(*Bulkhead); ok {
+				if out == nil {
+					out = map[string]BulkheadStats{}
+				}
+				out[b.Name()] = b.Stats()
+			}
+		}
+	}
+	return out
+}
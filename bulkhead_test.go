@@ -0,0 +1,125 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sync"
+	"testing"
+)
+
+func TestBulkheadsIsolateHandlers(t *testing.T) {
+	release, started := make(chan struct{}), make(chan struct{}, 1)
+	var (
+		mu   sync.Mutex
+		fast int
+		errs []error
+	)
+	slow := pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return errors.New("webhook failed")
+	})
+	quick := pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fast++
+		return nil
+	})
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{slow, quick},
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Bulkheads: &pqstream.BulkheadOptions{Queue: 2}}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+	<-started
+	for i := 0; i < 4; i++ {
+		client.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+	}
+	stats := client.Stats().Bulkheads
+	if len(stats) != 2 {
+		t.Fatalf("expected a bulkhead per handler, got: %+v", stats)
+	}
+	//the slow handler holds one notification and queues two, rejecting the rest
+	if s := stats["main[0](pqstream.HandlerFunc)"]; s.Busy != 1 || s.Queued != 2 || s.Rejected != 2 {
+		t.Fatalf("expected the saturated bulkhead to reject 2 notifications, got: %+v", stats)
+	}
+	close(release)
+	for _, h := range handlerSet.Handlers {
+		h.(*pqstream.Bulkhead).Close()
+	}
+	stats = client.Stats().Bulkheads
+	fastRejected := stats["main[1](pqstream.HandlerFunc)"].Rejected
+	mu.Lock()
+	defer mu.Unlock()
+	if fast+int(fastRejected) != 5 || len(errs) != 5+int(fastRejected) {
+		t.Fatalf("expected the fast handler to keep up and the slow one's failures to be reported, got %d and %v", fast, errs)
+	}
+	if err := handlerSet.Handlers[0].Process(&pq.Notification{Channel: "users"}); err != pqstream.ErrBulkheadClosed {
+		t.Fatalf("expected a closed bulkhead to refuse notifications, got: %v", err)
+	}
+}
+
+func TestNewBulkhead(t *testing.T) {
+	var errs []error
+	b := pqstream.NewBulkhead(pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+		return errors.New("boom")
+	}), pqstream.BulkheadOptions{Workers: 2, ErrorHandler: func(err error) { errs = append(errs, err) }})
+	if err := b.Process(&pq.Notification{Channel: "users"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	b.Close()
+	if s := b.Stats(); s.Workers != 2 || s.Processed != 1 || s.Failed != 1 || len(errs) != 1 {
+		t.Fatalf("unexpected bulkhead stats: %+v %v", s, errs)
+	}
+}
+
+type bulkheadKey struct{}
+
+type contextRecorder struct {
+	err   error
+	value any
+}
+
+func (c *contextRecorder) Process(notification *pq.Notification) error {
+	return nil
+}
+
+func (c *contextRecorder) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	c.err, c.value = ctx.Err(), ctx.Value(bulkheadKey{})
+	return nil
+}
+
+func TestBulkheadDetachesContext(t *testing.T) {
+	h := &contextRecorder{}
+	b := pqstream.NewBulkhead(h, pqstream.BulkheadOptions{})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), bulkheadKey{}, "traced"))
+	if err := b.ProcessContext(ctx, &pq.Notification{Channel: "users"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel()
+	b.Close()
+	if h.err != nil || h.value != "traced" {
+		t.Fatalf("expected the handler to keep the context's values but not its cancellation, got %v and %v", h.err, h.value)
+	}
+}
+
+func TestBulkheadsRejectOutbox(t *testing.T) {
+	_, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Bulkheads: &pqstream.BulkheadOptions{}, Outbox: &pqstream.Outbox{}}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err == nil {
+		t.Fatal("expected bulkheads with an outbox to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"sync"
+	"sync/atomic"
+)
+
+//defaultBusBuffer is the number of notifications held for each bus subscriber when BusOptions.Buffer is unset
+const defaultBusBuffer = 64
+
+//BusOptions configure a Bus
+type BusOptions struct {
+	//Buffer is the number of notifications held for each subscriber. Defaults to 64
+	Buffer int
+	//Block makes the client wait for a subscriber whose buffer is full, so every subscriber sees every notification but a slow one holds back its channel.
+	//By default notifications for a subscriber that fell behind are dropped
+	Block bool
+}
+
+//A Bus fans a client's notifications out to in-process subscribers, so several components of one application consume the same stream independently,
+//each at its own pace, over the client's single LISTEN connection. Each subscriber gets its own copy of every notification
+type Bus struct {
+	opts    BusOptions
+	mu      sync.RWMutex
+	subs    map[*busSubscriber]struct{}
+	dropped uint64
+}
+
+type busSubscriber struct {
+	channel string
+	out     chan *pq.Notification
+	done    chan struct{}
+	cancel  func()
+}
+
+//NewBus returns a Bus receiving every notification the client processes
+func NewBus(c *Client, opts BusOptions) *Bus {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultBusBuffer
+	}
+	b := &Bus{opts: opts, subs: map[*busSubscriber]struct{}{}}
+	c.mu.Lock()
+	c.handlers.Handlers = append(append([]Handler{}, c.handlers.Handlers...), b)
+	c.mu.Unlock()
+	return b
+}
+
+func (b *Bus) Name() string {
+	return "bus"
+}
+
+func (b *Bus) Process(notification *pq.Notification) error {
+	return b.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext copies the notification to every subscriber of its channel
+func (b *Bus) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.channel != "" && sub.channel != notification.Channel {
+			continue
+		}
+		copied := *notification
+		if !b.opts.Block {
+			select {
+			case sub.out <- &copied:
+			default:
+				atomic.AddUint64(&b.dropped, 1)
+			}
+			continue
+		}
+		select {
+		case sub.out <- &copied:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+//Subscribe returns a channel receiving the notifications on a channel, or on every channel if channel is empty, until the returned func is called,
+//which closes it
+func (b *Bus) Subscribe(channel string) (<-chan *pq.Notification, func()) {
+	sub := &busSubscriber{channel: channel, out: make(chan *pq.Notification, b.opts.Buffer), done: make(chan struct{})}
+	var once sync.Once
+	sub.cancel = func() {
+		once.Do(func() {
+			//a blocked delivery gives up first, so the lock is free to remove the subscriber
+			close(sub.done)
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			close(sub.out)
+		})
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub.out, sub.cancel
+}
+
+//Close unsubscribes every subscriber, closing their channels, ie: once the client's Run returned
+func (b *Bus) Close() {
+	b.mu.RLock()
+	subs := make([]*busSubscriber, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.RUnlock()
+	for _, sub := range subs {
+		sub.cancel()
+	}
+}
+
+//Subscribers returns the number of current subscribers
+func (b *Bus) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+//Dropped returns the number of notifications dropped for subscribers that fell behind
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
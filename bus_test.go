@@ -0,0 +1,83 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	client, err := pqstream.NewClient([]string{"users", "orders"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bus := pqstream.NewBus(client, pqstream.BusOptions{Buffer: 2})
+	users, cancelUsers := bus.Subscribe("users")
+	all, cancelAll := bus.Subscribe("")
+	defer cancelAll()
+	if bus.Subscribers() != 2 {
+		t.Fatalf("expected 2 subscribers, got: %d", bus.Subscribers())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	client.Process(&pq.Notification{Channel: "orders", Extra: "2"})
+	if n := <-users; n.Extra != "1" {
+		t.Fatalf("expected the users notification, got: %+v", n)
+	}
+	if a, b := <-all, <-all; a.Extra != "1" || b.Extra != "2" {
+		t.Fatalf("expected every notification, got: %+v %+v", a, b)
+	}
+	//a subscriber that falls behind misses notifications without holding back the others
+	for i := 0; i < 3; i++ {
+		client.Process(&pq.Notification{Channel: "users", Extra: "x"})
+	}
+	if bus.Dropped() != 2 || len(users) != 2 || len(all) != 2 {
+		t.Fatalf("expected the third notification to be dropped for each full subscriber, got: %d dropped", bus.Dropped())
+	}
+	cancelUsers()
+	cancelUsers()
+	for range users {
+	}
+	if bus.Subscribers() != 1 {
+		t.Fatalf("expected the cancelled subscriber to be removed, got: %d", bus.Subscribers())
+	}
+}
+
+func TestBusBlock(t *testing.T) {
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bus := pqstream.NewBus(client, pqstream.BusOptions{Buffer: 1, Block: true})
+	users, _ := bus.Subscribe("users")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			client.Process(&pq.Notification{Channel: "users", Extra: "x"})
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-users:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a blocking bus to deliver every notification")
+		}
+	}
+	<-done
+	if bus.Dropped() != 0 {
+		t.Fatalf("expected nothing dropped, got: %d", bus.Dropped())
+	}
+	//closing the bus releases a delivery blocked on a subscriber that stopped reading
+	go client.Process(&pq.Notification{Channel: "users", Extra: "x"})
+	go client.Process(&pq.Notification{Channel: "users", Extra: "x"})
+	time.Sleep(10 * time.Millisecond)
+	bus.Close()
+	if bus.Subscribers() != 0 {
+		t.Fatalf("expected close to remove every subscriber, got: %d", bus.Subscribers())
+	}
+}
@@ -0,0 +1,168 @@
+package pqstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//defaultCanaryTimeout bounds a candidate's run when CanaryOptions.Timeout is unset
+	defaultCanaryTimeout = 5 * time.Second
+	//defaultCanaryConcurrency is the number of candidate runs at once when CanaryOptions.Concurrency is unset
+	defaultCanaryConcurrency = 16
+)
+
+//A Divergence is a notification on which a canary's candidate handler disagreed with the primary
+type Divergence struct {
+	Notification *pq.Notification
+	Primary      any
+	Candidate    any
+	PrimaryErr   error
+	CandidateErr error
+}
+
+//CanaryOptions configures a Canary
+type CanaryOptions struct {
+	//Equal compares the primary and candidate values. Defaults to reflect.DeepEqual
+	Equal func(primary, candidate any) bool
+	//OnDivergence is called with every notification the handlers disagreed on, from the goroutine the candidate ran on
+	OnDivergence func(d Divergence)
+	//Timeout bounds each candidate run, after which it is reported as a divergence. Defaults to 5s
+	Timeout time.Duration
+	//Concurrency is the number of candidate runs at once. Notifications arriving while that many run skip the candidate. Defaults to 16
+	Concurrency int
+}
+
+//CanaryStats are a Canary's counters
+type CanaryStats struct {
+	Compared uint64 `json:"compared"`
+	Diverged uint64 `json:"diverged"`
+	Skipped  uint64 `json:"skipped"`
+}
+
+//A Canary runs a new handler implementation side by side with the one it replaces and compares their values and errors, to de-risk handler rewrites.
+//The primary's value and error are what the Canary returns; the candidate runs after it on its own goroutine, so its latency never holds back delivery,
+//and a panicking or timed out candidate is reported as a divergence instead of crashing the client. Handlers implementing ResultHandler are compared on their values, others on their errors alone
+type Canary struct {
+	primary   Handler
+	candidate Handler
+	opts      CanaryOptions
+	running   chan struct{}
+	wg        sync.WaitGroup
+	compared  uint64
+	diverged  uint64
+	skipped   uint64
+}
+
+//NewCanary compares a candidate handler against the primary it is meant to replace
+func NewCanary(primary, candidate Handler, opts CanaryOptions) *Canary {
+	if opts.Equal == nil {
+		opts.Equal = reflect.DeepEqual
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultCanaryTimeout
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultCanaryConcurrency
+	}
+	return &Canary{primary: primary, candidate: candidate, opts: opts, running: make(chan struct{}, opts.Concurrency)}
+}
+
+//Name returns the primary handler's name
+func (c *Canary) Name() string {
+	return "canary:" + nameOf(c.primary, "primary", 0)
+}
+
+//Process runs both handlers, returning the primary's error
+func (c *Canary) Process(notification *pq.Notification) error {
+	return c.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs both handlers with the context, returning the primary's error
+func (c *Canary) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	_, err := c.processResultContext(ctx, notification, nil)
+	return err
+}
+
+//ProcessResult runs both handlers, returning the primary's value and error
+func (c *Canary) ProcessResult(notification *pq.Notification) (any, error) {
+	return c.processResultContext(context.Background(), notification, nil)
+}
+
+//processResultContext runs both handlers the way the client invokes handlers, so ContextHandlers receive the context and ResultConsumers the results
+func (c *Canary) processResultContext(ctx context.Context, notification *pq.Notification, results Results) (any, error) {
+	value, _, err := handle(ctx, c.primary, notification, results)
+	c.compare(ctx, notification, append(Results(nil), results...), value, err)
+	return value, err
+}
+
+//Wait blocks until every candidate run started so far has been compared, ie: before reading Stats
+func (c *Canary) Wait() {
+	c.wg.Wait()
+}
+
+//Stats returns the canary's counters
+func (c *Canary) Stats() CanaryStats {
+	return CanaryStats{
+		Compared: atomic.LoadUint64(&c.compared),
+		Diverged: atomic.LoadUint64(&c.diverged),
+		Skipped:  atomic.LoadUint64(&c.skipped),
+	}
+}
+
+//candidateOutcome is a candidate run's value and error
+type candidateOutcome struct {
+	value any
+	err   error
+}
+
+//compare runs the candidate off the delivery goroutine and compares it with the primary's value and error once it returns or times out.
+//A candidate that hangs past its timeout keeps its slot of Concurrency until it returns, so hung candidates can't pile up
+func (c *Canary) compare(ctx context.Context, notification *pq.Notification, results Results, value any, err error) {
+	select {
+	case c.running <- struct{}{}:
+	default:
+		atomic.AddUint64(&c.skipped, 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(detach(ctx), c.opts.Timeout)
+	outcome := make(chan candidateOutcome, 1)
+	c.wg.Add(1)
+	go func() {
+		defer func() { <-c.running }()
+		value, err := c.runCandidate(ctx, notification, results)
+		outcome <- candidateOutcome{value: value, err: err}
+	}()
+	go func() {
+		defer c.wg.Done()
+		defer cancel()
+		var candidate candidateOutcome
+		select {
+		case candidate = <-outcome:
+		case <-ctx.Done():
+			candidate.err = fmt.Errorf("candidate timed out after %s", c.opts.Timeout)
+		}
+		atomic.AddUint64(&c.compared, 1)
+		if (err == nil) != (candidate.err == nil) || (err != nil && err.Error() != candidate.err.Error()) || !c.opts.Equal(value, candidate.value) {
+			atomic.AddUint64(&c.diverged, 1)
+			if c.opts.OnDivergence != nil {
+				c.opts.OnDivergence(Divergence{Notification: notification, Primary: value, Candidate: candidate.value, PrimaryErr: err, CandidateErr: candidate.err})
+			}
+		}
+	}()
+}
+
+func (c *Canary) runCandidate(ctx context.Context, notification *pq.Notification, results Results) (value any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("candidate panicked: %v", r)
+		}
+	}()
+	value, _, err = handle(ctx, c.candidate, notification, results)
+	return value, err
+}
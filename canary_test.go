@@ -0,0 +1,135 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	primary := pqstream.ResultHandlerFunc(func(n *pq.Notification) (any, error) {
+		if n.Extra == "" {
+			return nil, errors.New("empty payload")
+		}
+		return strings.ToUpper(n.Extra), nil
+	})
+	candidate := pqstream.ResultHandlerFunc(func(n *pq.Notification) (any, error) {
+		switch n.Extra {
+		case "bob":
+			return "Bob", nil
+		case "panic":
+			panic("unexpected payload")
+		case "":
+			return nil, errors.New("empty payload")
+		}
+		return strings.ToUpper(n.Extra), nil
+	})
+	var divergences []pqstream.Divergence
+	canary := pqstream.NewCanary(primary, candidate, pqstream.CanaryOptions{
+		OnDivergence: func(d pqstream.Divergence) {
+			divergences = append(divergences, d)
+		},
+	})
+	for _, payload := range []string{"alice", "bob", "", "panic"} {
+		value, err := canary.ProcessResult(&pq.Notification{Extra: payload})
+		canary.Wait()
+		if payload == "" {
+			if err == nil {
+				t.Fatal("expected the primary's error")
+			}
+			continue
+		}
+		if value != strings.ToUpper(payload) {
+			t.Fatalf("expected the primary's value, got: %v", value)
+		}
+	}
+	if stats := canary.Stats(); stats.Compared != 4 || stats.Diverged != 2 {
+		t.Fatalf("unexpected canary stats: %+v", stats)
+	}
+	if divergences[0].Candidate != "Bob" || divergences[1].CandidateErr == nil {
+		t.Fatalf("unexpected divergences: %+v", divergences)
+	}
+}
+
+func TestCanaryPassesContext(t *testing.T) {
+	primary, candidate := &contextRecorder{}, &contextRecorder{}
+	canary := pqstream.NewCanary(primary, candidate, pqstream.CanaryOptions{})
+	ctx := context.WithValue(context.Background(), bulkheadKey{}, "traced")
+	if err := canary.ProcessContext(ctx, &pq.Notification{Channel: "users"}); err != nil {
+		t.Fatal(err)
+	}
+	canary.Wait()
+	if primary.value != "traced" || candidate.value != "traced" {
+		t.Fatalf("expected both handlers to receive the context, got %v and %v", primary.value, candidate.value)
+	}
+}
+
+func TestCanaryResultsAndTimeout(t *testing.T) {
+	produced := pqstream.ResultHandlerFunc(func(n *pq.Notification) (any, error) {
+		return "ada", nil
+	})
+	var mu sync.Mutex
+	var got []string
+	consumer := func(name string) pqstream.Handler {
+		return pqstream.ResultConsumerFunc(func(n *pq.Notification, results pqstream.Results) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, r := range results {
+				got = append(got, name+"="+fmt.Sprint(r.Value))
+			}
+			return nil
+		})
+	}
+	release := make(chan struct{})
+	var divergences []pqstream.Divergence
+	canary := pqstream.NewCanary(consumer("primary"), consumer("candidate"), pqstream.CanaryOptions{Timeout: 20 * time.Millisecond})
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers:     []pqstream.Handler{produced},
+		PostHandlers: []pqstream.Handler{canary},
+		ErrorHandler: func(err error) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Process(&pq.Notification{Channel: "users"})
+	canary.Wait()
+	sort.Strings(got)
+	if strings.Join(got, ",") != "candidate=ada,primary=ada" || canary.Stats().Diverged != 0 {
+		t.Fatalf("expected both handlers to receive the results, got %v and %+v", got, canary.Stats())
+	}
+
+	slow := pqstream.NewCanary(pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil }), pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		<-release
+		return nil
+	}), pqstream.CanaryOptions{
+		Timeout:      20 * time.Millisecond,
+		Concurrency:  1,
+		OnDivergence: func(d pqstream.Divergence) { divergences = append(divergences, d) },
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slow.Process(&pq.Notification{Channel: "users"})
+		slow.Process(&pq.Notification{Channel: "users"})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected a slow candidate not to hold back the primary")
+	}
+	slow.Wait()
+	close(release)
+	if stats := slow.Stats(); stats.Compared != 1 || stats.Diverged != 1 || stats.Skipped != 1 {
+		t.Fatalf("expected the slow candidate to time out and the next one to be skipped, got %+v", stats)
+	}
+	if len(divergences) != 1 || !strings.Contains(divergences[0].CandidateErr.Error(), "timed out") {
+		t.Fatalf("unexpected divergences: %+v", divergences)
+	}
+}
@@ -0,0 +1,108 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ErrUnsupported is returned by features the connected server can't provide
+var ErrUnsupported = errors.New("not supported by the server")
+
+//Feature is an optional server capability the library can use
+type Feature string
+
+const (
+	//FeatureQueueUsage is pg_notification_queue_usage(), reporting how full the server's NOTIFY queue is. Postgres 9.5+
+	FeatureQueueUsage Feature = "notify_queue_usage"
+	//FeaturePartitioning is declarative table partitioning, used by AuditSink. Postgres 10+
+	FeaturePartitioning Feature = "partitioning"
+	//FeatureLogicalReplication is logical decoding, available on postgres 10+ with wal_level = logical
+	FeatureLogicalReplication Feature = "logical_replication"
+	//FeatureNotify is LISTEN and NOTIFY, which a server in recovery rejects
+	FeatureNotify Feature = "notify"
+)
+
+//Capabilities describes the server a client is connected to: its version, installed extensions and the optional features it supports
+type Capabilities struct {
+	//Version is the server's version string, ie: 15.4
+	Version string `json:"version"`
+	//VersionNum is the server's numeric version, ie: 150004
+	VersionNum int               `json:"version_num"`
+	InRecovery bool              `json:"in_recovery"`
+	WALLevel   string            `json:"wal_level"`
+	Extensions map[string]string `json:"extensions"`
+	Features   map[Feature]bool  `json:"features"`
+	DetectedAt time.Time         `json:"detected_at"`
+}
+
+//Has reports whether the server supports a feature
+func (c *Capabilities) Has(feature Feature) bool {
+	return c != nil && c.Features[feature]
+}
+
+//Extension returns the installed version of an extension, ie: postgis
+func (c *Capabilities) Extension(name string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	v, ok := c.Extensions[name]
+	return v, ok
+}
+
+//DetectCapabilities reads the server's version, recovery state, wal_level and installed extensions
+func DetectCapabilities(ctx context.Context, db *sql.DB) (*Capabilities, error) {
+	caps := &Capabilities{Extensions: map[string]string{}, Features: map[Feature]bool{}, DetectedAt: time.Now()}
+	err := db.QueryRowContext(ctx, "SELECT current_setting('server_version'), current_setting('server_version_num')::int, pg_is_in_recovery(), current_setting('wal_level')").
+		Scan(&caps.Version, &caps.VersionNum, &caps.InRecovery, &caps.WALLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect server version! %s", err.Error())
+	}
+	rows, err := db.QueryContext(ctx, "SELECT extname, extversion FROM pg_extension")
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect extensions! %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, err
+		}
+		caps.Extensions[name] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	caps.Features[FeatureQueueUsage] = caps.VersionNum >= 90500
+	caps.Features[FeaturePartitioning] = caps.VersionNum >= 100000
+	caps.Features[FeatureLogicalReplication] = caps.VersionNum >= 100000 && caps.WALLevel == "logical"
+	caps.Features[FeatureNotify] = !caps.InRecovery
+	return caps, nil
+}
+
+//QueueUsage returns the fraction of the server's NOTIFY queue in use. When it approaches 1, a slow listener is about to make NOTIFY fail for every producer
+func (c *Capabilities) QueueUsage(ctx context.Context, db *sql.DB) (float64, error) {
+	if !c.Has(FeatureQueueUsage) {
+		return 0, ErrUnsupported
+	}
+	var usage float64
+	if err := db.QueryRowContext(ctx, "SELECT pg_notification_queue_usage()").Scan(&usage); err != nil {
+		return 0, fmt.Errorf("failed to read notification queue usage! %s", err.Error())
+	}
+	return usage, nil
+}
+
+//Capabilities returns what the client detected about its server when it last connected, or nil before it has connected
+func (c *Client) Capabilities() *Capabilities {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities
+}
+
+func (c *Client) setCapabilities(caps *Capabilities) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capabilities = caps
+}
@@ -0,0 +1,50 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	var missing *pqstream.Capabilities
+	if missing.Has(pqstream.FeatureNotify) {
+		t.Fatal("expected undetected capabilities to support nothing")
+	}
+	if _, err := missing.QueueUsage(context.Background(), nil); err != pqstream.ErrUnsupported {
+		t.Fatalf("expected queue usage to be unsupported, got %v", err)
+	}
+	caps := &pqstream.Capabilities{
+		VersionNum: 90400,
+		Extensions: map[string]string{"postgis": "3.4.0"},
+		Features:   map[pqstream.Feature]bool{pqstream.FeatureNotify: true},
+	}
+	if v, ok := caps.Extension("postgis"); !ok || v != "3.4.0" {
+		t.Fatalf("expected postgis to be detected, got %q", v)
+	}
+	if !caps.Has(pqstream.FeatureNotify) || caps.Has(pqstream.FeatureQueueUsage) {
+		t.Fatal("unexpected feature set")
+	}
+
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.Capabilities() != nil {
+		t.Fatal("expected no capabilities before connecting")
+	}
+	server := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/capabilities")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Fatalf("expected capabilities to be unavailable before connecting, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,133 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"sync"
+	"time"
+)
+
+//captureVersion is the version of the capture file format written by Client.Capture
+const captureVersion = 1
+
+//A CaptureHeader is the first line of a capture file: the client configuration the notifications were captured under. Credentials are never captured
+type CaptureHeader struct {
+	Version      int               `json:"capture_version"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Channels     []string          `json:"channels"`
+	InstanceID   string            `json:"instance_id"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Host         string            `json:"host"`
+	Database     string            `json:"database"`
+	User         string            `json:"user"`
+	Workers      int               `json:"workers,omitempty"`
+	MaxAge       time.Duration     `json:"max_age,omitempty"`
+	LagThreshold time.Duration     `json:"lag_threshold,omitempty"`
+	DryRun       bool              `json:"dry_run,omitempty"`
+}
+
+//A Capture records every notification a client receives, in order, into a portable capture file that Replayer and the pqstream replay command can reproduce
+type Capture struct {
+	client *Client
+	mu     sync.Mutex
+	enc    *json.Encoder
+	count  int
+	err    error
+	closed bool
+}
+
+//Capture starts recording every notification the client receives to w as NDJSON: a CaptureHeader line followed by one Record per notification.
+//Wrap w in a gzip.Writer and name the file .gz to compress it. Only one capture can run at a time
+func (c *Client) Capture(w io.Writer) (*Capture, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capture != nil {
+		return nil, errors.New("capture already running")
+	}
+	header := CaptureHeader{
+		Version:      captureVersion,
+		CreatedAt:    c.config.Clock.Now().UTC(),
+		Channels:     append([]string{}, c.channels...),
+		InstanceID:   c.config.InstanceID,
+		Labels:       c.identity.Labels,
+		Host:         c.config.Host,
+		Database:     c.config.Database,
+		User:         c.config.User,
+		Workers:      c.workers.size,
+		MaxAge:       c.config.MaxAge,
+		LagThreshold: c.config.LagThreshold,
+		DryRun:       c.config.DryRun,
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return nil, fmt.Errorf("failed to write capture header! %s", err.Error())
+	}
+	c.capture = &Capture{client: c, enc: enc}
+	return c.capture, nil
+}
+
+//Count returns the number of notifications captured so far
+func (cp *Capture) Count() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.count
+}
+
+//Stop stops capturing, returning the first error writing the capture, if any. It does not close the underlying writer
+func (cp *Capture) Stop() error {
+	cp.client.mu.Lock()
+	if cp.client.capture == cp {
+		cp.client.capture = nil
+	}
+	cp.client.mu.Unlock()
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.closed = true
+	return cp.err
+}
+
+func (cp *Capture) record(n *pq.Notification, at time.Time) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed || cp.err != nil {
+		return
+	}
+	if err := cp.enc.Encode(NewRecord(n, at)); err != nil {
+		cp.err = err
+		return
+	}
+	cp.count++
+}
+
+//captured returns the running capture, if any
+func (c *Client) captured() *Capture {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capture
+}
+
+//OpenCapture opens a capture file, returning its header and a reader positioned at its first Record
+func OpenCapture(path string) (*CaptureHeader, *RecordReader, error) {
+	return OpenEncryptedCapture(path, nil)
+}
+
+//OpenEncryptedCapture opens a capture file like OpenCapture, decrypting it with the cipher if its name ends in .enc, ie: one written through FileCipher.Writer
+func OpenEncryptedCapture(path string, c *FileCipher) (*CaptureHeader, *RecordReader, error) {
+	reader, err := OpenEncryptedRecords(path, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := &CaptureHeader{}
+	if err := reader.dec.Decode(header); err != nil {
+		reader.Close()
+		return nil, nil, fmt.Errorf("failed to read capture header! %s", err.Error())
+	}
+	if header.Version == 0 || header.Version > captureVersion {
+		reader.Close()
+		return nil, nil, fmt.Errorf("unsupported capture version: %d", header.Version)
+	}
+	return header, reader, nil
+}
@@ -0,0 +1,71 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{
+		InstanceID: "capture-test",
+		Password:   "secret",
+		Labels:     map[string]string{"region": "us-east-1"},
+	}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "bug.ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	capture, err := client.Capture(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := client.Capture(f); err == nil {
+		t.Fatal("expected a second concurrent capture to fail")
+	}
+	for _, payload := range []string{"1", "2", "3"} {
+		client.Process(&pq.Notification{Channel: "users", Extra: payload})
+	}
+	if err := capture.Stop(); err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "4"})
+	f.Close()
+	if capture.Count() != 3 {
+		t.Fatalf("expected 3 captured notifications, got %d", capture.Count())
+	}
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "secret") {
+		t.Fatal("capture must not contain credentials")
+	}
+
+	header, reader, err := pqstream.OpenCapture(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer reader.Close()
+	if header.InstanceID != "capture-test" || header.Labels["region"] != "us-east-1" || len(header.Channels) != 1 {
+		t.Fatalf("unexpected capture header: %+v", header)
+	}
+	var replayed []string
+	n, err := (&pqstream.Replayer{}).Replay(context.Background(), pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		replayed = append(replayed, n.Extra)
+		return nil
+	}), reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 3 || strings.Join(replayed, ",") != "1,2,3" {
+		t.Fatalf("expected the captured sequence to replay in order, got %v", replayed)
+	}
+}
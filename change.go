@@ -0,0 +1,171 @@
+package pqstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"reflect"
+	"sort"
+)
+
+//Op is the kind of row change a trigger reports
+type Op string
+
+const (
+	//OpInsert is a change event for an inserted row, with only a new row
+	OpInsert Op = "INSERT"
+	//OpUpdate is a change event for an updated row, with both an old and a new row
+	OpUpdate Op = "UPDATE"
+	//OpDelete is a change event for a deleted row, with only an old row
+	OpDelete Op = "DELETE"
+)
+
+//A Row is a table row keyed by column name. Numbers decode as json.Number so bigint keys keep their precision
+type Row map[string]any
+
+//UnmarshalJSON decodes a row, keeping numbers as json.Number
+func (r *Row) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	*r = m
+	return nil
+}
+
+//A ChangeEvent is the conventional payload of a row-level trigger, ie: {"schema": "public", "table": "users", "op": "UPDATE", "old": {...}, "new": {...}}.
+//Within a ContextHandler, Decoded[*ChangeEvent] shares one parsed event between handlers. Truncated events, from a trigger installed with EnsureTriggers whose
+//rows were too large to notify, only carry the rows' keys
+type ChangeEvent struct {
+	//ID is generated by the trigger's IDFunction, if it has one
+	ID string `json:"id,omitempty"`
+	//TraceParent and Baggage are the writing transaction's trace context, from a trigger installed with TriggerSpec.Trace
+	TraceParent string `json:"traceparent,omitempty"`
+	Baggage     string `json:"baggage,omitempty"`
+	Schema      string `json:"schema,omitempty"`
+	Table       string `json:"table"`
+	Op          Op     `json:"op"`
+	Old         Row    `json:"old,omitempty"`
+	New         Row    `json:"new,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	//Types are the ColumnTypes of the rows' columns, from the trigger, that a PGCodec converts them by
+	Types map[string]ColumnType `json:"types,omitempty"`
+	//Seq is the channel's sequence number, from a trigger installed with TriggerSpec.SequenceTable
+	Seq int64 `json:"seq,omitempty"`
+}
+
+//FieldChange is a single column's value before and after a change. Before is nil for inserts and After is nil for deletes
+type FieldChange struct {
+	Column string `json:"column"`
+	Before any    `json:"before"`
+	After  any    `json:"after"`
+}
+
+//ParseChange decodes a notification's payload as a ChangeEvent
+func ParseChange(notification *pq.Notification) (*ChangeEvent, error) {
+	if notification == nil {
+		return nil, errors.New("empty notification")
+	}
+	e := &ChangeEvent{}
+	if err := DecodeJSON(notification, e); err != nil {
+		return nil, err
+	}
+	if e.Table == "" || e.Op == "" {
+		return nil, errors.New("payload is not a change event")
+	}
+	return e, nil
+}
+
+//QualifiedTable returns the event's table prefixed with its schema, if it has one
+func (e *ChangeEvent) QualifiedTable() string {
+	if e.Schema == "" {
+		return e.Table
+	}
+	return e.Schema + "." + e.Table
+}
+
+//Diff returns the columns whose values differ between the old and new rows, sorted by column. Every column of an inserted or deleted row counts as changed
+func (e *ChangeEvent) Diff() []FieldChange {
+	columns := map[string]bool{}
+	for column := range e.Old {
+		columns[column] = true
+	}
+	for column := range e.New {
+		columns[column] = true
+	}
+	var changes []FieldChange
+	for column := range columns {
+		before, after := e.Old[column], e.New[column]
+		if e.Op == OpUpdate && reflect.DeepEqual(before, after) {
+			continue
+		}
+		changes = append(changes, FieldChange{Column: column, Before: before, After: after})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Column < changes[j].Column })
+	return changes
+}
+
+//Changed reports whether any of the columns changed
+func (e *ChangeEvent) Changed(columns ...string) bool {
+	for _, column := range columns {
+		before, hadBefore := e.Old[column]
+		after, hasAfter := e.New[column]
+		if hadBefore != hasAfter || !reflect.DeepEqual(before, after) {
+			return true
+		}
+	}
+	return false
+}
+
+//ColumnsChanged returns a filter that only passes updates changing at least one of the listed columns. Columns are keyed by channel, schema qualified table or bare table,
+//checked in that order. Inserts, deletes, payloads that aren't change events and tables without listed columns always pass
+func ColumnsChanged(columns map[string][]string) FilterFunc {
+	return func(notification *pq.Notification) bool {
+		e, err := ParseChange(notification)
+		if err != nil || e.Op != OpUpdate {
+			return true
+		}
+		for _, key := range []string{notification.Channel, e.QualifiedTable(), e.Table} {
+			if cols, ok := columns[key]; ok {
+				return e.Changed(cols...)
+			}
+		}
+		return true
+	}
+}
+
+type filteredHandler struct {
+	handler Handler
+	filter  FilterFunc
+}
+
+//Filtered wraps a handler so it only runs on notifications passing the filter, ie: Filtered(handler, ColumnsChanged(map[string][]string{"users": {"status"}}))
+func Filtered(handler Handler, filter FilterFunc) Handler {
+	return &filteredHandler{handler: handler, filter: filter}
+}
+
+func (f *filteredHandler) Name() string {
+	return nameOf(f.handler, "filtered", 0)
+}
+
+func (f *filteredHandler) Process(notification *pq.Notification) error {
+	if !f.filter(notification) {
+		return nil
+	}
+	return f.handler.Process(notification)
+}
+
+func (f *filteredHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if !f.filter(notification) {
+		traceFrom(ctx).record(TraceEvent{Stage: TraceFiltered, Handler: f.Name()})
+		return nil
+	}
+	if h, ok := f.handler.(ContextHandler); ok {
+		return h.ProcessContext(ctx, notification)
+	}
+	return f.handler.Process(notification)
+}
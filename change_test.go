@@ -0,0 +1,63 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestChangeDiff(t *testing.T) {
+	e, err := pqstream.ParseChange(&pq.Notification{Extra: `{"schema": "public", "table": "users", "op": "UPDATE",
+		"old": {"id": 9007199254740993, "status": "pending", "meta": {"a": 1}, "email": "bob@example.com"},
+		"new": {"id": 9007199254740993, "status": "active", "meta": {"a": 1}, "email": null}}`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.QualifiedTable() != "public.users" {
+		t.Fatalf("unexpected table: %s", e.QualifiedTable())
+	}
+	diff := e.Diff()
+	if len(diff) != 2 || diff[0].Column != "email" || diff[0].After != nil || diff[1].Column != "status" || diff[1].Before != "pending" || diff[1].After != "active" {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+	if e.New["id"] != json.Number("9007199254740993") {
+		t.Fatalf("expected ids to keep their precision, got: %v", e.New["id"])
+	}
+	if !e.Changed("status") || e.Changed("id", "meta") {
+		t.Fatal("unexpected column changes")
+	}
+
+	inserted, err := pqstream.ParseChange(&pq.Notification{Extra: `{"table": "users", "op": "INSERT", "new": {"id": 1}}`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if diff := inserted.Diff(); len(diff) != 1 || diff[0].Before != nil || !inserted.Changed("id") {
+		t.Fatalf("expected every inserted column to change, got: %+v", diff)
+	}
+	if _, err := pqstream.ParseChange(&pq.Notification{Extra: `{"id": 1}`}); err == nil {
+		t.Fatal("expected an error parsing a payload that isn't a change event")
+	}
+}
+
+func TestColumnsChanged(t *testing.T) {
+	var handled []string
+	handler := pqstream.Filtered(pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		handled = append(handled, n.Extra)
+		return nil
+	}), pqstream.ColumnsChanged(map[string][]string{"public.users": {"status"}}))
+	for _, payload := range []string{
+		`{"schema": "public", "table": "users", "op": "UPDATE", "old": {"status": "a", "seen": 1}, "new": {"status": "a", "seen": 2}}`,
+		`{"schema": "public", "table": "users", "op": "UPDATE", "old": {"status": "a"}, "new": {"status": "b"}}`,
+		`{"schema": "public", "table": "users", "op": "INSERT", "new": {"status": "a"}}`,
+		`{"schema": "public", "table": "orders", "op": "UPDATE", "old": {"seen": 1}, "new": {"seen": 2}}`,
+		`not a change`,
+	} {
+		if err := handler.Process(&pq.Notification{Channel: "changes", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(handled) != 4 {
+		t.Fatalf("expected only the irrelevant update to be filtered, handled: %v", handled)
+	}
+}
@@ -0,0 +1,233 @@
+package pqstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//fileCipherMagic starts every encrypted file, followed by its format version and a random file ID
+const fileCipherMagic = "PQSE"
+
+//fileIDSize is the length of the random file ID each file's key is derived from
+const fileIDSize = 16
+
+//finalChunk marks the length prefix of the last chunk of an encrypted file, so truncation is detected
+const finalChunk = 1 << 31
+
+//maxCipherChunk bounds the plaintext sealed in one chunk. Larger writes are split, and a reader refuses a longer chunk before allocating it
+const maxCipherChunk = 1 << 20
+
+//A FileCipher encrypts the files the library writes to disk, ie: FileSink output and captures, which may hold row data that otherwise only lives inside postgres.
+//Files are a sequence of AES-GCM sealed chunks, one per write, authenticated with the file's ID and their position so chunks can't be reordered, swapped between files or truncated unnoticed.
+//Each file is sealed with its own key, derived from the cipher's key and the file's ID with HKDF-SHA256, and its chunks' nonces count up from zero, so no nonce is reused under a key
+type FileCipher struct {
+	key []byte
+}
+
+//NewFileCipher returns a cipher for a 16, 24 or 32 byte AES key
+func NewFileCipher(key []byte) (*FileCipher, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("invalid file key! %s", err.Error())
+	}
+	return &FileCipher{key: append([]byte{}, key...)}, nil
+}
+
+//fileAEAD returns the AES-GCM cipher for the file with the given ID
+func (c *FileCipher) fileAEAD(id []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(c.key, id, []byte("pqstream file cipher"), len(c.key)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//hkdf derives a size byte key from secret, salt and info as described by RFC 5869, for sizes up to sha256.Size
+func hkdf(secret, salt, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:size]
+}
+
+//chunkNonce is the nonce of a file's index'th chunk
+func chunkNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+//ParseFileKey decodes a hex or base64 encoded key, ie: from an environment variable or secret file
+func ParseFileKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("file key must be hex or base64 encoded")
+}
+
+//Writer returns a writer encrypting to w. Each Write is sealed as its own chunks, so everything written survives a crash. Close writes the final chunk but doesn't close w
+func (c *FileCipher) Writer(w io.Writer) io.WriteCloser {
+	return &cipherWriter{cipher: c, w: w}
+}
+
+//Reader returns a reader decrypting r. It fails with io.ErrUnexpectedEOF if r ends before the final chunk, after returning every chunk before it
+func (c *FileCipher) Reader(r io.Reader) io.Reader {
+	return &cipherReader{cipher: c, r: r}
+}
+
+//chunkData binds a chunk to its file, position and whether it is the last one
+func chunkData(id []byte, index uint64, final bool) []byte {
+	data := make([]byte, len(id)+9)
+	copy(data, id)
+	binary.BigEndian.PutUint64(data[len(id):], index)
+	if final {
+		data[len(data)-1] = 1
+	}
+	return data
+}
+
+type cipherWriter struct {
+	cipher *FileCipher
+	w      io.Writer
+	aead   cipher.AEAD
+	id     []byte
+	index  uint64
+	closed bool
+}
+
+func (w *cipherWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed cipher writer")
+	}
+	for written := 0; written < len(p); written += maxCipherChunk {
+		chunk := p[written:]
+		if len(chunk) > maxCipherChunk {
+			chunk = chunk[:maxCipherChunk]
+		}
+		if err := w.seal(chunk, false); err != nil {
+			return written, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *cipherWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(nil, true)
+}
+
+func (w *cipherWriter) seal(p []byte, final bool) error {
+	if w.id == nil {
+		id := make([]byte, fileIDSize)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		aead, err := w.cipher.fileAEAD(id)
+		if err != nil {
+			return err
+		}
+		header := append([]byte(fileCipherMagic+"\x01"), id...)
+		if _, err := w.w.Write(header); err != nil {
+			return err
+		}
+		w.id, w.aead = id, aead
+	}
+	chunk := make([]byte, 4, 4+len(p)+w.aead.Overhead())
+	chunk = w.aead.Seal(chunk, chunkNonce(w.aead, w.index), p, chunkData(w.id, w.index, final))
+	size := uint32(len(chunk) - 4)
+	if final {
+		size |= finalChunk
+	}
+	binary.BigEndian.PutUint32(chunk, size)
+	w.index++
+	_, err := w.w.Write(chunk)
+	return err
+}
+
+type cipherReader struct {
+	cipher *FileCipher
+	r      io.Reader
+	aead   cipher.AEAD
+	id     []byte
+	index  uint64
+	buf    []byte
+	done   bool
+}
+
+func (r *cipherReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+//open reads and authenticates the next chunk
+func (r *cipherReader) open() error {
+	if r.id == nil {
+		header := make([]byte, len(fileCipherMagic)+1+fileIDSize)
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			return fmt.Errorf("failed to read encrypted file header! %s", err.Error())
+		}
+		if string(header[:len(fileCipherMagic)]) != fileCipherMagic || header[len(fileCipherMagic)] != 1 {
+			return errors.New("not an encrypted file")
+		}
+		id := header[len(fileCipherMagic)+1:]
+		aead, err := r.cipher.fileAEAD(id)
+		if err != nil {
+			return err
+		}
+		r.id, r.aead = id, aead
+	}
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, prefix); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(prefix)
+	final := size&finalChunk != 0
+	size &^= finalChunk
+	if size > maxCipherChunk+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("failed to decrypt chunk %d! chunk of %d bytes exceeds the %d byte limit", r.index, size, maxCipherChunk)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.aead, r.index), sealed, chunkData(r.id, r.index, final))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d! %s", r.index, err.Error())
+	}
+	r.index++
+	r.buf, r.done = plain, final
+	return nil
+}
@@ -0,0 +1,124 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCipher(t *testing.T) *pqstream.FileCipher {
+	key, err := pqstream.ParseFileKey("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c, err := pqstream.NewFileCipher(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return c
+}
+
+func TestFileCipher(t *testing.T) {
+	c := testCipher(t)
+	var buf bytes.Buffer
+	w := c.Writer(&buf)
+	for _, line := range []string{"first\n", "second\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	partial := append([]byte{}, buf.Bytes()...)
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Contains(buf.Bytes(), []byte("first")) {
+		t.Fatal("expected the output to be encrypted")
+	}
+	plain, err := io.ReadAll(c.Reader(bytes.NewReader(buf.Bytes())))
+	if err != nil || string(plain) != "first\nsecond\n" {
+		t.Fatalf("unexpected decryption: %q %v", plain, err)
+	}
+	plain, err = io.ReadAll(c.Reader(bytes.NewReader(partial)))
+	if err != io.ErrUnexpectedEOF || string(plain) != "first\nsecond\n" {
+		t.Fatalf("expected the chunks before a truncation and an error, got: %q %v", plain, err)
+	}
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := io.ReadAll(c.Reader(bytes.NewReader(tampered))); err == nil {
+		t.Fatal("expected tampering to be detected")
+	}
+	if _, err := pqstream.NewFileCipher([]byte("short")); err == nil {
+		t.Fatal("expected an invalid key size to fail")
+	}
+}
+
+func TestFileCipherChunkLimit(t *testing.T) {
+	c := testCipher(t)
+	var buf bytes.Buffer
+	w := c.Writer(&buf)
+	large := bytes.Repeat([]byte("x"), 3<<20)
+	if n, err := w.Write(large); err != nil || n != len(large) {
+		t.Fatalf("unexpected write: %d %v", n, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	plain, err := io.ReadAll(c.Reader(bytes.NewReader(buf.Bytes())))
+	if err != nil || !bytes.Equal(plain, large) {
+		t.Fatalf("unexpected decryption of %d bytes: %v", len(plain), err)
+	}
+	forged := append([]byte{}, buf.Bytes()[:21]...)
+	forged = append(forged, 0x7f, 0xff, 0xff, 0xff)
+	if _, err := io.ReadAll(c.Reader(bytes.NewReader(forged))); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected an oversized chunk to be refused, got %v", err)
+	}
+}
+
+func TestEncryptedFileSink(t *testing.T) {
+	c := testCipher(t)
+	dir := t.TempDir()
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, MaxAge: time.Minute, Gzip: true, Cipher: c, Clock: clock})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"a", "b"} {
+		payload := `{"table": "users", "op": "UPDATE", "new": {"id": 1, "name": "` + name + `"}}`
+		if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+		clock.Advance(time.Minute)
+	}
+	stats, err := sink.Compact(pqstream.CompactOptions{Keys: pqstream.NewKeyRegistry().Register("users", "id"), Clock: clock})
+	if err != nil || stats.Dropped != 0 || stats.Kept != 1 {
+		t.Fatalf("unexpected compaction: %+v %v", stats, err)
+	}
+	sink.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "pqstream-*.ndjson.gz.enc"))
+	if len(files) != 2 {
+		t.Fatalf("expected encrypted files, got: %v", files)
+	}
+	raw, _ := os.ReadFile(files[1])
+	if bytes.Contains(raw, []byte("users")) {
+		t.Fatal("expected the file to be encrypted")
+	}
+	if _, err := pqstream.OpenRecords(files[1]); err == nil {
+		t.Fatal("expected opening an encrypted file without a cipher to fail")
+	}
+	reader, err := pqstream.OpenEncryptedRecords(files[1], c)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer reader.Close()
+	r, err := reader.Next()
+	if err != nil || !strings.Contains(r.Payload, `"b"`) {
+		t.Fatalf("unexpected record: %+v %v", r, err)
+	}
+}
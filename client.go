@@ -3,10 +3,11 @@
 package pqstream
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -19,9 +20,18 @@ type Handler interface {
 	Process(notification *pq.Notification) error
 }
 
+//A ContextHandler is a Handler that also receives a context carrying per-notification state, such as its trace
+type ContextHandler interface {
+	Handler
+	ProcessContext(ctx context.Context, notification *pq.Notification) error
+}
+
 //ErrHandlerFunc handles an error in any way
 type ErrHandlerFunc func(err error)
 
+//LagHandlerFunc is called when a channel's consumer lag exceeds Config.LagThreshold
+type LagHandlerFunc func(channel string, lag time.Duration)
+
 //A HandlerFunc is a first class function that satisfies the Handler interface(think http.HandlerFunc)
 type HandlerFunc func(notification *pq.Notification) error
 
@@ -48,7 +58,120 @@ type Config struct {
 	SSLRootCert  string
 	MaxOpenConns int
 	MaxIdleConns int
-	Verbose      bool
+	//Budget admits every postgres connection the client opens, shared with the DBs opened with its Open, so the library can't exhaust max_connections
+	Budget  *ConnectionBudget
+	Verbose bool
+
+	//InstanceID identifies this client in Stats and across a fleet of consumers. Defaults to hostname-pid
+	InstanceID string
+	//Labels further identify this client, ie: region or version, and are attached to its logs, stats and traces along with InstanceID
+	Labels map[string]string
+	//LagThreshold is the consumer lag above which HandlerSet.LagHandler is called. Zero disables the alert
+	LagThreshold time.Duration
+	//TraceWriter receives a JSON line for every stage a sampled notification passes through. Nil disables tracing
+	TraceWriter io.Writer
+	//TraceSampleRate is the fraction (0, 1] of notifications traced when TraceWriter is set. Defaults to 1
+	TraceSampleRate float64
+	//Clock is the source of time for ping timers, lag and tracing. Defaults to SystemClock
+	Clock Clock
+	//Workers is the number of handlers running at once across all channels. Defaults to 4 * GOMAXPROCS. A client with a single handler and no pre
+	//or post handlers runs it inline on the goroutine draining the channel's queue instead, unless the channel has ChannelWorkers, skipping the hand off
+	//but still counting against Workers
+	Workers int
+	//ChannelWorkers caps the number of handlers running at once for individual channels
+	ChannelWorkers map[string]int
+	//QueueSize is the capacity of each channel's queue. Defaults to 64
+	QueueSize int
+	//Ordering is how each channel's notifications are processed. Defaults to OrderingStrict
+	Ordering Ordering
+	//Overflow is what happens to notifications arriving at a full queue. Defaults to OverflowBlock
+	Overflow OverflowPolicy
+	//SpillLimit bounds the notifications OverflowSpill holds in memory per channel. Defaults to 1024
+	SpillLimit int
+	//Delivery is the guarantee the client makes about each notification. Defaults to DeliveryAtLeastOnce
+	Delivery Delivery
+	//MaxAge skips notifications whose envelope was emitted longer ago than this when dispatch begins, ie: after a long outage or a replay,
+	//passing them to HandlerSet.StaleHandler instead of running time-sensitive handlers. Zero disables the check
+	MaxAge time.Duration
+	//DryRun passes a dry-run context to handlers and pipelines: built-in sinks log what they would write instead of writing, and ContextHandlers can check IsDryRun
+	DryRun bool
+	//Standby starts the client as a warm standby: it connects and LISTENs but only buffers notifications until Promote is called
+	Standby bool
+	//StandbyBuffer is the number of notifications a standby holds before dropping the oldest. Defaults to 10000
+	StandbyBuffer int
+	//StandbyLockKey starts the client as a standby that promotes itself once it holds this postgres session advisory lock, so the first instance to start
+	//becomes active and a standby takes over when the active instance's connection is lost. Zero disables lock based promotion
+	StandbyLockKey int64
+	//StandbyLockInterval is how often a standby tries to take the StandbyLockKey lock. Defaults to 5s
+	StandbyLockInterval time.Duration
+	//Preflight checks the role has the privileges the client and Requirements need before Start listens, failing with a *PreflightError instead of mid-stream
+	Preflight bool
+	//ReadOnly guarantees the client never writes: its sessions default to read-only transactions, which Start verifies, and built-in sinks, checkpoints,
+	//heartbeats, handoffs and migrations refuse to run with ErrReadOnly. For use against replicas or restricted roles
+	ReadOnly bool
+	//StatementTimeout and LockTimeout are set as the statement_timeout and lock_timeout of every session opened with ConnInfo, so the library's own queries,
+	//ie: catch-up, checkpoints and staged payload fetches, fail instead of wedging the notification loop behind a locked table. Open the DBs of sinks
+	//and stages with ConnInfo for their queries to honor them too. Zero keeps the server's setting
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	//WriteUser and WritePassword are the role the client writes as, so User only needs to LISTEN and SELECT: checkpoints are written through a connection of
+	//its own, and sinks, stores and trigger installs should open their DBs with WriteConnInfo. Preflight checks each requirement against the role it's
+	//used by. An empty WriteUser writes as User
+	WriteUser     string
+	WritePassword string
+	//DebugRate is the number of debug lines per second logged for each channel enabled with EnableDebug. Defaults to 5
+	DebugRate float64
+	//Hosts are the other host or host:port members of the cluster. The client connects to the first of Host and Hosts that is a primary, and a watcher
+	//reconnects it to the new primary when its server enters recovery or becomes unreachable
+	Hosts []string
+	//FailoverInterval is how often the failover watcher checks the server. Defaults to 10s
+	FailoverInterval time.Duration
+	//Requirements are the privileges the client's sinks and helpers need, ie: from their Requirements methods, checked when Preflight is set
+	Requirements []Requirement
+	//Aliases maps a channel to other names it is also listened on, ie: its old name during a rename. Notifications on an alias are processed as the channel's,
+	//and one already received under another of the channel's names is dropped, so producers can send on both names while they are rolled out
+	Aliases map[string][]string
+	//AliasDedupSize is the number of recent notifications per aliased channel remembered to drop duplicates. Defaults to 10000
+	AliasDedupSize int
+	//Outbox makes delivery durable: notifications are sent through an outbox table, caught up on after every reconnect and retried until their handlers succeed
+	Outbox *Outbox
+	//Bulkheads runs each of HandlerSet.Handlers in its own Bulkhead sized by these options, so one slow or failing handler can't hold back the others.
+	//It can't be combined with Outbox, which would checkpoint notifications once queued rather than once handled
+	Bulkheads *BulkheadOptions
+	//Escalation classifies errors and decides, per class, whether they are retried, reported, pause their channel, alert or stop the client
+	Escalation *EscalationPolicy
+	//FailFastOnFatal makes Start return a *FatalError instead of retrying forever when the client hits an unrecoverable condition: authentication or privilege
+	//failures, a channel it can't listen on or MaxReconnectAttempts failed reconnects in a row. For orchestrators that restart failed processes
+	FailFastOnFatal bool
+	//MaxReconnectAttempts is the number of failed reconnect attempts in a row FailFastOnFatal tolerates. Defaults to 5
+	MaxReconnectAttempts int
+	//Logger receives the client's log lines, and the errors the default ErrorHandler reports, instead of the global log package
+	Logger Logger
+	//Handover writes the client's position on each channel when it stops gracefully and catches up from the previous instance's position when it starts,
+	//for planned restarts without an Outbox
+	Handover *Handover
+	//Collector receives per channel notification counts, handler durations and errors, ping results and listener events, see Metrics
+	Collector Collector
+	//SlowHandlerThreshold is the time a handler may take to process a notification before it is reported to HandlerSet.SlowHandler. Zero disables the reports
+	SlowHandlerThreshold time.Duration
+	//SlowHandlerThresholds overrides SlowHandlerThreshold for individual handlers, by name, ie: main[0](*pqstream.WebhookSink) or a Named handler's name
+	SlowHandlerThresholds map[string]time.Duration
+	//Fingerprint identifies notifications by a hash of selected fields in the trace log, debug log, slow handler reports and quarantine alerts,
+	//which by default hash the whole payload, and in handlers' contexts, see FingerprintFrom. With it set, debug logs no longer show payloads
+	Fingerprint *Fingerprinter
+	//Backends resolves the session that sent each notification from pg_stat_activity into handlers' contexts, see BackendFrom, so changes can be
+	//attributed to the service that made them. Nil resolves none
+	Backends *BackendResolver
+	//Sources are inputs other than postgres whose events the client processes alongside its notifications, see EventSource
+	Sources []EventSource
+	//DeadLetters stores the notifications handlers fail on, with every failure, so they can be inspected, edited and requeued, see DeadLetterTable.
+	//A durable client only dead letters the outbox rows it skips after Outbox.MaxAttempts
+	DeadLetters DeadLetterStore
+	//Quarantine sets aside poison notifications, ones that fail, crash or time out their handlers on every attempt, so they stop blocking the stream
+	Quarantine *Quarantine
+	//Drain decides, per channel, whether notifications arriving after shutdown begins are processed, spooled for the next instance or dropped.
+	//Nil processes them
+	Drain *DrainPolicy
 }
 
 //HandlerSet is a set of interface/first-class functions that run logic on inbound notifications & errors in real time
@@ -57,17 +180,65 @@ type HandlerSet struct {
 	Handlers     []Handler
 	PostHandlers []Handler
 	ErrorHandler ErrHandlerFunc
+	LagHandler   LagHandlerFunc
+	//StaleHandler receives notifications older than Config.MaxAge, or past their envelope's Deadline, instead of the other handlers, ie: to dead-letter them.
+	//Nil drops them
+	StaleHandler Handler
+	//FailoverHandler is called when the client detects its primary moved. Setting it watches for failovers even without Config.Hosts
+	FailoverHandler FailoverHandlerFunc
+	//ReconnectHandler is called with a channel's listener state, including its attempt count and downtime, after every connection event
+	ReconnectHandler ReconnectHandlerFunc
+	//TerminatedHandler is called when the server terminates the listener's backend, ie: a managed provider running pg_terminate_backend on idle connections,
+	//as opposed to the connection failing. See IsTerminated
+	TerminatedHandler TerminatedHandlerFunc
+	//GapHandler is called when a gap is detected in a channel's envelope sequence numbers
+	GapHandler GapHandlerFunc
+	//GapCatchup recovers the notifications missing in each gap, which are processed ahead of the notification after it. It holds back the dispatcher while it runs
+	GapCatchup GapCatchupFunc
+	//SlowHandler is called when a handler exceeds its slow handler threshold. Nil logs a warning
+	SlowHandler SlowHandlerFunc
+	//StartupHandler is called with a report of each start serving on a host, once listening and caught up. Nil logs it when verbose
+	StartupHandler StartupHandlerFunc
 }
 
 //A Client runs Handlers on inbound streams of notifications from postgres LISTEN NOTIFY
 type Client struct {
-	channels  []string
-	config    *Config
-	handlers  *HandlerSet
-	listeners map[string]*pq.Listener
+	aliases      *aliases
+	capabilities *Capabilities
+	capture      *Capture
+	channels     []string
+	config       *Config
+	handlers     *HandlerSet
+	fenced       bool
+	debug        debugLog
+	durable      *durable
+	escalation   escalation
+	events       events
+	handoff      handoff
+	chunks       chunks
+	handover     handover
+	host         string
+	slow         slowHandlers
+	spoolTaken   bool
+	served       bool
+	identity     Identity
+	lifecycle    lifecycle
+	mu           sync.RWMutex
+	mux          *Mux
+	dashboard    sync.Once
+	dashStream   *StreamServer
+	pending      sync.WaitGroup
+	listener     *pq.Listener
+	states       map[string]*ListenerState
+	standby      *standby
+	sourced      chan *pq.Notification
+	stats        *statsRegistry
+	taps         taps
+	tracer       *tracer
+	workers      *workerPool
 }
 
-//NewClient provides a fully configures LISTEN NOTIFY client
+//NewClient provides a fully configures LISTEN NOTIFY client. HandlerSet.Handlers may be empty when the client routes channels with Handle, see ErrNoHandlers
 func NewClient(channels []string, config *Config, handlerset *HandlerSet) (*Client, error) {
 	if handlerset == nil {
 		return nil, errors.New("empty handlerset")
@@ -79,9 +250,11 @@ func NewClient(channels []string, config *Config, handlerset *HandlerSet) (*Clie
 		handlerset.ErrorHandler = func(err error) {
 			log.Printf("[%s] error: %s", pkg, err.Error())
 		}
-	}
-	if len(handlerset.Handlers) == 0 {
-		return nil, fmt.Errorf("[%s] error: %s", pkg, "zero handlers in config")
+		if logger := config.Logger; logger != nil {
+			handlerset.ErrorHandler = func(err error) {
+				logger.Log(LevelError, err.Error(), map[string]any{"error": err.Error()})
+			}
+		}
 	}
 	if config.Port == "" {
 		config.Port = "5432"
@@ -95,121 +268,344 @@ func NewClient(channels []string, config *Config, handlerset *HandlerSet) (*Clie
 	if config.Database == "" {
 		config.Database = "postgres"
 	}
-	return &Client{
-		channels:  channels,
-		config:    config,
-		handlers:  handlerset,
-		listeners: map[string]*pq.Listener{},
-	}, nil
+	if config.InstanceID == "" {
+		config.InstanceID = defaultInstanceID()
+	}
+	for _, ch := range channels {
+		if err := ValidateChannel(ch); err != nil {
+			return nil, err
+		}
+	}
+	if config.Drain != nil {
+		if err := config.Drain.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.validateDelivery(); err != nil {
+		return nil, err
+	}
+	if config.Bulkheads != nil && config.Outbox != nil {
+		return nil, errors.New("bulkheads can't be combined with an outbox: queued notifications would be checkpointed before their handlers run")
+	}
+	config.Clock = clockOr(config.Clock)
+	stats := newStatsRegistry(config.Clock)
+	for _, ch := range channels {
+		stats.channel(ch)
+	}
+	c := &Client{
+		aliases:  newAliases(config.Aliases, config.AliasDedupSize),
+		channels: channels,
+		config:   config,
+		durable:  newDurable(config.Outbox),
+		handlers: handlerset,
+		sourced:  make(chan *pq.Notification),
+		standby:  newStandby(config.Standby || config.StandbyLockKey != 0, config.StandbyBuffer),
+		states:   map[string]*ListenerState{},
+		stats:    stats,
+		workers:  newWorkerPool(config.Workers, config.ChannelWorkers),
+	}
+	c.lifecycle.state = ClientNew
+	c.lifecycle.stopping = make(chan struct{})
+	c.lifecycle.ready = make(chan struct{})
+	if config.Bulkheads != nil {
+		c.bulkheads(*config.Bulkheads)
+	}
+	c.identity = c.Identity()
+	c.tracer = newTracer(config.TraceWriter, config.TraceSampleRate, config.Clock, c.identity)
+	return c, nil
 }
 
 //ConnInfo returns the database connection info
 func (c *Config) ConnInfo() string {
+	return c.connInfo(c.User, c.Password)
+}
+
+//WriteConnInfo returns the database connection info of the role the client writes as, see WriteUser. It's ConnInfo when WriteUser is empty
+func (c *Config) WriteConnInfo() string {
+	if !c.separateWriter() {
+		return c.ConnInfo()
+	}
+	return c.connInfo(c.WriteUser, c.WritePassword)
+}
+
+//separateWriter reports whether the client writes as a role other than the one it reads as
+func (c *Config) separateWriter() bool {
+	return c.WriteUser != "" && (c.WriteUser != c.User || c.WritePassword != c.Password)
+}
+
+func (c *Config) connInfo(user, password string) string {
+	var info string
 	if c.SSLCert == "" || c.SSLKey == "" {
-		return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			c.Host, c.Port, c.User, c.Password, c.Database)
+		info = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+			c.Host, c.Port, user, password, c.Database)
+	} else {
+		info = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s sslrootcert=%s sslcert=%s sslkey=%s",
+			c.Host, c.Port, user, password, c.Database, c.SSLMode, c.SSLRootCert, c.SSLCert, c.SSLKey)
+	}
+	if c.ReadOnly {
+		info += " default_transaction_read_only=on"
 	}
-	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s sslrootcert=%s sslcert=%s sslkey=%s",
-		c.Host, c.Port, c.User, c.Password, c.Database, c.SSLMode, c.SSLRootCert, c.SSLCert, c.SSLKey)
+	//postgres takes both timeouts in milliseconds, and rounding a positive timeout down to zero would disable it
+	for _, setting := range []struct {
+		name    string
+		timeout time.Duration
+	}{{"statement_timeout", c.StatementTimeout}, {"lock_timeout", c.LockTimeout}} {
+		if setting.timeout > 0 {
+			info += fmt.Sprintf(" %s=%d", setting.name, (setting.timeout+time.Millisecond-1)/time.Millisecond)
+		}
+	}
+	return info
 }
 
-//Start starts a LISTEN NOTIFY connection on each channel and runs every registered handler on each inbound notification
+//Start starts a LISTEN NOTIFY connection on each channel and runs every registered handler on each inbound notification, blocking until Shutdown is called
 func (c *Client) Start() error {
-	return c.start()
+	return c.Run(context.Background())
 }
 
-func (c *Client) start() error {
-	db, err := sql.Open("postgres", c.config.ConnInfo())
+//Process runs every registered handler on a notification as if it had been received from a listener, so a Client can itself be used as a Handler, ie: as a replay target.
+//Handler errors are reported to the ErrorHandler rather than returned
+func (c *Client) Process(notification *pq.Notification) error {
+	for _, missed := range c.sequenced(notification) {
+		c.process(missed)
+	}
+	c.process(notification)
+	return nil
+}
+
+//process runs the pre, main and post handlers on a single notification, returning their errors once each has been reported to the ErrorHandler.
+//A notification they fail on is dead lettered if the client has a DeadLetterStore
+func (c *Client) process(n *pq.Notification) error {
+	if c.config.DeadLetters == nil {
+		return c.processIn(context.Background(), n)
+	}
+	log := &deadLetterLog{attempt: 1}
+	err := c.processIn(withDeadLetterLog(context.Background(), log), n)
 	if err != nil {
-		return fmt.Errorf("failed to open with connection info! %s", err.Error())
-	}
-	defer db.Close()
-	if c.config.MaxOpenConns != 0 {
-		db.SetMaxOpenConns(c.config.MaxOpenConns)
-	}
-	if c.config.MaxIdleConns != 0 {
-		db.SetMaxIdleConns(c.config.MaxIdleConns)
-	}
-	group := sync.WaitGroup{}
-	for _, channel := range c.channels {
-		group.Add(1)
-		go func(ch string) {
-			defer group.Done()
-			c.listeners[ch] = pq.NewListener(c.config.ConnInfo(), 10*time.Second, 3*time.Minute, func(event pq.ListenerEventType, err error) {
-				if err != nil {
-					c.handlers.ErrorHandler(fmt.Errorf("event type: %d error: %s\n", event, err.Error()))
-					return
-				}
-			})
-			if err := c.listeners[ch].Listen(ch); err != nil {
-				c.handlers.ErrorHandler(fmt.Errorf("failed to listen on channel : %s!", ch))
-				return
-			}
-			defer func() {
-				if err := c.listeners[ch].Close(); err != nil {
-					if c.config.Verbose {
-						c.handlers.ErrorHandler(fmt.Errorf("failed to close channel : %s!", ch))
-					}
-				}
-			}()
-			for {
-				select {
-				case n := <-c.listeners[ch].Notify:
-					if c.config.Verbose {
-						log.Printf("%s received notification %d on channel: %s", pkg, n.BePid, n.Channel)
-					}
-					if len(c.handlers.PreHandlers) > 0 {
-						preWg := sync.WaitGroup{}
-						for _, handler := range c.handlers.Handlers {
-							preWg.Add(1)
-							go func(notification *pq.Notification, h Handler) {
-								defer preWg.Done()
-								if err := h.Process(notification); err != nil {
-									c.handlers.ErrorHandler(fmt.Errorf("failed to pre-process notification! pid: %d, channel: %s error: %s", notification.BePid, notification.Channel, err.Error()))
-								}
-							}(n, handler)
-						}
-						preWg.Wait()
-					}
-					mainWg := sync.WaitGroup{}
-					for _, handler := range c.handlers.Handlers {
-						mainWg.Add(1)
-						go func(notification *pq.Notification, h Handler) {
-							defer mainWg.Done()
-							if err := h.Process(notification); err != nil {
-								c.handlers.ErrorHandler(fmt.Errorf("failed to process notification! pid: %d, channel: %s error: %s", notification.BePid, notification.Channel, err.Error()))
-							}
-						}(n, handler)
-					}
-					mainWg.Wait()
-					if len(c.handlers.PostHandlers) > 0 {
-						postWg := sync.WaitGroup{}
-						for _, handler := range c.handlers.PostHandlers {
-							postWg.Add(1)
-							go func(notification *pq.Notification, h Handler) {
-								defer postWg.Done()
-								if err := h.Process(notification); err != nil {
-									c.handlers.ErrorHandler(fmt.Errorf("failed to post-process notification! pid: %d, channel: %s error: %s", notification.BePid, notification.Channel, err.Error()))
-								}
-							}(n, handler)
-						}
-						postWg.Wait()
-					}
-
-				case <-time.After(90 * time.Second):
-					if c.config.Verbose {
-						log.Printf("%s Received no events for 90 seconds, checking connection!", pkg)
-					}
-					if err := c.listeners[ch].Ping(); err != nil {
-						c.handlers.ErrorHandler(fmt.Errorf("failed to ping database for channel: %s error: %s", ch, err.Error()))
-					}
-					if c.config.Verbose {
-						log.Printf("%s Successful database ping!", pkg)
-					}
-				}
+		c.deadLetter(n, 1, log.snapshot())
+	}
+	return err
+}
+
+//processIn runs the handlers on a notification with a context holding the attempt's dead letter log, if any
+func (c *Client) processIn(base context.Context, n *pq.Notification) error {
+	c.taps.offer(n)
+	received := c.config.Clock.Now()
+	if capture := c.captured(); capture != nil {
+		capture.record(n, received)
+	}
+	stats := c.stats.channel(n.Channel)
+	stats.receive(received, len(n.Extra))
+	c.collector().ObserveNotification(n.Channel)
+	if collector, ok := c.collector().(PayloadCollector); ok {
+		collector.ObservePayload(n.Channel, len(n.Extra))
+	}
+	tr := c.tracer.start(n)
+	envelope := envelopeOf(n)
+	span, traced := receivedTrace(envelope, tr != nil)
+	if traced {
+		tr.setParent(span)
+	}
+	var fingerprint string
+	if c.config.Fingerprint != nil {
+		fingerprint = c.fingerprint(n)
+		tr.setFingerprint(fingerprint)
+	}
+	tr.record(TraceEvent{Stage: TraceReceived})
+	defer func() {
+		stats.done()
+		if envelope != nil && !envelope.EmittedAt.IsZero() {
+			c.observeLag(n.Channel, stats, c.config.Clock.Now().Sub(envelope.EmittedAt))
+		}
+		tr.record(TraceEvent{Stage: TraceDone})
+	}()
+	if c.config.Verbose {
+		c.logf("received notification %d on channel: %s", n.BePid, n.Channel)
+	}
+	if c.config.Fingerprint != nil {
+		c.debugf(n.Channel, "received notification pid: %d fingerprint: %s", n.BePid, fingerprint)
+	} else {
+		c.debugf(n.Channel, "received notification pid: %d payload: %s", n.BePid, truncate(n.Extra, debugPayloadLimit))
+	}
+	defer func() {
+		c.debugf(n.Channel, "processed notification pid: %d in %s", n.BePid, c.config.Clock.Now().Sub(received))
+	}()
+	ctx := withDecodeCache(withTrace(withIdentity(base, c.identity), tr), newDecodeCache(n))
+	if traced {
+		ctx = WithTraceContext(ctx, span)
+	}
+	if c.config.Fingerprint != nil {
+		ctx = context.WithValue(ctx, fingerprintKey{}, fingerprint)
+	}
+	//notifications from event sources weren't sent by a backend
+	if c.config.Backends != nil && n.BePid != 0 {
+		ctx = c.withBackend(ctx, n)
+	}
+	if c.config.ReadOnly {
+		ctx = WithReadOnly(ctx)
+	}
+	if c.config.DryRun {
+		ctx = WithDryRun(ctx)
+	}
+	if c.config.MaxAge > 0 && envelope != nil && !envelope.EmittedAt.IsZero() && c.config.Clock.Now().Sub(envelope.EmittedAt) > c.config.MaxAge {
+		stats.stale()
+		tr.record(TraceEvent{Stage: TraceStale})
+		if c.handlers.StaleHandler == nil {
+			return nil
+		}
+		_, err := c.runPhase(ctx, n, "stale", []Handler{c.handlers.StaleHandler}, nil, "failed to handle stale notification!")
+		return err
+	}
+	if envelope != nil && envelope.Deadline != nil {
+		if !c.config.Clock.Now().Before(*envelope.Deadline) {
+			stats.expire()
+			tr.record(TraceEvent{Stage: TraceExpired})
+			if c.handlers.StaleHandler == nil {
+				return nil
 			}
-		}(channel)
+			_, err := c.runPhase(ctx, n, "expired", []Handler{c.handlers.StaleHandler}, nil, "failed to handle expired notification!")
+			return err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, *envelope.Deadline)
+		defer cancel()
 	}
-	group.Wait()
-	return nil
+	if handler, ok := c.inlineHandler(n.Channel); ok {
+		return c.guard(ctx, n, func(ctx context.Context) error {
+			var err error
+			c.workers.runInline(func() {
+				_, err = c.invoke(ctx, n, "main", 0, handler, nil, "failed to process notification!")
+			})
+			return err
+		})
+	}
+	return c.guard(ctx, n, func(ctx context.Context) error {
+		_, pre := c.runPhase(ctx, n, "pre", c.handlers.PreHandlers, nil, "failed to pre-process notification!")
+		results, main := c.runPhase(ctx, n, "main", c.mainHandlers(), nil, "failed to process notification!")
+		_, post := c.runPhase(ctx, n, "post", c.handlers.PostHandlers, results, "failed to post-process notification!")
+		return errors.Join(pre, main, post)
+	})
+}
+
+//runPhase runs a set of handlers concurrently on a notification and waits for them all to return.
+//It returns the values produced by ResultHandlers, passing results from a previous phase to ResultConsumers, and the handlers' errors
+func (c *Client) runPhase(ctx context.Context, n *pq.Notification, phase string, handlers []Handler, results Results, failure string) (Results, error) {
+	if len(handlers) == 0 {
+		return nil, nil
+	}
+	produced := make([]*Result, len(handlers))
+	errs := make([]error, len(handlers))
+	tasks := make([]func(), len(handlers))
+	for i, handler := range handlers {
+		h, index := handler, i
+		tasks[i] = func() {
+			produced[index], errs[index] = c.invoke(ctx, n, phase, index, h, results, failure)
+		}
+	}
+	c.workers.run(n.Channel, tasks)
+	var out Results
+	for _, r := range produced {
+		if r != nil {
+			out = append(out, *r)
+		}
+	}
+	return out, errors.Join(errs...)
+}
+
+//a contextResultHandler is a ResultHandler that also needs the invocation's context, ie: a Canary passing it on to the handlers it compares
+type contextResultHandler interface {
+	ResultHandler
+	processResultContext(ctx context.Context, notification *pq.Notification, results Results) (any, error)
+}
+
+//a contextResultConsumer is a ResultConsumer that also needs the invocation's context, ie: a Mux passing both on to its routes
+type contextResultConsumer interface {
+	ResultConsumer
+	processResultsContext(ctx context.Context, notification *pq.Notification, results Results) error
+}
+
+//handle calls whichever of its methods a handler implements, returning its value and true if it is a ResultHandler
+func handle(ctx context.Context, h Handler, notification *pq.Notification, results Results) (any, bool, error) {
+	switch h := h.(type) {
+	case contextResultHandler:
+		value, err := h.processResultContext(ctx, notification, results)
+		return value, true, err
+	case ResultHandler:
+		value, err := h.ProcessResult(notification)
+		return value, true, err
+	case contextResultConsumer:
+		return nil, false, h.processResultsContext(ctx, notification, results)
+	case ResultConsumer:
+		return nil, false, h.ProcessResults(notification, results)
+	case ContextHandler:
+		return nil, false, h.ProcessContext(ctx, notification)
+	case BytesHandler:
+		payload := borrowPayload(notification)
+		defer payload.Release()
+		return nil, false, h.ProcessBytes(notification, payload)
+	default:
+		return nil, false, h.Process(notification)
+	}
+}
+
+//invoke runs a handler on a notification, retrying it as the EscalationPolicy says, and records and reports the outcome.
+//It returns the value produced by a ResultHandler
+func (c *Client) invoke(ctx context.Context, notification *pq.Notification, phase string, index int, h Handler, results Results, failure string) (*Result, error) {
+	finish := traceFrom(ctx).handler(h, phase, index)
+	started := c.config.Clock.Now()
+	var produced *Result
+	call := func() error {
+		value, ok, err := handle(ctx, h, notification, results)
+		if ok && err == nil {
+			produced = &Result{Handler: nameOf(h, phase, index), Value: value}
+		}
+		return err
+	}
+	err := c.retryHandler(notification.Channel, call(), call)
+	finish(err)
+	name := nameOf(h, phase, index)
+	took := c.config.Clock.Now().Sub(started)
+	c.collector().ObserveHandler(notification.Channel, name, took, err)
+	c.observeSlow(name, notification, took)
+	c.stats.sink(name).observe(len(notification.Extra), err)
+	if collector, ok := c.collector().(PayloadCollector); ok && err == nil {
+		collector.ObserveDelivered(notification.Channel, name, len(notification.Extra))
+	}
+	if err != nil {
+		c.events.publish(Event{Type: EventHandlerFailed, Channel: notification.Channel, Time: c.config.Clock.Now(), Handler: name, Error: err.Error()})
+		recordFailure(ctx, name, err, c.config.Clock.Now())
+		c.handleErr(notification.Channel, fmt.Errorf("%s pid: %d, channel: %s error: %w", failure, notification.BePid, notification.Channel, err))
+	}
+	return produced, err
+}
+
+//inlineHandler returns the client's handler when a notification on the channel can run it inline, without the worker pool: it is the only handler,
+//there are no pre or post handlers and the channel's worker limit doesn't have to be enforced
+func (c *Client) inlineHandler(channel string) (Handler, bool) {
+	if len(c.handlers.PreHandlers) > 0 || len(c.handlers.PostHandlers) > 0 || !c.workers.inline(channel) {
+		return nil, false
+	}
+	handlers := c.mainHandlers()
+	if len(handlers) != 1 {
+		return nil, false
+	}
+	return handlers[0], true
+}
+
+//observeLag records a channel's consumer lag and alerts the LagHandler once it crosses the configured threshold
+func (c *Client) observeLag(channel string, stats *channelStats, lag time.Duration) {
+	stats.lag(lag)
+	if c.config.LagThreshold > 0 && lag > c.config.LagThreshold && c.handlers.LagHandler != nil {
+		c.handlers.LagHandler(channel, lag)
+	}
+}
+
+//handleErr records an error against a channel and passes it to the ErrorHandler
+func (c *Client) handleErr(channel string, err error) {
+	c.stats.channel(channel).fail()
+	c.debugf(channel, "error: %s", err.Error())
+	if c.config.Escalation != nil {
+		c.escalate(channel, err)
+		return
+	}
+	c.handlers.ErrorHandler(err)
 }
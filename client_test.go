@@ -5,7 +5,9 @@ import (
 	"github.com/autom8ter/pqstream"
 	"github.com/lib/pq"
 	"log"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFull(t *testing.T) {
@@ -63,3 +65,43 @@ func TestFull(t *testing.T) {
 		log.Fatal(err.Error())
 	}
 }
+
+func TestConnInfoTimeouts(t *testing.T) {
+	config := &pqstream.Config{Host: "localhost", StatementTimeout: 5 * time.Second, LockTimeout: 1500 * time.Microsecond}
+	if info := config.ConnInfo(); !strings.HasSuffix(info, " statement_timeout=5000 lock_timeout=2") {
+		t.Fatalf("expected the timeouts in milliseconds, rounded up, got %s", info)
+	}
+	client, err := pqstream.NewClient([]string{"users"}, config, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e := client.EffectiveConfig(); e.StatementTimeout != "5s" || e.LockTimeout != "1.5ms" {
+		t.Fatalf("expected the timeouts in the effective config, got %+v", e)
+	}
+	if info := (&pqstream.Config{}).ConnInfo(); strings.Contains(info, "timeout") {
+		t.Fatalf("expected no timeouts by default, got %s", info)
+	}
+}
+
+func TestWriteConnInfo(t *testing.T) {
+	config := &pqstream.Config{Host: "localhost", User: "reader", Password: "r", LockTimeout: time.Second}
+	if config.WriteConnInfo() != config.ConnInfo() {
+		t.Fatalf("expected the client to write as its user by default, got %s", config.WriteConnInfo())
+	}
+	config.WriteUser, config.WritePassword = "writer", "w"
+	info := config.WriteConnInfo()
+	if !strings.Contains(info, "user=writer password=w ") || !strings.HasSuffix(info, " lock_timeout=1000") || !strings.Contains(config.ConnInfo(), "user=reader password=r ") {
+		t.Fatalf("expected the write role's credentials with the same settings, got %s", info)
+	}
+	client, err := pqstream.NewClient([]string{"users"}, config, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e := client.EffectiveConfig(); e.WriteUser != "writer" || e.WritePassword == "w" || e.WritePassword == "" {
+		t.Fatalf("expected the write user with its password redacted, got %+v", e)
+	}
+}
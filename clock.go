@@ -0,0 +1,198 @@
+package pqstream
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//A Clock is the source of time for ping timers, lag measurement, retries, backoff and rotation, so time dependent behavior can be tested deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+//A Timer fires once on C after its duration, and can be reset to fire again without allocating a new one
+type Timer interface {
+	C() <-chan time.Time
+	//Reset stops the timer, discarding a firing that wasn't received, and starts it again for d
+	Reset(d time.Duration)
+	Stop()
+}
+
+//A TimerClock is a Clock that creates resettable timers. Timers from a Clock that isn't one are emulated with After
+type TimerClock interface {
+	Clock
+	NewTimer(d time.Duration) Timer
+}
+
+func newTimer(clock Clock, d time.Duration) Timer {
+	if timers, ok := clock.(TimerClock); ok {
+		return timers.NewTimer(d)
+	}
+	return &afterTimer{clock: clock, c: clock.After(d)}
+}
+
+type afterTimer struct {
+	clock Clock
+	c     <-chan time.Time
+}
+
+func (t *afterTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *afterTimer) Reset(d time.Duration) {
+	t.c = t.clock.After(d)
+}
+
+func (t *afterTimer) Stop() {}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Reset(d time.Duration) {
+	t.Stop()
+	t.timer.Reset(d)
+}
+
+func (t realTimer) Stop() {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+}
+
+//SystemClock is the Clock backed by the time package, used when no Clock is configured
+var SystemClock Clock = realClock{}
+
+func clockOr(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+//A FakeClock is a Clock that only moves when Advance is called
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+//NewFakeClock creates a FakeClock starting at the given time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+//Now returns the fake current time
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+//After returns a channel that receives the fake time once the clock has been advanced by at least d
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	at := f.now.Add(d)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, fakeWaiter{at: at, ch: ch})
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+	return ch
+}
+
+//Advance moves the clock forward, firing every After whose duration has elapsed
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for len(f.waiters) > 0 && !f.waiters[0].at.After(f.now) {
+		f.waiters[0].ch <- f.now
+		f.waiters = f.waiters[1:]
+	}
+}
+
+//NewTimer returns a Timer that fires once the clock has been advanced by at least d
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) {
+	t.Stop()
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d <= 0 {
+		t.c <- f.now
+		return
+	}
+	f.waiters = append(f.waiters, fakeWaiter{at: f.now.Add(d), ch: t.c})
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+}
+
+func (t *fakeTimer) Stop() {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	waiters := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.ch != t.c {
+			waiters = append(waiters, w)
+		}
+	}
+	f.waiters = waiters
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+//Waiters returns the number of pending After calls and timers, so tests can wait for a goroutine to block on the clock before advancing it
+func (f *FakeClock) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
@@ -0,0 +1,64 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := pqstream.NewFakeClock(start)
+	later, sooner := clock.After(2*time.Second), clock.After(time.Second)
+	clock.Advance(time.Second)
+	select {
+	case now := <-sooner:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("unexpected fire time: %s", now)
+		}
+	default:
+		t.Fatal("expected the elapsed timer to fire")
+	}
+	select {
+	case <-later:
+		t.Fatal("timer fired early")
+	default:
+	}
+	clock.Advance(time.Second)
+	<-later
+	if clock.Waiters() != 0 {
+		t.Fatal("expected no pending timers")
+	}
+}
+
+func TestPipelineBackoffClock(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	attempts := 0
+	p := pqstream.NewPipeline().
+		Clock(clock).
+		FanOut(pqstream.NewSink("flaky", func(ctx context.Context, n *pq.Notification) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("down")
+			}
+			return nil
+		})).
+		OnError(pqstream.ErrorPolicy{Retries: 2, Backoff: time.Minute})
+	done := make(chan error, 1)
+	go func() { done <- p.Process(&pq.Notification{Channel: "users"}) }()
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(backoff)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"os"
+)
+
+func apply(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	config := configFlags(fs)
+	path := fs.String("state", "streams.yaml", "state file declaring the triggers and outboxes, in YAML or JSON")
+	table := fs.String("table", "", "state table recording what is managed, defaults to pqstream_state")
+	planOnly := fs.Bool("plan", false, "print the plan without applying it")
+	verbose := fs.Bool("sql", false, "print the SQL of each change")
+	prune := fs.Bool("prune", false, "first remove the pqstream triggers, functions and records left behind by deleted channels and renamed tables")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	state, err := pqstream.ParseStreamState(data)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", config.WriteConnInfo())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	reconciler := &pqstream.Reconciler{DB: db, Table: *table}
+	var plan, changes pqstream.Plan
+	if *prune {
+		if *planOnly {
+			plan, err = reconciler.Orphans(ctx, state)
+		} else {
+			plan, err = reconciler.Prune(ctx, state)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if *planOnly {
+		changes, err = reconciler.Plan(ctx, state)
+	} else {
+		changes, err = reconciler.Apply(ctx, state)
+	}
+	if err != nil {
+		return err
+	}
+	pruned := map[string]bool{}
+	for _, orphan := range plan {
+		if orphan.Kind == "record" {
+			pruned[orphan.Name] = true
+		}
+	}
+	for _, change := range changes {
+		//a stale record planned for pruning isn't also dropped by the apply
+		if change.Action == pqstream.PlanDrop && change.Kind == "trigger" && pruned[change.Name] {
+			continue
+		}
+		plan = append(plan, change)
+	}
+	fmt.Fprint(os.Stdout, plan)
+	if *verbose {
+		for _, change := range plan {
+			fmt.Fprintf(os.Stdout, "\n-- %s %s %s\n%s;\n", change.Action, change.Kind, change.Name, change.SQL)
+		}
+	}
+	if !*planOnly && len(plan) > 0 {
+		fmt.Fprintf(os.Stdout, "Applied %d changes.\n", len(plan))
+	}
+	return nil
+}
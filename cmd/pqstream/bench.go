@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+)
+
+func bench(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	config := configFlags(fs)
+	opts := pqstream.BenchOptions{}
+	fs.StringVar(&opts.Channel, "channel", "pqstream_bench", "channel to publish to and listen on")
+	fs.IntVar(&opts.Rate, "rate", 1000, "target notifications per second")
+	fs.IntVar(&opts.PayloadSize, "size", 256, "approximate payload size in bytes")
+	fs.DurationVar(&opts.Duration, "duration", 0, "how long to produce traffic for (default 10s)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	report, err := pqstream.Bench(ctx, config, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report.String())
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/autom8ter/pqstream"
+	"os"
+)
+
+func config(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base url of the client's admin API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	effective, err := pqstream.NewAdminClient(*addr).Config(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(effective)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func consumers(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("consumers", flag.ExitOnError)
+	config := configFlags(fs)
+	presence := &pqstream.Presence{}
+	fs.StringVar(&presence.Table, "table", "", "consumers table, defaults to pqstream_consumers")
+	fs.DurationVar(&presence.TTL, "ttl", 30*time.Second, "how long after its last heartbeat a consumer is still listed")
+	asJSON := fs.Bool("json", false, "print the consumers as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", config.ConnInfo())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	presence.DB = db
+	list, err := presence.Consumers(ctx)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tHOST\tVERSION\tCHANNELS\tSTARTED\tLAST HEARTBEAT")
+	for _, c := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s ago\n", c.InstanceID, c.Hostname, c.Version, strings.Join(c.Channels, ","),
+			c.StartedAt.Format(time.RFC3339), time.Since(c.LastHeartbeat).Round(time.Second))
+	}
+	return w.Flush()
+}
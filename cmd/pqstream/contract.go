@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"os"
+	"time"
+)
+
+func contract(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("contract", flag.ExitOnError)
+	path := fs.String("contracts", "contracts.yaml", "contract file declaring what consumers rely on in each channel's payloads")
+	records := fs.String("records", "", "NDJSON records of a producer's payloads to verify, ie: written by a FileSink")
+	samples := fs.Bool("samples", false, "print a sample record of each contract for consumers to test their handlers with, instead of verifying")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	contracts, err := pqstream.ParseContracts(data)
+	if err != nil {
+		return err
+	}
+	if *samples {
+		enc := json.NewEncoder(os.Stdout)
+		for _, sample := range contracts.Samples() {
+			if err := enc.Encode(pqstream.NewRecord(sample, time.Now())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if *records == "" {
+		return fmt.Errorf("-records is required unless -samples is set")
+	}
+	reader, err := pqstream.OpenRecords(*records)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	var verified, broken int
+	for line := 1; ; line++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		verified++
+		err = contracts.Verify(&pq.Notification{Channel: record.Channel, BePid: record.PID, Extra: record.Payload})
+		var contractErr *pqstream.ContractError
+		if errors.As(err, &contractErr) {
+			broken++
+			for _, v := range contractErr.Violations {
+				fmt.Fprintf(os.Stdout, "%s:%d: %s\n", *records, line, v)
+			}
+		}
+	}
+	fmt.Fprintf(os.Stdout, "verified %d payloads, %d break a contract\n", verified, broken)
+	if broken > 0 {
+		return fmt.Errorf("%d payloads break a contract", broken)
+	}
+	return nil
+}
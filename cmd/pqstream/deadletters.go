@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func deadLetters(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pqstream deadletters list|edit|requeue|delete [flags]")
+	}
+	action, args := args[0], args[1:]
+	fs := flag.NewFlagSet("deadletters "+action, flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base url of the client's admin API")
+	ids := fs.String("id", "", "comma separated dead letter ids")
+	filter := pqstream.DeadLetterFilter{}
+	fs.StringVar(&filter.Channel, "channel", "", "only the dead letters of a channel")
+	fs.StringVar(&filter.Handler, "handler", "", "only the dead letters a handler failed on, by name")
+	var (
+		all     *bool
+		asJSON  *bool
+		payload *string
+	)
+	switch action {
+	case "list":
+		fs.IntVar(&filter.Limit, "limit", 100, "maximum number of dead letters to list, 0 for all")
+		asJSON = fs.Bool("json", false, "print the dead letters, with their failure history, as JSON")
+	case "edit":
+		payload = fs.String("payload", "", "the new payload, or - to read it from stdin")
+	case "requeue", "delete":
+		all = fs.Bool("all", false, "select every dead letter when no filter is given")
+	default:
+		return fmt.Errorf("unknown deadletters action: %s", action)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	for _, v := range strings.Split(*ids, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id %s", v)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+	admin := pqstream.NewAdminClient(*addr)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	switch action {
+	case "list":
+		letters, err := admin.DeadLetters(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return enc.Encode(letters)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCHANNEL\tATTEMPTS\tLAST FAILED\tHANDLER\tERROR")
+		for _, d := range letters {
+			var last pqstream.DeadLetterFailure
+			if len(d.Failures) > 0 {
+				last = d.Failures[len(d.Failures)-1]
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", d.ID, d.Channel, d.Attempts, d.UpdatedAt.Format(time.RFC3339), last.Handler, last.Error)
+		}
+		return w.Flush()
+	case "edit":
+		if len(filter.IDs) != 1 {
+			return errors.New("edit requires exactly one -id")
+		}
+		data := *payload
+		if data == "-" {
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			data = string(b)
+		}
+		letter, err := admin.EditDeadLetter(ctx, filter.IDs[0], data)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(letter)
+	}
+	if filter.IsZero() && !*all {
+		return fmt.Errorf("%s requires -id, -channel or -handler, or -all", action)
+	}
+	if action == "delete" {
+		deleted, err := admin.DeleteDeadLetters(ctx, filter)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "deleted %d dead letters\n", deleted)
+		return nil
+	}
+	result, err := admin.Requeue(ctx, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "requeued %d dead letters, %d failed again\n", len(result.Requeued), len(result.Failed))
+	if len(result.Failed) > 0 {
+		return enc.Encode(result)
+	}
+	return nil
+}
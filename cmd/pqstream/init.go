@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"go/format"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//project is what a scaffolded consumer is customized by
+type project struct {
+	Module string
+	Table  string
+	//QuotedTable is Table as a quoted, optionally schema qualified, identifier
+	QuotedTable string
+	Channel     string
+	Image       string
+	Password    string
+	Trigger     string
+	Handlers    []string
+	//Counts declares the counter the stats handler increments
+	Counts bool
+}
+
+//scaffold writes a small runnable consumer project: a main.go wiring handlers to a channel, the migration creating a table and its trigger,
+//the state file to apply, and a docker-compose running postgres with the migration and the consumer
+func scaffold(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to write the project to, defaults to the last element of -module")
+	p := &project{}
+	fs.StringVar(&p.Module, "module", "example.com/consumer", "go module path of the project")
+	fs.StringVar(&p.Table, "table", "orders", "table the trigger watches, created by the migration if it doesn't exist")
+	fs.StringVar(&p.Channel, "channel", "", "channel the trigger notifies, defaults to -table without its schema")
+	fs.StringVar(&p.Image, "postgres-image", "postgres:16", "postgres image docker-compose runs")
+	handlers := fs.String("handlers", "log", "comma separated handlers to wire: log, changes and stats")
+	force := fs.Bool("force", false, "overwrite files that already exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir = filepath.Base(p.Module)
+	}
+	if p.Table == "" {
+		return errors.New("init requires a -table")
+	}
+	//the migration creates the table with an id primary key, which truncated events are sent with
+	spec := pqstream.TriggerSpec{Table: p.Table, Channel: p.Channel, Key: []string{"id"}}
+	if p.Channel == "" {
+		parts := strings.Split(p.Table, ".")
+		p.Channel = parts[len(parts)-1]
+	}
+	if err := pqstream.ValidateChannel(p.Channel); err != nil {
+		return err
+	}
+	p.Trigger = spec.Up()
+	parts := strings.Split(p.Table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	p.QuotedTable = strings.Join(parts, ".")
+	p.Password = "postgres"
+	for _, h := range strings.Split(*handlers, ",") {
+		h = strings.TrimSpace(h)
+		if _, ok := handlerTemplates[h]; !ok {
+			return fmt.Errorf("unknown handler %q, expected one of: %s", h, strings.Join(handlerNames(), ", "))
+		}
+		p.Handlers = append(p.Handlers, handlerTemplates[h])
+		p.Counts = p.Counts || h == "stats"
+	}
+	files := map[string]string{}
+	for name, text := range projectTemplates {
+		path, err := render(name, name, p)
+		if err != nil {
+			return err
+		}
+		if files[path], err = render(name, text, p); err != nil {
+			return err
+		}
+	}
+	main, err := format.Source([]byte(files["main.go"]))
+	if err != nil {
+		return fmt.Errorf("failed to format main.go! %s", err.Error())
+	}
+	files["main.go"] = string(main)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !*force {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(*dir, name)); err == nil {
+				return fmt.Errorf("%s already exists, pass -force to overwrite it", filepath.Join(*dir, name))
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(*dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "wrote %s\n", path)
+	}
+	fmt.Fprintf(os.Stdout, "\ncd %s && go mod tidy && docker compose up\n", *dir)
+	return nil
+}
+
+func render(name, text string, p *project) (string, error) {
+	out := &bytes.Buffer{}
+	if err := template.Must(template.New(name).Parse(text)).Execute(out, p); err != nil {
+		return "", fmt.Errorf("failed to render %s! %s", name, err.Error())
+	}
+	return out.String(), nil
+}
+
+func handlerNames() []string {
+	names := make([]string, 0, len(handlerTemplates))
+	for name := range handlerTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//handlerTemplates are the handlers a project can be scaffolded with, as the Go expressions main.go registers
+var handlerTemplates = map[string]string{
+	"log": `pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			log.Printf("%s: %s", notification.Channel, notification.Extra)
+			return nil
+		})`,
+	"changes": `pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			e, err := pqstream.ParseChange(notification)
+			if err != nil {
+				return err
+			}
+			log.Printf("%s %s: %v", e.Op, e.QualifiedTable(), e.New)
+			return nil
+		})`,
+	"stats": `pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			if n := atomic.AddUint64(&processed, 1); n%100 == 0 {
+				log.Printf("processed %d notifications", n)
+			}
+			return nil
+		})`,
+}
+
+var projectTemplates = map[string]string{
+	"go.mod": `module {{.Module}}
+
+go 1.20
+`,
+	"main.go": `package main
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"log"
+	"os"
+	"os/signal"
+{{- if .Counts}}
+	"sync/atomic"
+{{- end}}
+)
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	config := &pqstream.Config{
+		Host:     env("PGHOST", "localhost"),
+		Port:     env("PGPORT", "5432"),
+		User:     env("PGUSER", "postgres"),
+		Password: env("PGPASSWORD", "{{.Password}}"),
+		Database: env("PGDATABASE", "postgres"),
+		SSLMode:  env("PGSSLMODE", "disable"),
+		Verbose:  true,
+	}
+{{- if .Counts}}
+	//handlers run concurrently, one notification per worker
+	var processed uint64
+{{- end}}
+	handlers := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+{{- range .Handlers}}
+		{{.}},
+{{- end}}
+		},
+		ErrorHandler: func(err error) {
+			log.Println("error:", err.Error())
+		},
+	}
+	client, err := pqstream.NewClient([]string{env("PQSTREAM_CHANNEL", "{{.Channel}}")}, config, handlers)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := client.Run(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+`,
+	"migrations/0001_{{.Channel}}.up.sql": `CREATE TABLE IF NOT EXISTS {{.QuotedTable}} (
+	id bigserial PRIMARY KEY,
+	data jsonb NOT NULL DEFAULT '{}',
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+{{.Trigger}};
+`,
+	"streams.yaml": `# the triggers pqstream apply keeps installed, once the migration is replaced by the application's own schema
+triggers:
+  - table: {{.Table}}
+    channel: {{.Channel}}
+    key: [id]
+`,
+	"docker-compose.yml": `services:
+  postgres:
+    image: {{.Image}}
+    environment:
+      POSTGRES_PASSWORD: {{.Password}}
+    ports:
+      - "5432:5432"
+    volumes:
+      - ./migrations:/docker-entrypoint-initdb.d
+    healthcheck:
+      test: ["CMD", "pg_isready", "-U", "postgres"]
+      interval: 1s
+      retries: 30
+  consumer:
+    image: golang:1.20
+    working_dir: /app
+    command: go run .
+    environment:
+      PGHOST: postgres
+      PGPASSWORD: {{.Password}}
+    volumes:
+      - .:/app
+    depends_on:
+      postgres:
+        condition: service_healthy
+`,
+	"README.md": `# {{.Module}}
+
+A pqstream consumer of the {{.Channel}} channel, notified by a trigger on {{.Table}}.
+
+    go mod tidy
+    docker compose up
+
+then, in another terminal, make a change:
+
+    docker compose exec postgres psql -U postgres -c "INSERT INTO {{.Table}} (data) VALUES ('{\"hello\": \"world\"}')"
+`,
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScaffold(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-dir", dir, "-module", "example.com/shop", "-table", "app.Orders", "-handlers", "log,stats"}
+	if err := scaffold(context.Background(), args); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, want := range map[string][]string{
+		"go.mod":                        {"module example.com/shop"},
+		"main.go":                       {`"sync/atomic"`, `env("PQSTREAM_CHANNEL", "Orders")`, "atomic.AddUint64(&processed, 1)"},
+		"migrations/0001_Orders.up.sql": {`CREATE TABLE IF NOT EXISTS "app"."Orders" (`, `PERFORM pg_notify('Orders', payload)`},
+		"streams.yaml":                  {"table: app.Orders", "channel: Orders"},
+		"docker-compose.yml":            {"image: postgres:16"},
+		"README.md":                     {"# example.com/shop"},
+	} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, w := range want {
+			if !strings.Contains(string(content), w) {
+				t.Fatalf("expected %s to contain %s, got:\n%s", name, w, content)
+			}
+		}
+	}
+	if err := scaffold(context.Background(), args); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected existing files to be kept without -force, got: %v", err)
+	}
+	if err := scaffold(context.Background(), append(args, "-force")); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"os"
+)
+
+func lint(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	config := configFlags(fs)
+	path := fs.String("config", "pipelines.json", "pipeline config to validate, in JSON or YAML, ie: pipelines.yaml")
+	schema := fs.Bool("schema", false, "connect to the database to check the tables and columns the config references exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+	pipelines, err := pqstream.ParsePipelineConfig(data)
+	if err != nil {
+		return err
+	}
+	opts := pqstream.LintOptions{}
+	if *schema {
+		db, err := sql.Open("postgres", config.ConnInfo())
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		opts.DB = db
+	}
+	issues, err := pqstream.Lint(ctx, pipelines, opts)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stdout, "%s: %s\n", *path, issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issues found", len(issues))
+	}
+	return nil
+}
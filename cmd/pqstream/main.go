@@ -0,0 +1,80 @@
+//pqstream is a command line tool for operating pqstream pipelines
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"os"
+	"os/signal"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"apply":       {usage: "reconcile the triggers and outboxes declared in a state file with the database, printing the plan", run: apply},
+	"bench":       {usage: "produce synthetic NOTIFY traffic and report throughput and latency percentiles", run: bench},
+	"config":      {usage: "print the configuration a running client resolved, with defaults applied and secrets redacted", run: config},
+	"consumers":   {usage: "list the pqstream consumers across the fleet that registered their presence", run: consumers},
+	"init":        {usage: "scaffold a small runnable consumer project wired to a table's trigger, with docker-compose running postgres", run: scaffold},
+	"contract":    {usage: "verify a producer's payloads against the consumers' contract file, or print samples of it", run: contract},
+	"deadletters": {usage: "list, edit, requeue or delete a running client's dead letters, through its admin API", run: deadLetters},
+	"lint":        {usage: "validate a pipeline config before it's deployed, failing on any issue", run: lint},
+	"migrate":     {usage: "apply the SQL the library's features need, or write it out as golang-migrate files", run: migrate},
+	"replay":      {usage: "re-publish a capture file's notifications, in order, to a local database", run: replay},
+	"soak":        {usage: "run traffic through a client while killing its connections and restarting it, verifying no event is lost or duplicated", run: soak},
+	"tap":         {usage: "print the next notifications a running client receives, through its admin API", run: tap},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := cmd.run(ctx, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "pqstream %s: %s\n", os.Args[1], err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pqstream <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, cmd.usage)
+	}
+}
+
+//configFlags registers the database connection flags shared by every command
+func configFlags(fs *flag.FlagSet) *pqstream.Config {
+	config := &pqstream.Config{}
+	fs.StringVar(&config.Host, "host", envOr("PGHOST", "localhost"), "postgres host")
+	fs.StringVar(&config.Port, "port", envOr("PGPORT", "5432"), "postgres port")
+	fs.StringVar(&config.User, "user", envOr("PGUSER", "postgres"), "postgres user")
+	fs.StringVar(&config.Password, "password", os.Getenv("PGPASSWORD"), "postgres password")
+	fs.StringVar(&config.WriteUser, "write-user", "", "postgres user that migrations, applies and replays write as, defaults to -user")
+	fs.StringVar(&config.WritePassword, "write-password", "", "password of -write-user")
+	fs.StringVar(&config.Database, "db", envOr("PGDATABASE", "postgres"), "postgres database")
+	fs.StringVar(&config.SSLMode, "sslmode", envOr("PGSSLMODE", "disable"), "postgres sslmode")
+	fs.DurationVar(&config.StatementTimeout, "statement-timeout", 0, "statement_timeout of the tool's sessions, zero keeps the server's")
+	fs.DurationVar(&config.LockTimeout, "lock-timeout", 0, "lock_timeout of the tool's sessions, zero keeps the server's")
+	return config
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
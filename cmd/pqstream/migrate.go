@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"os"
+)
+
+func migrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	config := configFlags(fs)
+	dir := fs.String("dir", "", "write the migrations to this directory as golang-migrate files instead of applying them")
+	table := fs.String("table", "", "migration version table, defaults to schema_migrations")
+	opts := pqstream.MigrationOptions{}
+	fs.StringVar(&opts.AuditTable, "audit-table", "", "audit table, defaults to pqstream_audit")
+	fs.StringVar(&opts.HeartbeatTable, "heartbeat-table", "", "heartbeat table, defaults to pqstream_heartbeat")
+	fs.StringVar(&opts.HandoffTable, "handoff-table", "", "handoff table, defaults to pqstream_handoff")
+	fs.StringVar(&opts.NotifyFunction, "notify-function", "", "change trigger function, defaults to pqstream_notify")
+	fs.StringVar(&opts.IDFunction, "id-function", "", "function generating the emit function's envelope ids, defaults to pqstream_uuidv7")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	migrations := pqstream.Migrations(opts)
+	if *dir != "" {
+		if err := pqstream.WriteMigrations(*dir, migrations); err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			fmt.Fprintf(os.Stdout, "wrote %s\n", m)
+		}
+		return nil
+	}
+	db, err := sql.Open("postgres", config.WriteConnInfo())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator := &pqstream.Migrator{DB: db, Table: *table}
+	applied, err := migrator.Up(ctx, migrations)
+	if err != nil {
+		return err
+	}
+	version, _, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "applied %d migrations, now at version %d\n", applied, version)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os"
+)
+
+func replay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	config := configFlags(fs)
+	path := fs.String("capture", "", "capture file to replay")
+	speed := fs.Float64("speed", 1, "pacing relative to the capture: 1 is the original pacing, 0 as fast as possible")
+	keyFile := fs.String("key-file", "", "file holding the hex or base64 key of an encrypted capture")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return fmt.Errorf("-capture is required")
+	}
+	var cipher *pqstream.FileCipher
+	if *keyFile != "" {
+		raw, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key, err := pqstream.ParseFileKey(string(raw))
+		if err != nil {
+			return err
+		}
+		if cipher, err = pqstream.NewFileCipher(key); err != nil {
+			return err
+		}
+	}
+	header, reader, err := pqstream.OpenEncryptedCapture(*path, cipher)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	fmt.Fprintf(os.Stderr, "replaying capture of %s on channels %v taken %s\n", header.InstanceID, header.Channels, header.CreatedAt)
+	db, err := sql.Open("postgres", config.WriteConnInfo())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sink := &pqstream.NotifySink{DB: db}
+	replayer := &pqstream.Replayer{Speed: *speed}
+	n, err := replayer.Replay(ctx, pqstream.HandlerFunc(func(notification *pq.Notification) error {
+		return sink.Send(ctx, notification)
+	}), reader)
+	fmt.Fprintf(os.Stderr, "replayed %d notifications\n", n)
+	return err
+}
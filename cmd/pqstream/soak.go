@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"strings"
+)
+
+func soak(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	config := configFlags(fs)
+	opts := pqstream.SoakOptions{}
+	delivery := fs.String("delivery", string(pqstream.DeliveryAtLeastOnce), "delivery mode whose invariants are verified: at_least_once or at_most_once")
+	outbox := fs.String("outbox", "", "outbox table to publish through and catch up from, from the library's migrations, instead of pg_notify")
+	consumer := fs.String("consumer", "pqstream_soak", "consumer group the outbox checkpoints of the soak's clients are kept under")
+	fs.StringVar(&opts.Channel, "channel", "pqstream_soak", "channel to publish to and listen on")
+	fs.IntVar(&opts.Rate, "rate", 100, "target events per second")
+	fs.IntVar(&opts.PayloadSize, "size", 0, "approximate padding of each event in bytes")
+	fs.DurationVar(&opts.Duration, "duration", 0, "how long to produce traffic for (default 10m)")
+	fs.DurationVar(&opts.KillEvery, "kill-every", 0, "mean interval between terminating the client's listener, negative never does (default 30s)")
+	fs.DurationVar(&opts.RestartEvery, "restart-every", 0, "mean interval between restarting the client, negative never does (default 2m)")
+	fs.DurationVar(&opts.Settle, "settle", 0, "how long an event may take to be delivered before it is counted lost (default 30s)")
+	fs.DurationVar(&opts.ReportEvery, "report-every", 0, "interval between progress reports (default 10s)")
+	fs.Int64Var(&opts.Seed, "seed", 0, "seed of the fault schedule, to repeat a run (default the time)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	config.Delivery = pqstream.Delivery(*delivery)
+	if *outbox != "" {
+		config.Outbox = &pqstream.Outbox{Table: *outbox, Consumer: *consumer}
+	}
+	opts.OnReport = func(report *pqstream.SoakReport) {
+		fmt.Println(report.String())
+	}
+	report, err := pqstream.Soak(ctx, config, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report.String())
+	if !report.OK() {
+		return errors.New(strings.Join(report.Violations, "; "))
+	}
+	return nil
+}
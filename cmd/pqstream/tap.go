@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/autom8ter/pqstream"
+	"os"
+	"time"
+)
+
+func tap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tap", flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "base url of the client's admin API")
+	channel := fs.String("channel", "", "channel to tap (default every channel)")
+	n := fs.Int("n", 10, "number of notifications to print")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for notifications")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	records, err := pqstream.NewAdminClient(*addr).Tap(ctx, *channel, *n, *timeout)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
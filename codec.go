@@ -0,0 +1,53 @@
+package pqstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//A Codec decodes notification payloads into Go values
+type Codec interface {
+	Decode(payload string, v any) error
+}
+
+//maxPooledBuffer is the largest buffer returned to the pool, so an occasional huge payload doesn't pin memory
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return bytes.NewBuffer(make([]byte, 0, 8<<10))
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+//JSONCodec decodes JSON payloads, copying each payload into a pooled buffer instead of allocating a new []byte per notification
+type JSONCodec struct{}
+
+//Decode unmarshals a JSON payload into v
+func (JSONCodec) Decode(payload string, v any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(payload)
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+//DefaultCodec is the Codec used when none is configured
+var DefaultCodec Codec = JSONCodec{}
+
+//DecodeJSON unmarshals a notification's JSON payload into v using the DefaultCodec
+func DecodeJSON(notification *pq.Notification, v any) error {
+	return DefaultCodec.Decode(notification.Extra, v)
+}
@@ -0,0 +1,66 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+type user struct {
+	ID    int             `json:"id"`
+	Name  string          `json:"name"`
+	Email string          `json:"email"`
+	Meta  json.RawMessage `json:"meta"`
+}
+
+var benchPayload = `{"id": 1, "name": "bob", "email": "bob@example.com", "meta": {"bio": "` + strings.Repeat("x", 2048) + `"}}`
+
+func TestDecodeJSONDoesNotAliasPooledBuffers(t *testing.T) {
+	var first, second user
+	if err := pqstream.DecodeJSON(&pq.Notification{Extra: `{"id": 1, "meta": {"a": 1}}`}, &first); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := pqstream.DecodeJSON(&pq.Notification{Extra: `{"id": 2, "meta": {"b": 2}}`}, &second); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(first.Meta) != `{"a": 1}` || second.ID != 2 {
+		t.Fatalf("decoded values were clobbered by buffer reuse: %s %+v", first.Meta, second)
+	}
+	if err := pqstream.DecodeJSON(&pq.Notification{Extra: "{"}, &first); err == nil {
+		t.Fatal("expected an error decoding invalid json")
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	n := &pq.Notification{Extra: benchPayload}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var u user
+		if err := pqstream.DecodeJSON(n, &u); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkDecodeJSONUnpooled(b *testing.B) {
+	n := &pq.Notification{Extra: benchPayload}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var u user
+		if err := json.Unmarshal([]byte(n.Extra), &u); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkParseEnvelope(b *testing.B) {
+	n := &pq.Notification{Extra: `{"id": "1", "emitted_at": "2020-01-02T15:04:05Z", "data": ` + benchPayload + `}`}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pqstream.ParseEnvelope(n); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package pqstream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//CompactOptions configures the compaction of record files
+type CompactOptions struct {
+	//Keys keys change event records by channel, table and primary key. Records it can't key are kept
+	Keys *KeyRegistry
+	//Key overrides Keys with a custom record key, returning false for records that must be kept
+	Key func(r Record) (string, bool)
+	//Horizon is the age beyond which records are compacted. Records received more recently are all kept
+	Horizon time.Duration
+	//Clock is the source of time for the horizon. Defaults to SystemClock
+	Clock Clock
+	//Cipher decrypts files ending in .enc and encrypts the compacted file if the first one does. FileSink.Compact defaults it to the sink's
+	Cipher *FileCipher
+}
+
+func (o CompactOptions) key(r Record) (string, bool) {
+	if o.Key != nil {
+		return o.Key(r)
+	}
+	e, err := ParseChange(r.Notification())
+	if err != nil {
+		return "", false
+	}
+	key, err := o.Keys.Key(e)
+	if err != nil {
+		return "", false
+	}
+	return r.Channel + "/" + e.QualifiedTable() + ":" + key, true
+}
+
+//CompactStats counts the records a compaction kept and dropped
+type CompactStats struct {
+	Kept    int `json:"kept"`
+	Dropped int `json:"dropped"`
+}
+
+//CompactFiles compacts NDJSON record files, in order, into the first of them: of the records older than the horizon only the latest one per key is kept,
+//so storage is bounded for high churn keys while replaying the files still ends at each key's latest state. The remaining files are removed.
+//The compacted file is written beside the first and renamed over it, so a failed compaction leaves the files untouched
+func CompactFiles(opts CompactOptions, paths ...string) (CompactStats, error) {
+	var stats CompactStats
+	if opts.Key == nil && opts.Keys == nil {
+		return stats, errors.New("compaction requires a key registry or key func")
+	}
+	if len(paths) == 0 {
+		return stats, nil
+	}
+	horizon := clockOr(opts.Clock).Now().Add(-opts.Horizon)
+	latest := map[string]int{}
+	err := eachRecord(paths, opts.Cipher, func(i int, r Record) {
+		if !r.ReceivedAt.After(horizon) {
+			if key, ok := opts.key(r); ok {
+				latest[key] = i
+			}
+		}
+	})
+	if err != nil {
+		return stats, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(paths[0]), ".compact-*")
+	if err != nil {
+		return stats, fmt.Errorf("failed to create compacted file! %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	var (
+		out io.Writer = tmp
+		enc io.WriteCloser
+		gz  *gzip.Writer
+	)
+	name := paths[0]
+	if strings.HasSuffix(name, ".enc") {
+		if opts.Cipher == nil {
+			return stats, fmt.Errorf("%s is encrypted, compact it with a cipher", name)
+		}
+		enc = opts.Cipher.Writer(tmp)
+		out = enc
+		name = strings.TrimSuffix(name, ".enc")
+	}
+	if strings.HasSuffix(name, ".gz") {
+		gz = gzip.NewWriter(out)
+		out = gz
+	}
+	buf := bufio.NewWriter(out)
+	var werr error
+	err = eachRecord(paths, opts.Cipher, func(i int, r Record) {
+		if werr != nil {
+			return
+		}
+		if !r.ReceivedAt.After(horizon) {
+			if key, ok := opts.key(r); ok && latest[key] != i {
+				stats.Dropped++
+				return
+			}
+		}
+		stats.Kept++
+		line, err := json.Marshal(r)
+		if err == nil {
+			_, err = buf.Write(append(line, '\n'))
+		}
+		werr = err
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return CompactStats{}, fmt.Errorf("failed to write compacted file! %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), paths[0]); err != nil {
+		return CompactStats{}, fmt.Errorf("failed to replace %s! %s", paths[0], err.Error())
+	}
+	for _, path := range paths[1:] {
+		if err := os.Remove(path); err != nil {
+			return stats, fmt.Errorf("failed to remove compacted file %s! %s", path, err.Error())
+		}
+	}
+	return stats, nil
+}
+
+//eachRecord passes every record of the files to fn along with its position across all of them
+func eachRecord(paths []string, c *FileCipher, fn func(i int, r Record)) error {
+	i := 0
+	for _, path := range paths {
+		reader, err := OpenEncryptedRecords(path, c)
+		if err != nil {
+			return fmt.Errorf("failed to open %s! %s", path, err.Error())
+		}
+		for {
+			r, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return fmt.Errorf("failed to read %s! %s", path, err.Error())
+			}
+			fn(i, r)
+			i++
+		}
+		reader.Close()
+	}
+	return nil
+}
+
+//Compact compacts the sink's rotated files with CompactFiles, leaving the file currently being written alone. Only NDJSON files of Records can be compacted
+func (f *FileSink) Compact(opts CompactOptions) (CompactStats, error) {
+	if f.opts.Format != NDJSON {
+		return CompactStats{}, errors.New("only ndjson files can be compacted")
+	}
+	if _, ok := f.opts.Marshaler.(RecordMarshaler); !ok {
+		return CompactStats{}, errors.New("only files of records can be compacted")
+	}
+	paths, err := filepath.Glob(filepath.Join(f.opts.Dir, f.opts.Prefix+"-*.ndjson*"))
+	if err != nil {
+		return CompactStats{}, err
+	}
+	f.mu.Lock()
+	current := ""
+	if f.file != nil {
+		current = f.file.Name()
+	}
+	f.mu.Unlock()
+	var closed []string
+	for _, path := range paths {
+		if path != current {
+			closed = append(closed, path)
+		}
+	}
+	sort.Strings(closed)
+	if opts.Cipher == nil {
+		opts.Cipher = f.opts.Cipher
+	}
+	return CompactFiles(opts, closed...)
+}
@@ -0,0 +1,75 @@
+package pqstream_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSinkCompact(t *testing.T) {
+	dir := t.TempDir()
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, MaxAge: time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	send := func(id int, name string) {
+		payload := fmt.Sprintf(`{"table": "users", "op": "UPDATE", "new": {"id": %d, "name": "%s"}}`, id, name)
+		if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+		clock.Advance(time.Minute)
+	}
+	send(1, "a")
+	send(1, "b")
+	send(2, "a")
+	sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: "unkeyed"})
+	clock.Advance(time.Minute)
+	send(1, "c")
+	clock.Advance(time.Hour)
+	send(1, "d")
+	send(1, "e")
+
+	stats, err := sink.Compact(pqstream.CompactOptions{Keys: pqstream.NewKeyRegistry().Register("users", "id"), Horizon: 30 * time.Minute, Clock: clock})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Kept != 4 || stats.Dropped != 2 {
+		t.Fatalf("unexpected compaction: %+v", stats)
+	}
+	sink.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "pqstream-*.ndjson"))
+	if len(files) != 2 {
+		t.Fatalf("expected the compacted file and the current one, got: %v", files)
+	}
+	reader, err := pqstream.OpenRecords(files[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer reader.Close()
+	var payloads []string
+	for {
+		r, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		payloads = append(payloads, r.Payload)
+	}
+	want := []string{
+		`{"table": "users", "op": "UPDATE", "new": {"id": 2, "name": "a"}}`,
+		"unkeyed",
+		`{"table": "users", "op": "UPDATE", "new": {"id": 1, "name": "c"}}`,
+		`{"table": "users", "op": "UPDATE", "new": {"id": 1, "name": "d"}}`,
+	}
+	if fmt.Sprint(payloads) != fmt.Sprint(want) {
+		t.Fatalf("unexpected compacted records: %v", payloads)
+	}
+}
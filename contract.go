@@ -0,0 +1,290 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+//contractTypes are the JSON types a ContractField may require
+var contractTypes = map[string]bool{"": true, "string": true, "number": true, "integer": true, "boolean": true, "object": true, "array": true}
+
+//A Contract declares what a consumer relies on in a channel's payloads. Consumers write theirs into a contract file shared with the channel's producers,
+//ie: checked into both repositories, so each side's CI runs against it: producers Verify the payloads they send, failing on a change that would
+//break a consumer before it's deployed, and consumers test their handlers against the Sample payload the contract promises
+//
+//	contracts:
+//	  - consumer: billing
+//	    channel: orders
+//	    fields:
+//	      - path: data.order_id
+//	        type: integer
+//	      - path: data.status
+//	        enum: [placed, paid, shipped]
+type Contract struct {
+	Consumer string          `json:"consumer"`
+	Channel  string          `json:"channel"`
+	Fields   []ContractField `json:"fields"`
+}
+
+//A ContractField is a payload field a consumer reads
+type ContractField struct {
+	//Path uses Mapping's path syntax, ie: data.order_id or new.email for a ChangeEvent
+	Path string `json:"path"`
+	//Type is the JSON type the field must have: string, number, integer, boolean, object or array. Empty accepts any
+	Type string `json:"type,omitempty"`
+	//Optional fields may be missing, but must have their Type when present
+	Optional bool `json:"optional,omitempty"`
+	//Nullable fields may be null
+	Nullable bool `json:"nullable,omitempty"`
+	//Enum are the values the field may have, ie: the statuses a consumer has a case for
+	Enum []any `json:"enum,omitempty"`
+}
+
+//A ContractViolation is a payload breaking a consumer's contract
+type ContractViolation struct {
+	Consumer string `json:"consumer"`
+	Channel  string `json:"channel"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+func (v ContractViolation) String() string {
+	return fmt.Sprintf("%s on %s: %s %s", v.Consumer, v.Channel, v.Path, v.Message)
+}
+
+//A ContractError is the violations of a payload that breaks one or more contracts
+type ContractError struct {
+	Violations []ContractViolation
+}
+
+func (e *ContractError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return "payload breaks its consumers' contracts: " + strings.Join(msgs, "; ")
+}
+
+//Contracts are the contracts of a contract file, of any number of consumers and channels
+type Contracts []Contract
+
+//ParseContracts decodes a contract file written in YAML or JSON, rejecting unknown fields, invalid paths and unknown types so a typo can't pass every payload
+func ParseContracts(data []byte) (Contracts, error) {
+	encoded := data
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse contracts! %s", err.Error())
+		}
+		if encoded, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("failed to parse contracts! %s", err.Error())
+		}
+	}
+	dec := json.NewDecoder(strings.NewReader(string(encoded)))
+	dec.DisallowUnknownFields()
+	file := struct {
+		Contracts Contracts `json:"contracts"`
+	}{}
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse contracts! %s", err.Error())
+	}
+	for i, c := range file.Contracts {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("contracts[%d]: %s", i, err.Error())
+		}
+	}
+	return file.Contracts, nil
+}
+
+func (c Contract) validate() error {
+	if c.Consumer == "" {
+		return errors.New("contract requires a consumer")
+	}
+	if err := ValidateChannel(c.Channel); err != nil {
+		return err
+	}
+	for i, f := range c.Fields {
+		if msg := lintPath(f.Path, true); msg != "" {
+			return fmt.Errorf("fields[%d]: invalid path %q: %s", i, f.Path, msg)
+		}
+		if !contractTypes[f.Type] {
+			return fmt.Errorf("fields[%d]: unknown type %q, expected string, number, integer, boolean, object or array", i, f.Type)
+		}
+		for _, value := range f.Enum {
+			if f.Type != "" && !hasType(value, f.Type) {
+				return fmt.Errorf("fields[%d]: enum value %v isn't a %s", i, value, f.Type)
+			}
+		}
+	}
+	return nil
+}
+
+//Verify checks a notification against the contracts of its channel, returning a *ContractError with every violation if it breaks any
+func (cs Contracts) Verify(notification *pq.Notification) error {
+	var violations []ContractViolation
+	for _, c := range cs {
+		if c.Channel == notification.Channel {
+			violations = append(violations, c.violations(notification)...)
+		}
+	}
+	if len(violations) > 0 {
+		return &ContractError{Violations: violations}
+	}
+	return nil
+}
+
+//VerifyPayload checks a payload a producer sends on a channel, encoded as JSON unless it is already a string or []byte, ie: in a unit test of the
+//function building it
+func (cs Contracts) VerifyPayload(channel string, payload any) error {
+	var extra string
+	switch p := payload.(type) {
+	case string:
+		extra = p
+	case []byte:
+		extra = string(p)
+	default:
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encode payload! %s", err.Error())
+		}
+		extra = string(encoded)
+	}
+	return cs.Verify(&pq.Notification{Channel: channel, Extra: extra})
+}
+
+//Samples returns a sample notification of each contract, for consumers to test their handlers with, ie: by replaying them through a Client's Process
+func (cs Contracts) Samples() []*pq.Notification {
+	samples := make([]*pq.Notification, len(cs))
+	for i, c := range cs {
+		samples[i] = c.Sample()
+	}
+	return samples
+}
+
+func (c Contract) violations(notification *pq.Notification) []ContractViolation {
+	var violations []ContractViolation
+	violate := func(path, msg string, args ...any) {
+		violations = append(violations, ContractViolation{Consumer: c.Consumer, Channel: c.Channel, Path: path, Message: fmt.Sprintf(msg, args...)})
+	}
+	payload, err := decodePayload(notification)
+	if err != nil || payload == nil {
+		violate("$payload", "isn't JSON")
+		return violations
+	}
+	for _, f := range c.Fields {
+		value, ok := resolve(notification, payload, f.Path)
+		switch {
+		case !ok && !f.Optional:
+			violate(f.Path, "is missing")
+		case !ok:
+		case value == nil && !f.Nullable:
+			violate(f.Path, "is null")
+		case value == nil:
+		case f.Type != "" && !hasType(value, f.Type):
+			violate(f.Path, "is %s, expected %s", typeOf(value), f.Type)
+		case len(f.Enum) > 0 && !inEnum(value, f.Enum):
+			violate(f.Path, "is %s, expected one of %s", jsonString(value), jsonString(f.Enum))
+		}
+	}
+	return violations
+}
+
+//Sample returns a notification whose payload has every field of the contract, with the first of its Enum or a zero value of its Type
+func (c Contract) Sample() *pq.Notification {
+	payload := map[string]any{}
+	for _, f := range c.Fields {
+		if strings.HasPrefix(f.Path, "$") {
+			continue
+		}
+		var value any
+		switch {
+		case len(f.Enum) > 0:
+			value = f.Enum[0]
+		case f.Type == "number", f.Type == "integer":
+			value = 0
+		case f.Type == "boolean":
+			value = false
+		case f.Type == "object":
+			value = map[string]any{}
+		case f.Type == "array":
+			value = []any{}
+		default:
+			value = ""
+		}
+		node := payload
+		parts := strings.Split(f.Path, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[part] = child
+			}
+			node = child
+		}
+		if _, ok := node[parts[len(parts)-1]].(map[string]any); !ok {
+			node[parts[len(parts)-1]] = value
+		}
+	}
+	encoded, _ := json.Marshal(payload)
+	return &pq.Notification{Channel: c.Channel, Extra: string(encoded)}
+}
+
+//hasType reports whether a decoded JSON value has a contract type
+func hasType(value any, typ string) bool {
+	actual := typeOf(value)
+	return actual == typ || (typ == "number" && actual == "integer")
+}
+
+//typeOf returns the contract type of a value decoded with UseNumber, or of an enum value decoded without it
+func typeOf(value any) string {
+	switch v := value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case int:
+		return "integer"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func inEnum(value any, enum []any) bool {
+	encoded := jsonString(value)
+	for _, allowed := range enum {
+		if jsonString(allowed) == encoded {
+			return true
+		}
+	}
+	return false
+}
+
+//jsonString encodes a value canonically, so numbers decoded with and without UseNumber compare equal
+func jsonString(value any) string {
+	if n, ok := value.(json.Number); ok {
+		var f float64
+		if err := json.Unmarshal([]byte(n), &f); err == nil {
+			value = f
+		}
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
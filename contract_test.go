@@ -0,0 +1,95 @@
+package pqstream_test
+
+import (
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+const contractFile = `
+contracts:
+  - consumer: billing
+    channel: orders
+    fields:
+      - path: data.order_id
+        type: integer
+      - path: data.total
+        type: number
+      - path: data.status
+        type: string
+        enum: [placed, paid]
+      - path: data.coupon
+        type: string
+        optional: true
+        nullable: true
+  - consumer: shipping
+    channel: orders
+    fields:
+      - path: data.address.zip
+        type: string
+`
+
+func TestContracts(t *testing.T) {
+	contracts, err := pqstream.ParseContracts([]byte(contractFile))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(contracts) != 2 || len(contracts[0].Fields) != 4 || !contracts[0].Fields[3].Optional {
+		t.Fatalf("unexpected contracts: %+v", contracts)
+	}
+	ok := map[string]any{"data": map[string]any{"order_id": 7, "total": 12.5, "status": "paid", "coupon": nil, "address": map[string]any{"zip": "02110"}}}
+	if err := contracts.VerifyPayload("orders", ok); err != nil {
+		t.Fatalf("expected the payload to honor both contracts, got: %v", err)
+	}
+	if err := contracts.VerifyPayload("users", `not json`); err != nil {
+		t.Fatalf("expected channels without contracts to pass, got: %v", err)
+	}
+	//a producer renaming order_id and adding a status breaks billing, and dropping the address breaks shipping
+	broken := `{"data": {"id": 7, "total": "12.50", "status": "refunded", "coupon": 3}}`
+	err = contracts.Verify(&pq.Notification{Channel: "orders", Extra: broken})
+	var contractErr *pqstream.ContractError
+	if !errors.As(err, &contractErr) {
+		t.Fatalf("expected a contract error, got: %v", err)
+	}
+	var got []string
+	for _, v := range contractErr.Violations {
+		got = append(got, v.String())
+	}
+	expected := []string{
+		"billing on orders: data.order_id is missing",
+		"billing on orders: data.total is string, expected number",
+		`billing on orders: data.status is "refunded", expected one of ["placed","paid"]`,
+		"billing on orders: data.coupon is integer, expected string",
+		"shipping on orders: data.address.zip is missing",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected violations:\n%s", strings.Join(got, "\n"))
+	}
+	if err := contracts.VerifyPayload("orders", `{"data": {"order_id": 1.5}}`); err == nil || !strings.Contains(err.Error(), "data.order_id is number, expected integer") {
+		t.Fatalf("expected a fractional id to break the contract, got: %v", err)
+	}
+
+	//consumers test their handlers with samples honoring their contracts
+	for i, sample := range contracts.Samples() {
+		if err := contracts[i : i+1].Verify(sample); sample.Channel != "orders" || err != nil {
+			t.Fatalf("expected the sample to honor its contract, got: %s %v", sample.Extra, err)
+		}
+	}
+	if sample := contracts[0].Sample(); sample.Extra != `{"data":{"coupon":"","order_id":0,"status":"placed","total":0}}` {
+		t.Fatalf("unexpected sample: %s", sample.Extra)
+	}
+
+	for _, bad := range []string{
+		"contracts:\n  - consumer: billing\n    channel: orders\n    fields:\n      - path: data.id\n        type: int\n",
+		"contracts:\n  - consumer: billing\n    channel: orders\n    fields:\n      - path: data..id\n",
+		"contracts:\n  - channel: orders\n",
+		"contracts:\n  - consumer: billing\n    channel: orders\n    feilds: []\n",
+		"contracts:\n  - consumer: billing\n    channel: orders\n    fields:\n      - path: data.status\n        type: integer\n        enum: [placed]\n",
+	} {
+		if _, err := pqstream.ParseContracts([]byte(bad)); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//defaultRedactFields are the JSON fields masked in payloads a dashboard shows when DashboardOptions.RedactFields is unset
+var defaultRedactFields = []string{"password", "secret", "token", "email"}
+
+//DashboardOptions configure a DashboardHandler
+type DashboardOptions struct {
+	//Authorize decides whether a request may use the dashboard, its admin API included. It is required: a dashboard without it refuses every request
+	Authorize func(r *http.Request) error
+	//Origins are the origins of the web pages allowed to call the dashboard from another site, see StreamOptions.Origins
+	Origins []string
+	//Payloads shows notification payloads, redacted, in the recent events feed and the admin API. Defaults to false, showing only their size
+	Payloads bool
+	//RedactFields are the JSON fields, matched case insensitively at any depth, whose values are masked in shown payloads. Defaults to password, secret, token and email
+	RedactFields []string
+	//Stream is the StreamServer the recent events feed subscribes to. Defaults to one shared by every dashboard of the client
+	Stream *StreamServer
+}
+
+func (o DashboardOptions) redactFields() []string {
+	if len(o.RedactFields) == 0 {
+		return defaultRedactFields
+	}
+	return o.RedactFields
+}
+
+//redact returns the shown form of a payload: redacted with Payloads, its size otherwise
+func (o DashboardOptions) redact(payload string) string {
+	if o.Payloads {
+		return redactPayload(payload, o.redactFields())
+	}
+	return fmt.Sprintf("[%d bytes]", len(payload))
+}
+
+//dashboardStream returns the StreamServer shared by the client's dashboards, built on first use so building dashboards doesn't add a handler each time
+func (c *Client) dashboardStream() *StreamServer {
+	c.dashboard.Do(func() {
+		c.dashStream = NewStreamServer(c, StreamOptions{Authorize: AuthorizeAny})
+	})
+	return c.dashStream
+}
+
+//DashboardHandler returns an http.Handler serving a web UI for operating a client: live throughput per channel, recent notifications with their payloads redacted,
+//a feed of errors and listener events, and controls to pause and resume channels. GET / serves the page, /api/ the AdminHandler it is built on,
+//and GET /stream and GET /feed the Server-Sent Events of recent notifications and of the client's Events. Every request is checked by opts.Authorize
+func DashboardHandler(c *Client, opts DashboardOptions) http.Handler {
+	stream := opts.Stream
+	if stream == nil {
+		stream = c.dashboardStream()
+	}
+	admin := AdminOptions{Authorize: opts.Authorize, Origins: opts.Origins, Redact: opts.redact}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", AdminHandler(c, admin)))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		records, cancel := stream.Subscribe(c.Channels(), nil)
+		defer cancel()
+		serveSSE(w, r, c, func(send func(event string, v any) error) error {
+			select {
+			case record := <-records:
+				record.Payload = opts.redact(record.Payload)
+				return send("notification", record)
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		})
+	})
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		events, cancel := c.Events(0)
+		defer cancel()
+		serveSSE(w, r, c, func(send func(event string, v any) error) error {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return ErrClientStopped
+				}
+				return send(string(e.Type), e)
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the admin API checks its own requests, with the AdminHeader its changes require
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			if err := admin.authorize(r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+//serveSSE streams Server-Sent Events to a request, calling next to send each one until it fails, the request ends or the client stops
+func serveSSE(w http.ResponseWriter, r *http.Request, c *Client, next func(send func(event string, v any) error) error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	send := func(event string, v any) error {
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	for !c.isStopping() {
+		if err := next(send); err != nil {
+			return
+		}
+	}
+}
+
+//redactPayload masks the values of the fields in a JSON payload, leaving payloads that aren't JSON objects or arrays masked entirely
+func redactPayload(payload string, fields []string) string {
+	var v any
+	if err := json.Unmarshal([]byte(payload), &v); err != nil {
+		return redacted
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+	default:
+		return redacted
+	}
+	masked, err := json.Marshal(redactValue(v, fields))
+	if err != nil {
+		return redacted
+	}
+	return string(masked)
+}
+
+func redactValue(v any, fields []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			masked := false
+			for _, f := range fields {
+				masked = masked || strings.EqualFold(key, f)
+			}
+			if masked {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(child, fields)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactValue(child, fields)
+		}
+	}
+	return v
+}
+
+const dashboardHTML = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pqstream</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 0; background: #f6f7f9; color: #1d2330; }
+header { background: #1d2330; color: #fff; padding: 12px 20px; }
+main { display: grid; grid-template-columns: 1fr 1fr; gap: 16px; padding: 16px 20px; }
+section { background: #fff; border-radius: 6px; padding: 12px 16px; box-shadow: 0 1px 2px rgba(0,0,0,.08); }
+section.wide { grid-column: span 2; }
+h2 { font-size: 15px; margin: 0 0 8px; }
+table { width: 100%; border-collapse: collapse; }
+td, th { text-align: left; padding: 4px 6px; border-bottom: 1px solid #eceef2; vertical-align: top; }
+.log { max-height: 320px; overflow-y: auto; font-family: ui-monospace, monospace; font-size: 12px; }
+.log div { padding: 2px 0; border-bottom: 1px solid #f0f1f4; word-break: break-all; }
+.error { color: #b3261e; }
+button { font: inherit; padding: 2px 8px; }
+</style>
+</head>
+<body>
+<header><strong>pqstream</strong> <span id="member"></span></header>
+<main>
+<section class="wide"><h2>Channels</h2>
+<table><thead><tr><th>channel</th><th>throughput</th><th>rate/s</th><th>received</th><th>errors</th><th>queued</th><th>lag</th><th></th></tr></thead><tbody id="channels"></tbody></table>
+</section>
+<section><h2>Recent notifications</h2><div class="log" id="notifications"></div></section>
+<section><h2>Errors and events</h2><div class="log" id="feed"></div></section>
+</main>
+<script>
+const rates = {}, last = {};
+let paused = {};
+function esc(s) {
+	return String(s).replace(/[&<>"']/g, c => "&#" + c.charCodeAt(0) + ";");
+}
+function spark(points) {
+	const max = Math.max(1, ...points), w = 160, h = 28;
+	const d = points.map((p, i) => (i ? "L" : "M") + (i * w / 59).toFixed(1) + "," + (h - p / max * h).toFixed(1)).join(" ");
+	return '<svg width="' + w + '" height="' + h + '"><path d="' + d + '" fill="none" stroke="#3b6fd8" stroke-width="1.5"/></svg>';
+}
+function prepend(id, text, cls) {
+	const log = document.getElementById(id), line = document.createElement("div");
+	line.textContent = text;
+	if (cls) line.className = cls;
+	log.prepend(line);
+	while (log.children.length > 200) log.lastChild.remove();
+}
+async function pause(channel, on) {
+	await fetch("api/pause?channel=" + encodeURIComponent(channel) + (on ? "&for=10m" : ""), {method: on ? "POST" : "DELETE", headers: {"X-Pqstream-Admin": "1"}});
+	refresh();
+}
+async function refresh() {
+	const stats = await (await fetch("api/stats")).json();
+	paused = await (await fetch("api/pause")).json();
+	document.getElementById("member").textContent = stats.member.instance_id + " (" + stats.member.role + ")";
+	const rows = [];
+	for (const [name, ch] of Object.entries(stats.channels).sort()) {
+		const rate = name in last ? Math.max(0, (ch.received - last[name]) / 2) : 0;
+		last[name] = ch.received;
+		rates[name] = (rates[name] || []).concat([rate]).slice(-60);
+		const button = '<button data-channel="' + esc(name) + '" data-pause="' + !(name in paused) + '">' + (name in paused ? "resume" : "pause") + "</button>";
+		rows.push("<tr><td>" + esc(name) + "</td><td>" + spark(rates[name]) + "</td><td>" + rate.toFixed(1) + "</td><td>" + ch.received + "</td><td>" + ch.errors +
+			"</td><td>" + ch.queued + "</td><td>" + (ch.consumer_lag / 1e6).toFixed(1) + "ms</td><td>" + button + "</td></tr>");
+	}
+	document.getElementById("channels").innerHTML = rows.join("");
+}
+document.getElementById("channels").addEventListener("click", e => {
+	if (e.target.dataset.channel) pause(e.target.dataset.channel, e.target.dataset.pause === "true");
+});
+new EventSource("stream").addEventListener("notification", e => {
+	const r = JSON.parse(e.data);
+	prepend("notifications", r.received_at + " " + r.channel + " " + r.payload);
+});
+const feed = new EventSource("feed");
+for (const type of ["channel_up", "channel_down", "handler_failed", "handler_slow", "checkpoint_advanced"]) {
+	feed.addEventListener(type, e => {
+		const ev = JSON.parse(e.data);
+		prepend("feed", ev.time + " " + ev.type + " " + ev.channel + (ev.handler ? " " + ev.handler : "") + (ev.error ? ": " + ev.error : ""), ev.error ? "error" : "");
+	});
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
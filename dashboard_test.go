@@ -0,0 +1,142 @@
+package pqstream_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := httptest.NewServer(pqstream.DashboardHandler(client, pqstream.DashboardOptions{Authorize: pqstream.AuthorizeAnyAdmin, Payloads: true}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the dashboard page, got: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/pause?channel=users&for=1m", nil)
+	req.Header.Set(pqstream.AdminHeader, "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if _, ok := client.Paused()["users"]; !ok {
+		t.Fatal("expected the channel to be paused")
+	}
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/api/pause?channel=users", nil)
+	req.Header.Set(pqstream.AdminHeader, "1")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if len(client.Paused()) != 0 {
+		t.Fatalf("expected the channel to be resumed, got: %v", client.Paused())
+	}
+
+	stream, err := http.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer stream.Body.Close()
+	//the subscription is registered once the handler has flushed its headers, but Process may still race it, so notify until one arrives
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				client.Process(&pq.Notification{Channel: "users", Extra: `{"name": "ada", "user": {"Password": "hunter2"}}`})
+			}
+		}
+	}()
+	r := bufio.NewReader(stream.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var record pqstream.Record
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &record); err != nil {
+			t.Fatal(err.Error())
+		}
+		if record.Payload != `{"name":"ada","user":{"Password":"[redacted]"}}` {
+			t.Fatalf("expected the password to be redacted, got: %s", record.Payload)
+		}
+		return
+	}
+}
+
+func TestDashboardAuthorize(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			return errors.New("malformed payload")
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{DeadLetters: &pqstream.MemoryDeadLetters{}}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"name": "ada", "token": "x"}`})
+	get := func(h http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	closed := pqstream.DashboardHandler(client, pqstream.DashboardOptions{})
+	for _, path := range []string{"/", "/api/stats"} {
+		if w := get(closed, path, nil); w.Code != http.StatusForbidden {
+			t.Fatalf("expected a dashboard without Authorize to refuse %s, got %d", path, w.Code)
+		}
+	}
+	open := pqstream.DashboardHandler(client, pqstream.DashboardOptions{Authorize: pqstream.AuthorizeAnyAdmin})
+	if w := get(open, "/", map[string]string{"Origin": "https://evil.example.com"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected another site's page to be refused, got %d", w.Code)
+	}
+	var letters []pqstream.DeadLetter
+	if err := json.Unmarshal(get(open, "/api/deadletters", nil).Body.Bytes(), &letters); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 1 || letters[0].Payload != "[29 bytes]" {
+		t.Fatalf("expected the dead letter's payload to be hidden, got: %+v", letters)
+	}
+	redacted := pqstream.DashboardHandler(client, pqstream.DashboardOptions{Authorize: pqstream.AuthorizeAnyAdmin, Payloads: true})
+	if err := json.Unmarshal(get(redacted, "/api/deadletters", nil).Body.Bytes(), &letters); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 1 || letters[0].Payload != `{"name":"ada","token":"[redacted]"}` {
+		t.Fatalf("expected the dead letter's payload to be redacted, got: %+v", letters)
+	}
+	if streams := strings.Count(client.DOT(), `"stream"`); streams != 1 {
+		t.Fatalf("expected the dashboards to share one stream server, got %d", streams)
+	}
+}
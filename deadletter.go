@@ -0,0 +1,470 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrNoDeadLetters is returned by the dead letter methods of a client without a DeadLetterStore
+var ErrNoDeadLetters = errors.New("client has no dead letter store configured")
+
+//ErrDeadLetterNotFound is returned when no dead letter has the given id
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+//A DeadLetterFailure is a single handler failure on a dead lettered notification. Attempt is 1 for the notification's first delivery, counting each retry
+//of a durable client and each requeue after it
+type DeadLetterFailure struct {
+	Attempt int       `json:"attempt"`
+	Handler string    `json:"handler"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+//A DeadLetter is a notification a client's handlers failed on, with every failure since it was first delivered
+type DeadLetter struct {
+	ID        int64               `json:"id"`
+	Channel   string              `json:"channel"`
+	PID       int                 `json:"pid"`
+	Payload   string              `json:"payload"`
+	Attempts  int                 `json:"attempts"`
+	Failures  []DeadLetterFailure `json:"failures"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+func (d DeadLetter) notification() *pq.Notification {
+	return &pq.Notification{Channel: d.Channel, BePid: d.PID, Extra: d.Payload}
+}
+
+//A DeadLetterFilter selects dead letters. Empty fields match every dead letter
+type DeadLetterFilter struct {
+	IDs     []int64
+	Channel string
+	//Handler matches the dead letters a handler failed on at least once, by name, ie: main[0](*pqstream.WebhookSink)
+	Handler string
+	//Limit caps the number of dead letters selected, oldest first. Zero selects them all
+	Limit int
+}
+
+//IsZero reports whether the filter matches every dead letter
+func (f DeadLetterFilter) IsZero() bool {
+	return len(f.IDs) == 0 && f.Channel == "" && f.Handler == ""
+}
+
+func (f DeadLetterFilter) matches(d DeadLetter) bool {
+	if f.Channel != "" && d.Channel != f.Channel {
+		return false
+	}
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			found = found || id == d.ID
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Handler != "" {
+		for _, failure := range d.Failures {
+			if failure.Handler == f.Handler {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+//A DeadLetterStore persists the notifications a client's handlers failed on, see Config.DeadLetters
+type DeadLetterStore interface {
+	//Add stores a new dead letter, returning its id
+	Add(ctx context.Context, letter DeadLetter) (int64, error)
+	//Fail adds the failures of another attempt at a dead letter to its history
+	Fail(ctx context.Context, id int64, failures []DeadLetterFailure) error
+	//List returns the dead letters matching a filter, oldest first
+	List(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error)
+	//Edit replaces a dead letter's payload, ie: to fix a malformed payload before requeueing it
+	Edit(ctx context.Context, id int64, payload string) error
+	//Delete removes dead letters, returning the number removed
+	Delete(ctx context.Context, ids ...int64) (int64, error)
+}
+
+//DeadLetterTable stores dead letters in a postgres table, their failure history as a jsonb array. It satisfies the Pruner interface by deleting
+//the dead letters that haven't failed since the cutoff, so it can be registered with a Retention
+type DeadLetterTable struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified dead letter table. Defaults to pqstream_dead_letters
+	Table string
+}
+
+func (t *DeadLetterTable) table() string {
+	if t.Table == "" {
+		return "pqstream_dead_letters"
+	}
+	return t.Table
+}
+
+//Setup creates the dead letter table if it doesn't exist
+func (t *DeadLetterTable) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if t.DB == nil {
+		return errors.New("dead letter table requires a db")
+	}
+	if _, err := t.DB.ExecContext(ctx, t.ddl()); err != nil {
+		return fmt.Errorf("failed to create dead letter table! %s", err.Error())
+	}
+	return nil
+}
+
+func (t *DeadLetterTable) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	channel text NOT NULL,
+	pid integer NOT NULL,
+	payload text NOT NULL,
+	attempts integer NOT NULL DEFAULT 1,
+	failures jsonb NOT NULL DEFAULT '[]',
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (channel, id)`, quoteQualified(t.table()), pq.QuoteIdentifier(unqualified(t.table())+"_channel"))
+}
+
+//Add stores a new dead letter, returning its id
+func (t *DeadLetterTable) Add(ctx context.Context, letter DeadLetter) (int64, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	failures, err := json.Marshal(letter.Failures)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = t.DB.QueryRowContext(ctx, fmt.Sprintf("INSERT INTO %s (channel, pid, payload, attempts, failures) VALUES ($1, $2, $3, $4, $5) RETURNING id", quoteQualified(t.table())),
+		letter.Channel, letter.PID, letter.Payload, letter.Attempts, string(failures)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add dead letter on channel: %s! %s", letter.Channel, err.Error())
+	}
+	return id, nil
+}
+
+//Fail adds the failures of another attempt at a dead letter to its history
+func (t *DeadLetterTable) Fail(ctx context.Context, id int64, failures []DeadLetterFailure) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	history, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+	return t.update(ctx, fmt.Sprintf("UPDATE %s SET failures = failures || $2::jsonb, attempts = attempts + 1, updated_at = now() WHERE id = $1", quoteQualified(t.table())),
+		id, string(history))
+}
+
+//Edit replaces a dead letter's payload
+func (t *DeadLetterTable) Edit(ctx context.Context, id int64, payload string) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	return t.update(ctx, fmt.Sprintf("UPDATE %s SET payload = $2, updated_at = now() WHERE id = $1", quoteQualified(t.table())), id, payload)
+}
+
+func (t *DeadLetterTable) update(ctx context.Context, query string, id int64, value string) error {
+	res, err := t.DB.ExecContext(ctx, query, id, value)
+	if err != nil {
+		return fmt.Errorf("failed to update dead letter %d! %s", id, err.Error())
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+//List returns the dead letters matching a filter, oldest first
+func (t *DeadLetterTable) List(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if len(filter.IDs) > 0 {
+		args = append(args, pq.Array(filter.IDs))
+		where = append(where, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+	if filter.Channel != "" {
+		args = append(args, filter.Channel)
+		where = append(where, fmt.Sprintf("channel = $%d", len(args)))
+	}
+	if filter.Handler != "" {
+		handler, _ := json.Marshal([]map[string]string{{"handler": filter.Handler}})
+		args = append(args, string(handler))
+		where = append(where, fmt.Sprintf("failures @> $%d::jsonb", len(args)))
+	}
+	query := fmt.Sprintf("SELECT id, channel, pid, payload, attempts, failures, created_at, updated_at FROM %s", quoteQualified(t.table()))
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := t.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters! %s", err.Error())
+	}
+	defer rows.Close()
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var (
+			d        DeadLetter
+			failures []byte
+		)
+		if err := rows.Scan(&d.ID, &d.Channel, &d.PID, &d.Payload, &d.Attempts, &failures, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to list dead letters! %s", err.Error())
+		}
+		if err := json.Unmarshal(failures, &d.Failures); err != nil {
+			return nil, fmt.Errorf("failed to decode the failures of dead letter %d! %s", d.ID, err.Error())
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+//Delete removes dead letters, returning the number removed
+func (t *DeadLetterTable) Delete(ctx context.Context, ids ...int64) (int64, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := t.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ANY($1)", quoteQualified(t.table())), pq.Array(ids))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete dead letters! %s", err.Error())
+	}
+	return res.RowsAffected()
+}
+
+//Prune deletes the dead letters that last failed before the cutoff
+func (t *DeadLetterTable) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	res, err := t.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE updated_at < $1", quoteQualified(t.table())), before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune dead letters! %s", err.Error())
+	}
+	return res.RowsAffected()
+}
+
+//MemoryDeadLetters stores dead letters in memory, ie: for tests or clients that only need to requeue them before they restart
+type MemoryDeadLetters struct {
+	mu      sync.Mutex
+	last    int64
+	letters map[int64]DeadLetter
+}
+
+//Add stores a new dead letter, returning its id
+func (m *MemoryDeadLetters) Add(ctx context.Context, letter DeadLetter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.letters == nil {
+		m.letters = map[int64]DeadLetter{}
+	}
+	m.last++
+	letter.ID = m.last
+	letter.Failures = append([]DeadLetterFailure(nil), letter.Failures...)
+	m.letters[letter.ID] = letter
+	return letter.ID, nil
+}
+
+//Fail adds the failures of another attempt at a dead letter to its history
+func (m *MemoryDeadLetters) Fail(ctx context.Context, id int64, failures []DeadLetterFailure) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.letters[id]
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	d.Attempts++
+	d.Failures = append(append([]DeadLetterFailure(nil), d.Failures...), failures...)
+	if len(failures) > 0 {
+		d.UpdatedAt = failures[len(failures)-1].Time
+	}
+	m.letters[id] = d
+	return nil
+}
+
+//List returns the dead letters matching a filter, oldest first
+func (m *MemoryDeadLetters) List(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	letters := []DeadLetter{}
+	for _, d := range m.letters {
+		if filter.matches(d) {
+			letters = append(letters, d)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	if filter.Limit > 0 && len(letters) > filter.Limit {
+		letters = letters[:filter.Limit]
+	}
+	return letters, nil
+}
+
+//Edit replaces a dead letter's payload
+func (m *MemoryDeadLetters) Edit(ctx context.Context, id int64, payload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.letters[id]
+	if !ok {
+		return ErrDeadLetterNotFound
+	}
+	d.Payload = payload
+	m.letters[id] = d
+	return nil
+}
+
+//Delete removes dead letters, returning the number removed
+func (m *MemoryDeadLetters) Delete(ctx context.Context, ids ...int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, id := range ids {
+		if _, ok := m.letters[id]; ok {
+			delete(m.letters, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+//deadLetterLog collects the handler failures of a single attempt at a notification
+type deadLetterLog struct {
+	mu       sync.Mutex
+	attempt  int
+	failures []DeadLetterFailure
+}
+
+type deadLetterKey struct{}
+
+func withDeadLetterLog(ctx context.Context, log *deadLetterLog) context.Context {
+	return context.WithValue(ctx, deadLetterKey{}, log)
+}
+
+//recordFailure adds a handler's failure to the dead letter log of the attempt the context belongs to, if any
+func recordFailure(ctx context.Context, handler string, err error, now time.Time) {
+	log, _ := ctx.Value(deadLetterKey{}).(*deadLetterLog)
+	if log == nil {
+		return
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.failures = append(log.failures, DeadLetterFailure{Attempt: log.attempt, Handler: handler, Error: err.Error(), Time: now})
+}
+
+func (l *deadLetterLog) snapshot() []DeadLetterFailure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]DeadLetterFailure(nil), l.failures...)
+}
+
+//deadLetter stores a notification its handlers failed on with the failures of every attempt at it
+func (c *Client) deadLetter(n *pq.Notification, attempts int, failures []DeadLetterFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if c.config.ReadOnly {
+		ctx = WithReadOnly(ctx)
+	}
+	now := c.config.Clock.Now()
+	id, err := c.config.DeadLetters.Add(ctx, DeadLetter{
+		Channel:   n.Channel,
+		PID:       n.BePid,
+		Payload:   n.Extra,
+		Attempts:  attempts,
+		Failures:  failures,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		c.handleErr(n.Channel, fmt.Errorf("failed to dead letter notification pid: %d, channel: %s! %s", n.BePid, n.Channel, err.Error()))
+		return
+	}
+	c.stats.channel(n.Channel).deadLetter()
+	c.events.publish(Event{Type: EventDeadLettered, Channel: n.Channel, Time: now, Position: id})
+}
+
+//DeadLetters returns the dead letters matching a filter, oldest first
+func (c *Client) DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	if c.config.DeadLetters == nil {
+		return nil, ErrNoDeadLetters
+	}
+	return c.config.DeadLetters.List(ctx, filter)
+}
+
+//EditDeadLetter replaces a dead letter's payload, ie: to fix the field a handler rejected before requeueing it
+func (c *Client) EditDeadLetter(ctx context.Context, id int64, payload string) error {
+	if c.config.DeadLetters == nil {
+		return ErrNoDeadLetters
+	}
+	return c.config.DeadLetters.Edit(ctx, id, payload)
+}
+
+//DeleteDeadLetters discards the dead letters matching a filter, returning the number discarded
+func (c *Client) DeleteDeadLetters(ctx context.Context, filter DeadLetterFilter) (int64, error) {
+	letters, err := c.DeadLetters(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, len(letters))
+	for i, d := range letters {
+		ids[i] = d.ID
+	}
+	return c.config.DeadLetters.Delete(ctx, ids...)
+}
+
+//RequeueResult lists the dead letters Requeue processed successfully, which were removed from the store, and those that failed again,
+//whose history now includes the new failures
+type RequeueResult struct {
+	Requeued []int64 `json:"requeued"`
+	Failed   []int64 `json:"failed"`
+}
+
+//Requeue runs the dead letters matching a filter through the client's handlers again, oldest first, as if they had been received from a listener
+func (c *Client) Requeue(ctx context.Context, filter DeadLetterFilter) (RequeueResult, error) {
+	result := RequeueResult{Requeued: []int64{}, Failed: []int64{}}
+	letters, err := c.DeadLetters(ctx, filter)
+	if err != nil {
+		return result, err
+	}
+	store := c.config.DeadLetters
+	for _, d := range letters {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		log := &deadLetterLog{attempt: d.Attempts + 1}
+		if err := c.processIn(withDeadLetterLog(context.Background(), log), d.notification()); err != nil {
+			if err := store.Fail(ctx, d.ID, log.snapshot()); err != nil {
+				return result, err
+			}
+			result.Failed = append(result.Failed, d.ID)
+			continue
+		}
+		if _, err := store.Delete(ctx, d.ID); err != nil {
+			return result, err
+		}
+		result.Requeued = append(result.Requeued, d.ID)
+	}
+	return result, nil
+}
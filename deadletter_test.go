@@ -0,0 +1,145 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeadLetters(t *testing.T) {
+	store := &pqstream.MemoryDeadLetters{}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			if strings.Contains(notification.Extra, "bad") {
+				return errors.New("malformed payload")
+			}
+			return nil
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{DeadLetters: store}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+	client.Process(&pq.Notification{Channel: "users", BePid: 7, Extra: `{"bad": true}`})
+	client.Process(&pq.Notification{Channel: "users", Extra: `{}`})
+
+	letters, err := client.DeadLetters(ctx, pqstream.DeadLetterFilter{Handler: "main[0](pqstream.HandlerFunc)"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 1 || letters[0].PID != 7 || letters[0].Attempts != 1 || len(letters[0].Failures) != 1 || letters[0].Failures[0].Error != "malformed payload" {
+		t.Fatalf("expected the failed notification to be dead lettered, got: %+v", letters)
+	}
+	if got := client.Stats().Channels["users"].DeadLettered; got != 1 {
+		t.Fatalf("expected 1 dead letter, got: %d", got)
+	}
+	id := letters[0].ID
+
+	result, err := client.Requeue(ctx, pqstream.DeadLetterFilter{Channel: "users"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Failed) != 1 || len(result.Requeued) != 0 {
+		t.Fatalf("expected the requeued dead letter to fail again, got: %+v", result)
+	}
+	letters, _ = client.DeadLetters(ctx, pqstream.DeadLetterFilter{IDs: []int64{id}})
+	if len(letters) != 1 || letters[0].Attempts != 2 || len(letters[0].Failures) != 2 || letters[0].Failures[1].Attempt != 2 {
+		t.Fatalf("expected the failure history to grow, got: %+v", letters)
+	}
+
+	if err := client.EditDeadLetter(ctx, id+1, "{}"); !errors.Is(err, pqstream.ErrDeadLetterNotFound) {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if err := client.EditDeadLetter(ctx, id, `{"fixed": true}`); err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"bad": 1}`})
+	//the fixed dead letter is requeued by id, leaving the other one
+	if result, err = client.Requeue(ctx, pqstream.DeadLetterFilter{IDs: []int64{id}}); err != nil || len(result.Requeued) != 1 {
+		t.Fatalf("expected the edited dead letter to be requeued, got: %+v %v", result, err)
+	}
+	if letters, _ = client.DeadLetters(ctx, pqstream.DeadLetterFilter{}); len(letters) != 1 || letters[0].ID == id {
+		t.Fatalf("expected the requeued dead letter to be removed, got: %+v", letters)
+	}
+
+	other, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := other.Requeue(ctx, pqstream.DeadLetterFilter{}); err != pqstream.ErrNoDeadLetters {
+		t.Fatalf("expected ErrNoDeadLetters, got: %v", err)
+	}
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	store := &pqstream.MemoryDeadLetters{}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			if strings.Contains(notification.Extra, "bad") {
+				return errors.New("malformed payload")
+			}
+			return nil
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users", "orders"}, &pqstream.Config{DeadLetters: store}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer srv.Close()
+	admin := pqstream.NewAdminClient(srv.URL)
+	ctx := context.Background()
+	for _, channel := range []string{"users", "users", "orders"} {
+		client.Process(&pq.Notification{Channel: channel, Extra: "bad"})
+	}
+
+	letters, err := admin.DeadLetters(ctx, pqstream.DeadLetterFilter{Channel: "users"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 dead letters on users, got: %+v", letters)
+	}
+	edited, err := admin.EditDeadLetter(ctx, letters[0].ID, "good")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if edited.Payload != "good" {
+		t.Fatalf("expected the payload to be edited, got: %+v", edited)
+	}
+	if _, err := admin.EditDeadLetter(ctx, 100, "good"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	result, err := admin.Requeue(ctx, pqstream.DeadLetterFilter{Channel: "users"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(result.Requeued) != 1 || len(result.Failed) != 1 {
+		t.Fatalf("expected one dead letter to be requeued and one to fail, got: %+v", result)
+	}
+	deleted, err := admin.DeleteDeadLetters(ctx, pqstream.DeadLetterFilter{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if deleted != 2 {
+		t.Fatalf("expected every remaining dead letter to be deleted, got: %d", deleted)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/deadletters/requeue", nil)
+	req.Header.Set(pqstream.AdminHeader, "1")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected bulk operations without a filter to require all=true, got: %d", resp.StatusCode)
+	}
+}
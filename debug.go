@@ -0,0 +1,121 @@
+package pqstream
+
+import (
+	"sync"
+	"time"
+)
+
+//defaultDebugRate is the number of debug lines logged per second per channel when Config.DebugRate is unset
+const defaultDebugRate = 5
+
+//debugPayloadLimit is the number of payload bytes included in debug lines
+const debugPayloadLimit = 256
+
+//EnableDebug turns on debug logging for a single channel for a duration, so one noisy channel can be inspected in production. Each channel's debug lines
+//are rate limited to Config.DebugRate per second; lines over the limit are counted and the count reported in the next line logged
+func (c *Client) EnableDebug(channel string, d time.Duration) {
+	c.debug.enable(channel, c.config.Clock.Now().Add(d), c.debugRate(), c.config.Clock)
+}
+
+//DisableDebug turns off debug logging for a channel
+func (c *Client) DisableDebug(channel string) {
+	c.debug.disable(channel)
+}
+
+//DebugChannels returns the channels with debug logging enabled and when it expires
+func (c *Client) DebugChannels() map[string]time.Time {
+	return c.debug.snapshot(c.config.Clock.Now())
+}
+
+func (c *Client) debugRate() float64 {
+	if c.config.DebugRate <= 0 {
+		return defaultDebugRate
+	}
+	return c.config.DebugRate
+}
+
+//debugf logs a line for a channel if debugging is enabled on it and its rate limit allows
+func (c *Client) debugf(channel, format string, args ...interface{}) {
+	suppressed, ok := c.debug.allow(channel, c.config.Clock.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		format += " (%d lines suppressed)"
+		args = append(args, suppressed)
+	}
+	if c.config.Logger != nil {
+		c.logAt(LevelDebug, map[string]any{"channel": channel}, format, args...)
+		return
+	}
+	c.logf("debug channel: %s "+format, append([]interface{}{channel}, args...)...)
+}
+
+//debugLog holds the channels with debug logging enabled. The zero value has none
+type debugLog struct {
+	mu       sync.Mutex
+	channels map[string]*debugChannel
+}
+
+type debugChannel struct {
+	until      time.Time
+	bucket     *tokenBucket
+	suppressed int
+}
+
+func (d *debugLog) enable(channel string, until time.Time, rate float64, clock Clock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.channels == nil {
+		d.channels = map[string]*debugChannel{}
+	}
+	burst := int(rate)
+	d.channels[channel] = &debugChannel{until: until, bucket: newTokenBucket(rate, burst, clock)}
+}
+
+func (d *debugLog) disable(channel string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.channels, channel)
+}
+
+//allow reports whether a debug line may be logged for a channel, and how many were suppressed since the last one
+func (d *debugLog) allow(channel string, now time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch, ok := d.channels[channel]
+	if !ok {
+		return 0, false
+	}
+	if !now.Before(ch.until) {
+		delete(d.channels, channel)
+		return 0, false
+	}
+	if !ch.bucket.take() {
+		ch.suppressed++
+		return 0, false
+	}
+	suppressed := ch.suppressed
+	ch.suppressed = 0
+	return suppressed, true
+}
+
+func (d *debugLog) snapshot(now time.Time) map[string]time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := map[string]time.Time{}
+	for channel, ch := range d.channels {
+		if now.Before(ch.until) {
+			out[channel] = ch.until
+		}
+	}
+	return out
+}
+
+//truncate shortens a payload for logging
+func truncate(payload string, limit int) string {
+	if len(payload) <= limit {
+		return payload
+	}
+	return payload[:limit] + "..."
+}
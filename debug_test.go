@@ -0,0 +1,70 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugChannel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	client, err := pqstream.NewClient([]string{"users", "accounts"}, &pqstream.Config{Clock: clock, DebugRate: 2}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.EnableDebug("users", time.Minute)
+	for i := 0; i < 3; i++ {
+		client.Process(&pq.Notification{Channel: "users", Extra: "u"})
+		client.Process(&pq.Notification{Channel: "accounts", Extra: "a"})
+	}
+	if strings.Contains(buf.String(), "accounts") {
+		t.Fatalf("expected only the enabled channel to be debugged:\n%s", buf.String())
+	}
+	if n := strings.Count(buf.String(), "debug channel: users"); n != 2 {
+		t.Fatalf("expected the rate limit to allow 2 lines, got %d:\n%s", n, buf.String())
+	}
+	clock.Advance(time.Second)
+	client.Process(&pq.Notification{Channel: "users", Extra: "u"})
+	if !strings.Contains(buf.String(), "(4 lines suppressed)") {
+		t.Fatalf("expected suppressed lines to be reported:\n%s", buf.String())
+	}
+
+	server := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/debug?channel=users", nil)
+	req.Header.Set(pqstream.AdminHeader, "1")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if len(client.DebugChannels()) != 0 {
+		t.Fatalf("expected debugging to be disabled, got %v", client.DebugChannels())
+	}
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/debug?channel=accounts&for=30s", nil)
+	req.Header.Set(pqstream.AdminHeader, "1")
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if until, ok := client.DebugChannels()["accounts"]; !ok || !until.Equal(clock.Now().Add(30*time.Second)) {
+		t.Fatalf("expected accounts to be debugged for 30s, got %v", client.DebugChannels())
+	}
+	clock.Advance(time.Minute)
+	if len(client.DebugChannels()) != 0 {
+		t.Fatal("expected debugging to expire")
+	}
+}
@@ -0,0 +1,69 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"reflect"
+	"sync"
+)
+
+//Decoded returns a notification's JSON payload decoded as a T. Within a ContextHandler the payload is decoded at most once per type and notification, and every handler asking for the same T shares the result,
+//so decoded values must be treated as read-only. Outside of a client's handler context it simply decodes the payload with the DefaultCodec
+func Decoded[T any](ctx context.Context, notification *pq.Notification) (T, error) {
+	cache := decodeCacheFrom(ctx)
+	if cache == nil || cache.notification != notification {
+		var v T
+		err := DecodeJSON(notification, &v)
+		return v, err
+	}
+	entry := cache.entry(reflect.TypeOf((*T)(nil)).Elem())
+	entry.once.Do(func() {
+		var v T
+		entry.err = DecodeJSON(notification, &v)
+		entry.value = v
+	})
+	v, _ := entry.value.(T)
+	return v, entry.err
+}
+
+//decodeCache holds the payload of a single notification decoded into each type handlers have asked for
+type decodeCache struct {
+	notification *pq.Notification
+	mu           sync.Mutex
+	values       map[reflect.Type]*decodedValue
+}
+
+type decodedValue struct {
+	once  sync.Once
+	value any
+	err   error
+}
+
+func newDecodeCache(notification *pq.Notification) *decodeCache {
+	return &decodeCache{
+		notification: notification,
+		values:       map[reflect.Type]*decodedValue{},
+	}
+}
+
+func (c *decodeCache) entry(t reflect.Type) *decodedValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.values[t]
+	if !ok {
+		entry = &decodedValue{}
+		c.values[t] = entry
+	}
+	return entry
+}
+
+type decodeCacheKey struct{}
+
+func withDecodeCache(ctx context.Context, cache *decodeCache) context.Context {
+	return context.WithValue(ctx, decodeCacheKey{}, cache)
+}
+
+func decodeCacheFrom(ctx context.Context) *decodeCache {
+	cache, _ := ctx.Value(decodeCacheKey{}).(*decodeCache)
+	return cache
+}
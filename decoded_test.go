@@ -0,0 +1,82 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sync"
+	"testing"
+)
+
+type decodingHandler struct {
+	mu   sync.Mutex
+	seen []*user
+}
+
+func (h *decodingHandler) Process(notification *pq.Notification) error {
+	return h.ProcessContext(context.Background(), notification)
+}
+
+func (h *decodingHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	u, err := pqstream.Decoded[*user](ctx, notification)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.seen = append(h.seen, u)
+	h.mu.Unlock()
+	return nil
+}
+
+func TestDecodedSharedAcrossHandlers(t *testing.T) {
+	handler := &decodingHandler{}
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{handler, handler, handler},
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"id": 1, "name": "bob"}`})
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"id": 2, "name": "alice"}`})
+	if len(errs) != 0 || len(handler.seen) != 6 {
+		t.Fatalf("unexpected decodes: %v %d", errs, len(handler.seen))
+	}
+	first, second := map[*user]bool{}, map[*user]bool{}
+	for _, u := range handler.seen {
+		if u.ID == 1 {
+			first[u] = true
+		} else {
+			second[u] = true
+		}
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("expected one shared decode per notification, got %d and %d", len(first), len(second))
+	}
+
+	client.Process(&pq.Notification{Channel: "users", Extra: "{"})
+	if len(errs) != 3 {
+		t.Fatalf("expected every handler to see the decode error, got %d", len(errs))
+	}
+}
+
+func TestDecodedWithoutCache(t *testing.T) {
+	n := &pq.Notification{Extra: `{"id": 1}`}
+	first, err := pqstream.Decoded[*user](context.Background(), n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second, _ := pqstream.Decoded[*user](context.Background(), n)
+	if first.ID != 1 || first == second {
+		t.Fatal("expected an independent decode outside a handler context")
+	}
+}
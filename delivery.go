@@ -0,0 +1,58 @@
+package pqstream
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Delivery is the guarantee a client makes about each notification it receives
+type Delivery string
+
+const (
+	//DeliveryAtLeastOnce processes every notification the client receives at least once, as far as its Outbox, Handover, Drain spool, DeadLetters,
+	//Quarantine and Escalation retries reach. It's the default
+	DeliveryAtLeastOnce Delivery = "at_least_once"
+	//DeliveryAtMostOnce processes each notification the client receives once or not at all, for latency sensitive consumers that tolerate loss, ie: live UI updates.
+	//Nothing is spooled, checkpointed, dead lettered or retried: a notification a handler fails on is reported and dropped, one whose channel's queue is full
+	//is dropped, as Overflow defaults to OverflowDrop, and those sent while the listener is disconnected are lost. NewClient rejects an Outbox, Handover,
+	//Drain spool, DeadLetters or Quarantine, and NewPipelineClient a pipeline Checkpoint, which contradict it
+	DeliveryAtMostOnce Delivery = "at_most_once"
+)
+
+//validateDelivery checks the config doesn't ask for more than its delivery guarantees, and defaults the overflow policy of at most once delivery
+func (c *Config) validateDelivery() error {
+	switch c.Delivery {
+	case "", DeliveryAtLeastOnce:
+		return nil
+	case DeliveryAtMostOnce:
+	default:
+		return fmt.Errorf("unknown delivery: %s", c.Delivery)
+	}
+	var conflicts []string
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"Outbox", c.Outbox != nil},
+		{"Handover", c.Handover != nil},
+		{"Drain spool", c.Drain != nil && c.Drain.Spool != nil},
+		{"DeadLetters", c.DeadLetters != nil},
+		{"Quarantine", c.Quarantine != nil},
+	} {
+		if option.set {
+			conflicts = append(conflicts, option.name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("at most once delivery can't be combined with: %s", strings.Join(conflicts, ", "))
+	}
+	if c.Overflow == "" {
+		c.Overflow = OverflowDrop
+	}
+	return nil
+}
+
+//atMostOnce reports whether the client drops notifications rather than retrying them
+func (c *Client) atMostOnce() bool {
+	return c.config.Delivery == DeliveryAtMostOnce
+}
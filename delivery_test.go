@@ -0,0 +1,53 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtMostOnceDelivery(t *testing.T) {
+	attempts, reported := 0, 0
+	handlers := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			attempts++
+			return &pq.Error{Code: "40P01"}
+		})},
+		ErrorHandler: func(err error) { reported++ },
+	}
+	config := &pqstream.Config{
+		Delivery:   pqstream.DeliveryAtMostOnce,
+		Clock:      pqstream.NewFakeClock(time.Unix(0, 0)),
+		Escalation: &pqstream.EscalationPolicy{Actions: map[pqstream.ErrorClass][]pqstream.EscalationAction{pqstream.ErrorTransient: {pqstream.ActionRetry, pqstream.ActionReport}}},
+	}
+	client, err := pqstream.NewClient([]string{"ui"}, config, handlers)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "ui", Extra: "{}"})
+	if attempts != 1 || reported == 0 {
+		t.Fatalf("expected a failed notification to be reported and dropped without a retry, got %d attempts", attempts)
+	}
+	if e := client.EffectiveConfig(); e.Delivery != pqstream.DeliveryAtMostOnce || e.Overflow != pqstream.OverflowDrop {
+		t.Fatalf("expected at most once delivery to drop on overflow, got %s %s", e.Delivery, e.Overflow)
+	}
+
+	_, err = pqstream.NewClient([]string{"ui"}, &pqstream.Config{
+		Delivery:    pqstream.DeliveryAtMostOnce,
+		Outbox:      &pqstream.Outbox{},
+		DeadLetters: &pqstream.MemoryDeadLetters{},
+	}, handlers)
+	if err == nil || !strings.Contains(err.Error(), "Outbox, DeadLetters") {
+		t.Fatalf("expected the durable options to be rejected, got %v", err)
+	}
+	pipeline := pqstream.NewPipeline().Source("ui").FanOut(pqstream.NewSink("ui", func(ctx context.Context, notification *pq.Notification) error { return nil })).Checkpoint(nil)
+	if _, err := pqstream.NewPipelineClient(&pqstream.Config{Delivery: pqstream.DeliveryAtMostOnce}, pipeline); err == nil {
+		t.Fatal("expected a pipeline checkpoint to be rejected")
+	}
+	if _, err := pqstream.NewClient([]string{"ui"}, &pqstream.Config{Delivery: "exactly_once"}, handlers); err == nil {
+		t.Fatal("expected an unknown delivery to be rejected")
+	}
+}
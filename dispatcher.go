@@ -0,0 +1,284 @@
+package pqstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//laneSize is the number of notifications buffered per channel when Config.QueueSize is unset
+const laneSize = 64
+
+//defaultSpillLimit is the number of notifications an OverflowSpill channel holds in memory when Config.SpillLimit is unset
+const defaultSpillLimit = 1024
+
+//pingInterval is how long the dispatcher waits without notifications before checking the connection
+const pingInterval = 90 * time.Second
+
+func (c *Client) start() error {
+	host, err := c.initialHost()
+	if err != nil {
+		return err
+	}
+	for !c.isStopping() {
+		failover, err := c.serve(host)
+		if err != nil || failover == nil {
+			return err
+		}
+		host = failover.To
+	}
+	return nil
+}
+
+//serve listens on every channel through a single host until the listener closes, returning the failover that closed it if the primary moved
+func (c *Client) serve(host string) (*Failover, error) {
+	config := c.config.forHost(host)
+	c.setHost(host)
+	startup := c.startup(host)
+	db, err := config.openDB("client", config.ConnInfo())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open with connection info! %s", err.Error())
+	}
+	defer db.Close()
+	if c.config.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(c.config.MaxOpenConns)
+	}
+	if c.config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(c.config.MaxIdleConns)
+	}
+	writeDB := db
+	if config.separateWriter() {
+		if writeDB, err = config.openDB("writer", config.WriteConnInfo()); err != nil {
+			return nil, fmt.Errorf("failed to open with write connection info! %s", err.Error())
+		}
+		defer writeDB.Close()
+	}
+	caps, err := DetectCapabilities(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+	c.setCapabilities(caps)
+	startup.report.Connect = startup.since(startup.report.StartedAt)
+	if !caps.Has(FeatureNotify) {
+		return nil, fmt.Errorf("failed to listen! postgres %s is in recovery, connect to the primary", caps.Version)
+	}
+	if c.config.Verbose {
+		c.logf("connected to postgres %s with extensions %v", caps.Version, caps.Extensions)
+	}
+	if c.config.ReadOnly {
+		if err := verifyReadOnly(context.Background(), db); err != nil {
+			return nil, err
+		}
+	}
+	if c.config.Preflight {
+		began := c.config.Clock.Now()
+		if err := c.preflight(context.Background(), db, writeDB); err != nil {
+			return nil, err
+		}
+		startup.report.Preflight = startup.since(began)
+	}
+	listener := config.newListener(config.ConnInfo(), 10*time.Second, 3*time.Minute, func(event pq.ListenerEventType, err error) {
+		states := c.onListenerEvent(c.aliases.names(c.Channels()), event, err)
+		c.reportListenerEvent(states, err)
+		c.checkListenerFatal(states, err)
+	})
+	c.setListener(listener)
+	defer func() {
+		for _, ch := range c.aliases.names(c.Channels()) {
+			c.setState(ch, ConnClosed, nil)
+		}
+		if err := listener.Close(); err != nil && c.config.Verbose && !c.isStopping() {
+			c.handlers.ErrorHandler(fmt.Errorf("failed to close listener! %s", err.Error()))
+		}
+	}()
+	if c.isStopping() {
+		return nil, nil
+	}
+	//channels added with Listen from here on are listened on by Listen itself
+	channels := c.aliases.names(c.Channels())
+	listening := 0
+	for _, ch := range channels {
+		began := c.config.Clock.Now()
+		err := listener.Listen(ch)
+		if err == pq.ErrChannelAlreadyOpen {
+			err = nil
+		}
+		startup.listened(ch, began, err)
+		if err != nil {
+			c.setState(ch, ConnFailed, err)
+			if c.config.FailFastOnFatal {
+				return nil, &FatalError{Reason: fmt.Sprintf("failed to listen on channel: %s", ch), Err: err}
+			}
+			c.handleErr(ch, fmt.Errorf("failed to listen on channel : %s!", ch))
+			continue
+		}
+		c.setState(ch, ConnListening, nil)
+		listening++
+	}
+	if listening == 0 && len(channels) > 0 {
+		return nil, nil
+	}
+	if listening == len(channels) {
+		c.markReady()
+	}
+	c.resumeHandover(context.Background())
+	startup.report.Spooled = c.resumeSpool(context.Background())
+	if c.durable != nil {
+		c.durable.connect(db, writeDB)
+		defer c.durable.catchups.Wait()
+		began := c.config.Clock.Now()
+		c.catchupAll(func(replayed map[string]int) {
+			startup.caughtUp(began, replayed)
+			startup.done()
+		})
+	} else {
+		startup.done()
+	}
+	if c.config.StandbyLockKey != 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.campaign(db, done)
+	}
+	failovers := make(chan *Failover, 1)
+	if c.watchesFailover() {
+		done := make(chan struct{})
+		defer close(done)
+		go c.watchFailover(db, host, listener, done, failovers)
+	}
+	c.dispatch(listener.Notify, listener.Ping)
+	select {
+	case failover := <-failovers:
+		return failover, nil
+	default:
+		return nil, nil
+	}
+}
+
+//dispatch is the client's single notification loop, handing notifications from the shared listener connection and Config.Sources to per-channel lanes
+//after resolving aliases, standby, handoff and drain state
+func (c *Client) dispatch(notify <-chan *pq.Notification, ping func() error) {
+	lanes := map[string]*lane{}
+	wg := sync.WaitGroup{}
+	defer func() {
+		for _, lane := range lanes {
+			lane.close()
+		}
+		wg.Wait()
+	}()
+	//idle fires once no notification has arrived for pingInterval, and is reset rather than recreated after each one
+	idle := newTimer(c.config.Clock, pingInterval)
+	defer idle.Stop()
+	deliver := func(n *pq.Notification) {
+		l, exists := lanes[n.Channel]
+		if !exists {
+			l = newLane(c.queueSize(), c.spillLimit())
+			lanes[n.Channel] = l
+			for i := c.laneWorkers(n.Channel); i > 0; i-- {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := range l.queue {
+						c.dequeued(n.Channel)
+						c.waitPaused(n.Channel)
+						if offset := offsetOf(n); c.durable != nil && offset > 0 {
+							c.deliverDurable(n, offset)
+						} else {
+							c.process(n)
+						}
+						c.pending.Done()
+					}
+				}()
+			}
+		}
+		for _, missed := range append(c.sequenced(n), n) {
+			c.pending.Add(1)
+			if !c.enqueue(l, missed) {
+				c.pending.Done()
+			}
+		}
+	}
+	//route hands a notification to its lane unless it is cut over, fenced, drained or held while the client is a standby
+	route := func(n *pq.Notification) {
+		if c.handoff.cut(n.Channel) || c.isFenced() || !c.drain(n) {
+			return
+		}
+		held, dropped := c.standby.hold(n)
+		if dropped != nil {
+			c.handleErr(dropped.Channel, fmt.Errorf("standby buffer full, dropped notification pid: %d, channel: %s", dropped.BePid, dropped.Channel))
+		}
+		if !held {
+			deliver(n)
+		}
+	}
+	promoted := c.standby.signal()
+	for {
+		select {
+		case n, ok := <-notify:
+			idle.Reset(pingInterval)
+			if !ok {
+				if c.standby.isActive() {
+					for _, n := range c.standby.drain() {
+						deliver(n)
+					}
+				}
+				return
+			}
+			if n == nil {
+				//the listener reconnected, so a durable client catches up on what it may have missed
+				if c.durable != nil {
+					c.durable.resync()
+					c.catchupAll(nil)
+				}
+				continue
+			}
+			if isHandoffMarker(n) {
+				if c.handoff.mark(n) && !c.standby.isActive() {
+					c.standby.discard(n.Channel)
+				}
+				continue
+			}
+			if isChunk(n) {
+				assembled, done, err := c.chunks.assemble(n)
+				if err != nil {
+					c.handleErr(n.Channel, err)
+				}
+				if !done {
+					continue
+				}
+				n = assembled
+			}
+			if n, ok = c.aliases.resolve(n); !ok {
+				continue
+			}
+			route(n)
+		case n := <-c.sourced:
+			idle.Reset(pingInterval)
+			route(n)
+		case <-promoted:
+			promoted = nil
+			buffered := c.standby.drain()
+			if c.config.Verbose {
+				c.logf("promoted to active, processing %d buffered notifications", len(buffered))
+			}
+			for _, n := range buffered {
+				deliver(n)
+			}
+		case <-idle.C():
+			idle.Reset(pingInterval)
+			if c.config.Verbose {
+				c.logf("Received no events for 90 seconds, checking connection!")
+			}
+			err := ping()
+			c.collector().ObservePing(err)
+			if err != nil {
+				for _, ch := range c.Channels() {
+					c.handleErr(ch, fmt.Errorf("failed to ping database for channel: %s error: %s", ch, err.Error()))
+				}
+			} else if c.config.Verbose {
+				c.logf("Successful database ping!")
+			}
+		}
+	}
+}
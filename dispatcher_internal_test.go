@@ -0,0 +1,238 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchLanes(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	release := make(chan struct{})
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		if n.Channel == "slow" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen[n.Channel] = append(seen[n.Channel], n.Extra)
+		return nil
+	})
+	clock := NewFakeClock(time.Now())
+	c, err := NewClient([]string{"slow", "fast"}, &Config{Clock: clock, Workers: 2}, &HandlerSet{Handlers: []Handler{handler}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	pinged := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error {
+			pinged <- struct{}{}
+			return nil
+		})
+	}()
+	notify <- &pq.Notification{Channel: "slow", Extra: "1"}
+	for _, payload := range []string{"1", "2", "3"} {
+		notify <- &pq.Notification{Channel: "fast", Extra: payload}
+	}
+	notify <- nil
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		fast := strings.Join(seen["fast"], ",")
+		mu.Unlock()
+		if fast == "1,2,3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a slow channel blocked a fast one, fast processed: %q", fast)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(pingInterval)
+	<-pinged
+	close(release)
+	close(notify)
+	<-done
+	if got := strings.Join(seen["slow"], ","); got != "1" {
+		t.Fatalf("expected the slow lane to drain on shutdown, got: %q", got)
+	}
+}
+
+func TestDispatchStandby(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, n.Extra)
+		return nil
+	})
+	var dropped []error
+	c, err := NewClient([]string{"users"}, &Config{Standby: true, StandbyBuffer: 2}, &HandlerSet{
+		Handlers: []Handler{handler},
+		ErrorHandler: func(err error) {
+			dropped = append(dropped, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c.Role() != RoleStandby {
+		t.Fatalf("expected a standby, got %s", c.Role())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	for _, payload := range []string{"1", "2", "3"} {
+		notify <- &pq.Notification{Channel: "users", Extra: payload}
+	}
+	mu.Lock()
+	processed := len(seen)
+	mu.Unlock()
+	if processed != 0 {
+		t.Fatal("a standby processed notifications before promotion")
+	}
+	c.Promote()
+	if c.Role() != RoleActive {
+		t.Fatalf("expected an active client after promotion, got %s", c.Role())
+	}
+	notify <- &pq.Notification{Channel: "users", Extra: "4"}
+	close(notify)
+	<-done
+	if got := strings.Join(seen, ","); got != "2,3,4" {
+		t.Fatalf("expected buffered notifications to be processed in order before new ones, got: %q", got)
+	}
+	if len(dropped) != 1 || !strings.Contains(dropped[0].Error(), "standby buffer full") {
+		t.Fatalf("expected the oldest notification to be dropped, got: %v", dropped)
+	}
+}
+
+func TestDispatchStandbyPromotedOnClose(t *testing.T) {
+	//the listener closing and the promotion are both ready when the dispatcher starts, so either may be picked first and neither can lose the buffer
+	for i := 0; i < 20; i++ {
+		var mu sync.Mutex
+		var seen []string
+		handler := HandlerFunc(func(n *pq.Notification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, n.Extra)
+			return nil
+		})
+		c, err := NewClient([]string{"users"}, &Config{Standby: true}, &HandlerSet{Handlers: []Handler{handler}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, payload := range []string{"1", "2"} {
+			c.standby.hold(&pq.Notification{Channel: "users", Extra: payload})
+		}
+		c.Promote()
+		notify := make(chan *pq.Notification)
+		close(notify)
+		c.dispatch(notify, func() error { return nil })
+		if got := strings.Join(seen, ","); got != "1,2" {
+			t.Fatalf("expected the promoted standby's buffer to be processed when the listener closes, got: %q", got)
+		}
+	}
+}
+
+func TestDispatchHandoff(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	newClient := func(name string, standby bool) *Client {
+		handler := HandlerFunc(func(n *pq.Notification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[name] = append(seen[name], n.Extra)
+			return nil
+		})
+		c, err := NewClient([]string{"users"}, &Config{InstanceID: name, Standby: standby}, &HandlerSet{Handlers: []Handler{handler}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return c
+	}
+	blue, green := newClient("blue", false), newClient("green", true)
+	released := blue.handoff.begin("token", true, blue.channels)
+	taken := green.handoff.begin("token", false, green.channels)
+	stream := []*pq.Notification{
+		{Channel: "users", Extra: "1"},
+		{Channel: "users", Extra: handoffPrefix + "stale"},
+		{Channel: "users", Extra: "2"},
+		{Channel: "users", Extra: handoffPrefix + "token"},
+		{Channel: "users", Extra: "3"},
+		{Channel: "users", Extra: "4"},
+	}
+	for _, c := range []*Client{blue, green} {
+		notify := make(chan *pq.Notification)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.dispatch(notify, func() error { return nil })
+		}()
+		for _, n := range stream {
+			notify <- n
+		}
+		if c == green {
+			<-taken
+			c.Promote()
+		} else {
+			<-released
+			c.pending.Wait()
+		}
+		close(notify)
+		<-done
+	}
+	if got := strings.Join(seen["blue"], ","); got != "1,2" {
+		t.Fatalf("expected the old instance to process up to the marker, got: %q", got)
+	}
+	if got := strings.Join(seen["green"], ","); got != "3,4" {
+		t.Fatalf("expected the new instance to process after the marker, got: %q", got)
+	}
+}
+
+func TestDispatchFenced(t *testing.T) {
+	var processed []string
+	var alerts []error
+	c, err := NewClient([]string{"users"}, &Config{InstanceID: "worker-1"}, &HandlerSet{
+		Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error {
+			processed = append(processed, n.Extra)
+			return nil
+		})},
+		ErrorHandler: func(err error) {
+			alerts = append(alerts, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	notify <- &pq.Notification{Channel: "users", Extra: "1"}
+	c.fence()
+	c.fence()
+	notify <- &pq.Notification{Channel: "users", Extra: "2"}
+	close(notify)
+	<-done
+	if got := strings.Join(processed, ","); got != "1" {
+		t.Fatalf("expected a fenced client to stop processing, got: %q", got)
+	}
+	if c.Role() != RoleFenced || len(alerts) != 1 || !strings.Contains(alerts[0].Error(), "worker-1") {
+		t.Fatalf("expected a single fencing alert, got role %s and %v", c.Role(), alerts)
+	}
+}
@@ -0,0 +1,287 @@
+package pqstream
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+//A DrainAction is what a client does with a notification it receives after it starts shutting down
+type DrainAction string
+
+const (
+	//DrainProcess processes the notification, delaying the shutdown until its handlers return
+	DrainProcess DrainAction = "process"
+	//DrainSpool stores the notification in the DrainPolicy's Spool for the next instance to process
+	DrainSpool DrainAction = "spool"
+	//DrainDrop discards the notification, counting it in ChannelStats.ShutdownDropped
+	DrainDrop DrainAction = "drop"
+)
+
+//A DrainPolicy decides, per channel, what happens to notifications that arrive once a client starts shutting down, ie: spool orders for the next instance
+//and drop cache invalidations that are moot after a restart. Notifications received before the shutdown began are always processed.
+//A durable client's outbox rows that are spooled or dropped aren't checkpointed, so they're redelivered by the next instance's catch-up either way
+type DrainPolicy struct {
+	//Default is the action for channels without their own. Defaults to DrainProcess
+	Default DrainAction
+	//Channels maps channels to their action
+	Channels map[string]DrainAction
+	//Spool stores the notifications spooled by DrainSpool. The next instance takes them when it connects and processes those on its channels
+	//before live notifications
+	Spool Spool
+}
+
+func (p *DrainPolicy) action(channel string) DrainAction {
+	if action, ok := p.Channels[channel]; ok {
+		return action
+	}
+	if p.Default == "" {
+		return DrainProcess
+	}
+	return p.Default
+}
+
+func (p *DrainPolicy) validate() error {
+	actions := []DrainAction{p.Default}
+	for _, action := range p.Channels {
+		actions = append(actions, action)
+	}
+	for _, action := range actions {
+		switch action {
+		case "", DrainProcess, DrainDrop:
+		case DrainSpool:
+			if p.Spool == nil {
+				return errors.New("drain policy spools notifications without a spool")
+			}
+		default:
+			return fmt.Errorf("unknown drain action: %s", action)
+		}
+	}
+	return nil
+}
+
+//A Spool stores notifications a client received as it shut down, for the next instance
+type Spool interface {
+	//Push stores a notification
+	Push(ctx context.Context, notification *pq.Notification) error
+	//Take removes and returns every stored notification, in the order they were pushed
+	Take(ctx context.Context) ([]*pq.Notification, error)
+}
+
+//drain applies the client's DrainPolicy to a notification received while stopping, reporting whether it should still be processed.
+//A notification the spool fails to store is processed rather than lost
+func (c *Client) drain(n *pq.Notification) bool {
+	p := c.config.Drain
+	if p == nil || !c.isStopping() {
+		return true
+	}
+	switch p.action(n.Channel) {
+	case DrainDrop:
+		atomic.AddUint64(&c.stats.channel(n.Channel).shutdownDropped, 1)
+		return false
+	case DrainSpool:
+		if err := p.Spool.Push(context.Background(), n); err != nil {
+			c.handleErr(n.Channel, fmt.Errorf("failed to spool notification pid: %d, channel: %s, processing it! %s", n.BePid, n.Channel, err.Error()))
+			return true
+		}
+		atomic.AddUint64(&c.stats.channel(n.Channel).spooled, 1)
+		return false
+	}
+	return true
+}
+
+//resumeSpool takes the notifications the previous instance spooled and processes those on the client's channels, once per client, returning how many it processed.
+//Notifications on other channels are spooled again for an instance that listens on them
+func (c *Client) resumeSpool(ctx context.Context) int {
+	p := c.config.Drain
+	if p == nil || p.Spool == nil || c.spoolTaken {
+		return 0
+	}
+	c.spoolTaken = true
+	spooled, err := p.Spool.Take(ctx)
+	if err != nil {
+		c.handlers.ErrorHandler(fmt.Errorf("failed to take spooled notifications! %s", err.Error()))
+		return 0
+	}
+	processed := 0
+	if c.config.Verbose && len(spooled) > 0 {
+		c.logf("processing %d notifications spooled by the previous instance", len(spooled))
+	}
+	channels := map[string]bool{}
+	for _, ch := range c.Channels() {
+		channels[ch] = true
+	}
+	for _, n := range spooled {
+		if channels[n.Channel] {
+			for _, missed := range c.sequenced(n) {
+				c.process(missed)
+			}
+			c.process(n)
+			processed++
+			continue
+		}
+		if err := p.Spool.Push(ctx, n); err != nil {
+			c.handleErr(n.Channel, fmt.Errorf("failed to respool notification pid: %d, channel: %s! %s", n.BePid, n.Channel, err.Error()))
+		}
+	}
+	return processed
+}
+
+//spooledNotification is a notification as a Spool stores it
+type spooledNotification struct {
+	Channel string `json:"channel"`
+	PID     int    `json:"pid"`
+	Payload string `json:"payload"`
+}
+
+//FileSpool spools notifications to a file of JSON lines, ie: on a volume kept across restarts
+type FileSpool struct {
+	Path string
+	mu   sync.Mutex
+}
+
+//Push appends a notification to the file
+func (f *FileSpool) Push(ctx context.Context, notification *pq.Notification) error {
+	line, err := json.Marshal(spooledNotification{Channel: notification.Channel, PID: notification.BePid, Payload: notification.Extra})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool! %s", err.Error())
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write spool! %s", err.Error())
+	}
+	return file.Close()
+}
+
+//Take reads the file's notifications and removes it
+func (f *FileSpool) Take(ctx context.Context) ([]*pq.Notification, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to open spool! %s", err.Error())
+	}
+	defer file.Close()
+	var out []*pq.Notification
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var s spooledNotification
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, fmt.Errorf("failed to decode spool! %s", err.Error())
+		}
+		out = append(out, &pq.Notification{Channel: s.Channel, BePid: s.PID, Extra: s.Payload})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spool! %s", err.Error())
+	}
+	if err := os.Remove(f.Path); err != nil {
+		return nil, fmt.Errorf("failed to remove spool! %s", err.Error())
+	}
+	return out, nil
+}
+
+//TableSpool spools notifications to a postgres table, so any instance of a deployment takes them
+type TableSpool struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified spool table. Defaults to pqstream_spool
+	Table string
+	//Key names the deployment the notifications belong to, so several deployments can share the table. Defaults to pqstream
+	Key string
+}
+
+func (t *TableSpool) table() string {
+	if t.Table == "" {
+		return "pqstream_spool"
+	}
+	return t.Table
+}
+
+func (t *TableSpool) key() string {
+	if t.Key == "" {
+		return "pqstream"
+	}
+	return t.Key
+}
+
+//Setup creates the spool table if it doesn't exist
+func (t *TableSpool) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if t.DB == nil {
+		return errors.New("spool table requires a db")
+	}
+	if _, err := t.DB.ExecContext(ctx, t.ddl()); err != nil {
+		return fmt.Errorf("failed to create spool table! %s", err.Error())
+	}
+	return nil
+}
+
+func (t *TableSpool) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	key text NOT NULL,
+	channel text NOT NULL,
+	pid integer NOT NULL,
+	payload text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (key, id)`, quoteQualified(t.table()), pq.QuoteIdentifier(unqualified(t.table())+"_key"))
+}
+
+//Push inserts a notification
+func (t *TableSpool) Push(ctx context.Context, notification *pq.Notification) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	_, err := t.DB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (key, channel, pid, payload) VALUES ($1, $2, $3, $4)", quoteQualified(t.table())),
+		t.key(), notification.Channel, notification.BePid, notification.Extra)
+	if err != nil {
+		return fmt.Errorf("failed to spool notification! %s", err.Error())
+	}
+	return nil
+}
+
+//Take deletes and returns the key's notifications
+func (t *TableSpool) Take(ctx context.Context) ([]*pq.Notification, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return nil, err
+	}
+	rows, err := t.DB.QueryContext(ctx, fmt.Sprintf(`WITH taken AS (DELETE FROM %s WHERE key = $1 RETURNING id, channel, pid, payload)
+SELECT channel, pid, payload FROM taken ORDER BY id`, quoteQualified(t.table())), t.key())
+	if err != nil {
+		return nil, fmt.Errorf("failed to take spooled notifications! %s", err.Error())
+	}
+	defer rows.Close()
+	var out []*pq.Notification
+	for rows.Next() {
+		n := &pq.Notification{}
+		if err := rows.Scan(&n.Channel, &n.BePid, &n.Extra); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+//Requirements returns the privileges the spool needs on its table
+func (t *TableSpool) Requirements() []Requirement {
+	return writes(tableRequirements("spool", t.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeDelete))
+}
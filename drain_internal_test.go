@@ -0,0 +1,76 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainPolicy(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	handlerSet := &HandlerSet{Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, n.Channel+":"+n.Extra)
+		return nil
+	})}}
+	spool := &FileSpool{Path: filepath.Join(t.TempDir(), "spool.jsonl")}
+	policy := &DrainPolicy{Default: DrainDrop, Channels: map[string]DrainAction{"orders": DrainSpool, "audit": DrainProcess}, Spool: spool}
+	c, err := NewClient([]string{"orders", "cache", "audit"}, &Config{Clock: NewFakeClock(time.Now()), Drain: policy}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	notify <- &pq.Notification{Channel: "cache", Extra: "before"}
+	c.stop()
+	for _, ch := range []string{"orders", "cache", "audit"} {
+		notify <- &pq.Notification{Channel: ch, Extra: "after"}
+	}
+	close(notify)
+	<-done
+	sort.Strings(seen)
+	if got := strings.Join(seen, ","); got != "audit:after,cache:before" {
+		t.Fatalf("expected notifications from before the shutdown and on processed channels only, got: %s", got)
+	}
+	stats := c.Stats().Channels
+	if stats["orders"].Spooled != 1 || stats["cache"].ShutdownDropped != 1 || stats["audit"].Spooled+stats["audit"].ShutdownDropped != 0 {
+		t.Fatalf("expected the spooled and dropped notifications to be counted, got: %+v", stats)
+	}
+	if e := c.EffectiveConfig(); e.DrainDefault != DrainDrop || e.DrainSpool != spool.Path {
+		t.Fatalf("expected the drain policy in the effective config, got: %+v", e)
+	}
+
+	//the next instance processes what was spooled on its channels and spools the rest again
+	seen = nil
+	next, err := NewClient([]string{"audit"}, &Config{Drain: policy}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	spool.Push(context.Background(), &pq.Notification{Channel: "audit", Extra: "spooled"})
+	next.resumeSpool(context.Background())
+	next.resumeSpool(context.Background())
+	if got := strings.Join(seen, ","); got != "audit:spooled" {
+		t.Fatalf("expected the spooled notification on the next instance's channel to be processed once, got: %s", got)
+	}
+	left, err := spool.Take(context.Background())
+	if err != nil || len(left) != 1 || left[0].Channel != "orders" || left[0].Extra != "after" {
+		t.Fatalf("expected the notification on another channel to stay spooled, got: %v %v", left, err)
+	}
+
+	if _, err := NewClient([]string{"orders"}, &Config{Drain: &DrainPolicy{Default: DrainSpool}}, handlerSet); err == nil {
+		t.Fatal("expected a policy spooling without a spool to fail")
+	}
+}
@@ -0,0 +1,34 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"log"
+)
+
+type dryRunKey struct{}
+
+//WithDryRun returns a context that tells destructive handlers and sinks to describe what they would do instead of doing it.
+//Clients configured with Config.DryRun pass such a context to every ContextHandler and Pipeline
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+//IsDryRun reports whether a handler's context is in dry-run mode
+func IsDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunKey{}).(bool)
+	return dry
+}
+
+//skipDryRun logs the write a built-in sink would have made and reports whether it should be skipped
+func skipDryRun(ctx context.Context, sink string, notification *pq.Notification) bool {
+	if !IsDryRun(ctx) {
+		return false
+	}
+	prefix := pkg
+	if identity, ok := IdentityFrom(ctx); ok {
+		prefix += " " + identity.String()
+	}
+	log.Printf("%s dry run: sink %s would write notification pid: %d, channel: %s payload: %s", prefix, sink, notification.BePid, notification.Channel, notification.Extra)
+	return true
+}
@@ -0,0 +1,39 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	files, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var dry bool
+	p := pqstream.NewPipeline().Source("users").FanOut(files, pqstream.NewSink("custom", func(ctx context.Context, n *pq.Notification) error {
+		dry = pqstream.IsDryRun(ctx)
+		return nil
+	}))
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{DryRun: true}, p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"id": 1}`})
+	if err := files.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !dry {
+		t.Fatal("expected sinks to receive a dry-run context")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected the file sink not to write in dry-run mode, got %d files", len(entries))
+	}
+	if pqstream.IsDryRun(context.Background()) {
+		t.Fatal("expected a plain context not to be a dry run")
+	}
+}
@@ -0,0 +1,222 @@
+package pqstream
+
+import (
+	"fmt"
+	"sort"
+)
+
+//redacted replaces secrets in an EffectiveConfig
+const redacted = "[redacted]"
+
+//EffectiveConfig is the configuration a client actually runs with: every default resolved and secrets redacted, to answer which settings an instance is using
+type EffectiveConfig struct {
+	Channels              []string               `json:"channels"`
+	Host                  string                 `json:"host"`
+	Port                  string                 `json:"port"`
+	User                  string                 `json:"user"`
+	Password              string                 `json:"password,omitempty"`
+	Database              string                 `json:"database"`
+	SSLMode               string                 `json:"sslmode"`
+	SSLCert               string                 `json:"sslcert,omitempty"`
+	SSLKey                string                 `json:"sslkey,omitempty"`
+	SSLRootCert           string                 `json:"sslrootcert,omitempty"`
+	MaxOpenConns          int                    `json:"max_open_conns"`
+	MaxIdleConns          int                    `json:"max_idle_conns"`
+	ConnectionBudget      int                    `json:"connection_budget,omitempty"`
+	Verbose               bool                   `json:"verbose"`
+	InstanceID            string                 `json:"instance_id"`
+	Labels                map[string]string      `json:"labels,omitempty"`
+	LagThreshold          string                 `json:"lag_threshold"`
+	Tracing               bool                   `json:"tracing"`
+	TraceSampleRate       float64                `json:"trace_sample_rate"`
+	Clock                 string                 `json:"clock"`
+	Workers               int                    `json:"workers"`
+	ChannelWorkers        map[string]int         `json:"channel_workers,omitempty"`
+	QueueSize             int                    `json:"queue_size"`
+	Ordering              Ordering               `json:"ordering"`
+	Overflow              OverflowPolicy         `json:"overflow"`
+	SpillLimit            int                    `json:"spill_limit"`
+	Delivery              Delivery               `json:"delivery"`
+	MaxAge                string                 `json:"max_age"`
+	DryRun                bool                   `json:"dry_run"`
+	Standby               bool                   `json:"standby"`
+	StandbyBuffer         int                    `json:"standby_buffer"`
+	StandbyLockKey        int64                  `json:"standby_lock_key,omitempty"`
+	StandbyLockInterval   string                 `json:"standby_lock_interval"`
+	Preflight             bool                   `json:"preflight"`
+	Requirements          int                    `json:"requirements"`
+	ReadOnly              bool                   `json:"read_only"`
+	StatementTimeout      string                 `json:"statement_timeout,omitempty"`
+	LockTimeout           string                 `json:"lock_timeout,omitempty"`
+	WriteUser             string                 `json:"write_user,omitempty"`
+	WritePassword         string                 `json:"write_password,omitempty"`
+	DebugRate             float64                `json:"debug_rate"`
+	Hosts                 []string               `json:"hosts,omitempty"`
+	FailoverWatch         bool                   `json:"failover_watch"`
+	FailoverInterval      string                 `json:"failover_interval"`
+	Aliases               map[string][]string    `json:"aliases,omitempty"`
+	AliasDedupSize        int                    `json:"alias_dedup_size"`
+	Outbox                string                 `json:"outbox,omitempty"`
+	BulkheadWorkers       int                    `json:"bulkhead_workers,omitempty"`
+	BulkheadQueue         int                    `json:"bulkhead_queue,omitempty"`
+	Escalation            string                 `json:"escalation,omitempty"`
+	FailFastOnFatal       bool                   `json:"fail_fast_on_fatal"`
+	MaxReconnects         int                    `json:"max_reconnect_attempts,omitempty"`
+	Logger                string                 `json:"logger,omitempty"`
+	Handover              string                 `json:"handover,omitempty"`
+	Collector             string                 `json:"collector,omitempty"`
+	SlowHandlerThreshold  string                 `json:"slow_handler_threshold"`
+	SlowHandlerThresholds map[string]string      `json:"slow_handler_thresholds,omitempty"`
+	FingerprintFields     []string               `json:"fingerprint_fields,omitempty"`
+	ResolveBackends       bool                   `json:"resolve_backends,omitempty"`
+	Sources               []string               `json:"sources,omitempty"`
+	DeadLetters           string                 `json:"dead_letters,omitempty"`
+	QuarantineAttempts    int                    `json:"quarantine_attempts,omitempty"`
+	QuarantineTimeout     string                 `json:"quarantine_timeout,omitempty"`
+	QuarantineStore       string                 `json:"quarantine_store,omitempty"`
+	DrainDefault          DrainAction            `json:"drain_default,omitempty"`
+	DrainChannels         map[string]DrainAction `json:"drain_channels,omitempty"`
+	DrainSpool            string                 `json:"drain_spool,omitempty"`
+}
+
+//EffectiveConfig returns the client's resolved configuration. Zero durations are reported as 0s, meaning the feature they configure is disabled
+func (c *Client) EffectiveConfig() EffectiveConfig {
+	cfg := c.config
+	channels := c.Channels()
+	sort.Strings(channels)
+	e := EffectiveConfig{
+		Channels:             channels,
+		Host:                 cfg.Host,
+		Port:                 cfg.Port,
+		User:                 cfg.User,
+		Database:             cfg.Database,
+		SSLMode:              "disable",
+		SSLRootCert:          cfg.SSLRootCert,
+		MaxOpenConns:         cfg.MaxOpenConns,
+		MaxIdleConns:         cfg.MaxIdleConns,
+		Verbose:              cfg.Verbose,
+		InstanceID:           cfg.InstanceID,
+		Labels:               cfg.Labels,
+		LagThreshold:         cfg.LagThreshold.String(),
+		Tracing:              cfg.TraceWriter != nil,
+		TraceSampleRate:      1,
+		Clock:                fmt.Sprintf("%T", cfg.Clock),
+		Workers:              c.workers.size,
+		ChannelWorkers:       cfg.ChannelWorkers,
+		QueueSize:            c.queueSize(),
+		Ordering:             OrderingStrict,
+		Overflow:             OverflowBlock,
+		SpillLimit:           c.spillLimit(),
+		Delivery:             DeliveryAtLeastOnce,
+		MaxAge:               cfg.MaxAge.String(),
+		DryRun:               cfg.DryRun,
+		Standby:              cfg.Standby || cfg.StandbyLockKey != 0,
+		StandbyBuffer:        c.standby.size,
+		StandbyLockKey:       cfg.StandbyLockKey,
+		StandbyLockInterval:  durationOr(cfg.StandbyLockInterval, defaultStandbyLockInterval).String(),
+		Preflight:            cfg.Preflight,
+		Requirements:         len(cfg.Requirements),
+		ReadOnly:             cfg.ReadOnly,
+		DebugRate:            c.debugRate(),
+		Hosts:                cfg.Hosts,
+		FailoverWatch:        c.watchesFailover(),
+		FailoverInterval:     c.failoverInterval().String(),
+		Aliases:              cfg.Aliases,
+		AliasDedupSize:       c.aliases.size,
+		SlowHandlerThreshold: cfg.SlowHandlerThreshold.String(),
+	}
+	if cfg.Fingerprint != nil {
+		e.FingerprintFields = cfg.Fingerprint.Fields
+	}
+	e.ResolveBackends = cfg.Backends != nil
+	for _, src := range cfg.Sources {
+		e.Sources = append(e.Sources, src.Name())
+	}
+	for handler, d := range cfg.SlowHandlerThresholds {
+		if e.SlowHandlerThresholds == nil {
+			e.SlowHandlerThresholds = map[string]string{}
+		}
+		e.SlowHandlerThresholds[handler] = d.String()
+	}
+	if cfg.Password != "" {
+		e.Password = redacted
+	}
+	if cfg.Budget != nil {
+		e.ConnectionBudget = cfg.Budget.Max
+	}
+	e.WriteUser = cfg.WriteUser
+	if cfg.WritePassword != "" {
+		e.WritePassword = redacted
+	}
+	if cfg.SSLCert != "" && cfg.SSLKey != "" {
+		e.SSLMode, e.SSLCert, e.SSLKey = cfg.SSLMode, cfg.SSLCert, cfg.SSLKey
+	}
+	if cfg.Ordering != "" {
+		e.Ordering = cfg.Ordering
+	}
+	if cfg.Overflow != "" {
+		e.Overflow = cfg.Overflow
+	}
+	if cfg.Delivery != "" {
+		e.Delivery = cfg.Delivery
+	}
+	if cfg.StatementTimeout > 0 {
+		e.StatementTimeout = cfg.StatementTimeout.String()
+	}
+	if cfg.LockTimeout > 0 {
+		e.LockTimeout = cfg.LockTimeout.String()
+	}
+	if cfg.FailFastOnFatal {
+		e.FailFastOnFatal, e.MaxReconnects = true, c.maxReconnectAttempts()
+	}
+	if cfg.Logger != nil {
+		e.Logger = fmt.Sprintf("%T", cfg.Logger)
+	}
+	if h := cfg.Handover; h != nil {
+		e.Handover = fmt.Sprintf("%T", h.Store)
+	}
+	if cfg.Collector != nil {
+		e.Collector = fmt.Sprintf("%T", cfg.Collector)
+	}
+	if cfg.Escalation != nil {
+		e.Escalation = cfg.Escalation.String()
+	}
+	if c.durable != nil {
+		e.Outbox = c.durable.outbox.table()
+	}
+	if q := cfg.Quarantine; q != nil {
+		e.QuarantineAttempts, e.QuarantineTimeout, e.QuarantineStore = q.maxAttempts(), q.Timeout.String(), fmt.Sprintf("%T", q.Store)
+	}
+	if d := cfg.Drain; d != nil {
+		e.DrainDefault, e.DrainChannels = d.action(""), d.Channels
+		switch spool := d.Spool.(type) {
+		case nil:
+		case *TableSpool:
+			e.DrainSpool = spool.table()
+		case *FileSpool:
+			e.DrainSpool = spool.Path
+		default:
+			e.DrainSpool = fmt.Sprintf("%T", spool)
+		}
+	}
+	switch store := cfg.DeadLetters.(type) {
+	case nil:
+	case *DeadLetterTable:
+		e.DeadLetters = store.table()
+	default:
+		e.DeadLetters = fmt.Sprintf("%T", store)
+	}
+	if b := cfg.Bulkheads; b != nil {
+		e.BulkheadWorkers, e.BulkheadQueue = 1, defaultBulkheadQueue
+		if b.Workers > 0 {
+			e.BulkheadWorkers = b.Workers
+		}
+		if b.Queue > 0 {
+			e.BulkheadQueue = b.Queue
+		}
+	}
+	if cfg.TraceSampleRate > 0 && cfg.TraceSampleRate <= 1 {
+		e.TraceSampleRate = cfg.TraceSampleRate
+	}
+	return e
+}
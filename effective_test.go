@@ -0,0 +1,38 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users", "orders"}, &pqstream.Config{Password: "hunter2", Workers: 3, SSLMode: "require"}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	e := client.EffectiveConfig()
+	if e.Password != "[redacted]" || e.Host != "localhost" || e.Port != "5432" || e.SSLMode != "disable" || e.Workers != 3 {
+		t.Fatalf("unexpected effective config: %+v", e)
+	}
+	if e.StandbyBuffer != 10000 || e.DebugRate != 5 || e.FailoverInterval != "10s" || e.TraceSampleRate != 1 || strings.Join(e.Channels, ",") != "orders,users" {
+		t.Fatalf("expected defaults to be resolved: %+v", e)
+	}
+
+	rec := httptest.NewRecorder()
+	pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatalf("unexpected config response: %d %s", rec.Code, rec.Body.String())
+	}
+	var served pqstream.EffectiveConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || served.InstanceID != e.InstanceID {
+		t.Fatalf("unexpected served config: %+v %v", served, err)
+	}
+}
@@ -0,0 +1,326 @@
+package pqstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrNoEncoding is returned when negotiating with a sink that accepts none of the available encodings
+var ErrNoEncoding = errors.New("sink accepts none of the available encodings")
+
+//A Compressor applies a content coding to marshaled notifications. Codings beyond gzip, ie: zstd, are plugged in by implementing it
+type Compressor interface {
+	//Encoding is the coding's name, as in a Content-Encoding header, ie: gzip or zstd
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+}
+
+//NoCompression leaves marshaled notifications uncompressed, the identity coding
+type NoCompression struct{}
+
+//Encoding returns identity
+func (NoCompression) Encoding() string {
+	return "identity"
+}
+
+//Compress returns the data unchanged
+func (NoCompression) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//GzipCompressor compresses marshaled notifications with gzip
+type GzipCompressor struct {
+	//Level is a compress/gzip level. Defaults to gzip.DefaultCompression
+	Level int
+}
+
+//Encoding returns gzip
+func (GzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+//Compress returns the gzipped data
+func (g GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//ProtobufMarshaler encodes notifications as Records in the protobuf wire format, for sinks feeding systems that expect protobuf, with the schema:
+//
+//	message Record {
+//	  string channel = 1;
+//	  int64 pid = 2;
+//	  bytes payload = 3;
+//	  int64 received_at_unix_nano = 4;
+//	}
+type ProtobufMarshaler struct{}
+
+//ContentType returns application/x-protobuf
+func (ProtobufMarshaler) ContentType() string {
+	return "application/x-protobuf"
+}
+
+//Marshal encodes the notification as a protobuf Record
+func (ProtobufMarshaler) Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	var b []byte
+	field := func(number int, value string) {
+		if value == "" {
+			return
+		}
+		b = binary.AppendUvarint(b, uint64(number)<<3|2)
+		b = binary.AppendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	}
+	varint := func(number int, value int64) {
+		if value == 0 {
+			return
+		}
+		b = binary.AppendUvarint(b, uint64(number)<<3)
+		b = binary.AppendUvarint(b, uint64(value))
+	}
+	field(1, notification.Channel)
+	varint(2, int64(notification.BePid))
+	field(3, notification.Extra)
+	varint(4, receivedAt.UnixNano())
+	return b, nil
+}
+
+//UnmarshalProtobufRecord decodes a Record encoded by ProtobufMarshaler, skipping unknown fields
+func UnmarshalProtobufRecord(data []byte) (Record, error) {
+	var r Record
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Record{}, errors.New("invalid protobuf record: bad tag")
+		}
+		data = data[n:]
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Record{}, errors.New("invalid protobuf record: bad value")
+		}
+		data = data[n:]
+		var bytes string
+		switch tag & 7 {
+		case 0:
+		case 2:
+			if value > uint64(len(data)) {
+				return Record{}, errors.New("invalid protobuf record: truncated field")
+			}
+			bytes, data = string(data[:value]), data[value:]
+		default:
+			return Record{}, fmt.Errorf("invalid protobuf record: unsupported wire type %d", tag&7)
+		}
+		switch tag >> 3 {
+		case 1:
+			r.Channel = bytes
+		case 2:
+			r.PID = int(int64(value))
+		case 3:
+			r.Payload = bytes
+		case 4:
+			r.ReceivedAt = time.Unix(0, int64(value)).UTC()
+		}
+	}
+	return r, nil
+}
+
+//Accepts are the encodings a sink accepts, each most preferred first
+type Accepts struct {
+	//ContentTypes are the media types accepted, ie: application/x-protobuf or application/json, matched without their parameters. */* accepts any.
+	//Empty accepts the first available Marshaler
+	ContentTypes []string
+	//Encodings are the content codings accepted, ie: zstd, gzip or identity, which none is an alias of. Empty accepts identity only
+	Encodings []string
+}
+
+//An Encoding is the marshaler and compressor negotiated for a sink
+type Encoding struct {
+	Marshaler  Marshaler
+	Compressor Compressor
+}
+
+//ContentType is the media type of the encoded notifications
+func (e Encoding) ContentType() string {
+	return e.Marshaler.ContentType()
+}
+
+//ContentEncoding is the coding the encoded notifications are compressed with, or empty if they aren't, as in a Content-Encoding header
+func (e Encoding) ContentEncoding() string {
+	if e.Compressor == nil || e.Compressor.Encoding() == "identity" {
+		return ""
+	}
+	return e.Compressor.Encoding()
+}
+
+//Encode marshals and compresses a notification received at the given time
+func (e Encoding) Encode(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	data, err := e.Marshaler.Marshal(notification, receivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if e.Compressor == nil {
+		return data, nil
+	}
+	return e.Compressor.Compress(data)
+}
+
+func (e Encoding) String() string {
+	if coding := e.ContentEncoding(); coding != "" {
+		return e.ContentType() + "+" + coding
+	}
+	return e.ContentType()
+}
+
+//An EncodingSink declares the encodings it accepts, and is delivered notifications already encoded in the one negotiated with it, ie: by a Pipeline
+//with Encodings, so one pipeline can feed sinks expecting protobuf, gzipped JSON and plain JSON alike. Sinks negotiating the same encoding share each
+//notification's encoded payload
+type EncodingSink interface {
+	Sink
+	Accepts() Accepts
+	SendEncoded(ctx context.Context, notification *pq.Notification, payload []byte, encoding Encoding) error
+}
+
+//Encodings are the marshalers and compressors available to negotiate with sinks, each in order of preference for sinks accepting several
+type Encodings struct {
+	Marshalers  []Marshaler
+	Compressors []Compressor
+}
+
+//DefaultEncodings offers Records as JSON, CloudEvents, raw payloads and Records as protobuf, uncompressed or gzipped. Append a Compressor to offer zstd
+func DefaultEncodings() *Encodings {
+	return &Encodings{
+		Marshalers:  []Marshaler{RecordMarshaler{}, CloudEventsMarshaler{}, RawMarshaler{}, ProtobufMarshaler{}},
+		Compressors: []Compressor{NoCompression{}, GzipCompressor{}},
+	}
+}
+
+//Negotiate returns the encoding a sink accepting accepts prefers among those available, failing with ErrNoEncoding if it accepts none
+func (e *Encodings) Negotiate(accepts Accepts) (Encoding, error) {
+	var negotiated Encoding
+	types := accepts.ContentTypes
+	if len(types) == 0 {
+		types = []string{"*/*"}
+	}
+	for _, accepted := range types {
+		for _, m := range e.Marshalers {
+			if mediaType(accepted) == "*/*" || mediaType(accepted) == mediaType(m.ContentType()) {
+				negotiated.Marshaler = m
+				break
+			}
+		}
+		if negotiated.Marshaler != nil {
+			break
+		}
+	}
+	codings := accepts.Encodings
+	if len(codings) == 0 {
+		codings = []string{"identity"}
+	}
+	for _, accepted := range codings {
+		accepted = strings.ToLower(strings.TrimSpace(accepted))
+		if accepted == "none" {
+			accepted = "identity"
+		}
+		for _, c := range e.Compressors {
+			if c.Encoding() == accepted {
+				negotiated.Compressor = c
+				break
+			}
+		}
+		//identity needs no compressor to be offered
+		if negotiated.Compressor == nil && accepted == "identity" {
+			negotiated.Compressor = NoCompression{}
+		}
+		if negotiated.Compressor != nil {
+			break
+		}
+	}
+	if negotiated.Marshaler == nil || negotiated.Compressor == nil {
+		return Encoding{}, fmt.Errorf("%w: accepts %s encoded %s", ErrNoEncoding, strings.Join(types, ", "), strings.Join(codings, ", "))
+	}
+	return negotiated, nil
+}
+
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+//encodedSink delivers notifications to an EncodingSink in its negotiated encoding, sharing payloads with sinks of the same encoding through the context
+type encodedSink struct {
+	sink     EncodingSink
+	encoding Encoding
+	clock    Clock
+}
+
+func (s *encodedSink) Name() string {
+	return s.sink.Name()
+}
+
+func (s *encodedSink) Send(ctx context.Context, notification *pq.Notification) error {
+	payload, err := encodedFrom(ctx).encode(notification, s.encoding, s.clock)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification as %s! %s", s.encoding, err.Error())
+	}
+	return s.sink.SendEncoded(ctx, notification, payload, s.encoding)
+}
+
+//encodeCache holds a notification's payload in each encoding a fan out negotiated
+type encodeCache struct {
+	mu       sync.Mutex
+	payloads map[string][]byte
+}
+
+type encodeCacheKey struct{}
+
+func withEncodeCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, encodeCacheKey{}, &encodeCache{payloads: map[string][]byte{}})
+}
+
+func encodedFrom(ctx context.Context) *encodeCache {
+	cache, _ := ctx.Value(encodeCacheKey{}).(*encodeCache)
+	return cache
+}
+
+//encode returns the notification in an encoding, encoding it once per cache
+func (c *encodeCache) encode(notification *pq.Notification, encoding Encoding, clock Clock) ([]byte, error) {
+	if c == nil {
+		return encoding.Encode(notification, clock.Now())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if payload, ok := c.payloads[encoding.String()]; ok {
+		return payload, nil
+	}
+	payload, err := encoding.Encode(notification, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	c.payloads[encoding.String()] = payload
+	return payload, nil
+}
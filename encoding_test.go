@@ -0,0 +1,145 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	encodings := pqstream.DefaultEncodings()
+	for _, tc := range []struct {
+		accepts pqstream.Accepts
+		want    string
+	}{
+		{pqstream.Accepts{}, "application/json"},
+		{pqstream.Accepts{ContentTypes: []string{"application/x-protobuf", "application/json"}, Encodings: []string{"zstd", "gzip"}}, "application/x-protobuf+gzip"},
+		{pqstream.Accepts{ContentTypes: []string{"application/avro", "text/plain"}, Encodings: []string{"none"}}, "text/plain; charset=utf-8"},
+		{pqstream.Accepts{ContentTypes: []string{"application/cloudevents+json; charset=utf-8"}, Encodings: []string{"br", "identity"}}, "application/cloudevents+json"},
+	} {
+		encoding, err := encodings.Negotiate(tc.accepts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := encoding.String(); got != tc.want {
+			t.Fatalf("expected %+v to negotiate %s, got %s", tc.accepts, tc.want, got)
+		}
+	}
+	if _, err := encodings.Negotiate(pqstream.Accepts{Encodings: []string{"zstd"}}); !errors.Is(err, pqstream.ErrNoEncoding) {
+		t.Fatalf("expected an unavailable coding to fail, got: %v", err)
+	}
+	if _, err := encodings.Negotiate(pqstream.Accepts{ContentTypes: []string{"application/avro"}}); !errors.Is(err, pqstream.ErrNoEncoding) {
+		t.Fatalf("expected an unavailable content type to fail, got: %v", err)
+	}
+}
+
+func TestProtobufMarshaler(t *testing.T) {
+	at := time.Unix(0, 1700000000123456789).UTC()
+	n := &pq.Notification{Channel: "orders", BePid: 42, Extra: `{"id":1}`}
+	data, err := pqstream.ProtobufMarshaler{}.Marshal(n, at)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	//channel = 1, a length delimited field
+	if !bytes.HasPrefix(data, []byte("\x0a\x06orders")) {
+		t.Fatalf("unexpected encoding: %x", data)
+	}
+	r, err := pqstream.UnmarshalProtobufRecord(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r != pqstream.NewRecord(n, at) {
+		t.Fatalf("expected the record to round trip, got: %+v", r)
+	}
+	if _, err := pqstream.UnmarshalProtobufRecord(data[:len(data)-12]); err == nil {
+		t.Fatal("expected a truncated record to fail")
+	}
+}
+
+type encodedRecorder struct {
+	name     string
+	accepts  pqstream.Accepts
+	mu       sync.Mutex
+	payloads [][]byte
+}
+
+func (e *encodedRecorder) Name() string {
+	return e.name
+}
+
+func (e *encodedRecorder) Accepts() pqstream.Accepts {
+	return e.accepts
+}
+
+func (e *encodedRecorder) Send(ctx context.Context, notification *pq.Notification) error {
+	return errors.New("expected an encoded send")
+}
+
+func (e *encodedRecorder) SendEncoded(ctx context.Context, notification *pq.Notification, payload []byte, encoding pqstream.Encoding) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.payloads = append(e.payloads, payload)
+	return nil
+}
+
+func TestPipelineEncodings(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+	webhook := &pqstream.WebhookSink{URL: srv.URL, Accept: pqstream.Accepts{ContentTypes: []string{"application/x-protobuf"}, Encodings: []string{"gzip"}}}
+	a := &encodedRecorder{name: "a", accepts: pqstream.Accepts{ContentTypes: []string{"application/json"}}}
+	b := &encodedRecorder{name: "b", accepts: pqstream.Accepts{ContentTypes: []string{"application/json"}}}
+	var plain []string
+	raw := pqstream.NewSink("raw", func(ctx context.Context, n *pq.Notification) error {
+		plain = append(plain, n.Extra)
+		return nil
+	})
+	p := pqstream.NewPipeline().Encodings(pqstream.DefaultEncodings()).FanOut(webhook, a, pqstream.Optional(b), raw)
+	if err := p.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	n := &pq.Notification{Channel: "orders", Extra: `{"id":1}`}
+	if err := p.Process(n); err != nil {
+		t.Fatal(err.Error())
+	}
+	req := <-requests
+	if req.Header.Get("Content-Type") != "application/x-protobuf" || req.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected headers: %v", req.Header)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(<-bodies))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := io.ReadAll(gz)
+	r, err := pqstream.UnmarshalProtobufRecord(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Channel != "orders" || r.Payload != `{"id":1}` {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if len(a.payloads) != 1 || len(b.payloads) != 1 || &a.payloads[0][0] != &b.payloads[0][0] {
+		t.Fatal("expected sinks negotiating the same encoding to share the encoded payload")
+	}
+	if len(plain) != 1 || plain[0] != `{"id":1}` {
+		t.Fatalf("expected other sinks to be sent the notification, got: %v", plain)
+	}
+	bad := pqstream.NewPipeline().Encodings(pqstream.DefaultEncodings()).FanOut(&encodedRecorder{name: "avro", accepts: pqstream.Accepts{ContentTypes: []string{"application/avro"}}})
+	if err := bad.Validate(); !errors.Is(err, pqstream.ErrNoEncoding) {
+		t.Fatalf("expected a sink accepting no available encoding to fail validation, got: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+//HealthHandler returns an http.Handler serving a client's Kubernetes style probes. GET /livez fails once the client has stopped, so a crashed client is restarted,
+//and GET /readyz fails until the client is Ready and while any channel's listener isn't listening, with the channels that aren't as the response body
+func HealthHandler(c *Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		if c.isStopping() {
+			http.Error(w, "stopped", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-c.Ready():
+		default:
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if c.isStopping() {
+			http.Error(w, "stopped", http.StatusServiceUnavailable)
+			return
+		}
+		var down []ListenerState
+		for _, state := range c.ListenersSnapshot() {
+			if state.State != ConnListening {
+				down = append(down, state)
+			}
+		}
+		if len(down) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJSON(w, down)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+//An HTTPEndpoint is an address serving some of a client's HTTP handlers, optionally over TLS
+type HTTPEndpoint struct {
+	//Addr is the address listened on, ie: :8081. Empty disables the endpoint
+	Addr string
+	//CertFile and KeyFile are a PEM server certificate and key. Empty serves plain HTTP
+	CertFile string
+	KeyFile  string
+	//ClientCAFile is a PEM bundle of the certificate authorities client certificates must be signed by, requiring mTLS. Empty accepts requests without one
+	ClientCAFile string
+}
+
+func (e HTTPEndpoint) tlsConfig() (*tls.Config, error) {
+	if e.CertFile == "" && e.KeyFile == "" {
+		if e.ClientCAFile != "" {
+			return nil, fmt.Errorf("endpoint %s requires a certificate to verify client certificates", e.Addr)
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(e.CertFile, e.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate of endpoint %s! %s", e.Addr, err.Error())
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if e.ClientCAFile != "" {
+		pem, err := os.ReadFile(e.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca file of endpoint %s! %s", e.Addr, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to read client ca file of endpoint %s! no certificates found", e.Addr)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+//endpointServer is the mux serving every endpoint sharing an address
+type endpointServer struct {
+	endpoint HTTPEndpoint
+	mux      *http.ServeMux
+}
+
+func (s *endpointServer) listen() (net.Listener, error) {
+	tlsConfig, err := s.endpoint.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", s.endpoint.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s! %s", s.endpoint.Addr, err.Error())
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+//EndpointOptions configure ServeEndpoints. Health, metrics and admin endpoints sharing an address are served together, ie: health and metrics on one port,
+//which requires them to agree on TLS
+type EndpointOptions struct {
+	//Health serves HealthHandler's /livez and /readyz
+	Health HTTPEndpoint
+	//Metrics serves MetricsHandler at /metrics
+	Metrics HTTPEndpoint
+	//Admin serves AdminHandler, and the OpenAPI definition of the admin API, at /
+	Admin HTTPEndpoint
+	//AdminOptions configures the AdminHandler. Its Authorize is required to serve Admin
+	AdminOptions AdminOptions
+	//MetricsHandler defaults to the client's Collector if it is an http.Handler, ie: Metrics
+	MetricsHandler http.Handler
+	//ShutdownTimeout bounds how long in-flight requests are drained for once the context is done. Defaults to 5s
+	ShutdownTimeout time.Duration
+}
+
+//ServeEndpoints serves a client's health checks, metrics and admin API on their own ports, so it slots into Kubernetes deployments as is: probes and scrapes
+//on ports that are never exposed, and the admin API behind mTLS. It returns once the context is done and every server has drained, or the first server fails
+func ServeEndpoints(ctx context.Context, c *Client, opts EndpointOptions) error {
+	metrics := opts.MetricsHandler
+	if metrics == nil {
+		handler, ok := c.config.Collector.(http.Handler)
+		if !ok && opts.Metrics.Addr != "" {
+			return errors.New("metrics endpoint requires a MetricsHandler or a Collector serving http")
+		}
+		metrics = handler
+	}
+	if opts.Admin.Addr != "" && opts.AdminOptions.Authorize == nil {
+		return errors.New("admin endpoint requires AdminOptions.Authorize")
+	}
+	var (
+		servers []*endpointServer
+		byAddr  = map[string]*endpointServer{}
+	)
+	mount := func(endpoint HTTPEndpoint, pattern string, handler http.Handler) error {
+		if endpoint.Addr == "" {
+			return nil
+		}
+		s, ok := byAddr[endpoint.Addr]
+		if !ok {
+			s = &endpointServer{endpoint: endpoint, mux: http.NewServeMux()}
+			byAddr[endpoint.Addr] = s
+			servers = append(servers, s)
+		} else if s.endpoint != endpoint {
+			return fmt.Errorf("endpoints sharing %s have different tls options", endpoint.Addr)
+		}
+		s.mux.Handle(pattern, handler)
+		return nil
+	}
+	health := HealthHandler(c)
+	if err := errors.Join(
+		mount(opts.Health, "/livez", health),
+		mount(opts.Health, "/readyz", health),
+		mount(opts.Metrics, "/metrics", metrics),
+		mount(opts.Admin, "/", AdminHandler(c, opts.AdminOptions)),
+	); err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.New("no endpoints to serve")
+	}
+	//every address is bound before any is served, so a port in use fails fast instead of leaving the other endpoints running
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, s := range servers {
+		ln, err := s.listen()
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	httpServers := make([]*http.Server, len(servers))
+	errs := make(chan error, len(servers))
+	for i, s := range servers {
+		httpServers[i] = &http.Server{Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+		go func(srv *http.Server, ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(httpServers[i], listeners[i])
+		if c.config.Verbose {
+			c.logf("serving endpoint on %s", listeners[i].Addr())
+		}
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		err = fmt.Errorf("endpoint failed! %s", err.Error())
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), durationOr(opts.ShutdownTimeout, 5*time.Second))
+	defer cancel()
+	for _, srv := range httpServers {
+		err = errors.Join(err, srv.Shutdown(shutdown))
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := pqstream.HealthHandler(client)
+	for path, code := range map[string]int{"/livez": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != code {
+			t.Fatalf("expected %s to return %d, got: %d", path, code, w.Code)
+		}
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestServeEndpoints(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Collector: pqstream.NewMetrics()}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ops, admin := freeAddr(t), freeAddr(t)
+	if err := pqstream.ServeEndpoints(context.Background(), client, pqstream.EndpointOptions{
+		Health:  pqstream.HTTPEndpoint{Addr: ops},
+		Metrics: pqstream.HTTPEndpoint{Addr: ops, CertFile: "cert.pem", KeyFile: "key.pem"},
+	}); err == nil || !strings.Contains(err.Error(), "different tls options") {
+		t.Fatalf("expected endpoints sharing an address to require the same tls options, got: %v", err)
+	}
+	if err := pqstream.ServeEndpoints(context.Background(), client, pqstream.EndpointOptions{Admin: pqstream.HTTPEndpoint{Addr: admin}}); err == nil {
+		t.Fatal("expected the admin endpoint to require an Authorize")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- pqstream.ServeEndpoints(ctx, client, pqstream.EndpointOptions{
+			Health:       pqstream.HTTPEndpoint{Addr: ops},
+			Metrics:      pqstream.HTTPEndpoint{Addr: ops},
+			Admin:        pqstream.HTTPEndpoint{Addr: admin},
+			AdminOptions: pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin},
+		})
+	}()
+	get := func(url string) (int, string) {
+		for i := 0; ; i++ {
+			resp, err := http.Get(url)
+			if err != nil {
+				if i > 100 {
+					t.Fatal(err.Error())
+				}
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+	}
+	if code, _ := get("http://" + ops + "/livez"); code != http.StatusOK {
+		t.Fatalf("expected the health endpoint to be live, got: %d", code)
+	}
+	if _, body := get("http://" + ops + "/metrics"); !strings.Contains(body, "pqstream_pings_total") {
+		t.Fatalf("expected metrics on the shared port, got: %s", body)
+	}
+	if code, _ := get("http://" + ops + "/stats"); code != http.StatusNotFound {
+		t.Fatalf("expected the admin API to be kept off the health port, got: %d", code)
+	}
+	if code, _ := get("http://" + admin + "/stats"); code != http.StatusOK {
+		t.Fatalf("expected the admin API on its own port, got: %d", code)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+}
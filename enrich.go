@@ -0,0 +1,174 @@
+package pqstream
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//A Join declares a foreign key to follow when enriching change events: the row of Ref whose RefColumn equals the event row's Column is embedded in the event row under As
+type Join struct {
+	//Table is the schema qualified or bare table whose change events are enriched
+	Table string
+	//Column is the foreign key column in the event row
+	Column string
+	//Ref is the optionally schema qualified table the foreign key references
+	Ref string
+	//RefColumn is the referenced column. Defaults to id
+	RefColumn string
+	//As is the field the related row is embedded as. Defaults to Ref
+	As string
+}
+
+//FetchFunc loads the row of a table whose column equals value as JSON, or nil if there is none
+type FetchFunc func(ctx context.Context, table, column string, value any) (json.RawMessage, error)
+
+//An Enricher denormalizes change events by embedding the rows their foreign keys reference, so sinks like search indexes receive complete documents.
+//Each related row is selected at most once per event and cached, bounded by CacheSize and TTL
+type Enricher struct {
+	DB    *sql.DB
+	Joins []Join
+	//Fetch loads related rows. Defaults to selecting row_to_json from DB
+	Fetch FetchFunc
+	//CacheSize is the number of related rows cached. Defaults to 1024
+	CacheSize int
+	//TTL is how long a cached row is used before it is selected again. Defaults to 1 minute
+	TTL time.Duration
+	//Clock is the source of time for cache expiry. Defaults to SystemClock
+	Clock Clock
+
+	once  sync.Once
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	lru   *list.List
+}
+
+type enrichedRow struct {
+	key     string
+	row     json.RawMessage
+	expires time.Time
+}
+
+//Transform returns a pipeline transform that enriches change events of joined tables. Events of other tables and payloads that aren't change events pass unchanged
+func (e *Enricher) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		return e.Enrich(context.Background(), notification)
+	}
+}
+
+//Enrich returns a copy of the notification with every declared join embedded in its change event's row: the new row, or the old one for deletes
+func (e *Enricher) Enrich(ctx context.Context, notification *pq.Notification) (*pq.Notification, error) {
+	event, err := ParseChange(notification)
+	if err != nil {
+		return notification, nil
+	}
+	row := event.New
+	if event.Op == OpDelete || row == nil {
+		row = event.Old
+	}
+	enriched := false
+	for _, join := range e.Joins {
+		if join.Table != event.Table && join.Table != event.QualifiedTable() {
+			continue
+		}
+		value, ok := row[join.Column]
+		if !ok || value == nil {
+			continue
+		}
+		related, err := e.lookup(ctx, join, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enrich %s.%s from %s! %s", event.QualifiedTable(), join.Column, join.Ref, err.Error())
+		}
+		as := join.As
+		if as == "" {
+			as = join.Ref
+		}
+		if related == nil {
+			row[as] = nil
+		} else {
+			row[as] = related
+		}
+		enriched = true
+	}
+	if !enriched {
+		return notification, nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(payload)}, nil
+}
+
+func (e *Enricher) lookup(ctx context.Context, join Join, value any) (json.RawMessage, error) {
+	e.once.Do(func() {
+		e.cache = map[string]*list.Element{}
+		e.lru = list.New()
+	})
+	refColumn := join.RefColumn
+	if refColumn == "" {
+		refColumn = "id"
+	}
+	key := fmt.Sprintf("%s.%s=%v", join.Ref, refColumn, value)
+	clock := clockOr(e.Clock)
+	e.mu.Lock()
+	if el, ok := e.cache[key]; ok {
+		cached := el.Value.(*enrichedRow)
+		if clock.Now().Before(cached.expires) {
+			e.lru.MoveToFront(el)
+			e.mu.Unlock()
+			return cached.row, nil
+		}
+		e.lru.Remove(el)
+		delete(e.cache, key)
+	}
+	e.mu.Unlock()
+	fetch := e.Fetch
+	if fetch == nil {
+		fetch = e.fetch
+	}
+	row, err := fetch(ctx, join.Ref, refColumn, value)
+	if err != nil {
+		return nil, err
+	}
+	ttl, size := e.TTL, e.CacheSize
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	if size <= 0 {
+		size = 1024
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.cache[key]; ok {
+		e.lru.Remove(el)
+	}
+	e.cache[key] = e.lru.PushFront(&enrichedRow{key: key, row: row, expires: clock.Now().Add(ttl)})
+	for e.lru.Len() > size {
+		oldest := e.lru.Back()
+		e.lru.Remove(oldest)
+		delete(e.cache, oldest.Value.(*enrichedRow).key)
+	}
+	return row, nil
+}
+
+func (e *Enricher) fetch(ctx context.Context, table, column string, value any) (json.RawMessage, error) {
+	if e.DB == nil {
+		return nil, errors.New("enricher requires a db")
+	}
+	var row []byte
+	err := e.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT row_to_json(t) FROM %s t WHERE %s = $1", quoteQualified(table), pq.QuoteIdentifier(column)), fmt.Sprint(value)).Scan(&row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
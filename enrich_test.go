@@ -0,0 +1,64 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestEnricher(t *testing.T) {
+	fetches := 0
+	clock := pqstream.NewFakeClock(time.Now())
+	enricher := &pqstream.Enricher{
+		Joins: []pqstream.Join{{Table: "orders", Column: "user_id", Ref: "users", As: "user"}},
+		Fetch: func(ctx context.Context, table, column string, value any) (json.RawMessage, error) {
+			fetches++
+			if value == json.Number("404") {
+				return nil, nil
+			}
+			return json.RawMessage(fmt.Sprintf(`{"%s": %v, "table": "%s"}`, column, value, table)), nil
+		},
+		TTL:   time.Minute,
+		Clock: clock,
+	}
+	p := pqstream.NewPipeline().Transform(enricher.Transform())
+	sink := &recordingSink{name: "index"}
+	p.FanOut(sink)
+	for _, payload := range []string{
+		`{"table": "orders", "op": "INSERT", "new": {"id": 1, "user_id": 7}}`,
+		`{"table": "orders", "op": "INSERT", "new": {"id": 2, "user_id": 7}}`,
+		`{"table": "orders", "op": "INSERT", "new": {"id": 3, "user_id": 404}}`,
+		`{"table": "users", "op": "INSERT", "new": {"id": 7}}`,
+	} {
+		if err := p.Process(&pq.Notification{Channel: "changes", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if fetches != 2 {
+		t.Fatalf("expected related rows to be cached, fetched %d times", fetches)
+	}
+	sent := sink.payloads()
+	e, err := pqstream.ParseChange(&pq.Notification{Extra: sent[0]})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	user, _ := e.New["user"].(map[string]any)
+	if user["table"] != "users" || user["id"] != json.Number("7") {
+		t.Fatalf("expected the order to embed its user, got: %s", sent[0])
+	}
+	if e, _ := pqstream.ParseChange(&pq.Notification{Extra: sent[2]}); e.New["user"] != nil {
+		t.Fatalf("expected a missing related row to embed as null, got: %s", sent[2])
+	}
+	if sent[3] != `{"table": "users", "op": "INSERT", "new": {"id": 7}}` {
+		t.Fatalf("expected events without joins to pass unchanged, got: %s", sent[3])
+	}
+	clock.Advance(2 * time.Minute)
+	p.Process(&pq.Notification{Channel: "changes", Extra: `{"table": "orders", "op": "INSERT", "new": {"id": 4, "user_id": 7}}`})
+	if fetches != 3 {
+		t.Fatalf("expected an expired row to be selected again, fetched %d times", fetches)
+	}
+}
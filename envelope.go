@@ -0,0 +1,126 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//Source is the kind of producer that emitted an enveloped notification
+type Source string
+
+const (
+	//SourceTrigger is a notification emitted by a table trigger
+	SourceTrigger Source = "trigger"
+	//SourceApplication is a notification emitted by application code, ie: with Notify
+	SourceApplication Source = "application"
+	//SourceProcedure is a notification emitted by a stored procedure or function
+	SourceProcedure Source = "procedure"
+	//SourceDerived is a notification republished by a Republisher stage from an event on another channel
+	SourceDerived Source = "derived"
+)
+
+//An Envelope is the conventional JSON wrapper producers may put around a notification payload, ie: {"id": "...", "emitted_at": "2006-01-02T15:04:05Z", "data": {...}}
+//Producers that set emitted_at let the client measure consumer lag. Origin and Via are set by a RelaySink to the region a notification was first relayed from and
+//every region it has been relayed through. Source tells consumers what kind of producer emitted it and Version is the schema version of Data, see SchemaVersions.
+//Seq is the channel's sequence number set by the library's emit function, NotifyOptions.SequenceTable or TriggerSpec.SequenceTable, from which the client detects lost notifications, and Offset is the position of the
+//outbox row a durable notification was sent for. Ref replaces Data when it was too large to notify and was staged instead, see PayloadStage.
+//Deadline is when the notification must be processed by: handlers run with it as their context's deadline, and a notification past it is skipped.
+//TraceParent and Baggage are the W3C trace context of the producer, which the client continues, see TraceContext
+type Envelope struct {
+	ID          string          `json:"id,omitempty"`
+	EmittedAt   time.Time       `json:"emitted_at"`
+	Source      Source          `json:"source,omitempty"`
+	Version     int             `json:"version,omitempty"`
+	Seq         int64           `json:"seq,omitempty"`
+	Offset      int64           `json:"offset,omitempty"`
+	Origin      string          `json:"origin,omitempty"`
+	Via         []string        `json:"via,omitempty"`
+	Lineage     []string        `json:"lineage,omitempty"`
+	Ref         string          `json:"ref,omitempty"`
+	Deadline    *time.Time      `json:"deadline,omitempty"`
+	TraceParent string          `json:"traceparent,omitempty"`
+	Baggage     string          `json:"baggage,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+}
+
+//ParseEnvelope decodes a notification's payload as an Envelope
+func ParseEnvelope(notification *pq.Notification) (*Envelope, error) {
+	if notification == nil {
+		return nil, errors.New("empty notification")
+	}
+	e := &Envelope{}
+	if err := DecodeJSON(notification, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+//Notify sends data to a channel wrapped in an Envelope with a random ID, see NotifyOptions.IDs for sortable ones, the current time and the source, which defaults to SourceApplication.
+//PL/pgSQL producers send the same envelope with the function from the library's migrations, ie: PERFORM pqstream_emit('orders', 'procedure', row_to_json(NEW))
+//Payloads over the NOTIFY size limit are chunked, see NotifyWith, which also assigns sequence numbers for gap detection
+func Notify(ctx context.Context, db Execer, channel string, source Source, data any) error {
+	return NotifyWith(ctx, db, channel, source, data, NotifyOptions{})
+}
+
+//FromSource returns a filter that only passes enveloped notifications emitted by one of the sources
+func FromSource(sources ...Source) FilterFunc {
+	return func(notification *pq.Notification) bool {
+		e := envelopeOf(notification)
+		if e == nil {
+			return false
+		}
+		for _, source := range sources {
+			if e.Source == source {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//envelopeFields are the JSON keys of an Envelope
+var envelopeFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Envelope{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}()
+
+//isEnvelope reports whether a payload is an envelope carrying its data or a ref to it, and nothing else, so it can be re-encoded as one without losing fields
+func isEnvelope(payload string) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil || fields == nil {
+		return false
+	}
+	if _, ok := fields["data"]; !ok {
+		if _, ok := fields["ref"]; !ok {
+			return false
+		}
+	}
+	for key := range fields {
+		if !envelopeFields[key] {
+			return false
+		}
+	}
+	return true
+}
+
+//envelopeOf returns the notification's envelope, or nil if its payload is not an enveloped JSON object
+func envelopeOf(notification *pq.Notification) *Envelope {
+	if len(notification.Extra) == 0 || notification.Extra[0] != '{' {
+		return nil
+	}
+	e, err := ParseEnvelope(notification)
+	if err != nil {
+		return nil
+	}
+	return e
+}
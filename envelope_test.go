@@ -0,0 +1,170 @@
+package pqstream_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	e, err := pqstream.ParseEnvelope(&pq.Notification{Extra: `{"id": "1", "emitted_at": "2020-01-02T15:04:05Z", "data": {"name": "bob"}}`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.ID != "1" || e.EmittedAt.Year() != 2020 || string(e.Data) != `{"name": "bob"}` {
+		t.Fatalf("unexpected envelope: %+v", e)
+	}
+	if _, err := pqstream.ParseEnvelope(&pq.Notification{Extra: "not json"}); err == nil {
+		t.Fatal("expected an error decoding a non-json payload")
+	}
+}
+
+func TestConsumerLag(t *testing.T) {
+	var alerted string
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				return nil
+			}),
+		},
+		LagHandler: func(channel string, lag time.Duration) {
+			alerted = channel
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{LagThreshold: time.Minute}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	emitted := time.Now().Add(-5 * time.Second).UTC().Format(time.RFC3339Nano)
+	client.Process(&pq.Notification{Channel: "users", Extra: fmt.Sprintf(`{"emitted_at": "%s"}`, emitted)})
+	lag := client.Stats().Channels["users"].ConsumerLag
+	if lag < 5*time.Second || lag > time.Minute {
+		t.Fatalf("unexpected consumer lag: %s", lag)
+	}
+	if alerted != "" {
+		t.Fatal("lag handler should not fire below the threshold")
+	}
+	emitted = time.Now().Add(-2 * time.Minute).UTC().Format(time.RFC3339Nano)
+	client.Process(&pq.Notification{Channel: "users", Extra: fmt.Sprintf(`{"emitted_at": "%s"}`, emitted)})
+	if alerted != "users" {
+		t.Fatal("expected lag handler to fire above the threshold")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	var handled, stale []string
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				handled = append(handled, notification.Extra)
+				return nil
+			}),
+		},
+		StaleHandler: pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			stale = append(stale, notification.Extra)
+			return nil
+		}),
+	}
+	clock := pqstream.NewFakeClock(time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC))
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{MaxAge: time.Minute, Clock: clock}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fresh := `{"emitted_at": "2020-01-02T15:04:00Z"}`
+	old := `{"emitted_at": "2020-01-02T14:00:00Z"}`
+	for _, payload := range []string{fresh, old, "not enveloped"} {
+		client.Process(&pq.Notification{Channel: "users", Extra: payload})
+	}
+	if len(handled) != 2 || len(stale) != 1 || stale[0] != old {
+		t.Fatalf("expected only the old notification to be treated as stale, handled: %v stale: %v", handled, stale)
+	}
+	if stats := client.Stats().Channels["users"]; stats.Stale != 1 || stats.Processed != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+type deadlineRecorder struct {
+	handled   []string
+	deadlines []time.Time
+}
+
+func (h *deadlineRecorder) Process(n *pq.Notification) error {
+	return h.ProcessContext(context.Background(), n)
+}
+
+func (h *deadlineRecorder) ProcessContext(ctx context.Context, n *pq.Notification) error {
+	deadline, _ := ctx.Deadline()
+	h.handled = append(h.handled, n.Extra)
+	h.deadlines = append(h.deadlines, deadline)
+	return nil
+}
+
+func TestDeadline(t *testing.T) {
+	var expired []string
+	recorder := &deadlineRecorder{}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{recorder},
+		StaleHandler: pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			expired = append(expired, notification.Extra)
+			return nil
+		}),
+	}
+	clock := pqstream.NewFakeClock(time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC))
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Clock: clock}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pending := `{"emitted_at": "2020-01-02T15:04:00Z", "deadline": "2020-01-02T15:05:00Z"}`
+	late := `{"emitted_at": "2020-01-02T15:00:00Z", "deadline": "2020-01-02T15:01:00Z"}`
+	for _, payload := range []string{pending, late} {
+		client.Process(&pq.Notification{Channel: "users", Extra: payload})
+	}
+	if len(recorder.handled) != 1 || recorder.handled[0] != pending || len(expired) != 1 || expired[0] != late {
+		t.Fatalf("expected only the late notification to be skipped, handled: %v expired: %v", recorder.handled, expired)
+	}
+	if !recorder.deadlines[0].Equal(time.Date(2020, 1, 2, 15, 5, 0, 0, time.UTC)) {
+		t.Fatalf("expected the envelope's deadline on the handler's context, got: %s", recorder.deadlines[0])
+	}
+	if stats := client.Stats().Channels["users"]; stats.Expired != 1 || stats.Processed != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	db := &execRecorder{}
+	if err := pqstream.NotifyWith(context.Background(), db, "users", "", nil, pqstream.NotifyOptions{Deadline: time.Date(2020, 1, 2, 15, 5, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err.Error())
+	}
+	e, err := pqstream.ParseEnvelope(&pq.Notification{Extra: db.args[0][1].(string)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Deadline == nil || !e.Deadline.Equal(time.Date(2020, 1, 2, 15, 5, 0, 0, time.UTC)) {
+		t.Fatalf("expected the deadline on the envelope, got: %+v", e)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	db := &execRecorder{}
+	if err := pqstream.Notify(context.Background(), db, "orders", pqstream.SourceProcedure, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(db.queries) != 1 || db.args[0][0] != "orders" {
+		t.Fatalf("unexpected notify: %v %v", db.queries, db.args)
+	}
+	n := &pq.Notification{Channel: "orders", Extra: db.args[0][1].(string)}
+	e, err := pqstream.ParseEnvelope(n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.ID == "" || e.EmittedAt.IsZero() || e.Source != pqstream.SourceProcedure || string(e.Data) != `{"id":1}` {
+		t.Fatalf("unexpected envelope: %+v", e)
+	}
+	if !pqstream.FromSource(pqstream.SourceTrigger, pqstream.SourceProcedure)(n) {
+		t.Fatal("expected the procedure source to pass")
+	}
+	if pqstream.FromSource(pqstream.SourceApplication)(n) || pqstream.FromSource(pqstream.SourceProcedure)(&pq.Notification{Extra: `{"id": 1}`}) {
+		t.Fatal("expected other sources and untagged payloads to be filtered")
+	}
+}
@@ -0,0 +1,384 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//An ErasureRequest asks for everything held about a data subject to be erased, ie: a user exercising their right to be forgotten
+type ErasureRequest struct {
+	//ID identifies the request, so its completion can be recorded and a redelivered request resumed
+	ID string `json:"id"`
+	//Subject is the subject's primary identifier, ie: their user id
+	Subject string `json:"subject"`
+	//Keys are other identifiers of the subject by name, ie: email, for targets that key the subject's data differently
+	Keys        map[string]string `json:"keys,omitempty"`
+	RequestedAt time.Time         `json:"requested_at,omitempty"`
+}
+
+//Key returns the subject's identifier by a name, or Subject for an empty name
+func (r ErasureRequest) Key(name string) (string, bool) {
+	if name == "" {
+		return r.Subject, r.Subject != ""
+	}
+	value, ok := r.Keys[name]
+	return value, ok && value != ""
+}
+
+//ParseErasureRequest decodes an erasure request from a notification's JSON payload, or from the data of its envelope
+func ParseErasureRequest(notification *pq.Notification) (ErasureRequest, error) {
+	var r ErasureRequest
+	if e := envelopeOf(notification); e != nil && e.Data != nil {
+		if err := json.Unmarshal(e.Data, &r); err != nil {
+			return ErasureRequest{}, fmt.Errorf("failed to decode erasure request! %s", err.Error())
+		}
+	} else if err := DecodeJSON(notification, &r); err != nil {
+		return ErasureRequest{}, fmt.Errorf("failed to decode erasure request! %s", err.Error())
+	}
+	if r.ID == "" {
+		return ErasureRequest{}, errors.New("erasure request requires an id")
+	}
+	if r.Subject == "" && len(r.Keys) == 0 {
+		return ErasureRequest{}, fmt.Errorf("erasure request %s names no subject", r.ID)
+	}
+	return r, nil
+}
+
+//An Eraser erases a subject's data from one place it was fanned out to. Erase must be idempotent, since a request is retried until every eraser succeeds,
+//and should succeed when there is nothing to erase
+type Eraser interface {
+	Named
+	Erase(ctx context.Context, request ErasureRequest) error
+}
+
+type eraserFunc struct {
+	name  string
+	erase func(ctx context.Context, request ErasureRequest) error
+}
+
+func (e *eraserFunc) Name() string {
+	return e.name
+}
+
+func (e *eraserFunc) Erase(ctx context.Context, request ErasureRequest) error {
+	return e.erase(ctx, request)
+}
+
+//NewEraser is a helper function to create a named Eraser from a first class function
+func NewEraser(name string, erase func(ctx context.Context, request ErasureRequest) error) Eraser {
+	return &eraserFunc{name: name, erase: erase}
+}
+
+//A TableEraser erases a subject's rows from a table, ie: a projection or archive, by deleting them or, with Anonymize, overwriting their personal columns
+type TableEraser struct {
+	DB Execer
+	//Table is the optionally schema qualified table
+	Table string
+	//Column holds the subject's identifier
+	Column string
+	//Condition matches the subject's rows instead of Column, given the identifier as $1, ie: payload::jsonb->>'user_id' = $1 for an AuditSink's table
+	Condition string
+	//Key names the request's identifier matched, see ErasureRequest.Key. Defaults to its Subject. Requests without the key erase nothing
+	Key string
+	//Anonymize are the values personal columns are overwritten with, ie: {"email": nil}. Empty deletes the rows
+	Anonymize map[string]any
+}
+
+//Name returns the eraser's name
+func (t *TableEraser) Name() string {
+	return "table:" + t.Table
+}
+
+//Erase deletes or anonymizes the subject's rows
+func (t *TableEraser) Erase(ctx context.Context, request ErasureRequest) error {
+	if t.DB == nil || t.Table == "" || (t.Column == "" && t.Condition == "") {
+		return errors.New("table eraser requires a db, table and column or condition")
+	}
+	value, ok := request.Key(t.Key)
+	if !ok {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	where := t.Condition
+	if where == "" {
+		where = pq.QuoteIdentifier(t.Column) + " = $1"
+	}
+	args := []interface{}{value}
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", quoteQualified(t.Table), where)
+	if len(t.Anonymize) > 0 {
+		set := make([]string, 0, len(t.Anonymize))
+		for _, column := range sortedKeys(t.Anonymize) {
+			args = append(args, t.Anonymize[column])
+			set = append(set, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), len(args)))
+		}
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteQualified(t.Table), strings.Join(set, ", "), where)
+	}
+	if _, err := t.DB.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to erase subject from %s! %s", t.Table, err.Error())
+	}
+	return nil
+}
+
+//A ChangeEraser erases a subject from a handler or sink maintaining data derived from a table, ie: a SearchIndexer, a CacheWarmer or a TombstoneSink,
+//by handing it a DELETE change event for the subject's row, so it removes whatever it derived from the row as if the row had been deleted
+type ChangeEraser struct {
+	//Handler receives the change event
+	Handler Handler
+	//Sink receives the change event instead of Handler, through Delete if it is a TombstoneSink
+	Sink Sink
+	//Schema and Table are the table the subject's row is in
+	Schema string
+	Table  string
+	//Column is the row's key column, see KeyRegistry
+	Column string
+	//Key names the request's identifier the row is keyed by, see ErasureRequest.Key. Defaults to its Subject. Requests without the key erase nothing
+	Key string
+}
+
+//Name returns the eraser's name
+func (c *ChangeEraser) Name() string {
+	switch {
+	case c.Sink != nil:
+		return "change:" + c.Sink.Name()
+	case c.Handler != nil:
+		if named, ok := c.Handler.(Named); ok {
+			return "change:" + named.Name()
+		}
+	}
+	return "change:" + c.Table
+}
+
+//Erase hands the subject's row's DELETE change event to the handler or sink
+func (c *ChangeEraser) Erase(ctx context.Context, request ErasureRequest) error {
+	if (c.Handler == nil && c.Sink == nil) || c.Table == "" || c.Column == "" {
+		return errors.New("change eraser requires a handler or sink, table and column")
+	}
+	value, ok := request.Key(c.Key)
+	if !ok {
+		return nil
+	}
+	e := &ChangeEvent{Schema: c.Schema, Table: c.Table, Op: OpDelete, Old: Row{c.Column: value}}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n := &pq.Notification{Extra: string(payload)}
+	switch {
+	case c.Sink != nil:
+		if tombstones, ok := c.Sink.(TombstoneSink); ok {
+			return tombstones.Delete(ctx, n, e)
+		}
+		return c.Sink.Send(ctx, n)
+	default:
+		if h, ok := c.Handler.(ContextHandler); ok {
+			return h.ProcessContext(ctx, n)
+		}
+		return c.Handler.Process(n)
+	}
+}
+
+//An ErasureStore records which erasers have completed each erasure request, so a redelivered request only retries those that failed, and completed
+//requests can be evidenced. It records request ids and eraser names only, never the subject
+type ErasureStore interface {
+	Completed(ctx context.Context, id string) (map[string]bool, error)
+	Complete(ctx context.Context, id string, eraser string, at time.Time) error
+}
+
+//An ErasureReport describes an erasure request every eraser has completed
+type ErasureReport struct {
+	Request ErasureRequest `json:"request"`
+	//Erased are the erasers that completed the request on this delivery
+	Erased []string `json:"erased"`
+	//Resumed are the erasers that completed it on an earlier delivery
+	Resumed     []string  `json:"resumed,omitempty"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+//An ErasureHandler is a Handler propagating erasure requests through an event fan out: for each request it receives it runs every eraser, ie: deleting
+//the subject from a search index, cache and archive, recording each one's completion in Store. A request any eraser failed is returned as an error, to be
+//retried, ie: by the client's retries or DeadLetters, and on redelivery only the erasers that haven't completed run again. Once all have, OnComplete is called
+type ErasureHandler struct {
+	Erasers []Eraser
+	//Store records completion. Defaults to recording none, so every delivery runs every eraser
+	Store ErasureStore
+	//OnComplete is called with a report once every eraser has completed a request, ie: to notify the subject or record evidence of the erasure
+	OnComplete func(report ErasureReport)
+	//Clock is the source of completion times. Defaults to SystemClock
+	Clock Clock
+}
+
+//Name returns the handler's name
+func (h *ErasureHandler) Name() string {
+	return "erasure"
+}
+
+//Process erases the subject of an erasure request
+func (h *ErasureHandler) Process(notification *pq.Notification) error {
+	return h.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext erases the subject of an erasure request from every eraser that hasn't completed it
+func (h *ErasureHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	request, err := ParseErasureRequest(notification)
+	if err != nil {
+		return err
+	}
+	if skipDryRun(ctx, h.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	completed := map[string]bool{}
+	if h.Store != nil {
+		if completed, err = h.Store.Completed(ctx, request.ID); err != nil {
+			return fmt.Errorf("failed to read completion of erasure request %s! %s", request.ID, err.Error())
+		}
+	}
+	clock := clockOr(h.Clock)
+	report := ErasureReport{Request: request}
+	var errs []error
+	for _, eraser := range h.Erasers {
+		name := eraser.Name()
+		if completed[name] {
+			report.Resumed = append(report.Resumed, name)
+			continue
+		}
+		if err := eraser.Erase(ctx, request); err != nil {
+			errs = append(errs, fmt.Errorf("failed to erase request %s with %s! %s", request.ID, name, err.Error()))
+			continue
+		}
+		if h.Store != nil {
+			if err := h.Store.Complete(ctx, request.ID, name, clock.Now()); err != nil {
+				errs = append(errs, fmt.Errorf("failed to record completion of erasure request %s by %s! %s", request.ID, name, err.Error()))
+				continue
+			}
+		}
+		report.Erased = append(report.Erased, name)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	report.CompletedAt = clock.Now()
+	if h.OnComplete != nil {
+		h.OnComplete(report)
+	}
+	return nil
+}
+
+//ErasureTable is an ErasureStore in a postgres table
+type ErasureTable struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified table. Defaults to pqstream_erasures
+	Table string
+}
+
+func (t *ErasureTable) table() string {
+	if t.Table == "" {
+		return "pqstream_erasures"
+	}
+	return t.Table
+}
+
+//Setup creates the table if it doesn't exist
+func (t *ErasureTable) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if t.DB == nil {
+		return errors.New("erasure table requires a db")
+	}
+	if _, err := t.DB.ExecContext(ctx, t.ddl()); err != nil {
+		return fmt.Errorf("failed to create erasure table! %s", err.Error())
+	}
+	return nil
+}
+
+func (t *ErasureTable) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	request_id text NOT NULL,
+	eraser text NOT NULL,
+	completed_at timestamptz NOT NULL,
+	PRIMARY KEY (request_id, eraser)
+)`, quoteQualified(t.table()))
+}
+
+//Completed returns the erasers that have completed a request
+func (t *ErasureTable) Completed(ctx context.Context, id string) (map[string]bool, error) {
+	rows, err := t.DB.QueryContext(ctx, fmt.Sprintf("SELECT eraser FROM %s WHERE request_id = $1", quoteQualified(t.table())), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	completed := map[string]bool{}
+	for rows.Next() {
+		var eraser string
+		if err := rows.Scan(&eraser); err != nil {
+			return nil, err
+		}
+		completed[eraser] = true
+	}
+	return completed, rows.Err()
+}
+
+//Complete records an eraser completing a request
+func (t *ErasureTable) Complete(ctx context.Context, id string, eraser string, at time.Time) error {
+	_, err := t.DB.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (request_id, eraser, completed_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		quoteQualified(t.table())), id, eraser, at)
+	return err
+}
+
+//MemoryErasures is an in memory ErasureStore, for tests and single process deployments
+type MemoryErasures struct {
+	mu        sync.Mutex
+	completed map[string]map[string]time.Time
+}
+
+//Completed returns the erasers that have completed a request
+func (m *MemoryErasures) Completed(ctx context.Context, id string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	completed := map[string]bool{}
+	for eraser := range m.completed[id] {
+		completed[eraser] = true
+	}
+	return completed, nil
+}
+
+//Complete records an eraser completing a request
+func (m *MemoryErasures) Complete(ctx context.Context, id string, eraser string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.completed == nil {
+		m.completed = map[string]map[string]time.Time{}
+	}
+	if m.completed[id] == nil {
+		m.completed[id] = map[string]time.Time{}
+	}
+	if _, ok := m.completed[id][eraser]; !ok {
+		m.completed[id][eraser] = at
+	}
+	return nil
+}
+
+//Requests returns the ids of the requests any eraser has completed, sorted
+func (m *MemoryErasures) Requests() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.completed))
+	for id := range m.completed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,114 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErasureRequest(t *testing.T) {
+	r, err := pqstream.ParseErasureRequest(&pq.Notification{Extra: `{"v": 1, "id": "env-1", "data": {"id": "req-1", "subject": "42", "keys": {"email": "a@b.c"}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != "req-1" || r.Subject != "42" || r.Keys["email"] != "a@b.c" {
+		t.Fatalf("unexpected request: %+v", r)
+	}
+	if _, err := pqstream.ParseErasureRequest(&pq.Notification{Extra: `{"subject": "42"}`}); err == nil {
+		t.Fatal("expected a request without an id to fail")
+	}
+	if _, err := pqstream.ParseErasureRequest(&pq.Notification{Extra: `{"id": "req-1"}`}); err == nil {
+		t.Fatal("expected a request without a subject to fail")
+	}
+}
+
+func TestTableEraser(t *testing.T) {
+	db := &execRecorder{}
+	request := pqstream.ErasureRequest{ID: "req-1", Subject: "42", Keys: map[string]string{"email": "a@b.c"}}
+	for _, eraser := range []*pqstream.TableEraser{
+		{DB: db, Table: "public.orders", Column: "user_id"},
+		{DB: db, Table: "users", Column: "id", Anonymize: map[string]any{"name": "erased", "email": nil}},
+		{DB: db, Table: "pqstream_audit", Condition: "payload::jsonb->>'email' = $1", Key: "email"},
+		{DB: db, Table: "profiles", Column: "phone", Key: "phone"},
+	} {
+		if err := eraser.Erase(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		`DELETE FROM "public"."orders" WHERE "user_id" = $1`,
+		`UPDATE "users" SET "email" = $2, "name" = $3 WHERE "id" = $1`,
+		`DELETE FROM "pqstream_audit" WHERE payload::jsonb->>'email' = $1`,
+	}
+	if !reflect.DeepEqual(db.queries, expected) {
+		t.Fatalf("unexpected queries: %q", db.queries)
+	}
+	if !reflect.DeepEqual(db.args[1], []interface{}{"42", nil, "erased"}) || db.args[2][0] != "a@b.c" {
+		t.Fatalf("unexpected args: %v", db.args)
+	}
+}
+
+func TestErasureHandler(t *testing.T) {
+	cache := &pqstream.MemoryCache{}
+	warmer := &pqstream.CacheWarmer{Cache: cache, Keys: pqstream.NewKeyRegistry().Register("users", "id")}
+	if err := warmer.Process(&pq.Notification{Extra: `{"schema": "public", "table": "users", "op": "INSERT", "new": {"id": "42", "name": "ann"}}`}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("public.users:42"); !ok {
+		t.Fatal("expected the row to be cached")
+	}
+	db := &execRecorder{}
+	failing := true
+	archiveRuns := 0
+	archive := pqstream.NewEraser("archive", func(ctx context.Context, request pqstream.ErasureRequest) error {
+		archiveRuns++
+		if failing {
+			return errors.New("archive unavailable")
+		}
+		return nil
+	})
+	var reports []pqstream.ErasureReport
+	store := &pqstream.MemoryErasures{}
+	h := &pqstream.ErasureHandler{
+		Erasers: []pqstream.Eraser{
+			&pqstream.TableEraser{DB: db, Table: "orders", Column: "user_id"},
+			&pqstream.ChangeEraser{Handler: warmer, Schema: "public", Table: "users", Column: "id"},
+			archive,
+		},
+		Store:      store,
+		OnComplete: func(report pqstream.ErasureReport) { reports = append(reports, report) },
+	}
+	request := &pq.Notification{Channel: "erasures", Extra: `{"id": "req-1", "subject": "42"}`}
+	err := h.Process(request)
+	if err == nil || !strings.Contains(err.Error(), "archive unavailable") {
+		t.Fatalf("expected the archive's failure, got %v", err)
+	}
+	if _, ok := cache.Get("public.users:42"); ok {
+		t.Fatal("expected the cached row to be erased")
+	}
+	if len(db.queries) != 1 || len(reports) != 0 {
+		t.Fatalf("unexpected queries %q and reports %v", db.queries, reports)
+	}
+	failing = false
+	if err := h.Process(request); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.queries) != 1 || archiveRuns != 2 {
+		t.Fatalf("expected only the failed eraser to run again, got queries %q and %d archive runs", db.queries, archiveRuns)
+	}
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0].Erased, []string{"archive"}) ||
+		!reflect.DeepEqual(reports[0].Resumed, []string{"table:orders", "change:cache_warmer"}) {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	completed, _ := store.Completed(context.Background(), "req-1")
+	if len(completed) != 3 || !reflect.DeepEqual(store.Requests(), []string{"req-1"}) {
+		t.Fatalf("unexpected completion: %v", completed)
+	}
+	if err := h.Process(&pq.Notification{Extra: `{"subject": "42"}`}); err == nil {
+		t.Fatal("expected an invalid request to fail")
+	}
+}
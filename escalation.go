@@ -0,0 +1,336 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaultEscalationRetries is the number of times a handler is retried when EscalationPolicy.Retries is unset
+const defaultEscalationRetries = 3
+
+//defaultEscalationRetryInterval is the first delay between handler retries when EscalationPolicy.RetryInterval is unset
+const defaultEscalationRetryInterval = 100 * time.Millisecond
+
+//defaultEscalationPause is how long a channel is paused when EscalationPolicy.PauseFor is unset
+const defaultEscalationPause = 30 * time.Second
+
+//ErrorClass is the kind of failure an error represents, which decides how an EscalationPolicy handles it
+type ErrorClass string
+
+const (
+	//ErrorTransient is a failure expected to clear by itself, ie: a dropped connection, a deadlock or a saturated downstream
+	ErrorTransient ErrorClass = "transient"
+	//ErrorPermanent is a failure that retrying won't fix, ie: a malformed payload or a rejected request
+	ErrorPermanent ErrorClass = "permanent"
+	//ErrorConfig is a failure caused by the deployment, ie: bad credentials, missing privileges or a missing database, that needs an operator
+	ErrorConfig ErrorClass = "config"
+)
+
+//ClassifyError returns the class of an error from its postgres error code or type. Errors it doesn't recognize are permanent
+func ClassifyError(err error) ErrorClass {
+	var (
+		pqErr     *pq.Error
+		preflight *PreflightError
+		netErr    net.Error
+	)
+	switch {
+	case errors.As(err, &pqErr):
+		switch {
+		case pqErr.Code.Class() == "28", pqErr.Code == "42501", pqErr.Code.Class() == "3D":
+			return ErrorConfig
+		case pqErr.Code.Class() == "08", pqErr.Code.Class() == "40", pqErr.Code.Class() == "53", pqErr.Code.Class() == "57", pqErr.Code == "55P03":
+			return ErrorTransient
+		}
+		return ErrorPermanent
+	case errors.As(err, &preflight), errors.Is(err, ErrReadOnly):
+		return ErrorConfig
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, ErrBulkheadFull), errors.Is(err, ErrBackfillBufferFull):
+		return ErrorTransient
+	}
+	var reconnect *ReconnectError
+	if errors.As(err, &reconnect) {
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
+
+//EscalationAction is what an EscalationPolicy does with an error of a given class
+type EscalationAction string
+
+const (
+	//ActionReport passes the error to the ErrorHandler
+	ActionReport EscalationAction = "report"
+	//ActionRetry runs a failed handler again, backing off between attempts, before the other actions are taken. On its own, the error is reported once the retries are exhausted
+	ActionRetry EscalationAction = "retry"
+	//ActionPause holds back the channel's next notifications for EscalationPolicy.PauseFor
+	ActionPause EscalationAction = "pause"
+	//ActionAlert sends the error to EscalationPolicy.Alert, ie: a WebhookSink paging the on-call
+	ActionAlert EscalationAction = "alert"
+	//ActionCrash stops the client, so Run returns the error
+	ActionCrash EscalationAction = "crash"
+)
+
+//An EscalationPolicy classifies the client's errors and applies the actions configured for each class. Classes without actions are reported to the ErrorHandler,
+//as every error is without a policy
+type EscalationPolicy struct {
+	//Classify returns an error's class. Defaults to ClassifyError
+	Classify func(err error) ErrorClass
+	//Actions are applied, in order, to errors of each class, ie: {ErrorTransient: {ActionRetry, ActionReport}, ErrorConfig: {ActionAlert, ActionCrash}}. See ParseEscalation
+	Actions map[ErrorClass][]EscalationAction
+	//Retries is the number of times ActionRetry runs a failed handler again. Defaults to 3
+	Retries int
+	//RetryInterval is the delay before the first retry, doubling with each attempt. Defaults to 100ms
+	RetryInterval time.Duration
+	//PauseFor is how long ActionPause holds back a channel. Defaults to 30s
+	PauseFor time.Duration
+	//Alert receives an EscalationAlert, encoded as JSON, on the failing channel for ActionAlert
+	Alert Sink
+}
+
+//An EscalationAlert is the payload sent to EscalationPolicy.Alert
+type EscalationAlert struct {
+	Class      ErrorClass `json:"class"`
+	Channel    string     `json:"channel"`
+	Error      string     `json:"error"`
+	InstanceID string     `json:"instance_id"`
+	Time       time.Time  `json:"time"`
+}
+
+//ParseEscalation parses the actions of an EscalationPolicy from a declarative spec naming each class's actions in order, ie: from an environment variable:
+//"transient=retry,report; permanent=report; config=alert,crash"
+func ParseEscalation(spec string) (map[ErrorClass][]EscalationAction, error) {
+	actions := map[ErrorClass][]EscalationAction{}
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		class, list, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid escalation rule: %s", rule)
+		}
+		c := ErrorClass(strings.TrimSpace(class))
+		switch c {
+		case ErrorTransient, ErrorPermanent, ErrorConfig:
+		default:
+			return nil, fmt.Errorf("unknown error class: %s", c)
+		}
+		for _, name := range strings.Split(list, ",") {
+			a := EscalationAction(strings.TrimSpace(name))
+			switch a {
+			case ActionReport, ActionRetry, ActionPause, ActionAlert, ActionCrash:
+			default:
+				return nil, fmt.Errorf("unknown escalation action: %s", a)
+			}
+			actions[c] = append(actions[c], a)
+		}
+	}
+	return actions, nil
+}
+
+func (p *EscalationPolicy) classify(err error) ErrorClass {
+	if p.Classify != nil {
+		return p.Classify(err)
+	}
+	return ClassifyError(err)
+}
+
+func (p *EscalationPolicy) actions(class ErrorClass) []EscalationAction {
+	if actions := p.Actions[class]; len(actions) > 0 {
+		return actions
+	}
+	return []EscalationAction{ActionReport}
+}
+
+func (p *EscalationPolicy) has(class ErrorClass, action EscalationAction) bool {
+	for _, a := range p.actions(class) {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *EscalationPolicy) retries() int {
+	if p.Retries <= 0 {
+		return defaultEscalationRetries
+	}
+	return p.Retries
+}
+
+func (p *EscalationPolicy) pauseFor() time.Duration {
+	if p.PauseFor <= 0 {
+		return defaultEscalationPause
+	}
+	return p.PauseFor
+}
+
+//escalation tracks the channels an EscalationPolicy, or Pause, paused. wake is closed to release the lanes waiting on a pause that was lifted early
+type escalation struct {
+	mu     sync.Mutex
+	paused map[string]time.Time
+	wake   chan struct{}
+}
+
+//retryHandler runs a failed handler again while the policy retries its error's class, returning the last error
+func (c *Client) retryHandler(channel string, err error, invoke func() error) error {
+	policy := c.config.Escalation
+	if policy == nil || err == nil || c.atMostOnce() || !policy.has(policy.classify(err), ActionRetry) {
+		return err
+	}
+	interval := policy.RetryInterval
+	if interval <= 0 {
+		interval = defaultEscalationRetryInterval
+	}
+	for attempt := 0; attempt < policy.retries() && err != nil; attempt++ {
+		select {
+		case <-c.lifecycle.stopping:
+			return err
+		case <-c.config.Clock.After(interval):
+		}
+		interval *= 2
+		c.debugf(channel, "retrying handler after error: %s", err.Error())
+		err = invoke()
+	}
+	return err
+}
+
+//escalate applies the policy's actions to an error on a channel. An error whose class only retries is reported once its retries are exhausted
+func (c *Client) escalate(channel string, err error) {
+	policy := c.config.Escalation
+	class := policy.classify(err)
+	handled := false
+	for _, action := range policy.actions(class) {
+		handled = handled || action != ActionRetry
+		switch action {
+		case ActionReport:
+			c.handlers.ErrorHandler(err)
+		case ActionPause:
+			c.pause(channel, policy.pauseFor())
+		case ActionAlert:
+			c.alert(policy, class, channel, err)
+		case ActionCrash:
+			c.crash(fmt.Errorf("stopping on %s error! %w", class, err))
+		}
+	}
+	if !handled {
+		c.handlers.ErrorHandler(err)
+	}
+}
+
+func (c *Client) alert(policy *EscalationPolicy, class ErrorClass, channel string, err error) {
+	if policy.Alert == nil {
+		c.handlers.ErrorHandler(fmt.Errorf("no alert sink for %s error! %s", class, err.Error()))
+		return
+	}
+	payload, _ := json.Marshal(EscalationAlert{Class: class, Channel: channel, Error: err.Error(), InstanceID: c.config.InstanceID, Time: c.config.Clock.Now()})
+	if sendErr := policy.Alert.Send(context.Background(), &pq.Notification{Channel: channel, Extra: string(payload)}); sendErr != nil {
+		c.handlers.ErrorHandler(fmt.Errorf("failed to send alert to %s! %s", policy.Alert.Name(), sendErr.Error()))
+	}
+}
+
+//pause holds back a channel's notifications until the pause ends, extending a pause already in progress
+func (c *Client) pause(channel string, d time.Duration) {
+	c.escalation.mu.Lock()
+	defer c.escalation.mu.Unlock()
+	if c.escalation.paused == nil {
+		c.escalation.paused = map[string]time.Time{}
+	}
+	until := c.config.Clock.Now().Add(d)
+	if until.After(c.escalation.paused[channel]) {
+		c.escalation.paused[channel] = until
+	}
+	if c.config.Verbose {
+		c.logf("pausing channel: %s until %s", channel, until.Format(time.RFC3339))
+	}
+}
+
+//Pause holds back a channel's notifications for a duration, as ActionPause does. Notifications keep being received and queued, see Config.Overflow
+func (c *Client) Pause(channel string, d time.Duration) {
+	c.pause(channel, d)
+}
+
+//Resume lifts a channel's pause, releasing its held back notifications
+func (c *Client) Resume(channel string) {
+	c.escalation.mu.Lock()
+	defer c.escalation.mu.Unlock()
+	if _, ok := c.escalation.paused[channel]; !ok {
+		return
+	}
+	delete(c.escalation.paused, channel)
+	if c.escalation.wake != nil {
+		close(c.escalation.wake)
+		c.escalation.wake = nil
+	}
+	if c.config.Verbose {
+		c.logf("resuming channel: %s", channel)
+	}
+}
+
+//Paused returns the channels an EscalationPolicy has paused and when each pause ends
+func (c *Client) Paused() map[string]time.Time {
+	c.escalation.mu.Lock()
+	defer c.escalation.mu.Unlock()
+	now := c.config.Clock.Now()
+	out := map[string]time.Time{}
+	for ch, until := range c.escalation.paused {
+		if until.After(now) {
+			out[ch] = until
+		}
+	}
+	return out
+}
+
+//waitPaused blocks a channel's lane until its pause ends or the client stops
+func (c *Client) waitPaused(channel string) {
+	for {
+		c.escalation.mu.Lock()
+		until, ok := c.escalation.paused[channel]
+		if ok && !until.After(c.config.Clock.Now()) {
+			delete(c.escalation.paused, channel)
+			ok = false
+		}
+		if ok && c.escalation.wake == nil {
+			c.escalation.wake = make(chan struct{})
+		}
+		wake := c.escalation.wake
+		c.escalation.mu.Unlock()
+		if !ok {
+			return
+		}
+		select {
+		case <-c.lifecycle.stopping:
+			return
+		case <-wake:
+		case <-c.config.Clock.After(until.Sub(c.config.Clock.Now())):
+		}
+	}
+}
+
+//String returns the policy's actions in the format ParseEscalation reads
+func (p *EscalationPolicy) String() string {
+	classes := make([]string, 0, len(p.Actions))
+	for class := range p.Actions {
+		classes = append(classes, string(class))
+	}
+	sort.Strings(classes)
+	rules := make([]string, len(classes))
+	for i, class := range classes {
+		actions := make([]string, len(p.Actions[ErrorClass(class)]))
+		for j, a := range p.Actions[ErrorClass(class)] {
+			actions[j] = string(a)
+		}
+		rules[i] = class + "=" + strings.Join(actions, ",")
+	}
+	return strings.Join(rules, "; ")
+}
@@ -0,0 +1,213 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want pqstream.ErrorClass
+	}{
+		{&pq.Error{Code: "28P01"}, pqstream.ErrorConfig},
+		{fmt.Errorf("failed to listen! %w", &pq.Error{Code: "42501"}), pqstream.ErrorConfig},
+		{&pq.Error{Code: "40P01"}, pqstream.ErrorTransient},
+		{&pq.Error{Code: "08006"}, pqstream.ErrorTransient},
+		{&pq.Error{Code: "23505"}, pqstream.ErrorPermanent},
+		{&pqstream.PreflightError{Role: "app"}, pqstream.ErrorConfig},
+		{&pqstream.ReconnectError{Err: errors.New("connection reset")}, pqstream.ErrorTransient},
+		{context.DeadlineExceeded, pqstream.ErrorTransient},
+		{pqstream.ErrBulkheadFull, pqstream.ErrorTransient},
+		{errors.New("bad payload"), pqstream.ErrorPermanent},
+	} {
+		if got := pqstream.ClassifyError(tt.err); got != tt.want {
+			t.Errorf("ClassifyError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseEscalation(t *testing.T) {
+	actions, err := pqstream.ParseEscalation("transient=retry,report; config = alert, crash")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	policy := &pqstream.EscalationPolicy{Actions: actions}
+	if got := policy.String(); got != "config=alert,crash; transient=retry,report" {
+		t.Fatalf("unexpected actions: %s", got)
+	}
+	for _, spec := range []string{"transient", "fatal=report", "config=explode"} {
+		if _, err := pqstream.ParseEscalation(spec); err == nil {
+			t.Fatalf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestEscalationPolicy(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	var (
+		reported []error
+		alerts   []pqstream.EscalationAlert
+		attempts int
+	)
+	alert := pqstream.NewSink("pager", func(ctx context.Context, n *pq.Notification) error {
+		var a pqstream.EscalationAlert
+		if err := json.Unmarshal([]byte(n.Extra), &a); err != nil {
+			return err
+		}
+		alerts = append(alerts, a)
+		return nil
+	})
+	handler := pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		switch n.Channel {
+		case "flaky":
+			attempts++
+			if attempts < 2 {
+				return &pq.Error{Code: "40001"}
+			}
+			return nil
+		case "denied":
+			return &pq.Error{Code: "42501", Message: "permission denied"}
+		}
+		return errors.New("bad payload")
+	})
+	handlerSet := &pqstream.HandlerSet{
+		Handlers:     []pqstream.Handler{handler},
+		ErrorHandler: func(err error) { reported = append(reported, err) },
+	}
+	config := &pqstream.Config{Clock: clock, Escalation: &pqstream.EscalationPolicy{
+		Actions: map[pqstream.ErrorClass][]pqstream.EscalationAction{
+			pqstream.ErrorTransient: {pqstream.ActionRetry, pqstream.ActionReport},
+			pqstream.ErrorPermanent: {pqstream.ActionPause},
+			pqstream.ErrorConfig:    {pqstream.ActionAlert, pqstream.ActionCrash},
+		},
+		RetryInterval: time.Millisecond,
+		PauseFor:      time.Minute,
+		Alert:         alert,
+	}}
+	client, err := pqstream.NewClient([]string{"flaky", "broken", "denied"}, config, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Process(&pq.Notification{Channel: "flaky"})
+	}()
+	for {
+		select {
+		case <-done:
+		default:
+			clock.Advance(time.Millisecond)
+			continue
+		}
+		break
+	}
+	if attempts != 2 || len(reported) != 0 {
+		t.Fatalf("expected the transient error to be retried away, got %d attempts and %v", attempts, reported)
+	}
+
+	client.Process(&pq.Notification{Channel: "broken"})
+	if until, ok := client.Paused()["broken"]; !ok || !until.Equal(clock.Now().Add(time.Minute)) || len(reported) != 0 {
+		t.Fatalf("expected the permanent error to pause its channel without reporting it, got %v %v", client.Paused(), reported)
+	}
+	clock.Advance(2 * time.Minute)
+	if len(client.Paused()) != 0 {
+		t.Fatal("expected the pause to end")
+	}
+
+	client.Process(&pq.Notification{Channel: "denied"})
+	if len(alerts) != 1 || alerts[0].Class != pqstream.ErrorConfig || alerts[0].Channel != "denied" {
+		t.Fatalf("expected the config error to alert, got: %+v", alerts)
+	}
+	if err := client.Run(context.Background()); err != pqstream.ErrClientStopped {
+		t.Fatalf("expected the config error to stop the client, got: %v", err)
+	}
+}
+
+func TestEscalationRetryOnlyReports(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	var reported []error
+	attempts := 0
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+			attempts++
+			return &pq.Error{Code: "40001"}
+		})},
+		ErrorHandler: func(err error) { reported = append(reported, err) },
+	}
+	config := &pqstream.Config{Clock: clock, Escalation: &pqstream.EscalationPolicy{
+		Actions:       map[pqstream.ErrorClass][]pqstream.EscalationAction{pqstream.ErrorTransient: {pqstream.ActionRetry}},
+		Retries:       2,
+		RetryInterval: time.Millisecond,
+	}}
+	client, err := pqstream.NewClient([]string{"flaky"}, config, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Process(&pq.Notification{Channel: "flaky"})
+	}()
+	for {
+		select {
+		case <-done:
+		default:
+			clock.Advance(time.Millisecond)
+			continue
+		}
+		break
+	}
+	if attempts != 3 || len(reported) != 1 {
+		t.Fatalf("expected the error to be reported once its retries were exhausted, got %d attempts and %v", attempts, reported)
+	}
+}
+
+func TestEscalationThroughMux(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	var reported []error
+	attempts := 0
+	mux := pqstream.NewMux()
+	mux.Handle("flaky", pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		attempts++
+		return &pq.Error{Code: "40001"}
+	}))
+	handlerSet := &pqstream.HandlerSet{
+		Handlers:     []pqstream.Handler{mux},
+		ErrorHandler: func(err error) { reported = append(reported, err) },
+	}
+	config := &pqstream.Config{Clock: clock, Escalation: &pqstream.EscalationPolicy{
+		Actions:       map[pqstream.ErrorClass][]pqstream.EscalationAction{pqstream.ErrorTransient: {pqstream.ActionRetry}},
+		Retries:       2,
+		RetryInterval: time.Millisecond,
+	}}
+	client, err := pqstream.NewClient([]string{"flaky"}, config, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Process(&pq.Notification{Channel: "flaky"})
+	}()
+	for {
+		select {
+		case <-done:
+		default:
+			clock.Advance(time.Millisecond)
+			continue
+		}
+		break
+	}
+	if attempts != 3 || len(reported) != 1 {
+		t.Fatalf("expected the error behind the mux to keep its class and be retried, got %d attempts and %v", attempts, reported)
+	}
+}
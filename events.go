@@ -0,0 +1,96 @@
+package pqstream
+
+import (
+	"sync"
+	"time"
+)
+
+//defaultEventBuffer is the number of events a subscription holds when Events is called with a buffer of zero
+const defaultEventBuffer = 64
+
+//EventType is the kind of a lifecycle Event
+type EventType string
+
+const (
+	//EventChannelUp is published when a channel's listener starts listening, including after a reconnect
+	EventChannelUp EventType = "channel_up"
+	//EventChannelDown is published when a channel's listener stops listening because it disconnected, failed or was closed
+	EventChannelDown EventType = "channel_down"
+	//EventHandlerFailed is published when a handler returns an error
+	EventHandlerFailed EventType = "handler_failed"
+	//EventCheckpointAdvanced is published when a durable client checkpoints an outbox row
+	EventCheckpointAdvanced EventType = "checkpoint_advanced"
+	//EventHandlerSlow is published when a handler exceeds its slow handler threshold, at most once a second per handler
+	EventHandlerSlow EventType = "handler_slow"
+	//EventDeadLettered is published when a notification its handlers failed on is stored as a dead letter
+	EventDeadLettered EventType = "dead_lettered"
+	//EventQuarantined is published when a poison notification is quarantined
+	EventQuarantined EventType = "quarantined"
+	//EventTerminated is published when the server terminates the listener's backend, with the server's message as its Error, before it listens again
+	EventTerminated EventType = "terminated"
+)
+
+//An Event is a typed change in a client's lifecycle, for applications embedding the client to build dashboards or UIs on. State is the channel's listener state
+//for channel events, Handler and Error describe a HandlerFailed event, Handler and Duration a HandlerSlow one and Position is the checkpoint of a CheckpointAdvanced one,
+//or the id of a DeadLettered or Quarantined one's dead letter
+type Event struct {
+	Type     EventType     `json:"type"`
+	Channel  string        `json:"channel"`
+	Time     time.Time     `json:"time"`
+	State    ConnState     `json:"state,omitempty"`
+	Handler  string        `json:"handler,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Position int64         `json:"position,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+type events struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+//Events returns a channel receiving the client's lifecycle events, holding up to buffer of them. Events never block the client: they are dropped while a
+//subscriber's buffer is full. The returned func cancels the subscription and closes the channel
+func (c *Client) Events(buffer int) (<-chan Event, func()) {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	out := make(chan Event, buffer)
+	c.events.mu.Lock()
+	if c.events.subscribers == nil {
+		c.events.subscribers = map[chan Event]struct{}{}
+	}
+	c.events.subscribers[out] = struct{}{}
+	c.events.mu.Unlock()
+	return out, func() {
+		c.events.mu.Lock()
+		defer c.events.mu.Unlock()
+		if _, ok := c.events.subscribers[out]; ok {
+			delete(c.events.subscribers, out)
+			close(out)
+		}
+	}
+}
+
+//publish sends an event to every subscriber with room for it
+func (e *events) publish(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for out := range e.subscribers {
+		select {
+		case out <- event:
+		default:
+		}
+	}
+}
+
+//publishState publishes a channel event for a listener moving into or out of ConnListening
+func (c *Client) publishState(channel string, from, to ConnState) {
+	switch {
+	case from == to:
+	case to == ConnListening:
+		c.events.publish(Event{Type: EventChannelUp, Channel: channel, Time: c.config.Clock.Now(), State: to})
+	case from == ConnListening:
+		c.events.publish(Event{Type: EventChannelDown, Channel: channel, Time: c.config.Clock.Now(), State: to})
+	}
+}
@@ -0,0 +1,36 @@
+package pqstream_test
+
+import (
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestEventsHandlerFailed(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers:     []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return errors.New("boom") })},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	events, cancel := client.Events(1)
+	client.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	client.Process(&pq.Notification{Channel: "users", Extra: "2"})
+	event := <-events
+	if event.Type != pqstream.EventHandlerFailed || event.Channel != "users" || event.Error != "boom" || event.Handler == "" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("expected events past the buffer to be dropped, got: %+v", event)
+	default:
+	}
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expected cancel to close the events channel")
+	}
+}
@@ -0,0 +1,160 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"net"
+	"time"
+)
+
+//defaultFailoverInterval is how often the failover watcher checks the server when Config.FailoverInterval is unset
+const defaultFailoverInterval = 10 * time.Second
+
+//A Failover records the client moving to a new primary, either because its server entered recovery or because it became unreachable while another host was promoted
+type Failover struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+//FailoverHandlerFunc is called when the client detects a failover, before it reconnects to the new primary
+type FailoverHandlerFunc func(failover Failover)
+
+//Host returns the host:port the client is connected, or last connected, to
+func (c *Client) Host() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.host
+}
+
+func (c *Client) setHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.host = host
+}
+
+//watchesFailover reports whether the client should watch its server for failovers
+func (c *Client) watchesFailover() bool {
+	return len(c.config.Hosts) > 0 || c.handlers.FailoverHandler != nil
+}
+
+//candidates returns every host:port of the cluster in the order they're tried: Host first, then Hosts
+func (c *Config) candidates() []string {
+	candidates := []string{net.JoinHostPort(c.Host, c.Port)}
+	for _, h := range c.Hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, c.Port)
+		}
+		candidates = append(candidates, h)
+	}
+	return candidates
+}
+
+//forHost returns a copy of the config connecting to a host:port
+func (c *Config) forHost(hostport string) *Config {
+	config := *c
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		config.Host, config.Port = host, port
+	}
+	return &config
+}
+
+//initialHost returns the first primary among the configured hosts, or Host itself when no alternates are configured
+func (c *Client) initialHost() (string, error) {
+	candidates := c.config.candidates()
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.failoverInterval())
+	defer cancel()
+	return c.findPrimary(ctx, "")
+}
+
+func (c *Client) failoverInterval() time.Duration {
+	if c.config.FailoverInterval <= 0 {
+		return defaultFailoverInterval
+	}
+	return c.config.FailoverInterval
+}
+
+//findPrimary returns the first candidate host, other than skip, that accepts connections and isn't in recovery
+func (c *Client) findPrimary(ctx context.Context, skip string) (string, error) {
+	var errs []string
+	for _, host := range c.config.candidates() {
+		if host == skip {
+			continue
+		}
+		inRecovery, err := probeRecovery(ctx, c.config.forHost(host))
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s: %s", host, err.Error()))
+		case !inRecovery:
+			return host, nil
+		default:
+			errs = append(errs, fmt.Sprintf("%s: in recovery", host))
+		}
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no other hosts configured")
+	}
+	return "", fmt.Errorf("failed to find a primary! %v", errs)
+}
+
+func probeRecovery(ctx context.Context, config *Config) (bool, error) {
+	db, err := config.openDB("failover", config.ConnInfo())
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var inRecovery bool
+	err = db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	return inRecovery, err
+}
+
+//watchFailover periodically checks the server the client is listening through. When it enters recovery or stops answering and another host is a primary,
+//it reports the failover, calls HandlerSet.FailoverHandler and closes the listener so the client reconnects to the new primary
+func (c *Client) watchFailover(db *sql.DB, host string, listener *pq.Listener, done <-chan struct{}, failovers chan<- *Failover) {
+	interval := c.failoverInterval()
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.config.Clock.After(interval):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		var inRecovery bool
+		err := db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+		cancel()
+		if err == nil && !inRecovery {
+			continue
+		}
+		reason := "server entered recovery"
+		if err != nil {
+			reason = fmt.Sprintf("server unreachable: %s", err.Error())
+		}
+		//an unreachable server may have used up the probe's timeout, so the search gets its own
+		ctx, cancel = context.WithTimeout(context.Background(), interval)
+		next, ferr := c.findPrimary(ctx, host)
+		cancel()
+		if ferr != nil {
+			if c.config.Verbose {
+				c.logf("%s on %s, staying put: %s", reason, host, ferr.Error())
+			}
+			continue
+		}
+		failover := &Failover{From: host, To: next, Reason: reason, At: c.config.Clock.Now()}
+		if c.config.Verbose {
+			c.logf("failing over from %s to %s: %s", failover.From, failover.To, failover.Reason)
+		}
+		if c.handlers.FailoverHandler != nil {
+			c.handlers.FailoverHandler(*failover)
+		}
+		failovers <- failover
+		listener.Close()
+		return
+	}
+}
@@ -0,0 +1,34 @@
+package pqstream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailoverCandidates(t *testing.T) {
+	config := &Config{Host: "db-1", Port: "5433", Hosts: []string{"db-2", "10.0.0.3:6432", "[::1]:5432"}}
+	got := strings.Join(config.candidates(), ",")
+	if got != "db-1:5433,db-2:5433,10.0.0.3:6432,[::1]:5432" {
+		t.Fatalf("unexpected candidates: %s", got)
+	}
+	moved := config.forHost("10.0.0.3:6432")
+	if moved.Host != "10.0.0.3" || moved.Port != "6432" || config.Host != "db-1" {
+		t.Fatalf("expected a copy connecting to the new host, got %s:%s", moved.Host, moved.Port)
+	}
+	if !strings.Contains(moved.ConnInfo(), "host=10.0.0.3 port=6432") {
+		t.Fatalf("unexpected conn info: %s", moved.ConnInfo())
+	}
+
+	c := &Client{config: &Config{Host: "localhost", Port: "5432"}, handlers: &HandlerSet{}}
+	host, err := c.initialHost()
+	if err != nil || host != "localhost:5432" {
+		t.Fatalf("expected a single host to be used without probing, got %s %v", host, err)
+	}
+	if c.watchesFailover() {
+		t.Fatal("expected no failover watcher without alternate hosts or a handler")
+	}
+	c.handlers.FailoverHandler = func(Failover) {}
+	if !c.watchesFailover() {
+		t.Fatal("expected a failover handler to enable the watcher")
+	}
+}
@@ -0,0 +1,51 @@
+package pqstream
+
+import (
+	"fmt"
+)
+
+//defaultMaxReconnectAttempts is the number of failed reconnect attempts FailFastOnFatal tolerates when Config.MaxReconnectAttempts is unset
+const defaultMaxReconnectAttempts = 5
+
+//A FatalError is returned by Start and Run when Config.FailFastOnFatal stops the client on an unrecoverable condition
+type FatalError struct {
+	Reason string
+	Err    error
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("fatal: %s! %s", e.Reason, e.Err.Error())
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Client) maxReconnectAttempts() int {
+	if c.config.MaxReconnectAttempts <= 0 {
+		return defaultMaxReconnectAttempts
+	}
+	return c.config.MaxReconnectAttempts
+}
+
+//fatal reports whether an error is unrecoverable under FailFastOnFatal, ie: bad credentials or missing privileges, which retrying never fixes
+func (c *Client) fatal(err error) bool {
+	return c.config.FailFastOnFatal && err != nil && ClassifyError(err) == ErrorConfig
+}
+
+//checkListenerFatal stops a FailFastOnFatal client whose listener failed on an unrecoverable error or on too many reconnect attempts in a row
+func (c *Client) checkListenerFatal(states []ListenerState, err error) {
+	if !c.config.FailFastOnFatal || err == nil {
+		return
+	}
+	if c.fatal(err) {
+		c.crash(&FatalError{Reason: "listener connection refused", Err: err})
+		return
+	}
+	for _, s := range states {
+		if s.Attempts >= c.maxReconnectAttempts() {
+			c.crash(&FatalError{Reason: fmt.Sprintf("listener on channel: %s failed to reconnect %d times", s.Channel, s.Attempts), Err: err})
+			return
+		}
+	}
+}
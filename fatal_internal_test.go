@@ -0,0 +1,52 @@
+package pqstream
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestFailFastOnFatal(t *testing.T) {
+	newClient := func(failFast bool) *Client {
+		c, err := NewClient([]string{"users"}, &Config{FailFastOnFatal: failFast, MaxReconnectAttempts: 3}, &HandlerSet{
+			Handlers:     []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })},
+			ErrorHandler: func(err error) {},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		c.setState("users", ConnConnecting, nil)
+		return c
+	}
+	event := func(c *Client, e pq.ListenerEventType, err error) {
+		c.checkListenerFatal(c.onListenerEvent([]string{"users"}, e, err), err)
+	}
+
+	c := newClient(true)
+	event(c, pq.ListenerEventConnectionAttemptFailed, &pq.Error{Code: "28P01", Message: "password authentication failed"})
+	var fatal *FatalError
+	if !c.isStopping() || !errors.As(c.lifecycle.err, &fatal) {
+		t.Fatalf("expected an authentication failure to stop the client, got: %v", c.lifecycle.err)
+	}
+
+	c = newClient(true)
+	refused := errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		event(c, pq.ListenerEventConnectionAttemptFailed, refused)
+	}
+	if c.isStopping() {
+		t.Fatal("expected transient failures to be retried")
+	}
+	event(c, pq.ListenerEventConnectionAttemptFailed, refused)
+	if !c.isStopping() || !errors.Is(c.lifecycle.err, refused) {
+		t.Fatalf("expected repeated reconnect failures to stop the client, got: %v", c.lifecycle.err)
+	}
+
+	c = newClient(false)
+	for i := 0; i < 5; i++ {
+		event(c, pq.ListenerEventConnectionAttemptFailed, &pq.Error{Code: "28P01"})
+	}
+	if c.isStopping() {
+		t.Fatal("expected a client without FailFastOnFatal to keep retrying")
+	}
+}
@@ -0,0 +1,237 @@
+package pqstream
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//FileFormat is the encoding a FileSink writes
+type FileFormat int
+
+const (
+	//NDJSON writes one JSON Record per line, or one line per notification encoded with FileSinkOptions.Marshaler
+	NDJSON FileFormat = iota
+	//CSV writes a header row followed by one Record per row
+	CSV
+)
+
+//Record is the portable representation of a notification written to and read from files
+type Record struct {
+	Channel    string    `json:"channel"`
+	PID        int       `json:"pid"`
+	Payload    string    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+//NewRecord captures a notification as a Record received at the given time
+func NewRecord(notification *pq.Notification, receivedAt time.Time) Record {
+	return Record{Channel: notification.Channel, PID: notification.BePid, Payload: notification.Extra, ReceivedAt: receivedAt.UTC()}
+}
+
+//Notification converts the record back to a notification
+func (r Record) Notification() *pq.Notification {
+	return &pq.Notification{Channel: r.Channel, BePid: r.PID, Extra: r.Payload}
+}
+
+//FileSinkOptions configures a FileSink
+type FileSinkOptions struct {
+	//Dir is the directory files are written to. It is created if missing
+	Dir string
+	//Prefix starts every file name. Defaults to pqstream
+	Prefix string
+	Format FileFormat
+	//MaxBytes rotates the file once this many uncompressed bytes have been written. Zero disables size based rotation
+	MaxBytes int64
+	//MaxAge rotates the file once it has been open this long. Zero disables time based rotation
+	MaxAge time.Duration
+	//Gzip compresses files as they are written
+	Gzip bool
+	//Clock is the source of time for record timestamps and rotation. Defaults to SystemClock
+	Clock Clock
+	//Marshaler encodes each NDJSON line. It must not emit newlines. Defaults to RecordMarshaler
+	Marshaler Marshaler
+	//Cipher encrypts files as they are written, after compression. Encrypted files end in .enc and are read with OpenEncryptedRecords
+	Cipher *FileCipher
+}
+
+//A FileSink writes notifications to rotating local files, for air-gapped environments that ship logs by other means
+type FileSink struct {
+	opts    FileSinkOptions
+	mu      sync.Mutex
+	file    *os.File
+	enc     io.WriteCloser
+	gz      *gzip.Writer
+	out     io.Writer
+	written int64
+	opened  time.Time
+	closed  bool
+}
+
+//NewFileSink creates the sink's directory. Files are opened lazily on the first Send
+func NewFileSink(opts FileSinkOptions) (*FileSink, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("file sink requires a directory")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "pqstream"
+	}
+	if opts.Marshaler == nil {
+		opts.Marshaler = RecordMarshaler{}
+	}
+	opts.Clock = clockOr(opts.Clock)
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSink{opts: opts}, nil
+}
+
+//Name returns the sink's name
+func (f *FileSink) Name() string {
+	return "file"
+}
+
+//Send appends a notification to the current file, rotating first if it is due
+func (f *FileSink) Send(ctx context.Context, notification *pq.Notification) error {
+	if skipDryRun(ctx, f.Name(), notification) {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.New("file sink closed")
+	}
+	if f.file != nil && f.due() {
+		if err := f.closeFile(); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	now := f.opts.Clock.Now()
+	counter := &countingWriter{w: f.out}
+	switch f.opts.Format {
+	case CSV:
+		r := NewRecord(notification, now)
+		w := csv.NewWriter(counter)
+		if err := w.Write([]string{r.Channel, strconv.Itoa(r.PID), r.Payload, r.ReceivedAt.Format(time.RFC3339Nano)}); err != nil {
+			return err
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	default:
+		line, err := f.opts.Marshaler.Marshal(notification, now)
+		if err != nil {
+			return err
+		}
+		if _, err := counter.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	f.written += counter.n
+	return nil
+}
+
+//Rotate closes the current file so the next Send starts a new one
+func (f *FileSink) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closeFile()
+}
+
+//Close flushes and closes the current file
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return f.closeFile()
+}
+
+func (f *FileSink) due() bool {
+	if f.opts.MaxBytes > 0 && f.written >= f.opts.MaxBytes {
+		return true
+	}
+	return f.opts.MaxAge > 0 && f.opts.Clock.Now().Sub(f.opened) >= f.opts.MaxAge
+}
+
+func (f *FileSink) open() error {
+	ext := ".ndjson"
+	if f.opts.Format == CSV {
+		ext = ".csv"
+	}
+	if f.opts.Gzip {
+		ext += ".gz"
+	}
+	if f.opts.Cipher != nil {
+		ext += ".enc"
+	}
+	now := f.opts.Clock.Now().UTC()
+	path := filepath.Join(f.opts.Dir, fmt.Sprintf("%s-%s%s", f.opts.Prefix, now.Format("20060102T150405.000000000"), ext))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file, f.out, f.written, f.opened = file, file, 0, now
+	if f.opts.Cipher != nil {
+		f.enc = f.opts.Cipher.Writer(file)
+		f.out = f.enc
+	}
+	if f.opts.Gzip {
+		f.gz = gzip.NewWriter(f.out)
+		f.out = f.gz
+	}
+	if f.opts.Format == CSV {
+		header := csv.NewWriter(f.out)
+		if err := header.Write([]string{"channel", "pid", "payload", "received_at"}); err != nil {
+			return err
+		}
+		header.Flush()
+		return header.Error()
+	}
+	return nil
+}
+
+func (f *FileSink) closeFile() error {
+	if f.file == nil {
+		return nil
+	}
+	var err error
+	if f.gz != nil {
+		err = f.gz.Close()
+	}
+	if f.enc != nil {
+		if cerr := f.enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.file, f.enc, f.gz, f.out = nil, nil, nil, nil
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
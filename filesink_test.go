@@ -0,0 +1,84 @@
+package pqstream_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, MaxBytes: 1, Gzip: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{`{"id": 1}`, `{"id": 2}`} {
+		if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", BePid: 7, Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "pqstream-*.ndjson.gz"))
+	if len(files) != 2 {
+		t.Fatalf("expected a rotated file per notification, got: %v", files)
+	}
+	sort.Strings(files)
+	f, err := os.Open(files[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var record pqstream.Record
+	if err := json.NewDecoder(bufio.NewReader(gz)).Decode(&record); err != nil {
+		t.Fatal(err.Error())
+	}
+	if record.Channel != "users" || record.PID != 7 || record.Payload != `{"id": 2}` {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+}
+
+func TestFileSinkCSV(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, Prefix: "users", Format: pqstream.CSV})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{"a,b", "c"} {
+		if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "users-*.csv"))
+	if len(files) != 1 {
+		t.Fatalf("expected a single csv file, got: %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rows) != 3 || rows[0][0] != "channel" || rows[1][2] != "a,b" {
+		t.Fatalf("unexpected csv rows: %v", rows)
+	}
+}
@@ -0,0 +1,75 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"hash"
+)
+
+//A Fingerprinter identifies notifications by a stable hash of selected payload fields, attached to logs, traces and alerts in place of the payload,
+//so an event can be correlated across systems, ie: with the producer's logs of the same order, without leaking its data. Fields use Mapping's path syntax,
+//ie: data.order_id or $channel, so fields that differ between systems, such as timestamps, can be left out. Without Fields the whole payload is hashed.
+//A fingerprint is the first 8 bytes, in hex, of the SHA-256, or with a Key the HMAC-SHA256, of each field's path, a NUL, its value as JSON and a NUL,
+//in the order of Fields. A missing field has an empty value
+type Fingerprinter struct {
+	Fields []string
+	//Key makes fingerprints HMACs, so those of low entropy fields, ie: emails, can't be reversed by hashing guesses. Systems correlating fingerprints share it
+	Key []byte
+}
+
+//NewFingerprinter returns a Fingerprinter of the fields, validating their paths
+func NewFingerprinter(key []byte, fields ...string) (*Fingerprinter, error) {
+	for _, field := range fields {
+		if msg := lintPath(field, true); msg != "" {
+			return nil, fmt.Errorf("invalid fingerprint field %q: %s", field, msg)
+		}
+	}
+	return &Fingerprinter{Fields: fields, Key: key}, nil
+}
+
+//Fingerprint returns the notification's fingerprint. A nil Fingerprinter hashes the whole payload, as slow handler reports and quarantine alerts do by default
+func (f *Fingerprinter) Fingerprint(n *pq.Notification) string {
+	if f == nil || (len(f.Fields) == 0 && len(f.Key) == 0) {
+		return payloadFingerprint(n.Extra)
+	}
+	var h hash.Hash
+	if len(f.Key) > 0 {
+		h = hmac.New(sha256.New, f.Key)
+	} else {
+		h = sha256.New()
+	}
+	if len(f.Fields) == 0 {
+		h.Write([]byte(n.Extra))
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	}
+	payload, _ := decodePayload(n)
+	for _, field := range f.Fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+		if value, ok := resolve(n, payload, field); ok {
+			encoded, _ := json.Marshal(value)
+			h.Write(encoded)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+type fingerprintKey struct{}
+
+//FingerprintFrom returns the fingerprint of the notification a handler's context is processing, for handlers to attach to their own logs and metrics.
+//It reports false unless the client has a Config.Fingerprint
+func FingerprintFrom(ctx context.Context) (string, bool) {
+	fp, ok := ctx.Value(fingerprintKey{}).(string)
+	return fp, ok
+}
+
+//fingerprint returns the fingerprint a notification is identified by in reports
+func (c *Client) fingerprint(n *pq.Notification) string {
+	return c.config.Fingerprint.Fingerprint(n)
+}
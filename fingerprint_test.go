@@ -0,0 +1,54 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprinter(t *testing.T) {
+	f, err := pqstream.NewFingerprinter(nil, "table", "new.id")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a := &pq.Notification{Channel: "orders", Extra: `{"table": "orders", "op": "UPDATE", "new": {"id": 7, "email": "a@example.com", "updated_at": "2024-05-01"}}`}
+	b := &pq.Notification{Channel: "orders_copy", Extra: `{"new": {"updated_at": "2024-05-02", "id": 7}, "table": "orders"}`}
+	c := &pq.Notification{Channel: "orders", Extra: `{"table": "orders", "new": {"id": 8}}`}
+	fp := f.Fingerprint(a)
+	if len(fp) != 16 || fp != f.Fingerprint(b) || fp == f.Fingerprint(c) {
+		t.Fatalf("expected fingerprints of the selected fields only, got %s %s %s", fp, f.Fingerprint(b), f.Fingerprint(c))
+	}
+	keyed := &pqstream.Fingerprinter{Fields: f.Fields, Key: []byte("secret")}
+	if keyed.Fingerprint(a) == fp || keyed.Fingerprint(a) != keyed.Fingerprint(b) {
+		t.Fatalf("expected a keyed fingerprint to differ from the plain one, got %s", keyed.Fingerprint(a))
+	}
+	var none *pqstream.Fingerprinter
+	if none.Fingerprint(a) == none.Fingerprint(b) {
+		t.Fatal("expected a nil fingerprinter to hash the whole payload")
+	}
+	if _, err := pqstream.NewFingerprinter(nil, "new..id"); err == nil {
+		t.Fatal("expected an invalid path to be rejected")
+	}
+
+	trace := &bytes.Buffer{}
+	var seen string
+	pipeline := pqstream.NewPipeline().Source("orders").FanOut(pqstream.NewSink("fp", func(ctx context.Context, notification *pq.Notification) error {
+		seen, _ = pqstream.FingerprintFrom(ctx)
+		return nil
+	}))
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{Fingerprint: f, TraceWriter: trace, Clock: pqstream.NewFakeClock(time.Unix(0, 0))}, pipeline)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(a)
+	if seen != fp || !strings.Contains(trace.String(), `"fingerprint":"`+fp+`"`) || strings.Contains(trace.String(), "a@example.com") {
+		t.Fatalf("expected the handler and trace log to carry the fingerprint, got %q: %s", seen, trace.String())
+	}
+	if e := client.EffectiveConfig(); len(e.FingerprintFields) != 2 {
+		t.Fatalf("expected the fingerprint fields in the effective config, got %+v", e.FingerprintFields)
+	}
+}
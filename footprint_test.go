@@ -0,0 +1,51 @@
+package pqstream_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//allowedImports are the only non-standard packages the module may import. Integrations with heavyweight SDKs, ie: Kafka, cloud providers or Elasticsearch,
+//belong in their own submodules implementing Sink, so users who only need LISTEN/NOTIFY don't pull in their dependency trees. Integrations built on the
+//standard library alone, ie: the StreamServer, Dashboard and HTTP sinks, stay in the core package: they add no dependencies, the linker drops them from
+//binaries that don't reference them, and since no file has an init function, importing the package never registers or starts anything
+var allowedImports = map[string]bool{
+	"github.com/lib/pq":             true,
+	"github.com/autom8ter/pqstream": true,
+}
+
+func TestDependencyFootprint(t *testing.T) {
+	for _, pattern := range []string{"*.go", "cmd/*/*.go"} {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file, "_test.go") {
+				continue
+			}
+			f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			for _, decl := range f.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "init" {
+					t.Fatalf("%s has an init function: importing the package must not register or start anything", file)
+				}
+			}
+			for _, spec := range f.Imports {
+				path, _ := strconv.Unquote(spec.Path.Value)
+				//standard library paths have no dot in their first element
+				if !strings.Contains(strings.Split(path, "/")[0], ".") || allowedImports[path] {
+					continue
+				}
+				t.Fatalf("%s imports %s: keep the core module's dependencies to lib/pq and move heavyweight integrations into a submodule", file, path)
+			}
+		}
+	}
+}
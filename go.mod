@@ -1,5 +1,5 @@
 module github.com/autom8ter/pqstream
 
-go 1.12
+go 1.20
 
 require github.com/lib/pq v1.3.0
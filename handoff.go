@@ -0,0 +1,259 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"time"
+)
+
+//handoffPrefix marks the notifications an instance sends on each of its channels to cut the stream over during a handoff. Markers are never passed to handlers
+const handoffPrefix = "pqstream:handoff:"
+
+//A Handoff coordinates a blue/green deploy through a row keyed by Key in a postgres table. The new instance starts as a standby and calls TakeOver while
+//the old one runs Serve. When the old instance sees the request it sends a marker notification on each of its channels: it processes everything before
+//the marker, drops everything after it and waits for its handlers to finish, so the marker is the shared checkpoint both instances cut over at.
+//The new instance discards what it buffered before the marker and is promoted once the old one reports the handoff released, so no notification is processed twice.
+//Both instances must listen on the same channels
+type Handoff struct {
+	DB *sql.DB
+	//Key identifies the deployment being handed off
+	Key string
+	//Table is the optionally schema qualified handoff table. Defaults to pqstream_handoff
+	Table string
+	//Interval is how often the handoff row is polled. Defaults to 1s
+	Interval time.Duration
+	//Clock is the source of time for polling. Defaults to SystemClock
+	Clock Clock
+}
+
+func (h *Handoff) table() string {
+	if h.Table == "" {
+		return "pqstream_handoff"
+	}
+	return h.Table
+}
+
+func (h *Handoff) interval() time.Duration {
+	if h.Interval <= 0 {
+		return time.Second
+	}
+	return h.Interval
+}
+
+func (h *Handoff) validate() error {
+	if h.DB == nil {
+		return errors.New("handoff requires a db")
+	}
+	if h.Key == "" {
+		return errors.New("empty handoff key")
+	}
+	return nil
+}
+
+//Setup creates the handoff table if it doesn't exist
+func (h *Handoff) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if err := h.validate(); err != nil {
+		return err
+	}
+	if _, err := h.DB.ExecContext(ctx, h.ddl()); err != nil {
+		return fmt.Errorf("failed to create handoff table! %s", err.Error())
+	}
+	return nil
+}
+
+func (h *Handoff) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	key text PRIMARY KEY,
+	state text NOT NULL,
+	token text NOT NULL,
+	owner text NOT NULL DEFAULT '',
+	requested_by text NOT NULL DEFAULT '',
+	updated_at timestamptz NOT NULL DEFAULT now()
+)`, quoteQualified(h.table()))
+}
+
+//Serve waits for another instance to request the handoff, then releases the client's channels to it. It returns once the client has flushed and
+//the handoff is marked released, leaving the client in RoleReleased
+func (h *Handoff) Serve(ctx context.Context, c *Client) error {
+	if err := checkReadOnly(ctx, c); err != nil {
+		return err
+	}
+	if err := h.validate(); err != nil {
+		return err
+	}
+	clock := clockOr(h.Clock)
+	for {
+		var state, token, requestedBy string
+		err := h.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT state, token, requested_by FROM %s WHERE key = $1", quoteQualified(h.table())), h.Key).Scan(&state, &token, &requestedBy)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return fmt.Errorf("failed to read handoff %s! %s", h.Key, err.Error())
+		case state == "requested" && requestedBy != c.config.InstanceID:
+			return h.release(ctx, c, token, requestedBy)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(h.interval()):
+		}
+	}
+}
+
+func (h *Handoff) release(ctx context.Context, c *Client, token, to string) error {
+	channels := c.Channels()
+	complete := c.handoff.begin(token, true, channels)
+	for _, ch := range channels {
+		if _, err := h.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", ch, handoffPrefix+token); err != nil {
+			return fmt.Errorf("failed to send handoff marker on channel: %s! %s", ch, err.Error())
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-complete:
+	}
+	c.pending.Wait()
+	c.handoff.releaseDone()
+	if c.config.Verbose {
+		c.logf("released handoff %s to %s", h.Key, to)
+	}
+	_, err := h.DB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET state = 'released', owner = requested_by, updated_at = now() WHERE key = $1 AND token = $2", quoteQualified(h.table())), h.Key, token)
+	if err != nil {
+		return fmt.Errorf("failed to release handoff %s! %s", h.Key, err.Error())
+	}
+	return nil
+}
+
+//TakeOver requests the handoff for a standby client and promotes it once the current owner has released its channels. If no instance releases the handoff,
+//TakeOver waits until the context is done, so callers starting the first instance of a deployment should promote it directly instead
+func (h *Handoff) TakeOver(ctx context.Context, c *Client) error {
+	if err := checkReadOnly(ctx, c); err != nil {
+		return err
+	}
+	if err := h.validate(); err != nil {
+		return err
+	}
+	if c.Role() != RoleStandby {
+		return errors.New("handoff requires a standby client")
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate handoff token! %s", err.Error())
+	}
+	token := hex.EncodeToString(raw)
+	complete := c.handoff.begin(token, false, c.Channels())
+	_, err := h.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (key, state, token, requested_by) VALUES ($1, 'requested', $2, $3)
+ON CONFLICT (key) DO UPDATE SET state = 'requested', token = EXCLUDED.token, requested_by = EXCLUDED.requested_by, updated_at = now()`, quoteQualified(h.table())),
+		h.Key, token, c.config.InstanceID)
+	if err != nil {
+		return fmt.Errorf("failed to request handoff %s! %s", h.Key, err.Error())
+	}
+	clock := clockOr(h.Clock)
+	for {
+		var state string
+		err := h.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT state FROM %s WHERE key = $1 AND token = $2", quoteQualified(h.table())), h.Key, token).Scan(&state)
+		switch {
+		case err == sql.ErrNoRows:
+			return fmt.Errorf("handoff %s was requested by another instance", h.Key)
+		case err != nil:
+			return fmt.Errorf("failed to read handoff %s! %s", h.Key, err.Error())
+		}
+		if state == "released" {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(h.interval()):
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-complete:
+	}
+	c.Promote()
+	if _, err := h.DB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET state = 'active', updated_at = now() WHERE key = $1 AND token = $2", quoteQualified(h.table())), h.Key, token); err != nil {
+		return fmt.Errorf("failed to activate handoff %s! %s", h.Key, err.Error())
+	}
+	return nil
+}
+
+//handoff tracks which channels have passed an in-progress handoff's marker
+type handoff struct {
+	mu        sync.Mutex
+	token     string
+	releasing bool
+	released  bool
+	channels  map[string]bool
+	remaining int
+	complete  chan struct{}
+}
+
+//begin starts a handoff, returning a channel closed once the marker has been seen on every channel
+func (h *handoff) begin(token string, releasing bool, channels []string) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token, h.releasing = token, releasing
+	h.channels = map[string]bool{}
+	for _, ch := range channels {
+		h.channels[ch] = false
+	}
+	h.remaining = len(h.channels)
+	h.complete = make(chan struct{})
+	if h.remaining == 0 {
+		close(h.complete)
+	}
+	return h.complete
+}
+
+//mark records a marker notification, reporting whether it belongs to the handoff in progress
+func (h *handoff) mark(n *pq.Notification) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.token == "" || n.Extra != handoffPrefix+h.token {
+		return false
+	}
+	if seen, ok := h.channels[n.Channel]; ok && !seen {
+		h.channels[n.Channel] = true
+		h.remaining--
+		if h.remaining == 0 {
+			close(h.complete)
+		}
+	}
+	return true
+}
+
+//cut reports whether a releasing client has passed the marker on a channel, so notifications after it belong to the new instance
+func (h *handoff) cut(channel string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.releasing && h.channels[channel]
+}
+
+func (h *handoff) releaseDone() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.released = true
+}
+
+func (h *handoff) isReleased() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.released
+}
+
+func isHandoffMarker(n *pq.Notification) bool {
+	return strings.HasPrefix(n.Extra, handoffPrefix)
+}
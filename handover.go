@@ -0,0 +1,227 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//A HandoverPosition is where a client stopped processing a channel: the sequence number of the last enveloped notification it received, if producers send them,
+//and when it received its last notification
+type HandoverPosition struct {
+	Seq int64     `json:"seq,omitempty"`
+	At  time.Time `json:"at"`
+}
+
+//A HandoverToken is written by a client as it shuts down gracefully, so the next instance knows where to catch up from before going live
+type HandoverToken struct {
+	InstanceID string                      `json:"instance_id"`
+	WrittenAt  time.Time                   `json:"written_at"`
+	Channels   map[string]HandoverPosition `json:"channels"`
+}
+
+//A HandoverStore persists the latest HandoverToken
+type HandoverStore interface {
+	//Read returns the latest token, or nil if none was written
+	Read(ctx context.Context) (*HandoverToken, error)
+	//Write replaces the latest token
+	Write(ctx context.Context, token *HandoverToken) error
+}
+
+//A Handover carries a client's position across planned restarts without an Outbox. A client stopped gracefully writes a HandoverToken with its position on each channel;
+//the next instance reads it once it has registered LISTEN and, before processing live notifications, runs Catchup from each channel's position, ie: querying
+//the rows updated since. Notifications sent while neither instance listened are only recovered by Catchup, and ones delivered both by Catchup and live are processed twice,
+//so handlers should be idempotent. Channel sequence numbers resume from the token, so a gap across the restart is reported to the GapHandler either way
+type Handover struct {
+	Store HandoverStore
+	//Catchup returns the notifications a channel missed since a position, processed in order before the live stream. Positions are taken as notifications
+	//are received, so catch-up queries on timestamps should overlap by a margin. Nil only resumes sequence numbers
+	Catchup func(ctx context.Context, channel string, since HandoverPosition) ([]*pq.Notification, error)
+}
+
+//FileHandover stores the token as JSON in a file, ie: on a volume kept across restarts
+type FileHandover string
+
+//Read returns the token in the file, or nil if it doesn't exist
+func (f FileHandover) Read(ctx context.Context) (*HandoverToken, error) {
+	data, err := os.ReadFile(string(f))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read handover token! %s", err.Error())
+	}
+	token := &HandoverToken{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("failed to decode handover token! %s", err.Error())
+	}
+	return token, nil
+}
+
+//Write replaces the file atomically
+func (f FileHandover) Write(ctx context.Context, token *HandoverToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), ".handover-*")
+	if err != nil {
+		return fmt.Errorf("failed to write handover token! %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write handover token! %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write handover token! %s", err.Error())
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+//TableHandover stores the token in a postgres table, one row per key
+type TableHandover struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified handover table. Defaults to pqstream_handover
+	Table string
+	//Key names the deployment the token belongs to, so the instances of several deployments can share the table. Defaults to pqstream
+	Key string
+}
+
+func (t *TableHandover) table() string {
+	if t.Table == "" {
+		return "pqstream_handover"
+	}
+	return t.Table
+}
+
+func (t *TableHandover) key() string {
+	if t.Key == "" {
+		return "pqstream"
+	}
+	return t.Key
+}
+
+//Read returns the key's token, or nil if it has none
+func (t *TableHandover) Read(ctx context.Context) (*HandoverToken, error) {
+	var data string
+	err := t.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT token::text FROM %s WHERE key = $1", quoteQualified(t.table())), t.key()).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read handover token %s! %s", t.key(), err.Error())
+	}
+	token := &HandoverToken{}
+	if err := json.Unmarshal([]byte(data), token); err != nil {
+		return nil, fmt.Errorf("failed to decode handover token %s! %s", t.key(), err.Error())
+	}
+	return token, nil
+}
+
+//Write replaces the key's token
+func (t *TableHandover) Write(ctx context.Context, token *HandoverToken) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	_, err = t.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (key, token) VALUES ($1, $2)
+ON CONFLICT (key) DO UPDATE SET token = EXCLUDED.token, updated_at = now()`, quoteQualified(t.table())), t.key(), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to write handover token %s! %s", t.key(), err.Error())
+	}
+	return nil
+}
+
+//Requirements returns the privileges the store needs on its table
+func (t *TableHandover) Requirements() []Requirement {
+	return writes(tableRequirements("handover", t.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate))
+}
+
+//handover holds whether the client has already caught up from the token, which it only does on its first connection, and the positions it resumed from
+type handover struct {
+	done    bool
+	resumed map[string]HandoverPosition
+}
+
+//resumeHandover reads the handover token and catches up every channel from it, once per client
+func (c *Client) resumeHandover(ctx context.Context) {
+	h := c.config.Handover
+	if h == nil || c.handover.done {
+		return
+	}
+	c.handover.done = true
+	token, err := h.Store.Read(ctx)
+	if err != nil {
+		c.handlers.ErrorHandler(err)
+		return
+	}
+	if token == nil {
+		return
+	}
+	c.handover.resumed = token.Channels
+	if c.config.Verbose {
+		c.logf("resuming from handover token written by %s at %s", token.InstanceID, token.WrittenAt.Format(time.RFC3339))
+	}
+	for _, ch := range c.Channels() {
+		pos, ok := token.Channels[ch]
+		if !ok {
+			continue
+		}
+		stats := c.stats.channel(ch)
+		stats.seqMu.Lock()
+		if stats.lastSeq < pos.Seq {
+			stats.lastSeq = pos.Seq
+		}
+		stats.seqMu.Unlock()
+		if h.Catchup == nil {
+			continue
+		}
+		missed, err := h.Catchup(ctx, ch, pos)
+		if err != nil {
+			c.handleErr(ch, fmt.Errorf("failed to catch up channel: %s from handover! %s", ch, err.Error()))
+			continue
+		}
+		for _, n := range missed {
+			for _, gap := range c.sequenced(n) {
+				c.process(gap)
+			}
+			c.process(n)
+		}
+	}
+}
+
+//writeHandover writes the client's position on every channel it received notifications on
+func (c *Client) writeHandover() {
+	h := c.config.Handover
+	if h == nil {
+		return
+	}
+	token := &HandoverToken{InstanceID: c.config.InstanceID, WrittenAt: c.config.Clock.Now().UTC(), Channels: map[string]HandoverPosition{}}
+	for _, ch := range c.Channels() {
+		stats := c.stats.channel(ch)
+		at, _ := stats.lastReceived.Load().(time.Time)
+		stats.seqMu.Lock()
+		seq := stats.lastSeq
+		stats.seqMu.Unlock()
+		switch resumed, ok := c.handover.resumed[ch]; {
+		case !at.IsZero():
+			token.Channels[ch] = HandoverPosition{Seq: seq, At: at.UTC()}
+		case ok:
+			//nothing was received since resuming, so the next instance catches up from the same position
+			token.Channels[ch] = resumed
+		}
+	}
+	if err := h.Store.Write(context.Background(), token); err != nil {
+		c.handlers.ErrorHandler(err)
+	}
+}
@@ -0,0 +1,78 @@
+package pqstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func enveloped(channel string, seq int64) *pq.Notification {
+	return &pq.Notification{Channel: channel, Extra: fmt.Sprintf(`{"emitted_at": "2024-01-01T00:00:00Z", "seq": %d, "data": %d}`, seq, seq)}
+}
+
+func TestHandover(t *testing.T) {
+	store := FileHandover(filepath.Join(t.TempDir(), "handover.json"))
+	if token, err := store.Read(context.Background()); err != nil || token != nil {
+		t.Fatalf("expected no token before the first shutdown, got: %+v %v", token, err)
+	}
+	var (
+		mu   sync.Mutex
+		seen []string
+		gaps []Gap
+	)
+	newClient := func(catchup func(ctx context.Context, channel string, since HandoverPosition) ([]*pq.Notification, error)) *Client {
+		c, err := NewClient([]string{"users", "orders"}, &Config{InstanceID: "blue", Handover: &Handover{Store: store, Catchup: catchup}}, &HandlerSet{
+			Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error {
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, n.Channel+":"+string(envelopeOf(n).Data))
+				return nil
+			})},
+			GapHandler: func(gap Gap) {
+				gaps = append(gaps, gap)
+			},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return c
+	}
+	blue := newClient(nil)
+	for seq := int64(1); seq <= 5; seq++ {
+		blue.Process(enveloped("users", seq))
+	}
+	blue.writeHandover()
+	token, err := store.Read(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pos, ok := token.Channels["users"]; !ok || pos.Seq != 5 || pos.At.IsZero() || token.InstanceID != "blue" {
+		t.Fatalf("expected the last position on users, got: %+v", token)
+	}
+	if _, ok := token.Channels["orders"]; ok {
+		t.Fatalf("expected no position on a channel without notifications, got: %+v", token)
+	}
+
+	seen = nil
+	var since []HandoverPosition
+	green := newClient(func(ctx context.Context, channel string, pos HandoverPosition) ([]*pq.Notification, error) {
+		since = append(since, pos)
+		return []*pq.Notification{enveloped(channel, 6), enveloped(channel, 7)}, nil
+	})
+	green.resumeHandover(context.Background())
+	green.resumeHandover(context.Background())
+	green.Process(enveloped("users", 9))
+	if len(since) != 1 || since[0].Seq != 5 {
+		t.Fatalf("expected a single catch up from sequence 5, got: %+v", since)
+	}
+	if got := strings.Join(seen, ","); got != "users:6,users:7,users:9" {
+		t.Fatalf("expected the caught up notifications before the live one, got: %s", got)
+	}
+	if len(gaps) != 1 || gaps[0].After != 7 || gaps[0].Next != 9 {
+		t.Fatalf("expected sequence numbers to resume from the token, got: %+v", gaps)
+	}
+}
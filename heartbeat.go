@@ -0,0 +1,122 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ErrFenced is reported when a client stops processing because another instance with the same InstanceID has taken over
+var ErrFenced = errors.New("fenced by a newer instance with the same instance id")
+
+//A Heartbeat detects two clients running with the same InstanceID, ie: in a single consumer deployment, through a heartbeat table.
+//Each run of a client registers a new session for its InstanceID, taking it over from any older session. An older client whose next heartbeat finds its session replaced
+//fences itself: it stops processing notifications and reports ErrFenced to its ErrorHandler, so the two never process the same notifications
+type Heartbeat struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified heartbeat table. Defaults to pqstream_heartbeat
+	Table string
+	//Interval is how often the heartbeat is written. Defaults to 10s
+	Interval time.Duration
+	//Clock is the source of time for the heartbeat interval. Defaults to SystemClock
+	Clock Clock
+}
+
+func (h *Heartbeat) table() string {
+	if h.Table == "" {
+		return "pqstream_heartbeat"
+	}
+	return h.Table
+}
+
+//Setup creates the heartbeat table if it doesn't exist
+func (h *Heartbeat) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if h.DB == nil {
+		return errors.New("heartbeat requires a db")
+	}
+	if _, err := h.DB.ExecContext(ctx, h.ddl()); err != nil {
+		return fmt.Errorf("failed to create heartbeat table! %s", err.Error())
+	}
+	return nil
+}
+
+func (h *Heartbeat) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	instance_id text PRIMARY KEY,
+	session text NOT NULL,
+	hostname text NOT NULL DEFAULT '',
+	started_at timestamptz NOT NULL,
+	beat_at timestamptz NOT NULL DEFAULT now()
+)`, quoteQualified(h.table()))
+}
+
+//Run registers the client's session and writes its heartbeat until the context is done. If another session takes over the client's InstanceID,
+//the client is fenced and Run returns ErrFenced
+func (h *Heartbeat) Run(ctx context.Context, c *Client) error {
+	if err := checkReadOnly(ctx, c); err != nil {
+		return err
+	}
+	if h.DB == nil {
+		return errors.New("heartbeat requires a db")
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate heartbeat session! %s", err.Error())
+	}
+	session := hex.EncodeToString(raw)
+	member := c.Stats().Member
+	_, err := h.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (instance_id, session, hostname, started_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (instance_id) DO UPDATE SET session = EXCLUDED.session, hostname = EXCLUDED.hostname, started_at = EXCLUDED.started_at, beat_at = now()`, quoteQualified(h.table())),
+		member.InstanceID, session, member.Hostname, member.StartedAt)
+	if err != nil {
+		return fmt.Errorf("failed to register heartbeat! %s", err.Error())
+	}
+	interval := h.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	clock := clockOr(h.Clock)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+		}
+		res, err := h.DB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET beat_at = now() WHERE instance_id = $1 AND session = $2", quoteQualified(h.table())), member.InstanceID, session)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.handlers.ErrorHandler(fmt.Errorf("failed to write heartbeat! %s", err.Error()))
+			continue
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+			c.fence()
+			return ErrFenced
+		}
+	}
+}
+
+//fence stops the client from processing any more notifications and alerts the ErrorHandler
+func (c *Client) fence() {
+	c.mu.Lock()
+	already := c.fenced
+	c.fenced = true
+	c.mu.Unlock()
+	if !already {
+		c.handlers.ErrorHandler(fmt.Errorf("instance %s: %s", c.config.InstanceID, ErrFenced.Error()))
+	}
+}
+
+func (c *Client) isFenced() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fenced
+}
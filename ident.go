@@ -0,0 +1,27 @@
+package pqstream
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+//ValidateChannel reports whether a channel name can be listened on and notified as it is: valid UTF-8 of at most 63 bytes without NUL bytes, as postgres
+//silently truncates longer names so LISTEN would succeed on a different channel to the one notified. Any script is allowed, ie: "заказы" or "注文",
+//as channels are always quoted
+func ValidateChannel(channel string) error {
+	if msg := lintIdentifier(channel); msg != "" {
+		return fmt.Errorf("invalid channel %q: %s", channel, msg)
+	}
+	return nil
+}
+
+//truncateIdentifier shortens an identifier to at most n bytes without splitting a multibyte character, as postgres does
+func truncateIdentifier(name string, n int) string {
+	if len(name) <= n {
+		return name
+	}
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n]
+}
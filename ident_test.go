@@ -0,0 +1,70 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestValidateChannel(t *testing.T) {
+	for _, channel := range []string{"users", "заказы", "注文-イベント", "Café \"quoted\" channel"} {
+		if err := pqstream.ValidateChannel(channel); err != nil {
+			t.Fatalf("expected %s to be a valid channel, got: %s", channel, err.Error())
+		}
+	}
+	for _, channel := range []string{"", "bad\xff", "nul\x00", strings.Repeat("é", 32)} {
+		if err := pqstream.ValidateChannel(channel); err == nil {
+			t.Fatalf("expected %q to be an invalid channel", channel)
+		}
+	}
+	if _, err := pqstream.NewClient([]string{"bad\xff"}, &pqstream.Config{}, &pqstream.HandlerSet{Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(*pq.Notification) error { return nil })}}); err == nil {
+		t.Fatal("expected a client on an invalid channel to fail")
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	spec := pqstream.TriggerSpec{Table: `магазин.Заказы "2024"`, Channel: "заказы", Key: []string{"ид"}}
+	up := spec.Up()
+	for _, want := range []string{
+		`CREATE OR REPLACE FUNCTION "магазин"."pqstream_заказы_2024__заказы"() RETURNS trigger`,
+		`json_build_object('ид', NEW."ид")`,
+		`PERFORM pg_notify('заказы', payload)`,
+		`ON "магазин"."Заказы ""2024"""`,
+	} {
+		if !strings.Contains(up, want) {
+			t.Fatalf("expected trigger sql to contain %s, got:\n%s", want, up)
+		}
+	}
+	//long names are truncated on a character boundary
+	long := pqstream.TriggerSpec{Table: strings.Repeat("é", 40)}.Up()
+	name := long[strings.Index(long, `"pqstream_`)+1 : strings.Index(long, `"()`)]
+	if !utf8.ValidString(name) || len(name) > 63 {
+		t.Fatalf("expected a valid trigger name within postgres' limit, got: %s", name)
+	}
+
+	metrics := pqstream.NewMetrics()
+	handlerSet := &pqstream.HandlerSet{Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(*pq.Notification) error { return nil })}}
+	client, err := pqstream.NewClient([]string{"заказы", `say "hi"`}, &pqstream.Config{Collector: metrics}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "заказы", Extra: "{}"})
+	client.Process(&pq.Notification{Channel: `say "hi"`, Extra: "{}"})
+	if stats := client.Stats().Channels["заказы"]; stats.Received != 1 {
+		t.Fatalf("expected stats for a unicode channel, got: %+v", stats)
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`pqstream_notifications_total{channel="заказы"} 1`,
+		`pqstream_notifications_total{channel="say \"hi\""} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("expected %s in metrics, got:\n%s", want, rec.Body.String())
+		}
+	}
+}
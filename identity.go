@@ -0,0 +1,57 @@
+package pqstream
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+//Identity is the instance a notification was processed by: its InstanceID plus the operator supplied Config.Labels, ie: region, deployment or version.
+//It is attached to logs, stats, traces and the context handlers and checkpoints receive, so multi-instance deployments are debuggable
+type Identity struct {
+	InstanceID string            `json:"instance_id"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+//String formats the identity as instance{key=value,...} with labels sorted by key
+func (i Identity) String() string {
+	if len(i.Labels) == 0 {
+		return i.InstanceID
+	}
+	keys := make([]string, 0, len(i.Labels))
+	for k := range i.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for n, k := range keys {
+		pairs[n] = k + "=" + i.Labels[k]
+	}
+	return i.InstanceID + "{" + strings.Join(pairs, ",") + "}"
+}
+
+//Identity returns the client's instance identity
+func (c *Client) Identity() Identity {
+	labels := make(map[string]string, len(c.config.Labels))
+	for k, v := range c.config.Labels {
+		labels[k] = v
+	}
+	return Identity{InstanceID: c.config.InstanceID, Labels: labels}
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+//IdentityFrom returns the identity of the client processing a notification, ie: to record which instance advanced a checkpoint
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+//logf logs a message prefixed with the client's identity
+func (c *Client) logf(format string, args ...interface{}) {
+	c.logAt(LevelInfo, nil, format, args...)
+}
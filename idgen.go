@@ -0,0 +1,161 @@
+package pqstream
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//An IDGenerator generates envelope IDs, ie: for NotifyWith and an AuditSink. Generators other than RandomIDs produce IDs that sort in the order they were generated,
+//so downstream systems can index, page and deduplicate on them
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+//RandomIDs generates 32 hex character random IDs, the default. They don't sort by time
+type RandomIDs struct{}
+
+//NewID returns a random ID
+func (RandomIDs) NewID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+//UUIDv7 generates RFC 9562 version 7 UUIDs: a millisecond timestamp followed by random bits. IDs generated within the same millisecond by one generator
+//are ordered by a counter in the rand_a field, so a generator's IDs sort in the order they were generated
+type UUIDv7 struct {
+	//Clock is the source of the IDs' timestamps. Defaults to SystemClock
+	Clock Clock
+	mu    sync.Mutex
+	last  int64
+	seq   uint16
+}
+
+//NewID returns a UUIDv7 in its canonical hyphenated form
+func (u *UUIDv7) NewID() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[8:]); err != nil {
+		return "", err
+	}
+	u.mu.Lock()
+	ms := clockOr(u.Clock).Now().UnixMilli()
+	if ms <= u.last {
+		//the counter borrows the next millisecond once it runs out, or while the clock is behind the last ID
+		if u.seq++; u.seq > 0xfff {
+			u.last, u.seq = u.last+1, 0
+		}
+		ms = u.last
+	} else {
+		u.last, u.seq = ms, 0
+	}
+	seq := u.seq
+	u.mu.Unlock()
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(ms))
+	copy(raw[:6], stamp[2:])
+	raw[6], raw[7] = 0x70|byte(seq>>8), byte(seq)
+	raw[8] = raw[8]&0x3f | 0x80
+	s := hex.EncodeToString(raw[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
+
+//crockford is the base32 alphabet ULIDs are encoded in
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//ULID generates 26 character ULIDs: a millisecond timestamp followed by 80 random bits, in Crockford base32. IDs generated within the same millisecond by
+//one generator increment the random bits, as in the spec's monotonic mode, so a generator's IDs sort in the order they were generated
+type ULID struct {
+	//Clock is the source of the IDs' timestamps. Defaults to SystemClock
+	Clock   Clock
+	mu      sync.Mutex
+	last    int64
+	entropy [10]byte
+}
+
+//NewID returns a ULID
+func (u *ULID) NewID() (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ms := clockOr(u.Clock).Now().UnixMilli()
+	if ms <= u.last && increment(u.entropy[:]) {
+		ms = u.last
+	} else {
+		if ms <= u.last {
+			ms = u.last + 1
+		}
+		if _, err := rand.Read(u.entropy[:]); err != nil {
+			return "", err
+		}
+		u.last = ms
+	}
+	hi := uint64(ms)<<16 | uint64(binary.BigEndian.Uint16(u.entropy[:2]))
+	lo := binary.BigEndian.Uint64(u.entropy[2:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+//increment adds one to a big endian number, reporting false if it overflowed
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i]++; b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//snowflakeEpoch is the default Snowflake.Epoch
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//Snowflake generates decimal snowflake IDs: 41 bits of milliseconds since its Epoch, 10 bits of node ID and a 12 bit per millisecond sequence.
+//Every instance generating IDs needs its own Node, ie: derived from a StatefulSet ordinal, for IDs to be unique across them
+type Snowflake struct {
+	//Node identifies the generator, from 0 to 1023
+	Node int64
+	//Epoch is the time IDs count from. Defaults to 2020-01-01 UTC; changing it on an existing deployment breaks the IDs' ordering
+	Epoch time.Time
+	//Clock is the source of the IDs' timestamps. Defaults to SystemClock
+	Clock Clock
+	mu    sync.Mutex
+	last  int64
+	seq   int64
+}
+
+//NewID returns a snowflake ID
+func (s *Snowflake) NewID() (string, error) {
+	if s.Node < 0 || s.Node > 1023 {
+		return "", fmt.Errorf("snowflake node %d is out of range 0-1023", s.Node)
+	}
+	epoch := s.Epoch
+	if epoch.IsZero() {
+		epoch = snowflakeEpoch
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := clockOr(s.Clock).Now().Sub(epoch).Milliseconds()
+	if ms < 0 {
+		return "", fmt.Errorf("snowflake clock is before its epoch %s", epoch.Format(time.RFC3339))
+	}
+	if ms <= s.last {
+		//the sequence borrows the next millisecond once it runs out, or while the clock is behind the last ID
+		if s.seq = (s.seq + 1) & 0xfff; s.seq == 0 {
+			s.last++
+		}
+		ms = s.last
+	} else {
+		s.last, s.seq = ms, 0
+	}
+	return strconv.FormatInt(ms<<22|s.Node<<12|s.seq, 10), nil
+}
@@ -0,0 +1,96 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIDGenerators(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, gen := range map[string]pqstream.IDGenerator{
+		"uuidv7":    &pqstream.UUIDv7{Clock: pqstream.NewFakeClock(start)},
+		"ulid":      &pqstream.ULID{Clock: pqstream.NewFakeClock(start)},
+		"snowflake": &pqstream.Snowflake{Node: 7, Clock: pqstream.NewFakeClock(start)},
+	} {
+		//more ids than fit in a millisecond's counter, from a clock that never moves
+		ids := make([]string, 5000)
+		for i := range ids {
+			id, err := gen.NewID()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			ids[i] = id
+		}
+		less := func(i, j int) bool { return ids[i] < ids[j] }
+		if name == "snowflake" {
+			less = func(i, j int) bool {
+				a, _ := strconv.ParseInt(ids[i], 10, 64)
+				b, _ := strconv.ParseInt(ids[j], 10, 64)
+				return a < b
+			}
+		}
+		if !sort.SliceIsSorted(ids, less) {
+			t.Fatalf("expected %s ids to sort in the order they were generated", name)
+		}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("expected unique %s ids, got %s twice", name, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	uuid, _ := (&pqstream.UUIDv7{Clock: pqstream.NewFakeClock(start)}).NewID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Fatalf("expected a version 7 uuid, got: %s", uuid)
+	}
+	if ms, _ := strconv.ParseInt(strings.ReplaceAll(uuid[:13], "-", ""), 16, 64); ms != start.UnixMilli() {
+		t.Fatalf("expected the uuid to start with its timestamp, got: %d", ms)
+	}
+	ulid, _ := (&pqstream.ULID{Clock: pqstream.NewFakeClock(start)}).NewID()
+	if len(ulid) != 26 || !strings.HasPrefix(ulid, "01HWT0D7G0") {
+		t.Fatalf("expected a 26 character ulid starting with its timestamp, got: %s", ulid)
+	}
+	id, _ := (&pqstream.Snowflake{Node: 7, Clock: pqstream.NewFakeClock(start)}).NewID()
+	if n, _ := strconv.ParseInt(id, 10, 64); n>>12&1023 != 7 || time.Duration(n>>22)*time.Millisecond != start.Sub(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the snowflake to hold its node and time, got: %s", id)
+	}
+	if _, err := (&pqstream.Snowflake{Node: 1024}).NewID(); err == nil {
+		t.Fatal("expected a node out of range to fail")
+	}
+
+	db := &execRecorder{}
+	if err := pqstream.NotifyWith(context.Background(), db, "users", "", "hello", pqstream.NotifyOptions{IDs: &pqstream.ULID{}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	e := &pqstream.Envelope{}
+	if err := json.Unmarshal([]byte(db.args[0][1].(string)), e); err != nil || len(e.ID) != 26 {
+		t.Fatalf("expected the envelope id from the generator, got: %+v %v", e, err)
+	}
+}
+
+func TestIDMigrations(t *testing.T) {
+	migrations := pqstream.Migrations(pqstream.MigrationOptions{IDFunction: "gen_ulid"})
+	ids := migrations[14]
+	if ids.Name != "pqstream_ids" || !strings.Contains(ids.Up, `FUNCTION "pqstream_uuidv7"()`) || !strings.Contains(ids.Up, `'id', "gen_ulid"()`) {
+		t.Fatalf("expected the emit function to generate ids with the configured function, got: %s", ids.Up)
+	}
+	if !strings.Contains(ids.Down, "md5(random()") {
+		t.Fatalf("expected the down migration to restore random ids, got: %s", ids.Down)
+	}
+	if audit := migrations[15]; !strings.Contains(audit.Up, `ALTER TABLE "pqstream_audit" ADD COLUMN IF NOT EXISTS id text`) {
+		t.Fatalf("expected the audit table to gain an id column, got: %s", audit.Up)
+	}
+	up := pqstream.TriggerSpec{Table: "users", IDFunction: "pqstream_uuidv7"}.Up()
+	if strings.Count(up, `'id', "pqstream_uuidv7"(),`) != 2 {
+		t.Fatalf("expected both payloads to carry an id, got: %s", up)
+	}
+}
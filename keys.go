@@ -0,0 +1,116 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+//A KeyRegistry knows the primary key columns of each table, so the key of any change event can be extracted for partition keys, dedup keys,
+//sink document IDs and enrichment lookups. Keys can be registered by hand or loaded from information_schema
+type KeyRegistry struct {
+	mu   sync.RWMutex
+	keys map[string][]string
+}
+
+//NewKeyRegistry returns an empty KeyRegistry
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: map[string][]string{}}
+}
+
+//Register sets the primary key columns of a schema qualified or bare table name
+func (r *KeyRegistry) Register(table string, columns ...string) *KeyRegistry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[table] = append([]string{}, columns...)
+	return r
+}
+
+//Load registers the primary key of every table visible to the connection, by schema qualified name. Tables in the public schema are registered by bare name too
+func (r *KeyRegistry) Load(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT tc.table_schema, tc.table_name, kcu.column_name
+FROM information_schema.table_constraints tc
+JOIN information_schema.key_column_usage kcu
+	ON kcu.constraint_schema = tc.constraint_schema AND kcu.constraint_name = tc.constraint_name AND kcu.table_name = tc.table_name
+WHERE tc.constraint_type = 'PRIMARY KEY'
+ORDER BY tc.table_schema, tc.table_name, kcu.ordinal_position`)
+	if err != nil {
+		return fmt.Errorf("failed to load primary keys! %s", err.Error())
+	}
+	defer rows.Close()
+	keys := map[string][]string{}
+	for rows.Next() {
+		var schema, table, column string
+		if err := rows.Scan(&schema, &table, &column); err != nil {
+			return err
+		}
+		keys[schema+"."+table] = append(keys[schema+"."+table], column)
+		if schema == "public" {
+			keys[table] = append(keys[table], column)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for table, columns := range keys {
+		r.keys[table] = columns
+	}
+	return nil
+}
+
+//Columns returns the primary key columns of a change event's table
+func (r *KeyRegistry) Columns(e *ChangeEvent) ([]string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	candidates := []string{e.QualifiedTable(), e.Table}
+	if e.Schema == "" {
+		candidates = append(candidates, "public."+e.Table)
+	}
+	for _, table := range candidates {
+		if columns, ok := r.keys[table]; ok {
+			return columns, true
+		}
+	}
+	return nil, false
+}
+
+//KeyValues returns the values of a change event's primary key columns, read from the new row or, for deletes, the old one
+func (r *KeyRegistry) KeyValues(e *ChangeEvent) ([]any, error) {
+	columns, ok := r.Columns(e)
+	if !ok {
+		return nil, fmt.Errorf("no primary key registered for table: %s", e.QualifiedTable())
+	}
+	row := e.New
+	if e.Op == OpDelete || row == nil {
+		row = e.Old
+	}
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		v, ok := row[column]
+		if !ok || v == nil {
+			return nil, fmt.Errorf("change event on table: %s is missing primary key column: %s", e.QualifiedTable(), column)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+//Key returns a change event's primary key as a string: the value itself for single column keys, or a JSON array of the values for composite ones
+func (r *KeyRegistry) Key(e *ChangeEvent) (string, error) {
+	values, err := r.KeyValues(e)
+	if err != nil {
+		return "", err
+	}
+	if len(values) == 1 {
+		return fmt.Sprint(values[0]), nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
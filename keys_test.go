@@ -0,0 +1,36 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestKeyRegistry(t *testing.T) {
+	keys := pqstream.NewKeyRegistry().
+		Register("public.users", "id").
+		Register("memberships", "org_id", "user_id")
+	for payload, want := range map[string]string{
+		`{"table": "users", "op": "INSERT", "new": {"id": 9007199254740993, "name": "bob"}}`:              "9007199254740993",
+		`{"schema": "public", "table": "users", "op": "DELETE", "old": {"id": 2}}`:                        "2",
+		`{"schema": "app", "table": "memberships", "op": "UPDATE", "new": {"org_id": "a", "user_id": 3}}`: `["a",3]`,
+	} {
+		e, err := pqstream.ParseChange(&pq.Notification{Extra: payload})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		key, err := keys.Key(e)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if key != want {
+			t.Fatalf("expected key %s, got: %s", want, key)
+		}
+	}
+	if _, err := keys.Key(&pqstream.ChangeEvent{Table: "orders", Op: pqstream.OpInsert}); err == nil {
+		t.Fatal("expected an error for a table without a registered key")
+	}
+	if _, err := keys.Key(&pqstream.ChangeEvent{Table: "users", Op: pqstream.OpInsert, New: pqstream.Row{"name": "bob"}}); err == nil {
+		t.Fatal("expected an error for an event missing its key")
+	}
+}
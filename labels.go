@@ -0,0 +1,173 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//defaultMaxLabelValues bounds the distinct values of each label when LabelCounter's MaxValues is unset
+const defaultMaxLabelValues = 100
+
+//otherLabelValue replaces label values past a label's cardinality bound
+const otherLabelValue = "other"
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+//A LabelCount is the number of events seen on a channel with a set of label values
+type LabelCount struct {
+	Channel string            `json:"channel"`
+	Labels  map[string]string `json:"labels"`
+	Count   uint64            `json:"count"`
+}
+
+//A LabelCounter is a turnkey Handler counting events per channel broken down by labels taken from payload fields, ie: event type or region.
+//Labels are configured per channel as a label name to payload path, using Mapping's path syntax. Each label keeps at most MaxValues distinct values and
+//counts the rest as "other", so a high cardinality field can't explode the series count. It serves the counts in the Prometheus text format as pqstream_events_total
+type LabelCounter struct {
+	labels    map[string]map[string]string
+	names     map[string][]string
+	maxValues int
+	mu        sync.RWMutex
+	seen      map[string]map[string]map[string]bool
+	counts    map[string]*LabelCount
+}
+
+//NewLabelCounter validates the labels configured for each channel, ie: {"orders": {"type": "data.type", "region": "data.region"}}.
+//maxValues bounds the distinct values per label and defaults to 100
+func NewLabelCounter(labels map[string]map[string]string, maxValues int) (*LabelCounter, error) {
+	if maxValues <= 0 {
+		maxValues = defaultMaxLabelValues
+	}
+	l := &LabelCounter{
+		labels:    labels,
+		names:     map[string][]string{},
+		maxValues: maxValues,
+		seen:      map[string]map[string]map[string]bool{},
+		counts:    map[string]*LabelCount{},
+	}
+	for channel, fields := range labels {
+		for name, path := range fields {
+			switch {
+			case !labelName.MatchString(name) || strings.HasPrefix(name, "__"):
+				return nil, fmt.Errorf("invalid label name on channel %s: %q", channel, name)
+			case name == "channel":
+				return nil, fmt.Errorf("label name on channel %s is reserved: %q", channel, name)
+			}
+			if msg := lintPath(path, true); msg != "" {
+				return nil, fmt.Errorf("invalid path for label %s on channel %s: %s", name, channel, msg)
+			}
+		}
+		l.names[channel] = sortedKeys(fields)
+		l.seen[channel] = map[string]map[string]bool{}
+	}
+	return l, nil
+}
+
+//Name returns the handler's name
+func (l *LabelCounter) Name() string {
+	return "label_counter"
+}
+
+//Process counts a notification under its label values. Channels without configured labels are counted without labels
+func (l *LabelCounter) Process(notification *pq.Notification) error {
+	names := l.names[notification.Channel]
+	values := make([]string, len(names))
+	if len(names) > 0 {
+		payload, _ := decodePayload(notification)
+		for i, name := range names {
+			value, ok := resolve(notification, payload, l.labels[notification.Channel][name])
+			if ok {
+				values[i] = labelValue(value)
+			}
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, name := range names {
+		values[i] = l.bound(notification.Channel, name, values[i])
+	}
+	key := notification.Channel + "\x00" + strings.Join(values, "\x00")
+	count, ok := l.counts[key]
+	if !ok {
+		labels := make(map[string]string, len(names))
+		for i, name := range names {
+			labels[name] = values[i]
+		}
+		count = &LabelCount{Channel: notification.Channel, Labels: labels}
+		l.counts[key] = count
+	}
+	count.Count++
+	return nil
+}
+
+//bound returns the value to count under, replacing new values past the label's cardinality bound with "other"
+func (l *LabelCounter) bound(channel, name, value string) string {
+	seen, ok := l.seen[channel][name]
+	if !ok {
+		seen = map[string]bool{}
+		l.seen[channel][name] = seen
+	}
+	if seen[value] {
+		return value
+	}
+	if len(seen) >= l.maxValues {
+		return otherLabelValue
+	}
+	seen[value] = true
+	return value
+}
+
+func labelValue(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+//Counts returns a snapshot of the counts, sorted by channel and label values
+func (l *LabelCounter) Counts() []LabelCount {
+	l.mu.RLock()
+	keys := sortedKeys(l.counts)
+	out := make([]LabelCount, 0, len(keys))
+	for _, key := range keys {
+		c := l.counts[key]
+		labels := make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		out = append(out, LabelCount{Channel: c.Channel, Labels: labels, Count: c.Count})
+	}
+	l.mu.RUnlock()
+	return out
+}
+
+//ServeHTTP writes the counts as the pqstream_events_total counter
+func (l *LabelCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := &strings.Builder{}
+	b.WriteString("# HELP pqstream_events_total Events received per channel and payload labels.\n")
+	b.WriteString("# TYPE pqstream_events_total counter\n")
+	for _, c := range l.Counts() {
+		fmt.Fprintf(b, "pqstream_events_total{channel=%s", promLabel(c.Channel))
+		names := make([]string, 0, len(c.Labels))
+		for name := range c.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(b, ",%s=%s", name, promLabel(c.Labels[name]))
+		}
+		fmt.Fprintf(b, "} %d\n", c.Count)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,70 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabelCounter(t *testing.T) {
+	for _, labels := range []map[string]map[string]string{
+		{"orders": {"channel": "data.type"}},
+		{"orders": {"__type": "data.type"}},
+		{"orders": {"event-type": "data.type"}},
+		{"orders": {"type": "data..type"}},
+	} {
+		if _, err := pqstream.NewLabelCounter(labels, 0); err == nil {
+			t.Fatalf("expected invalid labels to be rejected: %v", labels)
+		}
+	}
+	counter, err := pqstream.NewLabelCounter(map[string]map[string]string{"orders": {"type": "data.type", "region": "data.region"}}, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{
+		`{"data": {"type": "created", "region": "eu"}}`,
+		`{"data": {"type": "created", "region": "eu"}}`,
+		`{"data": {"type": "paid", "region": "us"}}`,
+		`{"data": {"type": "refunded", "region": "eu"}}`,
+		`{"data": {"type": "shipped"}}`,
+	} {
+		counter.Process(&pq.Notification{Channel: "orders", Extra: payload})
+	}
+	counter.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+
+	server := httptest.NewServer(counter)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`pqstream_events_total{channel="orders",region="eu",type="created"} 2`,
+		`pqstream_events_total{channel="orders",region="us",type="paid"} 1`,
+		`pqstream_events_total{channel="orders",region="eu",type="other"} 1`,
+		`pqstream_events_total{channel="orders",region="other",type="other"} 1`,
+		`pqstream_events_total{channel="users"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("expected %s in:\n%s", want, body)
+		}
+	}
+}
+
+func TestLabelCounterEscaping(t *testing.T) {
+	counter, err := pqstream.NewLabelCounter(map[string]map[string]string{"orders": {"type": "data.type"}}, 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	counter.Process(&pq.Notification{Channel: "orders", Extra: `{"data": {"type": "q\"\\\ncé"}}`})
+	rec := httptest.NewRecorder()
+	counter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `pqstream_events_total{channel="orders",type="q\"\\\ncé"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("expected only backslashes, quotes and newlines escaped, ie: %s in:\n%s", want, rec.Body.String())
+	}
+}
@@ -0,0 +1,248 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//ErrClientStopped is returned by Start and Run once a client has been shut down, or has returned from Run. Clients can't be restarted
+var ErrClientStopped = errors.New("client stopped")
+
+//ErrClientRunning is returned by Start and Run while the client is already starting, running or draining, ie: from another goroutine
+var ErrClientRunning = errors.New("client already running")
+
+//ErrClientNotStarted is returned by Shutdown on a client that was never started. The client is stopped regardless, so it can't be started afterwards
+var ErrClientNotStarted = errors.New("client not started")
+
+//ErrNoHandlers is returned by Start and Run while the client has no handlers, neither in HandlerSet.Handlers nor routed with Handle or Subscribe
+var ErrNoHandlers = errors.New("zero handlers in config")
+
+//ClientState is a stage of a client's lifecycle, which only ever moves forward: New, Starting, Running, Draining, then Stopped.
+//A client shut down before it starts goes straight from New to Stopped, and one that fails to start from Starting to Stopped
+type ClientState string
+
+const (
+	//ClientNew is a client that hasn't been started
+	ClientNew ClientState = "new"
+	//ClientStarting is a client connecting and registering LISTEN on its channels
+	ClientStarting ClientState = "starting"
+	//ClientRunning is a client that has been Ready, listening on every channel, including while it reconnects
+	ClientRunning ClientState = "running"
+	//ClientDraining is a client that has been told to stop, processing the notifications it already received
+	ClientDraining ClientState = "draining"
+	//ClientStopped is a client whose Run has returned, or that was shut down before it started
+	ClientStopped ClientState = "stopped"
+)
+
+//lifecycle tracks the client's state and signals it to stop
+type lifecycle struct {
+	once     sync.Once
+	state    ClientState
+	stopping chan struct{}
+	stopped  chan struct{}
+	err      error
+	ready    chan struct{}
+	isReady  sync.Once
+}
+
+//Channels returns the channels the client listens on, excluding aliases
+func (c *Client) Channels() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string{}, c.channels...)
+}
+
+//State returns the stage of its lifecycle the client is in
+func (c *Client) State() ClientState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lifecycle.state
+}
+
+//Run listens on every channel and runs the handlers on each inbound notification until the context is done or Shutdown is called.
+//In-flight notifications are processed before it returns nil, or the error an EscalationPolicy stopped the client on.
+//Run may only be called once: it returns ErrClientRunning while another call is running and ErrClientStopped after one has returned
+func (c *Client) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if len(c.handlers.Handlers) == 0 {
+		c.mu.Unlock()
+		return ErrNoHandlers
+	}
+	switch c.lifecycle.state {
+	case ClientStopped:
+		c.mu.Unlock()
+		return ErrClientStopped
+	case ClientStarting, ClientRunning, ClientDraining:
+		c.mu.Unlock()
+		return ErrClientRunning
+	}
+	c.lifecycle.state = ClientStarting
+	c.lifecycle.stopped = make(chan struct{})
+	c.mu.Unlock()
+	defer close(c.lifecycle.stopped)
+	//the worker pool stops once every notification has been processed, after which stray invocations run on their caller's goroutine
+	defer c.workers.close()
+	//a client that returns from Run, even without being stopped, ie: failing to connect, is done: later calls fail with ErrClientStopped
+	defer func() {
+		c.lifecycle.once.Do(func() { close(c.lifecycle.stopping) })
+		c.setLifecycle(ClientStopped)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.stop()
+		case <-done:
+		}
+	}()
+	stopSources := c.runSources()
+	err := c.start()
+	stopSources()
+	c.closeBulkheads()
+	if c.isStopping() {
+		c.mu.RLock()
+		crashed := c.lifecycle.err
+		c.mu.RUnlock()
+		if crashed == nil {
+			c.writeHandover()
+		}
+		return crashed
+	}
+	return err
+}
+
+//Shutdown stops listening and waits for the handlers of every notification already received to return, or for the context to be done.
+//Shutting down a client that was never started stops it so it can't start, returning ErrClientNotStarted. Shutting down a stopped client does nothing
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.RLock()
+	state := c.lifecycle.state
+	c.mu.RUnlock()
+	c.stop()
+	c.mu.RLock()
+	stopped := c.lifecycle.stopped
+	c.mu.RUnlock()
+	if stopped == nil {
+		if state == ClientNew {
+			return ErrClientNotStarted
+		}
+		return nil
+	}
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Listen starts listening on a channel, and its aliases, without restarting the client. Listening on a channel twice does nothing
+func (c *Client) Listen(channel string) error {
+	if err := ValidateChannel(channel); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	for _, ch := range c.channels {
+		if ch == channel {
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	c.channels = append(append([]string{}, c.channels...), channel)
+	listener := c.listener
+	c.mu.Unlock()
+	c.stats.channel(channel)
+	if listener == nil {
+		return nil
+	}
+	for _, name := range c.aliases.names([]string{channel}) {
+		if err := listener.Listen(name); err != nil && err != pq.ErrChannelAlreadyOpen {
+			c.setState(name, ConnFailed, err)
+			return fmt.Errorf("failed to listen on channel: %s! %s", name, err.Error())
+		}
+		c.setState(name, ConnListening, nil)
+	}
+	if c.config.Verbose {
+		c.logf("listening on channel: %s", channel)
+	}
+	return nil
+}
+
+//Unlisten stops listening on a channel, and its aliases, without restarting the client. Notifications already received on it are still processed
+func (c *Client) Unlisten(channel string) error {
+	c.mu.Lock()
+	channels := make([]string, 0, len(c.channels))
+	for _, ch := range c.channels {
+		if ch != channel {
+			channels = append(channels, ch)
+		}
+	}
+	if len(channels) == len(c.channels) {
+		c.mu.Unlock()
+		return fmt.Errorf("not listening on channel: %s", channel)
+	}
+	c.channels = channels
+	listener := c.listener
+	c.mu.Unlock()
+	for _, name := range c.aliases.names([]string{channel}) {
+		if listener != nil {
+			if err := listener.Unlisten(name); err != nil && err != pq.ErrChannelNotOpen {
+				return fmt.Errorf("failed to unlisten on channel: %s! %s", name, err.Error())
+			}
+		}
+		c.setState(name, ConnClosed, nil)
+	}
+	if c.config.Verbose {
+		c.logf("stopped listening on channel: %s", channel)
+	}
+	return nil
+}
+
+//crash stops the client, making Run return the error. Only the first error is kept
+func (c *Client) crash(err error) {
+	c.mu.Lock()
+	if c.lifecycle.err == nil && !c.isStopping() {
+		c.lifecycle.err = err
+	}
+	c.mu.Unlock()
+	c.stop()
+}
+
+//stop signals the client to stop and closes its listener, which ends the dispatcher once it has drained every lane
+func (c *Client) stop() {
+	c.lifecycle.once.Do(func() { close(c.lifecycle.stopping) })
+	c.mu.Lock()
+	switch c.lifecycle.state {
+	case ClientNew:
+		c.lifecycle.state = ClientStopped
+	case ClientStarting, ClientRunning:
+		c.lifecycle.state = ClientDraining
+	}
+	listener := c.listener
+	c.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+//setLifecycle moves the client to a later state. Moving back, ie: to Running once Draining, does nothing
+func (c *Client) setLifecycle(state ClientState) {
+	order := map[ClientState]int{ClientNew: 0, ClientStarting: 1, ClientRunning: 2, ClientDraining: 3, ClientStopped: 4}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if order[state] > order[c.lifecycle.state] {
+		c.lifecycle.state = state
+	}
+}
+
+func (c *Client) isStopping() bool {
+	select {
+	case <-c.lifecycle.stopping:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,132 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientLifecycle(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Listen("orders"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Listen("orders"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := strings.Join(client.Channels(), ","); got != "users,orders" {
+		t.Fatalf("unexpected channels: %s", got)
+	}
+	if _, ok := client.Stats().Channels["orders"]; !ok {
+		t.Fatal("expected stats for the new channel")
+	}
+	if err := client.Unlisten("users"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Unlisten("users"); err == nil {
+		t.Fatal("expected an error unlistening a channel twice")
+	}
+	if got := strings.Join(client.Channels(), ","); got != "orders" {
+		t.Fatalf("unexpected channels: %s", got)
+	}
+	if err := client.Listen(""); err == nil {
+		t.Fatal("expected an error for an empty channel")
+	}
+
+	if err := client.Shutdown(context.Background()); err != pqstream.ErrClientNotStarted {
+		t.Fatalf("expected shutting down a client that never started to say so, got: %v", err)
+	}
+	if err := client.Run(context.Background()); err != pqstream.ErrClientStopped {
+		t.Fatalf("expected a stopped client not to run, got: %v", err)
+	}
+	if client.State() != pqstream.ClientStopped {
+		t.Fatalf("expected the client to be stopped, got: %s", client.State())
+	}
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected shutting down a stopped client to do nothing, got: %v", err)
+	}
+}
+
+func TestClientState(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	//the server accepts connections but never answers, so the client is starting until they close
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+	var conns []net.Conn
+	accepting := make(chan struct{})
+	go func() {
+		defer close(accepting)
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(server.Addr().String())
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Host: "127.0.0.1", Port: port}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.State() != pqstream.ClientNew {
+		t.Fatalf("expected a new client, got: %s", client.State())
+	}
+	done := make(chan error, 1)
+	go func() { done <- client.Run(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() == pqstream.ClientNew && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if client.State() != pqstream.ClientStarting {
+		t.Fatalf("expected the client to be starting, got: %s", client.State())
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = client.Start()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != pqstream.ErrClientRunning {
+			t.Fatalf("expected concurrent starts to fail, got: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded || client.State() != pqstream.ClientDraining {
+		t.Fatalf("expected the client to drain until its connection attempt ends, got: %s %v", client.State(), err)
+	}
+	server.Close()
+	<-accepting
+	for _, conn := range conns {
+		conn.Close()
+	}
+	<-done
+	if client.State() != pqstream.ClientStopped {
+		t.Fatalf("expected the client to be stopped, got: %s", client.State())
+	}
+	if err := client.Run(context.Background()); err != pqstream.ErrClientStopped {
+		t.Fatalf("expected a stopped client not to restart, got: %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//maxIdentifier is the longest identifier postgres accepts without truncating it (NAMEDATALEN - 1)
+const maxIdentifier = 63
+
+//PipelineConfig is the JSON document describing a deployment's pipelines, ie: {"pipelines": [{"name": "search", "channels": ["users"], "sinks": [{"type": "relay", "dsn_env": "SEARCH_DSN"}]}]}
+type PipelineConfig struct {
+	Pipelines []PipelineSpec `json:"pipelines"`
+}
+
+//PipelineSpec declares a single pipeline: the channels it sources from, the columns it filters on, the mapping reshaping its payloads, the routes
+//branching it and its sinks
+type PipelineSpec struct {
+	Name     string              `json:"name"`
+	Channels []string            `json:"channels"`
+	Columns  map[string][]string `json:"columns,omitempty"`
+	Mapping  *Mapping            `json:"mapping,omitempty"`
+	Routes   []RouteSpec         `json:"routes,omitempty"`
+	Sinks    []SinkSpec          `json:"sinks"`
+}
+
+//RouteSpec declares a pipeline branch, see Pipeline.Route: notifications meeting every When condition, or without conditions those matching no other route,
+//are mapped and delivered to the branch's sinks and routes, then merged back into the pipeline
+//
+//	routes:
+//	  - name: inserts
+//	    when:
+//	      - path: op
+//	        value: INSERT
+//	    sinks:
+//	      - type: file
+//	        dir: /var/lib/pqstream/inserts
+type RouteSpec struct {
+	Name    string          `json:"name"`
+	When    []RuleCondition `json:"when,omitempty"`
+	Mapping *Mapping        `json:"mapping,omitempty"`
+	Routes  []RouteSpec     `json:"routes,omitempty"`
+	Sinks   []SinkSpec      `json:"sinks,omitempty"`
+}
+
+//SinkSpec declares a sink. Type is one of audit, file, notify or relay. Credentials are never written in the config: DSNEnv names the environment variable holding
+//the connection string of a relay's target database
+type SinkSpec struct {
+	Type    string `json:"type"`
+	Table   string `json:"table,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	DSNEnv  string `json:"dsn_env,omitempty"`
+}
+
+//A LintIssue is a problem found in a PipelineConfig. Path locates it, ie: pipelines[0].sinks[1].table
+type LintIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s", i.Path, i.Message)
+}
+
+//LintOptions configures Lint
+type LintOptions struct {
+	//DB checks the tables the config references exist and have the columns it filters on. Nil skips schema checks
+	DB *sql.DB
+	//LookupEnv resolves the environment variables sinks take credentials from. Defaults to os.LookupEnv
+	LookupEnv func(key string) (string, bool)
+}
+
+func lintMapping(report func(path, format string, args ...interface{}), path string, mapping *Mapping) {
+	if mapping == nil {
+		return
+	}
+	for _, target := range sortedKeys(mapping.Fields) {
+		source := mapping.Fields[target]
+		if msg := lintPath(target, false); msg != "" {
+			report(fmt.Sprintf("%s.mapping.fields[%q]", path, target), "invalid target field: %s", msg)
+		}
+		if msg := lintPath(source, true); msg != "" {
+			report(fmt.Sprintf("%s.mapping.fields[%q]", path, target), "invalid source path %q: %s", source, msg)
+		}
+	}
+	for _, header := range sortedKeys(mapping.Headers) {
+		source := mapping.Headers[header]
+		if msg := lintPath(source, true); msg != "" {
+			report(fmt.Sprintf("%s.mapping.headers[%q]", path, header), "invalid source path %q: %s", source, msg)
+		}
+	}
+}
+
+func lintRoutes(report func(path, format string, args ...interface{}), lookup func(string) (string, bool), path string, routes []RouteSpec) {
+	names := map[string]bool{}
+	for i, r := range routes {
+		rpath := fmt.Sprintf("%s.routes[%d]", path, i)
+		switch {
+		case r.Name == "":
+			report(rpath+".name", "empty route name")
+		case names[r.Name]:
+			report(rpath+".name", "duplicate route name %q", r.Name)
+		}
+		names[r.Name] = true
+		for j, cond := range r.When {
+			if err := cond.validate(); err != nil {
+				report(fmt.Sprintf("%s.when[%d]", rpath, j), "condition %s", err.Error())
+			}
+		}
+		lintMapping(report, rpath, r.Mapping)
+		lintRoutes(report, lookup, rpath, r.Routes)
+		lintSinks(report, lookup, rpath, r.Sinks)
+	}
+}
+
+func lintSinks(report func(path, format string, args ...interface{}), lookup func(string) (string, bool), path string, sinks []SinkSpec) {
+	for j, s := range sinks {
+		spath := fmt.Sprintf("%s.sinks[%d]", path, j)
+		switch s.Type {
+		case "audit":
+		case "file":
+			if s.Dir == "" {
+				report(spath+".dir", "file sink requires a dir")
+			}
+		case "notify", "relay":
+			if s.Channel != "" {
+				if msg := lintIdentifier(s.Channel); msg != "" {
+					report(spath+".channel", "invalid channel %q: %s", s.Channel, msg)
+				}
+			}
+		default:
+			report(spath+".type", "unknown sink type %q", s.Type)
+		}
+		if s.Table != "" {
+			if msg := lintQualified(s.Table); msg != "" {
+				report(spath+".table", "invalid table %q: %s", s.Table, msg)
+			}
+		}
+		if s.Type == "relay" {
+			if s.DSNEnv == "" {
+				report(spath+".dsn_env", "relay sink requires dsn_env naming its target's connection string")
+			} else if v, ok := lookup(s.DSNEnv); !ok || v == "" {
+				report(spath+".dsn_env", "environment variable %s is not set", s.DSNEnv)
+			}
+		}
+	}
+}
+
+//ParsePipelineConfig decodes a pipeline config written in YAML or JSON, rejecting unknown fields so typos fail loudly
+func ParsePipelineConfig(data []byte) (*PipelineConfig, error) {
+	encoded, err := yamlToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config! %s", err.Error())
+	}
+	dec := json.NewDecoder(strings.NewReader(string(encoded)))
+	dec.DisallowUnknownFields()
+	config := &PipelineConfig{}
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config! %s", err.Error())
+	}
+	return config, nil
+}
+
+//Lint validates a pipeline config before it's deployed: channel names, SQL identifiers, the presence of sink credentials, mapping paths and, given a DB,
+//the tables and columns it references. It returns every issue found rather than stopping at the first
+func Lint(ctx context.Context, config *PipelineConfig, opts LintOptions) ([]LintIssue, error) {
+	lookup := opts.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	var issues []LintIssue
+	report := func(path, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if len(config.Pipelines) == 0 {
+		report("pipelines", "no pipelines")
+	}
+	names := map[string]bool{}
+	tables := map[string]string{}
+	for i, p := range config.Pipelines {
+		path := fmt.Sprintf("pipelines[%d]", i)
+		switch {
+		case p.Name == "":
+			report(path+".name", "empty pipeline name")
+		case names[p.Name]:
+			report(path+".name", "duplicate pipeline name %q", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Channels) == 0 {
+			report(path+".channels", "no source channels")
+		}
+		for j, ch := range p.Channels {
+			if msg := lintIdentifier(ch); msg != "" {
+				report(fmt.Sprintf("%s.channels[%d]", path, j), "invalid channel %q: %s", ch, msg)
+			}
+		}
+		for _, key := range sortedKeys(p.Columns) {
+			columns := p.Columns[key]
+			if msg := lintQualified(key); msg != "" {
+				report(fmt.Sprintf("%s.columns[%q]", path, key), "invalid table %q: %s", key, msg)
+			} else if strings.Contains(key, ".") {
+				tables[key] = fmt.Sprintf("%s.columns[%q]", path, key)
+			}
+			if len(columns) == 0 {
+				report(fmt.Sprintf("%s.columns[%q]", path, key), "no columns")
+			}
+			for _, col := range columns {
+				if msg := lintIdentifier(col); msg != "" {
+					report(fmt.Sprintf("%s.columns[%q]", path, key), "invalid column %q: %s", col, msg)
+				}
+			}
+		}
+		lintMapping(report, path, p.Mapping)
+		if len(p.Sinks) == 0 && len(p.Routes) == 0 {
+			report(path+".sinks", "no sinks")
+		}
+		lintRoutes(report, lookup, path, p.Routes)
+		lintSinks(report, lookup, path, p.Sinks)
+	}
+	if opts.DB == nil {
+		return issues, nil
+	}
+	for _, p := range config.Pipelines {
+		for _, key := range sortedKeys(p.Columns) {
+			columns := p.Columns[key]
+			path, ok := tables[key]
+			if !ok {
+				continue
+			}
+			existing, err := tableColumns(ctx, opts.DB, key)
+			if err != nil {
+				return issues, err
+			}
+			if len(existing) == 0 {
+				report(path, "table %s does not exist", key)
+				continue
+			}
+			for _, col := range columns {
+				if !existing[col] {
+					report(path, "table %s has no column %s", key, col)
+				}
+			}
+		}
+	}
+	return issues, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func tableColumns(ctx context.Context, db *sql.DB, qualified string) (map[string]bool, error) {
+	parts := strings.SplitN(qualified, ".", 2)
+	rows, err := db.QueryContext(ctx, "SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2", parts[0], parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s! %s", qualified, err.Error())
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+//lintIdentifier describes why name isn't usable as a postgres identifier, or returns an empty string
+func lintIdentifier(name string) string {
+	switch {
+	case name == "":
+		return "empty identifier"
+	case len(name) > maxIdentifier:
+		return fmt.Sprintf("longer than %d bytes, postgres would truncate it", maxIdentifier)
+	case strings.ContainsRune(name, 0):
+		return "contains a NUL byte"
+	case !utf8.ValidString(name):
+		return "isn't valid UTF-8"
+	}
+	return ""
+}
+
+//lintQualified describes why name isn't a table or schema.table, or returns an empty string
+func lintQualified(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return "expected table or schema.table"
+	}
+	for _, part := range parts {
+		if msg := lintIdentifier(part); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+//lintPath describes why path isn't a valid mapping path, or returns an empty string. Source paths may also be one of the $ notification references
+func lintPath(path string, source bool) string {
+	if strings.HasPrefix(path, "$") {
+		switch {
+		case !source:
+			return "target fields can't reference the notification"
+		case path == "$channel", path == "$pid", path == "$payload":
+			return ""
+		}
+		return fmt.Sprintf("unknown reference %s, expected $channel, $pid or $payload", path)
+	}
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return "empty path segment"
+		}
+	}
+	return ""
+}
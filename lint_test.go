@@ -0,0 +1,91 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	config, err := pqstream.ParsePipelineConfig([]byte(`{"pipelines": [
+	{"name": "search", "channels": ["users"], "columns": {"public.users": ["email"]},
+	 "mapping": {"fields": {"id": "data.id", "channel": "$channel"}},
+	 "sinks": [{"type": "relay", "dsn_env": "SEARCH_DSN"}, {"type": "file", "dir": "/tmp/search"}]}
+]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	env := func(key string) (string, bool) { return "postgres://search", key == "SEARCH_DSN" }
+	issues, err := pqstream.Lint(context.Background(), config, pqstream.LintOptions{LookupEnv: env})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(issues) != 0 {
+		t.Fatalf("expected a valid config, got %v", issues)
+	}
+
+	config, err = pqstream.ParsePipelineConfig([]byte(`{"pipelines": [
+	{"name": "search", "channels": ["", "` + strings.Repeat("x", 64) + `"], "columns": {"a.b.c": ["email"]},
+	 "mapping": {"fields": {"id": "data..id", "pid": "$bepid"}},
+	 "sinks": [{"type": "relay", "dsn_env": "MISSING"}, {"type": "kafka"}, {"type": "audit", "table": "audit."}]},
+	{"name": "search", "channels": ["users"]}
+]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	issues, err = pqstream.Lint(context.Background(), config, pqstream.LintOptions{LookupEnv: env})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.Path)
+	}
+	want := []string{
+		"pipelines[0].channels[0]",
+		"pipelines[0].channels[1]",
+		`pipelines[0].columns["a.b.c"]`,
+		`pipelines[0].mapping.fields["id"]`,
+		`pipelines[0].mapping.fields["pid"]`,
+		"pipelines[0].sinks[0].dsn_env",
+		"pipelines[0].sinks[1].type",
+		"pipelines[0].sinks[2].table",
+		"pipelines[1].name",
+		"pipelines[1].sinks",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected issues:\n%v", issues)
+	}
+
+	if _, err := pqstream.ParsePipelineConfig([]byte(`{"pipelines": [{"nmae": "typo"}]}`)); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
+
+func TestParsePipelineConfigYAML(t *testing.T) {
+	config, err := pqstream.ParsePipelineConfig([]byte(`
+pipelines:
+  - name: search
+    channels: [users]
+    columns:
+      public.users: [email]
+    mapping:
+      fields:
+        id: data.id
+        channel: $channel
+    sinks:
+      - type: relay
+        dsn_env: SEARCH_DSN
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	spec := config.Pipelines[0]
+	if spec.Name != "search" || spec.Channels[0] != "users" || spec.Columns["public.users"][0] != "email" || spec.Mapping.Fields["channel"] != "$channel" || spec.Sinks[0].DSNEnv != "SEARCH_DSN" {
+		t.Fatalf("unexpected config: %+v", spec)
+	}
+	if _, err := pqstream.ParsePipelineConfig([]byte("pipelines:\n  - nmae: typo\n")); err == nil {
+		t.Fatal("expected unknown fields to be rejected")
+	}
+}
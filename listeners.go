@@ -0,0 +1,172 @@
+package pqstream
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"time"
+)
+
+//ConnState is the connection state of a channel's listener
+type ConnState string
+
+const (
+	//ConnConnecting is the state of a listener that hasn't connected yet
+	ConnConnecting ConnState = "connecting"
+	//ConnListening is the state of a connected listener that has registered LISTEN
+	ConnListening ConnState = "listening"
+	//ConnReconnecting is the state of a listener that lost its connection and is retrying
+	ConnReconnecting ConnState = "reconnecting"
+	//ConnFailed is the state of a listener that could not LISTEN on its channel
+	ConnFailed ConnState = "failed"
+	//ConnClosed is the state of a listener that has been closed
+	ConnClosed ConnState = "closed"
+)
+
+//ListenerState is a snapshot of a single channel's listener
+type ListenerState struct {
+	Channel    string    `json:"channel"`
+	State      ConnState `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	//Attempts is the number of failed connection attempts since the listener went down
+	Attempts int `json:"attempts,omitempty"`
+	//Event is the listener event that last changed the state, ie: "disconnected", or "terminated" if the server terminated the backend
+	Event string `json:"event,omitempty"`
+	//Downtime is how long the listener has been down, or was down before it last reconnected
+	Downtime  time.Duration `json:"downtime,omitempty"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+//A ReconnectError is reported to the ErrorHandler when a channel's listener loses its connection or fails to reconnect
+type ReconnectError struct {
+	Channel  string
+	Event    string
+	Attempt  int
+	Downtime time.Duration
+	Err      error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("listener %s on channel: %s (attempt %d, down %s)! %s", e.Event, e.Channel, e.Attempt, e.Downtime.Round(time.Millisecond), e.Err.Error())
+}
+
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+//ReconnectHandlerFunc is called with a channel's listener state after every connection event
+type ReconnectHandlerFunc func(state ListenerState)
+
+//eventName returns a readable name for a pq listener event
+func eventName(event pq.ListenerEventType) string {
+	switch event {
+	case pq.ListenerEventConnected:
+		return "connected"
+	case pq.ListenerEventDisconnected:
+		return "disconnected"
+	case pq.ListenerEventReconnected:
+		return "reconnected"
+	case pq.ListenerEventConnectionAttemptFailed:
+		return "connection attempt failed"
+	}
+	return fmt.Sprintf("event %d", event)
+}
+
+//ListenersSnapshot returns a copy of every channel's listener state, sorted by channel, that is safe to inspect while the client is running
+func (c *Client) ListenersSnapshot() []ListenerState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]ListenerState, 0, len(c.states))
+	for _, state := range c.states {
+		out = append(out, *state)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Channel < out[j].Channel })
+	return out
+}
+
+//setListener registers the client's listener connection
+func (c *Client) setListener(l *pq.Listener) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = l
+}
+
+//setState records a transition of a channel's listener
+func (c *Client) setState(channel string, state ConnState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.states[channel]
+	if !ok {
+		s = &ListenerState{Channel: channel}
+		c.states[channel] = s
+	}
+	c.publishState(channel, s.State, state)
+	if state == ConnListening && s.State == ConnReconnecting {
+		s.Reconnects++
+		s.Downtime = c.config.Clock.Now().Sub(s.Since)
+	}
+	if s.State != state {
+		s.State = state
+		s.Since = c.config.Clock.Now()
+	}
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+//onListenerEvent maps pq listener events onto the state of every channel sharing the connection, returning each channel's new state.
+//A disconnect caused by the server terminating the backend is recorded as a "terminated" event
+func (c *Client) onListenerEvent(channels []string, event pq.ListenerEventType, err error) []ListenerState {
+	states := make([]ListenerState, 0, len(channels))
+	name := eventName(event)
+	termination, terminated := c.termination(channels, event, err)
+	if terminated {
+		name = "terminated"
+	}
+	for _, channel := range channels {
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			c.setState(channel, ConnListening, err)
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			c.setState(channel, ConnReconnecting, err)
+		}
+		c.collector().ObserveListener(channel, name)
+		states = append(states, c.recordEvent(channel, event, name))
+	}
+	if terminated {
+		c.onTermination(termination)
+	}
+	return states
+}
+
+//recordEvent tracks the attempts and downtime of a channel's listener across connection events
+func (c *Client) recordEvent(channel string, event pq.ListenerEventType, name string) ListenerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.states[channel]
+	s.Event = name
+	switch event {
+	case pq.ListenerEventConnectionAttemptFailed:
+		s.Attempts++
+		s.Downtime = c.config.Clock.Now().Sub(s.Since)
+	case pq.ListenerEventDisconnected:
+		s.Attempts = 0
+		s.Downtime = 0
+	case pq.ListenerEventReconnected:
+		s.Attempts = 0
+	}
+	return *s
+}
+
+//reportListenerEvent passes connection errors to the ErrorHandler with each channel's attempt count and downtime, and states to the ReconnectHandler
+func (c *Client) reportListenerEvent(states []ListenerState, err error) {
+	for _, s := range states {
+		if err != nil {
+			c.handleErr(s.Channel, &ReconnectError{Channel: s.Channel, Event: s.Event, Attempt: s.Attempts, Downtime: s.Downtime, Err: err})
+		}
+		if c.handlers.ReconnectHandler != nil {
+			c.handlers.ReconnectHandler(s)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package pqstream
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListenerStates(t *testing.T) {
+	c, err := NewClient([]string{"users", "accounts"}, &Config{}, &HandlerSet{Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	wg := sync.WaitGroup{}
+	for _, ch := range []string{"users", "accounts"} {
+		wg.Add(1)
+		go func(ch string) {
+			defer wg.Done()
+			c.setState(ch, ConnConnecting, nil)
+			c.setListener(nil)
+			c.onListenerEvent([]string{ch}, pq.ListenerEventConnected, nil)
+			c.onListenerEvent([]string{ch}, pq.ListenerEventDisconnected, errors.New("connection reset"))
+			c.onListenerEvent([]string{ch}, pq.ListenerEventReconnected, nil)
+		}(ch)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = c.ListenersSnapshot()
+		}()
+	}
+	wg.Wait()
+	states := c.ListenersSnapshot()
+	if len(states) != 2 || states[0].Channel != "accounts" {
+		t.Fatalf("unexpected listener states: %+v", states)
+	}
+	for _, s := range states {
+		if s.State != ConnListening || s.Reconnects != 1 || s.LastError != "connection reset" {
+			t.Fatalf("unexpected listener state: %+v", s)
+		}
+	}
+}
+
+func TestReconnectErrors(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	var (
+		errs   []error
+		events []ListenerState
+	)
+	c, err := NewClient([]string{"users"}, &Config{Clock: clock}, &HandlerSet{
+		Handlers:         []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })},
+		ErrorHandler:     func(err error) { errs = append(errs, err) },
+		ReconnectHandler: func(state ListenerState) { events = append(events, state) },
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	channels := []string{"users"}
+	c.setState("users", ConnConnecting, nil)
+	c.reportListenerEvent(c.onListenerEvent(channels, pq.ListenerEventConnected, nil), nil)
+	reset := errors.New("connection reset")
+	c.reportListenerEvent(c.onListenerEvent(channels, pq.ListenerEventDisconnected, reset), reset)
+	refused := errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		clock.Advance(5 * time.Second)
+		c.reportListenerEvent(c.onListenerEvent(channels, pq.ListenerEventConnectionAttemptFailed, refused), refused)
+	}
+	clock.Advance(5 * time.Second)
+	c.reportListenerEvent(c.onListenerEvent(channels, pq.ListenerEventReconnected, nil), nil)
+
+	if len(errs) != 3 {
+		t.Fatalf("expected an error per failed event, got %v", errs)
+	}
+	var rerr *ReconnectError
+	if !errors.As(errs[2], &rerr) || rerr.Channel != "users" || rerr.Event != "connection attempt failed" || rerr.Attempt != 2 || rerr.Downtime != 10*time.Second || !errors.Is(errs[2], refused) {
+		t.Fatalf("unexpected reconnect error: %+v", errs[2])
+	}
+	if errs[2].Error() != "listener connection attempt failed on channel: users (attempt 2, down 10s)! connection refused" {
+		t.Fatalf("unexpected error message: %s", errs[2].Error())
+	}
+	last := events[len(events)-1]
+	if len(events) != 5 || last.Event != "reconnected" || last.Attempts != 0 || last.Downtime != 15*time.Second || last.Reconnects != 1 {
+		t.Fatalf("unexpected reconnect events: %+v", events)
+	}
+}
+
+func TestChannelEvents(t *testing.T) {
+	c, err := NewClient([]string{"users"}, &Config{}, &HandlerSet{Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	events, cancel := c.Events(0)
+	defer cancel()
+	c.setState("users", ConnConnecting, nil)
+	c.onListenerEvent([]string{"users"}, pq.ListenerEventConnected, nil)
+	c.onListenerEvent([]string{"users"}, pq.ListenerEventDisconnected, errors.New("connection reset"))
+	c.onListenerEvent([]string{"users"}, pq.ListenerEventConnectionAttemptFailed, errors.New("connection refused"))
+	c.onListenerEvent([]string{"users"}, pq.ListenerEventReconnected, nil)
+	c.setState("users", ConnClosed, nil)
+	var got []string
+	for len(events) > 0 {
+		e := <-events
+		got = append(got, string(e.Type)+":"+string(e.State))
+	}
+	want := "channel_up:listening channel_down:reconnecting channel_up:listening channel_down:closed"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("unexpected channel events: %v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package pqstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+//A Mapping reshapes notification payloads for a sink without a custom handler. Fields maps a target field to a source path and Headers maps a header name to one,
+//ie: {"fields": {"doc.id": "data.id", "doc.name": "data.user.name", "channel": "$channel"}, "headers": {"x-tenant": "data.tenant"}}.
+//Paths are dot separated, numeric segments index arrays, and $channel, $pid and $payload refer to the notification itself. Dotted target fields build nested objects.
+//Missing source paths are omitted
+type Mapping struct {
+	Fields  map[string]string `json:"fields"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+//ParseMapping decodes a JSON mapping, ie: from a config file
+func ParseMapping(data []byte) (*Mapping, error) {
+	m := &Mapping{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping! %s", err.Error())
+	}
+	for target, source := range m.Fields {
+		if target == "" || source == "" {
+			return nil, fmt.Errorf("invalid mapping field: %q -> %q", target, source)
+		}
+	}
+	return m, nil
+}
+
+//Apply maps a notification's payload into a new document
+func (m *Mapping) Apply(notification *pq.Notification) (map[string]any, error) {
+	payload, err := decodePayload(notification)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	for target, source := range m.Fields {
+		value, ok := resolve(notification, payload, source)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(target, ".")
+		node := out
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+	return out, nil
+}
+
+//MapHeaders returns the mapped headers of a notification, formatting non-string values as JSON
+func (m *Mapping) MapHeaders(notification *pq.Notification) (map[string]string, error) {
+	payload, err := decodePayload(notification)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{}
+	for name, source := range m.Headers {
+		value, ok := resolve(notification, payload, source)
+		if !ok {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			headers[name] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		headers[name] = string(encoded)
+	}
+	return headers, nil
+}
+
+//Transform returns a pipeline transform replacing each payload with its mapped document
+func (m *Mapping) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		doc, err := m.Apply(notification)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(payload)}, nil
+	}
+}
+
+//decodePayload decodes a JSON payload keeping numbers as json.Number, or returns nil for payloads that aren't JSON so only $ sources resolve
+func decodePayload(notification *pq.Notification) (any, error) {
+	if !json.Valid([]byte(notification.Extra)) {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(notification.Extra)))
+	dec.UseNumber()
+	var payload any
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func resolve(notification *pq.Notification, payload any, path string) (any, bool) {
+	switch path {
+	case "$channel":
+		return notification.Channel, true
+	case "$pid":
+		return notification.BePid, true
+	case "$payload":
+		if payload == nil {
+			return notification.Extra, true
+		}
+		return payload, true
+	}
+	node := payload
+	for _, part := range strings.Split(path, ".") {
+		switch v := node.(type) {
+		case map[string]any:
+			child, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			node = child
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			node = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
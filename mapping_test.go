@@ -0,0 +1,35 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestMapping(t *testing.T) {
+	mapping, err := pqstream.ParseMapping([]byte(`{
+		"fields": {"doc.id": "data.id", "doc.name": "data.user.name", "doc.first_tag": "data.tags.0", "source": "$channel", "missing": "data.nope"},
+		"headers": {"x-tenant": "data.tenant", "x-id": "data.id"}
+	}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n := &pq.Notification{Channel: "users", Extra: `{"data": {"id": 9007199254740993, "tenant": "acme", "user": {"name": "bob"}, "tags": ["a", "b"]}}`}
+	transformed, err := mapping.Transform()(n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := `{"doc":{"first_tag":"a","id":9007199254740993,"name":"bob"},"source":"users"}`; transformed.Extra != want {
+		t.Fatalf("expected %s, got: %s", want, transformed.Extra)
+	}
+	headers, err := mapping.MapHeaders(n)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if headers["x-tenant"] != "acme" || headers["x-id"] != "9007199254740993" {
+		t.Fatalf("unexpected headers: %v", headers)
+	}
+	if _, err := pqstream.ParseMapping([]byte(`{"fields": {"id": ""}}`)); err == nil {
+		t.Fatal("expected an error for an empty source path")
+	}
+}
@@ -0,0 +1,108 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+//A Marshaler converts notifications into a sink's wire format. Built-in sinks accept one so output formats are consistent and swappable;
+//ProtobufMarshaler is built in, and formats such as Avro can be plugged in by implementing it. Sinks negotiate theirs with a Pipeline, see EncodingSink
+type Marshaler interface {
+	//ContentType is the media type of the marshaled output, ie: for an HTTP Content-Type header
+	ContentType() string
+	//Marshal encodes a notification received at the given time
+	Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error)
+}
+
+//RawMarshaler passes payloads through unchanged
+type RawMarshaler struct{}
+
+//ContentType returns text/plain, since payloads may be any text
+func (RawMarshaler) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+//Marshal returns the notification's payload
+func (RawMarshaler) Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	return []byte(notification.Extra), nil
+}
+
+//RecordMarshaler encodes notifications as JSON Records, the format FileSink and Replayer share by default
+type RecordMarshaler struct{}
+
+//ContentType returns application/json
+func (RecordMarshaler) ContentType() string {
+	return "application/json"
+}
+
+//Marshal encodes the notification as a Record
+func (RecordMarshaler) Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	return json.Marshal(NewRecord(notification, receivedAt))
+}
+
+//CloudEventsMarshaler encodes notifications as CloudEvents 1.0 in structured JSON mode. Enveloped payloads keep their id and emitted_at as the event's id and time,
+//and change events are typed by table and operation with the table as the subject
+type CloudEventsMarshaler struct {
+	//Source is the event source URI, ie: //postgres/mydb. Defaults to pqstream
+	Source string
+	//TypePrefix starts every event type. Defaults to pqstream.
+	TypePrefix string
+}
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+//ContentType returns application/cloudevents+json
+func (CloudEventsMarshaler) ContentType() string {
+	return "application/cloudevents+json"
+}
+
+//Marshal encodes the notification as a CloudEvent
+func (m CloudEventsMarshaler) Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	source, prefix := m.Source, m.TypePrefix
+	if source == "" {
+		source = "pqstream"
+	}
+	if prefix == "" {
+		prefix = "pqstream."
+	}
+	e := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              fmt.Sprintf("%s-%d-%d", notification.Channel, notification.BePid, receivedAt.UnixNano()),
+		Source:          source,
+		Type:            prefix + notification.Channel,
+		Time:            receivedAt.UTC(),
+		DataContentType: "application/json",
+	}
+	if envelope := envelopeOf(notification); envelope != nil {
+		if envelope.ID != "" {
+			e.ID = envelope.ID
+		}
+		if !envelope.EmittedAt.IsZero() {
+			e.Time = envelope.EmittedAt.UTC()
+		}
+	}
+	if change, err := ParseChange(notification); err == nil {
+		e.Type = prefix + change.QualifiedTable() + "." + strings.ToLower(string(change.Op))
+		e.Subject = change.QualifiedTable()
+	}
+	if json.Valid([]byte(notification.Extra)) {
+		e.Data = json.RawMessage(notification.Extra)
+	} else {
+		e.DataContentType = "text/plain"
+		e.DataBase64 = []byte(notification.Extra)
+	}
+	return json.Marshal(e)
+}
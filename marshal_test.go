@@ -0,0 +1,64 @@
+package pqstream_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloudEventsMarshaler(t *testing.T) {
+	m := pqstream.CloudEventsMarshaler{Source: "//postgres/app"}
+	at := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	raw, err := m.Marshal(&pq.Notification{Channel: "changes", BePid: 7, Extra: `{"schema": "public", "table": "users", "op": "UPDATE", "new": {"id": 1}}`}, at)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var e map[string]any
+	if err := json.Unmarshal(raw, &e); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e["specversion"] != "1.0" || e["source"] != "//postgres/app" || e["type"] != "pqstream.public.users.update" || e["subject"] != "public.users" || e["time"] != "2020-01-02T15:04:05Z" {
+		t.Fatalf("unexpected cloud event: %s", raw)
+	}
+	raw, _ = m.Marshal(&pq.Notification{Channel: "users", Extra: `{"id": "abc", "emitted_at": "2019-01-01T00:00:00Z"}`}, at)
+	json.Unmarshal(raw, &e)
+	if e["id"] != "abc" || e["time"] != "2019-01-01T00:00:00Z" || e["type"] != "pqstream.users" {
+		t.Fatalf("expected an enveloped payload to keep its id and time: %s", raw)
+	}
+	raw, _ = m.Marshal(&pq.Notification{Channel: "users", Extra: "plain"}, at)
+	json.Unmarshal(raw, &e)
+	if e["datacontenttype"] != "text/plain" || e["data_base64"] != "cGxhaW4=" {
+		t.Fatalf("expected a non-json payload to be base64 encoded: %s", raw)
+	}
+}
+
+func TestFileSinkMarshaler(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, Marshaler: pqstream.CloudEventsMarshaler{}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: `{"id": 1}`})
+	sink.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	if len(files) != 1 {
+		t.Fatalf("expected one file, got: %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	var e map[string]any
+	if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e["type"] != "pqstream.users" {
+		t.Fatalf("expected the file to hold cloud events, got: %s", scanner.Bytes())
+	}
+}
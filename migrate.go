@@ -0,0 +1,397 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//defaultMigrationsTable is the version table golang-migrate uses by default, so the two tools can share a database
+const defaultMigrationsTable = "schema_migrations"
+
+//defaultEmitFunction is the function sending enveloped notifications when MigrationOptions.EmitFunction is unset
+const defaultEmitFunction = "pqstream_emit"
+
+//defaultNotifyFunction is the trigger function emitting ChangeEvents when MigrationOptions.NotifyFunction is unset
+const defaultNotifyFunction = "pqstream_notify"
+
+//defaultIDFunction is the function generating the emit function's envelope IDs when MigrationOptions.IDFunction is unset
+const defaultIDFunction = "pqstream_uuidv7"
+
+//A Migration is a single versioned, idempotent schema change. Up and Down are plain SQL, so migrations can be written out as golang-migrate files or applied with a Migrator
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+//MigrationOptions names the objects the library's migrations create. Empty names default to the ones each feature uses when unconfigured
+type MigrationOptions struct {
+	AuditTable     string
+	HeartbeatTable string
+	HandoffTable   string
+	//NotifyFunction is the trigger function that sends a ChangeEvent for each changed row to the channel given as its first argument. Defaults to pqstream_notify
+	NotifyFunction string
+	//EmitFunction is the function that sends its data to a channel as an Envelope tagged with a source, as Notify does. Defaults to pqstream_emit
+	EmitFunction string
+	//SequenceTable holds the last sequence number the emit function assigned each channel. Defaults to pqstream_sequences
+	SequenceTable string
+	//OutboxTable is the table durable producers insert notifications into, see Outbox. Defaults to pqstream_outbox
+	OutboxTable string
+	//CheckpointTable holds the last outbox position each consumer has processed on each channel. Defaults to pqstream_checkpoints
+	CheckpointTable string
+	//HandoverTable holds the HandoverToken a client writes as it stops, see TableHandover. Defaults to pqstream_handover
+	HandoverTable string
+	//ConsumersTable is the table each client's Presence registers it in. Defaults to pqstream_consumers
+	ConsumersTable string
+	//PayloadTable holds the payloads too large to notify that NotifyWith staged with OversizeStage. Defaults to pqstream_payloads
+	PayloadTable string
+	//StateTable records the triggers and outboxes a Reconciler manages. Defaults to pqstream_state
+	StateTable string
+	//DeadLetterTable holds the notifications handlers failed on, see DeadLetterTable. Defaults to pqstream_dead_letters
+	DeadLetterTable string
+	//AttemptsTable counts the attempts at each notification a Quarantine has seen, see TableAttempts. Defaults to pqstream_attempts
+	AttemptsTable string
+	//SpoolTable holds the notifications a DrainPolicy spooled as a client shut down, see TableSpool. Defaults to pqstream_spool
+	SpoolTable string
+	//IDFunction is the SQL function, returning text or uuid, the emit function generates envelope IDs with, ie: an extension's ULID generator.
+	//Defaults to pqstream_uuidv7, which the migrations create
+	IDFunction string
+}
+
+func (o MigrationOptions) sequenceTable() string {
+	if o.SequenceTable == "" {
+		return "pqstream_sequences"
+	}
+	return o.SequenceTable
+}
+
+//outbox returns the outbox table's name and the trigger function notifying its rows, named after the table
+func (o MigrationOptions) outbox() (string, string) {
+	table := (&Outbox{Table: o.OutboxTable}).table()
+	return table, table + "_notify"
+}
+
+func (o MigrationOptions) emitFunction() string {
+	if o.EmitFunction == "" {
+		return defaultEmitFunction
+	}
+	return o.EmitFunction
+}
+
+func (o MigrationOptions) idFunction() string {
+	if o.IDFunction == "" {
+		return defaultIDFunction
+	}
+	return o.IDFunction
+}
+
+func (o MigrationOptions) notifyFunction() string {
+	if o.NotifyFunction == "" {
+		return defaultNotifyFunction
+	}
+	return o.NotifyFunction
+}
+
+//Migrations returns the SQL every feature of the library needs, in version order. Versions are stable across releases: new infrastructure is only ever appended
+func Migrations(opts MigrationOptions) []Migration {
+	heartbeat := &Heartbeat{Table: opts.HeartbeatTable}
+	handoff := &Handoff{Table: opts.HandoffTable}
+	audit := &AuditSink{Table: opts.AuditTable}
+	checkpoints := &TableCheckpoints{Table: opts.CheckpointTable}
+	outbox, outboxNotify := opts.outbox()
+	handover := &TableHandover{Table: opts.HandoverTable}
+	presence := &Presence{Table: opts.ConsumersTable}
+	state := &Reconciler{Table: opts.StateTable}
+	deadLetters := &DeadLetterTable{Table: opts.DeadLetterTable}
+	attempts := &TableAttempts{Table: opts.AttemptsTable}
+	spool := &TableSpool{Table: opts.SpoolTable}
+	payloads := NotifyOptions{StagingTable: opts.PayloadTable}.stagingTable()
+	emit := fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s(channel text, source text, data json) RETURNS void LANGUAGE plpgsql AS $$
+BEGIN
+	PERFORM pg_notify(channel, json_build_object(
+		'id', md5(random()::text || clock_timestamp()::text),
+		'emitted_at', clock_timestamp(),
+		'source', source,
+		'data', data
+	)::text);
+END
+$$`, quoteQualified(opts.emitFunction()))
+	//sequencedEmit is the emit function assigning sequence numbers, generating ids with the SQL expression
+	sequencedEmit := func(id string) string {
+		return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s(channel text, source text, data json) RETURNS void LANGUAGE plpgsql AS $$
+DECLARE
+	assigned bigint;
+BEGIN
+	INSERT INTO %s AS s (channel, seq) VALUES (channel, 1)
+	ON CONFLICT ON CONSTRAINT %s DO UPDATE SET seq = s.seq + 1
+	RETURNING s.seq INTO assigned;
+	PERFORM pg_notify(channel, json_build_object(
+		'id', %s,
+		'emitted_at', clock_timestamp(),
+		'source', source,
+		'seq', assigned,
+		'data', data
+	)::text);
+END
+$$`, quoteQualified(opts.emitFunction()), quoteQualified(opts.sequenceTable()), pq.QuoteIdentifier(unqualified(opts.sequenceTable())+"_pkey"), id)
+	}
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "pqstream_notify_function",
+			Up: fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+	PERFORM pg_notify(TG_ARGV[0], json_build_object(
+		'schema', TG_TABLE_SCHEMA,
+		'table', TG_TABLE_NAME,
+		'op', TG_OP,
+		'old', CASE WHEN TG_OP <> 'INSERT' THEN row_to_json(OLD) END,
+		'new', CASE WHEN TG_OP <> 'DELETE' THEN row_to_json(NEW) END
+	)::text);
+	RETURN NULL;
+END
+$$`, quoteQualified(opts.notifyFunction())),
+			Down: fmt.Sprintf("DROP FUNCTION IF EXISTS %s()", quoteQualified(opts.notifyFunction())),
+		},
+		{Version: 2, Name: "pqstream_heartbeat", Up: heartbeat.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(heartbeat.table()))},
+		{Version: 3, Name: "pqstream_handoff", Up: handoff.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(handoff.table()))},
+		{Version: 4, Name: "pqstream_audit", Up: audit.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(audit.table()))},
+		{Version: 5, Name: "pqstream_emit_function", Up: emit, Down: fmt.Sprintf("DROP FUNCTION IF EXISTS %s(text, text, json)", quoteQualified(opts.emitFunction()))},
+		{
+			//sequence numbers come from a counter row rather than a postgres sequence: the row stays locked until the emitting transaction commits, so numbers are
+			//assigned in commit order, the order notifications are delivered in, and a rolled back transaction gives its number back instead of leaving a false gap
+			Version: 6,
+			Name:    "pqstream_sequences",
+			Up: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	channel text PRIMARY KEY,
+	seq bigint NOT NULL
+);
+%s`, quoteQualified(opts.sequenceTable()), sequencedEmit("md5(random()::text || clock_timestamp()::text)")),
+			Down: emit + ";\n" + fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(opts.sequenceTable())),
+		},
+		{
+			//outbox positions share the emit function's per channel counters, so they are assigned in commit order too and double as the envelope's seq
+			Version: 7,
+			Name:    "pqstream_outbox",
+			Up: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	channel text NOT NULL,
+	position bigint NOT NULL,
+	source text NOT NULL DEFAULT 'application',
+	data json,
+	created_at timestamptz NOT NULL DEFAULT clock_timestamp(),
+	PRIMARY KEY (channel, position)
+);
+CREATE TABLE IF NOT EXISTS %[2]s (
+	consumer text NOT NULL,
+	channel text NOT NULL,
+	position bigint NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (consumer, channel)
+);
+CREATE OR REPLACE FUNCTION %[3]s() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+	assigned bigint;
+BEGIN
+	IF TG_WHEN = 'BEFORE' THEN
+		INSERT INTO %[4]s AS s (channel, seq) VALUES (NEW.channel, 1)
+		ON CONFLICT ON CONSTRAINT %[5]s DO UPDATE SET seq = s.seq + 1
+		RETURNING s.seq INTO assigned;
+		NEW.position := assigned;
+		RETURN NEW;
+	END IF;
+	PERFORM pg_notify(NEW.channel, %[6]s);
+	RETURN NULL;
+END
+$$;
+DROP TRIGGER IF EXISTS pqstream_outbox_position ON %[1]s;
+CREATE TRIGGER pqstream_outbox_position BEFORE INSERT ON %[1]s FOR EACH ROW EXECUTE PROCEDURE %[3]s();
+DROP TRIGGER IF EXISTS pqstream_outbox_notify ON %[1]s;
+CREATE TRIGGER pqstream_outbox_notify AFTER INSERT ON %[1]s FOR EACH ROW EXECUTE PROCEDURE %[3]s()`,
+				quoteQualified(outbox), quoteQualified(checkpoints.table()), quoteQualified(outboxNotify), quoteQualified(opts.sequenceTable()),
+				pq.QuoteIdentifier(unqualified(opts.sequenceTable())+"_pkey"), outboxEnvelope("NEW")),
+			Down: fmt.Sprintf("DROP TABLE IF EXISTS %s;\nDROP FUNCTION IF EXISTS %s();\nDROP TABLE IF EXISTS %s", quoteQualified(outbox), quoteQualified(outboxNotify), quoteQualified(checkpoints.table())),
+		},
+		{
+			Version: 8,
+			Name:    "pqstream_payloads",
+			Up: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id text PRIMARY KEY,
+	channel text NOT NULL,
+	data json,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (created_at)`, quoteQualified(payloads), pq.QuoteIdentifier(unqualified(payloads)+"_created_at")),
+			Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(payloads)),
+		},
+		{
+			Version: 9,
+			Name:    "pqstream_handover",
+			Up: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	key text PRIMARY KEY,
+	token json NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+)`, quoteQualified(handover.table())),
+			Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(handover.table())),
+		},
+		{Version: 10, Name: "pqstream_consumers", Up: presence.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(presence.table()))},
+		{Version: 11, Name: "pqstream_state", Up: state.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(state.table()))},
+		{Version: 12, Name: "pqstream_dead_letters", Up: deadLetters.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(deadLetters.table()))},
+		{Version: 13, Name: "pqstream_attempts", Up: attempts.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(attempts.table()))},
+		{Version: 14, Name: "pqstream_spool", Up: spool.ddl(), Down: fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteQualified(spool.table()))},
+		{
+			//the version and variant bits of a random v4 UUID are rewritten to v7's after its first 48 bits are replaced by the millisecond timestamp.
+			//gen_random_uuid is built in from postgres 13, older servers need pgcrypto
+			Version: 15,
+			Name:    "pqstream_ids",
+			Up: fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS uuid LANGUAGE sql VOLATILE AS $$
+	SELECT encode(set_bit(set_bit(overlay(uuid_send(gen_random_uuid()) PLACING substring(int8send(floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint) FROM 3) FROM 1 FOR 6), 52, 1), 53, 1), 'hex')::uuid
+$$;
+%s`, quoteQualified(defaultIDFunction), sequencedEmit(quoteQualified(opts.idFunction())+"()")),
+			Down: sequencedEmit("md5(random()::text || clock_timestamp()::text)") + ";\n" + fmt.Sprintf("DROP FUNCTION IF EXISTS %s()", quoteQualified(defaultIDFunction)),
+		},
+		{Version: 16, Name: "pqstream_audit_ids", Up: audit.idDDL(), Down: fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS id", quoteQualified(audit.table()))},
+	}
+}
+
+//unqualified returns the name of an optionally schema qualified object without its schema
+func unqualified(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+//WriteMigrations writes each migration to dir as a golang-migrate pair of files, ie: 000001_pqstream_notify_function.up.sql. Existing files are overwritten
+func WriteMigrations(dir string, migrations []Migration) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create migrations dir! %s", err.Error())
+	}
+	for _, m := range migrations {
+		base := filepath.Join(dir, m.String())
+		if err := os.WriteFile(base+".up.sql", []byte(m.Up+";\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write migration %d! %s", m.Version, err.Error())
+		}
+		if err := os.WriteFile(base+".down.sql", []byte(m.Down+";\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write migration %d! %s", m.Version, err.Error())
+		}
+	}
+	return nil
+}
+
+//A Migrator applies migrations, tracking the current version in the same single row schema_migrations table golang-migrate does, so either tool can pick up where the other left off
+type Migrator struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified version table. Defaults to schema_migrations
+	Table string
+}
+
+func (m *Migrator) table() string {
+	if m.Table == "" {
+		return defaultMigrationsTable
+	}
+	return m.Table
+}
+
+func (m *Migrator) setup(ctx context.Context) error {
+	if m.DB == nil {
+		return errors.New("migrator requires a db")
+	}
+	_, err := m.DB.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)", quoteQualified(m.table())))
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table! %s", err.Error())
+	}
+	return nil
+}
+
+//Version returns the database's current migration version and whether the last migration failed part way. A database that was never migrated is at version 0
+func (m *Migrator) Version(ctx context.Context) (uint, bool, error) {
+	if err := m.setup(ctx); err != nil {
+		return 0, false, err
+	}
+	return m.version(ctx, m.DB)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (m *Migrator) version(ctx context.Context, q queryRower) (uint, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT version, dirty FROM %s LIMIT 1", quoteQualified(m.table()))).Scan(&version, &dirty)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("failed to read migration version! %s", err.Error())
+	}
+	return uint(version), dirty, nil
+}
+
+//Up applies every migration newer than the database's version, each in its own transaction, returning the number applied.
+//Concurrent migrators serialize on an advisory lock. Up refuses to run against a dirty database, which needs fixing by hand as with golang-migrate
+func (m *Migrator) Up(ctx context.Context, migrations []Migration) (int, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	if err := m.setup(ctx); err != nil {
+		return 0, err
+	}
+	pending := append([]Migration{}, migrations...)
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+	applied := 0
+	for _, migration := range pending {
+		ok, err := m.apply(ctx, migration)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, migration Migration) (bool, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", m.table()); err != nil {
+		return false, fmt.Errorf("failed to lock migrations! %s", err.Error())
+	}
+	version, dirty, err := m.version(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if dirty {
+		return false, fmt.Errorf("database is dirty at version %d, fix it and force the version before migrating", version)
+	}
+	if migration.Version <= version {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+		return false, fmt.Errorf("failed to apply migration %d %s! %s", migration.Version, migration.Name, err.Error())
+	}
+	table := quoteQualified(m.table())
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", table)); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version, dirty) VALUES ($1, false)", table), int64(migration.Version)); err != nil {
+		return false, fmt.Errorf("failed to record migration %d! %s", migration.Version, err.Error())
+	}
+	return true, tx.Commit()
+}
+
+//String returns the migration's golang-migrate file name stem, ie: 000001_pqstream_notify_function
+func (m Migration) String() string {
+	return fmt.Sprintf("%06d_%s", m.Version, m.Name)
+}
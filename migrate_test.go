@@ -0,0 +1,46 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations := pqstream.Migrations(pqstream.MigrationOptions{AuditTable: "ops.audit"})
+	for i, m := range migrations {
+		if m.Version != uint(i+1) || m.Up == "" || m.Down == "" {
+			t.Fatalf("expected consecutive versions with up and down sql, got %+v", m)
+		}
+	}
+	if !strings.Contains(migrations[3].Up, `CREATE TABLE IF NOT EXISTS "ops"."audit"`) {
+		t.Fatalf("expected the configured audit table, got %s", migrations[3].Up)
+	}
+	if !strings.Contains(migrations[4].Up, `FUNCTION "pqstream_emit"(channel text, source text, data json)`) {
+		t.Fatalf("expected the default emit function, got %s", migrations[4].Up)
+	}
+	if !strings.Contains(migrations[5].Up, `ON CONFLICT ON CONSTRAINT "pqstream_sequences_pkey"`) || !strings.Contains(migrations[5].Down, `FUNCTION "pqstream_emit"`) {
+		t.Fatalf("expected the sequence migration to replace the emit function, got %s", migrations[5].Up)
+	}
+	if !strings.Contains(migrations[1].Up, `"pqstream_heartbeat"`) {
+		t.Fatalf("expected the default heartbeat table, got %s", migrations[1].Up)
+	}
+
+	dir := t.TempDir()
+	if err := pqstream.WriteMigrations(dir, migrations); err != nil {
+		t.Fatal(err.Error())
+	}
+	up, err := os.ReadFile(filepath.Join(dir, "000001_pqstream_notify_function.up.sql"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(up), `CREATE OR REPLACE FUNCTION "pqstream_notify"()`) {
+		t.Fatalf("unexpected notify function migration: %s", up)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if len(files) != 2*len(migrations) {
+		t.Fatalf("expected an up and down file per migration, got %v", files)
+	}
+}
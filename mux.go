@@ -0,0 +1,133 @@
+package pqstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//A Mux routes notifications to a chain of handlers registered for their channel, so a client listening on many channels doesn't switch on the channel in every handler.
+//A chain runs its handlers in order and stops at the first error, which is returned to be reported like any other handler's.
+//Notifications on channels without a route go to NotFound, or are ignored if it is nil
+type Mux struct {
+	mu     sync.RWMutex
+	routes map[string][]Handler
+	//NotFound receives notifications on channels without a route
+	NotFound Handler
+}
+
+//NewMux returns a Mux without any routes
+func NewMux() *Mux {
+	return &Mux{routes: map[string][]Handler{}}
+}
+
+//Handle appends handlers to a channel's chain. Routes may be added while the mux is processing notifications
+func (m *Mux) Handle(channel string, handlers ...Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.routes == nil {
+		m.routes = map[string][]Handler{}
+	}
+	m.routes[channel] = append(append([]Handler{}, m.routes[channel]...), handlers...)
+}
+
+//HandleFunc appends a handler func to a channel's chain
+func (m *Mux) HandleFunc(channel string, handler func(notification *pq.Notification) error) {
+	m.Handle(channel, HandlerFunc(handler))
+}
+
+//Channels returns the channels the mux has routes for
+func (m *Mux) Channels() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	channels := make([]string, 0, len(m.routes))
+	for ch := range m.routes {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+func (m *Mux) Name() string {
+	return "mux"
+}
+
+func (m *Mux) Process(notification *pq.Notification) error {
+	return m.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs the chain of the notification's channel
+func (m *Mux) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	return m.processResultsContext(ctx, notification, nil)
+}
+
+//ProcessResults runs the chain of the notification's channel, passing the results to its ResultConsumers, ie: when the Mux is one of HandlerSet.PostHandlers
+func (m *Mux) ProcessResults(notification *pq.Notification, results Results) error {
+	return m.processResultsContext(context.Background(), notification, results)
+}
+
+func (m *Mux) processResultsContext(ctx context.Context, notification *pq.Notification, results Results) error {
+	m.mu.RLock()
+	chain, ok := m.routes[notification.Channel]
+	m.mu.RUnlock()
+	if !ok {
+		if m.NotFound == nil {
+			return nil
+		}
+		chain = []Handler{m.NotFound}
+	}
+	return runChain(ctx, chain, notification.Channel, notification, results)
+}
+
+//runChain runs a chain of handlers in order, the way the client runs its own, passing each the results along with the values of the ResultHandlers before it.
+//It stops at the first error
+func runChain(ctx context.Context, chain []Handler, route string, notification *pq.Notification, results Results) error {
+	for i, h := range chain {
+		value, ok, err := handle(ctx, h, notification, results)
+		if err != nil {
+			return fmt.Errorf("%s: %w", nameOf(h, route, i), err)
+		}
+		if ok {
+			results = append(results[:len(results):len(results)], Result{Handler: nameOf(h, route, i), Value: value})
+		}
+	}
+	return nil
+}
+
+//Handle routes a channel's notifications to a chain of handlers, run alongside HandlerSet.Handlers by a Mux the client adds on first use. Handle doesn't
+//start listening on the channel, see Listen
+func (c *Client) Handle(channel string, handlers ...Handler) {
+	c.mu.Lock()
+	if c.mux == nil {
+		c.mux = NewMux()
+		c.handlers.Handlers = append(append([]Handler{}, c.handlers.Handlers...), c.mux)
+	}
+	mux := c.mux
+	c.mu.Unlock()
+	mux.Handle(channel, handlers...)
+}
+
+//mainHandlers returns HandlerSet.Handlers, which Handle may extend while the client runs
+func (c *Client) mainHandlers() []Handler {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.handlers.Handlers
+}
+
+//A JSONHandlerFunc is a handler whose notification payload is decoded as a T before it is called, ie: JSONHandlerFunc[*User](func(ctx context.Context, n *pq.Notification, u *User) error {...}).
+//Payloads that fail to decode never reach the func: the decode error is returned to be reported to the ErrorHandler. Within a client the decoded value is shared
+//with other handlers decoding the same type, as with Decoded, so it must be treated as read-only
+type JSONHandlerFunc[T any] func(ctx context.Context, notification *pq.Notification, payload T) error
+
+func (f JSONHandlerFunc[T]) Process(notification *pq.Notification) error {
+	return f.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext decodes the payload and calls the func with it
+func (f JSONHandlerFunc[T]) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	payload, err := Decoded[T](ctx, notification)
+	if err != nil {
+		return fmt.Errorf("failed to decode payload on channel: %s! %s", notification.Channel, err.Error())
+	}
+	return f(ctx, notification, payload)
+}
@@ -0,0 +1,122 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type order struct {
+	ID    int `json:"id"`
+	Total int `json:"total"`
+}
+
+func TestMux(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+		errs []string
+	)
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, s)
+	}
+	handlerSet := &pqstream.HandlerSet{
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err.Error())
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users", "orders"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Run(context.Background()); err != pqstream.ErrNoHandlers {
+		t.Fatalf("expected a client without handlers or routes not to run, got: %v", err)
+	}
+	client.Handle("users", pqstream.JSONHandlerFunc[*user](func(ctx context.Context, n *pq.Notification, u *user) error {
+		record("user:" + u.Name)
+		return nil
+	}))
+	client.Handle("orders",
+		pqstream.JSONHandlerFunc[order](func(ctx context.Context, n *pq.Notification, o order) error {
+			if o.Total < 0 {
+				return errors.New("negative total")
+			}
+			record("order")
+			return nil
+		}),
+		pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+			record("order audit")
+			return nil
+		}),
+	)
+	client.Process(&pq.Notification{Channel: "users", Extra: `{"id": 1, "name": "bob"}`})
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{"id": 1, "total": 10}`})
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{"id": 2, "total": -1}`})
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{`})
+	client.Process(&pq.Notification{Channel: "accounts", Extra: `{}`})
+	if got := strings.Join(seen, ","); got != "user:bob,order,order audit" {
+		t.Fatalf("unexpected routing: %s", got)
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0], "negative total") || !strings.Contains(errs[1], "failed to decode payload") {
+		t.Fatalf("expected a failed chain to stop and decode errors to be reported, got: %v", errs)
+	}
+}
+
+func TestMuxNotFound(t *testing.T) {
+	var unrouted []string
+	mux := pqstream.NewMux()
+	mux.HandleFunc("users", func(n *pq.Notification) error { return nil })
+	mux.NotFound = pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		unrouted = append(unrouted, n.Channel)
+		return nil
+	})
+	for _, ch := range []string{"users", "orders"} {
+		if err := mux.Process(&pq.Notification{Channel: ch}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if strings.Join(unrouted, ",") != "orders" || len(mux.Channels()) != 1 {
+		t.Fatalf("unexpected unrouted notifications: %v", unrouted)
+	}
+}
+
+func TestMuxDispatch(t *testing.T) {
+	var got []string
+	recorder := &contextRecorder{}
+	mux := pqstream.NewMux()
+	mux.Handle("users",
+		pqstream.ResultHandlerFunc(func(n *pq.Notification) (any, error) {
+			return "ada", nil
+		}),
+		recorder,
+		pqstream.ResultConsumerFunc(func(n *pq.Notification, results pqstream.Results) error {
+			for _, r := range results {
+				got = append(got, fmt.Sprint(r.Value))
+			}
+			return nil
+		}),
+	)
+	ctx := context.WithValue(context.Background(), bulkheadKey{}, "traced")
+	if err := mux.ProcessContext(ctx, &pq.Notification{Channel: "users"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if recorder.value != "traced" || strings.Join(got, ",") != "ada" {
+		t.Fatalf("expected the chain to get the context and earlier results, got: %v", got)
+	}
+	got = nil
+	if err := mux.ProcessResults(&pq.Notification{Channel: "users"}, pqstream.Results{{Handler: "main", Value: "bob"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(got, ",") != "bob,ada" {
+		t.Fatalf("expected the chain to get the mux's results, got: %v", got)
+	}
+}
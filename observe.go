@@ -0,0 +1,359 @@
+package pqstream
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//LogLevel is the severity of a line logged to a Logger
+type LogLevel string
+
+const (
+	//LevelDebug is per channel debug logging, see Client.Debug
+	LevelDebug LogLevel = "debug"
+	//LevelInfo is verbose operational logging, see Config.Verbose
+	LevelInfo LogLevel = "info"
+	//LevelWarn is a problem that doesn't fail processing, ie: a slow handler
+	LevelWarn LogLevel = "warn"
+	//LevelError is an error reported by the default ErrorHandler
+	LevelError LogLevel = "error"
+)
+
+//A Logger receives the client's log lines with their structured fields, ie: instance, channel and error, in place of the global log package.
+//Adapting it to slog, zap or logrus is a few lines
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]any)
+}
+
+//LoggerFunc is a func used as a Logger
+type LoggerFunc func(level LogLevel, msg string, fields map[string]any)
+
+func (f LoggerFunc) Log(level LogLevel, msg string, fields map[string]any) {
+	f(level, msg, fields)
+}
+
+//StdLogger returns a Logger writing logfmt style lines, ie: level=info msg="..." channel=users, to a standard library logger
+func StdLogger(l *log.Logger) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, fields map[string]any) {
+		b := &strings.Builder{}
+		fmt.Fprintf(b, "level=%s msg=%q", level, msg)
+		for _, key := range sortedKeys(fields) {
+			fmt.Fprintf(b, " %s=%q", key, fmt.Sprint(fields[key]))
+		}
+		l.Print(b.String())
+	})
+}
+
+//logAt logs a line through the configured Logger, or the global log package prefixed with the client's identity if there is none
+func (c *Client) logAt(level LogLevel, fields map[string]any, format string, args ...interface{}) {
+	if c.config.Logger == nil {
+		log.Printf("%s %s "+format, append([]interface{}{pkg, c.identity}, args...)...)
+		return
+	}
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	fields["instance"] = c.identity.String()
+	c.config.Logger.Log(level, fmt.Sprintf(format, args...), fields)
+}
+
+//A Collector is a metrics hook receiving the client's measurements as they happen, ie: to update Prometheus or StatsD metrics and alert when a stream goes quiet
+//or its handlers slow down. Implementations must be safe for concurrent use and return quickly. See Metrics for a Collector serving the Prometheus text format
+type Collector interface {
+	//ObserveNotification is called as each notification is received
+	ObserveNotification(channel string)
+	//ObserveHandler is called as each handler returns, with how long it took and its error, after any escalation retries
+	ObserveHandler(channel, handler string, d time.Duration, err error)
+	//ObservePing is called with the result of each connection health check
+	ObservePing(err error)
+	//ObserveListener is called with each listener connection event on a channel, ie: disconnected or reconnected
+	ObserveListener(channel, event string)
+}
+
+//A PayloadCollector is a Collector also measuring payload sizes, for capacity planning and finding the producers of oversized payloads
+type PayloadCollector interface {
+	Collector
+	//ObservePayload is called as each notification is received, with its payload's size in bytes
+	ObservePayload(channel string, bytes int)
+	//ObserveDelivered is called as each handler returns without an error, with the size of the payload it processed
+	ObserveDelivered(channel, handler string, bytes int)
+}
+
+type nopCollector struct{}
+
+func (nopCollector) ObserveNotification(channel string)                                 {}
+func (nopCollector) ObserveHandler(channel, handler string, d time.Duration, err error) {}
+func (nopCollector) ObservePing(err error)                                              {}
+func (nopCollector) ObserveListener(channel, event string)                              {}
+
+//collector returns the configured Collector, or one discarding every measurement
+func (c *Client) collector() Collector {
+	if c.config.Collector == nil {
+		return nopCollector{}
+	}
+	return c.config.Collector
+}
+
+//Metrics is a PayloadCollector aggregating measurements in memory and serving them in the Prometheus text format
+type Metrics struct {
+	mu            sync.Mutex
+	notifications map[string]uint64
+	last          map[string]time.Time
+	bytes         map[string]uint64
+	maxPayload    map[string]int
+	handlers      map[[2]string]*handlerMetrics
+	pings         uint64
+	pingFailures  uint64
+	listener      map[[2]string]uint64
+	startups      map[string]uint64
+	startup       *StartupReport
+	quota         map[string]float64
+	throttled     map[string]uint64
+	watermarks    map[string]time.Time
+	late          map[string]uint64
+}
+
+type handlerMetrics struct {
+	count   uint64
+	errors  uint64
+	seconds float64
+	bytes   uint64
+}
+
+//NewMetrics returns a Metrics without any measurements
+func NewMetrics() *Metrics {
+	return &Metrics{
+		notifications: map[string]uint64{},
+		last:          map[string]time.Time{},
+		bytes:         map[string]uint64{},
+		maxPayload:    map[string]int{},
+		handlers:      map[[2]string]*handlerMetrics{},
+		listener:      map[[2]string]uint64{},
+		startups:      map[string]uint64{},
+		quota:         map[string]float64{},
+		throttled:     map[string]uint64{},
+		watermarks:    map[string]time.Time{},
+		late:          map[string]uint64{},
+	}
+}
+
+func (m *Metrics) ObserveNotification(channel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications[channel]++
+	m.last[channel] = time.Now()
+}
+
+func (m *Metrics) ObservePayload(channel string, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[channel] += uint64(bytes)
+	if bytes > m.maxPayload[channel] {
+		m.maxPayload[channel] = bytes
+	}
+}
+
+func (m *Metrics) ObserveDelivered(channel, handler string, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler(channel, handler).bytes += uint64(bytes)
+}
+
+//handler returns a handler's metrics on a channel. The lock must be held
+func (m *Metrics) handler(channel, handler string) *handlerMetrics {
+	h, ok := m.handlers[[2]string{channel, handler}]
+	if !ok {
+		h = &handlerMetrics{}
+		m.handlers[[2]string{channel, handler}] = h
+	}
+	return h
+}
+
+func (m *Metrics) ObserveHandler(channel, handler string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.handler(channel, handler)
+	h.count++
+	h.seconds += d.Seconds()
+	if err != nil {
+		h.errors++
+	}
+}
+
+func (m *Metrics) ObservePing(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pings++
+	if err != nil {
+		m.pingFailures++
+	}
+}
+
+func (m *Metrics) ObserveListener(channel, event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listener[[2]string{channel, event}]++
+}
+
+func (m *Metrics) ObserveStartup(report StartupReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if report.Warm {
+		m.startups["warm"]++
+	} else {
+		m.startups["cold"]++
+	}
+	m.startup = &report
+}
+
+func sortedPairs[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+//labelEscaper escapes the characters the Prometheus text format requires escaped in label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *Metrics) ObserveQuota(sink string, pressure float64, throttled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quota[sink] = pressure
+	if throttled {
+		m.throttled[sink]++
+	} else if _, ok := m.throttled[sink]; !ok {
+		m.throttled[sink] = 0
+	}
+}
+
+func (m *Metrics) ObserveWatermark(operator string, watermark time.Time, late bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watermarks[operator] = watermark
+	if late {
+		m.late[operator]++
+	} else if _, ok := m.late[operator]; !ok {
+		m.late[operator] = 0
+	}
+}
+
+//promLabel returns a quoted Prometheus label value. Unlike %q it leaves non-ASCII characters as they are, which the format allows,
+//and replaces invalid UTF-8, which it doesn't, so channels and tables named in any script are exported intact
+func promLabel(value string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+//ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	b := &strings.Builder{}
+	b.WriteString("# HELP pqstream_notifications_total Notifications received per channel.\n")
+	b.WriteString("# TYPE pqstream_notifications_total counter\n")
+	for _, ch := range sortedKeys(m.notifications) {
+		fmt.Fprintf(b, "pqstream_notifications_total{channel=%s} %d\n", promLabel(ch), m.notifications[ch])
+	}
+	b.WriteString("# HELP pqstream_last_notification_timestamp_seconds When each channel last received a notification.\n")
+	b.WriteString("# TYPE pqstream_last_notification_timestamp_seconds gauge\n")
+	for _, ch := range sortedKeys(m.last) {
+		fmt.Fprintf(b, "pqstream_last_notification_timestamp_seconds{channel=%s} %d\n", promLabel(ch), m.last[ch].Unix())
+	}
+	b.WriteString("# HELP pqstream_received_bytes_total Payload bytes received per channel.\n")
+	b.WriteString("# TYPE pqstream_received_bytes_total counter\n")
+	for _, ch := range sortedKeys(m.bytes) {
+		fmt.Fprintf(b, "pqstream_received_bytes_total{channel=%s} %d\n", promLabel(ch), m.bytes[ch])
+	}
+	b.WriteString("# HELP pqstream_max_payload_bytes Size of the largest payload received per channel.\n")
+	b.WriteString("# TYPE pqstream_max_payload_bytes gauge\n")
+	for _, ch := range sortedKeys(m.maxPayload) {
+		fmt.Fprintf(b, "pqstream_max_payload_bytes{channel=%s} %d\n", promLabel(ch), m.maxPayload[ch])
+	}
+	b.WriteString("# HELP pqstream_handler_duration_seconds Time spent in each handler per channel.\n")
+	b.WriteString("# TYPE pqstream_handler_duration_seconds summary\n")
+	for _, k := range sortedPairs(m.handlers) {
+		h := m.handlers[k]
+		fmt.Fprintf(b, "pqstream_handler_duration_seconds_sum{channel=%s,handler=%s} %g\n", promLabel(k[0]), promLabel(k[1]), h.seconds)
+		fmt.Fprintf(b, "pqstream_handler_duration_seconds_count{channel=%s,handler=%s} %d\n", promLabel(k[0]), promLabel(k[1]), h.count)
+	}
+	b.WriteString("# HELP pqstream_handler_errors_total Handler errors per channel.\n")
+	b.WriteString("# TYPE pqstream_handler_errors_total counter\n")
+	for _, k := range sortedPairs(m.handlers) {
+		fmt.Fprintf(b, "pqstream_handler_errors_total{channel=%s,handler=%s} %d\n", promLabel(k[0]), promLabel(k[1]), m.handlers[k].errors)
+	}
+	b.WriteString("# HELP pqstream_handler_bytes_total Payload bytes processed successfully by each handler per channel.\n")
+	b.WriteString("# TYPE pqstream_handler_bytes_total counter\n")
+	for _, k := range sortedPairs(m.handlers) {
+		fmt.Fprintf(b, "pqstream_handler_bytes_total{channel=%s,handler=%s} %d\n", promLabel(k[0]), promLabel(k[1]), m.handlers[k].bytes)
+	}
+	b.WriteString("# HELP pqstream_pings_total Connection health checks.\n")
+	b.WriteString("# TYPE pqstream_pings_total counter\n")
+	fmt.Fprintf(b, "pqstream_pings_total %d\n", m.pings)
+	b.WriteString("# HELP pqstream_ping_failures_total Failed connection health checks.\n")
+	b.WriteString("# TYPE pqstream_ping_failures_total counter\n")
+	fmt.Fprintf(b, "pqstream_ping_failures_total %d\n", m.pingFailures)
+	b.WriteString("# HELP pqstream_listener_events_total Listener connection events per channel.\n")
+	b.WriteString("# TYPE pqstream_listener_events_total counter\n")
+	for _, k := range sortedPairs(m.listener) {
+		fmt.Fprintf(b, "pqstream_listener_events_total{channel=%s,event=%s} %d\n", promLabel(k[0]), promLabel(k[1]), m.listener[k])
+	}
+	b.WriteString("# HELP pqstream_startups_total Starts serving on a host, cold for the client's first and warm after a failover or lost connection.\n")
+	b.WriteString("# TYPE pqstream_startups_total counter\n")
+	for _, start := range sortedKeys(m.startups) {
+		fmt.Fprintf(b, "pqstream_startups_total{start=%s} %d\n", promLabel(start), m.startups[start])
+	}
+	b.WriteString("# HELP pqstream_sink_quota_pressure Fraction of each quota limited sink's quota used over its period.\n")
+	b.WriteString("# TYPE pqstream_sink_quota_pressure gauge\n")
+	for _, sink := range sortedKeys(m.quota) {
+		fmt.Fprintf(b, "pqstream_sink_quota_pressure{sink=%s} %g\n", promLabel(sink), m.quota[sink])
+	}
+	b.WriteString("# HELP pqstream_sink_throttled_total Requests of each quota limited sink its provider throttled.\n")
+	b.WriteString("# TYPE pqstream_sink_throttled_total counter\n")
+	for _, sink := range sortedKeys(m.throttled) {
+		fmt.Fprintf(b, "pqstream_sink_throttled_total{sink=%s} %d\n", promLabel(sink), m.throttled[sink])
+	}
+	b.WriteString("# HELP pqstream_watermark_timestamp_seconds Event time each windowed operator has progressed to, less its allowed lateness.\n")
+	b.WriteString("# TYPE pqstream_watermark_timestamp_seconds gauge\n")
+	for _, operator := range sortedKeys(m.watermarks) {
+		fmt.Fprintf(b, "pqstream_watermark_timestamp_seconds{operator=%s} %d\n", promLabel(operator), m.watermarks[operator].Unix())
+	}
+	b.WriteString("# HELP pqstream_late_events_total Events each windowed operator dropped for arriving behind its watermark.\n")
+	b.WriteString("# TYPE pqstream_late_events_total counter\n")
+	for _, operator := range sortedKeys(m.late) {
+		fmt.Fprintf(b, "pqstream_late_events_total{operator=%s} %d\n", promLabel(operator), m.late[operator])
+	}
+	if s := m.startup; s != nil {
+		b.WriteString("# HELP pqstream_startup_seconds Time each stage of the latest start took.\n")
+		b.WriteString("# TYPE pqstream_startup_seconds gauge\n")
+		for _, stage := range []struct {
+			name string
+			d    time.Duration
+		}{{"connect", s.Connect}, {"preflight", s.Preflight}, {"catch_up", s.CatchUp}, {"ready", s.Ready}} {
+			fmt.Fprintf(b, "pqstream_startup_seconds{stage=%s} %g\n", promLabel(stage.name), stage.d.Seconds())
+		}
+		b.WriteString("# HELP pqstream_startup_listen_seconds Time the LISTEN on each channel took in the latest start.\n")
+		b.WriteString("# TYPE pqstream_startup_listen_seconds gauge\n")
+		for _, ch := range s.Channels {
+			fmt.Fprintf(b, "pqstream_startup_listen_seconds{channel=%s} %g\n", promLabel(ch.Channel), ch.Listen.Seconds())
+		}
+		b.WriteString("# HELP pqstream_startup_replayed_rows Outbox rows each channel caught up on in the latest start.\n")
+		b.WriteString("# TYPE pqstream_startup_replayed_rows gauge\n")
+		for _, ch := range s.Channels {
+			fmt.Fprintf(b, "pqstream_startup_replayed_rows{channel=%s} %d\n", promLabel(ch.Channel), ch.Replayed)
+		}
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,87 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type logLine struct {
+	level  pqstream.LogLevel
+	msg    string
+	fields map[string]any
+}
+
+func TestLoggerAndMetrics(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []logLine
+	)
+	logger := pqstream.LoggerFunc(func(level pqstream.LogLevel, msg string, fields map[string]any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, logLine{level, msg, fields})
+	})
+	metrics := pqstream.NewMetrics()
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			if notification.Extra == "bad" {
+				return errors.New("boom")
+			}
+			return nil
+		})},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Verbose: true, InstanceID: "a", Logger: logger, Collector: metrics}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "ok"})
+	client.Process(&pq.Notification{Channel: "users", Extra: "bad"})
+
+	var info, errs int
+	for _, l := range lines {
+		switch {
+		case l.level == pqstream.LevelInfo && l.fields["instance"] == "a":
+			info++
+		case l.level == pqstream.LevelError && strings.Contains(l.msg, "boom"):
+			errs++
+		}
+	}
+	if info == 0 || errs != 1 {
+		t.Fatalf("expected verbose lines and the handler error to be logged, got: %+v", lines)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`pqstream_notifications_total{channel="users"} 2`,
+		`pqstream_handler_duration_seconds_count{channel="users",handler="main[0](pqstream.HandlerFunc)"} 2`,
+		`pqstream_handler_errors_total{channel="users",handler="main[0](pqstream.HandlerFunc)"} 1`,
+		`pqstream_last_notification_timestamp_seconds{channel="users"}`,
+		`pqstream_received_bytes_total{channel="users"} 5`,
+		`pqstream_max_payload_bytes{channel="users"} 3`,
+		`pqstream_handler_bytes_total{channel="users",handler="main[0](pqstream.HandlerFunc)"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("expected %s in metrics, got:\n%s", want, rec.Body.String())
+		}
+	}
+	if e := client.EffectiveConfig(); e.Logger == "" || e.Collector != "*pqstream.Metrics" {
+		t.Fatalf("expected the logger and collector in the effective config, got: %+v", e)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pqstream.StdLogger(log.New(buf, "", 0)).Log(pqstream.LevelInfo, "hello world", map[string]any{"channel": "users", "instance": "a"})
+	if got := strings.TrimSpace(buf.String()); got != `level=info msg="hello world" channel="users" instance="a"` {
+		t.Fatalf("unexpected log line: %s", got)
+	}
+}
@@ -0,0 +1,93 @@
+package pqstream
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//OpCounts are the number of change events seen for a table, by operation
+type OpCounts struct {
+	Inserts uint64 `json:"inserts"`
+	Updates uint64 `json:"updates"`
+	Deletes uint64 `json:"deletes"`
+}
+
+//An OpCounter is a turnkey Handler counting INSERT, UPDATE and DELETE change events per table, showing what is churning in the database right now.
+//It serves the counts in the Prometheus text format, ie: mux.Handle("/metrics/tables", counter). Payloads that aren't change events are ignored
+type OpCounter struct {
+	mu     sync.RWMutex
+	counts map[string]*OpCounts
+}
+
+//NewOpCounter returns an empty OpCounter
+func NewOpCounter() *OpCounter {
+	return &OpCounter{counts: map[string]*OpCounts{}}
+}
+
+//Name returns the handler's name
+func (o *OpCounter) Name() string {
+	return "op_counter"
+}
+
+//Process counts a change event
+func (o *OpCounter) Process(notification *pq.Notification) error {
+	e, err := ParseChange(notification)
+	if err != nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	counts, ok := o.counts[e.QualifiedTable()]
+	if !ok {
+		counts = &OpCounts{}
+		o.counts[e.QualifiedTable()] = counts
+	}
+	switch e.Op {
+	case OpInsert:
+		counts.Inserts++
+	case OpUpdate:
+		counts.Updates++
+	case OpDelete:
+		counts.Deletes++
+	}
+	return nil
+}
+
+//Counts returns a snapshot of the counts by table
+func (o *OpCounter) Counts() map[string]OpCounts {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	out := make(map[string]OpCounts, len(o.counts))
+	for table, counts := range o.counts {
+		out[table] = *counts
+	}
+	return out
+}
+
+//ServeHTTP writes the counts as the pqstream_table_operations_total counter
+func (o *OpCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counts := o.Counts()
+	tables := make([]string, 0, len(counts))
+	for table := range counts {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	b := &strings.Builder{}
+	b.WriteString("# HELP pqstream_table_operations_total Change events received per table and operation.\n")
+	b.WriteString("# TYPE pqstream_table_operations_total counter\n")
+	for _, table := range tables {
+		c := counts[table]
+		for _, op := range []struct {
+			name  string
+			count uint64
+		}{{"insert", c.Inserts}, {"update", c.Updates}, {"delete", c.Deletes}} {
+			fmt.Fprintf(b, "pqstream_table_operations_total{table=%s,op=%s} %d\n", promLabel(table), promLabel(op.name), op.count)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
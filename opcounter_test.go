@@ -0,0 +1,40 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpCounter(t *testing.T) {
+	counter := pqstream.NewOpCounter()
+	for _, payload := range []string{
+		`{"schema": "public", "table": "users", "op": "INSERT", "new": {"id": 1}}`,
+		`{"schema": "public", "table": "users", "op": "UPDATE", "new": {"id": 1}}`,
+		`{"schema": "public", "table": "users", "op": "UPDATE", "new": {"id": 1}}`,
+		`{"table": "orders", "op": "DELETE", "old": {"id": 1}}`,
+		`{"table": "caf\u00e9 \"menu\"", "op": "INSERT", "new": {"id": 1}}`,
+		`not a change event`,
+	} {
+		if err := counter.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if users := counter.Counts()["public.users"]; users.Inserts != 1 || users.Updates != 2 || users.Deletes != 0 {
+		t.Fatalf("unexpected counts: %+v", users)
+	}
+	rec := httptest.NewRecorder()
+	counter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`pqstream_table_operations_total{table="orders",op="delete"} 1`,
+		`pqstream_table_operations_total{table="public.users",op="update"} 2`,
+		`pqstream_table_operations_total{table="café \"menu\"",op="insert"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expected metrics to contain %s, got:\n%s", line, body)
+		}
+	}
+}
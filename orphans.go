@@ -0,0 +1,222 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+)
+
+//triggerSignature matches the source of the trigger functions TriggerSpec.Up installs, whatever they are named
+const triggerSignature = `%'truncated', true%PERFORM pg_notify(%`
+
+//installedTrigger is a trigger calling a pqstream trigger function, with its schema qualified table and function
+type installedTrigger struct {
+	table, name, function string
+}
+
+func (t installedTrigger) key() string {
+	return t.name + " on " + t.table
+}
+
+//orphanScan is what Orphans finds in the database: every pqstream trigger and trigger function, the triggers declared or recorded and their functions,
+//and the undeclared recorded triggers whose table is gone
+type orphanScan struct {
+	triggers  []installedTrigger
+	functions []string
+	accounted map[string]bool
+	keep      map[string]bool
+	stale     []string
+}
+
+//plan returns the changes removing the scan's orphans: triggers first, then the functions no remaining trigger calls, then the stale records
+func (s orphanScan) plan(stateTable string) Plan {
+	var plan Plan
+	calls := map[string]bool{}
+	for function := range s.keep {
+		calls[function] = true
+	}
+	for _, t := range s.triggers {
+		if s.accounted[t.key()] {
+			calls[t.function] = true
+			continue
+		}
+		plan = append(plan, PlanChange{Action: PlanDrop, Kind: "trigger", Name: t.key(), Reason: "not declared or managed",
+			SQL: fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", pq.QuoteIdentifier(t.name), quoteQualified(t.table))})
+	}
+	for _, function := range s.functions {
+		if calls[function] {
+			continue
+		}
+		plan = append(plan, PlanChange{Action: PlanDrop, Kind: "function", Name: function, Reason: "no declared trigger calls it",
+			SQL: fmt.Sprintf("DROP FUNCTION IF EXISTS %s()", quoteQualified(function))})
+	}
+	for _, name := range s.stale {
+		plan = append(plan, PlanChange{Action: PlanDrop, Kind: "record", Name: name, Reason: "its table is gone",
+			SQL: fmt.Sprintf("DELETE FROM %s WHERE kind = 'trigger' AND name = %s", quoteQualified(stateTable), pq.QuoteLiteral(name))})
+	}
+	return plan
+}
+
+//Orphans returns the changes Prune would make, without making them
+func (r *Reconciler) Orphans(ctx context.Context, state *StreamState) (Plan, error) {
+	if r.DB == nil {
+		return nil, errors.New("reconciler requires a db")
+	}
+	tx, err := r.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return r.orphans(ctx, tx, state)
+}
+
+//Prune removes what deleted channels and renamed tables leave behind, which Apply can't: pqstream triggers neither declared in the state nor recorded
+//in the state table, ie: installed by EnsureTriggers or named after a table's old name, trigger functions no remaining trigger calls, since dropping a table
+//drops its triggers but not their functions, and the records of undeclared triggers whose table is gone, whose drop would fail. Either every orphan is
+//removed or none is. Prune before Apply when a table is renamed, so its old record doesn't fail the apply
+func (r *Reconciler) Prune(ctx context.Context, state *StreamState) (Plan, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return nil, err
+	}
+	if r.DB == nil {
+		return nil, errors.New("reconciler requires a db")
+	}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", quoteQualified(r.table())).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		//an apply running alongside records triggers the scan would otherwise find unaccounted for
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", quoteQualified(r.table()))); err != nil {
+			return nil, fmt.Errorf("failed to lock state table! %s", err.Error())
+		}
+	}
+	plan, err := r.orphans(ctx, tx, state)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range plan {
+		if _, err := tx.ExecContext(ctx, change.SQL); err != nil {
+			return nil, fmt.Errorf("failed to %s %s %s! %s", change.Action, change.Kind, change.Name, err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (r *Reconciler) orphans(ctx context.Context, tx *sql.Tx, state *StreamState) (Plan, error) {
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+	recorded, err := r.recorded(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	desired := state.resources()
+	scan := orphanScan{accounted: map[string]bool{}, keep: map[string]bool{}}
+	//declared and recorded triggers are matched by the table their names resolve to, so bare tables are found on the search path
+	account := func(res resource, stale bool) error {
+		if res.trigger == nil {
+			return nil
+		}
+		table, err := resolveTable(ctx, tx, res.trigger.Table)
+		if err != nil {
+			return err
+		}
+		if table == "" {
+			if stale {
+				scan.stale = append(scan.stale, res.name)
+			}
+			return nil
+		}
+		scan.accounted[res.trigger.name()+" on "+table] = true
+		scan.keep[schemaOf(table)+"."+res.trigger.name()] = true
+		return nil
+	}
+	for _, key := range sortedResources(desired) {
+		if err := account(desired[key], false); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range sortedResources(recorded) {
+		_, declared := desired[key]
+		if err := account(recorded[key], !declared); err != nil {
+			return nil, err
+		}
+	}
+	if scan.triggers, err = installedTriggers(ctx, tx); err != nil {
+		return nil, err
+	}
+	if scan.functions, err = triggerFunctions(ctx, tx); err != nil {
+		return nil, err
+	}
+	return scan.plan(r.table()), nil
+}
+
+//resolveTable returns the schema qualified name of a table, or nothing if it doesn't exist
+func resolveTable(ctx context.Context, tx *sql.Tx, table string) (string, error) {
+	var qualified string
+	err := tx.QueryRowContext(ctx, `SELECT n.nspname || '.' || c.relname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.oid = to_regclass($1)`, quoteQualified(table)).Scan(&qualified)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve table %s! %s", table, err.Error())
+	}
+	return qualified, nil
+}
+
+//installedTriggers returns every trigger calling a pqstream trigger function, by table and name
+func installedTriggers(ctx context.Context, tx *sql.Tx) ([]installedTrigger, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT n.nspname || '.' || c.relname, t.tgname, fn.nspname || '.' || p.proname
+FROM pg_trigger t
+JOIN pg_class c ON c.oid = t.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+JOIN pg_proc p ON p.oid = t.tgfoid
+JOIN pg_namespace fn ON fn.oid = p.pronamespace
+WHERE NOT t.tgisinternal AND p.prosrc LIKE $1`, triggerSignature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list triggers! %s", err.Error())
+	}
+	defer rows.Close()
+	var triggers []installedTrigger
+	for rows.Next() {
+		var t installedTrigger
+		if err := rows.Scan(&t.table, &t.name, &t.function); err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, t)
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].key() < triggers[j].key() })
+	return triggers, rows.Err()
+}
+
+//triggerFunctions returns every pqstream trigger function, schema qualified
+func triggerFunctions(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT n.nspname || '.' || p.proname FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace
+WHERE p.prorettype = 'trigger'::regtype AND p.prosrc LIKE $1 ORDER BY 1`, triggerSignature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trigger functions! %s", err.Error())
+	}
+	defer rows.Close()
+	var functions []string
+	for rows.Next() {
+		var function string
+		if err := rows.Scan(&function); err != nil {
+			return nil, err
+		}
+		functions = append(functions, function)
+	}
+	return functions, rows.Err()
+}
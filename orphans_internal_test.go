@@ -0,0 +1,54 @@
+package pqstream
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrphanScanPlan(t *testing.T) {
+	scan := orphanScan{
+		triggers: []installedTrigger{
+			{table: "public.users", name: "pqstream_users_users", function: "public.pqstream_users_users"},
+			//a renamed table keeps the trigger named after its old name
+			{table: "public.customers", name: "pqstream_users_users", function: "public.pqstream_users_users"},
+			{table: "public.orders", name: "pqstream_orders_orders", function: "public.pqstream_orders_orders"},
+		},
+		functions: []string{"public.pqstream_orders_orders", "public.pqstream_users_users", "public.pqstream_invoices_invoices", "public.pqstream_carts_carts"},
+		accounted: map[string]bool{"pqstream_users_users on public.users": true},
+		keep:      map[string]bool{"public.pqstream_carts_carts": true},
+		stale:     []string{"pqstream_invoices_invoices on invoices"},
+	}
+	plan := scan.plan("ops.pqstream_state")
+	var names []string
+	for _, change := range plan {
+		if change.Action != PlanDrop {
+			t.Fatalf("expected only drops, got: %+v", change)
+		}
+		names = append(names, change.Kind+" "+change.Name)
+	}
+	expected := []string{
+		"trigger pqstream_users_users on public.customers",
+		"trigger pqstream_orders_orders on public.orders",
+		"function public.pqstream_orders_orders",
+		"function public.pqstream_invoices_invoices",
+		"record pqstream_invoices_invoices on invoices",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected orphans: %v", names)
+	}
+	if plan[0].SQL != `DROP TRIGGER IF EXISTS "pqstream_users_users" ON "public"."customers"` {
+		t.Fatalf("unexpected trigger sql: %s", plan[0].SQL)
+	}
+	if plan[2].SQL != `DROP FUNCTION IF EXISTS "public"."pqstream_orders_orders"()` {
+		t.Fatalf("unexpected function sql: %s", plan[2].SQL)
+	}
+	if plan[4].SQL != `DELETE FROM "ops"."pqstream_state" WHERE kind = 'trigger' AND name = 'pqstream_invoices_invoices on invoices'` {
+		t.Fatalf("unexpected record sql: %s", plan[4].SQL)
+	}
+	if !strings.Contains(plan.String(), "Plan: 0 to create, 0 to update, 5 to drop.") {
+		t.Fatalf("unexpected summary: %s", plan)
+	}
+	if len(orphanScan{}.plan("pqstream_state")) != 0 {
+		t.Fatal("expected nothing to prune in an empty database")
+	}
+}
@@ -0,0 +1,496 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//defaultOutboxBatchSize is the number of outbox rows read per query when Outbox.BatchSize is unset
+const defaultOutboxBatchSize = 500
+
+//defaultOutboxRetryInterval is the first delay before retrying a failed outbox row when Outbox.RetryInterval is unset
+const defaultOutboxRetryInterval = time.Second
+
+//maxOutboxRetryInterval caps the doubling delay between retries of a failed outbox row
+const maxOutboxRetryInterval = time.Minute
+
+//ErrNotDurable is returned by Catchup and Replay on a client configured without an Outbox
+var ErrNotDurable = errors.New("client has no outbox configured")
+
+//An Outbox makes a client's delivery durable. Producers insert rows into the outbox table, from the library's migrations, instead of calling pg_notify,
+//and a trigger notifies the row's channel with an Envelope whose Offset is the row's position in the channel. The client checkpoints the last position
+//whose handlers all returned nil, so notifications are processed at least once: after connecting or reconnecting the client catches up on every row past
+//its checkpoints, and a failed row is retried, holding back the rows after it on its channel, until its handlers succeed.
+//Positions are assigned in commit order, so a row committed late can't be skipped by the checkpoint. Each attempt is counted and traced as a delivery.
+//Catch-up reads rows by the channels the client listens on, not their aliases
+type Outbox struct {
+	//Table is the optionally schema qualified outbox table. Defaults to pqstream_outbox
+	Table string
+	//Checkpoints stores each channel's last processed position. Defaults to the pqstream_checkpoints table in the client's database, keyed by Consumer
+	Checkpoints CheckpointStore
+	//Consumer names the consumer group whose checkpoints the default store keeps, so instances sharing a name resume from each other's progress. Defaults to pqstream
+	Consumer string
+	//BatchSize is the number of rows read per catch-up query. Defaults to 500
+	BatchSize int
+	//MaxAttempts is the number of times a row's handlers are run before it is reported to the ErrorHandler and skipped. Zero retries until they succeed or the client stops
+	MaxAttempts int
+	//RetryInterval is the delay before a failed row is retried, doubling with each attempt up to a minute. Defaults to 1s
+	RetryInterval time.Duration
+}
+
+func (o *Outbox) table() string {
+	if o.Table == "" {
+		return "pqstream_outbox"
+	}
+	return o.Table
+}
+
+func (o *Outbox) consumer() string {
+	if o.Consumer == "" {
+		return "pqstream"
+	}
+	return o.Consumer
+}
+
+func (o *Outbox) batchSize() int {
+	if o.BatchSize <= 0 {
+		return defaultOutboxBatchSize
+	}
+	return o.BatchSize
+}
+
+//retryInterval returns the delay before the next attempt at a row whose handlers have failed attempt times
+func (o *Outbox) retryInterval(attempt int) time.Duration {
+	d := o.RetryInterval
+	if d <= 0 {
+		d = defaultOutboxRetryInterval
+	}
+	for i := 1; i < attempt && d < maxOutboxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > maxOutboxRetryInterval {
+		return maxOutboxRetryInterval
+	}
+	return d
+}
+
+//Send inserts data into the outbox for a channel, tagged with the source, which defaults to SourceApplication. Run it in the transaction making the change
+//the notification describes, so the notification is sent if and only if the change commits
+func (o *Outbox) Send(ctx context.Context, db Execer, channel string, source Source, data any) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if channel == "" {
+		return errors.New("empty channel")
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox data! %s", err.Error())
+	}
+	if source == "" {
+		source = SourceApplication
+	}
+	query := fmt.Sprintf("INSERT INTO %s (channel, source, data) VALUES ($1, $2, $3)", quoteQualified(o.table()))
+	if _, err := db.ExecContext(ctx, query, channel, string(source), string(encoded)); err != nil {
+		return fmt.Errorf("failed to insert into outbox for channel: %s! %s", channel, err.Error())
+	}
+	return nil
+}
+
+//outboxEnvelope is the SQL building the Envelope the outbox trigger notifies with, shared with catch-up queries so both deliver identical payloads
+func outboxEnvelope(row string) string {
+	return fmt.Sprintf(`json_build_object(
+		'id', %[1]s.channel || ':' || %[1]s.position,
+		'emitted_at', %[1]s.created_at,
+		'source', %[1]s.source,
+		'seq', %[1]s.position,
+		'offset', %[1]s.position,
+		'data', %[1]s.data
+	)::text`, row)
+}
+
+//read returns the notifications for up to BatchSize of a channel's rows after a position, in order
+func (o *Outbox) read(ctx context.Context, db *sql.DB, channel string, after int64) ([]*pq.Notification, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s AS o WHERE o.channel = $1 AND o.position > $2 ORDER BY o.position LIMIT $3", outboxEnvelope("o"), quoteQualified(o.table()))
+	rows, err := db.QueryContext(ctx, query, channel, after, o.batchSize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox for channel: %s! %s", channel, err.Error())
+	}
+	defer rows.Close()
+	var out []*pq.Notification
+	for rows.Next() {
+		n := &pq.Notification{Channel: channel}
+		if err := rows.Scan(&n.Extra); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+//A CheckpointStore persists the last position of each channel a durable client has processed
+type CheckpointStore interface {
+	//Load returns a channel's checkpoint, or zero if it has none
+	Load(ctx context.Context, channel string) (int64, error)
+	//Save records a channel's checkpoint
+	Save(ctx context.Context, channel string, position int64) error
+}
+
+//TableCheckpoints stores checkpoints in a postgres table, one row per consumer and channel
+type TableCheckpoints struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified checkpoint table. Defaults to pqstream_checkpoints
+	Table string
+	//Consumer names the consumer group the checkpoints belong to. Defaults to pqstream
+	Consumer string
+}
+
+func (t *TableCheckpoints) table() string {
+	if t.Table == "" {
+		return "pqstream_checkpoints"
+	}
+	return t.Table
+}
+
+func (t *TableCheckpoints) consumer() string {
+	if t.Consumer == "" {
+		return "pqstream"
+	}
+	return t.Consumer
+}
+
+//Load returns a channel's checkpoint, or zero if it has none
+func (t *TableCheckpoints) Load(ctx context.Context, channel string) (int64, error) {
+	var position int64
+	err := t.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT position FROM %s WHERE consumer = $1 AND channel = $2", quoteQualified(t.table())), t.consumer(), channel).Scan(&position)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("failed to load checkpoint for channel: %s! %s", channel, err.Error())
+	}
+	return position, nil
+}
+
+//Save records a channel's checkpoint
+func (t *TableCheckpoints) Save(ctx context.Context, channel string, position int64) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	_, err := t.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (consumer, channel, position) VALUES ($1, $2, $3)
+ON CONFLICT (consumer, channel) DO UPDATE SET position = EXCLUDED.position, updated_at = now()`, quoteQualified(t.table())), t.consumer(), channel, position)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint for channel: %s! %s", channel, err.Error())
+	}
+	return nil
+}
+
+//MemoryCheckpoints stores checkpoints in memory, ie: for tests or consumers that only need to survive reconnects
+type MemoryCheckpoints struct {
+	mu        sync.Mutex
+	positions map[string]int64
+}
+
+//Load returns a channel's checkpoint, or zero if it has none
+func (m *MemoryCheckpoints) Load(ctx context.Context, channel string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.positions[channel], nil
+}
+
+//Save records a channel's checkpoint
+func (m *MemoryCheckpoints) Save(ctx context.Context, channel string, position int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.positions == nil {
+		m.positions = map[string]int64{}
+	}
+	m.positions[channel] = position
+	return nil
+}
+
+//durable is a client's outbox delivery state
+type durable struct {
+	outbox   *Outbox
+	mu       sync.Mutex
+	store    CheckpointStore
+	read     func(ctx context.Context, channel string, after int64) ([]*pq.Notification, error)
+	channels map[string]*durableChannel
+	catchups sync.WaitGroup
+}
+
+//durableChannel is a channel's last processed position. Its lock is held while rows are processed, so catch-ups and live notifications run one at a time, in order
+type durableChannel struct {
+	mu     sync.Mutex
+	loaded bool
+	last   int64
+	synced bool
+}
+
+func newDurable(outbox *Outbox) *durable {
+	if outbox == nil {
+		return nil
+	}
+	return &durable{outbox: outbox, channels: map[string]*durableChannel{}}
+}
+
+//connect reads the outbox through a connection, checkpointing through the write role's unless a store is configured, and marks every channel as needing a catch-up
+func (d *durable) connect(db, writeDB *sql.DB) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.read = func(ctx context.Context, channel string, after int64) ([]*pq.Notification, error) {
+		return d.outbox.read(ctx, db, channel, after)
+	}
+	d.store = d.outbox.Checkpoints
+	if d.store == nil {
+		d.store = &TableCheckpoints{DB: writeDB, Consumer: d.outbox.consumer()}
+	}
+	for _, ch := range d.channels {
+		ch.mu.Lock()
+		ch.synced = false
+		ch.mu.Unlock()
+	}
+}
+
+//resync marks every channel as needing a catch-up, ie: after the listener reconnects and may have missed notifications
+func (d *durable) resync() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, ch := range d.channels {
+		ch.mu.Lock()
+		ch.synced = false
+		ch.mu.Unlock()
+	}
+}
+
+func (d *durable) channel(name string) *durableChannel {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch, ok := d.channels[name]
+	if !ok {
+		ch = &durableChannel{}
+		d.channels[name] = ch
+	}
+	return ch
+}
+
+func (d *durable) source() (CheckpointStore, func(ctx context.Context, channel string, after int64) ([]*pq.Notification, error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.store, d.read
+}
+
+//Catchup processes every outbox row past the checkpoint of each channel the client listens on. The client catches up by itself whenever it connects,
+//so Catchup is only needed to resume sooner, ie: after a GapHandler reports lost notifications
+func (c *Client) Catchup(ctx context.Context) error {
+	if c.durable == nil {
+		return ErrNotDurable
+	}
+	var errs []error
+	for _, channel := range c.Channels() {
+		if _, err := c.catchup(ctx, channel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//Replay runs the handlers again on every outbox row of a channel after a position, including rows already processed, and moves the checkpoint forward past
+//any that weren't. Live notifications on the channel wait until the replay finishes
+func (c *Client) Replay(ctx context.Context, channel string, after int64) error {
+	if c.durable == nil {
+		return ErrNotDurable
+	}
+	ch := c.durable.channel(channel)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if err := c.loadCheckpoint(ctx, channel, ch); err != nil {
+		return err
+	}
+	_, err := c.drainOutbox(ctx, channel, ch, after, 0)
+	return err
+}
+
+//catchup processes a channel's rows past its checkpoint, returning how many it processed
+func (c *Client) catchup(ctx context.Context, channel string) (int, error) {
+	ch := c.durable.channel(channel)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if err := c.loadCheckpoint(ctx, channel, ch); err != nil {
+		return 0, err
+	}
+	replayed, err := c.drainOutbox(ctx, channel, ch, ch.last, 0)
+	if err != nil {
+		return replayed, err
+	}
+	ch.synced = true
+	return replayed, nil
+}
+
+//catchupAll catches up every channel in the background, reporting failures to the ErrorHandler, then calls done, if it isn't nil, with the number of rows
+//processed on each channel. done isn't called if the client stops first
+func (c *Client) catchupAll(done func(replayed map[string]int)) {
+	c.durable.catchups.Add(1)
+	go func() {
+		defer c.durable.catchups.Done()
+		replayed := map[string]int{}
+		for _, channel := range c.Channels() {
+			if c.isStopping() {
+				return
+			}
+			n, err := c.catchup(context.Background(), channel)
+			if err != nil {
+				c.handleErr(channel, err)
+			}
+			replayed[channel] = n
+		}
+		if done != nil {
+			done(replayed)
+		}
+	}()
+}
+
+func (c *Client) loadCheckpoint(ctx context.Context, channel string, ch *durableChannel) error {
+	if ch.loaded {
+		return nil
+	}
+	store, _ := c.durable.source()
+	if store == nil {
+		return errors.New("client is not connected")
+	}
+	last, err := store.Load(ctx, channel)
+	if err != nil {
+		return err
+	}
+	ch.last, ch.loaded = last, true
+	return nil
+}
+
+//drainOutbox processes a channel's rows after a position, in order, stopping before a row at or past until unless until is zero.
+//It returns the number of rows it processed
+func (c *Client) drainOutbox(ctx context.Context, channel string, ch *durableChannel, after, until int64) (int, error) {
+	_, read := c.durable.source()
+	if read == nil {
+		return 0, errors.New("client is not connected")
+	}
+	processed := 0
+	for {
+		batch, err := read(ctx, channel, after)
+		if err != nil {
+			return processed, err
+		}
+		for _, n := range batch {
+			offset := offsetOf(n)
+			if until > 0 && offset >= until {
+				return processed, nil
+			}
+			if err := c.processDurable(ctx, ch, n, offset); err != nil {
+				return processed, err
+			}
+			processed++
+			after = offset
+		}
+		if len(batch) < c.durable.outbox.batchSize() {
+			return processed, nil
+		}
+	}
+}
+
+//deliverDurable processes a live outbox notification, first catching up on any rows before it the channel may have missed. Rows at or before the checkpoint
+//were already processed and are dropped
+func (c *Client) deliverDurable(n *pq.Notification, offset int64) {
+	ctx := context.Background()
+	ch := c.durable.channel(n.Channel)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if err := c.loadCheckpoint(ctx, n.Channel, ch); err != nil {
+		c.handleErr(n.Channel, err)
+		return
+	}
+	if offset <= ch.last {
+		return
+	}
+	if !ch.synced || offset > ch.last+1 {
+		if _, err := c.drainOutbox(ctx, n.Channel, ch, ch.last, offset); err != nil {
+			c.handleErr(n.Channel, err)
+			return
+		}
+		ch.synced = true
+	}
+	if err := c.processDurable(ctx, ch, n, offset); err != nil {
+		c.handleErr(n.Channel, err)
+	}
+}
+
+//processDurable runs the handlers on an outbox row until they all succeed, then checkpoints it. A row that still fails, or that the client stopped
+//retrying, leaves the channel out of sync so the next notification or catch-up starts again from it
+func (c *Client) processDurable(ctx context.Context, ch *durableChannel, n *pq.Notification, offset int64) error {
+	if offset <= ch.last {
+		return c.retryDurable(n, nil)
+	}
+	var log *deadLetterLog
+	if c.config.DeadLetters != nil {
+		log = &deadLetterLog{}
+	}
+	if err := c.retryDurable(n, log); err != nil {
+		if c.isStopping() || c.durable.outbox.MaxAttempts <= 0 {
+			ch.synced = false
+			return err
+		}
+		c.handleErr(n.Channel, fmt.Errorf("skipping outbox row %d on channel: %s after %d attempts", offset, n.Channel, c.durable.outbox.MaxAttempts))
+		if log != nil {
+			c.deadLetter(n, c.durable.outbox.MaxAttempts, log.snapshot())
+		}
+	}
+	store, _ := c.durable.source()
+	if err := store.Save(ctx, n.Channel, offset); err != nil {
+		ch.synced = false
+		return err
+	}
+	ch.last = offset
+	c.events.publish(Event{Type: EventCheckpointAdvanced, Channel: n.Channel, Time: c.config.Clock.Now(), Position: offset})
+	return nil
+}
+
+//retryDurable runs the handlers on a notification until they all succeed, the attempts run out or the client stops, collecting each attempt's failures in log
+func (c *Client) retryDurable(n *pq.Notification, log *deadLetterLog) error {
+	for attempt := 1; ; attempt++ {
+		ctx := context.Background()
+		if log != nil {
+			log.mu.Lock()
+			log.attempt = attempt
+			log.mu.Unlock()
+			ctx = withDeadLetterLog(ctx, log)
+		}
+		err := c.processIn(ctx, n)
+		if err == nil {
+			return nil
+		}
+		if max := c.durable.outbox.MaxAttempts; max > 0 && attempt >= max {
+			return err
+		}
+		if c.config.Verbose {
+			c.logf("retrying notification on channel: %s after %d failed attempts", n.Channel, attempt)
+		}
+		select {
+		case <-c.lifecycle.stopping:
+			return err
+		case <-c.config.Clock.After(c.durable.outbox.retryInterval(attempt)):
+		}
+	}
+}
+
+//offsetOf returns the outbox position of an enveloped notification, or zero if it wasn't sent through an outbox
+func offsetOf(n *pq.Notification) int64 {
+	envelope := envelopeOf(n)
+	if envelope == nil {
+		return 0
+	}
+	return envelope.Offset
+}
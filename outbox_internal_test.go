@@ -0,0 +1,135 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func outboxRow(channel string, offset int64) *pq.Notification {
+	return &pq.Notification{Channel: channel, Extra: fmt.Sprintf(`{"id":"%s:%d","seq":%d,"offset":%d,"data":%d}`, channel, offset, offset, offset, offset)}
+}
+
+func TestDurableDelivery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		seen     []string
+		failures = map[int64]int{4: 1, 5: 3}
+	)
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		offset := offsetOf(n)
+		mu.Lock()
+		defer mu.Unlock()
+		if failures[offset] > 0 {
+			failures[offset]--
+			return errors.New("handler failed")
+		}
+		seen = append(seen, fmt.Sprint(offset))
+		return nil
+	})
+	store := &MemoryCheckpoints{}
+	outbox := &Outbox{Checkpoints: store, BatchSize: 2, MaxAttempts: 3, RetryInterval: time.Millisecond}
+	c, err := NewClient([]string{"users"}, &Config{Outbox: outbox}, &HandlerSet{Handlers: []Handler{handler}, ErrorHandler: func(err error) {}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	events, cancel := c.Events(100)
+	defer cancel()
+	rows := []*pq.Notification{outboxRow("users", 1), outboxRow("users", 2), outboxRow("users", 3), outboxRow("users", 4), outboxRow("users", 5)}
+	c.durable.store = store
+	c.durable.read = func(ctx context.Context, channel string, after int64) ([]*pq.Notification, error) {
+		var out []*pq.Notification
+		for _, n := range rows {
+			if offsetOf(n) > after && len(out) < outbox.batchSize() {
+				out = append(out, n)
+			}
+		}
+		return out, nil
+	}
+
+	//the first live notification catches up on the rows before it
+	c.deliverDurable(outboxRow("users", 3), 3)
+	c.deliverDurable(outboxRow("users", 2), 2)
+	if got := strings.Join(seen, ","); got != "1,2,3" {
+		t.Fatalf("expected a catch-up in order without duplicates, got: %s", got)
+	}
+	if last, _ := store.Load(context.Background(), "users"); last != 3 {
+		t.Fatalf("expected checkpoint 3, got: %d", last)
+	}
+
+	//a failing row is retried, then skipped once its attempts run out
+	c.deliverDurable(outboxRow("users", 4), 4)
+	c.deliverDurable(outboxRow("users", 5), 5)
+	if got := strings.Join(seen, ","); got != "1,2,3,4" {
+		t.Fatalf("unexpected deliveries after retries: %s", got)
+	}
+	if last, _ := store.Load(context.Background(), "users"); last != 5 {
+		t.Fatalf("expected the exhausted row to be checkpointed, got: %d", last)
+	}
+	if errs := c.Stats().Channels["users"].Errors; errs != 5 {
+		t.Fatalf("expected every failed attempt and the skip to be reported, got: %d", errs)
+	}
+	var checkpoints []int64
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventCheckpointAdvanced {
+			checkpoints = append(checkpoints, e.Position)
+		}
+	}
+	if fmt.Sprint(checkpoints) != "[1 2 3 4 5]" {
+		t.Fatalf("unexpected checkpoint events: %v", checkpoints)
+	}
+
+	seen = nil
+	if err := c.Replay(context.Background(), "users", 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := strings.Join(seen, ","); got != "3,4,5" {
+		t.Fatalf("unexpected replay: %s", got)
+	}
+	if err := c.Catchup(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := strings.Join(seen, ","); got != "3,4,5" {
+		t.Fatalf("expected nothing to catch up on, got: %s", got)
+	}
+}
+
+func TestDurableRetriesUntilSuccess(t *testing.T) {
+	attempts := 0
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("handler failed")
+		}
+		return nil
+	})
+	store := &MemoryCheckpoints{}
+	c, err := NewClient([]string{"users"}, &Config{Outbox: &Outbox{Checkpoints: store, RetryInterval: time.Millisecond}}, &HandlerSet{Handlers: []Handler{handler}, ErrorHandler: func(err error) {}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c.durable.store = store
+	c.durable.read = func(ctx context.Context, channel string, after int64) ([]*pq.Notification, error) { return nil, nil }
+	c.deliverDurable(outboxRow("users", 1), 1)
+	if last, _ := store.Load(context.Background(), "users"); attempts != 3 || last != 1 {
+		t.Fatalf("expected the row to be checkpointed after 3 attempts, got %d attempts and checkpoint %d", attempts, last)
+	}
+}
+
+func TestNotDurable(t *testing.T) {
+	c, err := NewClient([]string{"users"}, &Config{}, &HandlerSet{Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.Catchup(context.Background()); err != ErrNotDurable {
+		t.Fatalf("expected ErrNotDurable, got: %v", err)
+	}
+	if err := c.Replay(context.Background(), "users", 0); err != ErrNotDurable {
+		t.Fatalf("expected ErrNotDurable, got: %v", err)
+	}
+}
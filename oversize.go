@@ -0,0 +1,291 @@
+package pqstream
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//chunkPrefix marks the notifications an oversized payload is split into by OversizeChunk. Chunks are reassembled by the client before dispatch
+const chunkPrefix = "pqstream:chunk:"
+
+//maxPendingChunks is the number of partly received chunked payloads a client holds before dropping the oldest
+const maxPendingChunks = 1000
+
+//maxChunkedPayload is the largest payload OversizeChunk sends, and maxChunks the most chunks it is split into, which bounds what a client allocates
+//for the chunk headers of untrusted notifications
+const (
+	maxChunkedPayload = 16 << 20
+	maxChunks         = maxChunkedPayload / (maxNotifyPayload / 2)
+)
+
+//ErrPayloadTooLarge is returned by NotifyWith for a payload over the NOTIFY size limit when its OversizePolicy is OversizeError
+var ErrPayloadTooLarge = errors.New("payload exceeds the 8000 byte NOTIFY limit")
+
+//OversizePolicy is what NotifyWith does with a payload too large for a single NOTIFY
+type OversizePolicy string
+
+const (
+	//OversizeChunk splits the payload across several notifications, sent atomically and in order, that the client reassembles before its handlers see them.
+	//Consumers other than pqstream clients see the chunks
+	OversizeChunk OversizePolicy = "chunk"
+	//OversizeStage inserts the envelope's data into a staging table and notifies with an Envelope whose Ref points at the row, see PayloadStage
+	OversizeStage OversizePolicy = "stage"
+	//OversizeError fails with ErrPayloadTooLarge before anything is sent
+	OversizeError OversizePolicy = "error"
+)
+
+//NotifyOptions configure how NotifyWith sends payloads too large for a single NOTIFY
+type NotifyOptions struct {
+	//Oversize is the fallback for payloads over the limit. Defaults to OversizeChunk
+	Oversize OversizePolicy
+	//StagingTable is the optionally schema qualified table OversizeStage inserts into. Defaults to pqstream_payloads
+	StagingTable string
+	//Deadline is set as the envelope's Deadline, when the notification must be processed by. Zero sets none
+	Deadline time.Time
+	//IDs generates the envelope's ID, ie: a shared *UUIDv7 so consumers can order and page on them. Defaults to RandomIDs
+	IDs IDGenerator
+	//SequenceTable is the sequence table, ie: pqstream_sequences from the library's migrations, assigning the envelope the channel's next Seq so consumers detect
+	//lost notifications. Chunked payloads are sent without one. Empty sends none
+	SequenceTable string
+}
+
+//seqReserve is the room left in a payload for the seq field NotifyOptions.SequenceTable adds
+var seqReserve = len(`"seq":9223372036854775807,`)
+
+func (o NotifyOptions) maxPayload() int {
+	if o.SequenceTable == "" {
+		return maxNotifyPayload
+	}
+	return maxNotifyPayload - seqReserve
+}
+
+//notify sends a payload to a channel. With a SequenceTable, the same statement assigns the channel's next sequence number and adds it to the payload,
+//so numbers are assigned in commit order
+func (o NotifyOptions) notify(ctx context.Context, db Execer, channel, payload string) error {
+	query := "SELECT pg_notify($1, $2)"
+	if o.SequenceTable != "" {
+		query = fmt.Sprintf(`WITH s AS (%s) SELECT pg_notify($1, '{"seq":' || s.seq || ',' || substr($2, 2)) FROM s`, sequenceUpsert(o.SequenceTable, "$1"))
+	}
+	if _, err := db.ExecContext(ctx, query, channel, payload); err != nil {
+		return fmt.Errorf("failed to notify channel: %s! %s", channel, err.Error())
+	}
+	return nil
+}
+
+func (o NotifyOptions) ids() IDGenerator {
+	if o.IDs == nil {
+		return RandomIDs{}
+	}
+	return o.IDs
+}
+
+func (o NotifyOptions) stagingTable() string {
+	if o.StagingTable == "" {
+		return "pqstream_payloads"
+	}
+	return o.StagingTable
+}
+
+//NotifyWith sends data to a channel in an Envelope like Notify, checking the encoded payload against the NOTIFY size limit first and falling back to
+//the options' OversizePolicy instead of letting postgres reject it. db may be a transaction, in which case every notification is sent when it commits
+func NotifyWith(ctx context.Context, db Execer, channel string, source Source, data any, opts NotifyOptions) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	id, err := opts.ids().NewID()
+	if err != nil {
+		return fmt.Errorf("failed to generate notification id! %s", err.Error())
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification data! %s", err.Error())
+	}
+	if source == "" {
+		source = SourceApplication
+	}
+	envelope := Envelope{ID: id, EmittedAt: time.Now().UTC(), Source: source, Data: encoded}
+	if !opts.Deadline.IsZero() {
+		deadline := opts.Deadline.UTC()
+		envelope.Deadline = &deadline
+	}
+	envelope.withTraceContext(ctx)
+	return notifyEnvelope(ctx, db, channel, envelope, opts)
+}
+
+//notifyEnvelope sends an envelope to a channel, falling back to the options' OversizePolicy when it is too large for a single NOTIFY
+func notifyEnvelope(ctx context.Context, db Execer, channel string, envelope Envelope, opts NotifyOptions) error {
+	id, encoded := envelope.ID, envelope.Data
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if len(payload) <= opts.maxPayload() {
+		return opts.notify(ctx, db, channel, string(payload))
+	}
+	switch opts.Oversize {
+	case OversizeError:
+		return fmt.Errorf("%w: %d bytes on channel: %s", ErrPayloadTooLarge, len(payload), channel)
+	case OversizeStage:
+		_, err := db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (id, channel, data) VALUES ($1, $2, $3)", quoteQualified(opts.stagingTable())), id, channel, string(encoded))
+		if err != nil {
+			return fmt.Errorf("failed to stage payload for channel: %s! %s", channel, err.Error())
+		}
+		envelope.Data, envelope.Ref = nil, opts.stagingTable()+":"+id
+		if payload, err = json.Marshal(envelope); err != nil {
+			return err
+		}
+		return opts.notify(ctx, db, channel, string(payload))
+	default:
+		if len(payload) > maxChunkedPayload {
+			return fmt.Errorf("%w: %d bytes on channel: %s is over the %d bytes chunked", ErrPayloadTooLarge, len(payload), channel, maxChunkedPayload)
+		}
+		//a single statement sends every chunk in one transaction, so consumers receive them together and in order
+		_, err := db.ExecContext(ctx, "SELECT pg_notify($1, c) FROM unnest($2::text[]) WITH ORDINALITY AS t(c, i) ORDER BY i", channel, pq.Array(chunkPayload(id, string(payload))))
+		if err != nil {
+			return fmt.Errorf("failed to notify channel: %s! %s", channel, err.Error())
+		}
+		return nil
+	}
+}
+
+//chunkPayload splits a payload into chunks that each fit in a NOTIFY with their header, never splitting a UTF-8 character
+func chunkPayload(id, payload string) []string {
+	var pieces []string
+	size := maxNotifyPayload - len(chunkPrefix) - len(id) - 24
+	for len(payload) > 0 {
+		end := size
+		if end >= len(payload) {
+			end = len(payload)
+		}
+		for end < len(payload) && !utf8.RuneStart(payload[end]) {
+			end--
+		}
+		pieces = append(pieces, payload[:end])
+		payload = payload[end:]
+	}
+	chunks := make([]string, len(pieces))
+	for i, piece := range pieces {
+		chunks[i] = fmt.Sprintf("%s%s:%d:%d:%s", chunkPrefix, id, i, len(pieces), piece)
+	}
+	return chunks
+}
+
+func isChunk(n *pq.Notification) bool {
+	return strings.HasPrefix(n.Extra, chunkPrefix)
+}
+
+//chunks reassembles chunked payloads, holding a bounded number of partly received ones
+type chunks struct {
+	mu      sync.Mutex
+	pending map[string]*list.Element
+	order   *list.List
+}
+
+type chunkSet struct {
+	key    string
+	pieces []string
+	seen   int
+}
+
+//assemble records a chunk, returning the reassembled notification once its last chunk has arrived
+func (c *chunks) assemble(n *pq.Notification) (*pq.Notification, bool, error) {
+	fields := strings.SplitN(strings.TrimPrefix(n.Extra, chunkPrefix), ":", 4)
+	if len(fields) != 4 {
+		return nil, false, fmt.Errorf("malformed chunk on channel: %s", n.Channel)
+	}
+	index, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed chunk on channel: %s", n.Channel)
+	}
+	total, err := strconv.Atoi(fields[2])
+	if err != nil || total <= 0 || total > maxChunks || index < 0 || index >= total {
+		return nil, false, fmt.Errorf("malformed chunk on channel: %s", n.Channel)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending, c.order = map[string]*list.Element{}, list.New()
+	}
+	key := n.Channel + ":" + fields[0]
+	el, ok := c.pending[key]
+	if !ok {
+		if c.order.Len() >= maxPendingChunks {
+			oldest := c.order.Front()
+			delete(c.pending, oldest.Value.(*chunkSet).key)
+			c.order.Remove(oldest)
+		}
+		el = c.order.PushBack(&chunkSet{key: key, pieces: make([]string, total)})
+		c.pending[key] = el
+	}
+	set := el.Value.(*chunkSet)
+	if len(set.pieces) != total {
+		return nil, false, fmt.Errorf("malformed chunk on channel: %s", n.Channel)
+	}
+	if set.pieces[index] == "" {
+		set.seen++
+	}
+	set.pieces[index] = fields[3]
+	if set.seen < total {
+		return nil, false, nil
+	}
+	delete(c.pending, key)
+	c.order.Remove(el)
+	return &pq.Notification{BePid: n.BePid, Channel: n.Channel, Extra: strings.Join(set.pieces, "")}, true, nil
+}
+
+//A PayloadStage resolves the envelopes OversizeStage sent with a Ref instead of their data
+type PayloadStage struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified staging table, as NotifyOptions.StagingTable. Defaults to pqstream_payloads. Refs to other tables are rejected,
+	//so a notification can't make the client read an arbitrary table
+	Table string
+}
+
+func (s *PayloadStage) table() string {
+	return NotifyOptions{StagingTable: s.Table}.stagingTable()
+}
+
+//Resolve returns the notification with its staged data restored to the envelope. Notifications without a Ref pass unchanged
+func (s *PayloadStage) Resolve(ctx context.Context, notification *pq.Notification) (*pq.Notification, error) {
+	e := envelopeOf(notification)
+	if e == nil || e.Ref == "" {
+		return notification, nil
+	}
+	i := strings.LastIndex(e.Ref, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("malformed payload ref: %s", e.Ref)
+	}
+	if e.Ref[:i] != s.table() {
+		return nil, fmt.Errorf("payload ref %s isn't in the staging table %s", e.Ref, s.table())
+	}
+	var data string
+	err := s.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT data::text FROM %s WHERE id = $1", quoteQualified(s.table())), e.Ref[i+1:]).Scan(&data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch staged payload %s! %s", e.Ref, err.Error())
+	}
+	e.Data, e.Ref = json.RawMessage(data), ""
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *notification
+	resolved.Extra = string(payload)
+	return &resolved, nil
+}
+
+//Transform returns a pipeline transform resolving staged payloads
+func (s *PayloadStage) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		return s.Resolve(context.Background(), notification)
+	}
+}
@@ -0,0 +1,77 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkPayload(t *testing.T) {
+	payload := strings.Repeat("héllo wörld ", 2000)
+	chunks := chunkPayload("abc", payload)
+	if len(chunks) < 4 {
+		t.Fatalf("expected the payload to be split, got %d chunks", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > maxNotifyPayload || !utf8.ValidString(chunk) {
+			t.Fatalf("expected every chunk to be valid UTF-8 within the NOTIFY limit, got %d bytes", len(chunk))
+		}
+	}
+}
+
+func TestChunkReassembly(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	c, err := NewClient([]string{"users"}, &Config{}, &HandlerSet{
+		Handlers: []Handler{HandlerFunc(func(n *pq.Notification) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, n.Extra)
+			return nil
+		})},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first, second := strings.Repeat("a", 10000), strings.Repeat("b", 10000)
+	a, b := chunkPayload("a", first), chunkPayload("b", second)
+	if len(a) != 2 {
+		t.Fatalf("expected the payload to be split in two, got %d chunks", len(a))
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	//chunks of different payloads may interleave, and one out of order still completes its payload
+	notify <- &pq.Notification{Channel: "users", Extra: a[1]}
+	notify <- &pq.Notification{Channel: "users", Extra: b[0]}
+	notify <- &pq.Notification{Channel: "users", Extra: "plain"}
+	notify <- &pq.Notification{Channel: "users", Extra: a[0]}
+	for _, chunk := range b[1:] {
+		notify <- &pq.Notification{Channel: "users", Extra: chunk}
+	}
+	close(notify)
+	<-done
+	if len(seen) != 3 || seen[0] != "plain" || seen[1] != first || seen[2] != second {
+		t.Fatalf("expected the plain notification and both reassembled payloads, got %d notifications", len(seen))
+	}
+	if len(c.chunks.pending) != 0 {
+		t.Fatalf("expected no partly received payloads, got %d", len(c.chunks.pending))
+	}
+}
+
+func TestChunkTotalBounded(t *testing.T) {
+	c := &chunks{}
+	if _, _, err := c.assemble(&pq.Notification{Channel: "users", Extra: chunkPrefix + "abc:0:999999999:x"}); err == nil {
+		t.Fatal("expected a chunk claiming too many chunks to be rejected")
+	}
+	if len(c.pending) != 0 {
+		t.Fatalf("expected nothing to be held, got %d", len(c.pending))
+	}
+}
@@ -0,0 +1,59 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestNotifyWithOversize(t *testing.T) {
+	ctx := context.Background()
+	large := strings.Repeat("x", 9000)
+	small := &execRecorder{}
+	if err := pqstream.NotifyWith(ctx, small, "users", "", "hello", pqstream.NotifyOptions{Oversize: pqstream.OversizeError}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(small.queries) != 1 || small.queries[0] != "SELECT pg_notify($1, $2)" {
+		t.Fatalf("expected a small payload to be notified directly, got: %v", small.queries)
+	}
+	rejected := &execRecorder{}
+	if err := pqstream.NotifyWith(ctx, rejected, "users", "", large, pqstream.NotifyOptions{Oversize: pqstream.OversizeError}); !errors.Is(err, pqstream.ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got: %v", err)
+	}
+	if len(rejected.queries) != 0 {
+		t.Fatalf("expected nothing to be sent, got: %v", rejected.queries)
+	}
+	staged := &execRecorder{}
+	if err := pqstream.NotifyWith(ctx, staged, "users", "", large, pqstream.NotifyOptions{Oversize: pqstream.OversizeStage, StagingTable: "app.payloads"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(staged.queries) != 2 || !strings.HasPrefix(staged.queries[0], `INSERT INTO "app"."payloads"`) {
+		t.Fatalf("expected the payload to be staged then notified, got: %v", staged.queries)
+	}
+	e := &pqstream.Envelope{}
+	if err := json.Unmarshal([]byte(staged.args[1][1].(string)), e); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Ref != "app.payloads:"+staged.args[0][0].(string) || len(e.Data) != 0 {
+		t.Fatalf("expected the envelope to reference the staged row, got: %+v", e)
+	}
+	chunked := &execRecorder{}
+	if err := pqstream.Notify(ctx, chunked, "users", "", large); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(chunked.queries) != 1 || !strings.Contains(chunked.queries[0], "unnest") {
+		t.Fatalf("expected the chunks to be sent in a single statement, got: %v", chunked.queries)
+	}
+}
+
+func TestPayloadStageRejectsOtherTables(t *testing.T) {
+	stage := &pqstream.PayloadStage{}
+	_, err := stage.Resolve(context.Background(), &pq.Notification{Extra: `{"id": "1", "ref": "users:1"}`})
+	if err == nil || !strings.Contains(err.Error(), "staging table") {
+		t.Fatalf("expected a ref to another table to be rejected, got %v", err)
+	}
+}
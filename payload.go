@@ -0,0 +1,76 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+//PayloadBytes returns a notification's payload as a []byte that shares memory with the payload string instead of copying it. The returned slice must not be modified
+func PayloadBytes(notification *pq.Notification) []byte {
+	if len(notification.Extra) == 0 {
+		return nil
+	}
+	return unsafe.Slice(unsafe.StringData(notification.Extra), len(notification.Extra))
+}
+
+//A Payload is a borrowed, read-only view of a notification's raw payload. It is only valid until the handler it was passed to returns, unless the handler calls Retain,
+//in which case it stays valid until the matching Release. Once the last reference is released Bytes returns nil. A Payload is safe for concurrent use
+type Payload struct {
+	mu   sync.RWMutex
+	data []byte
+	refs int32
+}
+
+//borrowPayload returns a zero-copy Payload over a notification's payload, held by one reference
+func borrowPayload(notification *pq.Notification) *Payload {
+	return &Payload{data: PayloadBytes(notification), refs: 1}
+}
+
+//Bytes returns the raw payload. The slice must not be modified or used after the payload is released
+func (p *Payload) Bytes() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.data
+}
+
+//Len returns the payload's size in bytes
+func (p *Payload) Len() int {
+	return len(p.Bytes())
+}
+
+//Retain keeps the payload valid after the handler returns, until a matching call to Release
+func (p *Payload) Retain() {
+	atomic.AddInt32(&p.refs, 1)
+}
+
+//Release drops a reference taken with Retain
+func (p *Payload) Release() {
+	if atomic.AddInt32(&p.refs, -1) == 0 {
+		p.mu.Lock()
+		p.data = nil
+		p.mu.Unlock()
+	}
+}
+
+//A BytesHandler is a Handler that opts into borrowing the raw payload rather than reading Notification.Extra, for throughput sensitive consumers
+type BytesHandler interface {
+	Handler
+	ProcessBytes(notification *pq.Notification, payload *Payload) error
+}
+
+//A BytesHandlerFunc is a first class function that satisfies the BytesHandler interface
+type BytesHandlerFunc func(notification *pq.Notification, payload *Payload) error
+
+//Process runs itself on a received postgres notification, borrowing its payload for the duration of the call
+func (h BytesHandlerFunc) Process(notification *pq.Notification) error {
+	payload := borrowPayload(notification)
+	defer payload.Release()
+	return h(notification, payload)
+}
+
+//ProcessBytes runs itself on a received postgres notification and its borrowed payload
+func (h BytesHandlerFunc) ProcessBytes(notification *pq.Notification, payload *Payload) error {
+	return h(notification, payload)
+}
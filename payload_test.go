@@ -0,0 +1,78 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestPayloadBytes(t *testing.T) {
+	n := &pq.Notification{Extra: `{"id": 1}`}
+	if string(pqstream.PayloadBytes(n)) != n.Extra {
+		t.Fatal("unexpected payload bytes")
+	}
+	if pqstream.PayloadBytes(&pq.Notification{}) != nil {
+		t.Fatal("expected nil bytes for an empty payload")
+	}
+}
+
+func TestBytesHandlerRetain(t *testing.T) {
+	var retained *pqstream.Payload
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.BytesHandlerFunc(func(n *pq.Notification, payload *pqstream.Payload) error {
+				payload.Retain()
+				retained = payload
+				return nil
+			}),
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "hello"})
+	if string(retained.Bytes()) != "hello" || retained.Len() != 5 {
+		t.Fatal("expected a retained payload to outlive the handler")
+	}
+	retained.Release()
+	if retained.Bytes() != nil {
+		t.Fatal("expected a released payload to be invalidated")
+	}
+}
+
+func BenchmarkPayloadBytes(b *testing.B) {
+	n := &pq.Notification{Extra: benchPayload}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if len(pqstream.PayloadBytes(n)) == 0 {
+			b.Fatal("empty payload")
+		}
+	}
+}
+
+func TestPayloadConcurrentRelease(t *testing.T) {
+	var retained *pqstream.Payload
+	handler := pqstream.BytesHandlerFunc(func(n *pq.Notification, payload *pqstream.Payload) error {
+		payload.Retain()
+		retained = payload
+		return nil
+	})
+	if err := handler.Process(&pq.Notification{Extra: "hello"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if b := retained.Bytes(); b != nil && string(b) != "hello" {
+				t.Errorf("unexpected payload: %q", b)
+			}
+		}
+	}()
+	retained.Release()
+	<-done
+	if retained.Bytes() != nil {
+		t.Fatal("expected a released payload to be invalidated")
+	}
+}
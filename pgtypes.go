@@ -0,0 +1,551 @@
+package pqstream
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//A ColumnType is how a PGCodec decodes a column's JSON value
+type ColumnType string
+
+const (
+	//TypeTimestamp decodes timestamptz, timestamp and date values as a Timestamp
+	TypeTimestamp ColumnType = "timestamp"
+	//TypeNumeric decodes numeric values, from JSON numbers or strings, as a Numeric
+	TypeNumeric ColumnType = "numeric"
+	//TypeGeometry decodes PostGIS geometry and geography values, as hex EWKB or GeoJSON, as a Geometry
+	TypeGeometry ColumnType = "geometry"
+)
+
+//timestampLayouts are the formats postgres writes timestamps and dates in, in JSON and as text
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+//A Timestamp is a postgres timestamptz, timestamp or date. Values without a zone, from timestamp and date columns, are in UTC.
+//Infinite is 1 for 'infinity' and -1 for '-infinity', which have no time
+type Timestamp struct {
+	time.Time
+	Infinite int
+}
+
+//UnmarshalJSON decodes a timestamp in any of the formats postgres writes them in
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("timestamp must be a string! %s", err.Error())
+	}
+	switch s {
+	case "infinity":
+		*t = Timestamp{Infinite: 1}
+		return nil
+	case "-infinity":
+		*t = Timestamp{Infinite: -1}
+		return nil
+	}
+	for _, layout := range timestampLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			*t = Timestamp{Time: parsed}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid timestamp %q", s)
+}
+
+//MarshalJSON encodes the timestamp as RFC 3339, or as 'infinity' or '-infinity'
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	switch {
+	case t.Infinite > 0:
+		return []byte(`"infinity"`), nil
+	case t.Infinite < 0:
+		return []byte(`"-infinity"`), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+//A Numeric is a postgres numeric in its exact decimal form, ie: 12345678901234567890.123456789, so it keeps the precision a float64 would lose.
+//It's also one of "NaN", "Infinity" or "-Infinity"
+type Numeric string
+
+//UnmarshalJSON decodes a numeric from a JSON number or a string
+func (n *Numeric) UnmarshalJSON(data []byte) error {
+	s := string(bytes.TrimSpace(data))
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	switch s {
+	case "NaN", "Infinity", "-Infinity":
+	default:
+		if _, ok := new(big.Rat).SetString(s); !ok {
+			return fmt.Errorf("invalid numeric %q", s)
+		}
+	}
+	*n = Numeric(s)
+	return nil
+}
+
+//MarshalJSON encodes the numeric as a JSON number, or as a string for NaN and infinities
+func (n Numeric) MarshalJSON() ([]byte, error) {
+	if _, ok := n.Rat(); !ok {
+		return json.Marshal(string(n))
+	}
+	return []byte(n), nil
+}
+
+//String returns the numeric's decimal form
+func (n Numeric) String() string {
+	return string(n)
+}
+
+//Rat returns the numeric's exact value, which NaN and infinities don't have
+func (n Numeric) Rat() (*big.Rat, bool) {
+	return new(big.Rat).SetString(string(n))
+}
+
+//Float64 returns the numeric's nearest float64, which may lose precision
+func (n Numeric) Float64() float64 {
+	switch n {
+	case "NaN":
+		return math.NaN()
+	case "Infinity":
+		return math.Inf(1)
+	case "-Infinity":
+		return math.Inf(-1)
+	}
+	r, ok := n.Rat()
+	if !ok {
+		return math.NaN()
+	}
+	f, _ := r.Float64()
+	return f
+}
+
+//A Geometry is a PostGIS geometry or geography as GeoJSON, ie: {"type": "Point", "coordinates": [1, 2]}. It decodes GeoJSON, from ST_AsGeoJSON, and the hex EWKB
+//postgres writes geometry columns as in row_to_json. SRID is the EWKB's spatial reference id, zero if it has none
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates,omitempty"`
+	Geometries  []Geometry      `json:"geometries,omitempty"`
+	SRID        int             `json:"-"`
+}
+
+//UnmarshalJSON decodes a GeoJSON geometry, as an object or a string, or a hex EWKB string
+func (g *Geometry) UnmarshalJSON(data []byte) error {
+	type geojson Geometry
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var decoded geojson
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return fmt.Errorf("invalid geojson! %s", err.Error())
+		}
+		*g = Geometry(decoded)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("geometry must be geojson or hex ewkb! %s", err.Error())
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return g.UnmarshalJSON([]byte(s))
+	}
+	wkb, err := hex.DecodeString(strings.TrimPrefix(s, `\x`))
+	if err != nil {
+		return fmt.Errorf("geometry must be geojson or hex ewkb! %s", err.Error())
+	}
+	r := &wkbReader{data: wkb}
+	geometry, err := r.geometry()
+	if err != nil {
+		return fmt.Errorf("invalid ewkb! %s", err.Error())
+	}
+	*g = *geometry
+	return nil
+}
+
+//Point returns a Point's coordinates
+func (g Geometry) Point() ([]float64, bool) {
+	var point []float64
+	if g.Type != "Point" || json.Unmarshal(g.Coordinates, &point) != nil {
+		return nil, false
+	}
+	return point, true
+}
+
+//wkbTypes are the GeoJSON types of the WKB geometry type codes
+var wkbTypes = map[uint32]string{
+	1: "Point",
+	2: "LineString",
+	3: "Polygon",
+	4: "MultiPoint",
+	5: "MultiLineString",
+	6: "MultiPolygon",
+	7: "GeometryCollection",
+}
+
+//EWKB flags set on the geometry type
+const (
+	ewkbZ    = 0x80000000
+	ewkbM    = 0x40000000
+	ewkbSRID = 0x20000000
+)
+
+//wkbReader decodes (E)WKB geometries
+type wkbReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errors.New("unexpected end of geometry")
+	}
+	v := r.order.Uint32(r.data)
+	r.data = r.data[4:]
+	return v, nil
+}
+
+func (r *wkbReader) float64() (float64, error) {
+	if len(r.data) < 8 {
+		return 0, errors.New("unexpected end of geometry")
+	}
+	v := math.Float64frombits(r.order.Uint64(r.data))
+	r.data = r.data[8:]
+	return v, nil
+}
+
+func (r *wkbReader) point(dims int) ([]float64, error) {
+	point := make([]float64, dims)
+	for i := range point {
+		v, err := r.float64()
+		if err != nil {
+			return nil, err
+		}
+		point[i] = v
+	}
+	return point, nil
+}
+
+func (r *wkbReader) points(dims int) ([][]float64, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(r.data)/(8*dims) {
+		return nil, errors.New("geometry has more points than data")
+	}
+	points := make([][]float64, n)
+	for i := range points {
+		if points[i], err = r.point(dims); err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
+func (r *wkbReader) rings(dims int) ([][][]float64, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(r.data)/4 {
+		return nil, errors.New("geometry has more rings than data")
+	}
+	rings := make([][][]float64, n)
+	for i := range rings {
+		if rings[i], err = r.points(dims); err != nil {
+			return nil, err
+		}
+	}
+	return rings, nil
+}
+
+func (r *wkbReader) geometry() (*Geometry, error) {
+	if len(r.data) < 1 {
+		return nil, errors.New("unexpected end of geometry")
+	}
+	switch r.data[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid byte order %d", r.data[0])
+	}
+	r.data = r.data[1:]
+	code, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	g := &Geometry{}
+	dims := 2
+	if code&ewkbZ != 0 {
+		dims++
+	}
+	if code&ewkbM != 0 {
+		dims++
+	}
+	if code&ewkbSRID != 0 {
+		srid, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		g.SRID = int(srid)
+	}
+	code &^= ewkbZ | ewkbM | ewkbSRID
+	//ISO WKB adds 1000 for Z, 2000 for M and 3000 for both to the type
+	dims += []int{0, 1, 1, 2}[code/1000%4]
+	code %= 1000
+	typ, ok := wkbTypes[code]
+	if !ok {
+		return nil, fmt.Errorf("unsupported geometry type %d", code)
+	}
+	g.Type = typ
+	var coordinates any
+	switch code {
+	case 1:
+		point, err := r.point(dims)
+		if err != nil {
+			return nil, err
+		}
+		//an empty point is encoded with NaN coordinates
+		if math.IsNaN(point[0]) {
+			point = []float64{}
+		}
+		coordinates = point
+	case 2:
+		coordinates, err = r.points(dims)
+	case 3:
+		coordinates, err = r.rings(dims)
+	default:
+		var parts []*Geometry
+		if parts, err = r.collection(); err != nil {
+			return nil, err
+		}
+		if code == 7 {
+			for _, part := range parts {
+				g.Geometries = append(g.Geometries, *part)
+			}
+			if g.Geometries == nil {
+				g.Geometries = []Geometry{}
+			}
+			return g, nil
+		}
+		multi := make([]json.RawMessage, len(parts))
+		for i, part := range parts {
+			multi[i] = part.Coordinates
+		}
+		coordinates = multi
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.Coordinates, err = json.Marshal(coordinates); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+//collection decodes the geometries of a multi geometry or geometry collection, each with its own byte order
+func (r *wkbReader) collection() ([]*Geometry, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(r.data)/5 {
+		return nil, errors.New("geometry has more parts than data")
+	}
+	parts := make([]*Geometry, n)
+	for i := range parts {
+		if parts[i], err = r.geometry(); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+//A PGCodec decodes JSON payloads like the JSONCodec, then converts the columns of Rows and ChangeEvents it has a ColumnType for into faithful Go values:
+//Timestamps, Numerics and Geometries instead of strings and float64s. Use it as the DefaultCodec, ie: pqstream.DefaultCodec = &pqstream.PGCodec{Columns: ...}.
+//Change events from triggers installed with EnsureTriggers carry their columns' types, so they're converted without configuring any.
+//Struct fields get the same values by declaring them as those types
+type PGCodec struct {
+	//Columns maps column names to their type, overriding the types change events carry. Names may be qualified by table, ie: users.balance,
+	//or schema and table, ie: public.users.balance, and the most qualified name a change event's column matches wins
+	Columns map[string]ColumnType
+}
+
+//Decode unmarshals a JSON payload into v, converting the typed columns of a Row or a ChangeEvent
+func (c *PGCodec) Decode(payload string, v any) error {
+	if err := (JSONCodec{}).Decode(payload, v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case **ChangeEvent:
+		if *v != nil {
+			return c.convertChange(*v)
+		}
+	case *ChangeEvent:
+		return c.convertChange(v)
+	case *Row:
+		return c.convertRow("", "", *v, nil)
+	}
+	return nil
+}
+
+func (c *PGCodec) convertChange(e *ChangeEvent) error {
+	if err := c.convertRow(e.Schema, e.Table, e.Old, e.Types); err != nil {
+		return err
+	}
+	return c.convertRow(e.Schema, e.Table, e.New, e.Types)
+}
+
+//columnType returns the type of a column, by its most qualified name, then by the types its change event carries
+func (c *PGCodec) columnType(schema, table, column string, types map[string]ColumnType) (ColumnType, bool) {
+	if schema != "" && table != "" {
+		if typ, ok := c.Columns[schema+"."+table+"."+column]; ok {
+			return typ, true
+		}
+	}
+	if table != "" {
+		if typ, ok := c.Columns[table+"."+column]; ok {
+			return typ, true
+		}
+	}
+	if typ, ok := c.Columns[column]; ok {
+		return typ, true
+	}
+	typ, ok := types[column]
+	return typ, ok
+}
+
+func (c *PGCodec) convertRow(schema, table string, row map[string]any, types map[string]ColumnType) error {
+	for column, value := range row {
+		typ, ok := c.columnType(schema, table, column, types)
+		if !ok || value == nil {
+			continue
+		}
+		converted, err := ConvertValue(typ, value)
+		if err != nil {
+			return fmt.Errorf("failed to decode column %s as %s! %s", column, typ, err.Error())
+		}
+		row[column] = converted
+	}
+	return nil
+}
+
+//PostgresColumnType returns the ColumnType of a column from its information_schema.columns data_type and udt_name, if it has one.
+//Other types round-trip through JSON faithfully, bigints included as a Row keeps numbers as json.Number
+func PostgresColumnType(dataType, udtName string) (ColumnType, bool) {
+	switch strings.ToLower(dataType) {
+	case "numeric", "decimal":
+		return TypeNumeric, true
+	case "timestamp with time zone", "timestamp without time zone", "date":
+		return TypeTimestamp, true
+	case "user-defined":
+		switch strings.ToLower(udtName) {
+		case "geometry", "geography":
+			return TypeGeometry, true
+		}
+	}
+	return "", false
+}
+
+//IntrospectColumnTypes returns the ColumnTypes of the tables' columns from information_schema, keyed by schema, table and column, ie: public.users.balance,
+//so a PGCodec decodes payloads other than change events faithfully too. Unqualified tables are in the current schema
+func IntrospectColumnTypes(ctx context.Context, db *sql.DB, tables ...string) (map[string]ColumnType, error) {
+	types := map[string]ColumnType{}
+	for _, table := range tables {
+		schema, columns, err := columnTypes(ctx, db, table)
+		if err != nil {
+			return nil, err
+		}
+		for column, typ := range columns {
+			types[schema+"."+unqualified(table)+"."+column] = typ
+		}
+	}
+	return types, nil
+}
+
+//queryer is satisfied by a *sql.DB and a *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+//columnTypes returns a table's schema and the ColumnTypes of its columns that have one
+func columnTypes(ctx context.Context, q queryer, table string) (string, map[string]ColumnType, error) {
+	var schema sql.NullString
+	if s := schemaOf(table); s != "" {
+		schema = sql.NullString{String: s, Valid: true}
+	}
+	rows, err := q.QueryContext(ctx, `SELECT table_schema, column_name, data_type, udt_name FROM information_schema.columns
+WHERE table_schema = COALESCE($1, current_schema()) AND table_name = $2 ORDER BY ordinal_position`, schema, unqualified(table))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read column types of %s! %s", table, err.Error())
+	}
+	defer rows.Close()
+	var found string
+	types := map[string]ColumnType{}
+	for rows.Next() {
+		var column, dataType, udtName string
+		if err := rows.Scan(&found, &column, &dataType, &udtName); err != nil {
+			return "", nil, err
+		}
+		if typ, ok := PostgresColumnType(dataType, udtName); ok {
+			types[column] = typ
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	if found == "" {
+		return "", nil, fmt.Errorf("table %s has no columns or doesn't exist", table)
+	}
+	return found, types, nil
+}
+
+//ConvertValue converts a decoded JSON value into the Go value of a column type: a Timestamp, Numeric or Geometry. Values of unknown types are returned unchanged
+func ConvertValue(typ ColumnType, value any) (any, error) {
+	var target json.Unmarshaler
+	switch typ {
+	case TypeTimestamp:
+		target = &Timestamp{}
+	case TypeNumeric:
+		target = new(Numeric)
+	case TypeGeometry:
+		target = &Geometry{}
+	default:
+		return value, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := target.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case *Timestamp:
+		return *t, nil
+	case *Numeric:
+		return *t, nil
+	case *Geometry:
+		return *t, nil
+	}
+	return value, nil
+}
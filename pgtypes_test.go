@@ -0,0 +1,113 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPGTypes(t *testing.T) {
+	var row struct {
+		At       pqstream.Timestamp `json:"at"`
+		Day      pqstream.Timestamp `json:"day"`
+		Forever  pqstream.Timestamp `json:"forever"`
+		Balance  pqstream.Numeric   `json:"balance"`
+		Quoted   pqstream.Numeric   `json:"quoted"`
+		Location pqstream.Geometry  `json:"location"`
+		Stops    pqstream.Geometry  `json:"stops"`
+		Area     pqstream.Geometry  `json:"area"`
+	}
+	payload := `{"at": "2024-03-01T12:30:00.123456+05:30", "day": "2024-03-01", "forever": "infinity",
+		"balance": 12345678901234567890.123456789, "quoted": "NaN",
+		"location": "0101000020e6100000000000000000f83f0000000000000040",
+		"stops": "00000003ec0000000200000003e93ff00000000000004000000000000000400800000000000000000003e9401000000000000040140000000000004018000000000000",
+		"area": {"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0]]]}}`
+	if err := pqstream.DecodeJSON(&pq.Notification{Extra: payload}, &row); err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := time.Date(2024, 3, 1, 7, 0, 0, 123456000, time.UTC); !row.At.Equal(want) || !row.Day.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected timestamps: %s %s", row.At, row.Day)
+	}
+	if row.Forever.Infinite != 1 {
+		t.Fatalf("expected infinity, got: %+v", row.Forever)
+	}
+	if row.Balance.String() != "12345678901234567890.123456789" || row.Quoted != "NaN" {
+		t.Fatalf("expected numerics to keep their precision, got: %s %s", row.Balance, row.Quoted)
+	}
+	if point, ok := row.Location.Point(); !ok || point[0] != 1.5 || point[1] != 2 || row.Location.SRID != 4326 {
+		t.Fatalf("expected an ewkb point, got: %+v", row.Location)
+	}
+	if row.Stops.Type != "MultiPoint" || string(row.Stops.Coordinates) != "[[1,2,3],[4,5,6]]" {
+		t.Fatalf("expected a wkb multipoint with z, got: %s %s", row.Stops.Type, row.Stops.Coordinates)
+	}
+	if row.Area.Type != "Polygon" {
+		t.Fatalf("expected a geojson polygon, got: %+v", row.Area)
+	}
+	encoded, _ := json.Marshal(row.Balance)
+	if string(encoded) != "12345678901234567890.123456789" {
+		t.Fatalf("expected a numeric to encode as an exact number, got: %s", encoded)
+	}
+	var bad pqstream.Numeric
+	if err := json.Unmarshal([]byte(`"12abc"`), &bad); err == nil {
+		t.Fatal("expected an invalid numeric to fail")
+	}
+}
+
+func TestPGCodec(t *testing.T) {
+	codec := &pqstream.PGCodec{Columns: map[string]pqstream.ColumnType{
+		"updated_at":          pqstream.TypeTimestamp,
+		"accounts.amount":     pqstream.TypeNumeric,
+		"public.orders.total": pqstream.TypeNumeric,
+		"other.orders.total":  pqstream.TypeTimestamp,
+	}}
+	var event *pqstream.ChangeEvent
+	err := codec.Decode(`{"schema": "public", "table": "orders", "op": "UPDATE", "old": {"total": 1.10, "updated_at": null},
+		"new": {"total": 99999999999999999.99, "amount": 5, "updated_at": "2024-03-01T00:00:00+00:00"}}`, &event)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total, ok := event.New["total"].(pqstream.Numeric); !ok || total != "99999999999999999.99" || event.Old["total"] != pqstream.Numeric("1.10") {
+		t.Fatalf("expected totals to decode as numerics, got: %#v %#v", event.New["total"], event.Old["total"])
+	}
+	if _, ok := event.New["updated_at"].(pqstream.Timestamp); !ok || event.Old["updated_at"] != nil {
+		t.Fatalf("expected updated_at to decode as a timestamp, got: %#v", event.New["updated_at"])
+	}
+	if _, ok := event.New["amount"].(json.Number); !ok {
+		t.Fatalf("expected a column of another table to be left alone, got: %#v", event.New["amount"])
+	}
+	if err := codec.Decode(`{"table": "accounts", "op": "INSERT", "new": {"updated_at": "yesterday"}}`, &event); err == nil {
+		t.Fatal("expected an invalid timestamp to fail")
+	}
+}
+
+func TestPGCodecEventTypes(t *testing.T) {
+	spec := pqstream.TriggerSpec{Table: "orders", Key: []string{"id"}, Types: map[string]pqstream.ColumnType{"total": pqstream.TypeNumeric}}
+	if up := spec.Up(); strings.Count(up, `'types', '{"total":"numeric"}'::json,`) != 2 {
+		t.Fatalf("expected both the full and truncated events to carry the types, got:\n%s", up)
+	}
+	var event *pqstream.ChangeEvent
+	if err := (&pqstream.PGCodec{}).Decode(`{"table": "orders", "op": "INSERT", "types": {"total": "numeric"}, "new": {"id": 1, "total": 0.1000000000000000055511}}`, &event); err != nil {
+		t.Fatal(err.Error())
+	}
+	if event.New["total"] != pqstream.Numeric("0.1000000000000000055511") {
+		t.Fatalf("expected the event's types to decode total as a numeric, got: %#v", event.New["total"])
+	}
+	for _, c := range []struct {
+		dataType, udtName string
+		want              pqstream.ColumnType
+	}{
+		{"numeric", "numeric", pqstream.TypeNumeric},
+		{"timestamp with time zone", "timestamptz", pqstream.TypeTimestamp},
+		{"date", "date", pqstream.TypeTimestamp},
+		{"USER-DEFINED", "geography", pqstream.TypeGeometry},
+		{"USER-DEFINED", "citext", ""},
+		{"bigint", "int8", ""},
+	} {
+		if got, _ := pqstream.PostgresColumnType(c.dataType, c.udtName); got != c.want {
+			t.Fatalf("expected %s to map to %q, got: %q", c.dataType, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//A Sink delivers notifications to a downstream system
+type Sink interface {
+	Named
+	Send(ctx context.Context, notification *pq.Notification) error
+}
+
+type sinkFunc struct {
+	name string
+	send func(ctx context.Context, notification *pq.Notification) error
+}
+
+func (s *sinkFunc) Name() string {
+	return s.name
+}
+
+func (s *sinkFunc) Send(ctx context.Context, notification *pq.Notification) error {
+	return s.send(ctx, notification)
+}
+
+//NewSink is a helper function to create a named Sink from a first class function
+func NewSink(name string, send func(ctx context.Context, notification *pq.Notification) error) Sink {
+	return &sinkFunc{name: name, send: send}
+}
+
+//A FilterFunc reports whether a notification should continue through a pipeline
+type FilterFunc func(notification *pq.Notification) bool
+
+//A TransformFunc rewrites a notification as it moves through a pipeline. Returning a nil notification drops it
+type TransformFunc func(notification *pq.Notification) (*pq.Notification, error)
+
+//ErrorPolicy configures how a pipeline reacts to sink failures
+type ErrorPolicy struct {
+	//Retries is how many times a failed send is retried per sink
+	Retries int
+	//Backoff is the delay before the first retry, doubling after each attempt
+	Backoff time.Duration
+	//Ignore drops sink errors once retries are exhausted instead of reporting them to the client's ErrorHandler
+	Ignore bool
+}
+
+//A Pipeline is a declarative, higher-level alternative to a HandlerSet: Source -> Filter/Transform stages -> FanOut(sinks...) -> ErrorPolicy.
+//A Pipeline is itself a Handler, so it can be tested by calling Process directly or registered alongside other handlers
+type Pipeline struct {
+	channels []string
+	stages   []stage
+	sinks    []Sink
+	policy   ErrorPolicy
+	acks     *ackTracker
+	clock    Clock
+	encoding *Encodings
+}
+
+type stage struct {
+	name      string
+	filter    FilterFunc
+	transform TransformFunc
+	routes    []Route
+}
+
+//A Route sends the notifications matching its When predicate down a branch pipeline. A Route with a nil When is a default branch, taken only when no other route matched
+type Route struct {
+	Name   string
+	When   FilterFunc
+	Branch *Pipeline
+}
+
+//NewPipeline creates an empty pipeline
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+//Source restricts the pipeline to notifications from the given channels. A pipeline without a source accepts every channel
+func (p *Pipeline) Source(channels ...string) *Pipeline {
+	p.channels = append(p.channels, channels...)
+	return p
+}
+
+//Filter adds a stage dropping notifications the filter rejects
+func (p *Pipeline) Filter(filter FilterFunc) *Pipeline {
+	p.stages = append(p.stages, stage{name: fmt.Sprintf("filter[%d]", len(p.stages)), filter: filter})
+	return p
+}
+
+//Transform adds a stage rewriting notifications before they reach the sinks
+func (p *Pipeline) Transform(transform TransformFunc) *Pipeline {
+	p.stages = append(p.stages, stage{name: fmt.Sprintf("transform[%d]", len(p.stages)), transform: transform})
+	return p
+}
+
+//Route adds a branching stage: each notification is sent down every route it matches. The output of each branch (after its own stages and sinks) is merged back and continues through the
+//remaining stages of this pipeline, so branches can either terminate in their own sinks or rejoin the main flow. Notifications matching no route are dropped
+func (p *Pipeline) Route(routes ...Route) *Pipeline {
+	p.stages = append(p.stages, stage{name: fmt.Sprintf("route[%d]", len(p.stages)), routes: routes})
+	return p
+}
+
+//FanOut adds sinks that every notification surviving the pipeline's stages is delivered to concurrently
+func (p *Pipeline) FanOut(sinks ...Sink) *Pipeline {
+	p.sinks = append(p.sinks, sinks...)
+	return p
+}
+
+//OnError sets the pipeline's ErrorPolicy
+func (p *Pipeline) OnError(policy ErrorPolicy) *Pipeline {
+	p.policy = policy
+	return p
+}
+
+//Encodings sets the encodings negotiated with the pipeline's EncodingSinks, each delivered notifications encoded in the one it prefers.
+//Other sinks are sent notifications as they are
+func (p *Pipeline) Encodings(encodings *Encodings) *Pipeline {
+	p.encoding = encodings
+	return p
+}
+
+//Clock sets the source of time for retry backoff. Defaults to the client's Clock, or SystemClock
+func (p *Pipeline) Clock(clock Clock) *Pipeline {
+	p.clock = clock
+	return p
+}
+
+//Channels returns the channels the pipeline sources from
+func (p *Pipeline) Channels() []string {
+	return append([]string{}, p.channels...)
+}
+
+//HandlerSet returns a HandlerSet running the pipeline
+func (p *Pipeline) HandlerSet() *HandlerSet {
+	return &HandlerSet{Handlers: []Handler{p}}
+}
+
+//NewPipelineClient provides a LISTEN NOTIFY client running each pipeline on the channels it sources from
+func NewPipelineClient(config *Config, pipelines ...*Pipeline) (*Client, error) {
+	if len(pipelines) == 0 {
+		return nil, errors.New("zero pipelines")
+	}
+	var channels []string
+	seen := map[string]bool{}
+	handlers := &HandlerSet{}
+	for _, p := range pipelines {
+		if len(p.channels) == 0 {
+			return nil, errors.New("pipeline has no source channels")
+		}
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		if p.acks != nil && config != nil && config.Delivery == DeliveryAtMostOnce {
+			return nil, errors.New("at most once delivery can't be combined with: pipeline Checkpoint")
+		}
+		for _, ch := range p.channels {
+			if !seen[ch] {
+				seen[ch] = true
+				channels = append(channels, ch)
+			}
+		}
+		handlers.Handlers = append(handlers.Handlers, p)
+	}
+	client, err := NewClient(channels, config, handlers)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pipelines {
+		if p.clock == nil {
+			p.clock = config.Clock
+		}
+	}
+	return client, nil
+}
+
+//Process runs the pipeline on a notification
+func (p *Pipeline) Process(notification *pq.Notification) error {
+	return p.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs the pipeline on a notification
+func (p *Pipeline) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if p.acks != nil && p.accepts(notification.Channel) {
+		var event *ackEvent
+		event, ctx = p.acks.begin(ctx, notification)
+		_, err := p.run(ctx, notification)
+		event.ack(err)
+		return err
+	}
+	_, err := p.run(ctx, notification)
+	return err
+}
+
+//A SinkFactory builds the sink a SinkSpec declares, ie: connecting a relay to the database its DSNEnv names
+type SinkFactory func(spec SinkSpec) (Sink, error)
+
+//Build creates the pipeline a spec from a PipelineConfig declares: sourced from its channels, filtered on its columns, mapped, routed and fanned out to
+//the sinks the factory builds, so branching flows can be defined in the config file rather than in code
+func (s PipelineSpec) Build(sinks SinkFactory) (*Pipeline, error) {
+	p := NewPipeline().Source(s.Channels...)
+	if len(s.Columns) > 0 {
+		p.Filter(ColumnsChanged(s.Columns))
+	}
+	if err := buildStages(p, s.Mapping, s.Routes, s.Sinks, sinks); err != nil {
+		return nil, fmt.Errorf("failed to build pipeline %s! %s", s.Name, err.Error())
+	}
+	return p, nil
+}
+
+func (r RouteSpec) build(sinks SinkFactory) (Route, error) {
+	route := Route{Name: r.Name, Branch: NewPipeline()}
+	if len(r.When) > 0 {
+		route.When = Matches(r.When...)
+	}
+	if err := buildStages(route.Branch, r.Mapping, r.Routes, r.Sinks, sinks); err != nil {
+		return Route{}, fmt.Errorf("route %s: %s", r.Name, err.Error())
+	}
+	return route, nil
+}
+
+//buildStages adds the stages and sinks shared by pipeline and route specs
+func buildStages(p *Pipeline, mapping *Mapping, routes []RouteSpec, specs []SinkSpec, sinks SinkFactory) error {
+	if mapping != nil {
+		p.Transform(mapping.Transform())
+	}
+	if len(routes) > 0 {
+		built := make([]Route, len(routes))
+		for i, r := range routes {
+			route, err := r.build(sinks)
+			if err != nil {
+				return err
+			}
+			built[i] = route
+		}
+		p.Route(built...)
+	}
+	for i, spec := range specs {
+		sink, err := sinks(spec)
+		if err != nil {
+			return fmt.Errorf("sinks[%d]: failed to build %s sink! %s", i, spec.Type, err.Error())
+		}
+		p.FanOut(sink)
+	}
+	return nil
+}
+
+//Validate checks that the pipeline's routes form a DAG
+func (p *Pipeline) Validate() error {
+	return p.validate(map[*Pipeline]bool{})
+}
+
+func (p *Pipeline) validate(path map[*Pipeline]bool) error {
+	if path[p] {
+		return errors.New("pipeline routes contain a cycle")
+	}
+	path[p] = true
+	defer delete(path, p)
+	for _, sink := range p.sinks {
+		if _, err := p.encoded(sink); err != nil {
+			return err
+		}
+	}
+	for _, s := range p.stages {
+		for _, r := range s.routes {
+			if r.Branch == nil {
+				return fmt.Errorf("%s: route %q has no branch", s.name, r.Name)
+			}
+			if err := r.Branch.validate(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//run walks a notification through the pipeline's stages and sinks, returning the notifications that reached the end of the pipeline
+func (p *Pipeline) run(ctx context.Context, notification *pq.Notification) ([]*pq.Notification, error) {
+	if !p.accepts(notification.Channel) {
+		return nil, nil
+	}
+	tr := traceFrom(ctx)
+	current := []*pq.Notification{notification}
+	//a notification failing a stage or its sinks doesn't hold back the others merged with it, so errors are collected rather than returned
+	var errs []error
+	for _, s := range p.stages {
+		var next []*pq.Notification
+		for _, n := range current {
+			switch {
+			case s.filter != nil:
+				if !s.filter(n) {
+					tr.record(TraceEvent{Stage: TraceFiltered, Handler: s.name})
+					continue
+				}
+				next = append(next, n)
+			case s.transform != nil:
+				out, err := s.transform(n)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+					continue
+				}
+				if out == nil {
+					tr.record(TraceEvent{Stage: TraceFiltered, Handler: s.name})
+					continue
+				}
+				next = append(next, out)
+			default:
+				merged, err := s.route(ctx, n)
+				if err != nil {
+					errs = append(errs, err)
+				}
+				next = append(next, merged...)
+			}
+		}
+		current = next
+		if len(current) == 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+	var delivered []*pq.Notification
+	for _, n := range current {
+		if err := p.fanOut(ctx, n); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delivered = append(delivered, n)
+	}
+	return delivered, errors.Join(errs...)
+}
+
+//route runs a notification down every matching branch concurrently and merges their outputs
+func (s stage) route(ctx context.Context, n *pq.Notification) ([]*pq.Notification, error) {
+	var branches []Route
+	var fallback []Route
+	for _, r := range s.routes {
+		switch {
+		case r.When == nil:
+			fallback = append(fallback, r)
+		case r.When(n):
+			branches = append(branches, r)
+		}
+	}
+	if len(branches) == 0 {
+		branches = fallback
+	}
+	if len(branches) == 0 {
+		traceFrom(ctx).record(TraceEvent{Stage: TraceFiltered, Handler: s.name})
+		return nil, nil
+	}
+	outputs := make([][]*pq.Notification, len(branches))
+	errs := make([]error, len(branches))
+	wg := sync.WaitGroup{}
+	for i, r := range branches {
+		wg.Add(1)
+		go func(i int, r Route) {
+			defer wg.Done()
+			outputs[i], errs[i] = r.Branch.run(ctx, n)
+		}(i, r)
+	}
+	wg.Wait()
+	var merged []*pq.Notification
+	var failed []error
+	for i, r := range branches {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("route %s: %w", r.Name, errs[i]))
+		}
+		merged = append(merged, outputs[i]...)
+	}
+	return merged, errors.Join(failed...)
+}
+
+func (p *Pipeline) accepts(channel string) bool {
+	if len(p.channels) == 0 {
+		return true
+	}
+	for _, ch := range p.channels {
+		if ch == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pipeline) fanOut(ctx context.Context, n *pq.Notification) error {
+	errs := make([]error, len(p.sinks))
+	if p.encoding != nil {
+		ctx = withEncodeCache(ctx)
+	}
+	wg := sync.WaitGroup{}
+	for i, sink := range p.sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			errs[i] = p.send(ctx, sink, n)
+		}(i, sink)
+	}
+	wg.Wait()
+	if p.policy.Ignore {
+		return nil
+	}
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("sink %s: %w", p.sinks[i].Name(), err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+//send delivers a notification to a single sink, retrying according to the policy. Deliveries to required sinks are acknowledged to the notification's checkpoint, if any
+func (p *Pipeline) send(ctx context.Context, sink Sink, n *pq.Notification) error {
+	optional := isOptional(sink)
+	sink, err := p.encoded(sink)
+	if err != nil {
+		return err
+	}
+	event := ackFrom(ctx)
+	if event == nil || optional {
+		return sendWithRetry(ctx, clockOr(p.clock), sink, n, p.policy.Retries, p.policy.Backoff)
+	}
+	event.add()
+	if async, ok := sink.(AsyncSink); ok {
+		err := async.SendAck(ctx, n, event.ack)
+		if err != nil {
+			event.ack(err)
+		}
+		return err
+	}
+	err = sendWithRetry(ctx, clockOr(p.clock), sink, n, p.policy.Retries, p.policy.Backoff)
+	event.ack(err)
+	return err
+}
+
+//encoded returns the sink to deliver to: an EncodingSink in the encoding negotiated with it, when the pipeline has Encodings, otherwise the sink itself
+func (p *Pipeline) encoded(sink Sink) (Sink, error) {
+	if p.encoding == nil {
+		return sink, nil
+	}
+	target := sink
+	if optional, ok := sink.(optionalSink); ok {
+		target = optional.Sink
+	}
+	es, ok := target.(EncodingSink)
+	if !ok {
+		return sink, nil
+	}
+	encoding, err := p.encoding.Negotiate(es.Accepts())
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", sink.Name(), err)
+	}
+	return &encodedSink{sink: es, encoding: encoding, clock: clockOr(p.clock)}, nil
+}
+
+//sendWithRetry delivers a notification to a sink, retrying failures with exponential backoff
+func sendWithRetry(ctx context.Context, clock Clock, sink Sink, n *pq.Notification, retries int, backoff time.Duration) error {
+	tr := traceFrom(ctx)
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = sink.Send(ctx, n)
+		e := TraceEvent{Stage: TraceSink, Sink: sink.Name()}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		tr.record(e)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		tr.record(TraceEvent{Stage: TraceRetry, Sink: sink.Name()})
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
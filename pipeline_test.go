@@ -0,0 +1,228 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingSink struct {
+	name  string
+	mu    sync.Mutex
+	fails int
+	sent  []string
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Send(ctx context.Context, notification *pq.Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, notification.Extra)
+	return nil
+}
+
+func (s *recordingSink) payloads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.sent...)
+}
+
+func TestPipeline(t *testing.T) {
+	a, b := &recordingSink{name: "a"}, &recordingSink{name: "b", fails: 1}
+	p := pqstream.NewPipeline().
+		Source("users").
+		Filter(func(n *pq.Notification) bool { return n.Extra != "skip" }).
+		Transform(func(n *pq.Notification) (*pq.Notification, error) {
+			return &pq.Notification{Channel: n.Channel, Extra: strings.ToUpper(n.Extra)}, nil
+		}).
+		FanOut(a, b).
+		OnError(pqstream.ErrorPolicy{Retries: 1})
+
+	for _, payload := range []string{"bob", "skip"} {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := p.Process(&pq.Notification{Channel: "accounts", Extra: "other"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := a.payloads(); len(got) != 1 || got[0] != "BOB" {
+		t.Fatalf("unexpected sink a payloads: %v", got)
+	}
+	if got := b.payloads(); len(got) != 1 || got[0] != "BOB" {
+		t.Fatalf("expected sink b to succeed on retry, got: %v", got)
+	}
+
+	b.fails = 2
+	if err := p.Process(&pq.Notification{Channel: "users", Extra: "alice"}); err == nil || !strings.Contains(err.Error(), "sink b") {
+		t.Fatalf("expected sink b error after retries, got: %v", err)
+	}
+	p.OnError(pqstream.ErrorPolicy{Ignore: true})
+	b.fails = 1
+	if err := p.Process(&pq.Notification{Channel: "users", Extra: "eve"}); err != nil {
+		t.Fatalf("expected ignored sink error, got: %s", err.Error())
+	}
+}
+
+func TestPipelineClient(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := &recordingSink{name: "audit"}
+	users := pqstream.NewPipeline().Source("users").Filter(func(n *pq.Notification) bool { return n.Extra != "" }).FanOut(sink)
+	accounts := pqstream.NewPipeline().Source("accounts", "users").FanOut(sink)
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{TraceWriter: buf}, users, accounts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if channels := client.Stats().Member.Channels; len(channels) != 2 {
+		t.Fatalf("expected merged pipeline channels, got: %v", channels)
+	}
+	client.Process(&pq.Notification{Channel: "users"})
+	if !strings.Contains(buf.String(), `"stage":"filtered"`) || !strings.Contains(buf.String(), `"sink":"audit"`) {
+		t.Fatalf("expected filter and sink stages in trace, got: %s", buf.String())
+	}
+	if _, err := pqstream.NewPipelineClient(&pqstream.Config{}, pqstream.NewPipeline()); err == nil {
+		t.Fatal("expected an error for a pipeline without source channels")
+	}
+}
+
+func TestPipelineRoutes(t *testing.T) {
+	search, cache, merged, fallback := &recordingSink{name: "search"}, &recordingSink{name: "cache"}, &recordingSink{name: "merged"}, &recordingSink{name: "fallback"}
+	isInsert := func(n *pq.Notification) bool { return strings.HasPrefix(n.Extra, "insert") }
+	isDelete := func(n *pq.Notification) bool { return strings.HasPrefix(n.Extra, "delete") }
+	p := pqstream.NewPipeline().
+		Source("users").
+		Route(
+			pqstream.Route{Name: "inserts", When: isInsert, Branch: pqstream.NewPipeline().Transform(func(n *pq.Notification) (*pq.Notification, error) {
+				return &pq.Notification{Channel: n.Channel, Extra: n.Extra + ":indexed"}, nil
+			}).FanOut(search)},
+			pqstream.Route{Name: "deletes", When: isDelete, Branch: pqstream.NewPipeline().FanOut(cache)},
+			pqstream.Route{Name: "other", Branch: pqstream.NewPipeline().
+				Filter(func(n *pq.Notification) bool { return false }).
+				FanOut(fallback)},
+		).
+		FanOut(merged)
+	if err := p.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{"insert 1", "delete 2", "update 3"} {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got := search.payloads(); len(got) != 1 || got[0] != "insert 1:indexed" {
+		t.Fatalf("unexpected search payloads: %v", got)
+	}
+	if got := cache.payloads(); len(got) != 1 || got[0] != "delete 2" {
+		t.Fatalf("unexpected cache payloads: %v", got)
+	}
+	if got := merged.payloads(); len(got) != 2 {
+		t.Fatalf("expected both branch outputs to be merged, got: %v", got)
+	}
+	if got := fallback.payloads(); len(got) != 0 {
+		t.Fatalf("expected default branch to filter everything, got: %v", got)
+	}
+}
+
+func TestPipelineCycle(t *testing.T) {
+	root := pqstream.NewPipeline().Source("users")
+	branch := pqstream.NewPipeline().Route(pqstream.Route{Name: "back", Branch: root})
+	root.Route(pqstream.Route{Name: "down", Branch: branch})
+	if err := root.Validate(); err == nil {
+		t.Fatal("expected cycle to be rejected")
+	}
+	if _, err := pqstream.NewPipelineClient(&pqstream.Config{}, root); err == nil {
+		t.Fatal("expected cyclic pipeline client to be rejected")
+	}
+}
+
+func TestPipelineRouteErrorsKeepGoing(t *testing.T) {
+	healthy, merged := &recordingSink{name: "healthy"}, &recordingSink{name: "merged", fails: 1}
+	p := pqstream.NewPipeline().
+		Route(
+			pqstream.Route{Name: "healthy", When: func(n *pq.Notification) bool { return true }, Branch: pqstream.NewPipeline().Transform(func(n *pq.Notification) (*pq.Notification, error) {
+				return &pq.Notification{Channel: n.Channel, Extra: n.Extra + ":a"}, nil
+			}).FanOut(healthy)},
+			pqstream.Route{Name: "copy", When: func(n *pq.Notification) bool { return true }, Branch: pqstream.NewPipeline().Transform(func(n *pq.Notification) (*pq.Notification, error) {
+				return &pq.Notification{Channel: n.Channel, Extra: n.Extra + ":b"}, nil
+			})},
+		).
+		FanOut(merged)
+	err := p.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	if err == nil {
+		t.Fatal("expected the merged sink's failure")
+	}
+	if got := merged.payloads(); len(got) != 1 {
+		t.Fatalf("expected the notification after the failed one to be delivered, got: %v", got)
+	}
+}
+
+func TestPipelineSpecBuild(t *testing.T) {
+	config, err := pqstream.ParsePipelineConfig([]byte(`
+pipelines:
+  - name: users
+    channels: [users]
+    routes:
+      - name: inserts
+        when:
+          - path: op
+            value: INSERT
+        mapping:
+          fields:
+            id: new.id
+        sinks:
+          - type: file
+            dir: inserts
+      - name: other
+        sinks:
+          - type: file
+            dir: other
+    sinks:
+      - type: file
+        dir: merged
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if issues, err := pqstream.Lint(context.Background(), config, pqstream.LintOptions{}); err != nil || len(issues) != 0 {
+		t.Fatalf("expected a valid config, got %v %v", issues, err)
+	}
+	sinks := map[string]*recordingSink{}
+	p, err := config.Pipelines[0].Build(func(spec pqstream.SinkSpec) (pqstream.Sink, error) {
+		sinks[spec.Dir] = &recordingSink{name: spec.Dir}
+		return sinks[spec.Dir], nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{`{"op": "INSERT", "new": {"id": 1}}`, `{"op": "DELETE", "old": {"id": 2}}`} {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got := sinks["inserts"].payloads(); len(got) != 1 || got[0] != `{"id":1}` {
+		t.Fatalf("unexpected inserts: %v", got)
+	}
+	if got := sinks["other"].payloads(); len(got) != 1 || !strings.Contains(got[0], "DELETE") {
+		t.Fatalf("unexpected other: %v", got)
+	}
+	if got := sinks["merged"].payloads(); len(got) != 2 {
+		t.Fatalf("expected both branches to merge, got: %v", got)
+	}
+
+	config.Pipelines[0].Routes[0].When[0].Op = "near"
+	config.Pipelines[0].Routes[1].Name = "inserts"
+	issues, _ := pqstream.Lint(context.Background(), config, pqstream.LintOptions{})
+	if len(issues) != 2 || issues[0].Path != "pipelines[0].routes[0].when[0]" || issues[1].Path != "pipelines[0].routes[1].name" {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+}
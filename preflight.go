@@ -0,0 +1,236 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+//Privilege is a capability a feature needs from the database role it connects as
+type Privilege string
+
+const (
+	//PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete and PrivilegeTrigger are privileges on a table
+	PrivilegeSelect  Privilege = "SELECT"
+	PrivilegeInsert  Privilege = "INSERT"
+	PrivilegeUpdate  Privilege = "UPDATE"
+	PrivilegeDelete  Privilege = "DELETE"
+	PrivilegeTrigger Privilege = "TRIGGER"
+	//PrivilegeCreate is the privilege to create tables and functions in a schema. An empty Object means the role's current schema
+	PrivilegeCreate Privilege = "CREATE"
+	//PrivilegeExecute is the privilege to call a function, ie: pg_try_advisory_lock(bigint)
+	PrivilegeExecute Privilege = "EXECUTE"
+	//PrivilegeListen and PrivilegeNotify need no grant, but can't be used on a server in recovery, ie: a read replica
+	PrivilegeListen Privilege = "LISTEN"
+	PrivilegeNotify Privilege = "NOTIFY"
+)
+
+//A Requirement is a privilege a feature needs on a database object
+type Requirement struct {
+	//Feature names what needs the privilege, ie: "audit sink", so failures say what to fix
+	Feature   string
+	Privilege Privilege
+	//Object is the table, schema, function or channel the privilege applies to
+	Object string
+	//Write marks the requirement of a write path, which the client checks against Config.WriteUser rather than User
+	Write bool
+}
+
+//A PreflightError lists every requirement the connected role doesn't meet, each with the statement that would fix it
+type PreflightError struct {
+	Role     string
+	Failures []string
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("preflight failed for role %s! %s", e.Role, strings.Join(e.Failures, "; "))
+}
+
+//A Requirer declares the privileges it needs, so Preflight can check them before it's used
+type Requirer interface {
+	Requirements() []Requirement
+}
+
+//Preflight checks the connected role meets every requirement, returning a *PreflightError describing each one it doesn't rather than letting a feature fail mid-stream
+func Preflight(ctx context.Context, db *sql.DB, requirements []Requirement) error {
+	var (
+		role       string
+		inRecovery bool
+	)
+	if err := db.QueryRowContext(ctx, "SELECT current_user, pg_is_in_recovery()").Scan(&role, &inRecovery); err != nil {
+		return fmt.Errorf("failed to run preflight! %s", err.Error())
+	}
+	perr := &PreflightError{Role: role}
+	fail := func(r Requirement, format string, args ...interface{}) {
+		perr.Failures = append(perr.Failures, fmt.Sprintf("%s: %s", r.Feature, fmt.Sprintf(format, args...)))
+	}
+	for _, r := range requirements {
+		switch r.Privilege {
+		case PrivilegeListen, PrivilegeNotify:
+			if inRecovery {
+				fail(r, "cannot %s on channel %s, the server is in recovery: connect to the primary", r.Privilege, r.Object)
+			}
+		case PrivilegeCreate:
+			var ok bool
+			if err := db.QueryRowContext(ctx, "SELECT has_schema_privilege(coalesce(nullif($1, ''), current_schema()), 'CREATE')", r.Object).Scan(&ok); err != nil {
+				fail(r, "failed to check CREATE on schema %s! %s", r.Object, err.Error())
+				continue
+			}
+			if !ok {
+				schema := r.Object
+				if schema == "" {
+					schema = "<current schema>"
+				}
+				fail(r, "role lacks CREATE on schema %s: GRANT CREATE ON SCHEMA %s TO %s", schema, schema, pq.QuoteIdentifier(role))
+			}
+		case PrivilegeExecute:
+			var ok bool
+			if err := db.QueryRowContext(ctx, "SELECT has_function_privilege($1, 'EXECUTE')", r.Object).Scan(&ok); err != nil {
+				fail(r, "failed to check EXECUTE on function %s! %s", r.Object, err.Error())
+				continue
+			}
+			if !ok {
+				fail(r, "role lacks EXECUTE on function %s: GRANT EXECUTE ON FUNCTION %s TO %s", r.Object, r.Object, pq.QuoteIdentifier(role))
+			}
+		default:
+			var exists, ok bool
+			err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL, to_regclass($1) IS NOT NULL AND has_table_privilege($1, $2)", quoteQualified(r.Object), string(r.Privilege)).Scan(&exists, &ok)
+			switch {
+			case err != nil:
+				fail(r, "failed to check %s on table %s! %s", r.Privilege, r.Object, err.Error())
+			case !exists:
+				fail(r, "table %s does not exist: run pqstream migrate or the feature's Setup", r.Object)
+			case !ok:
+				fail(r, "role lacks %s on table %s: GRANT %s ON %s TO %s", r.Privilege, r.Object, r.Privilege, quoteQualified(r.Object), pq.QuoteIdentifier(role))
+			}
+		}
+	}
+	if len(perr.Failures) > 0 {
+		return perr
+	}
+	return nil
+}
+
+//Requirements returns the privileges the client needs: LISTEN on each channel and, for lock based standbys, the advisory lock function
+func (c *Client) Requirements() []Requirement {
+	var reqs []Requirement
+	for _, ch := range c.Channels() {
+		reqs = append(reqs, Requirement{Feature: "listener", Privilege: PrivilegeListen, Object: ch})
+	}
+	if c.config.StandbyLockKey != 0 {
+		reqs = append(reqs, Requirement{Feature: "standby lock", Privilege: PrivilegeExecute, Object: "pg_try_advisory_lock(bigint)"})
+	}
+	if c.durable != nil {
+		reqs = append(reqs, tableRequirements("outbox", c.durable.outbox.table(), PrivilegeSelect)...)
+		if c.durable.outbox.Checkpoints == nil {
+			reqs = append(reqs, (&TableCheckpoints{}).Requirements()...)
+		}
+	}
+	if h := c.config.Handover; h != nil {
+		if t, ok := h.Store.(*TableHandover); ok {
+			reqs = append(reqs, t.Requirements()...)
+		}
+	}
+	if d := c.config.Drain; d != nil {
+		if t, ok := d.Spool.(*TableSpool); ok {
+			reqs = append(reqs, t.Requirements()...)
+		}
+	}
+	return reqs
+}
+
+//preflight runs Preflight on the client's requirements, checking those of its write paths through the write role's connection
+func (c *Client) preflight(ctx context.Context, db, writeDB *sql.DB) error {
+	var reads, writes []Requirement
+	for _, r := range append(c.Requirements(), c.config.Requirements...) {
+		if r.Write && writeDB != db {
+			writes = append(writes, r)
+		} else {
+			reads = append(reads, r)
+		}
+	}
+	if err := Preflight(ctx, db, reads); err != nil {
+		return err
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return Preflight(ctx, writeDB, writes)
+}
+
+//Requirements returns the privileges the store needs on its checkpoint table
+func (t *TableCheckpoints) Requirements() []Requirement {
+	return writes(tableRequirements("checkpoints", t.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate))
+}
+
+//Requirements returns the privileges the sink needs to write to and partition its table
+func (a *AuditSink) Requirements() []Requirement {
+	return writes([]Requirement{
+		{Feature: "audit sink", Privilege: PrivilegeInsert, Object: a.table()},
+		{Feature: "audit sink", Privilege: PrivilegeSelect, Object: a.table()},
+		{Feature: "audit sink", Privilege: PrivilegeCreate, Object: schemaOf(a.table())},
+	})
+}
+
+//Requirements returns the privileges the heartbeat needs on its table
+func (h *Heartbeat) Requirements() []Requirement {
+	return writes(tableRequirements("heartbeat", h.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate))
+}
+
+//Requirements returns the privileges the handoff needs on its table
+func (h *Handoff) Requirements() []Requirement {
+	return writes(tableRequirements("handoff", h.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate))
+}
+
+//Requirements returns the privileges the sink needs to publish
+func (s *NotifySink) Requirements() []Requirement {
+	return []Requirement{{Feature: "notify sink", Privilege: PrivilegeNotify, Object: s.Channel, Write: true}}
+}
+
+//Requirements returns the privileges the indexer needs on the tables it writes documents to
+func (s *SearchIndexer) Requirements() []Requirement {
+	var reqs []Requirement
+	for _, index := range s.Indexes {
+		if index.Column != "" {
+			reqs = append(reqs, tableRequirements("search indexer", index.Table, PrivilegeUpdate)...)
+		}
+	}
+	return writes(append(reqs, tableRequirements("search indexer", s.table(), PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete)...))
+}
+
+//Requirements returns the privileges the projection needs on its table
+func (p *Projection) Requirements() []Requirement {
+	return writes(tableRequirements("projection", p.Table, PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete))
+}
+
+//Requirements returns the privileges the aggregate needs to apply deltas and reconcile
+func (a *Aggregate) Requirements() []Requirement {
+	return append(writes(tableRequirements("aggregate", a.Table, PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete)),
+		Requirement{Feature: "aggregate", Privilege: PrivilegeSelect, Object: a.Source})
+}
+
+//writes marks requirements as those of a write path
+func writes(reqs []Requirement) []Requirement {
+	for i := range reqs {
+		reqs[i].Write = true
+	}
+	return reqs
+}
+
+func tableRequirements(feature, table string, privileges ...Privilege) []Requirement {
+	reqs := make([]Requirement, len(privileges))
+	for i, p := range privileges {
+		reqs[i] = Requirement{Feature: feature, Privilege: p, Object: table}
+	}
+	return reqs
+}
+
+//schemaOf returns the schema of an optionally schema qualified name, or an empty string for the current schema
+func schemaOf(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
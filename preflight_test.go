@@ -0,0 +1,47 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestRequirements(t *testing.T) {
+	client, err := pqstream.NewClient([]string{"users", "accounts"}, &pqstream.Config{StandbyLockKey: 42}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reqs := client.Requirements()
+	if len(reqs) != 3 || reqs[0].Privilege != pqstream.PrivilegeListen || reqs[1].Object != "accounts" || reqs[2].Privilege != pqstream.PrivilegeExecute {
+		t.Fatalf("unexpected client requirements: %+v", reqs)
+	}
+	var requirers []pqstream.Requirer = []pqstream.Requirer{&pqstream.AuditSink{Table: "ops.audit"}, &pqstream.Heartbeat{}, &pqstream.Handoff{}, &pqstream.NotifySink{Channel: "out"}}
+	var all []pqstream.Requirement
+	for _, r := range requirers {
+		all = append(all, r.Requirements()...)
+	}
+	if all[2].Privilege != pqstream.PrivilegeCreate || all[2].Object != "ops" {
+		t.Fatalf("expected the audit sink to need CREATE on its schema, got %+v", all[2])
+	}
+	if all[3].Object != "pqstream_heartbeat" || all[len(all)-1].Privilege != pqstream.PrivilegeNotify {
+		t.Fatalf("unexpected requirements: %+v", all)
+	}
+	for _, r := range all {
+		if !r.Write {
+			t.Fatalf("expected sink and store requirements to be checked against the write role, got %+v", r)
+		}
+	}
+	for _, r := range reqs {
+		if r.Write {
+			t.Fatalf("expected the listener's requirements to be checked against the read role, got %+v", r)
+		}
+	}
+
+	perr := &pqstream.PreflightError{Role: "app", Failures: []string{"audit sink: role lacks INSERT on table audit", "listener: cannot LISTEN"}}
+	if !strings.Contains(perr.Error(), "role app") || !strings.Contains(perr.Error(), "; listener") {
+		t.Fatalf("unexpected preflight error: %s", perr.Error())
+	}
+}
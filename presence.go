@@ -0,0 +1,173 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"runtime/debug"
+	"time"
+)
+
+//A Consumer is a pqstream client registered in a Presence table
+type Consumer struct {
+	InstanceID    string            `json:"instance_id"`
+	Hostname      string            `json:"hostname"`
+	Channels      []string          `json:"channels"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Version       string            `json:"version"`
+	StartedAt     time.Time         `json:"started_at"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+}
+
+//A Presence registers a client in a consumers table and keeps its row fresh, so the pqstream consumers of a whole fleet, and the channels each listens on,
+//can be listed from any of them or with pqstream consumers. Rows are removed when Run returns and considered gone once they miss their heartbeats for TTL
+type Presence struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified consumers table. Defaults to pqstream_consumers
+	Table string
+	//Interval is how often the client's row is refreshed. Defaults to 10s
+	Interval time.Duration
+	//TTL is how long a consumer is listed after its last heartbeat. Defaults to 3 * Interval
+	TTL time.Duration
+	//Version is the version of the consuming service. Defaults to the main module's version from its build info
+	Version string
+	//Clock is the source of time for the heartbeat interval. Defaults to SystemClock
+	Clock Clock
+}
+
+func (p *Presence) table() string {
+	if p.Table == "" {
+		return "pqstream_consumers"
+	}
+	return p.Table
+}
+
+func (p *Presence) interval() time.Duration {
+	if p.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return p.Interval
+}
+
+func (p *Presence) ttl() time.Duration {
+	if p.TTL <= 0 {
+		return 3 * p.interval()
+	}
+	return p.TTL
+}
+
+func (p *Presence) version() string {
+	if p.Version != "" {
+		return p.Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
+//Setup creates the consumers table if it doesn't exist
+func (p *Presence) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if p.DB == nil {
+		return errors.New("presence requires a db")
+	}
+	if _, err := p.DB.ExecContext(ctx, p.ddl()); err != nil {
+		return fmt.Errorf("failed to create consumers table! %s", err.Error())
+	}
+	return nil
+}
+
+func (p *Presence) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	instance_id text PRIMARY KEY,
+	hostname text NOT NULL DEFAULT '',
+	channels text[] NOT NULL DEFAULT '{}',
+	labels json,
+	version text NOT NULL DEFAULT '',
+	started_at timestamptz NOT NULL,
+	beat_at timestamptz NOT NULL DEFAULT now()
+)`, quoteQualified(p.table()))
+}
+
+//Run registers the client and refreshes its row, with the channels it currently listens on, until the context is done, then removes it
+func (p *Presence) Run(ctx context.Context, c *Client) error {
+	if err := checkReadOnly(ctx, c); err != nil {
+		return err
+	}
+	if p.DB == nil {
+		return errors.New("presence requires a db")
+	}
+	member := c.Stats().Member
+	labels, err := json.Marshal(member.Labels)
+	if err != nil {
+		return err
+	}
+	upsert := fmt.Sprintf(`INSERT INTO %s (instance_id, hostname, channels, labels, version, started_at) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (instance_id) DO UPDATE SET hostname = EXCLUDED.hostname, channels = EXCLUDED.channels, labels = EXCLUDED.labels, version = EXCLUDED.version,
+started_at = EXCLUDED.started_at, beat_at = now()`, quoteQualified(p.table()))
+	beat := func() error {
+		_, err := p.DB.ExecContext(ctx, upsert, member.InstanceID, member.Hostname, pq.Array(c.Channels()), string(labels), p.version(), member.StartedAt)
+		return err
+	}
+	if err := beat(); err != nil {
+		return fmt.Errorf("failed to register consumer! %s", err.Error())
+	}
+	defer func() {
+		if _, err := p.DB.ExecContext(context.Background(), fmt.Sprintf("DELETE FROM %s WHERE instance_id = $1", quoteQualified(p.table())), member.InstanceID); err != nil {
+			c.handlers.ErrorHandler(fmt.Errorf("failed to deregister consumer! %s", err.Error()))
+		}
+	}()
+	clock := clockOr(p.Clock)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(p.interval()):
+		}
+		if err := beat(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.handlers.ErrorHandler(fmt.Errorf("failed to refresh consumer! %s", err.Error()))
+		}
+	}
+}
+
+//Consumers returns the consumers whose last heartbeat is within the TTL, ordered by instance id
+func (p *Presence) Consumers(ctx context.Context) ([]Consumer, error) {
+	if p.DB == nil {
+		return nil, errors.New("presence requires a db")
+	}
+	rows, err := p.DB.QueryContext(ctx, fmt.Sprintf(`SELECT instance_id, hostname, channels, coalesce(labels::text, 'null'), version, started_at, beat_at FROM %s
+WHERE beat_at > now() - make_interval(secs => $1) ORDER BY instance_id`, quoteQualified(p.table())), p.ttl().Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consumers! %s", err.Error())
+	}
+	defer rows.Close()
+	consumers := []Consumer{}
+	for rows.Next() {
+		var (
+			consumer Consumer
+			labels   string
+		)
+		if err := rows.Scan(&consumer.InstanceID, &consumer.Hostname, pq.Array(&consumer.Channels), &labels, &consumer.Version, &consumer.StartedAt, &consumer.LastHeartbeat); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(labels), &consumer.Labels); err != nil {
+			return nil, fmt.Errorf("failed to decode labels of consumer %s! %s", consumer.InstanceID, err.Error())
+		}
+		consumers = append(consumers, consumer)
+	}
+	return consumers, rows.Err()
+}
+
+//Requirements returns the privileges Run and Consumers need on the consumers table
+func (p *Presence) Requirements() []Requirement {
+	return tableRequirements("presence", p.table(), PrivilegeSelect, PrivilegeInsert, PrivilegeUpdate, PrivilegeDelete)
+}
@@ -0,0 +1,23 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"strings"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	p := &pqstream.Presence{Table: "ops.consumers"}
+	if _, err := p.Consumers(context.Background()); err == nil || !strings.Contains(err.Error(), "requires a db") {
+		t.Fatalf("expected listing without a db to fail, got: %v", err)
+	}
+	reqs := p.Requirements()
+	if len(reqs) != 4 || reqs[0].Object != "ops.consumers" {
+		t.Fatalf("unexpected requirements: %+v", reqs)
+	}
+	migrations := pqstream.Migrations(pqstream.MigrationOptions{ConsumersTable: "ops.consumers"})
+	if m := migrations[9]; m.Name != "pqstream_consumers" || !strings.Contains(m.Up, `"ops"."consumers"`) {
+		t.Fatalf("expected a consumers table migration, got: %+v", m)
+	}
+}
@@ -0,0 +1,222 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+)
+
+//ConflictPolicy is what a Projection does when the projected row already exists
+type ConflictPolicy string
+
+const (
+	//ConflictUpdate overwrites the existing row's non-key columns
+	ConflictUpdate ConflictPolicy = "update"
+	//ConflictIgnore keeps the existing row
+	ConflictIgnore ConflictPolicy = "ignore"
+	//ConflictError fails the event
+	ConflictError ConflictPolicy = "error"
+)
+
+//A ProjectionFunc maps a source row to its projected row. Returning a nil row excludes it from the projection, removing any projected row with its key
+type ProjectionFunc func(e *ChangeEvent, row Row) (Row, error)
+
+//A Projection is a Handler maintaining a denormalized read model: each change event of its Source table is mapped to a row of its Table, which is
+//inserted, updated or deleted to match. Rows are mapped by Map or, without one, by Columns; when an update changes a row's projected key, or Map excludes it,
+//the old projected row is deleted, in the same statement as the new one is written, which requires the event to carry the old row. The projection's Key columns must have a unique constraint
+type Projection struct {
+	DB Execer
+	//Source is the schema qualified or bare table whose change events are projected
+	Source string
+	//Table is the optionally schema qualified projection table
+	Table string
+	//Key is the projection table's key columns, used as the conflict target and to delete projected rows
+	Key []string
+	//Columns maps each projection column to a source column. Ignored if Map is set
+	Columns map[string]string
+	//Map maps source rows to projected ones
+	Map ProjectionFunc
+	//OnConflict is what to do when an insert's projected row exists. Defaults to ConflictUpdate. Updates always overwrite their projected row
+	OnConflict ConflictPolicy
+}
+
+func (p *Projection) validate() error {
+	if p.DB == nil {
+		return errors.New("projection requires a db")
+	}
+	if p.Source == "" || p.Table == "" || len(p.Key) == 0 {
+		return errors.New("projection requires a source, table and key")
+	}
+	if p.Map == nil && len(p.Columns) == 0 {
+		return errors.New("projection requires a mapping")
+	}
+	switch p.OnConflict {
+	case "", ConflictUpdate, ConflictIgnore, ConflictError:
+	default:
+		return fmt.Errorf("invalid projection conflict policy: %s", p.OnConflict)
+	}
+	return nil
+}
+
+//Name returns the handler's name
+func (p *Projection) Name() string {
+	return "projection:" + p.Table
+}
+
+//Process projects a change event
+func (p *Projection) Process(notification *pq.Notification) error {
+	return p.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext projects a change event. Payloads that aren't change events and events of other tables are ignored
+func (p *Projection) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	e, err := ParseChange(notification)
+	if err != nil || (e.Table != p.Source && e.QualifiedTable() != p.Source) {
+		return nil
+	}
+	var before, after Row
+	if e.Old != nil {
+		if before, err = p.project(e, e.Old); err != nil {
+			return err
+		}
+	}
+	if e.Op != OpDelete && e.New != nil {
+		if after, err = p.project(e, e.New); err != nil {
+			return err
+		}
+	}
+	if skipDryRun(ctx, p.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	var removed Row
+	if before != nil && (after == nil || !reflect.DeepEqual(p.keyValues(before), p.keyValues(after))) {
+		removed = before
+	}
+	if after == nil {
+		if removed == nil {
+			return nil
+		}
+		return p.delete(ctx, removed)
+	}
+	policy := p.OnConflict
+	if e.Op != OpInsert {
+		policy = ConflictUpdate
+	}
+	return p.upsert(ctx, after, removed, policy)
+}
+
+func (p *Projection) project(e *ChangeEvent, row Row) (Row, error) {
+	if p.Map != nil {
+		projected, err := p.Map(e, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to project %s! %s", e.QualifiedTable(), err.Error())
+		}
+		return projected, nil
+	}
+	projected := Row{}
+	for target, source := range p.Columns {
+		projected[target] = row[source]
+	}
+	return projected, nil
+}
+
+func (p *Projection) keyValues(row Row) []any {
+	values := make([]any, len(p.Key))
+	for i, column := range p.Key {
+		values[i] = row[column]
+	}
+	return values
+}
+
+//deleteQuery returns the statement deleting a projected row, with its placeholders numbered after the first offset arguments
+func (p *Projection) deleteQuery(row Row, offset int) (string, []interface{}) {
+	where := make([]string, len(p.Key))
+	args := make([]interface{}, len(p.Key))
+	for i, column := range p.Key {
+		where[i] = fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), offset+i+1)
+		args[i] = sqlArg(row[column])
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", quoteQualified(p.Table), strings.Join(where, " AND ")), args
+}
+
+func (p *Projection) delete(ctx context.Context, row Row) error {
+	query, args := p.deleteQuery(row, 0)
+	if _, err := p.DB.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to delete from projection %s! %s", p.Table, err.Error())
+	}
+	return nil
+}
+
+//upsert writes a projected row according to policy, deleting the removed row, if any, in the same statement so neither happens without the other
+func (p *Projection) upsert(ctx context.Context, row, removed Row, policy ConflictPolicy) error {
+	columns := sortedKeys(row)
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		quoted[i] = pq.QuoteIdentifier(column)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = sqlArg(row[column])
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteQualified(p.Table), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	keys := make([]string, len(p.Key))
+	isKey := map[string]bool{}
+	for i, column := range p.Key {
+		keys[i] = pq.QuoteIdentifier(column)
+		isKey[column] = true
+	}
+	switch policy {
+	case ConflictError:
+	case ConflictIgnore:
+		query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+	default:
+		var set []string
+		for _, column := range columns {
+			if !isKey[column] {
+				set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(column), pq.QuoteIdentifier(column)))
+			}
+		}
+		if len(set) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(set, ", "))
+		}
+	}
+	if removed != nil {
+		deletion, deleteArgs := p.deleteQuery(removed, len(args))
+		query = fmt.Sprintf("WITH removed AS (%s) %s", deletion, query)
+		args = append(args, deleteArgs...)
+	}
+	if _, err := p.DB.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to write projection %s! %s", p.Table, err.Error())
+	}
+	return nil
+}
+
+//sqlArg converts a decoded JSON value to a query argument, encoding objects and arrays as JSON
+func sqlArg(v any) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		return v.String()
+	case map[string]any, []any:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(encoded)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,83 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestProjectionColumns(t *testing.T) {
+	db := &execRecorder{}
+	projection := &pqstream.Projection{
+		DB:      db,
+		Source:  "users",
+		Table:   "read.user_names",
+		Key:     []string{"user_id"},
+		Columns: map[string]string{"user_id": "id", "name": "name"},
+	}
+	for _, payload := range []string{
+		`{"table": "users", "op": "INSERT", "new": {"id": 1, "name": "bob", "email": "bob@example.com"}}`,
+		`{"table": "users", "op": "UPDATE", "old": {"id": 1, "name": "bob"}, "new": {"id": 2, "name": "bob"}}`,
+		`{"table": "users", "op": "DELETE", "old": {"id": 2, "name": "bob"}}`,
+		`{"table": "orders", "op": "INSERT", "new": {"id": 1}}`,
+	} {
+		if err := projection.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	want := []string{
+		`INSERT INTO "read"."user_names" ("name", "user_id") VALUES ($1, $2) ON CONFLICT ("user_id") DO UPDATE SET "name" = EXCLUDED."name"`,
+		`WITH removed AS (DELETE FROM "read"."user_names" WHERE "user_id" = $3) INSERT INTO "read"."user_names" ("name", "user_id") VALUES ($1, $2) ON CONFLICT ("user_id") DO UPDATE SET "name" = EXCLUDED."name"`,
+		`DELETE FROM "read"."user_names" WHERE "user_id" = $1`,
+	}
+	if len(db.queries) != len(want) {
+		t.Fatalf("unexpected queries: %v", db.queries)
+	}
+	for i, query := range want {
+		if db.queries[i] != query {
+			t.Fatalf("unexpected query %d: %s", i, db.queries[i])
+		}
+	}
+	if db.args[1][2] != "1" || db.args[1][1] != "2" || db.args[2][0] != "2" {
+		t.Fatalf("unexpected args: %v", db.args)
+	}
+}
+
+func TestProjectionMap(t *testing.T) {
+	db := &execRecorder{}
+	projection := &pqstream.Projection{
+		DB:         db,
+		Source:     "users",
+		Table:      "active_users",
+		Key:        []string{"id"},
+		OnConflict: pqstream.ConflictIgnore,
+		Map: func(e *pqstream.ChangeEvent, row pqstream.Row) (pqstream.Row, error) {
+			if row["active"] != true {
+				return nil, nil
+			}
+			return pqstream.Row{"id": row["id"]}, nil
+		},
+	}
+	for _, payload := range []string{
+		`{"table": "users", "op": "INSERT", "new": {"id": 1, "active": true}}`,
+		`{"table": "users", "op": "UPDATE", "old": {"id": 1, "active": true}, "new": {"id": 1, "active": false}}`,
+	} {
+		if err := projection.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(db.queries) != 2 || db.queries[0] != `INSERT INTO "active_users" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING` || db.queries[1] != `DELETE FROM "active_users" WHERE "id" = $1` {
+		t.Fatalf("unexpected queries: %v", db.queries)
+	}
+	projection.OnConflict = pqstream.ConflictError
+	if err := projection.Process(&pq.Notification{Extra: `{"table": "users", "op": "UPDATE", "old": {"id": 1, "active": true}, "new": {"id": 1, "active": true}}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if db.queries[2] != `INSERT INTO "active_users" ("id") VALUES ($1) ON CONFLICT ("id") DO NOTHING` {
+		t.Fatalf("expected an update to overwrite its projected row, got: %s", db.queries[2])
+	}
+	projection.OnConflict = "merge"
+	if err := projection.Process(&pq.Notification{Extra: `{"table": "users", "op": "INSERT", "new": {"id": 1}}`}); err == nil {
+		t.Fatal("expected an error for an invalid conflict policy")
+	}
+}
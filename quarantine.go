@@ -0,0 +1,259 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//defaultQuarantineAttempts is the number of attempts at a notification before it is quarantined when Quarantine.MaxAttempts is unset
+const defaultQuarantineAttempts = 3
+
+//An AttemptStore counts the attempts at each notification, persisting them so attempts a crash interrupted are counted after a restart
+type AttemptStore interface {
+	//Attempt records the start of an attempt at a notification, returning the number of attempts at it including this one
+	Attempt(ctx context.Context, key string) (int, error)
+	//Clear forgets a notification's attempts once its handlers succeed
+	Clear(ctx context.Context, key string) error
+}
+
+//A Quarantine detects poison notifications, ones that repeatedly fail, crash or time out their handlers, and sets them aside once they reach MaxAttempts
+//so they stop blocking the stream, ie: a durable client retrying an outbox row that crashes the process each time. A quarantined notification is skipped,
+//stored as a dead letter if the client has a DeadLetterStore, and operators are alerted
+type Quarantine struct {
+	//Store counts the attempts at each notification. A TableAttempts, next to the client's checkpoints, counts them across restarts
+	Store AttemptStore
+	//MaxAttempts is the number of attempts at a notification, counting those interrupted by a crash, before it's quarantined. Defaults to 3
+	MaxAttempts int
+	//Timeout is how long the handlers may take on a notification before the attempt counts as failed, even if they succeed. Their context is done once it passes.
+	//Zero disables it
+	Timeout time.Duration
+	//Alert receives a QuarantineAlert, encoded as JSON, on the quarantined notification's channel. Nil reports the quarantine to the ErrorHandler
+	Alert Sink
+}
+
+//A QuarantineAlert is the payload sent to Quarantine.Alert
+type QuarantineAlert struct {
+	Channel     string    `json:"channel"`
+	Key         string    `json:"key"`
+	PID         int       `json:"pid"`
+	Attempts    int       `json:"attempts"`
+	Fingerprint string    `json:"fingerprint"`
+	DeadLetter  int64     `json:"dead_letter,omitempty"`
+	InstanceID  string    `json:"instance_id"`
+	Time        time.Time `json:"time"`
+}
+
+func (q *Quarantine) maxAttempts() int {
+	if q.MaxAttempts <= 0 {
+		return defaultQuarantineAttempts
+	}
+	return q.MaxAttempts
+}
+
+//attemptKey identifies a notification across redeliveries: by its outbox position, then its envelope id, then its sending backend's pid and a fingerprint
+//of its payload, so identical payloads from different transactions don't share their attempts
+func attemptKey(n *pq.Notification) string {
+	if envelope := envelopeOf(n); envelope != nil {
+		if envelope.Offset > 0 {
+			return n.Channel + ":offset:" + strconv.FormatInt(envelope.Offset, 10)
+		}
+		if envelope.ID != "" {
+			return n.Channel + ":id:" + envelope.ID
+		}
+	}
+	return n.Channel + ":payload:" + strconv.Itoa(n.BePid) + ":" + payloadFingerprint(n.Extra)
+}
+
+//guard runs the handlers on a notification as an attempt counted by the client's Quarantine, quarantining the notification instead once it has had MaxAttempts.
+//An attempt store that fails is reported and the handlers run as if there were no quarantine, so it can't hold up the stream
+func (c *Client) guard(ctx context.Context, n *pq.Notification, run func(ctx context.Context) error) error {
+	q := c.config.Quarantine
+	if q == nil || q.Store == nil {
+		return run(ctx)
+	}
+	key := attemptKey(n)
+	attempts, err := q.Store.Attempt(ctx, key)
+	if err != nil {
+		c.handleErr(n.Channel, fmt.Errorf("failed to count attempts at notification pid: %d, channel: %s! %s", n.BePid, n.Channel, err.Error()))
+		return run(ctx)
+	}
+	if attempts > q.maxAttempts() {
+		c.quarantine(n, key, attempts-1)
+		return nil
+	}
+	started := c.config.Clock.Now()
+	if q.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.Timeout)
+		defer cancel()
+	}
+	err = run(ctx)
+	if err != nil || (q.Timeout > 0 && c.config.Clock.Now().Sub(started) > q.Timeout) {
+		return err
+	}
+	c.clearAttempts(n, key)
+	return nil
+}
+
+//clearAttempts forgets the attempts at a notification once it has been processed or quarantined. It doesn't use the handlers' context, which may already be done
+func (c *Client) clearAttempts(n *pq.Notification, key string) {
+	if err := c.config.Quarantine.Store.Clear(context.Background(), key); err != nil {
+		c.handleErr(n.Channel, fmt.Errorf("failed to clear attempts at notification pid: %d, channel: %s! %s", n.BePid, n.Channel, err.Error()))
+	}
+}
+
+//quarantine sets a poison notification aside, dead lettering it and alerting operators
+func (c *Client) quarantine(n *pq.Notification, key string, attempts int) {
+	q := c.config.Quarantine
+	now := c.config.Clock.Now()
+	c.stats.channel(n.Channel).quarantine()
+	alert := QuarantineAlert{
+		Channel:     n.Channel,
+		Key:         key,
+		PID:         n.BePid,
+		Attempts:    attempts,
+		Fingerprint: c.fingerprint(n),
+		InstanceID:  c.config.InstanceID,
+		Time:        now,
+	}
+	if c.config.DeadLetters != nil {
+		ctx := context.Background()
+		if c.config.ReadOnly {
+			ctx = WithReadOnly(ctx)
+		}
+		failure := DeadLetterFailure{Attempt: attempts, Handler: "quarantine", Error: fmt.Sprintf("quarantined after %d attempts", attempts), Time: now}
+		id, err := c.config.DeadLetters.Add(ctx, DeadLetter{Channel: n.Channel, PID: n.BePid, Payload: n.Extra, Attempts: attempts, Failures: []DeadLetterFailure{failure}, CreatedAt: now, UpdatedAt: now})
+		if err != nil {
+			c.handleErr(n.Channel, fmt.Errorf("failed to dead letter quarantined notification pid: %d, channel: %s! %s", n.BePid, n.Channel, err.Error()))
+		} else {
+			alert.DeadLetter = id
+			c.stats.channel(n.Channel).deadLetter()
+		}
+	}
+	c.clearAttempts(n, key)
+	c.events.publish(Event{Type: EventQuarantined, Channel: n.Channel, Time: now, Position: alert.DeadLetter})
+	if q.Alert == nil {
+		c.handlers.ErrorHandler(fmt.Errorf("quarantined notification pid: %d, channel: %s after %d attempts, payload %s", n.BePid, n.Channel, attempts, alert.Fingerprint))
+		return
+	}
+	payload, _ := json.Marshal(alert)
+	if err := q.Alert.Send(context.Background(), &pq.Notification{Channel: n.Channel, Extra: string(payload)}); err != nil {
+		c.handlers.ErrorHandler(fmt.Errorf("failed to send alert to %s! %s", q.Alert.Name(), err.Error()))
+	}
+}
+
+//TableAttempts counts attempts in a postgres table, one row per consumer and notification, so they survive the restarts a poison notification causes
+type TableAttempts struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified attempts table. Defaults to pqstream_attempts
+	Table string
+	//Consumer names the consumer group the attempts belong to. Defaults to pqstream
+	Consumer string
+}
+
+func (t *TableAttempts) table() string {
+	if t.Table == "" {
+		return "pqstream_attempts"
+	}
+	return t.Table
+}
+
+func (t *TableAttempts) consumer() string {
+	if t.Consumer == "" {
+		return "pqstream"
+	}
+	return t.Consumer
+}
+
+//Setup creates the attempts table if it doesn't exist
+func (t *TableAttempts) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if t.DB == nil {
+		return errors.New("attempts table requires a db")
+	}
+	if _, err := t.DB.ExecContext(ctx, t.ddl()); err != nil {
+		return fmt.Errorf("failed to create attempts table! %s", err.Error())
+	}
+	return nil
+}
+
+func (t *TableAttempts) ddl() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	consumer text NOT NULL,
+	key text NOT NULL,
+	attempts integer NOT NULL DEFAULT 1,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (consumer, key)
+)`, quoteQualified(t.table()))
+}
+
+//Attempt records the start of an attempt at a notification, returning the number of attempts at it including this one
+func (t *TableAttempts) Attempt(ctx context.Context, key string) (int, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	var attempts int
+	err := t.DB.QueryRowContext(ctx, fmt.Sprintf(`INSERT INTO %[1]s (consumer, key) VALUES ($1, $2)
+ON CONFLICT (consumer, key) DO UPDATE SET attempts = %[1]s.attempts + 1, updated_at = now() RETURNING attempts`, quoteQualified(t.table())), t.consumer(), key).Scan(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record attempt at %s! %s", key, err.Error())
+	}
+	return attempts, nil
+}
+
+//Clear forgets a notification's attempts
+func (t *TableAttempts) Clear(ctx context.Context, key string) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if _, err := t.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE consumer = $1 AND key = $2", quoteQualified(t.table())), t.consumer(), key); err != nil {
+		return fmt.Errorf("failed to clear attempts at %s! %s", key, err.Error())
+	}
+	return nil
+}
+
+//Prune deletes the attempts at notifications that haven't been retried since the cutoff, ie: live notifications that failed once and were never redelivered
+func (t *TableAttempts) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return 0, err
+	}
+	res, err := t.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE updated_at < $1", quoteQualified(t.table())), before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune attempts! %s", err.Error())
+	}
+	return res.RowsAffected()
+}
+
+//MemoryAttempts counts attempts in memory, ie: for tests or to quarantine notifications that fail without crashing the process
+type MemoryAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+//Attempt records the start of an attempt at a notification, returning the number of attempts at it including this one
+func (m *MemoryAttempts) Attempt(ctx context.Context, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.attempts == nil {
+		m.attempts = map[string]int{}
+	}
+	m.attempts[key]++
+	return m.attempts[key], nil
+}
+
+//Clear forgets a notification's attempts
+func (m *MemoryAttempts) Clear(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
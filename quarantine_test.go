@@ -0,0 +1,157 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		calls  int
+		alerts []pqstream.QuarantineAlert
+	)
+	alert := pqstream.NewSink("alerts", func(ctx context.Context, notification *pq.Notification) error {
+		var a pqstream.QuarantineAlert
+		if err := json.Unmarshal([]byte(notification.Extra), &a); err != nil {
+			return err
+		}
+		mu.Lock()
+		alerts = append(alerts, a)
+		mu.Unlock()
+		return nil
+	})
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			if notification.Extra == "poison" {
+				return errors.New("boom")
+			}
+			return nil
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	//the attempts outlive the client, as they would in a table across restarts
+	attempts := &pqstream.MemoryAttempts{}
+	deadLetters := &pqstream.MemoryDeadLetters{}
+	newClient := func() *pqstream.Client {
+		client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{
+			Quarantine:  &pqstream.Quarantine{Store: attempts, MaxAttempts: 2, Alert: alert},
+			DeadLetters: deadLetters,
+		}, handlerSet)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return client
+	}
+	poison := &pq.Notification{Channel: "users", BePid: 3, Extra: "poison"}
+	newClient().Process(poison)
+	restarted := newClient()
+	restarted.Process(poison)
+	restarted.Process(poison)
+	if calls != 2 {
+		t.Fatalf("expected the handler to run on the first 2 attempts only, got: %d", calls)
+	}
+	if len(alerts) != 1 || alerts[0].Attempts != 2 || alerts[0].PID != 3 || alerts[0].Fingerprint == "" || alerts[0].DeadLetter == 0 {
+		t.Fatalf("expected a quarantine alert, got: %+v", alerts)
+	}
+	stats := restarted.Stats().Channels["users"]
+	if stats.Quarantined != 1 {
+		t.Fatalf("expected 1 quarantined notification, got: %+v", stats)
+	}
+	letters, _ := deadLetters.List(context.Background(), pqstream.DeadLetterFilter{Handler: "quarantine"})
+	if len(letters) != 1 || letters[0].ID != alerts[0].DeadLetter {
+		t.Fatalf("expected the quarantined notification to be dead lettered, got: %+v", letters)
+	}
+	//a quarantine clears the notification's attempts, so a fixed handler can process it again
+	restarted.Process(poison)
+	if calls != 3 {
+		t.Fatalf("expected the handler to run again after the quarantine, got: %d", calls)
+	}
+
+	//successful attempts are forgotten
+	for i := 0; i < 3; i++ {
+		restarted.Process(&pq.Notification{Channel: "users", Extra: "ok"})
+	}
+	if calls != 6 || len(alerts) != 1 {
+		t.Fatalf("expected healthy notifications to never be quarantined, got: %d calls %d alerts", calls, len(alerts))
+	}
+}
+
+func TestQuarantineTimeout(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	var calls int
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			calls++
+			clock.Advance(time.Second)
+			return nil
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{
+		Clock:      clock,
+		Quarantine: &pqstream.Quarantine{Store: &pqstream.MemoryAttempts{}, MaxAttempts: 1, Timeout: 100 * time.Millisecond},
+	}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	slow := &pq.Notification{Channel: "users", Extra: "slow"}
+	client.Process(slow)
+	client.Process(slow)
+	if calls != 1 || client.Stats().Channels["users"].Quarantined != 1 {
+		t.Fatalf("expected an attempt that timed out to count towards the quarantine, got: %d calls", calls)
+	}
+}
+
+//clearRecorder is a MemoryAttempts recording the attempts it clears
+type clearRecorder struct {
+	pqstream.MemoryAttempts
+	cleared []string
+}
+
+func (r *clearRecorder) Clear(ctx context.Context, key string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.cleared = append(r.cleared, key)
+	return r.MemoryAttempts.Clear(ctx, key)
+}
+
+func TestQuarantineKeys(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			if notification.BePid == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		})},
+		ErrorHandler: func(err error) {},
+	}
+	store := &clearRecorder{}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{
+		Quarantine: &pqstream.Quarantine{Store: store, MaxAttempts: 1},
+	}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", BePid: 1, Extra: "same"})
+	client.Process(&pq.Notification{Channel: "users", BePid: 2, Extra: "same"})
+	if client.Stats().Channels["users"].Quarantined != 0 {
+		t.Fatal("expected identical payloads from different backends to be counted apart")
+	}
+	if len(store.cleared) != 1 {
+		t.Fatalf("expected the successfully processed notification's attempts to be cleared, got: %v", store.cleared)
+	}
+	if attempts, _ := store.Attempt(context.Background(), store.cleared[0]); attempts != 1 {
+		t.Fatalf("expected the cleared attempts to be deleted, got: %d", attempts)
+	}
+}
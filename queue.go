@@ -0,0 +1,174 @@
+package pqstream
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"sync/atomic"
+)
+
+//Ordering is whether a channel's notifications are processed one at a time, in order, or concurrently. Each channel has its own queue, set by Config.QueueSize,
+//and channels are always processed concurrently with each other
+type Ordering string
+
+const (
+	//OrderingStrict processes each channel's notifications one at a time, in the order they were received. Channels are still processed concurrently
+	OrderingStrict Ordering = "strict"
+	//OrderingConcurrent processes a channel's notifications concurrently, up to Config.ChannelWorkers or Config.Workers at once, giving up their order for throughput
+	OrderingConcurrent Ordering = "concurrent"
+)
+
+//OverflowPolicy is what the dispatcher does with a notification whose channel's queue is full. Config.Overflow defaults to OverflowBlock,
+//or OverflowDrop with DeliveryAtMostOnce
+type OverflowPolicy string
+
+const (
+	//OverflowBlock waits for room in the queue. Nothing is lost and memory stays bounded by Config.QueueSize, but a stalled channel holds back the listener and with it every other channel
+	OverflowBlock OverflowPolicy = "block"
+	//OverflowSpill holds notifications arriving at a full queue in memory, up to Config.SpillLimit, and feeds them into the queue in order so a stalled channel doesn't hold back the others.
+	//Past the limit it drops the notification and reports a *QueueFullError like OverflowError
+	OverflowSpill OverflowPolicy = "spill"
+	//OverflowDrop drops the notification, counting it in ChannelStats.Dropped, so the listener never waits on a slow channel
+	OverflowDrop OverflowPolicy = "drop"
+	//OverflowError drops the notification like OverflowDrop and reports a *QueueFullError to the ErrorHandler
+	OverflowError OverflowPolicy = "error"
+)
+
+//A QueueFullError is reported for a notification dropped by OverflowError
+type QueueFullError struct {
+	Channel string
+	PID     int
+	Size    int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("queue of %d full, dropped notification pid: %d, channel: %s", e.Size, e.PID, e.Channel)
+}
+
+func (c *Client) spillLimit() int {
+	if c.config.SpillLimit <= 0 {
+		return defaultSpillLimit
+	}
+	return c.config.SpillLimit
+}
+
+func (c *Client) queueSize() int {
+	if c.config.QueueSize <= 0 {
+		return laneSize
+	}
+	return c.config.QueueSize
+}
+
+//laneWorkers returns the number of goroutines draining a channel's queue
+func (c *Client) laneWorkers(channel string) int {
+	if c.config.Ordering != OrderingConcurrent {
+		return 1
+	}
+	if limit := c.config.ChannelWorkers[channel]; limit > 0 {
+		return limit
+	}
+	return c.workers.size
+}
+
+//lane is a channel's queue. Under OverflowSpill, notifications arriving while it is full spill into memory, up to limit, and are fed into it in order
+type lane struct {
+	queue   chan *pq.Notification
+	limit   int
+	mu      sync.Mutex
+	spilled []*pq.Notification
+	feeding bool
+	fed     sync.WaitGroup
+}
+
+func newLane(size, limit int) *lane {
+	return &lane{queue: make(chan *pq.Notification, size), limit: limit}
+}
+
+//spill queues a notification, spilling it while the queue is full or earlier notifications are still spilled. It returns false once limit notifications are spilled
+func (l *lane) spill(n *pq.Notification) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.feeding {
+		select {
+		case l.queue <- n:
+			return true
+		default:
+		}
+		l.feeding = true
+		l.fed.Add(1)
+		go l.feed()
+	}
+	if len(l.spilled) >= l.limit {
+		return false
+	}
+	l.spilled = append(l.spilled, n)
+	return true
+}
+
+//feed moves spilled notifications into the queue until none are left, keeping each one spilled, and counted against limit, until it is queued
+func (l *lane) feed() {
+	defer l.fed.Done()
+	l.mu.Lock()
+	for len(l.spilled) > 0 {
+		n := l.spilled[0]
+		l.mu.Unlock()
+		l.queue <- n
+		l.mu.Lock()
+		l.spilled[0] = nil
+		l.spilled = l.spilled[1:]
+	}
+	l.feeding = false
+	l.spilled = nil
+	l.mu.Unlock()
+}
+
+//close closes the queue once every spilled notification is in it
+func (l *lane) close() {
+	l.fed.Wait()
+	close(l.queue)
+}
+
+//enqueue puts a notification on its channel's queue according to the overflow policy, reporting whether it was queued
+func (c *Client) enqueue(lane *lane, n *pq.Notification) bool {
+	stats := c.stats.channel(n.Channel)
+	atomic.AddInt64(&stats.queued, 1)
+	switch c.config.Overflow {
+	case OverflowDrop, OverflowError:
+		select {
+		case lane.queue <- n:
+			return true
+		default:
+		}
+		atomic.AddInt64(&stats.queued, -1)
+		atomic.AddUint64(&stats.dropped, 1)
+		if c.config.Overflow == OverflowError {
+			c.handleErr(n.Channel, &QueueFullError{Channel: n.Channel, PID: n.BePid, Size: cap(lane.queue)})
+		}
+		return false
+	case OverflowSpill:
+		if lane.spill(n) {
+			return true
+		}
+		atomic.AddInt64(&stats.queued, -1)
+		atomic.AddUint64(&stats.dropped, 1)
+		c.handleErr(n.Channel, &QueueFullError{Channel: n.Channel, PID: n.BePid, Size: cap(lane.queue) + lane.limit})
+		return false
+	default:
+		lane.queue <- n
+		return true
+	}
+}
+
+//dequeued records a notification leaving its channel's queue
+func (c *Client) dequeued(channel string) {
+	atomic.AddInt64(&c.stats.channel(channel).queued, -1)
+}
+
+//QueueDepth returns the number of notifications waiting in each channel's queue, to monitor backpressure
+func (c *Client) QueueDepth() map[string]int {
+	out := map[string]int{}
+	for channel, s := range c.stats.snapshot() {
+		out[channel] = s.Queued
+	}
+	return out
+}
@@ -0,0 +1,252 @@
+package pqstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueOverflow(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowError} {
+		t.Run(string(policy), func(t *testing.T) {
+			var (
+				mu   sync.Mutex
+				seen []string
+				errs []error
+			)
+			started, release := make(chan struct{}, 1), make(chan struct{})
+			handler := HandlerFunc(func(n *pq.Notification) error {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, n.Extra)
+				return nil
+			})
+			c, err := NewClient([]string{"users"}, &Config{QueueSize: 1, Overflow: policy}, &HandlerSet{
+				Handlers: []Handler{handler},
+				ErrorHandler: func(err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					errs = append(errs, err)
+				},
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			notify := make(chan *pq.Notification)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				c.dispatch(notify, func() error { return nil })
+			}()
+			notify <- &pq.Notification{Channel: "users", Extra: "1"}
+			<-started
+			for _, payload := range []string{"2", "3", "4", "5"} {
+				notify <- &pq.Notification{Channel: "users", Extra: payload}
+			}
+			//an unbuffered send only completes once the previous notification was queued or dropped
+			notify <- nil
+			if depth := c.QueueDepth()["users"]; depth != 1 {
+				t.Fatalf("expected one queued notification, got %d", depth)
+			}
+			close(release)
+			close(notify)
+			<-done
+			if got := strings.Join(seen, ","); got != "1,2" {
+				t.Fatalf("expected the queued notifications to be processed, got: %s", got)
+			}
+			if dropped := c.Stats().Channels["users"].Dropped; dropped != 3 {
+				t.Fatalf("expected 3 dropped notifications, got %d", dropped)
+			}
+			var full *QueueFullError
+			switch {
+			case policy == OverflowDrop && len(errs) != 0:
+				t.Fatalf("expected drops not to be reported, got: %v", errs)
+			case policy == OverflowError && (len(errs) != 3 || !errors.As(errs[0], &full) || full.Size != 1):
+				t.Fatalf("expected every drop to be reported, got: %v", errs)
+			}
+		})
+	}
+}
+
+func TestConcurrentOrdering(t *testing.T) {
+	var running, peak int64
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		now := atomic.AddInt64(&running, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if now <= p || atomic.CompareAndSwapInt64(&peak, p, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		return nil
+	})
+	c, err := NewClient([]string{"users"}, &Config{Ordering: OrderingConcurrent, ChannelWorkers: map[string]int{"users": 3}}, &HandlerSet{Handlers: []Handler{handler}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	for i := 0; i < 9; i++ {
+		notify <- &pq.Notification{Channel: "users"}
+	}
+	close(notify)
+	<-done
+	if peak != 3 {
+		t.Fatalf("expected a channel's notifications to be processed 3 at a time, peaked at %d", peak)
+	}
+}
+
+func TestBlockedLaneBounded(t *testing.T) {
+	release := make(chan struct{})
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		<-release
+		return nil
+	})
+	c, err := NewClient([]string{"users"}, &Config{QueueSize: 1}, &HandlerSet{Handlers: []Handler{handler}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	//one notification is being processed, one is queued and the dispatcher waits to queue the third
+	for _, payload := range []string{"1", "2", "3"} {
+		notify <- &pq.Notification{Channel: "users", Extra: payload}
+	}
+	select {
+	case notify <- &pq.Notification{Channel: "users", Extra: "4"}:
+		t.Fatal("expected a full lane to block the dispatcher")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if depth := c.QueueDepth()["users"]; depth > 2 {
+		t.Fatalf("expected the lane to stay bounded by its queue, got %d queued", depth)
+	}
+	close(release)
+	close(notify)
+	<-done
+}
+
+func TestSpilledLaneBounded(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var (
+		seen []string
+		errs []error
+	)
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		if n.Channel == "users" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, n.Channel+":"+n.Extra)
+		return nil
+	})
+	clock := NewFakeClock(time.Unix(0, 0))
+	c, err := NewClient([]string{"users", "orders"}, &Config{QueueSize: 1, Overflow: OverflowSpill, SpillLimit: 2, Clock: clock}, &HandlerSet{
+		Handlers: []Handler{handler},
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	notify <- &pq.Notification{Channel: "users", Extra: "1"}
+	//wait for the first notification to leave the queue, so the rest fill it and then the spill
+	for c.QueueDepth()["users"] != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, payload := range []string{"2", "3", "4", "5"} {
+		notify <- &pq.Notification{Channel: "users", Extra: payload}
+	}
+	//the stalled channel doesn't hold back another one
+	notify <- &pq.Notification{Channel: "orders", Extra: "1"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := strings.Join(seen, ",")
+		mu.Unlock()
+		if got == "orders:1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the other channel to be processed, got: %s", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if waiters := clock.Waiters(); waiters != 1 {
+		t.Fatalf("expected one idle timer, got %d", waiters)
+	}
+	if depth := c.QueueDepth()["users"]; depth != 3 {
+		t.Fatalf("expected 3 queued notifications, got %d", depth)
+	}
+	var full *QueueFullError
+	if len(errs) != 1 || !errors.As(errs[0], &full) || full.Size != 3 {
+		t.Fatalf("expected the notification past the spill limit to be reported, got: %v", errs)
+	}
+	close(release)
+	close(notify)
+	<-done
+	if got := strings.Join(seen, ","); got != "orders:1,users:1,users:2,users:3,users:4" {
+		t.Fatalf("expected the spilled notifications in order, got: %s", got)
+	}
+}
+
+func TestConcurrentOrderingSequence(t *testing.T) {
+	var gaps int64
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		if n.Extra == `{"seq": 2, "data": {}}` {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	})
+	c, err := NewClient([]string{"users"}, &Config{Ordering: OrderingConcurrent, ChannelWorkers: map[string]int{"users": 4}}, &HandlerSet{
+		Handlers:   []Handler{handler},
+		GapHandler: func(gap Gap) { atomic.AddInt64(&gaps, 1) },
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	for _, seq := range []int{1, 2, 3, 4, 6} {
+		notify <- &pq.Notification{Channel: "users", Extra: fmt.Sprintf(`{"seq": %d, "data": {}}`, seq)}
+	}
+	close(notify)
+	<-done
+	if gaps != 1 || c.Stats().Channels["users"].Missed != 1 {
+		t.Fatalf("expected only the real gap to be reported, got %d gaps", gaps)
+	}
+}
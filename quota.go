@@ -0,0 +1,403 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ErrThrottled is wrapped by the errors of sinks whose provider rejected a request for exceeding its quota, ie: an SNS ThrottlingException or a
+//Pub/Sub RESOURCE_EXHAUSTED, so a QuotaSink backs off further
+var ErrThrottled = errors.New("sink throttled by its provider")
+
+//A BatchSink sends several notifications in one request, ie: SNS PublishBatch, a Pub/Sub publish of many messages, a Lambda invocation with a list of events
+//or a WebhookBatchSink
+type BatchSink interface {
+	Sink
+	SendBatch(ctx context.Context, notifications []*pq.Notification) error
+}
+
+//A Quota is the limits a provider's API enforces over a period. Zero limits are unlimited
+type Quota struct {
+	//Requests is the number of requests allowed per Per, each batch being one
+	Requests int
+	//Messages is the number of notifications allowed per Per
+	Messages int
+	//Bytes is the payload bytes allowed per Per
+	Bytes int
+	//Per is the period the limits are enforced over. Defaults to 1 second
+	Per time.Duration
+}
+
+//A QuotaCollector is a Collector also measuring how close sinks are to their quotas
+type QuotaCollector interface {
+	Collector
+	//ObserveQuota is called after each request a QuotaSink makes, with the fraction of its quota used over the quota's period and whether the provider throttled it
+	ObserveQuota(sink string, pressure float64, throttled bool)
+}
+
+//QuotaOptions configures a QuotaSink
+type QuotaOptions struct {
+	Quota Quota
+	//Headroom is the fraction of the quota used before the sink waits for it to free up, leaving room for other clients of the same account. Defaults to 0.8
+	Headroom float64
+	//MaxBatch is the most notifications sent in one request, ie: 10 for SNS. Defaults to 10, and to 1 for a sink that isn't a BatchSink
+	MaxBatch int
+	//MaxBatchBytes is the largest total payload sent in one request, ie: 256KB for SNS. Zero is unlimited
+	MaxBatchBytes int
+	//Linger is the longest a notification waits for its batch to fill. Defaults to 100ms
+	Linger time.Duration
+	//Size is the number of notifications queued ahead of the sink, beyond which Send blocks. Defaults to 1024
+	Size int
+	//Retries is how many times a failed request is retried before its notifications are given up on
+	Retries int
+	//Backoff is the delay before the first retry, doubling after each attempt. Defaults to 1 second
+	Backoff time.Duration
+	//OnError is called with requests that failed after all retries. Defaults to discarding them
+	OnError ErrHandlerFunc
+	//Collector measures the sink's quota pressure, ie: the client's Metrics
+	Collector QuotaCollector
+	//Clock is the source of time for the quota's period, lingering and backoff. Defaults to SystemClock
+	Clock Clock
+}
+
+//QuotaStats are a QuotaSink's counters
+type QuotaStats struct {
+	Queued    int    `json:"queued"`
+	Requests  uint64 `json:"requests"`
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+	//Throttled are the requests the provider rejected for exceeding its quota
+	Throttled uint64 `json:"throttled"`
+	//Waits are the times a request was held back until the quota freed up
+	Waits uint64 `json:"waits"`
+	//Pressure is the fraction of the quota used over its period
+	Pressure float64 `json:"pressure"`
+	//Rate is the fraction of the quota the sink currently allows itself, halved each time it is throttled and recovering as requests succeed
+	Rate float64 `json:"rate"`
+}
+
+//A QuotaSink delivers notifications to a cloud API with strict quotas, ie: SNS, Pub/Sub or Lambda, tracking its usage client side so it waits for the quota to
+//free up before the provider would throttle it. Notifications are batched adaptively: while the quota is barely used each is sent as soon as it arrives,
+//and as usage approaches the headroom batches grow towards MaxBatch, sending as many notifications in fewer requests. A throttled request, one whose error
+//wraps ErrThrottled, halves the rate the sink allows itself, which recovers gradually as requests succeed, for quotas shared with other clients.
+//Like a BufferedSink, Send only enqueues and a dedicated worker delivers, acknowledging each notification once its batch is sent
+type QuotaSink struct {
+	sink      Sink
+	opts      QuotaOptions
+	queue     chan bufferedNotification
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	usage     []quotaUse
+	rate      float64
+	requests  uint64
+	delivered uint64
+	failed    uint64
+	throttled uint64
+	waits     uint64
+}
+
+//quotaUse is a request made within the quota's period
+type quotaUse struct {
+	at       time.Time
+	messages int
+	bytes    int
+}
+
+//NewQuotaSink starts a worker delivering batches to the sink within its quota
+func NewQuotaSink(sink Sink, opts QuotaOptions) *QuotaSink {
+	if opts.Quota.Per <= 0 {
+		opts.Quota.Per = time.Second
+	}
+	if opts.Headroom <= 0 || opts.Headroom > 1 {
+		opts.Headroom = 0.8
+	}
+	if _, ok := sink.(BatchSink); !ok {
+		opts.MaxBatch = 1
+	} else if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 10
+	}
+	if opts.Linger <= 0 {
+		opts.Linger = 100 * time.Millisecond
+	}
+	if opts.Size <= 0 {
+		opts.Size = 1024
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {}
+	}
+	opts.Clock = clockOr(opts.Clock)
+	q := &QuotaSink{
+		sink:  sink,
+		opts:  opts,
+		queue: make(chan bufferedNotification, opts.Size),
+		done:  make(chan struct{}),
+		rate:  1,
+	}
+	go q.work()
+	return q
+}
+
+//Name returns the wrapped sink's name
+func (q *QuotaSink) Name() string {
+	return q.sink.Name()
+}
+
+//Send enqueues a notification for delivery, blocking while the queue is full
+func (q *QuotaSink) Send(ctx context.Context, notification *pq.Notification) error {
+	return q.SendAck(ctx, notification, nil)
+}
+
+//SendAck enqueues a notification for delivery. ack is called once its batch is delivered or fails after all retries
+func (q *QuotaSink) SendAck(ctx context.Context, notification *pq.Notification, ack func(err error)) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrBufferClosed
+	}
+	if ack == nil {
+		ack = func(error) {}
+	}
+	select {
+	case q.queue <- bufferedNotification{ctx: detach(ctx), notification: notification, ack: ack}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Stats returns the sink's counters
+func (q *QuotaSink) Stats() QuotaStats {
+	q.mu.Lock()
+	q.expire(q.opts.Clock.Now())
+	pressure, _ := q.pressure()
+	rate := q.rate
+	q.mu.Unlock()
+	return QuotaStats{
+		Queued:    len(q.queue),
+		Requests:  atomic.LoadUint64(&q.requests),
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Failed:    atomic.LoadUint64(&q.failed),
+		Throttled: atomic.LoadUint64(&q.throttled),
+		Waits:     atomic.LoadUint64(&q.waits),
+		Pressure:  pressure,
+		Rate:      rate,
+	}
+}
+
+//Close stops accepting notifications and waits for the queued ones to be delivered or the context to expire
+func (q *QuotaSink) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *QuotaSink) work() {
+	defer close(q.done)
+	var batch []bufferedNotification
+	var size int
+	var linger <-chan time.Time
+	add := func(item bufferedNotification) {
+		if len(batch) == 0 {
+			linger = q.opts.Clock.After(q.opts.Linger)
+		}
+		batch = append(batch, item)
+		size += len(item.notification.Extra)
+	}
+	flush := func() {
+		q.deliver(batch, size)
+		batch, size, linger = nil, 0, nil
+	}
+	for {
+		if len(batch) == 0 {
+			item, ok := <-q.queue
+			if !ok {
+				return
+			}
+			add(item)
+		}
+		if len(batch) >= q.target() {
+			flush()
+			continue
+		}
+		select {
+		case item, ok := <-q.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if q.opts.MaxBatchBytes > 0 && size+len(item.notification.Extra) > q.opts.MaxBatchBytes {
+				flush()
+			}
+			add(item)
+		case <-linger:
+			flush()
+		}
+	}
+}
+
+//target is the batch size sent without lingering: one while the quota is barely used, growing to MaxBatch as usage reaches the headroom
+func (q *QuotaSink) target() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire(q.opts.Clock.Now())
+	_, load := q.pressure()
+	if load > 1 {
+		load = 1
+	}
+	return 1 + int(load*float64(q.opts.MaxBatch-1))
+}
+
+//deliver sends a batch within the quota, retrying failures with exponential backoff, and acknowledges its notifications
+func (q *QuotaSink) deliver(batch []bufferedNotification, size int) {
+	notifications := make([]*pq.Notification, len(batch))
+	for i, item := range batch {
+		notifications[i] = item.notification
+	}
+	ctx := batch[0].ctx
+	backoff := q.opts.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		q.wait(len(batch), size)
+		err = q.send(ctx, notifications)
+		throttled := errors.Is(err, ErrThrottled)
+		q.mu.Lock()
+		q.usage = append(q.usage, quotaUse{at: q.opts.Clock.Now(), messages: len(batch), bytes: size})
+		if throttled {
+			q.rate /= 2
+			if q.rate < 0.1 {
+				q.rate = 0.1
+			}
+		} else if err == nil && q.rate < 1 {
+			q.rate += 0.05
+			if q.rate > 1 {
+				q.rate = 1
+			}
+		}
+		pressure, _ := q.pressure()
+		q.mu.Unlock()
+		atomic.AddUint64(&q.requests, 1)
+		if throttled {
+			atomic.AddUint64(&q.throttled, 1)
+		}
+		if q.opts.Collector != nil {
+			q.opts.Collector.ObserveQuota(q.Name(), pressure, throttled)
+		}
+		if err == nil || attempt >= q.opts.Retries {
+			break
+		}
+		<-q.opts.Clock.After(backoff)
+		backoff *= 2
+	}
+	for _, item := range batch {
+		item.ack(err)
+	}
+	if err != nil {
+		atomic.AddUint64(&q.failed, uint64(len(batch)))
+		q.opts.OnError(fmt.Errorf("sink %s failed to deliver %d notifications! %s", q.sink.Name(), len(batch), err.Error()))
+		return
+	}
+	atomic.AddUint64(&q.delivered, uint64(len(batch)))
+}
+
+func (q *QuotaSink) send(ctx context.Context, notifications []*pq.Notification) error {
+	if batcher, ok := q.sink.(BatchSink); ok {
+		return batcher.SendBatch(ctx, notifications)
+	}
+	return q.sink.Send(ctx, notifications[0])
+}
+
+//wait blocks until a request of messages and bytes fits within the quota's allowance
+func (q *QuotaSink) wait(messages, bytes int) {
+	for {
+		q.mu.Lock()
+		now := q.opts.Clock.Now()
+		q.expire(now)
+		delay := q.delay(now, messages, bytes)
+		q.mu.Unlock()
+		if delay <= 0 {
+			return
+		}
+		atomic.AddUint64(&q.waits, 1)
+		<-q.opts.Clock.After(delay)
+	}
+}
+
+//delay returns how long until enough of the period's usage expires for a request to fit within the allowance. The lock must be held
+func (q *QuotaSink) delay(now time.Time, messages, bytes int) time.Duration {
+	var delay time.Duration
+	for _, limit := range []struct {
+		limit, need int
+		used        func(quotaUse) int
+	}{
+		{q.opts.Quota.Requests, 1, func(quotaUse) int { return 1 }},
+		{q.opts.Quota.Messages, messages, func(u quotaUse) int { return u.messages }},
+		{q.opts.Quota.Bytes, bytes, func(u quotaUse) int { return u.bytes }},
+	} {
+		if limit.limit <= 0 {
+			continue
+		}
+		//a request larger than the allowance is sent alone within the period
+		allowance := float64(limit.limit) * q.opts.Headroom * q.rate
+		if allowance < float64(limit.need) {
+			allowance = float64(limit.need)
+		}
+		used := 0
+		for _, u := range q.usage {
+			used += limit.used(u)
+		}
+		for _, u := range q.usage {
+			if float64(used+limit.need) <= allowance {
+				break
+			}
+			used -= limit.used(u)
+			if d := u.at.Add(q.opts.Quota.Per).Sub(now); d > delay {
+				delay = d
+			}
+		}
+	}
+	return delay
+}
+
+//expire forgets the usage older than the quota's period. The lock must be held
+func (q *QuotaSink) expire(now time.Time) {
+	i := 0
+	for i < len(q.usage) && !q.usage[i].at.Add(q.opts.Quota.Per).After(now) {
+		i++
+	}
+	q.usage = q.usage[i:]
+}
+
+//pressure returns the fraction of the quota used over its period, and of the allowance the sink currently allows itself. The lock must be held
+func (q *QuotaSink) pressure() (float64, float64) {
+	var requests, messages, bytes int
+	for _, u := range q.usage {
+		requests++
+		messages += u.messages
+		bytes += u.bytes
+	}
+	var pressure float64
+	for _, limit := range [][2]int{{q.opts.Quota.Requests, requests}, {q.opts.Quota.Messages, messages}, {q.opts.Quota.Bytes, bytes}} {
+		if limit[0] > 0 && float64(limit[1])/float64(limit[0]) > pressure {
+			pressure = float64(limit[1]) / float64(limit[0])
+		}
+	}
+	return pressure, pressure / (q.opts.Headroom * q.rate)
+}
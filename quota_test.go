@@ -0,0 +1,144 @@
+package pqstream_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type batchRecorder struct {
+	mu       sync.Mutex
+	batches  []int
+	throttle int
+}
+
+func (b *batchRecorder) Name() string {
+	return "sns"
+}
+
+func (b *batchRecorder) Send(ctx context.Context, notification *pq.Notification) error {
+	return b.SendBatch(ctx, []*pq.Notification{notification})
+}
+
+func (b *batchRecorder) SendBatch(ctx context.Context, notifications []*pq.Notification) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.throttle > 0 {
+		b.throttle--
+		return fmt.Errorf("publish failed! %w", pqstream.ErrThrottled)
+	}
+	b.batches = append(b.batches, len(notifications))
+	return nil
+}
+
+func (b *batchRecorder) sent() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Trim(fmt.Sprint(b.batches), "[]")
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuotaSinkAdaptiveBatching(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	metrics := pqstream.NewMetrics()
+	sink := &batchRecorder{}
+	q := pqstream.NewQuotaSink(sink, pqstream.QuotaOptions{
+		Quota:     pqstream.Quota{Requests: 4},
+		Headroom:  1,
+		MaxBatch:  5,
+		Collector: metrics,
+		Clock:     clock,
+	})
+	var mu sync.Mutex
+	acked := 0
+	for i := 0; i < 12; i++ {
+		if err := q.SendAck(context.Background(), &pq.Notification{Channel: "orders", Extra: "{}"}, func(err error) {
+			if err != nil {
+				t.Error(err.Error())
+			}
+			mu.Lock()
+			acked++
+			mu.Unlock()
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	//batches grow as the quota is used, until the last lingers for more notifications
+	waitUntil(t, "the quota to be used", func() bool { return sink.sent() == "1 2 3 4" })
+	if stats := q.Stats(); stats.Pressure != 1 || stats.Requests != 4 || stats.Delivered != 10 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	//with the quota exhausted, the lingering batch waits for the period to pass
+	clock.Advance(100 * time.Millisecond)
+	waitUntil(t, "the sink to wait for its quota", func() bool { return q.Stats().Waits == 1 && clock.Waiters() == 1 })
+	clock.Advance(time.Second)
+	waitUntil(t, "the rest to be delivered", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return acked == 12
+	})
+	if got := sink.sent(); got != "1 2 3 4 2" {
+		t.Fatalf("unexpected batches: %s", got)
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`pqstream_sink_quota_pressure{sink="sns"} 0.25`, `pqstream_sink_throttled_total{sink="sns"} 0`} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Fatalf("expected %s in metrics, got:\n%s", line, rec.Body.String())
+		}
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := q.Send(context.Background(), &pq.Notification{}); err != pqstream.ErrBufferClosed {
+		t.Fatalf("expected a closed sink to reject notifications, got: %v", err)
+	}
+}
+
+func TestQuotaSinkThrottled(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	sink := &batchRecorder{throttle: 1}
+	var errs []error
+	q := pqstream.NewQuotaSink(pqstream.NewSink("lambda", sink.Send), pqstream.QuotaOptions{
+		Quota:   pqstream.Quota{Messages: 100},
+		Retries: 1,
+		Backoff: time.Second,
+		OnError: func(err error) { errs = append(errs, err) },
+		Clock:   clock,
+	})
+	if err := q.Send(context.Background(), &pq.Notification{Channel: "orders", Extra: "{}"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitUntil(t, "the request to be throttled", func() bool { return q.Stats().Throttled == 1 && clock.Waiters() == 2 })
+	if rate := q.Stats().Rate; rate != 0.5 {
+		t.Fatalf("expected a throttled sink to halve its rate, got %g", rate)
+	}
+	//fires the retry backoff, along with the linger the request was sent without waiting out
+	clock.Advance(time.Second)
+	waitUntil(t, "the retry to be delivered", func() bool { return q.Stats().Delivered == 1 })
+	if stats := q.Stats(); stats.Requests != 2 || stats.Rate != 0.55 || stats.Failed != 0 || len(errs) != 0 {
+		t.Fatalf("unexpected stats: %+v, errors: %v", stats, errs)
+	}
+	if got := sink.sent(); got != "1" {
+		t.Fatalf("expected a sink that can't batch to be sent single notifications, got: %s", got)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+}
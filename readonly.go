@@ -0,0 +1,44 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+//ErrReadOnly is returned by built-in sinks and helpers asked to write in read-only mode
+var ErrReadOnly = errors.New("read-only mode forbids writes")
+
+type readOnlyKey struct{}
+
+//WithReadOnly returns a context in which built-in sinks, checkpoints and helpers refuse to write. Clients configured with Config.ReadOnly pass such a context to every ContextHandler and Pipeline
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+//IsReadOnly reports whether a handler's context is in read-only mode
+func IsReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
+
+//checkReadOnly returns ErrReadOnly if the context or client forbids writes
+func checkReadOnly(ctx context.Context, c *Client) error {
+	if IsReadOnly(ctx) || (c != nil && c.config.ReadOnly) {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+//verifyReadOnly checks the server enforces read-only transactions on the client's session, so a write slipping past the library still fails
+func verifyReadOnly(ctx context.Context, db *sql.DB) error {
+	var setting string
+	if err := db.QueryRowContext(ctx, "SHOW default_transaction_read_only").Scan(&setting); err != nil {
+		return fmt.Errorf("failed to verify read-only mode! %s", err.Error())
+	}
+	if setting != "on" {
+		return fmt.Errorf("failed to verify read-only mode! default_transaction_read_only is %s", setting)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	config := &pqstream.Config{ReadOnly: true}
+	if !strings.HasSuffix(config.ConnInfo(), " default_transaction_read_only=on") {
+		t.Fatalf("expected read-only sessions, got %s", config.ConnInfo())
+	}
+	checkpoints := 0
+	var sent error
+	pipeline := pqstream.NewPipeline().
+		Source("users").
+		FanOut(pqstream.NewSink("probe", func(ctx context.Context, n *pq.Notification) error {
+			sent = (&pqstream.AuditSink{}).Send(ctx, n)
+			return nil
+		})).
+		Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+			checkpoints++
+			return nil
+		})
+	client, err := pqstream.NewPipelineClient(config, pipeline)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	if sent != pqstream.ErrReadOnly {
+		t.Fatalf("expected the audit sink to refuse to write, got %v", sent)
+	}
+	if checkpoints != 0 {
+		t.Fatalf("expected no checkpoint writes, got %d", checkpoints)
+	}
+	if err := (&pqstream.Heartbeat{}).Run(context.Background(), client); err != pqstream.ErrReadOnly {
+		t.Fatalf("expected the heartbeat to refuse to run, got %v", err)
+	}
+	if _, err := (&pqstream.Migrator{}).Up(pqstream.WithReadOnly(context.Background()), pqstream.Migrations(pqstream.MigrationOptions{})); err != pqstream.ErrReadOnly {
+		t.Fatalf("expected migrations to refuse to run, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package pqstream
+
+import (
+	"context"
+)
+
+//Ready returns a channel closed once the client has registered LISTEN on every one of its channels for the first time. Notifications sent before then may be lost,
+//so producers in the same process, ie: tests and services that consume their own events, should wait for it before they start. It stays closed across reconnects
+func (c *Client) Ready() <-chan struct{} {
+	return c.lifecycle.ready
+}
+
+//WaitReady blocks until the client is Ready, returning ErrClientStopped if it stops first, or the context's error if it is done first
+func (c *Client) WaitReady(ctx context.Context) error {
+	select {
+	case <-c.lifecycle.ready:
+		return nil
+	case <-c.lifecycle.stopping:
+		return ErrClientStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//WaitReady blocks until every client is Ready, ie: the consumers a producer notifies, returning the first error
+func WaitReady(ctx context.Context, clients ...*Client) error {
+	for _, c := range clients {
+		if err := c.WaitReady(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//markReady closes the Ready channel the first time it is called
+func (c *Client) markReady() {
+	c.lifecycle.isReady.Do(func() {
+		if c.config.Verbose {
+			c.logf("listening on every channel, ready")
+		}
+		close(c.lifecycle.ready)
+		c.setLifecycle(ClientRunning)
+	})
+}
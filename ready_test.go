@@ -0,0 +1,36 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-client.Ready():
+		t.Fatal("expected a client that never listened not to be ready")
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pqstream.WaitReady(ctx, client); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got: %v", err)
+	}
+	if err := client.Shutdown(context.Background()); err != pqstream.ErrClientNotStarted {
+		t.Fatalf("expected the client never to have started, got: %v", err)
+	}
+	if err := client.WaitReady(context.Background()); !errors.Is(err, pqstream.ErrClientStopped) {
+		t.Fatalf("expected ErrClientStopped once the client stopped, got: %v", err)
+	}
+}
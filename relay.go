@@ -0,0 +1,97 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+//A RelaySink forwards notifications to a channel in another database with pg_notify, tagging each one with the regions it has passed through so
+//bidirectional relays between regions don't forward their own events back and forth forever. Payloads that aren't already enveloped are wrapped in an Envelope to carry the tags
+type RelaySink struct {
+	DB *sql.DB
+	//Region is the region this relay forwards from
+	Region string
+	//Target is the region of DB
+	Target string
+	//Channel is the channel notifications are sent to. Defaults to the channel they were received on
+	Channel string
+	//MaxHops drops notifications that have already been relayed this many times. Zero means no limit
+	MaxHops int
+}
+
+//Name returns the sink's name
+func (r *RelaySink) Name() string {
+	return fmt.Sprintf("relay:%s->%s", r.Region, r.Target)
+}
+
+//Tag returns the payload to forward for a notification, or false if it has already passed through the target or this region and forwarding it would loop
+func (r *RelaySink) Tag(notification *pq.Notification) (string, bool, error) {
+	return r.tag(context.Background(), notification)
+}
+
+//tag tags a notification like Tag, setting the context's trace context on its envelope so the trace continues in the target region
+func (r *RelaySink) tag(ctx context.Context, notification *pq.Notification) (string, bool, error) {
+	if r.Region == "" || r.Target == "" {
+		return "", false, errors.New("relay requires a region and a target")
+	}
+	//an enveloped payload carries its data or a ref to it and only envelope fields: other objects, ie: change events with an id, are wrapped whole
+	var e *Envelope
+	if isEnvelope(notification.Extra) {
+		e = envelopeOf(notification)
+	}
+	if e == nil {
+		e = &Envelope{Data: json.RawMessage(notification.Extra)}
+		if !json.Valid(e.Data) {
+			quoted, _ := json.Marshal(notification.Extra)
+			e.Data = quoted
+		}
+	}
+	if e.Origin == r.Target || (r.MaxHops > 0 && len(e.Via) >= r.MaxHops) {
+		return "", false, nil
+	}
+	for _, region := range e.Via {
+		if region == r.Region || region == r.Target {
+			return "", false, nil
+		}
+	}
+	if e.Origin == "" {
+		e.Origin = r.Region
+	}
+	e.Via = append(e.Via, r.Region)
+	e.withTraceContext(ctx)
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return "", false, err
+	}
+	return string(payload), true, nil
+}
+
+//Send forwards a notification unless it would loop back to a region it has already been through
+func (r *RelaySink) Send(ctx context.Context, notification *pq.Notification) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	payload, ok, err := r.tag(ctx, notification)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		traceFrom(ctx).record(TraceEvent{Stage: TraceFiltered, Sink: r.Name()})
+		return nil
+	}
+	if skipDryRun(ctx, r.Name(), &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: payload}) {
+		return nil
+	}
+	channel := r.Channel
+	if channel == "" {
+		channel = notification.Channel
+	}
+	if _, err := r.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, payload); err != nil {
+		return fmt.Errorf("failed to relay notification to %s! %s", r.Target, err.Error())
+	}
+	return nil
+}
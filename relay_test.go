@@ -0,0 +1,53 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestRelayLoopPrevention(t *testing.T) {
+	east := &pqstream.RelaySink{Region: "us-east", Target: "eu-west"}
+	west := &pqstream.RelaySink{Region: "eu-west", Target: "us-east"}
+
+	payload, ok, err := east.Tag(&pq.Notification{Channel: "users", Extra: `{"name": "bob"}`})
+	if err != nil || !ok {
+		t.Fatalf("expected a local notification to be relayed: %v", err)
+	}
+	e, err := pqstream.ParseEnvelope(&pq.Notification{Extra: payload})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Origin != "us-east" || len(e.Via) != 1 || string(e.Data) != `{"name":"bob"}` {
+		t.Fatalf("unexpected relayed envelope: %+v", e)
+	}
+	if _, ok, _ := west.Tag(&pq.Notification{Channel: "users", Extra: payload}); ok {
+		t.Fatal("expected a relayed notification not to be sent back to its origin")
+	}
+
+	third := &pqstream.RelaySink{Region: "eu-west", Target: "ap-south", MaxHops: 2}
+	payload, ok, _ = third.Tag(&pq.Notification{Channel: "users", Extra: payload})
+	if !ok {
+		t.Fatal("expected a relayed notification to continue to a new region")
+	}
+	if _, ok, _ := (&pqstream.RelaySink{Region: "ap-south", Target: "sa-east", MaxHops: 2}).Tag(&pq.Notification{Extra: payload}); ok {
+		t.Fatal("expected a notification past MaxHops to be dropped")
+	}
+
+	change := `{"id": "0190", "table": "users", "op": "INSERT", "new": {"name": "bob"}}`
+	payload, _, _ = east.Tag(&pq.Notification{Extra: change})
+	if e, _ = pqstream.ParseEnvelope(&pq.Notification{Extra: payload}); !strings.Contains(string(e.Data), `"table":"users"`) {
+		t.Fatalf("expected a change event with an id to be wrapped whole, got: %s", payload)
+	}
+	mixed := `{"id": "1", "data": {"name": "bob"}, "tenant": "acme"}`
+	payload, _, _ = east.Tag(&pq.Notification{Extra: mixed})
+	if e, _ = pqstream.ParseEnvelope(&pq.Notification{Extra: payload}); !strings.Contains(string(e.Data), `"tenant"`) {
+		t.Fatalf("expected a payload with fields beyond an envelope's to be wrapped whole, got: %s", payload)
+	}
+
+	payload, _, _ = east.Tag(&pq.Notification{Extra: "plain text"})
+	if e, _ = pqstream.ParseEnvelope(&pq.Notification{Extra: payload}); string(e.Data) != `"plain text"` {
+		t.Fatalf("expected a non-json payload to be wrapped as a string, got: %s", e.Data)
+	}
+}
@@ -0,0 +1,149 @@
+package pqstream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//A RecordReader reads Records from an NDJSON stream, such as a file written by a FileSink
+type RecordReader struct {
+	dec    *json.Decoder
+	closer io.Closer
+}
+
+//NewRecordReader reads Records from an NDJSON stream
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+//OpenRecords opens an NDJSON file for reading, transparently decompressing files ending in .gz
+func OpenRecords(path string) (*RecordReader, error) {
+	return OpenEncryptedRecords(path, nil)
+}
+
+//OpenEncryptedRecords opens an NDJSON file for reading like OpenRecords, decrypting files ending in .enc with the cipher
+func OpenEncryptedRecords(path string, c *FileCipher) (*RecordReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".enc") {
+		if c == nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is encrypted, open it with a cipher", path)
+		}
+		in = c.Reader(f)
+		path = strings.TrimSuffix(path, ".enc")
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		r := NewRecordReader(in)
+		r.closer = f
+		return r, nil
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := NewRecordReader(gz)
+	r.closer = multiCloser{gz, f}
+	return r, nil
+}
+
+//Next returns the next Record, or io.EOF once the stream is exhausted
+func (r *RecordReader) Next() (Record, error) {
+	var record Record
+	err := r.dec.Decode(&record)
+	return record, err
+}
+
+//Close closes the underlying file, if any
+func (r *RecordReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//A Replayer pushes previously exported Records through a Handler (a Pipeline, a Client, or any other Handler), for disaster recovery and load testing
+type Replayer struct {
+	//Speed scales the original gaps between records: 1 replays with the original pacing, 2 twice as fast. Zero replays as fast as possible
+	Speed float64
+	//OnError is called with handler errors. Defaults to stopping the replay on the first error
+	OnError func(record Record, err error) error
+	//Clock is the source of time for pacing. Defaults to SystemClock
+	Clock Clock
+}
+
+//ReplayFiles replays every file in order, returning the number of records replayed
+func (r *Replayer) ReplayFiles(ctx context.Context, handler Handler, paths ...string) (int, error) {
+	total := 0
+	for _, path := range paths {
+		reader, err := OpenRecords(path)
+		if err != nil {
+			return total, err
+		}
+		n, err := r.Replay(ctx, handler, reader)
+		reader.Close()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return total, nil
+}
+
+//Replay pushes every Record from the reader through the handler, returning the number of records replayed
+func (r *Replayer) Replay(ctx context.Context, handler Handler, reader *RecordReader) (int, error) {
+	var previous time.Time
+	count := 0
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if r.Speed > 0 && !previous.IsZero() && record.ReceivedAt.After(previous) {
+			gap := time.Duration(float64(record.ReceivedAt.Sub(previous)) / r.Speed)
+			select {
+			case <-ctx.Done():
+				return count, ctx.Err()
+			case <-clockOr(r.Clock).After(gap):
+			}
+		} else if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		previous = record.ReceivedAt
+		if err := handler.Process(record.Notification()); err != nil {
+			if r.OnError == nil {
+				return count, err
+			}
+			if err := r.OnError(record, err); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+}
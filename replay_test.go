@@ -0,0 +1,88 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayFiles(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := pqstream.NewFileSink(pqstream.FileSinkOptions{Dir: dir, Gzip: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+
+	var replayed []string
+	handler := pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		replayed = append(replayed, n.Extra)
+		return nil
+	})
+	n, err := (&pqstream.Replayer{}).ReplayFiles(context.Background(), handler, files...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 3 || strings.Join(replayed, ",") != "1,2,3" {
+		t.Fatalf("unexpected replay: %d %v", n, replayed)
+	}
+}
+
+func TestReplayPacing(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	input := `{"channel": "users", "payload": "1", "received_at": "2020-01-01T00:00:00Z"}
+{"channel": "users", "payload": "2", "received_at": "2020-01-01T00:00:01Z"}
+`
+	handled := make(chan string, 2)
+	handler := pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		handled <- n.Extra
+		if n.Extra == "2" {
+			return errors.New("bad record")
+		}
+		return nil
+	})
+	replayer := &pqstream.Replayer{Speed: 10, Clock: clock, OnError: func(record pqstream.Record, err error) error { return nil }}
+	done := make(chan int, 1)
+	go func() {
+		n, err := replayer.Replay(context.Background(), handler, pqstream.NewRecordReader(strings.NewReader(input)))
+		if err != nil {
+			t.Error(err.Error())
+		}
+		done <- n
+	}()
+	if got := <-handled; got != "1" {
+		t.Fatalf("unexpected first record: %s", got)
+	}
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(99 * time.Millisecond)
+	select {
+	case <-handled:
+		t.Fatal("record replayed before its scaled gap elapsed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if got := <-handled; got != "2" {
+		t.Fatalf("unexpected second record: %s", got)
+	}
+	if n := <-done; n != 2 {
+		t.Fatalf("unexpected replay count: %d", n)
+	}
+	if _, err := (&pqstream.Replayer{}).Replay(context.Background(), handler, pqstream.NewRecordReader(strings.NewReader(input))); err == nil {
+		t.Fatal("expected replay to stop on the first error without an OnError")
+	}
+}
@@ -0,0 +1,151 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"sync/atomic"
+)
+
+//A Republisher is a handler publishing a transformed copy of each notification onto another channel with pg_notify, so multi step processing can be
+//decomposed into stages connected through postgres itself: each stage is a client, or a handler of one, listening on the channel the previous stage republishes to.
+//Republished payloads are Envelopes from SourceDerived whose Lineage lists the channels the event was derived through, and an event is never republished
+//onto a channel already in its lineage, or past MaxHops, so stages feeding back into each other can't loop. Derived IDs are a hash of the event's
+//IdempotencyKey and Channel, so a redelivered event is republished with the same ID and later stages can dedupe it
+type Republisher struct {
+	DB Execer
+	//Channel is the channel derived events are published to
+	Channel string
+	//Transform derives the event republished from each notification, given its data unwrapped from its envelope, or the whole payload of a staged or
+	//unenveloped one. Returning nil republishes nothing. Nil republishes the data unchanged
+	Transform TransformFunc
+	//MaxHops is the longest lineage an event is republished with. Defaults to 8
+	MaxHops int
+	//Options configure how derived events too large for a single NOTIFY are sent
+	Options NotifyOptions
+	//Clock is the source of derived events' EmittedAt. Defaults to SystemClock
+	Clock Clock
+
+	republished uint64
+	dropped     uint64
+	looped      uint64
+}
+
+//RepublisherStats are a Republisher's counters
+type RepublisherStats struct {
+	Republished uint64 `json:"republished"`
+	//Dropped are the notifications Transform derived nothing from
+	Dropped uint64 `json:"dropped"`
+	//Looped are the notifications not republished because Channel is already in their lineage or their lineage is MaxHops long
+	Looped uint64 `json:"looped"`
+}
+
+//Name returns the handler's name
+func (r *Republisher) Name() string {
+	return "republish:" + r.Channel
+}
+
+//Process republishes a notification
+func (r *Republisher) Process(notification *pq.Notification) error {
+	return r.ProcessContext(context.Background(), notification)
+}
+
+//Send republishes a notification, so a Republisher can be a pipeline's sink
+func (r *Republisher) Send(ctx context.Context, notification *pq.Notification) error {
+	return r.ProcessContext(ctx, notification)
+}
+
+//ProcessContext republishes a notification, continuing the context's trace on the derived event
+func (r *Republisher) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if r.DB == nil {
+		return errors.New("republisher requires a db")
+	}
+	if err := ValidateChannel(r.Channel); err != nil {
+		return err
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	e, data, ok := r.derive(notification)
+	if !ok {
+		atomic.AddUint64(&r.looped, 1)
+		traceFrom(ctx).record(TraceEvent{Stage: TraceFiltered, Sink: r.Name()})
+		return nil
+	}
+	out := data
+	if r.Transform != nil {
+		var err error
+		if out, err = r.Transform(data); err != nil {
+			return err
+		}
+	}
+	if out == nil {
+		atomic.AddUint64(&r.dropped, 1)
+		traceFrom(ctx).record(TraceEvent{Stage: TraceFiltered, Sink: r.Name()})
+		return nil
+	}
+	e.Data = json.RawMessage(out.Extra)
+	if !json.Valid(e.Data) {
+		quoted, _ := json.Marshal(out.Extra)
+		e.Data = quoted
+	}
+	e.withTraceContext(ctx)
+	if skipDryRun(ctx, r.Name(), out) {
+		return nil
+	}
+	if err := notifyEnvelope(ctx, r.DB, r.Channel, e, r.Options); err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.republished, 1)
+	return nil
+}
+
+//derive returns the envelope of the event derived from a notification, without its data, and the notification's data to transform. It reports false
+//if republishing the notification would loop
+func (r *Republisher) derive(notification *pq.Notification) (Envelope, *pq.Notification, bool) {
+	maxHops := r.MaxHops
+	if maxHops <= 0 {
+		maxHops = 8
+	}
+	parent := envelopeOf(notification)
+	//other objects, ie: change events with an id, aren't envelopes
+	if parent == nil || (parent.Data == nil && parent.Ref == "") {
+		parent = &Envelope{}
+	}
+	lineage := append(append([]string{}, parent.Lineage...), notification.Channel)
+	if len(lineage) > maxHops {
+		return Envelope{}, nil, false
+	}
+	for _, channel := range lineage {
+		if channel == r.Channel {
+			return Envelope{}, nil, false
+		}
+	}
+	sum := sha256.Sum256([]byte(IdempotencyKey(notification) + "\x00" + r.Channel))
+	e := Envelope{
+		ID:        hex.EncodeToString(sum[:16]),
+		EmittedAt: clockOr(r.Clock).Now().UTC(),
+		Source:    SourceDerived,
+		Origin:    parent.Origin,
+		Via:       parent.Via,
+		Lineage:   lineage,
+		Deadline:  parent.Deadline,
+	}
+	data := notification
+	if parent.Data != nil {
+		data = &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(parent.Data)}
+	}
+	return e, data, true
+}
+
+//Stats returns the republisher's counters
+func (r *Republisher) Stats() RepublisherStats {
+	return RepublisherStats{
+		Republished: atomic.LoadUint64(&r.republished),
+		Dropped:     atomic.LoadUint64(&r.dropped),
+		Looped:      atomic.LoadUint64(&r.looped),
+	}
+}
@@ -0,0 +1,92 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestRepublisher(t *testing.T) {
+	db := &execRecorder{}
+	enrich := &pqstream.Republisher{
+		DB:      db,
+		Channel: "orders_enriched",
+		Transform: func(n *pq.Notification) (*pq.Notification, error) {
+			if strings.Contains(n.Extra, "test") {
+				return nil, nil
+			}
+			return &pq.Notification{Channel: n.Channel, Extra: strings.Replace(n.Extra, "}", `,"enriched":true}`, 1)}, nil
+		},
+	}
+	received := &pq.Notification{Channel: "orders", Extra: `{"id":1}`}
+	for i := 0; i < 2; i++ {
+		if err := enrich.Process(received); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := enrich.Process(&pq.Notification{Channel: "orders", Extra: `{"id":"test"}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(db.args) != 2 {
+		t.Fatalf("expected 2 republished events, got %d", len(db.args))
+	}
+	if db.args[0][0] != "orders_enriched" {
+		t.Fatalf("expected the event on orders_enriched, got %v", db.args[0][0])
+	}
+	derived := &pq.Notification{Channel: "orders_enriched", Extra: db.args[0][1].(string)}
+	e, err := pqstream.ParseEnvelope(derived)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Source != pqstream.SourceDerived || strings.Join(e.Lineage, ",") != "orders" || string(e.Data) != `{"id":1,"enriched":true}` {
+		t.Fatalf("unexpected derived envelope: %+v", e)
+	}
+	if !strings.Contains(db.args[1][1].(string), `"id":"`+e.ID+`"`) {
+		t.Fatalf("expected a redelivered event to be republished with the same id, got: %s", db.args[1][1])
+	}
+	//a later stage is given the derived data, and can't republish it back onto a channel it was derived from
+	var seen string
+	audit := &pqstream.Republisher{DB: db, Channel: "orders_audit", Transform: func(n *pq.Notification) (*pq.Notification, error) {
+		seen = n.Extra
+		return n, nil
+	}}
+	if err := audit.Process(derived); err != nil {
+		t.Fatal(err.Error())
+	}
+	if seen != `{"id":1,"enriched":true}` {
+		t.Fatalf("expected the stage to transform the derived data, got: %s", seen)
+	}
+	audited := &pq.Notification{Channel: "orders_audit", Extra: db.args[2][1].(string)}
+	var envelope struct {
+		Lineage []string `json:"lineage"`
+	}
+	if err := json.Unmarshal([]byte(audited.Extra), &envelope); err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(envelope.Lineage, ",") != "orders,orders_enriched" {
+		t.Fatalf("unexpected lineage: %v", envelope.Lineage)
+	}
+	back := &pqstream.Republisher{DB: db, Channel: "orders"}
+	if err := back.Process(audited); err != nil {
+		t.Fatal(err.Error())
+	}
+	short := &pqstream.Republisher{DB: db, Channel: "orders_archive", MaxHops: 2}
+	if err := short.ProcessContext(context.Background(), audited); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(db.args) != 3 {
+		t.Fatalf("expected looping events not to be republished, got %d events", len(db.args))
+	}
+	if stats := enrich.Stats(); stats.Republished != 2 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if back.Stats().Looped != 1 || short.Stats().Looped != 1 {
+		t.Fatalf("expected the loops to be counted, got %+v and %+v", back.Stats(), short.Stats())
+	}
+	if err := enrich.ProcessContext(pqstream.WithReadOnly(context.Background()), received); err == nil {
+		t.Fatal("expected a read only client not to republish")
+	}
+}
@@ -0,0 +1,63 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+)
+
+//A ResultHandler is a Handler that computes a value from a notification. When registered as one of HandlerSet.Handlers, its value is collected and passed to every PostHandler implementing ResultConsumer
+type ResultHandler interface {
+	Handler
+	ProcessResult(notification *pq.Notification) (any, error)
+}
+
+//A ResultConsumer is a Handler that receives the results of the main Handlers when registered as one of HandlerSet.PostHandlers
+type ResultConsumer interface {
+	Handler
+	ProcessResults(notification *pq.Notification, results Results) error
+}
+
+//Result is the value a ResultHandler produced for a notification
+type Result struct {
+	Handler string
+	Value   any
+}
+
+//Results are the values produced by the main Handlers that succeeded, in registration order
+type Results []Result
+
+//Get returns the value produced by the named handler
+func (r Results) Get(handler string) (any, bool) {
+	for _, result := range r {
+		if result.Handler == handler {
+			return result.Value, true
+		}
+	}
+	return nil, false
+}
+
+//A ResultHandlerFunc is a first class function that satisfies the ResultHandler interface
+type ResultHandlerFunc func(notification *pq.Notification) (any, error)
+
+//Process runs itself on a received postgres notification, discarding the result
+func (h ResultHandlerFunc) Process(notification *pq.Notification) error {
+	_, err := h(notification)
+	return err
+}
+
+//ProcessResult runs itself on a received postgres notification
+func (h ResultHandlerFunc) ProcessResult(notification *pq.Notification) (any, error) {
+	return h(notification)
+}
+
+//A ResultConsumerFunc is a first class function that satisfies the ResultConsumer interface
+type ResultConsumerFunc func(notification *pq.Notification, results Results) error
+
+//Process runs itself on a received postgres notification with no results
+func (h ResultConsumerFunc) Process(notification *pq.Notification) error {
+	return h(notification, nil)
+}
+
+//ProcessResults runs itself on a received postgres notification and the main Handlers' results
+func (h ResultConsumerFunc) ProcessResults(notification *pq.Notification, results Results) error {
+	return h(notification, results)
+}
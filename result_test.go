@@ -0,0 +1,43 @@
+package pqstream_test
+
+import (
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestResultPropagation(t *testing.T) {
+	var published pqstream.Results
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.ResultHandlerFunc(func(notification *pq.Notification) (any, error) {
+				return "projection:" + notification.Extra, nil
+			}),
+			pqstream.ResultHandlerFunc(func(notification *pq.Notification) (any, error) {
+				return nil, errors.New("failed")
+			}),
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				return nil
+			}),
+		},
+		PostHandlers: []pqstream.Handler{
+			pqstream.ResultConsumerFunc(func(notification *pq.Notification, results pqstream.Results) error {
+				published = results
+				return nil
+			}),
+		},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	if len(published) != 1 || published[0].Value != "projection:1" {
+		t.Fatalf("unexpected results: %+v", published)
+	}
+	if _, ok := published.Get(published[0].Handler); !ok {
+		t.Fatal("expected result lookup by handler name")
+	}
+}
@@ -0,0 +1,174 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A Pruner deletes records older than a cutoff from a store that would otherwise grow unbounded (audit tables, staging tables, spools, dedup stores) and reports how many it removed
+type Pruner interface {
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+//A PrunerFunc is a first class function that satisfies the Pruner interface
+type PrunerFunc func(ctx context.Context, before time.Time) (int64, error)
+
+//Prune runs itself
+func (f PrunerFunc) Prune(ctx context.Context, before time.Time) (int64, error) {
+	return f(ctx, before)
+}
+
+//TablePruner deletes rows whose timestamp column is older than the cutoff, in batches so a large backlog doesn't hold locks for long
+type TablePruner struct {
+	DB *sql.DB
+	//Table is the optionally schema qualified table name, ie: pqstream.audit
+	Table string
+	//Column is the timestamp column compared against the cutoff
+	Column string
+	//BatchSize is the number of rows deleted per statement. Defaults to 10000
+	BatchSize int
+}
+
+//Prune deletes rows older than before
+func (t *TablePruner) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if t.DB == nil || t.Table == "" || t.Column == "" {
+		return 0, errors.New("table pruner requires a db, table and column")
+	}
+	batch := t.BatchSize
+	if batch <= 0 {
+		batch = 10000
+	}
+	table := quoteQualified(t.Table)
+	query := fmt.Sprintf("DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE %s < $1 LIMIT %d)", table, table, pq.QuoteIdentifier(t.Column), batch)
+	var total int64
+	for {
+		res, err := t.DB.ExecContext(ctx, query, before)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(batch) {
+			return total, nil
+		}
+	}
+}
+
+//RetentionStats are the counters for a single pruned store
+type RetentionStats struct {
+	Pruned  int64     `json:"pruned"`
+	LastRun time.Time `json:"last_run"`
+	Error   string    `json:"error,omitempty"`
+}
+
+//Retention periodically prunes records older than MaxAge from every registered store
+type Retention struct {
+	//MaxAge is how long records are kept
+	MaxAge time.Duration
+	//Interval is how often stores are pruned. Defaults to an hour
+	Interval time.Duration
+	//OnError is called when a store fails to prune
+	OnError ErrHandlerFunc
+	//Clock is the source of time for cutoffs and the pruning interval. Defaults to SystemClock
+	Clock Clock
+
+	mu      sync.Mutex
+	pruners map[string]Pruner
+	stats   map[string]RetentionStats
+}
+
+//Register adds a named store to be pruned
+func (r *Retention) Register(name string, pruner Pruner) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pruners == nil {
+		r.pruners = map[string]Pruner{}
+		r.stats = map[string]RetentionStats{}
+	}
+	r.pruners[name] = pruner
+}
+
+//PruneOnce prunes every registered store once, returning the rows pruned per store
+func (r *Retention) PruneOnce(ctx context.Context) map[string]int64 {
+	if r.MaxAge <= 0 {
+		return map[string]int64{}
+	}
+	clock := clockOr(r.Clock)
+	before := clock.Now().Add(-r.MaxAge)
+	r.mu.Lock()
+	names := make([]string, 0, len(r.pruners))
+	for name := range r.pruners {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	pruned := map[string]int64{}
+	for _, name := range names {
+		r.mu.Lock()
+		pruner := r.pruners[name]
+		r.mu.Unlock()
+		n, err := pruner.Prune(ctx, before)
+		pruned[name] = n
+		r.mu.Lock()
+		stats := r.stats[name]
+		stats.Pruned += n
+		stats.LastRun = clock.Now()
+		stats.Error = ""
+		if err != nil {
+			stats.Error = err.Error()
+		}
+		r.stats[name] = stats
+		r.mu.Unlock()
+		if err != nil && r.OnError != nil {
+			r.OnError(fmt.Errorf("failed to prune %s! error: %s", name, err.Error()))
+		}
+	}
+	return pruned
+}
+
+//Run prunes every Interval until the context is cancelled
+func (r *Retention) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	clock := clockOr(r.Clock)
+	for {
+		r.PruneOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+		}
+	}
+}
+
+//Stats returns the pruning counters per store
+func (r *Retention) Stats() map[string]RetentionStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]RetentionStats, len(r.stats))
+	for name, stats := range r.stats {
+		out[name] = stats
+	}
+	return out
+}
+
+//quoteQualified quotes each part of an optionally schema qualified identifier
+func quoteQualified(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
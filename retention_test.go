@@ -0,0 +1,45 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	var cutoff time.Time
+	var failures []error
+	now := time.Date(2020, 3, 30, 12, 0, 0, 0, time.UTC)
+	r := &pqstream.Retention{
+		Clock:   pqstream.NewFakeClock(now),
+		MaxAge:  48 * time.Hour,
+		OnError: func(err error) { failures = append(failures, err) },
+	}
+	r.Register("audit", pqstream.PrunerFunc(func(ctx context.Context, before time.Time) (int64, error) {
+		cutoff = before
+		return 7, nil
+	}))
+	r.Register("spool", pqstream.PrunerFunc(func(ctx context.Context, before time.Time) (int64, error) {
+		return 0, errors.New("locked")
+	}))
+	pruned := r.PruneOnce(context.Background())
+	if pruned["audit"] != 7 {
+		t.Fatalf("unexpected pruned rows: %v", pruned)
+	}
+	if !cutoff.Equal(now.Add(-48 * time.Hour)) {
+		t.Fatalf("unexpected cutoff: %s", cutoff)
+	}
+	r.PruneOnce(context.Background())
+	stats := r.Stats()
+	if stats["audit"].Pruned != 14 || stats["spool"].Error != "locked" || len(failures) != 2 {
+		t.Fatalf("unexpected retention stats: %+v, failures: %v", stats, failures)
+	}
+}
+
+func TestTablePrunerRequiresTable(t *testing.T) {
+	if _, err := (&pqstream.TablePruner{}).Prune(context.Background(), time.Now()); err == nil {
+		t.Fatal("expected an error for an unconfigured table pruner")
+	}
+}
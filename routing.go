@@ -0,0 +1,145 @@
+package pqstream
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"path"
+	"strings"
+	"sync"
+)
+
+//MatchTable reports whether a change event's table matches a pattern. A schema qualified pattern, ie: tenant_a.orders, only matches the table in that schema,
+//while a bare one, ie: orders, matches the table in any schema. Either part may use path.Match wildcards, ie: tenant_*.orders or *.audit_*
+func MatchTable(pattern string, e *ChangeEvent) bool {
+	schema, table, qualified := strings.Cut(pattern, ".")
+	if !qualified {
+		schema, table = "*", pattern
+	}
+	if ok, _ := path.Match(table, e.Table); !ok {
+		return false
+	}
+	ok, _ := path.Match(schema, e.Schema)
+	return ok
+}
+
+//OnTable returns a filter that only passes change events of tables matching one of the patterns, see MatchTable. Triggers name channels after their table
+//without its schema, so on a database with a schema per tenant OnTable tells identical tables on a shared channel apart, ie: as a pipeline Route's When
+func OnTable(patterns ...string) FilterFunc {
+	return func(notification *pq.Notification) bool {
+		e, err := ParseChange(notification)
+		if err != nil {
+			return false
+		}
+		for _, pattern := range patterns {
+			if MatchTable(pattern, e) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//SchemaTenant extracts a change event's schema as its tenant, for a TenantRouter's Extract on a database with a schema per tenant
+func SchemaTenant(notification *pq.Notification) (string, bool) {
+	e, err := ParseChange(notification)
+	if err != nil || e.Schema == "" {
+		return "", false
+	}
+	return e.Schema, true
+}
+
+//A TableMux routes change events to a chain of handlers registered for their table, like a Mux does by channel. Routes registered with a schema qualified
+//table without wildcards are matched first, then the other patterns in the order they were registered, see MatchTable, so tenant_a.orders can be handled
+//apart from every other schema's orders. Notifications that aren't change events, or whose table has no route, go to NotFound, or are ignored if it is nil
+type TableMux struct {
+	mu       sync.RWMutex
+	exact    map[string][]Handler
+	patterns []tableRoute
+	//NotFound receives change events of tables without a route and notifications that aren't change events
+	NotFound Handler
+}
+
+type tableRoute struct {
+	pattern string
+	chain   []Handler
+}
+
+//NewTableMux returns a TableMux without any routes
+func NewTableMux() *TableMux {
+	return &TableMux{exact: map[string][]Handler{}}
+}
+
+//Handle appends handlers to a table pattern's chain. Routes may be added while the mux is processing notifications
+func (m *TableMux) Handle(pattern string, handlers ...Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Contains(pattern, ".") && !strings.ContainsAny(pattern, `*?[\`) {
+		if m.exact == nil {
+			m.exact = map[string][]Handler{}
+		}
+		m.exact[pattern] = append(append([]Handler{}, m.exact[pattern]...), handlers...)
+		return
+	}
+	for i, route := range m.patterns {
+		if route.pattern == pattern {
+			patterns := append([]tableRoute{}, m.patterns...)
+			patterns[i].chain = append(append([]Handler{}, route.chain...), handlers...)
+			m.patterns = patterns
+			return
+		}
+	}
+	m.patterns = append(append([]tableRoute{}, m.patterns...), tableRoute{pattern: pattern, chain: handlers})
+}
+
+//HandleFunc appends a handler func to a table pattern's chain
+func (m *TableMux) HandleFunc(pattern string, handler func(notification *pq.Notification) error) {
+	m.Handle(pattern, HandlerFunc(handler))
+}
+
+func (m *TableMux) Name() string {
+	return "table_mux"
+}
+
+func (m *TableMux) Process(notification *pq.Notification) error {
+	return m.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs the chain of the change event's table
+func (m *TableMux) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	return m.processResultsContext(ctx, notification, nil)
+}
+
+//ProcessResults runs the chain of the change event's table, passing the results to its ResultConsumers
+func (m *TableMux) ProcessResults(notification *pq.Notification, results Results) error {
+	return m.processResultsContext(context.Background(), notification, results)
+}
+
+func (m *TableMux) processResultsContext(ctx context.Context, notification *pq.Notification, results Results) error {
+	chain, route := m.route(ctx, notification)
+	if chain == nil {
+		if m.NotFound == nil {
+			return nil
+		}
+		chain = []Handler{m.NotFound}
+	}
+	return runChain(ctx, chain, route, notification, results)
+}
+
+//route returns the chain of the change event's table and the pattern it was registered with
+func (m *TableMux) route(ctx context.Context, notification *pq.Notification) ([]Handler, string) {
+	e, err := Decoded[*ChangeEvent](ctx, notification)
+	if err != nil || e == nil || e.Table == "" || e.Op == "" {
+		return nil, ""
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if chain, ok := m.exact[e.QualifiedTable()]; ok {
+		return chain, e.QualifiedTable()
+	}
+	for _, route := range m.patterns {
+		if MatchTable(route.pattern, e) {
+			return route.chain, route.pattern
+		}
+	}
+	return nil, ""
+}
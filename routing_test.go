@@ -0,0 +1,58 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func changeOn(schema, table string) *pq.Notification {
+	return &pq.Notification{Channel: table, Extra: `{"schema": "` + schema + `", "table": "` + table + `", "op": "INSERT", "new": {"id": 1}}`}
+}
+
+func TestOnTable(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		n       *pq.Notification
+		want    bool
+	}{
+		{"tenant_a.orders", changeOn("tenant_a", "orders"), true},
+		{"tenant_a.orders", changeOn("tenant_b", "orders"), false},
+		{"orders", changeOn("tenant_b", "orders"), true},
+		{"tenant_*.orders", changeOn("tenant_b", "orders"), true},
+		{"tenant_*.orders", changeOn("public", "orders"), false},
+		{"*.audit_*", changeOn("ops", "audit_2024"), true},
+		{"orders", &pq.Notification{Channel: "orders", Extra: `{"id": 1}`}, false},
+	} {
+		if got := pqstream.OnTable(tt.pattern)(tt.n); got != tt.want {
+			t.Fatalf("expected %s on %s to be %v", tt.pattern, tt.n.Extra, tt.want)
+		}
+	}
+	if tenant, ok := pqstream.SchemaTenant(changeOn("tenant_a", "orders")); !ok || tenant != "tenant_a" {
+		t.Fatalf("expected the schema as the tenant, got: %s", tenant)
+	}
+}
+
+func TestTableMux(t *testing.T) {
+	var seen []string
+	record := func(name string) func(*pq.Notification) error {
+		return func(*pq.Notification) error {
+			seen = append(seen, name)
+			return nil
+		}
+	}
+	mux := pqstream.NewTableMux()
+	mux.HandleFunc("tenant_*.orders", record("tenants"))
+	mux.HandleFunc("tenant_a.orders", record("a"))
+	mux.HandleFunc("orders", record("any"))
+	mux.NotFound = pqstream.HandlerFunc(record("notfound"))
+	for _, n := range []*pq.Notification{changeOn("tenant_a", "orders"), changeOn("tenant_b", "orders"), changeOn("public", "orders"), changeOn("public", "users"), {Channel: "orders", Extra: "plain"}} {
+		if err := mux.Process(n); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if got := strings.Join(seen, ","); got != "a,tenants,any,notfound,notfound" {
+		t.Fatalf("expected exact tables to win over patterns, then patterns in order, got: %s", got)
+	}
+}
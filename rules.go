@@ -0,0 +1,512 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//RuleAggregate is what a Rule computes over the events in its window
+type RuleAggregate string
+
+const (
+	//RuleCount counts the events in the window
+	RuleCount RuleAggregate = "count"
+	//RuleSum sums the rule's Field over the window
+	RuleSum RuleAggregate = "sum"
+	//RuleAvg averages the rule's Field over the window
+	RuleAvg RuleAggregate = "avg"
+	//RuleMax is the largest Field in the window
+	RuleMax RuleAggregate = "max"
+	//RuleMin is the smallest Field in the window
+	RuleMin RuleAggregate = "min"
+)
+
+//A Rule raises an alert when an aggregate over the events matching it within a sliding window exceeds a threshold, separately for each group,
+//ie: more than 5 failed_login events per minute per user
+//
+//	rules:
+//	  - name: brute_force
+//	    channel: logins
+//	    when:
+//	      - path: data.outcome
+//	        value: failed
+//	    group_by: [data.user_id]
+//	    threshold: 5
+//	    window: 1m
+type Rule struct {
+	Name string `json:"name"`
+	//Channel is the channel the rule watches. Empty watches every channel
+	Channel string `json:"channel,omitempty"`
+	//When are the conditions an event must meet to count, all of them
+	When []RuleCondition `json:"when,omitempty"`
+	//GroupBy are the paths, in Mapping's syntax, of the fields the rule is evaluated separately for, ie: data.user_id. Empty evaluates every event together
+	GroupBy []string `json:"group_by,omitempty"`
+	//Aggregate defaults to RuleCount. The others aggregate Field, and ignore events where it isn't a number
+	Aggregate RuleAggregate `json:"aggregate,omitempty"`
+	Field     string        `json:"field,omitempty"`
+	//Threshold is the value the aggregate must exceed to alert
+	Threshold float64 `json:"threshold"`
+	//Window is how far back the events aggregated go, ie: 1m
+	Window time.Duration `json:"window"`
+	//Cooldown is how long a group that alerted waits before alerting again, however far over the threshold it stays. Defaults to Window
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+}
+
+//UnmarshalJSON decodes a rule whose Window and Cooldown are durations, ie: "1m30s", rejecting unknown fields
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	type plain Rule
+	raw := struct {
+		*plain
+		Window   string `json:"window"`
+		Cooldown string `json:"cooldown,omitempty"`
+	}{plain: (*plain)(r)}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	var err error
+	if r.Window, err = time.ParseDuration(raw.Window); err != nil {
+		return fmt.Errorf("invalid window %q! %s", raw.Window, err.Error())
+	}
+	if raw.Cooldown != "" {
+		if r.Cooldown, err = time.ParseDuration(raw.Cooldown); err != nil {
+			return fmt.Errorf("invalid cooldown %q! %s", raw.Cooldown, err.Error())
+		}
+	}
+	return nil
+}
+
+//A RuleCondition is a test of an event's field
+type RuleCondition struct {
+	//Path uses Mapping's path syntax, ie: data.outcome or $channel
+	Path string `json:"path"`
+	//Op is eq, ne, gt, gte, lt, lte or exists. Defaults to eq
+	Op string `json:"op,omitempty"`
+	//Value is compared with the field: as JSON by eq and ne, as numbers by the others
+	Value any `json:"value,omitempty"`
+}
+
+//A RuleAlert is a rule's aggregate exceeding its threshold for a group
+type RuleAlert struct {
+	Rule string `json:"rule"`
+	//Group are the values of the rule's GroupBy fields, by path
+	Group     map[string]any `json:"group,omitempty"`
+	Aggregate RuleAggregate  `json:"aggregate"`
+	Value     float64        `json:"value"`
+	Threshold float64        `json:"threshold"`
+	//Events is the number of events in the window
+	Events int    `json:"events"`
+	Window string `json:"window"`
+	//Channel is the channel of the event that crossed the threshold
+	Channel string    `json:"channel"`
+	At      time.Time `json:"at"`
+}
+
+//ParseRules decodes the rules of a config written in YAML or JSON, ie: {"rules": [...]}, validating each of them
+func ParseRules(data []byte) ([]Rule, error) {
+	encoded := data
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rules! %s", err.Error())
+		}
+		if encoded, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("failed to parse rules! %s", err.Error())
+		}
+	}
+	dec := json.NewDecoder(strings.NewReader(string(encoded)))
+	dec.DisallowUnknownFields()
+	file := struct {
+		Rules []Rule `json:"rules"`
+	}{}
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to parse rules! %s", err.Error())
+	}
+	for i, r := range file.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %s", i, err.Error())
+		}
+	}
+	return file.Rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule requires a name")
+	}
+	if r.Channel != "" {
+		if err := ValidateChannel(r.Channel); err != nil {
+			return err
+		}
+	}
+	if r.Window <= 0 {
+		return fmt.Errorf("rule %s requires a window", r.Name)
+	}
+	switch r.Aggregate {
+	case "", RuleCount:
+	case RuleSum, RuleAvg, RuleMax, RuleMin:
+		if msg := lintPath(r.Field, true); r.Field == "" || msg != "" {
+			return fmt.Errorf("rule %s requires a field to %s: %s", r.Name, r.Aggregate, msg)
+		}
+	default:
+		return fmt.Errorf("rule %s has an unknown aggregate %q, expected count, sum, avg, max or min", r.Name, r.Aggregate)
+	}
+	for _, path := range r.GroupBy {
+		if msg := lintPath(path, true); msg != "" {
+			return fmt.Errorf("rule %s has an invalid group_by %q: %s", r.Name, path, msg)
+		}
+	}
+	for i, cond := range r.When {
+		if err := cond.validate(); err != nil {
+			return fmt.Errorf("rule %s: when[%d] %s", r.Name, i, err.Error())
+		}
+	}
+	return nil
+}
+
+func (c RuleCondition) validate() error {
+	if msg := lintPath(c.Path, true); msg != "" {
+		return fmt.Errorf("has an invalid path %q: %s", c.Path, msg)
+	}
+	switch c.Op {
+	case "", "eq", "ne", "exists":
+	case "gt", "gte", "lt", "lte":
+		if _, ok := ruleNumber(c.Value); !ok {
+			return fmt.Errorf("compares with %s, which requires a number", c.Op)
+		}
+	default:
+		return fmt.Errorf("has an unknown op %q, expected eq, ne, gt, gte, lt, lte or exists", c.Op)
+	}
+	return nil
+}
+
+//matches reports whether an event meets every one of the rule's conditions
+func (r Rule) matches(notification *pq.Notification, payload any) bool {
+	if r.Channel != "" && r.Channel != notification.Channel {
+		return false
+	}
+	return conditionsMatch(r.When, notification, payload)
+}
+
+//Matches returns a FilterFunc accepting notifications that meet every condition, ie: as a Route's When
+func Matches(conditions ...RuleCondition) FilterFunc {
+	return func(notification *pq.Notification) bool {
+		payload, err := decodePayload(notification)
+		if err != nil {
+			return false
+		}
+		return conditionsMatch(conditions, notification, payload)
+	}
+}
+
+//conditionsMatch reports whether a decoded event meets every condition
+func conditionsMatch(conditions []RuleCondition, notification *pq.Notification, payload any) bool {
+	for _, cond := range conditions {
+		value, ok := resolve(notification, payload, cond.Path)
+		switch cond.Op {
+		case "exists":
+			if !ok {
+				return false
+			}
+			continue
+		case "", "eq":
+			if !ok || jsonString(value) != jsonString(cond.Value) {
+				return false
+			}
+			continue
+		case "ne":
+			if ok && jsonString(value) == jsonString(cond.Value) {
+				return false
+			}
+			continue
+		}
+		actual, isNumber := ruleNumber(value)
+		expected, _ := ruleNumber(cond.Value)
+		if !ok || !isNumber {
+			return false
+		}
+		switch {
+		case cond.Op == "gt" && !(actual > expected), cond.Op == "gte" && !(actual >= expected),
+			cond.Op == "lt" && !(actual < expected), cond.Op == "lte" && !(actual <= expected):
+			return false
+		}
+	}
+	return true
+}
+
+//ruleNumber returns a decoded JSON value as a number, including numeric strings
+func ruleNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+//A RuleEngine is a Handler matching every event against its Rules continuously, raising a RuleAlert whenever a rule's aggregate exceeds its threshold
+//for a group. Alerts are passed to OnAlert and sent to Sink as a notification on Channel, ie: a NotifySink republishing them to an alerts channel that
+//other consumers handle. Windows are kept in memory, so they restart empty when the client does.
+//
+//With EventTime, events are windowed by when their envelope says they were emitted, so events arriving out of order count towards the windows they
+//happened in, including windows that already ended at later events. The engine's Watermark trails the latest event time seen by AllowedLateness, across
+//every channel: events from before it are late, dropped and counted. Channels whose producers lag far behind each other are best watched by separate engines
+type RuleEngine struct {
+	Rules []Rule
+	//Channel is the channel alert notifications are sent on. Defaults to pqstream_alerts
+	Channel string
+	//Sink receives each alert as a notification whose payload is the RuleAlert as JSON. Nil sends nothing
+	Sink Sink
+	//OnAlert is called with every alert
+	OnAlert func(alert RuleAlert)
+	//Clock is the source of time for windows, and of events without an emitted_at when windowing by EventTime. Defaults to SystemClock
+	Clock Clock
+	//EventTime windows events by their envelope's emitted_at instead of when they are processed
+	EventTime bool
+	//AllowedLateness is how far behind the latest event time an event may be and still be windowed, with EventTime
+	AllowedLateness time.Duration
+	//OnLate is called with each late event, with EventTime
+	OnLate func(notification *pq.Notification)
+	//Collector measures the engine's watermark and late events, ie: the client's Metrics
+	Collector WatermarkCollector
+
+	mu        sync.Mutex
+	windows   map[ruleGroup]*ruleWindow
+	swept     time.Time
+	watermark Watermark
+}
+
+type ruleGroup struct {
+	rule  int
+	group string
+}
+
+//ruleWindow holds a group's events within its rule's window of the watermark, oldest first
+type ruleWindow struct {
+	at      []time.Time
+	values  []float64
+	alerted time.Time
+}
+
+//NewRuleEngine returns an engine of the rules, validating them
+func NewRuleEngine(rules ...Rule) (*RuleEngine, error) {
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %s", i, err.Error())
+		}
+	}
+	return &RuleEngine{Rules: rules}, nil
+}
+
+//Name returns the handler's name
+func (e *RuleEngine) Name() string {
+	return "rules"
+}
+
+func (e *RuleEngine) Process(notification *pq.Notification) error {
+	return e.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext adds the event to the window of each rule it matches, sending the alerts it raises
+func (e *RuleEngine) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	alerts, late := e.observe(notification, clockOr(e.Clock).Now())
+	if late && e.OnLate != nil {
+		e.OnLate(notification)
+	}
+	var errs []error
+	for _, alert := range alerts {
+		if e.OnAlert != nil {
+			e.OnAlert(alert)
+		}
+		if e.Sink == nil {
+			continue
+		}
+		payload, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		if err := e.Sink.Send(ctx, &pq.Notification{Channel: e.channel(), Extra: string(payload)}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send alert of rule %s! %s", alert.Rule, err.Error()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *RuleEngine) channel() string {
+	if e.Channel == "" {
+		return "pqstream_alerts"
+	}
+	return e.Channel
+}
+
+//Watermark returns the progress of the engine's event time and its late events, with EventTime
+func (e *RuleEngine) Watermark() WatermarkStats {
+	return e.watermark.Stats()
+}
+
+//observe adds an event received at a time to the windows of the rules it matches, returning the alerts raised, or reporting that it is late
+func (e *RuleEngine) observe(notification *pq.Notification, received time.Time) ([]RuleAlert, bool) {
+	payload, _ := decodePayload(notification)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.windows == nil {
+		e.windows = map[ruleGroup]*ruleWindow{}
+	}
+	//windows are kept back to the watermark, where events may still be added
+	at, horizon := received, received
+	if e.EventTime {
+		if emitted, ok := EventTime(notification); ok {
+			at = emitted
+		}
+		e.watermark.AllowedLateness = e.AllowedLateness
+		late := e.watermark.Observe(at)
+		horizon = e.watermark.Current()
+		if e.Collector != nil {
+			e.Collector.ObserveWatermark(e.Name(), horizon, late)
+		}
+		if late {
+			return nil, true
+		}
+	}
+	e.sweep(horizon)
+	var alerts []RuleAlert
+	for i, r := range e.Rules {
+		if !r.matches(notification, payload) {
+			continue
+		}
+		value := 1.0
+		if r.Aggregate != "" && r.Aggregate != RuleCount {
+			v, ok := resolve(notification, payload, r.Field)
+			if !ok {
+				continue
+			}
+			if value, ok = ruleNumber(v); !ok {
+				continue
+			}
+		}
+		group := map[string]any{}
+		for _, path := range r.GroupBy {
+			group[path], _ = resolve(notification, payload, path)
+		}
+		key := ruleGroup{rule: i}
+		if len(group) > 0 {
+			key.group = jsonString(group)
+		}
+		w, ok := e.windows[key]
+		if !ok {
+			w = &ruleWindow{}
+			e.windows[key] = w
+		}
+		w.expire(horizon.Add(-r.Window))
+		aggregate, events := w.add(at, value, r)
+		cooldown := r.Cooldown
+		if cooldown <= 0 {
+			cooldown = r.Window
+		}
+		if aggregate <= r.Threshold || (!w.alerted.IsZero() && at.Sub(w.alerted) < cooldown) {
+			continue
+		}
+		w.alerted = at
+		aggregateName := r.Aggregate
+		if aggregateName == "" {
+			aggregateName = RuleCount
+		}
+		alert := RuleAlert{Rule: r.Name, Aggregate: aggregateName, Value: aggregate, Threshold: r.Threshold, Events: events,
+			Window: r.Window.String(), Channel: notification.Channel, At: at}
+		if len(group) > 0 {
+			alert.Group = group
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, false
+}
+
+//sweep forgets the groups without events in their rule's window, at most once per the shortest window, so groups that stop receiving events don't pile up
+func (e *RuleEngine) sweep(at time.Time) {
+	shortest := time.Duration(0)
+	for _, r := range e.Rules {
+		if shortest == 0 || r.Window < shortest {
+			shortest = r.Window
+		}
+	}
+	if at.Sub(e.swept) < shortest {
+		return
+	}
+	e.swept = at
+	for key, w := range e.windows {
+		r := e.Rules[key.rule]
+		w.expire(at.Add(-r.Window))
+		cooldown := r.Cooldown
+		if cooldown < r.Window {
+			cooldown = r.Window
+		}
+		if len(w.at) == 0 && at.Sub(w.alerted) >= cooldown {
+			delete(e.windows, key)
+		}
+	}
+}
+
+//expire drops the events before a time
+func (w *ruleWindow) expire(before time.Time) {
+	i := 0
+	for i < len(w.at) && w.at[i].Before(before) {
+		i++
+	}
+	w.at, w.values = w.at[i:], w.values[i:]
+}
+
+//add inserts an event in time order, returning the aggregate and number of events of the fullest window it is part of: the one it ends, or for an event
+//arriving out of order, one ending at a later event
+func (w *ruleWindow) add(at time.Time, value float64, r Rule) (float64, int) {
+	i := sort.Search(len(w.at), func(i int) bool { return w.at[i].After(at) })
+	w.at = append(w.at[:i], append([]time.Time{at}, w.at[i:]...)...)
+	w.values = append(w.values[:i], append([]float64{value}, w.values[i:]...)...)
+	var peak float64
+	var events int
+	for end := i; end < len(w.at) && !w.at[end].After(at.Add(r.Window)); end++ {
+		start := sort.Search(end, func(j int) bool { return !w.at[j].Before(w.at[end].Add(-r.Window)) })
+		if aggregate := ruleAggregate(w.values[start:end+1], r.Aggregate); end == i || aggregate > peak {
+			peak, events = aggregate, end+1-start
+		}
+	}
+	return peak, events
+}
+
+func ruleAggregate(values []float64, aggregate RuleAggregate) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	result := values[0]
+	if aggregate == "" || aggregate == RuleCount || aggregate == RuleSum || aggregate == RuleAvg {
+		result = 0
+		for _, v := range values {
+			result += v
+		}
+	}
+	for _, v := range values[1:] {
+		switch {
+		case aggregate == RuleMax && v > result, aggregate == RuleMin && v < result:
+			result = v
+		}
+	}
+	if aggregate == RuleAvg {
+		result /= float64(len(values))
+	}
+	return result
+}
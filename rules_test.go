@@ -0,0 +1,168 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleEngine(t *testing.T) {
+	rules, err := pqstream.ParseRules([]byte(`
+rules:
+  - name: brute_force
+    channel: logins
+    when:
+      - path: data.outcome
+        value: failed
+    group_by: [data.user_id]
+    threshold: 2
+    window: 1m
+  - name: big_refunds
+    channel: refunds
+    when:
+      - path: data.amount
+        op: gte
+        value: 10
+    aggregate: sum
+    field: data.amount
+    threshold: 100
+    window: 1h
+    cooldown: 10m
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(rules) != 2 || rules[0].Window != time.Minute || rules[1].Cooldown != 10*time.Minute || rules[1].Aggregate != pqstream.RuleSum {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	clock := pqstream.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	engine, err := pqstream.NewRuleEngine(rules...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine.Clock = clock
+	var alerts []pqstream.RuleAlert
+	engine.OnAlert = func(alert pqstream.RuleAlert) {
+		alerts = append(alerts, alert)
+	}
+	var sent []*pq.Notification
+	engine.Sink = pqstream.NewSink("alerts", func(ctx context.Context, notification *pq.Notification) error {
+		sent = append(sent, notification)
+		return nil
+	})
+	login := func(user, outcome string) {
+		engine.Process(&pq.Notification{Channel: "logins", Extra: `{"data": {"user_id": ` + user + `, "outcome": "` + outcome + `"}}`})
+		clock.Advance(10 * time.Second)
+	}
+	login("1", "failed")
+	login("1", "failed")
+	login("11", "failed")
+	login("1", "ok")
+	if len(alerts) != 0 {
+		t.Fatalf("expected no alert at the threshold, got: %+v", alerts)
+	}
+	login("1", "failed")
+	if len(alerts) != 1 || alerts[0].Rule != "brute_force" || alerts[0].Value != 3 || alerts[0].Events != 3 || alerts[0].Group["data.user_id"] != json.Number("1") {
+		t.Fatalf("expected the third failure within a minute to alert, got: %+v", alerts)
+	}
+	if len(sent) != 1 || sent[0].Channel != "pqstream_alerts" || !strings.Contains(sent[0].Extra, `"rule":"brute_force"`) {
+		t.Fatalf("expected the alert to be sent to the alerts channel, got: %+v", sent)
+	}
+	//the group stays over the threshold but is cooling down
+	login("1", "failed")
+	if len(alerts) != 1 {
+		t.Fatalf("expected the cooldown to hold back a second alert, got: %+v", alerts)
+	}
+	//the first failures leave the window
+	clock.Advance(time.Minute)
+	login("1", "failed")
+	login("1", "failed")
+	if len(alerts) != 1 {
+		t.Fatalf("expected expired failures not to count, got: %+v", alerts)
+	}
+	login("1", "failed")
+	if len(alerts) != 2 {
+		t.Fatalf("expected a new alert once cooled down, got: %+v", alerts)
+	}
+
+	for _, amount := range []string{"60", "5", "50"} {
+		engine.Process(&pq.Notification{Channel: "refunds", Extra: `{"data": {"amount": ` + amount + `}}`})
+	}
+	if len(alerts) != 3 || alerts[2].Rule != "big_refunds" || alerts[2].Value != 110 || alerts[2].Events != 2 || alerts[2].Group != nil {
+		t.Fatalf("expected refunds of 10 or more summing over 100 to alert, got: %+v", alerts)
+	}
+
+	for _, bad := range []string{
+		"rules:\n  - name: r\n    threshold: 1\n",
+		"rules:\n  - name: r\n    window: 1m\n    aggregate: sum\n",
+		"rules:\n  - name: r\n    window: 1m\n    aggregate: p99\n    field: data.x\n",
+		"rules:\n  - name: r\n    window: 1m\n    when:\n      - path: data.x\n        op: gt\n        value: high\n",
+		"rules:\n  - name: r\n    window: soon\n",
+		"rules:\n  - name: r\n    window: 1m\n    treshold: 1\n",
+	} {
+		if _, err := pqstream.ParseRules([]byte(bad)); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRuleEngineEventTime(t *testing.T) {
+	engine, err := pqstream.NewRuleEngine(pqstream.Rule{Name: "bursts", Threshold: 2, Window: time.Minute})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	metrics := pqstream.NewMetrics()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	engine.Clock = pqstream.NewFakeClock(start)
+	engine.EventTime = true
+	engine.AllowedLateness = 30 * time.Second
+	engine.Collector = metrics
+	var alerts []pqstream.RuleAlert
+	engine.OnAlert = func(alert pqstream.RuleAlert) {
+		alerts = append(alerts, alert)
+	}
+	var late []string
+	engine.OnLate = func(n *pq.Notification) {
+		late = append(late, n.Extra)
+	}
+	emit := func(after time.Duration) string {
+		payload := `{"emitted_at": "` + start.Add(after).Format(time.RFC3339) + `", "data": {}}`
+		if err := engine.Process(&pq.Notification{Channel: "events", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+		return payload
+	}
+	//processed at the same time, but emitted more than a minute apart
+	emit(0)
+	emit(50 * time.Second)
+	emit(100 * time.Second)
+	if len(alerts) != 0 {
+		t.Fatalf("expected events to be windowed by when they were emitted, got: %+v", alerts)
+	}
+	//behind the watermark, 30s before the latest event
+	dropped := emit(40 * time.Second)
+	if len(late) != 1 || late[0] != dropped || len(alerts) != 0 {
+		t.Fatalf("expected the late event to be dropped, got late: %v, alerts: %+v", late, alerts)
+	}
+	//out of order but within the allowed lateness, it fills the window ending at the latest event
+	emit(80 * time.Second)
+	if len(alerts) != 1 || alerts[0].Events != 3 || alerts[0].Value != 3 {
+		t.Fatalf("expected the out of order event to complete a window, got: %+v", alerts)
+	}
+	if wm := engine.Watermark(); !wm.Watermark.Equal(start.Add(70*time.Second)) || wm.Late != 1 || wm.Events != 5 {
+		t.Fatalf("unexpected watermark: %+v", wm)
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`pqstream_late_events_total{operator="rules"} 1`, fmt.Sprintf(`pqstream_watermark_timestamp_seconds{operator="rules"} %d`, start.Add(70*time.Second).Unix())} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Fatalf("expected %s in metrics, got:\n%s", line, rec.Body.String())
+		}
+	}
+}
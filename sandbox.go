@@ -0,0 +1,207 @@
+package pqstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//ErrSandboxTimeout is returned by a sandboxed handler that exceeded its SandboxLimits.Timeout
+var ErrSandboxTimeout = errors.New("handler exceeded its sandbox time limit")
+
+//ErrSandboxCPU is returned by a CommandHandler whose process exceeded its SandboxLimits.CPUTime
+var ErrSandboxCPU = errors.New("handler exceeded its sandbox cpu limit")
+
+//commandStderrLimit bounds how much of a failed command's stderr its error includes
+const commandStderrLimit = 1024
+
+//SandboxLimits bound a single invocation of an untrusted handler
+type SandboxLimits struct {
+	//Timeout is the wall time an invocation may take. A ContextHandler's context is done once it passes and a CommandHandler's process is killed;
+	//other handlers can't be stopped, so the invocation is abandoned to finish in the background. Zero disables it
+	Timeout time.Duration
+	//CPUTime is the CPU time a CommandHandler's process may use, enforced with RLIMIT_CPU. Zero disables it
+	CPUTime time.Duration
+	//Memory is the address space in bytes a CommandHandler's process may use, enforced with RLIMIT_AS. Zero disables it
+	Memory int64
+}
+
+//A PanicError is a panic recovered from a sandboxed handler
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+//SandboxStats are a Sandbox's counters
+type SandboxStats struct {
+	Invocations uint64 `json:"invocations"`
+	Timeouts    uint64 `json:"timeouts"`
+	Panics      uint64 `json:"panics"`
+}
+
+//A Sandbox runs an untrusted or buggy handler so it can't take down the client: a panic is returned as a *PanicError and an invocation running past
+//its Timeout returns ErrSandboxTimeout. In-process handlers can only be bounded in time; run plugins and scripts as a CommandHandler to bound their
+//CPU time and memory too
+type Sandbox struct {
+	handler     Handler
+	limits      SandboxLimits
+	invocations uint64
+	timeouts    uint64
+	panics      uint64
+}
+
+//NewSandbox runs a handler within limits
+func NewSandbox(handler Handler, limits SandboxLimits) *Sandbox {
+	return &Sandbox{handler: handler, limits: limits}
+}
+
+//Name returns the sandboxed handler's name
+func (s *Sandbox) Name() string {
+	return "sandbox:" + nameOf(s.handler, "sandboxed", 0)
+}
+
+//Process runs the handler within its limits
+func (s *Sandbox) Process(notification *pq.Notification) error {
+	return s.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs the handler within its limits, passing a ContextHandler a context that is done once the Timeout passes
+func (s *Sandbox) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	atomic.AddUint64(&s.invocations, 1)
+	if s.limits.Timeout <= 0 {
+		return s.invoke(ctx, notification)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.limits.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.invoke(ctx, notification)
+	}()
+	select {
+	case err := <-done:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			atomic.AddUint64(&s.timeouts, 1)
+			return fmt.Errorf("%w after %s! %v", ErrSandboxTimeout, s.limits.Timeout, err)
+		}
+		return err
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ctx.Err()
+		}
+		atomic.AddUint64(&s.timeouts, 1)
+		return fmt.Errorf("%w after %s", ErrSandboxTimeout, s.limits.Timeout)
+	}
+}
+
+func (s *Sandbox) invoke(ctx context.Context, notification *pq.Notification) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&s.panics, 1)
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	if h, ok := s.handler.(ContextHandler); ok {
+		return h.ProcessContext(ctx, notification)
+	}
+	return s.handler.Process(notification)
+}
+
+//Stats returns the sandbox's counters
+func (s *Sandbox) Stats() SandboxStats {
+	return SandboxStats{
+		Invocations: atomic.LoadUint64(&s.invocations),
+		Timeouts:    atomic.LoadUint64(&s.timeouts),
+		Panics:      atomic.LoadUint64(&s.panics),
+	}
+}
+
+//A CommandHandler runs a plugin or script as a separate process per notification, so its crashes, CPU time and memory are isolated from the client.
+//The payload is written to the process's stdin and the channel and backend pid are set in PQSTREAM_CHANNEL and PQSTREAM_PID. A non-zero exit
+//fails the notification with the end of the process's stderr. CPU and memory limits are applied with ulimit, so they require a unix /bin/sh
+type CommandHandler struct {
+	//Path is the program to run
+	Path string
+	Args []string
+	//Env is added to the client's environment
+	Env []string
+	//Dir is the working directory. Defaults to the client's
+	Dir    string
+	Limits SandboxLimits
+}
+
+//Name returns the command's name
+func (h *CommandHandler) Name() string {
+	return "command:" + h.Path
+}
+
+//Process runs the command on a notification
+func (h *CommandHandler) Process(notification *pq.Notification) error {
+	return h.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext runs the command on a notification, killing it once the context is done or its Timeout passes
+func (h *CommandHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if h.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Limits.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, h.Path, h.Args...)
+	if limits := h.ulimits(); limits != "" {
+		//the shell sets the limits on itself, then replaces itself with the command so they apply to it and the kill on timeout reaches it
+		cmd = exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", limits + ` && exec "$0" "$@"`, h.Path}, h.Args...)...)
+	}
+	cmd.Dir = h.Dir
+	cmd.Env = append(append(os.Environ(), h.Env...), "PQSTREAM_CHANNEL="+notification.Channel, "PQSTREAM_PID="+strconv.Itoa(notification.BePid))
+	cmd.Stdin = strings.NewReader(notification.Extra)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(stderr.String())
+	if len(msg) > commandStderrLimit {
+		msg = msg[len(msg)-commandStderrLimit:]
+	}
+	switch state := cmd.ProcessState; {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) && h.Limits.Timeout > 0:
+		return fmt.Errorf("%w after %s! %s", ErrSandboxTimeout, h.Limits.Timeout, h.Path)
+	case state != nil && h.Limits.CPUTime > 0 && state.UserTime()+state.SystemTime() >= h.cpuLimit()*9/10:
+		return fmt.Errorf("%w of %s! %s", ErrSandboxCPU, h.Limits.CPUTime, h.Path)
+	case msg != "":
+		return fmt.Errorf("command %s failed! %s: %s", h.Path, err.Error(), msg)
+	}
+	return fmt.Errorf("command %s failed! %s", h.Path, err.Error())
+}
+
+//cpuLimit is the CPU time limit rounded up to the whole seconds RLIMIT_CPU takes
+func (h *CommandHandler) cpuLimit() time.Duration {
+	return (h.Limits.CPUTime + time.Second - 1).Truncate(time.Second)
+}
+
+//ulimits returns the shell commands applying the CPU and memory limits, in the units ulimit takes
+func (h *CommandHandler) ulimits() string {
+	var limits []string
+	if h.Limits.CPUTime > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", int64(h.cpuLimit()/time.Second)))
+	}
+	if mem := h.Limits.Memory; mem > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", (mem+1023)/1024))
+	}
+	return strings.Join(limits, " && ")
+}
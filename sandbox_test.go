@@ -0,0 +1,78 @@
+package pqstream_test
+
+import (
+	"context"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockingHandler struct{}
+
+func (blockingHandler) Process(notification *pq.Notification) error {
+	return blockingHandler{}.ProcessContext(context.Background(), notification)
+}
+
+func (blockingHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSandbox(t *testing.T) {
+	n := &pq.Notification{Channel: "users", Extra: "{}"}
+	panicking := pqstream.NewSandbox(pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+		panic("plugin bug")
+	}), pqstream.SandboxLimits{})
+	var panicked *pqstream.PanicError
+	if err := panicking.Process(n); !errors.As(err, &panicked) || panicked.Value != "plugin bug" || len(panicked.Stack) == 0 {
+		t.Fatalf("expected the panic to be returned, got: %v", err)
+	}
+	if stats := panicking.Stats(); stats.Panics != 1 || stats.Invocations != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	blocking := pqstream.NewSandbox(blockingHandler{}, pqstream.SandboxLimits{Timeout: 10 * time.Millisecond})
+	if err := blocking.Process(n); !errors.Is(err, pqstream.ErrSandboxTimeout) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	stuck := make(chan struct{})
+	defer close(stuck)
+	abandoned := pqstream.NewSandbox(pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+		<-stuck
+		return nil
+	}), pqstream.SandboxLimits{Timeout: 10 * time.Millisecond})
+	if err := abandoned.Process(n); !errors.Is(err, pqstream.ErrSandboxTimeout) || abandoned.Stats().Timeouts != 1 {
+		t.Fatalf("expected a handler that ignores its context to be abandoned, got: %v", err)
+	}
+	if name := abandoned.Name(); !strings.HasPrefix(name, "sandbox:") {
+		t.Fatalf("unexpected name: %s", name)
+	}
+}
+
+func TestCommandHandler(t *testing.T) {
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+	n := &pq.Notification{Channel: "users", BePid: 9, Extra: "hello"}
+	echo := &pqstream.CommandHandler{Path: "/bin/sh", Args: []string{"-c", `test "$(cat)" = hello && test "$PQSTREAM_CHANNEL" = users && test "$PQSTREAM_PID" = 9`}}
+	if err := echo.Process(n); err != nil {
+		t.Fatalf("expected the payload on stdin and the notification in the environment, got: %v", err)
+	}
+	failing := &pqstream.CommandHandler{Path: "/bin/sh", Args: []string{"-c", "echo invalid payload >&2; exit 3"}}
+	if err := failing.Process(n); err == nil || !strings.Contains(err.Error(), "invalid payload") {
+		t.Fatalf("expected the command's stderr in its error, got: %v", err)
+	}
+	slow := &pqstream.CommandHandler{Path: "/bin/sh", Args: []string{"-c", "sleep 10"}, Limits: pqstream.SandboxLimits{Timeout: 50 * time.Millisecond}}
+	started := time.Now()
+	if err := slow.Process(n); !errors.Is(err, pqstream.ErrSandboxTimeout) || time.Since(started) > 5*time.Second {
+		t.Fatalf("expected the command to be killed, got: %v", err)
+	}
+	spinning := &pqstream.CommandHandler{Path: "/bin/sh", Args: []string{"-c", "while :; do :; done"}, Limits: pqstream.SandboxLimits{CPUTime: time.Second, Memory: 64 << 20}}
+	if err := spinning.Process(n); !errors.Is(err, pqstream.ErrSandboxCPU) {
+		t.Fatalf("expected the command to exceed its cpu limit, got: %v", err)
+	}
+}
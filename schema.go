@@ -0,0 +1,155 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"sync"
+)
+
+//An Upconverter migrates a payload's data from one schema version to the next
+type Upconverter func(data json.RawMessage) (json.RawMessage, error)
+
+//A VersionedHandler is a Handler declaring the payload schema versions it supports
+type VersionedHandler interface {
+	Handler
+	Versions() []int
+}
+
+//UnsupportedVersionError is returned for a payload whose schema version a handler doesn't support and can't be upconverted to one it does
+type UnsupportedVersionError struct {
+	Channel   string
+	Version   int
+	Supported []int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported schema version %d on channel: %s, supported: %v", e.Version, e.Channel, e.Supported)
+}
+
+//SchemaVersions holds the upconverters of each channel's payload schema, so producers can be upgraded ahead of their consumers.
+//A payload's version is its envelope's Version, and payloads that aren't enveloped or don't set one are version 1
+type SchemaVersions struct {
+	mu           sync.RWMutex
+	upconverters map[string]map[int]Upconverter
+}
+
+//NewSchemaVersions returns an empty registry
+func NewSchemaVersions() *SchemaVersions {
+	return &SchemaVersions{upconverters: map[string]map[int]Upconverter{}}
+}
+
+//Register adds the upconverter of a channel's payloads from a version to the next
+func (s *SchemaVersions) Register(channel string, from int, up Upconverter) *SchemaVersions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.upconverters[channel] == nil {
+		s.upconverters[channel] = map[int]Upconverter{}
+	}
+	s.upconverters[channel][from] = up
+	return s
+}
+
+//Upconvert returns the notification with its payload migrated to the lowest supported version at or above its own, applying each registered upconverter in turn.
+//Upconverted envelopes keep their other fields with Data and Version replaced, while payloads that aren't enveloped are replaced entirely
+func (s *SchemaVersions) Upconvert(notification *pq.Notification, supported []int) (*pq.Notification, error) {
+	versions := append([]int{}, supported...)
+	sort.Ints(versions)
+	envelope, data, version := versionOf(notification)
+	target := -1
+	for _, v := range versions {
+		if v == version {
+			return notification, nil
+		}
+		if v > version && target < 0 {
+			target = v
+		}
+	}
+	unsupported := &UnsupportedVersionError{Channel: notification.Channel, Version: version, Supported: versions}
+	if target < 0 {
+		return nil, unsupported
+	}
+	s.mu.RLock()
+	upconverters := s.upconverters[notification.Channel]
+	s.mu.RUnlock()
+	for ; version < target; version++ {
+		up, ok := upconverters[version]
+		if !ok {
+			return nil, unsupported
+		}
+		var err error
+		if data, err = up(data); err != nil {
+			return nil, fmt.Errorf("failed to upconvert channel: %s from version %d! %s", notification.Channel, version, err.Error())
+		}
+	}
+	payload := []byte(data)
+	if envelope != nil {
+		envelope.Data, envelope.Version = data, target
+		encoded, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		payload = encoded
+	}
+	return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(payload)}, nil
+}
+
+//versionOf returns a notification's envelope, if it has one with data, along with the data and its schema version
+func versionOf(notification *pq.Notification) (*Envelope, json.RawMessage, int) {
+	if e := envelopeOf(notification); e != nil && len(e.Data) > 0 {
+		if e.Version == 0 {
+			return e, e.Data, 1
+		}
+		return e, e.Data, e.Version
+	}
+	return nil, json.RawMessage(notification.Extra), 1
+}
+
+type versionedHandler struct {
+	schemas    *SchemaVersions
+	handler    Handler
+	versions   []int
+	deadLetter Handler
+}
+
+//Versioned wraps a handler so it only sees payloads of the versions it supports: either the versions given or, without any, those it declares as a VersionedHandler.
+//Older payloads are upconverted, and payloads that can't be, ie: from a newer producer, go to the dead letter handler or fail with an *UnsupportedVersionError if it is nil
+func (s *SchemaVersions) Versioned(handler Handler, deadLetter Handler, versions ...int) Handler {
+	if len(versions) == 0 {
+		if v, ok := handler.(VersionedHandler); ok {
+			versions = v.Versions()
+		} else {
+			versions = []int{1}
+		}
+	}
+	return &versionedHandler{schemas: s, handler: handler, versions: versions, deadLetter: deadLetter}
+}
+
+func (v *versionedHandler) Name() string {
+	return nameOf(v.handler, "versioned", 0)
+}
+
+func (v *versionedHandler) Versions() []int {
+	return v.versions
+}
+
+func (v *versionedHandler) Process(notification *pq.Notification) error {
+	return v.ProcessContext(context.Background(), notification)
+}
+
+func (v *versionedHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	handler := v.handler
+	upconverted, err := v.schemas.Upconvert(notification, v.versions)
+	if err != nil {
+		if _, unsupported := err.(*UnsupportedVersionError); !unsupported || v.deadLetter == nil {
+			return err
+		}
+		handler, upconverted = v.deadLetter, notification
+	}
+	if h, ok := handler.(ContextHandler); ok {
+		return h.ProcessContext(ctx, upconverted)
+	}
+	return handler.Process(upconverted)
+}
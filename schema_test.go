@@ -0,0 +1,64 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+type v3Handler struct {
+	seen []string
+}
+
+func (h *v3Handler) Process(notification *pq.Notification) error {
+	h.seen = append(h.seen, notification.Extra)
+	return nil
+}
+
+func (h *v3Handler) Versions() []int {
+	return []int{3}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	schemas := pqstream.NewSchemaVersions().
+		Register("users", 1, func(data json.RawMessage) (json.RawMessage, error) {
+			return json.RawMessage(strings.Replace(string(data), `"name"`, `"full_name"`, 1)), nil
+		}).
+		Register("users", 2, func(data json.RawMessage) (json.RawMessage, error) {
+			return json.RawMessage(strings.Replace(string(data), "}", `,"v":3}`, 1)), nil
+		})
+	handler, dead := &v3Handler{}, &v3Handler{}
+	versioned := schemas.Versioned(handler, dead)
+	for _, payload := range []string{
+		`{"name":"bob"}`,
+		`{"id":"1","emitted_at":"2020-01-02T15:04:05Z","version":2,"data":{"full_name":"bob"}}`,
+		`{"id":"2","emitted_at":"2020-01-02T15:04:05Z","version":3,"data":{"x":1}}`,
+		`{"id":"3","emitted_at":"2020-01-02T15:04:05Z","version":4,"data":{"x":1}}`,
+	} {
+		if err := versioned.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(handler.seen) != 3 || handler.seen[0] != `{"full_name":"bob","v":3}` || handler.seen[2] != `{"id":"2","emitted_at":"2020-01-02T15:04:05Z","version":3,"data":{"x":1}}` {
+		t.Fatalf("unexpected upconverted payloads: %v", handler.seen)
+	}
+	e, err := pqstream.ParseEnvelope(&pq.Notification{Extra: handler.seen[1]})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.ID != "1" || e.Version != 3 || string(e.Data) != `{"full_name":"bob","v":3}` {
+		t.Fatalf("unexpected upconverted envelope: %+v", e)
+	}
+	if len(dead.seen) != 1 || !strings.Contains(dead.seen[0], `"version":4`) {
+		t.Fatalf("expected the newer version to be dead lettered, got: %v", dead.seen)
+	}
+
+	err = schemas.Versioned(handler, nil, 2).Process(&pq.Notification{Channel: "orders", Extra: `{"x":1}`})
+	var unsupported *pqstream.UnsupportedVersionError
+	if !errors.As(err, &unsupported) || unsupported.Version != 1 {
+		t.Fatalf("expected an unsupported version error without an upconverter, got: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+)
+
+//An Execer runs statements, ie: a *sql.DB, *sql.Conn or *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//A SearchIndex declares the text columns of a table that make up its full-text search document
+type SearchIndex struct {
+	//Table is the schema qualified or bare table, matched like KeyRegistry
+	Table string
+	//Fields maps each text column to its weight, A through D
+	Fields map[string]string
+	//Column is a tsvector column of Table kept up to date in place. Empty writes documents to the indexer's SearchTable instead
+	Column string
+	//Config is the text search configuration. Defaults to english
+	Config string
+}
+
+func (s SearchIndex) config() string {
+	if s.Config == "" {
+		return "english"
+	}
+	return s.Config
+}
+
+func (s SearchIndex) validate() error {
+	if s.Table == "" || len(s.Fields) == 0 {
+		return errors.New("search index requires a table and fields")
+	}
+	for field, weight := range s.Fields {
+		switch weight {
+		case "A", "B", "C", "D":
+		default:
+			return fmt.Errorf("invalid weight for search field %s.%s: %q", s.Table, field, weight)
+		}
+	}
+	return nil
+}
+
+//A SearchIndexer is a Handler maintaining Postgres native full-text search from change events: for each changed row of an indexed table it recomputes the
+//weighted tsvector of its fields, either into a tsvector column of the row itself or into a dedicated search table keyed by table and primary key.
+//Updates that don't change an indexed field are skipped, so the indexer's own in-place updates don't feed back into it
+type SearchIndexer struct {
+	DB      Execer
+	Keys    *KeyRegistry
+	Indexes []SearchIndex
+	//SearchTable is the optionally schema qualified table documents are written to for indexes without a Column. Defaults to pqstream_search
+	SearchTable string
+}
+
+func (s *SearchIndexer) table() string {
+	if s.SearchTable == "" {
+		return "pqstream_search"
+	}
+	return s.SearchTable
+}
+
+//Name returns the handler's name
+func (s *SearchIndexer) Name() string {
+	return "search_indexer"
+}
+
+//Setup creates the search table and its GIN index if they don't exist
+func (s *SearchIndexer) Setup(ctx context.Context) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	table := quoteQualified(s.table())
+	ddl := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	source text NOT NULL,
+	key text NOT NULL,
+	document tsvector NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (source, key)
+)`, table)
+	if _, err := s.DB.ExecContext(ctx, ddl); err != nil {
+		return fmt.Errorf("failed to create search table! %s", err.Error())
+	}
+	index := pq.QuoteIdentifier(strings.ReplaceAll(s.table(), ".", "_") + "_document_idx")
+	if _, err := s.DB.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (document)", index, table)); err != nil {
+		return fmt.Errorf("failed to create search index! %s", err.Error())
+	}
+	return nil
+}
+
+//Process indexes a change event
+func (s *SearchIndexer) Process(notification *pq.Notification) error {
+	return s.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext indexes a change event. Payloads that aren't change events and tables without an index are ignored
+func (s *SearchIndexer) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	e, err := ParseChange(notification)
+	if err != nil {
+		return nil
+	}
+	index, ok := s.index(e)
+	if !ok {
+		return nil
+	}
+	if err := index.validate(); err != nil {
+		return err
+	}
+	fields := sortedKeys(index.Fields)
+	if e.Op == OpUpdate && !e.Changed(fields...) {
+		return nil
+	}
+	if skipDryRun(ctx, s.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	if s.Keys == nil {
+		return errors.New("search indexer requires a key registry")
+	}
+	columns, _ := s.Keys.Columns(e)
+	keys, err := s.Keys.KeyValues(e)
+	if err != nil {
+		return err
+	}
+	if index.Column != "" {
+		if e.Op == OpDelete {
+			return nil
+		}
+		args := []interface{}{index.config()}
+		document := searchDocument(index, fields, e.New, &args)
+		where := make([]string, len(columns))
+		for i, column := range columns {
+			args = append(args, keys[i])
+			where[i] = fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), len(args))
+		}
+		_, err := s.DB.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s", quoteQualified(e.QualifiedTable()), pq.QuoteIdentifier(index.Column), document, strings.Join(where, " AND ")), args...)
+		if err != nil {
+			return fmt.Errorf("failed to update search column of %s! %s", e.QualifiedTable(), err.Error())
+		}
+		return nil
+	}
+	key, err := s.Keys.Key(e)
+	if err != nil {
+		return err
+	}
+	if e.Op == OpDelete {
+		_, err := s.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE source = $1 AND key = $2", quoteQualified(s.table())), e.QualifiedTable(), key)
+		if err != nil {
+			return fmt.Errorf("failed to delete search document of %s! %s", e.QualifiedTable(), err.Error())
+		}
+		return nil
+	}
+	args := []interface{}{index.config(), e.QualifiedTable(), key}
+	document := searchDocument(index, fields, e.New, &args)
+	_, err = s.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (source, key, document) VALUES ($2, $3, %s)
+ON CONFLICT (source, key) DO UPDATE SET document = EXCLUDED.document, updated_at = now()`, quoteQualified(s.table()), document), args...)
+	if err != nil {
+		return fmt.Errorf("failed to write search document of %s! %s", e.QualifiedTable(), err.Error())
+	}
+	return nil
+}
+
+func (s *SearchIndexer) index(e *ChangeEvent) (SearchIndex, bool) {
+	for _, index := range s.Indexes {
+		if index.Table == e.QualifiedTable() || index.Table == e.Table {
+			return index, true
+		}
+	}
+	return SearchIndex{}, false
+}
+
+//searchDocument returns the weighted tsvector expression of a row's fields, appending its values to args. The text search config is always $1
+func searchDocument(index SearchIndex, fields []string, row Row, args *[]interface{}) string {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		var value interface{}
+		if v, ok := row[field]; ok && v != nil {
+			value = fmt.Sprint(v)
+		}
+		*args = append(*args, value)
+		parts[i] = fmt.Sprintf("setweight(to_tsvector($1::regconfig, coalesce($%d::text, '')), '%s')", len(*args), index.Fields[field])
+	}
+	return strings.Join(parts, " || ")
+}
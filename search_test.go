@@ -0,0 +1,83 @@
+package pqstream_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+type execRecorder struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (e *execRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	e.args = append(e.args, args)
+	return nil, nil
+}
+
+func TestSearchIndexerColumn(t *testing.T) {
+	db := &execRecorder{}
+	indexer := &pqstream.SearchIndexer{
+		DB:   db,
+		Keys: pqstream.NewKeyRegistry().Register("articles", "id"),
+		Indexes: []pqstream.SearchIndex{
+			{Table: "public.articles", Column: "search", Fields: map[string]string{"title": "A", "body": "B"}},
+		},
+	}
+	for _, payload := range []string{
+		`{"schema": "public", "table": "articles", "op": "INSERT", "new": {"id": 1, "title": "hello", "body": "world"}}`,
+		`{"schema": "public", "table": "articles", "op": "UPDATE", "old": {"id": 1, "title": "hello", "body": "world", "search": "a"}, "new": {"id": 1, "title": "hello", "body": "world", "search": "b"}}`,
+		`{"schema": "public", "table": "articles", "op": "DELETE", "old": {"id": 1}}`,
+		`{"schema": "public", "table": "comments", "op": "INSERT", "new": {"id": 1}}`,
+		`{"id": 1}`,
+	} {
+		if err := indexer.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(db.queries) != 1 {
+		t.Fatalf("expected a single update, got: %v", db.queries)
+	}
+	want := `UPDATE "public"."articles" SET "search" = setweight(to_tsvector($1::regconfig, coalesce($2::text, '')), 'B') || setweight(to_tsvector($1::regconfig, coalesce($3::text, '')), 'A') WHERE "id" = $4`
+	if db.queries[0] != want {
+		t.Fatalf("unexpected query: %s", db.queries[0])
+	}
+	if args := db.args[0]; len(args) != 4 || args[0] != "english" || args[1] != "world" || args[2] != "hello" {
+		t.Fatalf("unexpected args: %v", args)
+	}
+}
+
+func TestSearchIndexerTable(t *testing.T) {
+	db := &execRecorder{}
+	indexer := &pqstream.SearchIndexer{
+		DB:   db,
+		Keys: pqstream.NewKeyRegistry().Register("articles", "id"),
+		Indexes: []pqstream.SearchIndex{
+			{Table: "articles", Config: "simple", Fields: map[string]string{"title": "A"}},
+		},
+	}
+	for _, payload := range []string{
+		`{"table": "articles", "op": "UPDATE", "old": {"id": 1, "title": "a"}, "new": {"id": 1, "title": "b"}}`,
+		`{"table": "articles", "op": "DELETE", "old": {"id": 1, "title": "b"}}`,
+	} {
+		if err := indexer.Process(&pq.Notification{Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(db.queries) != 2 || !strings.HasPrefix(db.queries[0], `INSERT INTO "pqstream_search"`) || !strings.HasPrefix(db.queries[1], `DELETE FROM "pqstream_search"`) {
+		t.Fatalf("unexpected queries: %v", db.queries)
+	}
+	if args := db.args[0]; len(args) != 4 || args[0] != "simple" || args[1] != "articles" || args[2] != "1" || args[3] != "b" {
+		t.Fatalf("unexpected args: %v", args)
+	}
+
+	indexer.Indexes[0].Fields["title"] = "E"
+	if err := indexer.Process(&pq.Notification{Extra: `{"table": "articles", "op": "INSERT", "new": {"id": 2}}`}); err == nil {
+		t.Fatal("expected an error for an invalid weight")
+	}
+}
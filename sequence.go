@@ -0,0 +1,98 @@
+package pqstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+//gapCatchupTimeout bounds a HandlerSet.GapCatchup, which holds back the dispatcher while it runs
+const gapCatchupTimeout = 10 * time.Second
+
+//A Gap is a run of sequence numbers missing from a channel, ie: notifications lost while the client was disconnected. After is the last sequence number
+//received before the gap and Next the one received after it
+type Gap struct {
+	Channel string `json:"channel"`
+	After   int64  `json:"after"`
+	Next    int64  `json:"next"`
+}
+
+//Missed returns the number of notifications missing in the gap
+func (g Gap) Missed() int64 {
+	return g.Next - g.After - 1
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("missed %d notifications on channel: %s between sequence %d and %d", g.Missed(), g.Channel, g.After, g.Next)
+}
+
+//GapHandlerFunc is called when a gap is detected in a channel's sequence numbers, ie: to start a catch-up from an outbox or audit table
+type GapHandlerFunc func(gap Gap)
+
+//GapCatchupFunc returns the notifications missing in a gap, in order, ie: read from an audit table, so the client processes them ahead of the notification after the gap
+type GapCatchupFunc func(ctx context.Context, gap Gap) ([]*pq.Notification, error)
+
+//sequenceUpsert is the SQL assigning a channel, given as a SQL expression, its next sequence number from a sequence table of the library's migrations, returning it as seq
+func sequenceUpsert(table, channel string) string {
+	return fmt.Sprintf("INSERT INTO %s AS s (channel, seq) VALUES (%s, 1) ON CONFLICT ON CONSTRAINT %s DO UPDATE SET seq = s.seq + 1 RETURNING s.seq",
+		quoteQualified(table), channel, pq.QuoteIdentifier(unqualified(table)+"_pkey"))
+}
+
+//sequence records an enveloped notification's sequence number, returning the gap before it if any. The first sequence number seen on a channel only sets its baseline,
+//and numbers at or below the last one, ie: from a replay, are ignored
+func (s *channelStats) sequence(channel string, seq int64) (Gap, bool) {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	last := s.lastSeq
+	if seq <= last {
+		return Gap{}, false
+	}
+	s.lastSeq = seq
+	if last == 0 || seq == last+1 {
+		return Gap{}, false
+	}
+	gap := Gap{Channel: channel, After: last, Next: seq}
+	s.gaps++
+	s.missed += uint64(gap.Missed())
+	return gap, true
+}
+
+//sequenced observes a notification's sequence number as it arrives, before it is queued, since lanes may process a channel's notifications concurrently
+//and out of order. It returns the notifications the GapCatchup recovered from a gap before it, to be processed first. Payloads that can't carry a sequence number skip decoding
+func (c *Client) sequenced(n *pq.Notification) []*pq.Notification {
+	if !strings.Contains(n.Extra, `"seq"`) {
+		return nil
+	}
+	return c.observeSequence(n.Channel, c.stats.channel(n.Channel), envelopeOf(n))
+}
+
+//observeSequence detects gaps in a channel's sequence numbers, reporting each one to the GapHandler and catching it up with the GapCatchup
+func (c *Client) observeSequence(channel string, stats *channelStats, envelope *Envelope) []*pq.Notification {
+	if envelope == nil || envelope.Seq <= 0 {
+		return nil
+	}
+	gap, ok := stats.sequence(channel, envelope.Seq)
+	if !ok {
+		return nil
+	}
+	if c.config.Verbose {
+		c.logf("%s", gap)
+	}
+	c.debugf(channel, "%s", gap)
+	if c.handlers.GapHandler != nil {
+		c.handlers.GapHandler(gap)
+	}
+	if c.handlers.GapCatchup == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gapCatchupTimeout)
+	defer cancel()
+	missed, err := c.handlers.GapCatchup(ctx, gap)
+	if err != nil {
+		c.handleErr(channel, fmt.Errorf("failed to catch up channel: %s after gap! %s", channel, err.Error()))
+		return nil
+	}
+	return missed
+}
@@ -0,0 +1,83 @@
+package pqstream_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestSequenceGaps(t *testing.T) {
+	var gaps []pqstream.Gap
+	handlerSet := &pqstream.HandlerSet{
+		Handlers:   []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+		GapHandler: func(gap pqstream.Gap) { gaps = append(gaps, gap) },
+	}
+	client, err := pqstream.NewClient([]string{"orders"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, seq := range []int{5, 6, 9, 7, 10, 13} {
+		client.Process(&pq.Notification{Channel: "orders", Extra: fmt.Sprintf(`{"seq": %d, "data": {}}`, seq)})
+	}
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{"id": 1}`})
+	if len(gaps) != 2 || gaps[0] != (pqstream.Gap{Channel: "orders", After: 6, Next: 9}) || gaps[1].Missed() != 2 {
+		t.Fatalf("unexpected gaps: %v", gaps)
+	}
+	stats := client.Stats().Channels["orders"]
+	if stats.Gaps != 2 || stats.Missed != 4 || stats.LastSeq != 13 {
+		t.Fatalf("unexpected gap stats: %+v", stats)
+	}
+}
+
+func TestGapCatchup(t *testing.T) {
+	var processed []string
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			processed = append(processed, notification.Extra)
+			return nil
+		})},
+		GapCatchup: func(ctx context.Context, gap pqstream.Gap) ([]*pq.Notification, error) {
+			var missed []*pq.Notification
+			for seq := gap.After + 1; seq < gap.Next; seq++ {
+				missed = append(missed, &pq.Notification{Channel: gap.Channel, Extra: fmt.Sprintf(`{"seq":%d}`, seq)})
+			}
+			return missed, nil
+		},
+	}
+	client, err := pqstream.NewClient([]string{"orders"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, seq := range []int{1, 4} {
+		client.Process(&pq.Notification{Channel: "orders", Extra: fmt.Sprintf(`{"seq":%d}`, seq)})
+	}
+	if fmt.Sprint(processed) != `[{"seq":1} {"seq":2} {"seq":3} {"seq":4}]` {
+		t.Fatalf("expected the gap to be caught up in order, got: %v", processed)
+	}
+}
+
+func TestNotifySequence(t *testing.T) {
+	recorder := &execRecorder{}
+	if err := pqstream.NotifyWith(context.Background(), recorder, "orders", "", "hello", pqstream.NotifyOptions{SequenceTable: "pqstream_sequences"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(recorder.queries) != 1 || recorder.queries[0] != `WITH s AS (INSERT INTO "pqstream_sequences" AS s (channel, seq) VALUES ($1, 1) ON CONFLICT ON CONSTRAINT "pqstream_sequences_pkey" DO UPDATE SET seq = s.seq + 1 RETURNING s.seq) SELECT pg_notify($1, '{"seq":' || s.seq || ',' || substr($2, 2)) FROM s` {
+		t.Fatalf("expected the notification to be assigned a sequence number, got: %v", recorder.queries)
+	}
+	up := (pqstream.TriggerSpec{Table: "orders", SequenceTable: "pqstream_sequences"}).Up()
+	for _, want := range []string{
+		`INSERT INTO "pqstream_sequences" AS s (channel, seq) VALUES ('orders', 1)`,
+		`RETURNING s.seq INTO assigned;`,
+		`'seq', assigned,`,
+	} {
+		if !strings.Contains(up, want) {
+			t.Fatalf("expected trigger sql to contain %s, got:\n%s", want, up)
+		}
+	}
+	if up := (pqstream.TriggerSpec{Table: "orders"}).Up(); strings.Contains(up, "pqstream_sequences") || strings.Contains(up, "'seq'") {
+		t.Fatalf("expected a spec without a sequence table to send no sequence numbers, got:\n%s", up)
+	}
+}
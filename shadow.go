@@ -0,0 +1,124 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+//A NotifySink re-publishes notifications unchanged with pg_notify, ie: to mirror production traffic into a staging database
+type NotifySink struct {
+	DB *sql.DB
+	//Channel is the channel notifications are sent to. Defaults to the channel they were received on
+	Channel string
+	//Marshaler encodes the payload sent. Defaults to RawMarshaler
+	Marshaler Marshaler
+	//Clock is the source of receive times passed to the Marshaler. Defaults to SystemClock
+	Clock Clock
+}
+
+//Name returns the sink's name
+func (s *NotifySink) Name() string {
+	return "notify"
+}
+
+//Send publishes the notification's payload
+func (s *NotifySink) Send(ctx context.Context, notification *pq.Notification) error {
+	if skipDryRun(ctx, s.Name(), notification) {
+		return nil
+	}
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	channel := s.Channel
+	if channel == "" {
+		channel = notification.Channel
+	}
+	payload := []byte(notification.Extra)
+	if s.Marshaler != nil {
+		var err error
+		if payload, err = s.Marshaler.Marshal(notification, clockOr(s.Clock).Now()); err != nil {
+			return err
+		}
+	}
+	if _, err := s.DB.ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify channel: %s! %s", channel, err.Error())
+	}
+	return nil
+}
+
+//ShadowOptions configures a ShadowSink
+type ShadowOptions struct {
+	//Rate is the fraction (0, 1] of notifications mirrored. Defaults to 1
+	Rate float64
+	//Buffer configures the buffer ahead of the mirrored sink. A Block drop policy is replaced with DropNewest so mirroring never applies backpressure
+	Buffer BufferOptions
+}
+
+//ShadowStats are a ShadowSink's counters
+type ShadowStats struct {
+	Mirrored uint64      `json:"mirrored"`
+	Skipped  uint64      `json:"skipped"`
+	Buffer   BufferStats `json:"buffer"`
+}
+
+//A ShadowSink mirrors a fraction of notifications to another sink, ie: a NotifySink pointed at a staging database, for realistic pre-production testing.
+//Mirroring is asynchronous and best effort: a shadow never blocks, never fails the pipeline it is part of and never holds back its checkpoint.
+//Sampling hashes the channel and payload, so the same notification is always either mirrored or skipped
+type ShadowSink struct {
+	buffered  *BufferedSink
+	threshold uint32
+	mirrored  uint64
+	skipped   uint64
+}
+
+//NewShadowSink starts mirroring to the sink
+func NewShadowSink(sink Sink, opts ShadowOptions) *ShadowSink {
+	if opts.Rate <= 0 || opts.Rate > 1 {
+		opts.Rate = 1
+	}
+	if opts.Buffer.Drop == Block {
+		opts.Buffer.Drop = DropNewest
+	}
+	return &ShadowSink{
+		buffered:  NewBufferedSink(sink, opts.Buffer),
+		threshold: uint32(opts.Rate * float64(^uint32(0))),
+	}
+}
+
+//Name returns the mirrored sink's name
+func (s *ShadowSink) Name() string {
+	return "shadow:" + s.buffered.Name()
+}
+
+//Send enqueues a sampled notification for mirroring. Errors are reported to the buffer's OnError rather than returned
+func (s *ShadowSink) Send(ctx context.Context, notification *pq.Notification) error {
+	h := fnv.New32a()
+	h.Write([]byte(notification.Channel))
+	h.Write([]byte(notification.Extra))
+	if h.Sum32() > s.threshold {
+		atomic.AddUint64(&s.skipped, 1)
+		return nil
+	}
+	if err := s.buffered.Send(ctx, notification); err == nil {
+		atomic.AddUint64(&s.mirrored, 1)
+	}
+	return nil
+}
+
+//Stats returns the shadow's counters
+func (s *ShadowSink) Stats() ShadowStats {
+	return ShadowStats{
+		Mirrored: atomic.LoadUint64(&s.mirrored),
+		Skipped:  atomic.LoadUint64(&s.skipped),
+		Buffer:   s.buffered.Stats(),
+	}
+}
+
+//Close stops mirroring and waits for buffered notifications to be delivered or the context to expire
+func (s *ShadowSink) Close(ctx context.Context) error {
+	return s.buffered.Close(ctx)
+}
@@ -0,0 +1,56 @@
+package pqstream_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestShadowSink(t *testing.T) {
+	release := make(chan struct{})
+	staging := pqstream.NewSink("staging", func(ctx context.Context, n *pq.Notification) error {
+		<-release
+		return fmt.Errorf("staging is down")
+	})
+	shadow := pqstream.NewShadowSink(staging, pqstream.ShadowOptions{Rate: 0.5, Buffer: pqstream.BufferOptions{Size: 1000, Drop: pqstream.Block}})
+	production := &recordingSink{name: "production"}
+	var checkpointed int
+	p := pqstream.NewPipeline().FanOut(production, shadow).Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+		checkpointed++
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := p.Process(&pq.Notification{Channel: "users", Extra: fmt.Sprint(i)}); err != nil {
+				t.Error(err.Error())
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled shadow blocked production")
+	}
+	if len(production.payloads()) != 1000 || checkpointed != 1000 {
+		t.Fatalf("expected production to see every notification, got %d and %d checkpoints", len(production.payloads()), checkpointed)
+	}
+	stats := shadow.Stats()
+	if stats.Mirrored+stats.Skipped != 1000 || stats.Mirrored < 400 || stats.Mirrored > 600 {
+		t.Fatalf("expected about half of the notifications to be mirrored: %+v", stats)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shadow.Close(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	if failed := shadow.Stats().Buffer.Failed; failed != stats.Mirrored {
+		t.Fatalf("expected every mirrored send to fail without affecting production, got %d", failed)
+	}
+}
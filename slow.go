@@ -0,0 +1,94 @@
+package pqstream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//slowReportInterval is the least time between two reports of the same slow handler, so a handler slowing down on every notification doesn't flood the logs
+const slowReportInterval = time.Second
+
+//A SlowHandlerReport describes a handler that took longer than its threshold to process a notification. Fingerprint identifies the payload without revealing it,
+//so the notifications a handler is slow on can be matched across reports and systems. Suppressed is the number of the handler's slow calls not reported since its last report
+type SlowHandlerReport struct {
+	Handler     string        `json:"handler"`
+	Channel     string        `json:"channel"`
+	Duration    time.Duration `json:"duration"`
+	Threshold   time.Duration `json:"threshold"`
+	PID         int           `json:"pid"`
+	Fingerprint string        `json:"fingerprint"`
+	Suppressed  int           `json:"suppressed,omitempty"`
+}
+
+//SlowHandlerFunc is called with a report when a handler exceeds its slow handler threshold, at most once a second per handler
+type SlowHandlerFunc func(report SlowHandlerReport)
+
+//slowHandlers samples the reports of slow handlers
+type slowHandlers struct {
+	mu         sync.Mutex
+	reported   map[string]time.Time
+	suppressed map[string]int
+}
+
+//payloadFingerprint returns a short stable hash of a payload
+func payloadFingerprint(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:8])
+}
+
+//slowThreshold returns the duration above which a handler is slow, zero if it is never reported
+func (c *Client) slowThreshold(handler string) time.Duration {
+	if d, ok := c.config.SlowHandlerThresholds[handler]; ok {
+		return d
+	}
+	return c.config.SlowHandlerThreshold
+}
+
+//observeSlow reports a handler call that exceeded its threshold to the SlowHandler, or logs a warning if there is none, and publishes an EventHandlerSlow
+func (c *Client) observeSlow(handler string, notification *pq.Notification, d time.Duration) {
+	channel := notification.Channel
+	threshold := c.slowThreshold(handler)
+	if threshold <= 0 || d <= threshold {
+		return
+	}
+	c.stats.sink(handler).slow()
+	now := c.config.Clock.Now()
+	c.slow.mu.Lock()
+	if c.slow.reported == nil {
+		c.slow.reported, c.slow.suppressed = map[string]time.Time{}, map[string]int{}
+	}
+	if last, ok := c.slow.reported[handler]; ok && now.Sub(last) < slowReportInterval {
+		c.slow.suppressed[handler]++
+		c.slow.mu.Unlock()
+		return
+	}
+	suppressed := c.slow.suppressed[handler]
+	c.slow.reported[handler] = now
+	delete(c.slow.suppressed, handler)
+	c.slow.mu.Unlock()
+	report := SlowHandlerReport{
+		Handler:     handler,
+		Channel:     channel,
+		Duration:    d,
+		Threshold:   threshold,
+		PID:         notification.BePid,
+		Fingerprint: c.fingerprint(notification),
+		Suppressed:  suppressed,
+	}
+	c.events.publish(Event{Type: EventHandlerSlow, Channel: channel, Time: now, Handler: handler, Duration: d})
+	if c.handlers.SlowHandler != nil {
+		c.handlers.SlowHandler(report)
+		return
+	}
+	c.logAt(LevelWarn, map[string]any{
+		"handler":     handler,
+		"channel":     channel,
+		"duration":    d.String(),
+		"threshold":   threshold.String(),
+		"fingerprint": report.Fingerprint,
+		"suppressed":  suppressed,
+	}, "slow handler: %s took %s on channel: %s (threshold %s, payload %s, %d more suppressed)", handler, d, channel, threshold, report.Fingerprint, suppressed)
+}
@@ -0,0 +1,68 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowHandler(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	var (
+		mu      sync.Mutex
+		reports []pqstream.SlowHandlerReport
+	)
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				clock.Advance(300 * time.Millisecond)
+				return nil
+			}),
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil }),
+		},
+		SlowHandler: func(report pqstream.SlowHandlerReport) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, report)
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{
+		Clock:                 clock,
+		Workers:               1,
+		SlowHandlerThreshold:  time.Second,
+		SlowHandlerThresholds: map[string]time.Duration{"main[0](pqstream.HandlerFunc)": 100 * time.Millisecond},
+	}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	events, cancel := client.Events(0)
+	defer cancel()
+	//one report a second per handler: each call takes 300ms, so the next three are suppressed until the fifth, over a second after the first
+	for i := 0; i < 5; i++ {
+		client.Process(&pq.Notification{Channel: "users", BePid: i, Extra: `{"id": 1}`})
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected the handler over its own threshold to be reported twice, got: %+v", reports)
+	}
+	first := reports[0]
+	if first.Handler != "main[0](pqstream.HandlerFunc)" || first.Channel != "users" || first.Duration < 300*time.Millisecond || first.Threshold != 100*time.Millisecond {
+		t.Fatalf("unexpected report: %+v", first)
+	}
+	if first.Fingerprint == "" || first.Fingerprint != reports[1].Fingerprint {
+		t.Fatalf("expected the same payload to have the same fingerprint, got: %+v", reports)
+	}
+	if reports[1].Suppressed != 3 || reports[1].PID != 4 {
+		t.Fatalf("expected the suppressed calls to be counted, got: %+v", reports[1])
+	}
+	if e := <-events; e.Type != pqstream.EventHandlerSlow || e.Duration < 300*time.Millisecond {
+		t.Fatalf("expected a slow handler event, got: %+v", e)
+	}
+	if sink := client.Stats().Sinks["main[0](pqstream.HandlerFunc)"]; sink.Slow != 5 {
+		t.Fatalf("expected every slow call to be counted, got: %+v", sink)
+	}
+	if e := client.EffectiveConfig(); e.SlowHandlerThreshold != "1s" || e.SlowHandlerThresholds["main[0](pqstream.HandlerFunc)"] != "100ms" {
+		t.Fatalf("unexpected effective config: %+v", e)
+	}
+}
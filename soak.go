@@ -0,0 +1,519 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A SoakEvent is the traffic a soak test publishes, numbered so the harness can tell which events were lost or duplicated
+type SoakEvent struct {
+	//Run identifies the soak test, so events left over from earlier runs, ie: caught up from an Outbox, are ignored
+	Run     string    `json:"run"`
+	Seq     int64     `json:"seq"`
+	SentAt  time.Time `json:"sent_at"`
+	Padding string    `json:"padding,omitempty"`
+}
+
+//A SoakTarget is the system a soak test publishes to, consumes from and injects faults into
+type SoakTarget interface {
+	Publish(ctx context.Context, event SoakEvent) error
+	//Start starts a consumer running handler on every event it receives, returning once it is ready, with a function shutting it down
+	Start(ctx context.Context, handler Handler) (stop func(ctx context.Context) error, err error)
+	//Kill abruptly terminates the consumer's connections, returning how many were terminated
+	Kill(ctx context.Context) (int, error)
+}
+
+//SoakOptions configures a soak test
+type SoakOptions struct {
+	//Channel is the channel traffic is published to and listened on. Defaults to pqstream_soak
+	Channel string
+	//Rate is the target number of events per second. Defaults to 100
+	Rate int
+	//PayloadSize is the approximate size in bytes of each event's padding. Defaults to none
+	PayloadSize int
+	//Duration is how long traffic is produced for. Defaults to 10 minutes
+	Duration time.Duration
+	//KillEvery is the mean interval between killing the consumer's connections, at random. Defaults to 30 seconds, negative never kills them
+	KillEvery time.Duration
+	//RestartEvery is the mean interval between shutting the consumer down and starting a new one, at random. Defaults to 2 minutes, negative never restarts it
+	RestartEvery time.Duration
+	//Settle is how long an event may take to be delivered, including across kills and restarts, before it is counted lost. Defaults to 30 seconds
+	Settle time.Duration
+	//ReportEvery is the interval between progress reports passed to OnReport. Defaults to 10 seconds
+	ReportEvery time.Duration
+	//OnReport is called with the verification so far every ReportEvery, ie: to print progress
+	OnReport func(report *SoakReport)
+	//Seed seeds the fault schedule, so a run that found a violation can be repeated. Defaults to the time
+	Seed int64
+	//Handler optionally runs on every event the consumer receives. Its errors are returned to the client, so they are retried as the delivery mode allows
+	Handler Handler
+	//Target is the system under test. Defaults to a client made from the config, publishing through its Outbox if it has one and pg_notify otherwise, and
+	//killing its listener's backend with pg_terminate_backend, which requires superuser or pg_signal_backend
+	Target SoakTarget
+}
+
+//SoakReport is the verification of a soak test's invariants against its delivery mode: at least once delivery may duplicate events but must not lose any,
+//and at most once delivery may lose events but must not duplicate any
+type SoakReport struct {
+	Run      string        `json:"run"`
+	Delivery Delivery      `json:"delivery"`
+	Seed     int64         `json:"seed"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Sent     int           `json:"sent"`
+	//PublishErrors are the events that failed to publish, which aren't expected to be received
+	PublishErrors int `json:"publish_errors"`
+	//Received are the distinct events received
+	Received   int `json:"received"`
+	Duplicates int `json:"duplicates"`
+	//Lost are the events sent longer than Settle ago that haven't been received, or, once the test is done, every event that wasn't
+	Lost     int `json:"lost"`
+	Kills    int `json:"kills"`
+	Restarts int `json:"restarts"`
+	//Failures are the kills, starts and shutdowns of the consumer that failed
+	Failures   int            `json:"failures"`
+	Latency    LatencySummary `json:"latency"`
+	Violations []string       `json:"violations,omitempty"`
+}
+
+//OK reports whether the delivery mode's invariants held
+func (r *SoakReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+//String formats the report for a terminal
+func (r *SoakReport) String() string {
+	status := "ok"
+	if !r.OK() {
+		status = "VIOLATED: " + strings.Join(r.Violations, "; ")
+	}
+	return fmt.Sprintf("run=%s delivery=%s elapsed=%s sent=%d received=%d duplicates=%d lost=%d publish_errors=%d kills=%d restarts=%d failures=%d latency: %s %s",
+		r.Run, r.Delivery, r.Elapsed.Round(time.Millisecond), r.Sent, r.Received, r.Duplicates, r.Lost, r.PublishErrors, r.Kills, r.Restarts, r.Failures, r.Latency, status)
+}
+
+//Soak runs a soak test: it publishes numbered events at a steady rate while, at random, killing the consumer's connections and restarting it, and
+//continuously verifies that no event is lost or duplicated beyond what the config's Delivery allows, so a deployment's guarantees can be validated
+//before production. The returned report's Violations list every invariant that didn't hold
+func Soak(ctx context.Context, config *Config, opts SoakOptions) (*SoakReport, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if opts.Channel == "" {
+		opts.Channel = "pqstream_soak"
+	}
+	if err := ValidateChannel(opts.Channel); err != nil {
+		return nil, err
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = 100
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Minute
+	}
+	if opts.KillEvery == 0 {
+		opts.KillEvery = 30 * time.Second
+	}
+	if opts.RestartEvery == 0 {
+		opts.RestartEvery = 2 * time.Minute
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = 30 * time.Second
+	}
+	if opts.ReportEvery <= 0 {
+		opts.ReportEvery = 10 * time.Second
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	delivery := config.Delivery
+	if delivery == "" {
+		delivery = DeliveryAtLeastOnce
+	}
+	target := opts.Target
+	if target == nil {
+		pg, err := newPostgresSoak(config, opts.Channel)
+		if err != nil {
+			return nil, err
+		}
+		defer pg.close()
+		target = pg
+	}
+	run, err := RandomIDs{}.NewID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate soak run id! %s", err.Error())
+	}
+	ledger := &soakLedger{run: run, delivery: delivery, seed: opts.Seed, settle: opts.Settle, sent: map[int64]time.Time{}, received: map[int64]int{}}
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		event, ok := parseSoakEvent(n)
+		if !ok || event.Run != run {
+			return nil
+		}
+		if opts.Handler != nil {
+			if err := opts.Handler.Process(n); err != nil {
+				return err
+			}
+		}
+		ledger.receive(event, time.Now())
+		return nil
+	})
+	stop, err := target.Start(ctx, handler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start soak consumer! %s", err.Error())
+	}
+	consumer := &soakConsumer{stop: stop}
+	defer consumer.shutdown()
+
+	start := time.Now()
+	chaosCtx, stopChaos := context.WithCancel(ctx)
+	defer stopChaos()
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		soakChaos(chaosCtx, ctx, target, handler, consumer, ledger, opts)
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(opts.ReportEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-chaosCtx.Done():
+				return
+			case now := <-ticker.C:
+				if opts.OnReport != nil {
+					opts.OnReport(ledger.report(now, now.Sub(start), false))
+				}
+			}
+		}
+	}()
+	produceErr := soakProduce(ctx, target, ledger, opts)
+	stopChaos()
+	wg.Wait()
+	if produceErr != nil {
+		return nil, produceErr
+	}
+	//faults have stopped, so give delivery Settle to catch up on everything sent before verifying
+	settle := time.NewTimer(opts.Settle)
+	defer settle.Stop()
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+wait:
+	for !ledger.settled() {
+		select {
+		case <-poll.C:
+		case <-settle.C:
+			break wait
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err := consumer.shutdown(); err != nil {
+		ledger.fail()
+	}
+	now := time.Now()
+	return ledger.report(now, now.Sub(start), true), nil
+}
+
+//soakProduce publishes events at the target rate for the test's duration
+func soakProduce(ctx context.Context, target SoakTarget, ledger *soakLedger, opts SoakOptions) error {
+	const tick = 10 * time.Millisecond
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	deadline := time.Now().Add(opts.Duration)
+	perTick := float64(opts.Rate) * tick.Seconds()
+	padding := strings.Repeat("x", opts.PayloadSize)
+	var budget float64
+	var seq int64
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		budget += perTick
+		for ; budget >= 1; budget-- {
+			seq++
+			event := SoakEvent{Run: ledger.run, Seq: seq, SentAt: time.Now(), Padding: padding}
+			//record the event as sent first, since it may be received before Publish returns
+			ledger.send(event)
+			if err := target.Publish(ctx, event); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				ledger.unsend(event)
+			}
+		}
+	}
+	return nil
+}
+
+//soakChaos kills and restarts the consumer at random until ctx is done. A restart in progress finishes starting the new consumer, unless the test's ctx is done
+func soakChaos(ctx, testCtx context.Context, target SoakTarget, handler Handler, consumer *soakConsumer, ledger *soakLedger, opts SoakOptions) {
+	random := rand.New(rand.NewSource(opts.Seed))
+	next := func(mean time.Duration) <-chan time.Time {
+		if mean < 0 {
+			return nil
+		}
+		return time.After(time.Duration(random.ExpFloat64() * float64(mean)))
+	}
+	kill, restart := next(opts.KillEvery), next(opts.RestartEvery)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-kill:
+			if _, err := target.Kill(ctx); err == nil {
+				ledger.kill()
+			} else if ctx.Err() == nil {
+				ledger.fail()
+			}
+			kill = next(opts.KillEvery)
+		case <-restart:
+			if err := consumer.shutdown(); err != nil {
+				ledger.fail()
+			}
+			stop, err := target.Start(testCtx, handler)
+			for err != nil && testCtx.Err() == nil {
+				ledger.fail()
+				select {
+				case <-testCtx.Done():
+				case <-time.After(time.Second):
+					stop, err = target.Start(testCtx, handler)
+				}
+			}
+			if err != nil {
+				return
+			}
+			consumer.set(stop)
+			ledger.restart()
+			restart = next(opts.RestartEvery)
+		}
+	}
+}
+
+//parseSoakEvent decodes a soak event from a notification's envelope data, or from its whole payload
+func parseSoakEvent(n *pq.Notification) (SoakEvent, bool) {
+	var event SoakEvent
+	data := []byte(n.Extra)
+	if e := envelopeOf(n); e != nil && e.Data != nil {
+		data = e.Data
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.Run == "" {
+		return SoakEvent{}, false
+	}
+	return event, true
+}
+
+//soakConsumer is the running consumer, swapped on each restart
+type soakConsumer struct {
+	mu   sync.Mutex
+	stop func(ctx context.Context) error
+}
+
+func (s *soakConsumer) set(stop func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop = stop
+}
+
+//shutdown shuts the consumer down, if it is running
+func (s *soakConsumer) shutdown() error {
+	s.mu.Lock()
+	stop := s.stop
+	s.stop = nil
+	s.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return stop(ctx)
+}
+
+//soakLedger records the events sent and received, verifying them against the delivery mode
+type soakLedger struct {
+	run      string
+	delivery Delivery
+	seed     int64
+	settle   time.Duration
+
+	mu            sync.Mutex
+	sent          map[int64]time.Time
+	received      map[int64]int
+	publishErrors int
+	duplicates    int
+	kills         int
+	restarts      int
+	failures      int
+	latencies     []time.Duration
+}
+
+func (l *soakLedger) send(event SoakEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sent[event.Seq] = event.SentAt
+}
+
+func (l *soakLedger) unsend(event SoakEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sent, event.Seq)
+	l.publishErrors++
+}
+
+func (l *soakLedger) receive(event SoakEvent, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.received[event.Seq]++
+	if l.received[event.Seq] > 1 {
+		l.duplicates++
+		return
+	}
+	l.latencies = append(l.latencies, at.Sub(event.SentAt))
+}
+
+func (l *soakLedger) kill() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.kills++
+}
+
+func (l *soakLedger) restart() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.restarts++
+}
+
+func (l *soakLedger) fail() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures++
+}
+
+//settled reports whether every event sent has been received
+func (l *soakLedger) settled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for seq := range l.sent {
+		if l.received[seq] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//report verifies the events so far. Before the test is done, only events sent longer than Settle ago count as lost
+func (l *soakLedger) report(now time.Time, elapsed time.Duration, done bool) *SoakReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := &SoakReport{
+		Run:           l.run,
+		Delivery:      l.delivery,
+		Seed:          l.seed,
+		Elapsed:       elapsed,
+		Sent:          len(l.sent),
+		PublishErrors: l.publishErrors,
+		Duplicates:    l.duplicates,
+		Kills:         l.kills,
+		Restarts:      l.restarts,
+		Failures:      l.failures,
+		Latency:       Summarize(l.latencies),
+	}
+	for seq, sentAt := range l.sent {
+		switch {
+		case l.received[seq] > 0:
+			r.Received++
+		case done || now.Sub(sentAt) > l.settle:
+			r.Lost++
+		}
+	}
+	if r.Lost > 0 && l.delivery != DeliveryAtMostOnce {
+		r.Violations = append(r.Violations, fmt.Sprintf("%d of %d events lost under %s delivery", r.Lost, r.Sent, l.delivery))
+	}
+	if r.Duplicates > 0 && l.delivery == DeliveryAtMostOnce {
+		r.Violations = append(r.Violations, fmt.Sprintf("%d events duplicated under %s delivery", r.Duplicates, l.delivery))
+	}
+	return r
+}
+
+//postgresSoak is the default SoakTarget: a client made from the config consuming the events a database is sent
+type postgresSoak struct {
+	config  *Config
+	channel string
+	db      *sql.DB
+}
+
+func newPostgresSoak(config *Config, channel string) (*postgresSoak, error) {
+	db, err := sql.Open("postgres", config.WriteConnInfo())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open with connection info! %s", err.Error())
+	}
+	return &postgresSoak{config: config, channel: channel, db: db}, nil
+}
+
+func (p *postgresSoak) close() error {
+	return p.db.Close()
+}
+
+//Publish inserts the event into the config's Outbox, or notifies it enveloped
+func (p *postgresSoak) Publish(ctx context.Context, event SoakEvent) error {
+	if p.config.Outbox != nil {
+		return p.config.Outbox.Send(ctx, p.db, p.channel, SourceApplication, event)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(Envelope{ID: fmt.Sprintf("%s-%d", event.Run, event.Seq), EmittedAt: event.SentAt, Data: data})
+	if err != nil {
+		return err
+	}
+	if _, err := p.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", p.channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify channel : %s! %s", p.channel, err.Error())
+	}
+	return nil
+}
+
+//Start runs a new client on the channel
+func (p *postgresSoak) Start(ctx context.Context, handler Handler) (func(ctx context.Context) error, error) {
+	client, err := NewClient([]string{p.channel}, p.config, &HandlerSet{Handlers: []Handler{handler}, ErrorHandler: func(err error) {}})
+	if err != nil {
+		return nil, err
+	}
+	ran := make(chan error, 1)
+	go func() {
+		ran <- client.Run(context.Background())
+	}()
+	if err := client.WaitReady(ctx); err != nil {
+		_ = client.Shutdown(context.Background())
+		if errors.Is(err, ErrClientStopped) {
+			return nil, <-ran
+		}
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		if err := client.Shutdown(ctx); err != nil {
+			return err
+		}
+		return <-ran
+	}, nil
+}
+
+//Kill terminates the backends listening on the channel
+func (p *postgresSoak) Kill(ctx context.Context) (int, error) {
+	var killed int
+	err := p.db.QueryRowContext(ctx, `SELECT count(*) FILTER (WHERE pg_terminate_backend(pid)) FROM pg_stat_activity
+WHERE datname = current_database() AND pid <> pg_backend_pid() AND query = $1`, "LISTEN "+pq.QuoteIdentifier(p.channel)).Scan(&killed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to terminate listeners of channel : %s! %s", p.channel, err.Error())
+	}
+	return killed, nil
+}
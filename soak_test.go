@@ -0,0 +1,136 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//soakBroker is an in memory SoakTarget. A durable broker holds events while no consumer is running and redelivers the last event after a kill; a lossy
+//one drops the events published while no consumer is running and the next few after a kill
+type soakBroker struct {
+	durable bool
+
+	mu       sync.Mutex
+	handler  pqstream.Handler
+	held     []*pq.Notification
+	last     *pq.Notification
+	dropping int
+}
+
+func (b *soakBroker) Publish(ctx context.Context, event pqstream.SoakEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	n := &pq.Notification{Channel: "pqstream_soak", Extra: string(data)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.handler == nil && b.durable:
+		b.held = append(b.held, n)
+	case b.handler == nil:
+	case b.dropping > 0:
+		b.dropping--
+	default:
+		b.last = n
+		return b.handler.Process(n)
+	}
+	return nil
+}
+
+func (b *soakBroker) Start(ctx context.Context, handler pqstream.Handler) (func(ctx context.Context) error, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+	for _, n := range b.held {
+		if err := handler.Process(n); err != nil {
+			return nil, err
+		}
+	}
+	b.held = nil
+	return func(ctx context.Context) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.handler = nil
+		return nil
+	}, nil
+}
+
+func (b *soakBroker) Kill(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handler == nil {
+		return 0, nil
+	}
+	if b.durable && b.last != nil {
+		return 1, b.handler.Process(b.last)
+	}
+	b.dropping = 5
+	return 1, nil
+}
+
+func TestSoak(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		delivery  pqstream.Delivery
+		durable   bool
+		violation string
+	}{
+		{name: "durable at least once", delivery: pqstream.DeliveryAtLeastOnce, durable: true},
+		{name: "lossy at least once", delivery: pqstream.DeliveryAtLeastOnce, violation: "lost"},
+		{name: "lossy at most once", delivery: pqstream.DeliveryAtMostOnce},
+		{name: "durable at most once", delivery: pqstream.DeliveryAtMostOnce, durable: true, violation: "duplicated"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			reports := 0
+			report, err := pqstream.Soak(context.Background(), &pqstream.Config{Delivery: test.delivery}, pqstream.SoakOptions{
+				Rate:         1000,
+				Duration:     300 * time.Millisecond,
+				KillEvery:    20 * time.Millisecond,
+				RestartEvery: 50 * time.Millisecond,
+				Settle:       100 * time.Millisecond,
+				ReportEvery:  50 * time.Millisecond,
+				OnReport: func(report *pqstream.SoakReport) {
+					mu.Lock()
+					defer mu.Unlock()
+					reports++
+				},
+				Seed:   1,
+				Target: &soakBroker{durable: test.durable},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Sent == 0 || report.Kills == 0 || report.Restarts == 0 {
+				t.Fatalf("expected traffic, kills and restarts: %s", report)
+			}
+			if report.Delivery != test.delivery || report.Received+report.Lost != report.Sent {
+				t.Fatalf("unexpected accounting: %s", report)
+			}
+			mu.Lock()
+			if reports == 0 {
+				t.Fatal("expected progress reports")
+			}
+			mu.Unlock()
+			if !test.durable && report.Lost == 0 {
+				t.Fatalf("expected a lossy broker to lose events: %s", report)
+			}
+			if test.violation == "" {
+				if !report.OK() {
+					t.Fatalf("expected the invariants to hold: %s", report)
+				}
+				return
+			}
+			if report.OK() || !strings.Contains(report.Violations[0], test.violation) {
+				t.Fatalf("expected events to be %s: %s", test.violation, report)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//sourceRestartDelay is how long a failed source waits before it is run again
+const sourceRestartDelay = time.Second
+
+//EmitFunc hands a notification from an EventSource to the client. It returns once the notification is queued on its channel's lane, not once it is
+//processed, blocking while the lane is full. It fails with ctx's error when ctx is done first, and with ErrClientStopped once the client stops
+type EmitFunc func(ctx context.Context, notification *pq.Notification) error
+
+//An EventSource is an input other than postgres, ie: a Kafka topic, a webhook receiver or a file tailer, whose events are processed like notifications:
+//set as Config.Sources, each runs alongside the client and the notifications it emits take the same lanes, workers, drain and standby policies,
+//handlers, stats and traces as those received from LISTEN. A source names the channel of each notification it emits, any valid channel, listened on or not,
+//and its BePid is zero. Run should return when ctx is done. A source returning early is reported to HandlerSet.ErrorHandler and run again after a second
+type EventSource interface {
+	Named
+	Run(ctx context.Context, emit EmitFunc) error
+}
+
+type eventSourceFunc struct {
+	name string
+	run  func(ctx context.Context, emit EmitFunc) error
+}
+
+func (s *eventSourceFunc) Name() string {
+	return s.name
+}
+
+func (s *eventSourceFunc) Run(ctx context.Context, emit EmitFunc) error {
+	return s.run(ctx, emit)
+}
+
+//NewEventSource is a helper function to create a named EventSource from a first class function
+func NewEventSource(name string, run func(ctx context.Context, emit EmitFunc) error) EventSource {
+	return &eventSourceFunc{name: name, run: run}
+}
+
+//runSources runs the client's sources until it stops, returning a function stopping them and waiting for them to return
+func (c *Client) runSources() func() {
+	if len(c.config.Sources) == 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.lifecycle.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	emit := func(emitCtx context.Context, n *pq.Notification) error {
+		if n == nil {
+			return errors.New("emitted a nil notification")
+		}
+		if err := ValidateChannel(n.Channel); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ErrClientStopped
+		}
+		select {
+		case c.sourced <- n:
+			return nil
+		case <-emitCtx.Done():
+			return emitCtx.Err()
+		case <-ctx.Done():
+			return ErrClientStopped
+		}
+	}
+	wg := &sync.WaitGroup{}
+	for _, src := range c.config.Sources {
+		wg.Add(1)
+		go func(src EventSource) {
+			defer wg.Done()
+			for {
+				err := src.Run(ctx, emit)
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil {
+					err = errors.New("returned before the client stopped")
+				}
+				c.handlers.ErrorHandler(fmt.Errorf("event source %s failed! %s", src.Name(), err.Error()))
+				select {
+				case <-c.config.Clock.After(sourceRestartDelay):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(src)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+//An HTTPSource is an EventSource receiving events as HTTP requests, ie: webhooks from a third party, mounted as an http.Handler on the application's server.
+//The body of each request is the payload of a notification on Channel, or on the channel of Channels named by its X-Pqstream-Channel header. A request is
+//answered 202 Accepted once its notification is queued in memory, before it is processed, so it is lost if the client crashes or restarts first, and
+//503 while the client isn't running
+type HTTPSource struct {
+	//Channel is the channel notifications are emitted on, unless a request names another
+	Channel string
+	//Channels are the other channels a request may name, so callers can't inject notifications on every channel the client handles. Defaults to none
+	Channels []string
+	//MaxBytes is the largest body accepted. Defaults to 1MB
+	MaxBytes int64
+
+	mu   sync.RWMutex
+	emit EmitFunc
+}
+
+//Name returns the source's name
+func (s *HTTPSource) Name() string {
+	return "http:" + s.Channel
+}
+
+//Run accepts requests until ctx is done
+func (s *HTTPSource) Run(ctx context.Context, emit EmitFunc) error {
+	s.mu.Lock()
+	s.emit = emit
+	s.mu.Unlock()
+	<-ctx.Done()
+	s.mu.Lock()
+	s.emit = nil
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *HTTPSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	emit := s.emit
+	s.mu.RUnlock()
+	if emit == nil {
+		http.Error(w, ErrClientStopped.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	channel := s.Channel
+	if named := r.Header.Get("X-Pqstream-Channel"); named != "" && named != channel {
+		allowed := false
+		for _, ch := range s.Channels {
+			allowed = allowed || ch == named
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("channel not allowed: %s", named), http.StatusForbidden)
+			return
+		}
+		channel = named
+	}
+	if err := ValidateChannel(channel); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := s.MaxBytes
+	if limit <= 0 {
+		limit = 1 << 20
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("failed to read body! %s", err.Error()), status)
+		return
+	}
+	if err := emit(r.Context(), &pq.Notification{Channel: channel, Extra: string(body)}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
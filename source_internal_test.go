@@ -0,0 +1,102 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSourcesFanIn(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	handler := HandlerFunc(func(n *pq.Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[n.Channel] = append(seen[n.Channel], n.Extra)
+		return nil
+	})
+	var errs []error
+	runs := 0
+	clock := NewFakeClock(time.Now())
+	kafka := NewEventSource("kafka", func(ctx context.Context, emit EmitFunc) error {
+		mu.Lock()
+		runs++
+		run := runs
+		mu.Unlock()
+		if run == 1 {
+			if err := emit(ctx, &pq.Notification{Channel: ""}); err == nil {
+				t.Error("expected an invalid channel to be rejected")
+			}
+			return errors.New("broker unavailable")
+		}
+		for _, payload := range []string{"1", "2"} {
+			if err := emit(ctx, &pq.Notification{Channel: "orders.kafka", Extra: payload}); err != nil {
+				return err
+			}
+		}
+		<-ctx.Done()
+		if err := emit(context.Background(), &pq.Notification{Channel: "orders.kafka"}); err != ErrClientStopped {
+			t.Errorf("expected emitting after the client stopped to fail, got: %v", err)
+		}
+		return nil
+	})
+	c, err := NewClient([]string{"orders"}, &Config{Clock: clock, Sources: []EventSource{kafka}}, &HandlerSet{
+		Handlers: []Handler{handler},
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	notify := make(chan *pq.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(notify, func() error { return nil })
+	}()
+	stopSources := c.runSources()
+	notify <- &pq.Notification{Channel: "orders", Extra: "pg"}
+	//the failed source is run again once its restart delay passes
+	for {
+		mu.Lock()
+		restarted := runs > 1
+		mu.Unlock()
+		if restarted {
+			break
+		}
+		clock.Advance(sourceRestartDelay)
+		time.Sleep(time.Millisecond)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := strings.Join(seen["orders.kafka"], ",")
+		mu.Unlock()
+		if got == "1,2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the source's notifications to be processed, got: %q", got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stopSources()
+	close(notify)
+	<-done
+	if got := strings.Join(seen["orders"], ","); got != "pg" {
+		t.Fatalf("expected postgres notifications alongside the source's, got: %q", got)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "event source kafka failed! broker unavailable") {
+		t.Fatalf("expected the source's failure to be reported, got: %v", errs)
+	}
+	if processed := c.stats.channel("orders.kafka").snapshot().Processed; processed != 2 {
+		t.Fatalf("expected the source's channel to have stats, got %d processed", processed)
+	}
+}
@@ -0,0 +1,79 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPSource(t *testing.T) {
+	src := &pqstream.HTTPSource{Channel: "webhooks", Channels: []string{"stripe", strings.Repeat("x", 64)}, MaxBytes: 16}
+	post := func(body, channel string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if channel != "" {
+			req.Header.Set("X-Pqstream-Channel", channel)
+		}
+		rec := httptest.NewRecorder()
+		src.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := post(`{}`, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before the source runs, got %d", code)
+	}
+	emitted := make(chan *pq.Notification, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	running := make(chan struct{})
+	go func() {
+		done <- src.Run(ctx, func(ctx context.Context, n *pq.Notification) error {
+			if n.Extra == "ping" {
+				close(running)
+				return nil
+			}
+			emitted <- n
+			return nil
+		})
+	}()
+	for code := 0; code != http.StatusAccepted; {
+		code = post("ping", "")
+	}
+	<-running
+	if code := post(`{"id":1}`, ""); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	if code := post(`{"id":2}`, "stripe"); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	if code := post(`{"id":3}`, strings.Repeat("x", 64)); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid channel to be rejected, got %d", code)
+	}
+	if code := post(`{"id":4}`, "erasures"); code != http.StatusForbidden {
+		t.Fatalf("expected a channel outside Channels to be forbidden, got %d", code)
+	}
+	if code := post(strings.Repeat("x", 17), ""); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a body over MaxBytes to be rejected, got %d", code)
+	}
+	if n := <-emitted; n.Channel != "webhooks" || n.Extra != `{"id":1}` {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	if n := <-emitted; n.Channel != "stripe" || n.Extra != `{"id":2}` {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if code := post(`{}`, ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the source stops, got %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	src.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+}
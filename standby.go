@@ -0,0 +1,183 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//defaultStandbyBuffer is the number of notifications a standby holds when Config.StandbyBuffer is unset
+const defaultStandbyBuffer = 10000
+
+//defaultStandbyLockInterval is how often a standby tries to take the advisory lock when Config.StandbyLockInterval is unset
+const defaultStandbyLockInterval = 5 * time.Second
+
+//Role is whether a client is processing notifications or holding them as a warm standby
+type Role string
+
+const (
+	//RoleActive is the role of a client that runs handlers on inbound notifications
+	RoleActive Role = "active"
+	//RoleStandby is the role of a client that listens and buffers notifications until it is promoted
+	RoleStandby Role = "standby"
+	//RoleReleased is the role of a client that has handed its channels off to another instance and no longer processes notifications
+	RoleReleased Role = "released"
+	//RoleFenced is the role of a client that detected a newer instance with its InstanceID and stopped processing
+	RoleFenced Role = "fenced"
+)
+
+//Role returns whether the client is active, a standby waiting to be promoted, released after handing off its channels or fenced
+func (c *Client) Role() Role {
+	if c.isFenced() {
+		return RoleFenced
+	}
+	if c.handoff.isReleased() {
+		return RoleReleased
+	}
+	if c.standby.isActive() {
+		return RoleActive
+	}
+	return RoleStandby
+}
+
+//Promote turns a standby client into an active one. Notifications buffered while in standby are processed, in order, before any new ones.
+//Promoting an active client does nothing
+func (c *Client) Promote() {
+	c.standby.promote()
+}
+
+//standby holds the notifications a standby client receives until it is promoted, dropping the oldest once the buffer is full
+type standby struct {
+	mu       sync.Mutex
+	active   bool
+	size     int
+	buffer   []*pq.Notification
+	promoted chan struct{}
+	once     sync.Once
+}
+
+func newStandby(enabled bool, size int) *standby {
+	if size <= 0 {
+		size = defaultStandbyBuffer
+	}
+	s := &standby{active: !enabled, size: size}
+	if enabled {
+		s.promoted = make(chan struct{})
+	}
+	return s
+}
+
+//isActive reports whether the standby has been promoted, even if the dispatcher hasn't drained its buffer yet
+func (s *standby) isActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active {
+		return true
+	}
+	select {
+	case <-s.promoted:
+		return true
+	default:
+		return false
+	}
+}
+
+//signal returns a channel closed when the standby is promoted, or nil if the client started active
+func (s *standby) signal() <-chan struct{} {
+	return s.promoted
+}
+
+func (s *standby) promote() {
+	if s.promoted == nil {
+		return
+	}
+	s.once.Do(func() { close(s.promoted) })
+}
+
+//hold buffers a notification if the client is still a standby. It returns the oldest notification if one had to be dropped to make room
+func (s *standby) hold(n *pq.Notification) (held bool, dropped *pq.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active {
+		return false, nil
+	}
+	if len(s.buffer) == s.size {
+		dropped = s.buffer[0]
+		s.buffer[0] = nil
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = append(s.buffer, n)
+	return true, dropped
+}
+
+//discard drops the notifications held for a channel
+func (s *standby) discard(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.buffer[:0]
+	for _, n := range s.buffer {
+		if n.Channel != channel {
+			kept = append(kept, n)
+		}
+	}
+	for i := len(kept); i < len(s.buffer); i++ {
+		s.buffer[i] = nil
+	}
+	s.buffer = kept
+}
+
+//drain makes the client active and returns everything buffered while it was a standby
+func (s *standby) drain() []*pq.Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = true
+	buffered := s.buffer
+	s.buffer = nil
+	return buffered
+}
+
+//campaign promotes a standby once it takes the session advisory lock identified by Config.StandbyLockKey, ie: when the active instance holding it disconnects.
+//The lock is held on a dedicated connection until done is closed
+func (c *Client) campaign(db *sql.DB, done <-chan struct{}) {
+	interval := c.config.StandbyLockInterval
+	if interval <= 0 {
+		interval = defaultStandbyLockInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		c.handlers.ErrorHandler(fmt.Errorf("failed to open standby lock connection! %s", err.Error()))
+		return
+	}
+	defer conn.Close()
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", c.config.StandbyLockKey).Scan(&locked); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.handlers.ErrorHandler(fmt.Errorf("failed to try standby lock! %s", err.Error()))
+		}
+		if locked {
+			if c.config.Verbose {
+				c.logf("acquired standby lock %d, promoting", c.config.StandbyLockKey)
+			}
+			c.Promote()
+			<-ctx.Done()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.config.Clock.After(interval):
+		}
+	}
+}
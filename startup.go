@@ -0,0 +1,119 @@
+package pqstream
+
+import (
+	"sort"
+	"time"
+)
+
+//A StartupReport describes how a client started serving on a host, from opening its connection to catching up on its outbox, so operators can see
+//where a slow (re)start spent its time. A warm start is one after the client has already served, ie: after a failover or a lost connection
+type StartupReport struct {
+	Host      string    `json:"host"`
+	Warm      bool      `json:"warm"`
+	StartedAt time.Time `json:"started_at"`
+	//Connect is the time to connect and detect the server's capabilities
+	Connect time.Duration `json:"connect"`
+	//Preflight is the time to check the role's privileges, when Config.Preflight is set
+	Preflight time.Duration    `json:"preflight,omitempty"`
+	Channels  []ChannelStartup `json:"channels"`
+	//Handlers are the handlers and pipeline sinks the client runs, as named in its topology
+	Handlers []string `json:"handlers"`
+	//Spooled is the number of notifications the previous instance spooled that the client processed
+	Spooled int `json:"spooled,omitempty"`
+	//CatchUp is the time a durable client took to process the outbox rows past its checkpoints
+	CatchUp time.Duration `json:"catch_up,omitempty"`
+	//Ready is the time from StartedAt until the client was listening on every channel and caught up
+	Ready time.Duration `json:"ready"`
+}
+
+//A ChannelStartup is how a channel started
+type ChannelStartup struct {
+	Channel string `json:"channel"`
+	//Listen is the time the LISTEN took, including connecting the listener for the first channel
+	Listen time.Duration `json:"listen"`
+	//Replayed is the number of outbox rows a durable client caught up on
+	Replayed int    `json:"replayed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//StartupHandlerFunc is called with the report of each start of a client serving on a host
+type StartupHandlerFunc func(report StartupReport)
+
+//A StartupCollector is a Collector also measuring how the client starts
+type StartupCollector interface {
+	Collector
+	//ObserveStartup is called with the report of each start
+	ObserveStartup(report StartupReport)
+}
+
+//startup times the stages of a client starting to serve
+type startup struct {
+	client *Client
+	report StartupReport
+	clock  Clock
+}
+
+func (c *Client) startup(host string) *startup {
+	s := &startup{client: c, clock: c.config.Clock, report: StartupReport{Host: host, Warm: c.served, StartedAt: c.config.Clock.Now()}}
+	c.served = true
+	return s
+}
+
+//since returns the time since a stage began
+func (s *startup) since(began time.Time) time.Duration {
+	return s.clock.Now().Sub(began)
+}
+
+//listened records the LISTEN of a channel
+func (s *startup) listened(channel string, began time.Time, err error) {
+	ch := ChannelStartup{Channel: channel, Listen: s.since(began)}
+	if err != nil {
+		ch.Error = err.Error()
+	}
+	s.report.Channels = append(s.report.Channels, ch)
+}
+
+//caughtUp records the outbox rows replayed on each channel by the catch-up that began at a time
+func (s *startup) caughtUp(began time.Time, replayed map[string]int) {
+	s.report.CatchUp = s.since(began)
+	for i, ch := range s.report.Channels {
+		s.report.Channels[i].Replayed = replayed[ch.Channel]
+	}
+}
+
+//done completes the report and hands it to the StartupHandler and the Collector, or logs it when verbose without a StartupHandler
+func (s *startup) done() {
+	c := s.client
+	s.report.Ready = s.since(s.report.StartedAt)
+	for _, n := range c.topology().nodes {
+		if n.kind == nodeHandler || n.kind == nodeSink {
+			s.report.Handlers = append(s.report.Handlers, n.label)
+		}
+	}
+	sort.Slice(s.report.Channels, func(i, j int) bool { return s.report.Channels[i].Channel < s.report.Channels[j].Channel })
+	if collector, ok := c.collector().(StartupCollector); ok {
+		collector.ObserveStartup(s.report)
+	}
+	if c.handlers.StartupHandler != nil {
+		c.handlers.StartupHandler(s.report)
+		return
+	}
+	if c.config.Verbose {
+		start := "cold"
+		if s.report.Warm {
+			start = "warm"
+		}
+		c.logAt(LevelInfo, map[string]any{
+			"host":      s.report.Host,
+			"warm":      s.report.Warm,
+			"connect":   s.report.Connect.String(),
+			"preflight": s.report.Preflight.String(),
+			"catch_up":  s.report.CatchUp.String(),
+			"ready":     s.report.Ready.String(),
+			"channels":  len(s.report.Channels),
+			"handlers":  s.report.Handlers,
+			"spooled":   s.report.Spooled,
+		}, "%s start on %s ready in %s: connected in %s, listened on %d channels, caught up in %s, %d spooled notifications, handlers %v",
+			start, s.report.Host, s.report.Ready, s.report.Connect, len(s.report.Channels), s.report.CatchUp, s.report.Spooled, s.report.Handlers)
+	}
+}
@@ -0,0 +1,61 @@
+package pqstream
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartupReport(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	metrics := NewMetrics()
+	var reports []StartupReport
+	c, err := NewClient([]string{"users", "orders"}, &Config{Clock: clock, Collector: metrics}, &HandlerSet{
+		Handlers:       []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })},
+		StartupHandler: func(report StartupReport) { reports = append(reports, report) },
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	start := c.startup("db-1:5432")
+	clock.Advance(40 * time.Millisecond)
+	start.report.Connect = start.since(start.report.StartedAt)
+	for _, ch := range []string{"users", "orders"} {
+		began := clock.Now()
+		clock.Advance(5 * time.Millisecond)
+		var err error
+		if ch == "orders" {
+			err = errors.New("permission denied")
+		}
+		start.listened(ch, began, err)
+	}
+	began := clock.Now()
+	clock.Advance(100 * time.Millisecond)
+	start.caughtUp(began, map[string]int{"users": 12})
+	start.done()
+	c.startup("db-2:5432").done()
+
+	if len(reports) != 2 || reports[0].Warm || !reports[1].Warm {
+		t.Fatalf("expected a cold then a warm start, got %+v", reports)
+	}
+	r := reports[0]
+	if r.Connect != 40*time.Millisecond || r.CatchUp != 100*time.Millisecond || r.Ready != 150*time.Millisecond {
+		t.Fatalf("unexpected stage timings: %+v", r)
+	}
+	if len(r.Channels) != 2 || r.Channels[0].Channel != "orders" || r.Channels[0].Error == "" || r.Channels[1].Replayed != 12 || r.Channels[1].Listen != 5*time.Millisecond {
+		t.Fatalf("unexpected channel startups: %+v", r.Channels)
+	}
+	if len(r.Handlers) != 1 || !strings.HasPrefix(r.Handlers[0], "main[0]") {
+		t.Fatalf("expected the report to name the handlers, got %v", r.Handlers)
+	}
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{`pqstream_startups_total{start="cold"} 1`, `pqstream_startups_total{start="warm"} 1`, `pqstream_startup_seconds{stage="ready"} 0`} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Fatalf("expected the metrics to contain %s, got: %s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package pqstream
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Stats is a point-in-time snapshot of a Client's activity
+type Stats struct {
+	Member   Member                  `json:"member"`
+	Channels map[string]ChannelStats `json:"channels"`
+	Workers  WorkerStats             `json:"workers"`
+	//Bulkheads are the stats of each Bulkhead among the client's handlers, by name
+	Bulkheads map[string]BulkheadStats `json:"bulkheads,omitempty"`
+	//Sinks are the notifications and bytes delivered to each handler, by name, ie: main[0](*pqstream.WebhookSink)
+	Sinks map[string]SinkStats `json:"sinks,omitempty"`
+	//Budget is the use of the client's ConnectionBudget, if it has one
+	Budget *BudgetStats `json:"budget,omitempty"`
+}
+
+//Member describes a running client instance and the channels it has claimed, so operators can see how work is distributed across a fleet
+type Member struct {
+	InstanceID string `json:"instance_id"`
+	Role       Role   `json:"role"`
+	//State is the stage of its lifecycle the client is in
+	State     ClientState       `json:"state,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Hostname  string            `json:"hostname"`
+	Primary   string            `json:"primary,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+	Channels  []string          `json:"channels"`
+}
+
+//ChannelStats holds the counters for a single channel. InFlight is the number of notifications received but not yet fully processed.
+//ConsumerLag is the delay between the producer emitting the most recent enveloped notification and its processing completing.
+//Gaps counts the gaps detected in the channel's sequence numbers and Missed the notifications missing from them.
+//Queued is the number of notifications waiting in the channel's queue and Dropped the number its overflow policy discarded.
+//Bytes is the total size of the payloads received and MaxPayload the size of the largest. Expired counts the notifications skipped past their envelope's Deadline.
+//Spooled and ShutdownDropped count the notifications the DrainPolicy spooled and dropped as the client shut down.
+//Terminated counts the times the server terminated the channel's listener backend, see IsTerminated
+type ChannelStats struct {
+	Received        uint64        `json:"received"`
+	Processed       uint64        `json:"processed"`
+	Errors          uint64        `json:"errors"`
+	Stale           uint64        `json:"stale"`
+	Expired         uint64        `json:"expired"`
+	DeadLettered    uint64        `json:"dead_lettered"`
+	Quarantined     uint64        `json:"quarantined"`
+	Spooled         uint64        `json:"spooled"`
+	ShutdownDropped uint64        `json:"shutdown_dropped"`
+	Terminated      uint64        `json:"terminated"`
+	Gaps            uint64        `json:"gaps"`
+	Missed          uint64        `json:"missed"`
+	LastSeq         int64         `json:"last_seq,omitempty"`
+	InFlight        int64         `json:"in_flight"`
+	Queued          int           `json:"queued"`
+	Dropped         uint64        `json:"dropped"`
+	Bytes           uint64        `json:"bytes"`
+	MaxPayload      int           `json:"max_payload"`
+	ConsumerLag     time.Duration `json:"consumer_lag"`
+	LastReceived    time.Time     `json:"last_received"`
+}
+
+//Stats returns a snapshot of the client's membership info and per-channel counters
+func (c *Client) Stats() Stats {
+	hostname, _ := os.Hostname()
+	channels := c.Channels()
+	sort.Strings(channels)
+	return Stats{
+		Member: Member{
+			InstanceID: c.config.InstanceID,
+			Role:       c.Role(),
+			State:      c.State(),
+			Labels:     c.Identity().Labels,
+			Hostname:   hostname,
+			Primary:    c.Host(),
+			StartedAt:  c.stats.startedAt,
+			Channels:   channels,
+		},
+		Channels:  c.stats.snapshot(),
+		Workers:   c.workers.stats(),
+		Bulkheads: c.bulkheadStats(),
+		Sinks:     c.stats.sinkSnapshot(),
+		Budget:    c.budgetStats(),
+	}
+}
+
+//SinkStats holds the counters for a single handler. Delivered and Bytes count the notifications it processed successfully and the size of their payloads,
+//Failed the ones it returned an error for and Slow the ones it took longer than its slow handler threshold on
+type SinkStats struct {
+	Delivered uint64 `json:"delivered"`
+	Bytes     uint64 `json:"bytes"`
+	Failed    uint64 `json:"failed"`
+	Slow      uint64 `json:"slow,omitempty"`
+}
+
+type sinkStats struct {
+	delivered uint64
+	bytes     uint64
+	failed    uint64
+	slowed    uint64
+}
+
+func (s *sinkStats) slow() {
+	atomic.AddUint64(&s.slowed, 1)
+}
+
+func (s *sinkStats) observe(size int, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		return
+	}
+	atomic.AddUint64(&s.delivered, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+}
+
+type channelStats struct {
+	received        uint64
+	processed       uint64
+	errors          uint64
+	staled          uint64
+	expired         uint64
+	deadLettered    uint64
+	quarantined     uint64
+	spooled         uint64
+	shutdownDropped uint64
+	terminated      uint64
+	inFlight        int64
+	queued          int64
+	dropped         uint64
+	bytes           uint64
+	maxPayload      int64
+	consumerLag     int64
+	lastReceived    atomic.Value
+	seqMu           sync.Mutex
+	lastSeq         int64
+	gaps            uint64
+	missed          uint64
+}
+
+func (s *channelStats) receive(now time.Time, size int) {
+	atomic.AddUint64(&s.received, 1)
+	atomic.AddInt64(&s.inFlight, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+	for {
+		max := atomic.LoadInt64(&s.maxPayload)
+		if int64(size) <= max || atomic.CompareAndSwapInt64(&s.maxPayload, max, int64(size)) {
+			break
+		}
+	}
+	s.lastReceived.Store(now)
+}
+
+func (s *channelStats) done() {
+	atomic.AddUint64(&s.processed, 1)
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+func (s *channelStats) lag(d time.Duration) {
+	atomic.StoreInt64(&s.consumerLag, int64(d))
+}
+
+func (s *channelStats) fail() {
+	atomic.AddUint64(&s.errors, 1)
+}
+
+func (s *channelStats) stale() {
+	atomic.AddUint64(&s.staled, 1)
+}
+
+func (s *channelStats) expire() {
+	atomic.AddUint64(&s.expired, 1)
+}
+
+func (s *channelStats) deadLetter() {
+	atomic.AddUint64(&s.deadLettered, 1)
+}
+
+func (s *channelStats) quarantine() {
+	atomic.AddUint64(&s.quarantined, 1)
+}
+
+func (s *channelStats) snapshot() ChannelStats {
+	last, _ := s.lastReceived.Load().(time.Time)
+	s.seqMu.Lock()
+	gaps, missed, lastSeq := s.gaps, s.missed, s.lastSeq
+	s.seqMu.Unlock()
+	return ChannelStats{
+		Received:        atomic.LoadUint64(&s.received),
+		Processed:       atomic.LoadUint64(&s.processed),
+		Errors:          atomic.LoadUint64(&s.errors),
+		Stale:           atomic.LoadUint64(&s.staled),
+		Expired:         atomic.LoadUint64(&s.expired),
+		DeadLettered:    atomic.LoadUint64(&s.deadLettered),
+		Quarantined:     atomic.LoadUint64(&s.quarantined),
+		Spooled:         atomic.LoadUint64(&s.spooled),
+		ShutdownDropped: atomic.LoadUint64(&s.shutdownDropped),
+		Terminated:      atomic.LoadUint64(&s.terminated),
+		Gaps:            gaps,
+		Missed:          missed,
+		LastSeq:         lastSeq,
+		InFlight:        atomic.LoadInt64(&s.inFlight),
+		Queued:          int(atomic.LoadInt64(&s.queued)),
+		Dropped:         atomic.LoadUint64(&s.dropped),
+		Bytes:           atomic.LoadUint64(&s.bytes),
+		MaxPayload:      int(atomic.LoadInt64(&s.maxPayload)),
+		ConsumerLag:     time.Duration(atomic.LoadInt64(&s.consumerLag)),
+		LastReceived:    last,
+	}
+}
+
+type statsRegistry struct {
+	mu        sync.RWMutex
+	startedAt time.Time
+	channels  map[string]*channelStats
+	sinks     map[string]*sinkStats
+}
+
+func newStatsRegistry(clock Clock) *statsRegistry {
+	return &statsRegistry{
+		startedAt: clock.Now(),
+		channels:  map[string]*channelStats{},
+		sinks:     map[string]*sinkStats{},
+	}
+}
+
+func (r *statsRegistry) channel(name string) *channelStats {
+	r.mu.RLock()
+	s, ok := r.channels[name]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok = r.channels[name]; !ok {
+		s = &channelStats{}
+		r.channels[name] = s
+	}
+	return s
+}
+
+func (r *statsRegistry) sink(name string) *sinkStats {
+	r.mu.RLock()
+	s, ok := r.sinks[name]
+	r.mu.RUnlock()
+	if ok {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok = r.sinks[name]; !ok {
+		s = &sinkStats{}
+		r.sinks[name] = s
+	}
+	return s
+}
+
+func (r *statsRegistry) sinkSnapshot() map[string]SinkStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.sinks) == 0 {
+		return nil
+	}
+	out := make(map[string]SinkStats, len(r.sinks))
+	for name, s := range r.sinks {
+		out[name] = SinkStats{Delivered: atomic.LoadUint64(&s.delivered), Bytes: atomic.LoadUint64(&s.bytes), Failed: atomic.LoadUint64(&s.failed), Slow: atomic.LoadUint64(&s.slowed)}
+	}
+	return out
+}
+
+func (r *statsRegistry) snapshot() map[string]ChannelStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]ChannelStats, len(r.channels))
+	for name, s := range r.channels {
+		out[name] = s.snapshot()
+	}
+	return out
+}
+
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "pqstream"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
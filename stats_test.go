@@ -0,0 +1,98 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				if notification.Extra == "bad" {
+					return errors.New("bad payload")
+				}
+				return nil
+			}),
+		},
+		ErrorHandler: func(err error) {},
+	}
+	client, err := pqstream.NewClient([]string{"users", "accounts"}, &pqstream.Config{InstanceID: "worker-1"}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+	client.Process(&pq.Notification{Channel: "users", Extra: "bad"})
+
+	stats := client.Stats()
+	if stats.Member.InstanceID != "worker-1" {
+		t.Fatalf("expected instance id worker-1, got %s", stats.Member.InstanceID)
+	}
+	if len(stats.Member.Channels) != 2 || stats.Member.Channels[0] != "accounts" {
+		t.Fatalf("unexpected claimed channels: %v", stats.Member.Channels)
+	}
+	users := stats.Channels["users"]
+	if users.Received != 2 || users.Processed != 2 || users.Errors != 1 || users.InFlight != 0 {
+		t.Fatalf("unexpected users stats: %+v", users)
+	}
+	if _, ok := stats.Channels["accounts"]; !ok {
+		t.Fatal("expected idle channel to be reported")
+	}
+	if users.Bytes != 5 || users.MaxPayload != 3 {
+		t.Fatalf("expected the payload bytes to be counted, got: %+v", users)
+	}
+	if sink := stats.Sinks["main[0](pqstream.HandlerFunc)"]; sink.Delivered != 1 || sink.Bytes != 2 || sink.Failed != 1 {
+		t.Fatalf("unexpected sink stats: %+v", stats.Sinks)
+	}
+
+	rec := httptest.NewRecorder()
+	pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var served pqstream.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err.Error())
+	}
+	if served.Member.InstanceID != "worker-1" {
+		t.Fatalf("unexpected served stats: %+v", served)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	var identity pqstream.Identity
+	p := pqstream.NewPipeline().Source("users").Checkpoint(func(ctx context.Context, n *pq.Notification) error {
+		identity, _ = pqstream.IdentityFrom(ctx)
+		return nil
+	})
+	trace := &bytes.Buffer{}
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{
+		InstanceID:  "worker-1",
+		Labels:      map[string]string{"region": "us-east", "version": "1.2.0"},
+		TraceWriter: trace,
+	}, p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", Extra: "{}"})
+	if identity.String() != "worker-1{region=us-east,version=1.2.0}" {
+		t.Fatalf("expected checkpoints to see the client's identity, got: %s", identity)
+	}
+	if labels := client.Stats().Member.Labels; labels["region"] != "us-east" {
+		t.Fatalf("expected stats to carry labels, got: %v", labels)
+	}
+	var e pqstream.TraceEvent
+	if err := json.NewDecoder(trace).Decode(&e); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Instance != "worker-1" || e.Labels["version"] != "1.2.0" {
+		t.Fatalf("expected traces to carry the identity, got: %+v", e)
+	}
+}
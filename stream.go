@@ -0,0 +1,470 @@
+package pqstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//defaultStreamBuffer is the number of notifications held for each stream connection when StreamOptions.Buffer is unset
+const defaultStreamBuffer = 64
+
+//defaultStreamKeepAlive is how often idle stream connections are pinged when StreamOptions.KeepAlive is unset
+const defaultStreamKeepAlive = 30 * time.Second
+
+//maxStreamMessage is the largest message a WebSocket client may send, which are only ever subscription changes
+const maxStreamMessage = 64 << 10
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+//StreamOptions configure a StreamServer
+type StreamOptions struct {
+	//Buffer is the number of notifications held for each connection. Notifications for a connection whose buffer is full are dropped rather than holding back the client.
+	//Defaults to 64
+	Buffer int
+	//KeepAlive is how often idle connections are pinged. Defaults to 30s
+	KeepAlive time.Duration
+	//Authorize decides whether a request may subscribe to a channel the client listens on, ie: checking a session cookie. It is required: a server without
+	//it refuses every request. AuthorizeAny allows every request, for servers only reachable by trusted callers
+	Authorize func(r *http.Request, channel string) error
+	//Origins are the origins, ie: https://app.example.com, of the web pages allowed to subscribe from another site. Requests from the server's own origin,
+	//and those without an Origin header, ie: from other servers, are always allowed. * allows any origin
+	Origins []string
+}
+
+//AuthorizeAny is a StreamOptions.Authorize allowing every request to subscribe to any channel the client listens on
+func AuthorizeAny(r *http.Request, channel string) error {
+	return nil
+}
+
+//A StreamServer fans a client's notifications out to remote subscribers, so pqstream can run as a realtime gateway for browsers and mobile apps.
+//It serves WebSocket connections, and Server-Sent Events to requests that don't ask for an upgrade, sending each notification as a JSON encoded Record.
+//Requests choose their channels with ?channel=users&channel=orders, defaulting to every channel the client listens on, and filter payloads with
+//?match=status=active, compared like Mapping paths against the payload's JSON. WebSocket clients change their subscriptions by sending {"subscribe": ["orders"], "unsubscribe": ["users"]}.
+//Other transports, ie: a gRPC server-streaming service, are built on Subscribe
+type StreamServer struct {
+	client  *Client
+	opts    StreamOptions
+	mu      sync.RWMutex
+	subs    map[*subscription]struct{}
+	dropped uint64
+}
+
+//NewStreamServer returns a StreamServer receiving every notification the client processes
+func NewStreamServer(c *Client, opts StreamOptions) *StreamServer {
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultStreamBuffer
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = defaultStreamKeepAlive
+	}
+	s := &StreamServer{client: c, opts: opts, subs: map[*subscription]struct{}{}}
+	c.mu.Lock()
+	c.handlers.Handlers = append(append([]Handler{}, c.handlers.Handlers...), s)
+	c.mu.Unlock()
+	return s
+}
+
+//subscription is a single subscriber's channels, filter and buffer
+type subscription struct {
+	mu       sync.RWMutex
+	channels map[string]bool
+	filter   FilterFunc
+	out      chan Record
+}
+
+func (sub *subscription) wants(n *pq.Notification) bool {
+	sub.mu.RLock()
+	ok := sub.channels[n.Channel]
+	sub.mu.RUnlock()
+	return ok && (sub.filter == nil || sub.filter(n))
+}
+
+func (sub *subscription) set(channels []string, subscribed bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	for _, ch := range channels {
+		if subscribed {
+			sub.channels[ch] = true
+		} else {
+			delete(sub.channels, ch)
+		}
+	}
+}
+
+func (s *StreamServer) Name() string {
+	return "stream"
+}
+
+func (s *StreamServer) Process(notification *pq.Notification) error {
+	return s.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext copies the notification to every subscriber that wants it, never blocking on a slow one
+func (s *StreamServer) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var record *Record
+	for sub := range s.subs {
+		if !sub.wants(notification) {
+			continue
+		}
+		if record == nil {
+			r := NewRecord(notification, s.client.config.Clock.Now())
+			record = &r
+		}
+		select {
+		case sub.out <- *record:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	return nil
+}
+
+//Subscribe returns a channel receiving a Record for each notification on the channels that passes the filter, which may be nil, until the returned func is called.
+//Subscribers that fall more than StreamOptions.Buffer notifications behind miss notifications rather than holding back the client
+func (s *StreamServer) Subscribe(channels []string, filter FilterFunc) (<-chan Record, func()) {
+	sub, cancel := s.subscribe(channels, filter)
+	return sub.out, cancel
+}
+
+func (s *StreamServer) subscribe(channels []string, filter FilterFunc) (*subscription, func()) {
+	sub := &subscription{channels: map[string]bool{}, filter: filter, out: make(chan Record, s.opts.Buffer)}
+	sub.set(channels, true)
+	s.mu.Lock()
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+	var once sync.Once
+	return sub, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, sub)
+			s.mu.Unlock()
+		})
+	}
+}
+
+//Connections returns the number of current subscribers
+func (s *StreamServer) Connections() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.subs)
+}
+
+//Dropped returns the number of notifications dropped for subscribers that fell behind
+func (s *StreamServer) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *StreamServer) authorize(r *http.Request, channels []string) error {
+	if s.opts.Authorize == nil {
+		return errors.New("stream server has no StreamOptions.Authorize")
+	}
+	if !s.allowOrigin(r) {
+		return fmt.Errorf("origin not allowed: %s", r.Header.Get("Origin"))
+	}
+	for _, ch := range channels {
+		listening := false
+		for _, c := range s.client.Channels() {
+			listening = listening || c == ch
+		}
+		if !listening {
+			return fmt.Errorf("not listening on channel: %s", ch)
+		}
+		if err := s.opts.Authorize(r, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//allowOrigin reports whether a request comes from the server's own origin, one of Origins, or no browser at all, so other sites' pages can't read the stream
+func (s *StreamServer) allowOrigin(r *http.Request) bool {
+	return allowOrigin(r, s.opts.Origins)
+}
+
+//allowOrigin reports whether a request comes from its server's own origin, one of origins, or no browser at all
+func allowOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchFilter returns a filter passing notifications whose payload has each path=value of the matches, or nil if there are none
+func matchFilter(matches []string) (FilterFunc, error) {
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	paths, values := make([]string, len(matches)), make([]string, len(matches))
+	for i, m := range matches {
+		path, value, ok := strings.Cut(m, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid match: %s", m)
+		}
+		paths[i], values[i] = path, value
+	}
+	return func(notification *pq.Notification) bool {
+		payload, err := decodePayload(notification)
+		if err != nil {
+			return false
+		}
+		for i, path := range paths {
+			v, ok := resolve(notification, payload, path)
+			if !ok || labelValue(v) != values[i] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+//ServeHTTP subscribes the request to its channels and streams their notifications until it disconnects
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	channels := query["channel"]
+	if len(channels) == 0 {
+		channels = s.client.Channels()
+	}
+	if err := s.authorize(r, channels); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	filter, err := matchFilter(query["match"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, cancel := s.subscribe(channels, filter)
+	defer cancel()
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		s.serveWebSocket(w, r, sub)
+		return
+	}
+	s.serveEvents(w, r, sub)
+}
+
+//serveEvents streams to the request as Server-Sent Events
+func (s *StreamServer) serveEvents(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.client.lifecycle.stopping:
+			return
+		case record := <-sub.out:
+			payload, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", record.Channel, payload); err != nil {
+				return
+			}
+		case <-s.client.config.Clock.After(s.opts.KeepAlive):
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+//streamControl is a message a WebSocket client sends to change its subscriptions
+type streamControl struct {
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
+
+//serveWebSocket upgrades the request and streams to it as WebSocket text messages, applying the subscription changes it sends
+func (s *StreamServer) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "unsupported websocket handshake", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	var mu sync.Mutex
+	write := func(op byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := writeFrame(rw.Writer, op, payload); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := readFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsClose:
+				write(wsClose, nil)
+				return
+			case wsPing:
+				write(wsPong, payload)
+			case wsText:
+				var control streamControl
+				if err := json.Unmarshal(payload, &control); err != nil {
+					write(wsText, streamError(fmt.Errorf("invalid subscription message! %s", err.Error())))
+					continue
+				}
+				if err := s.authorize(r, control.Subscribe); err != nil {
+					write(wsText, streamError(err))
+					continue
+				}
+				sub.set(control.Subscribe, true)
+				sub.set(control.Unsubscribe, false)
+			}
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-s.client.lifecycle.stopping:
+			write(wsClose, []byte{0x03, 0xE9})
+			return
+		case record := <-sub.out:
+			payload, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			if err := write(wsText, payload); err != nil {
+				return
+			}
+		case <-s.client.config.Clock.After(s.opts.KeepAlive):
+			if err := write(wsPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func streamError(err error) []byte {
+	payload, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return payload
+}
+
+//writeFrame writes a single unmasked, unfragmented WebSocket frame, as servers send them
+func writeFrame(w *bufio.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+//readFrame reads a single masked WebSocket frame, as clients send them, returning its opcode and unmasked payload
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[0]&0x80 == 0 || head[0]&0x0F == 0 {
+		return 0, nil, errors.New("fragmented websocket messages are not supported")
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked websocket frame")
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxStreamMessage {
+		return 0, nil, fmt.Errorf("websocket message of %d bytes exceeds the limit", length)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0F, payload, nil
+}
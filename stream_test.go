@@ -0,0 +1,185 @@
+package pqstream_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStreamServer(t *testing.T) (*pqstream.Client, *pqstream.StreamServer, *httptest.Server) {
+	t.Helper()
+	c, err := pqstream.NewClient([]string{"users", "orders"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := pqstream.NewStreamServer(c, pqstream.StreamOptions{Authorize: pqstream.AuthorizeAny, Origins: []string{"https://app.example.com"}})
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return c, s, srv
+}
+
+func waitConnections(t *testing.T, s *pqstream.StreamServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Connections() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, got %d", n, s.Connections())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStreamServerEvents(t *testing.T) {
+	c, s, srv := newStreamServer(t)
+	if resp, err := http.Get(srv.URL + "?channel=secrets"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a channel the client doesn't listen on to be forbidden, got: %v %v", resp, err)
+	}
+	resp, err := http.Get(srv.URL + "?channel=users&match=status=active")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	waitConnections(t, s, 1)
+	c.Process(&pq.Notification{Channel: "orders", Extra: `{"status": "active"}`})
+	c.Process(&pq.Notification{Channel: "users", Extra: `{"status": "inactive"}`})
+	c.Process(&pq.Notification{Channel: "users", Extra: `{"status": "active", "id": 1}`})
+	r := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(strings.TrimSpace(line), "data: ")
+		}
+	}
+	var record pqstream.Record
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		t.Fatal(err.Error())
+	}
+	if record.Channel != "users" || record.Payload != `{"status": "active", "id": 1}` {
+		t.Fatalf("expected only the matching notification, got: %+v", record)
+	}
+}
+
+//writeClientFrame writes a masked text frame, as a browser does
+func writeClientFrame(w io.Writer, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return head[0] & 0x0F, payload, err
+}
+
+func TestStreamServerWebSocket(t *testing.T) {
+	c, s, srv := newStreamServer(t)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /?channel=users HTTP/1.1\r\nHost: pqstream\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("expected the upgrade to be accepted, got: %d %s", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	waitConnections(t, s, 1)
+	if err := writeClientFrame(conn, []byte(`{"subscribe": ["orders"], "unsubscribe": ["users"]}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := writeClientFrame(conn, []byte(`{"subscribe": ["secrets"]}`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, payload, err := readServerFrame(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(payload), "not listening on channel: secrets") {
+		t.Fatalf("expected the unauthorized subscription to be rejected, got: %s", payload)
+	}
+	c.Process(&pq.Notification{Channel: "users", Extra: "1"})
+	c.Process(&pq.Notification{Channel: "orders", Extra: "2"})
+	op, payload, err := readServerFrame(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var record pqstream.Record
+	if err := json.Unmarshal(payload, &record); err != nil || op != 0x1 {
+		t.Fatalf("expected a text message, got op %d: %s", op, payload)
+	}
+	if record.Channel != "orders" || record.Payload != "2" {
+		t.Fatalf("expected the changed subscription to apply, got: %+v", record)
+	}
+	conn.Close()
+	waitConnections(t, s, 0)
+}
+
+func TestStreamServerRefusesUnauthorized(t *testing.T) {
+	_, _, srv := newStreamServer(t)
+	for origin, status := range map[string]int{"https://evil.example.com": http.StatusForbidden, "https://app.example.com": http.StatusOK, srv.URL: http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"?channel=users", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expected origin %s to get %d, got %d", origin, status, resp.StatusCode)
+		}
+	}
+
+	c, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	open := httptest.NewServer(pqstream.NewStreamServer(c, pqstream.StreamOptions{}))
+	defer open.Close()
+	resp, err := http.Get(open.URL + "?channel=users")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a server without Authorize to refuse requests, got %d", resp.StatusCode)
+	}
+}
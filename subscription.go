@@ -0,0 +1,220 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+)
+
+//A Subscription is a logical consumer of a channel within a client, like a consumer group sharing the client's connection: it has its own filter,
+//handlers and checkpoint, so several subscriptions on one channel progress independently without a postgres connection each.
+//A subscription's handlers run in order and stop at the first error, which is reported under the subscription's name
+type Subscription struct {
+	//Name identifies the subscription and the handler it runs as, ie: billing
+	Name    string
+	Channel string
+	//Filter skips the notifications it returns false for. Nil receives every notification on the channel
+	Filter   FilterFunc
+	Handlers []Handler
+	//Checkpoints stores the position of the last notification the subscription processed, from its envelope's outbox offset or sequence number,
+	//and notifications at or before it are skipped, ie: a TableCheckpoints whose Consumer is the subscription's name. Nil processes every notification
+	Checkpoints CheckpointStore
+
+	mu     sync.Mutex
+	loaded bool
+	last   int64
+}
+
+func (s *Subscription) name() string {
+	return "subscription:" + s.Name
+}
+
+func (s *Subscription) accepts(notification *pq.Notification) bool {
+	return s.Filter == nil || s.Filter(notification)
+}
+
+//positionOf returns a notification's outbox offset, or its envelope sequence number, or zero if it has neither
+func positionOf(n *pq.Notification) int64 {
+	envelope := envelopeOf(n)
+	if envelope == nil {
+		return 0
+	}
+	if envelope.Offset > 0 {
+		return envelope.Offset
+	}
+	return envelope.Seq
+}
+
+//Position returns the subscription's checkpoint, loading it on first use
+func (s *Subscription) Position(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position(ctx)
+}
+
+func (s *Subscription) position(ctx context.Context) (int64, error) {
+	if s.Checkpoints == nil || s.loaded {
+		return s.last, nil
+	}
+	last, err := s.Checkpoints.Load(ctx, s.Channel)
+	if err != nil {
+		return 0, err
+	}
+	s.last, s.loaded = last, true
+	return last, nil
+}
+
+//subscriptionHandler runs a subscription as one of the client's handlers
+type subscriptionHandler struct {
+	sub *Subscription
+}
+
+func (h subscriptionHandler) Name() string {
+	return h.sub.name()
+}
+
+func (h subscriptionHandler) Process(notification *pq.Notification) error {
+	return h.ProcessContext(context.Background(), notification)
+}
+
+func (h subscriptionHandler) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	s := h.sub
+	if notification.Channel != s.Channel {
+		return nil
+	}
+	position := positionOf(notification)
+	if s.Checkpoints == nil || position == 0 {
+		if !s.accepts(notification) {
+			return nil
+		}
+		return s.run(ctx, notification)
+	}
+	//a checkpointed subscription processes its notifications one at a time, so its checkpoint only ever moves forward past processed ones
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, err := s.position(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint of subscription %s! %s", s.Name, err.Error())
+	}
+	if position <= last {
+		return nil
+	}
+	//filtered notifications move the checkpoint too, so a catch-up doesn't read them again
+	if s.accepts(notification) {
+		if err := s.run(ctx, notification); err != nil {
+			return err
+		}
+	}
+	if err := s.Checkpoints.Save(ctx, s.Channel, position); err != nil {
+		return fmt.Errorf("failed to save checkpoint of subscription %s! %s", s.Name, err.Error())
+	}
+	s.last = position
+	return nil
+}
+
+func (s *Subscription) run(ctx context.Context, notification *pq.Notification) error {
+	for i, h := range s.Handlers {
+		var err error
+		if ch, ok := h.(ContextHandler); ok {
+			err = ch.ProcessContext(ctx, notification)
+		} else {
+			err = h.Process(notification)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", nameOf(h, s.Name, i), err)
+		}
+	}
+	return nil
+}
+
+//Subscribe registers a subscription, run alongside HandlerSet.Handlers. Subscriptions may be added while the client runs, but Subscribe doesn't start
+//listening on the subscription's channel, see Listen
+func (c *Client) Subscribe(sub *Subscription) error {
+	if sub == nil || sub.Name == "" || sub.Channel == "" {
+		return errors.New("subscription requires a name and a channel")
+	}
+	if len(sub.Handlers) == 0 {
+		return fmt.Errorf("subscription %s has no handlers", sub.Name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.handlers.Handlers {
+		if s, ok := h.(subscriptionHandler); ok && s.sub.Name == sub.Name {
+			return fmt.Errorf("subscription %s already exists", sub.Name)
+		}
+	}
+	c.handlers.Handlers = append(append([]Handler{}, c.handlers.Handlers...), subscriptionHandler{sub: sub})
+	return nil
+}
+
+//Unsubscribe removes a subscription, reporting whether it existed. Its checkpoint is kept, so subscribing again resumes from it
+func (c *Client) Unsubscribe(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handlers := make([]Handler, 0, len(c.handlers.Handlers))
+	for _, h := range c.handlers.Handlers {
+		if s, ok := h.(subscriptionHandler); ok && s.sub.Name == name {
+			continue
+		}
+		handlers = append(handlers, h)
+	}
+	removed := len(handlers) < len(c.handlers.Handlers)
+	c.handlers.Handlers = handlers
+	return removed
+}
+
+//Subscriptions returns the client's subscriptions in the order they were registered
+func (c *Client) Subscriptions() []*Subscription {
+	var subs []*Subscription
+	for _, h := range c.mainHandlers() {
+		if s, ok := h.(subscriptionHandler); ok {
+			subs = append(subs, s.sub)
+		}
+	}
+	return subs
+}
+
+//CatchupSubscription runs a single subscription on every outbox row of its channel past its own checkpoint, ie: to backfill a new subscription
+//without rerunning the others
+func (c *Client) CatchupSubscription(ctx context.Context, name string) error {
+	if c.durable == nil {
+		return ErrNotDurable
+	}
+	var sub *Subscription
+	for _, s := range c.Subscriptions() {
+		if s.Name == name {
+			sub = s
+		}
+	}
+	if sub == nil {
+		return fmt.Errorf("no subscription named %s", name)
+	}
+	if sub.Checkpoints == nil {
+		return fmt.Errorf("subscription %s has no checkpoints", name)
+	}
+	_, read := c.durable.source()
+	if read == nil {
+		return errors.New("client isn't connected")
+	}
+	handler := subscriptionHandler{sub: sub}
+	for {
+		after, err := sub.Position(ctx)
+		if err != nil {
+			return err
+		}
+		batch, err := read(ctx, sub.Channel, after)
+		if err != nil {
+			return err
+		}
+		for _, n := range batch {
+			if err := handler.ProcessContext(ctx, n); err != nil {
+				return err
+			}
+		}
+		if len(batch) < c.durable.outbox.batchSize() {
+			return nil
+		}
+	}
+}
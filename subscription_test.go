@@ -0,0 +1,101 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSubscriptions(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		billing  []int64
+		shipping []int64
+		failures []error
+	)
+	record := func(into *[]int64, fail bool) pqstream.Handler {
+		return pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+			envelope, err := pqstream.ParseEnvelope(notification)
+			if err != nil {
+				return err
+			}
+			if fail {
+				return errors.New("unavailable")
+			}
+			mu.Lock()
+			*into = append(*into, envelope.Offset)
+			mu.Unlock()
+			return nil
+		})
+	}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error { return nil })},
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			failures = append(failures, err)
+			mu.Unlock()
+		},
+	}
+	client, err := pqstream.NewClient([]string{"orders"}, &pqstream.Config{}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	billingCheckpoints, shippingCheckpoints := &pqstream.MemoryCheckpoints{}, &pqstream.MemoryCheckpoints{}
+	if err := client.Subscribe(&pqstream.Subscription{Name: "billing", Channel: "orders", Handlers: []pqstream.Handler{record(&billing, false)}, Checkpoints: billingCheckpoints}); err != nil {
+		t.Fatal(err.Error())
+	}
+	//shipping has already processed the first two rows
+	shippingCheckpoints.Save(context.Background(), "orders", 2)
+	shippingSub := &pqstream.Subscription{
+		Name:        "shipping",
+		Channel:     "orders",
+		Filter:      func(notification *pq.Notification) bool { return !strings.Contains(notification.Extra, "digital") },
+		Handlers:    []pqstream.Handler{record(&shipping, false)},
+		Checkpoints: shippingCheckpoints,
+	}
+	if err := client.Subscribe(shippingSub); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.Subscribe(&pqstream.Subscription{Name: "billing", Channel: "orders", Handlers: []pqstream.Handler{record(&billing, false)}}); err == nil {
+		t.Fatal("expected duplicate subscriptions to be rejected")
+	}
+	if err := client.Subscribe(&pqstream.Subscription{Name: "broken", Channel: "orders", Handlers: []pqstream.Handler{record(nil, true)}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for offset := int64(1); offset <= 4; offset++ {
+		data := `"physical"`
+		if offset == 4 {
+			data = `"digital"`
+		}
+		payload, _ := json.Marshal(pqstream.Envelope{Offset: offset, Data: json.RawMessage(data)})
+		client.Process(&pq.Notification{Channel: "orders", Extra: string(payload)})
+	}
+	//a redelivered row is skipped by both subscriptions
+	payload, _ := json.Marshal(pqstream.Envelope{Offset: 3, Data: json.RawMessage(`"physical"`)})
+	client.Process(&pq.Notification{Channel: "orders", Extra: string(payload)})
+
+	if len(billing) != 4 {
+		t.Fatalf("expected billing to process every row once, got: %v", billing)
+	}
+	if len(shipping) != 1 || shipping[0] != 3 {
+		t.Fatalf("expected shipping to resume from its checkpoint and filter digital orders, got: %v", shipping)
+	}
+	if position, _ := shippingSub.Position(context.Background()); position != 4 {
+		t.Fatalf("expected the filtered row to move the checkpoint, got: %d", position)
+	}
+	if len(failures) != 5 || !strings.Contains(failures[0].Error(), "unavailable") || client.Stats().Sinks["subscription:broken"].Failed != 5 {
+		t.Fatalf("expected the broken subscription's failures to be reported under its name, got: %v", failures)
+	}
+	if !client.Unsubscribe("broken") || client.Unsubscribe("broken") || len(client.Subscriptions()) != 2 {
+		t.Fatalf("expected the subscription to be removed once, got: %v", client.Subscriptions())
+	}
+	if err := client.CatchupSubscription(context.Background(), "billing"); err != pqstream.ErrNotDurable {
+		t.Fatalf("expected ErrNotDurable, got: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"sync"
+)
+
+//maxTap is the largest number of notifications a single tap may collect
+const maxTap = 1000
+
+//tap is a pending request for the next notifications on a channel
+type tap struct {
+	channel   string
+	remaining int
+	out       chan *pq.Notification
+}
+
+type taps struct {
+	mu     sync.Mutex
+	active map[*tap]struct{}
+}
+
+//Tap returns a channel receiving copies of the next n notifications on a channel, or on every channel if channel is empty, for peeking at live traffic.
+//Tapped notifications are still processed normally and a tap never blocks processing. The returned channel is closed once n notifications arrived,
+//or when the returned func is called to cancel the tap. n is capped at 1000
+func (c *Client) Tap(channel string, n int) (<-chan *pq.Notification, func()) {
+	if n <= 0 {
+		n = 1
+	}
+	if n > maxTap {
+		n = maxTap
+	}
+	t := &tap{channel: channel, remaining: n, out: make(chan *pq.Notification, n)}
+	c.taps.mu.Lock()
+	if c.taps.active == nil {
+		c.taps.active = map[*tap]struct{}{}
+	}
+	c.taps.active[t] = struct{}{}
+	c.taps.mu.Unlock()
+	return t.out, func() {
+		c.taps.mu.Lock()
+		defer c.taps.mu.Unlock()
+		if _, ok := c.taps.active[t]; ok {
+			delete(c.taps.active, t)
+			close(t.out)
+		}
+	}
+}
+
+//offer copies a notification to every tap waiting for it
+func (t *taps) offer(n *pq.Notification) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tp := range t.active {
+		if tp.channel != "" && tp.channel != n.Channel {
+			continue
+		}
+		copied := *n
+		tp.out <- &copied
+		tp.remaining--
+		if tp.remaining == 0 {
+			delete(t.active, tp)
+			close(tp.out)
+		}
+	}
+}
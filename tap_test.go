@@ -0,0 +1,66 @@
+package pqstream_test
+
+import (
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTap(t *testing.T) {
+	processed := 0
+	client, err := pqstream.NewClient([]string{"users", "accounts"}, &pqstream.Config{}, &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+			processed++
+			return nil
+		})},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tapped, cancel := client.Tap("users", 2)
+	defer cancel()
+	for _, n := range []*pq.Notification{{Channel: "accounts", Extra: "a"}, {Channel: "users", Extra: "1"}, {Channel: "users", Extra: "2"}, {Channel: "users", Extra: "3"}} {
+		client.Process(n)
+	}
+	var got []string
+	for n := range tapped {
+		got = append(got, n.Extra)
+	}
+	if len(got) != 2 || got[0] != "1" || got[1] != "2" || processed != 4 {
+		t.Fatalf("expected the next two users notifications to be tapped without affecting processing, got %v and %d processed", got, processed)
+	}
+
+	_, cancel = client.Tap("", 5)
+	cancel()
+	cancel()
+
+	server := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer server.Close()
+	done := make(chan []pqstream.Record)
+	go func() {
+		resp, err := server.Client().Get(server.URL + "/tap?channel=accounts&n=1&timeout=5s")
+		if err != nil {
+			t.Error(err.Error())
+			done <- nil
+			return
+		}
+		defer resp.Body.Close()
+		var records []pqstream.Record
+		json.NewDecoder(resp.Body).Decode(&records)
+		done <- records
+	}()
+	for {
+		client.Process(&pq.Notification{Channel: "accounts", Extra: "b"})
+		select {
+		case records := <-done:
+			if len(records) != 1 || records[0].Channel != "accounts" || records[0].Payload != "b" {
+				t.Fatalf("unexpected tapped records: %+v", records)
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
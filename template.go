@@ -0,0 +1,234 @@
+package pqstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//TemplateData is what a Templates template renders: the notification's channel, pid and raw payload, its payload decoded from JSON, and when it was received
+type TemplateData struct {
+	Channel    string
+	PID        int
+	Raw        string
+	Payload    any
+	ReceivedAt time.Time
+}
+
+//TemplateFuncs are the functions available to Templates beyond text/template's builtins: default, empty, upper, lower, title, trim, replace, contains,
+//hasPrefix, hasSuffix, join, quote, trunc, toJson, toPrettyJson, get and date, with the names and arguments of their sprig counterparts, and field,
+//which looks up a dotted path in the payload, ie: {{field "customer.name" .Payload}}
+var TemplateFuncs = template.FuncMap{
+	"default": func(fallback any, given ...any) any {
+		if len(given) == 0 || empty(given[0]) {
+			return fallback
+		}
+		return given[0]
+	},
+	"empty":     empty,
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"title":     title,
+	"trim":      strings.TrimSpace,
+	"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"join":      join,
+	"quote":     quote,
+	"trunc":     trunc,
+	"toJson": func(v any) string {
+		out, _ := json.Marshal(v)
+		return string(out)
+	},
+	"toPrettyJson": func(v any) string {
+		out, _ := json.MarshalIndent(v, "", "  ")
+		return string(out)
+	},
+	"get": func(d map[string]any, key string) any {
+		if v, ok := d[key]; ok {
+			return v
+		}
+		return ""
+	},
+	"field": func(path string, payload any) any {
+		v, _ := resolve(&pq.Notification{}, payload, path)
+		return v
+	},
+	"date": date,
+}
+
+//empty reports whether a value is nil or its type's zero value, or an empty slice or map
+func empty(v any) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return value.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+//title upper cases the first ASCII letter of each word. Other runes are left as they are
+func title(s string) string {
+	b := []byte(s)
+	start := true
+	for i, c := range b {
+		if start && 'a' <= c && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+		start = c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '-' || c == '_'
+	}
+	return string(b)
+}
+
+//join joins a list's elements, or a single value, with a separator
+func join(sep string, v any) string {
+	value := reflect.ValueOf(v)
+	if v == nil || (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) {
+		return fmt.Sprint(v)
+	}
+	parts := make([]string, value.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(value.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+//quote double quotes each value, skipping nils, and joins them with spaces
+func quote(values ...any) string {
+	var quoted []string
+	for _, v := range values {
+		if v != nil {
+			quoted = append(quoted, fmt.Sprintf("%q", fmt.Sprint(v)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+//trunc keeps the first n bytes of a string, or its last -n for a negative n
+func trunc(n int, s string) string {
+	switch {
+	case n >= 0 && len(s) > n:
+		return s[:n]
+	case n < 0 && len(s)+n > 0:
+		return s[len(s)+n:]
+	}
+	return s
+}
+
+//date formats a time.Time, an RFC3339 string, ie: a timestamp from a JSON payload, or unix seconds
+func date(layout string, v any) (string, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(layout), nil
+	case *time.Time:
+		return t.Format(layout), nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse date: %s! %s", t, err.Error())
+		}
+		return parsed.Format(layout), nil
+	case float64:
+		return time.Unix(0, int64(t*float64(time.Second))).Format(layout), nil
+	case int:
+		return time.Unix(int64(t), 0).Format(layout), nil
+	case int64:
+		return time.Unix(t, 0).Format(layout), nil
+	}
+	return "", fmt.Errorf("failed to format date! unsupported type %T", v)
+}
+
+//Templates renders human readable messages, ie: Slack, email or webhook bodies, from notifications using a text/template per channel, so formatting is
+//configuration rather than code. A template keyed by "*" renders channels without their own. Missing payload fields render as <no value> unless guarded with default
+type Templates struct {
+	templates map[string]*template.Template
+	//Clock is the source of ReceivedAt. Defaults to SystemClock
+	Clock Clock
+}
+
+//ParseTemplates parses a template per channel, ie: {"orders": "Order {{.Payload.id}} for {{.Payload.total | printf \"%.2f\"}}"}
+func ParseTemplates(templates map[string]string) (*Templates, error) {
+	t := &Templates{templates: map[string]*template.Template{}}
+	for channel, text := range templates {
+		parsed, err := template.New(channel).Funcs(TemplateFuncs).Option("missingkey=default").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template for channel: %s! %s", channel, err.Error())
+		}
+		t.templates[channel] = parsed
+	}
+	return t, nil
+}
+
+func (t *Templates) template(channel string) (*template.Template, bool) {
+	if tmpl, ok := t.templates[channel]; ok {
+		return tmpl, true
+	}
+	tmpl, ok := t.templates["*"]
+	return tmpl, ok
+}
+
+//Render renders the notification with its channel's template
+func (t *Templates) Render(notification *pq.Notification) (string, error) {
+	return t.render(notification, clockOr(t.Clock).Now())
+}
+
+func (t *Templates) render(notification *pq.Notification, receivedAt time.Time) (string, error) {
+	tmpl, ok := t.template(notification.Channel)
+	if !ok {
+		return "", fmt.Errorf("no template for channel: %s", notification.Channel)
+	}
+	var payload any
+	if json.Valid([]byte(notification.Extra)) {
+		json.Unmarshal([]byte(notification.Extra), &payload)
+	}
+	b := &bytes.Buffer{}
+	err := tmpl.Execute(b, TemplateData{Channel: notification.Channel, PID: notification.BePid, Raw: notification.Extra, Payload: payload, ReceivedAt: receivedAt})
+	if err != nil {
+		return "", fmt.Errorf("failed to render template for channel: %s! %s", notification.Channel, err.Error())
+	}
+	return b.String(), nil
+}
+
+//Transform returns a pipeline transform replacing each payload with its rendered message
+func (t *Templates) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		message, err := t.Render(notification)
+		if err != nil {
+			return nil, err
+		}
+		return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: message}, nil
+	}
+}
+
+//Marshaler returns a Marshaler rendering sink bodies with the templates, ie: for WebhookSink. contentType defaults to text/plain
+func (t *Templates) Marshaler(contentType string) Marshaler {
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	return &templateMarshaler{templates: t, contentType: contentType}
+}
+
+type templateMarshaler struct {
+	templates   *Templates
+	contentType string
+}
+
+func (m *templateMarshaler) ContentType() string {
+	return m.contentType
+}
+
+func (m *templateMarshaler) Marshal(notification *pq.Notification, receivedAt time.Time) ([]byte, error) {
+	message, err := m.templates.render(notification, receivedAt)
+	return []byte(message), err
+}
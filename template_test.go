@@ -0,0 +1,83 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	if _, err := pqstream.ParseTemplates(map[string]string{"orders": "{{.Payload.id"}); err == nil {
+		t.Fatal("expected a malformed template to be rejected")
+	}
+	templates, err := pqstream.ParseTemplates(map[string]string{
+		"orders": `Order {{.Payload.id}} for {{printf "%.2f" .Payload.total}} by {{field "customer.name" .Payload | upper}} ({{default "standard" .Payload.tier}})`,
+		"*":      `{{.Channel}}: {{.Raw}}`,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	message, err := templates.Render(&pq.Notification{Channel: "orders", Extra: `{"id": 7, "total": 19.5, "customer": {"name": "bob"}}`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if message != "Order 7 for 19.50 by BOB (standard)" {
+		t.Fatalf("unexpected message: %s", message)
+	}
+	if message, _ := templates.Render(&pq.Notification{Channel: "users", Extra: "plain"}); message != "users: plain" {
+		t.Fatalf("expected the fallback template, got %s", message)
+	}
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+	}))
+	defer server.Close()
+	sink := &pqstream.WebhookSink{URL: server.URL, Marshaler: templates.Marshaler("")}
+	if err := sink.Send(context.Background(), &pq.Notification{Channel: "users", Extra: "bob"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if body != "users: bob" {
+		t.Fatalf("expected the webhook body to be rendered, got %s", body)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	payload := `{"name": "ada lovelace", "tags": ["a", "b"], "empty": [], "zero": 0, "at": "2020-01-02T03:04:05Z", "unix": 1577934245, "customer": {"id": 7}}`
+	for text, want := range map[string]string{
+		`{{default "none" .Payload.missing}} {{default "none" .Payload.zero}} {{default "none" .Payload.empty}} {{default "none" .Payload.name}}`: "none none none ada lovelace",
+		`{{empty .Payload.empty}} {{empty .Payload.tags}}`:                                                      "true false",
+		`{{upper .Payload.name}} {{lower "ADA"}} {{title .Payload.name}} {{title "ünï code-x"}}`:                "ADA LOVELACE ada Ada Lovelace ünï Code-X",
+		`[{{trim "  ada  "}}] {{replace "a" "o" .Payload.name}}`:                                                "[ada] odo loveloce",
+		`{{contains "love" .Payload.name}} {{hasPrefix "ada" .Payload.name}} {{hasSuffix "ada" .Payload.name}}`: "true true false",
+		`{{join ", " .Payload.tags}} {{join "-" .Payload.name}}`:                                                "a, b ada lovelace",
+		`{{quote .Payload.name}} {{quote "a" 1}}`:                                                               `"ada lovelace" "a" "1"`,
+		`{{trunc 3 .Payload.name}} {{trunc -3 .Payload.name}} {{trunc 99 "ada"}}`:                               "ada ace ada",
+		`{{toJson .Payload.tags}} {{toPrettyJson .Payload.customer}}`:                                           "[\"a\",\"b\"] {\n  \"id\": 7\n}",
+		`{{get .Payload.customer "id"}} [{{get .Payload.customer "missing"}}] {{field "customer.id" .Payload}}`: "7 [] 7",
+		`{{date "2006-01-02" .Payload.at}} {{date "2006" .Payload.unix}} {{date "2006" .ReceivedAt}}`:           "2020-01-02 2020 " + time.Now().UTC().Format("2006"),
+	} {
+		templates, err := pqstream.ParseTemplates(map[string]string{"*": text})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		templates.Clock = pqstream.NewFakeClock(time.Now().UTC())
+		message, err := templates.Render(&pq.Notification{Channel: "users", Extra: payload})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if message != want {
+			t.Fatalf("expected %s to render %q, got %q", text, want, message)
+		}
+	}
+	templates, _ := pqstream.ParseTemplates(map[string]string{"*": `{{date "2006" .Payload.name}}`})
+	if _, err := templates.Render(&pq.Notification{Channel: "users", Extra: payload}); err == nil {
+		t.Fatal("expected a string that isn't RFC3339 to fail to render as a date")
+	}
+}
@@ -0,0 +1,383 @@
+package pqstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"sync"
+	"time"
+)
+
+//ErrRateLimited is returned by a TenantRouter for notifications of a tenant that has exceeded its rate limit
+var ErrRateLimited = errors.New("tenant rate limited")
+
+//ErrTenantQueueFull is returned by a fair TenantRouter for notifications of a tenant whose queue is full
+var ErrTenantQueueFull = errors.New("tenant queue full")
+
+type tenantKey struct{}
+
+//WithTenant returns a context carrying a tenant identifier
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+//TenantFrom returns the tenant a TenantRouter routed a notification for
+func TenantFrom(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+//TenantStats are the counters of a single tenant
+type TenantStats struct {
+	Processed uint64 `json:"processed"`
+	Limited   uint64 `json:"limited"`
+	Errors    uint64 `json:"errors"`
+	Queued    int    `json:"queued"`
+}
+
+//A TenantRouter extracts a tenant identifier from each payload and routes the notification to that tenant's handler, or the default one, with the tenant
+//injected into the handler's context. Each tenant can be rate limited and is counted separately, so stats can be labeled by tenant.
+//A Fair router queues each tenant's notifications separately and dispatches them round-robin, so on a shared channel one noisy tenant cannot starve the others.
+//Its rate limits become quotas: a tenant over its quota waits for its bucket to refill instead of having notifications rejected
+type TenantRouter struct {
+	//Path is the payload path of the tenant identifier, ie: data.tenant_id. See Mapping for the path syntax
+	Path string
+	//Extract overrides Path with a custom tenant extractor
+	Extract func(notification *pq.Notification) (string, bool)
+	//Handlers are per-tenant handlers, ie: pipelines to per-tenant sinks
+	Handlers map[string]Handler
+	//Default handles tenants without their own handler, and notifications without a tenant. Nil drops them
+	Default Handler
+	//Rate is the number of notifications per second each tenant may process. Zero disables rate limiting
+	Rate float64
+	//Burst is the number of notifications a tenant may process at once above its rate. Defaults to 1
+	Burst int
+	//Limits overrides Rate for individual tenants
+	Limits map[string]float64
+	//Clock is the source of time for rate limiting. Defaults to SystemClock
+	Clock Clock
+	//Fair queues notifications per tenant and dispatches them round-robin on a goroutine of the router's own. Process only enqueues, and handler errors go to OnError
+	Fair bool
+	//QueueSize is the number of notifications queued per tenant by a Fair router. Defaults to 256
+	QueueSize int
+	//OnError is called with handler errors of a Fair router. Defaults to discarding them
+	OnError ErrHandlerFunc
+
+	mu      sync.Mutex
+	tenants map[string]*tenantState
+	once    sync.Once
+	order   []string
+	next    int
+	queued  int
+	closed  bool
+	ready   chan struct{}
+	done    chan struct{}
+}
+
+type tenantState struct {
+	stats  TenantStats
+	bucket *tokenBucket
+	queue  []tenantTask
+}
+
+type tenantTask struct {
+	ctx          context.Context
+	handler      Handler
+	notification *pq.Notification
+}
+
+//Name returns the router's name
+func (r *TenantRouter) Name() string {
+	return "tenants"
+}
+
+//Tenant returns the tenant identifier of a notification
+func (r *TenantRouter) Tenant(notification *pq.Notification) (string, bool) {
+	if r.Extract != nil {
+		return r.Extract(notification)
+	}
+	payload, err := decodePayload(notification)
+	if err != nil || payload == nil {
+		return "", false
+	}
+	value, ok := resolve(notification, payload, r.Path)
+	if !ok || value == nil {
+		return "", false
+	}
+	tenant := fmt.Sprint(value)
+	return tenant, tenant != ""
+}
+
+//Process routes a notification to its tenant's handler
+func (r *TenantRouter) Process(notification *pq.Notification) error {
+	return r.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext routes a notification to its tenant's handler, returning ErrRateLimited if the tenant is over its limit
+func (r *TenantRouter) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	tenant, ok := r.Tenant(notification)
+	handler := r.Default
+	if ok {
+		if h, exists := r.Handlers[tenant]; exists {
+			handler = h
+		}
+		ctx = WithTenant(ctx, tenant)
+	}
+	state := r.state(tenant)
+	if r.Fair {
+		return r.enqueue(tenant, state, tenantTask{ctx: detach(ctx), handler: handler, notification: notification})
+	}
+	if !r.allow(state) {
+		return ErrRateLimited
+	}
+	return r.run(state, tenantTask{ctx: ctx, handler: handler, notification: notification})
+}
+
+func (r *TenantRouter) run(state *tenantState, task tenantTask) error {
+	if task.handler == nil {
+		return nil
+	}
+	var err error
+	if h, ok := task.handler.(ContextHandler); ok {
+		err = h.ProcessContext(task.ctx, task.notification)
+	} else {
+		err = task.handler.Process(task.notification)
+	}
+	r.mu.Lock()
+	state.stats.Processed++
+	if err != nil {
+		state.stats.Errors++
+	}
+	r.mu.Unlock()
+	return err
+}
+
+//Close stops a Fair router from accepting notifications and waits for the queued ones to be processed or the context to expire
+func (r *TenantRouter) Close(ctx context.Context) error {
+	r.mu.Lock()
+	r.closed = true
+	done := r.done
+	r.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	r.signal()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *TenantRouter) enqueue(tenant string, state *tenantState, task tenantTask) error {
+	r.once.Do(func() {
+		r.mu.Lock()
+		r.ready = make(chan struct{}, 1)
+		r.done = make(chan struct{})
+		r.mu.Unlock()
+		go r.schedule()
+	})
+	size := r.QueueSize
+	if size <= 0 {
+		size = 256
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return errors.New("tenant router closed")
+	}
+	if len(state.queue) >= size {
+		state.stats.Limited++
+		r.mu.Unlock()
+		return ErrTenantQueueFull
+	}
+	if len(state.queue) == 0 {
+		r.order = append(r.order, tenant)
+	}
+	state.queue = append(state.queue, task)
+	r.queued++
+	r.mu.Unlock()
+	r.signal()
+	return nil
+}
+
+func (r *TenantRouter) signal() {
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+//schedule dispatches queued notifications one tenant at a time in round-robin order, skipping tenants that are out of quota until their buckets refill
+func (r *TenantRouter) schedule() {
+	defer close(r.done)
+	clock := clockOr(r.Clock)
+	for {
+		r.mu.Lock()
+		task, state, wait, ok := r.pick()
+		stop := r.closed && r.queued == 0
+		r.mu.Unlock()
+		if ok {
+			if err := r.run(state, task); err != nil && r.OnError != nil {
+				r.OnError(err)
+			}
+			continue
+		}
+		if stop {
+			return
+		}
+		if wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-r.ready:
+			}
+			continue
+		}
+		<-r.ready
+	}
+}
+
+//pick takes the next runnable task in round-robin order, or returns how long until a tenant that is out of quota can run again
+func (r *TenantRouter) pick() (tenantTask, *tenantState, time.Duration, bool) {
+	var wait time.Duration
+	for i := 0; i < len(r.order); i++ {
+		idx := (r.next + i) % len(r.order)
+		tenant := r.order[idx]
+		state := r.tenants[tenant]
+		if state.bucket != nil && !state.bucket.take() {
+			w := state.bucket.wait()
+			if w <= 0 {
+				w = time.Millisecond
+			}
+			if wait == 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+		task := state.queue[0]
+		state.queue[0] = tenantTask{}
+		state.queue = state.queue[1:]
+		r.queued--
+		if len(state.queue) == 0 {
+			r.order = append(r.order[:idx], r.order[idx+1:]...)
+			r.next = idx
+		} else {
+			r.next = idx + 1
+		}
+		if len(r.order) > 0 {
+			r.next %= len(r.order)
+		} else {
+			r.next = 0
+		}
+		return task, state, 0, true
+	}
+	return tenantTask{}, nil, wait, false
+}
+
+//Stats returns the counters of every tenant seen so far. Notifications without a tenant are counted under the empty tenant
+func (r *TenantRouter) Stats() map[string]TenantStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]TenantStats, len(r.tenants))
+	for tenant, state := range r.tenants {
+		stats := state.stats
+		stats.Queued = len(state.queue)
+		out[tenant] = stats
+	}
+	return out
+}
+
+//Tenants returns the tenants seen so far, sorted
+func (r *TenantRouter) Tenants() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenants := make([]string, 0, len(r.tenants))
+	for tenant := range r.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+func (r *TenantRouter) state(tenant string) *tenantState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tenants == nil {
+		r.tenants = map[string]*tenantState{}
+	}
+	state, ok := r.tenants[tenant]
+	if !ok {
+		state = &tenantState{}
+		rate := r.Rate
+		if limit, ok := r.Limits[tenant]; ok {
+			rate = limit
+		}
+		if rate > 0 {
+			state.bucket = newTokenBucket(rate, r.Burst, clockOr(r.Clock))
+		}
+		r.tenants[tenant] = state
+	}
+	return state
+}
+
+func (r *TenantRouter) allow(state *tenantState) bool {
+	if state.bucket == nil || state.bucket.take() {
+		return true
+	}
+	r.mu.Lock()
+	state.stats.Limited++
+	r.mu.Unlock()
+	return false
+}
+
+//tokenBucket allows rate events per second with bursts of up to burst events
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+func newTokenBucket(rate float64, burst int, clock Clock) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: clock.Now(), clock: clock}
+}
+
+func (b *tokenBucket) refill() {
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+//wait returns how long until a token is available
+func (b *tokenBucket) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+//take consumes a token if one is available
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
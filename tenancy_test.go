@@ -0,0 +1,143 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+type tenantRecorder struct {
+	tenants []string
+}
+
+func (h *tenantRecorder) Process(n *pq.Notification) error {
+	return h.ProcessContext(context.Background(), n)
+}
+
+func (h *tenantRecorder) ProcessContext(ctx context.Context, n *pq.Notification) error {
+	tenant, _ := pqstream.TenantFrom(ctx)
+	h.tenants = append(h.tenants, tenant)
+	return nil
+}
+
+func TestTenantRouter(t *testing.T) {
+	acme, shared := &tenantRecorder{}, &tenantRecorder{}
+	clock := pqstream.NewFakeClock(time.Now())
+	router := &pqstream.TenantRouter{
+		Path:     "data.tenant",
+		Handlers: map[string]pqstream.Handler{"acme": acme},
+		Default:  shared,
+		Rate:     1,
+		Limits:   map[string]float64{"acme": 100},
+		Clock:    clock,
+	}
+	for _, payload := range []string{
+		`{"data": {"tenant": "acme"}}`,
+		`{"data": {"tenant": "acme"}}`,
+		`{"data": {"tenant": 42}}`,
+		`{"data": {"tenant": 42}}`,
+		`{"data": {}}`,
+	} {
+		err := router.Process(&pq.Notification{Channel: "orders", Extra: payload})
+		if err != nil && err != pqstream.ErrRateLimited {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(acme.tenants) != 1 || acme.tenants[0] != "acme" {
+		t.Fatalf("expected acme's handler to receive acme's notifications, got: %v", acme.tenants)
+	}
+	if len(shared.tenants) != 2 || shared.tenants[0] != "42" || shared.tenants[1] != "" {
+		t.Fatalf("expected the default handler to receive other tenants, got: %v", shared.tenants)
+	}
+	stats := router.Stats()
+	if stats["acme"].Limited != 1 || stats["42"].Limited != 1 || stats["42"].Processed != 1 {
+		t.Fatalf("unexpected tenant stats: %+v", stats)
+	}
+	clock.Advance(time.Second)
+	router.Process(&pq.Notification{Channel: "orders", Extra: `{"data": {"tenant": 42}}`})
+	if router.Stats()["42"].Processed != 2 {
+		t.Fatal("expected a tenant's rate limit to refill over time")
+	}
+}
+
+func TestTenantRouterFairness(t *testing.T) {
+	release := make(chan struct{})
+	var order []string
+	handler := pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		if n.Extra == `{"tenant": "gate"}` {
+			<-release
+		}
+		order = append(order, n.Extra)
+		return nil
+	})
+	router := &pqstream.TenantRouter{Path: "tenant", Default: handler, Fair: true, QueueSize: 50}
+	if err := router.Process(&pq.Notification{Extra: `{"tenant": "gate"}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 50; i++ {
+		if err := router.Process(&pq.Notification{Extra: `{"tenant": "noisy"}`}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := router.Process(&pq.Notification{Extra: `{"tenant": "noisy"}`}); err != pqstream.ErrTenantQueueFull {
+		t.Fatalf("expected a full tenant queue to reject notifications, got: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		router.Process(&pq.Notification{Extra: `{"tenant": "quiet"}`})
+	}
+	if queued := router.Stats()["noisy"].Queued; queued != 50 {
+		t.Fatalf("expected the noisy tenant's notifications to be queued, got %d", queued)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Close(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(order) != 56 {
+		t.Fatalf("expected every queued notification to be processed, got %d", len(order))
+	}
+	last := 0
+	for i, payload := range order {
+		if payload == `{"tenant": "quiet"}` {
+			last = i
+		}
+	}
+	if last > 11 {
+		t.Fatalf("a noisy tenant starved a quiet one, whose last notification ran at position %d", last)
+	}
+}
+
+func TestTenantRouterQuota(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Now())
+	processed := make(chan string, 10)
+	router := &pqstream.TenantRouter{
+		Path: "tenant",
+		Default: pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+			processed <- n.Extra
+			return nil
+		}),
+		Fair:  true,
+		Rate:  1,
+		Clock: clock,
+	}
+	router.Process(&pq.Notification{Extra: `{"tenant": "a"}`})
+	router.Process(&pq.Notification{Extra: `{"tenant": "a"}`})
+	<-processed
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-processed:
+		t.Fatal("expected a tenant over its quota to wait")
+	default:
+	}
+	clock.Advance(time.Second)
+	<-processed
+	router.Close(context.Background())
+	if stats := router.Stats()["a"]; stats.Limited != 0 || stats.Processed != 2 {
+		t.Fatalf("expected quota to delay rather than reject notifications: %+v", stats)
+	}
+}
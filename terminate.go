@@ -0,0 +1,72 @@
+package pqstream
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"sync/atomic"
+	"time"
+)
+
+//terminationCodes are the SQLSTATEs a server closes a healthy connection with on purpose, as opposed to losing it
+var terminationCodes = map[pq.ErrorCode]string{
+	//pg_terminate_backend, which managed providers run on idle connections
+	"57P01": "admin_shutdown",
+	//idle_session_timeout, postgres 14+
+	"57P05": "idle_session_timeout",
+}
+
+//A Termination is the server terminating the listener's backend, ie: with pg_terminate_backend or idle_session_timeout, rather than the connection failing
+type Termination struct {
+	//Code is the SQLSTATE the server terminated the backend with, ie: 57P01
+	Code string `json:"code"`
+	//Reason is the code's name, ie: admin_shutdown
+	Reason string `json:"reason"`
+	//Message is the server's message, ie: terminating connection due to administrator command
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	Channels []string  `json:"channels"`
+}
+
+//TerminatedHandlerFunc is called when the server terminates the listener's backend, with every channel the connection was listening on
+type TerminatedHandlerFunc func(termination Termination)
+
+//IsTerminated reports whether a listener error is the server terminating the backend: pg_terminate_backend or an idle session timeout.
+//The server is healthy, so a terminated listener's first reconnect attempt is made straight away, unless its connection lasted under 10 seconds,
+//and it LISTENs again on every channel once connected
+func IsTerminated(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	_, ok := terminationCodes[pqErr.Code]
+	return ok
+}
+
+//termination returns the Termination a disconnect was caused by, or false if it wasn't caused by the server terminating the backend
+func (c *Client) termination(channels []string, event pq.ListenerEventType, err error) (Termination, bool) {
+	var pqErr *pq.Error
+	if event != pq.ListenerEventDisconnected || !IsTerminated(err) || !errors.As(err, &pqErr) {
+		return Termination{}, false
+	}
+	return Termination{
+		Code:     string(pqErr.Code),
+		Reason:   terminationCodes[pqErr.Code],
+		Message:  pqErr.Message,
+		Time:     c.config.Clock.Now(),
+		Channels: channels,
+	}, true
+}
+
+//onTermination counts and publishes a terminated backend on each of its channels and calls the TerminatedHandler
+func (c *Client) onTermination(t Termination) {
+	for _, ch := range t.Channels {
+		atomic.AddUint64(&c.stats.channel(ch).terminated, 1)
+		c.events.publish(Event{Type: EventTerminated, Channel: ch, Time: t.Time, State: ConnReconnecting, Error: t.Message})
+	}
+	if c.config.Verbose {
+		c.logf("server terminated the listener's backend (%s), listening again", t.Reason)
+	}
+	if c.handlers.TerminatedHandler != nil {
+		c.handlers.TerminatedHandler(t)
+	}
+}
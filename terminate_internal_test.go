@@ -0,0 +1,48 @@
+package pqstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"testing"
+)
+
+func TestTermination(t *testing.T) {
+	var terminations []Termination
+	c, err := NewClient([]string{"users", "orders"}, &Config{}, &HandlerSet{
+		Handlers:          []Handler{HandlerFunc(func(n *pq.Notification) error { return nil })},
+		TerminatedHandler: func(termination Termination) { terminations = append(terminations, termination) },
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	events, cancel := c.Events(0)
+	defer cancel()
+	channels := []string{"orders", "users"}
+	terminated := fmt.Errorf("read: %w", &pq.Error{Severity: "FATAL", Code: "57P01", Message: "terminating connection due to administrator command"})
+	c.onListenerEvent(channels, pq.ListenerEventConnected, nil)
+	states := c.onListenerEvent(channels, pq.ListenerEventDisconnected, terminated)
+	if !IsTerminated(terminated) || states[0].Event != "terminated" || states[0].State != ConnReconnecting {
+		t.Fatalf("expected the disconnect to be recorded as a termination, got: %+v", states)
+	}
+	if len(terminations) != 1 || terminations[0].Reason != "admin_shutdown" || len(terminations[0].Channels) != 2 {
+		t.Fatalf("expected the handler to be called once for the connection, got: %+v", terminations)
+	}
+	c.onListenerEvent(channels, pq.ListenerEventReconnected, nil)
+	c.onListenerEvent(channels, pq.ListenerEventDisconnected, errors.New("connection reset by peer"))
+	if len(terminations) != 1 || IsTerminated(errors.New("connection reset by peer")) {
+		t.Fatal("expected a network failure not to count as a termination")
+	}
+	if stats := c.Stats().Channels; stats["users"].Terminated != 1 || stats["orders"].Terminated != 1 {
+		t.Fatalf("expected a termination on each channel, got: %+v", stats)
+	}
+	var published int
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventTerminated {
+			published++
+		}
+	}
+	if published != 2 {
+		t.Fatalf("expected a terminated event per channel, got %d", published)
+	}
+}
@@ -0,0 +1,73 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lib/pq"
+)
+
+//Tombstones describes which change events remove an entity: every DELETE, plus updates that set a table's soft-delete column.
+//A soft-delete column counts as set when it's non-null and not false, ie: deleted_at or is_deleted
+type Tombstones struct {
+	//SoftDelete maps a schema qualified or bare table name to its soft-delete column
+	SoftDelete map[string]string
+}
+
+//Is reports whether a change event is a tombstone
+func (t Tombstones) Is(e *ChangeEvent) bool {
+	if e.Op == OpDelete {
+		return true
+	}
+	column, ok := t.SoftDelete[e.QualifiedTable()]
+	if !ok {
+		column, ok = t.SoftDelete[e.Table]
+	}
+	if !ok || e.New == nil {
+		return false
+	}
+	switch v := e.New[column]; v {
+	case nil, false:
+		return false
+	default:
+		return v != ""
+	}
+}
+
+//Transform returns a pipeline transform that rewrites soft deletes into DELETE events carrying the last state of the row as the old row,
+//so downstream sinks only need to understand one kind of tombstone. Kafka-style sinks can emit a null-valued compaction record for every DELETE
+func (t Tombstones) Transform() TransformFunc {
+	return func(notification *pq.Notification) (*pq.Notification, error) {
+		e, err := ParseChange(notification)
+		if err != nil || e.Op == OpDelete || !t.Is(e) {
+			return notification, nil
+		}
+		payload, err := json.Marshal(&ChangeEvent{Schema: e.Schema, Table: e.Table, Op: OpDelete, Old: e.New})
+		if err != nil {
+			return nil, err
+		}
+		return &pq.Notification{BePid: notification.BePid, Channel: notification.Channel, Extra: string(payload)}, nil
+	}
+}
+
+//A TombstoneSink is a sink that can remove the entity a tombstone refers to, ie: a search index or cache deleting a document
+type TombstoneSink interface {
+	Sink
+	Delete(ctx context.Context, notification *pq.Notification, e *ChangeEvent) error
+}
+
+type tombstoneSink struct {
+	TombstoneSink
+	rules Tombstones
+}
+
+//WithTombstones routes tombstones to the sink's Delete instead of Send, so entities removed in postgres are removed downstream too
+func WithTombstones(sink TombstoneSink, rules Tombstones) Sink {
+	return &tombstoneSink{TombstoneSink: sink, rules: rules}
+}
+
+func (s *tombstoneSink) Send(ctx context.Context, notification *pq.Notification) error {
+	if e, err := ParseChange(notification); err == nil && s.rules.Is(e) {
+		return s.TombstoneSink.Delete(ctx, notification, e)
+	}
+	return s.TombstoneSink.Send(ctx, notification)
+}
@@ -0,0 +1,51 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+type indexSink struct {
+	docs map[string]bool
+}
+
+func (s *indexSink) Name() string { return "index" }
+
+func (s *indexSink) Send(ctx context.Context, n *pq.Notification) error {
+	e, err := pqstream.ParseChange(n)
+	if err != nil {
+		return err
+	}
+	s.docs[e.New["id"].(string)] = true
+	return nil
+}
+
+func (s *indexSink) Delete(ctx context.Context, n *pq.Notification, e *pqstream.ChangeEvent) error {
+	delete(s.docs, e.Old["id"].(string))
+	return nil
+}
+
+func TestTombstones(t *testing.T) {
+	rules := pqstream.Tombstones{SoftDelete: map[string]string{"users": "deleted_at"}}
+	index := &indexSink{docs: map[string]bool{}}
+	p := pqstream.NewPipeline().Transform(rules.Transform()).FanOut(pqstream.WithTombstones(index, rules))
+	for _, payload := range []string{
+		`{"table": "users", "op": "INSERT", "new": {"id": "1", "deleted_at": null}}`,
+		`{"table": "users", "op": "INSERT", "new": {"id": "2", "deleted_at": null}}`,
+		`{"table": "users", "op": "INSERT", "new": {"id": "3", "deleted_at": null}}`,
+		`{"table": "users", "op": "UPDATE", "old": {"id": "1", "deleted_at": null}, "new": {"id": "1", "deleted_at": "2020-01-02T15:04:05Z"}}`,
+		`{"table": "users", "op": "DELETE", "old": {"id": "2"}}`,
+	} {
+		if err := p.Process(&pq.Notification{Channel: "users", Extra: payload}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(index.docs) != 1 || !index.docs["3"] {
+		t.Fatalf("expected soft and hard deletes to remove documents, got: %v", index.docs)
+	}
+	if rules.Is(&pqstream.ChangeEvent{Table: "users", Op: pqstream.OpUpdate, New: pqstream.Row{"deleted_at": false}}) {
+		t.Fatal("expected an unset soft-delete flag not to be a tombstone")
+	}
+}
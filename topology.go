@@ -0,0 +1,261 @@
+package pqstream
+
+import (
+	"fmt"
+	"strings"
+)
+
+//nodeKind is the role a node plays in a topology graph, which decides how it is drawn
+type nodeKind int
+
+const (
+	nodeChannel nodeKind = iota
+	nodeHandler
+	nodeStage
+	nodeRoute
+	nodeSink
+)
+
+type topologyNode struct {
+	id    string
+	label string
+	kind  nodeKind
+}
+
+type topologyEdge struct {
+	from  string
+	to    string
+	label string
+}
+
+//topology is a directed graph of channels, handlers, pipeline stages and sinks that DOT and Mermaid documents are rendered from
+type topology struct {
+	label    string
+	nodes    []topologyNode
+	edges    []topologyEdge
+	channels map[string]string
+}
+
+func newTopology(label string) *topology {
+	return &topology{label: label, channels: map[string]string{}}
+}
+
+func (t *topology) node(label string, kind nodeKind) string {
+	id := fmt.Sprintf("n%d", len(t.nodes))
+	t.nodes = append(t.nodes, topologyNode{id: id, label: label, kind: kind})
+	return id
+}
+
+func (t *topology) channel(name string) string {
+	if id, ok := t.channels[name]; ok {
+		return id
+	}
+	id := t.node(name, nodeChannel)
+	t.channels[name] = id
+	return id
+}
+
+func (t *topology) edge(from []topologyEdge, to string) {
+	for _, e := range from {
+		t.edges = append(t.edges, topologyEdge{from: e.from, to: to, label: e.label})
+	}
+}
+
+//addPipeline draws a pipeline's stages and sinks fed by the given edges, returning edges from the nodes its output leaves through
+func (t *topology) addPipeline(p *Pipeline, from []topologyEdge) []topologyEdge {
+	current := from
+	for _, s := range p.stages {
+		if s.routes == nil {
+			id := t.node(s.name, nodeStage)
+			t.edge(current, id)
+			current = []topologyEdge{{from: id}}
+			continue
+		}
+		id := t.node(s.name, nodeRoute)
+		t.edge(current, id)
+		current = nil
+		for _, r := range s.routes {
+			label := r.Name
+			if r.When == nil {
+				label = "default"
+			}
+			if r.Branch == nil {
+				continue
+			}
+			current = append(current, t.addPipeline(r.Branch, []topologyEdge{{from: id, label: label}})...)
+		}
+	}
+	policy := p.policy.String()
+	for _, sink := range p.sinks {
+		id := t.node(sink.Name(), nodeSink)
+		for _, e := range current {
+			t.edges = append(t.edges, topologyEdge{from: e.from, to: id, label: joinLabels(e.label, policy)})
+		}
+	}
+	return current
+}
+
+func joinLabels(labels ...string) string {
+	var out []string
+	for _, l := range labels {
+		if l != "" {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+//String summarizes the policy for topology exports, eg: "retries=3 backoff=1s"
+func (e ErrorPolicy) String() string {
+	var parts []string
+	if e.Retries > 0 {
+		parts = append(parts, fmt.Sprintf("retries=%d", e.Retries))
+	}
+	if e.Backoff > 0 {
+		parts = append(parts, fmt.Sprintf("backoff=%s", e.Backoff))
+	}
+	if e.Ignore {
+		parts = append(parts, "ignore errors")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *Pipeline) topology() *topology {
+	t := newTopology("pipeline")
+	var from []topologyEdge
+	for _, ch := range p.channels {
+		from = append(from, topologyEdge{from: t.channel(ch)})
+	}
+	if len(from) == 0 {
+		from = []topologyEdge{{from: t.channel("*")}}
+	}
+	t.addPipeline(p, from)
+	return t
+}
+
+//DOT renders the pipeline's channels, stages, routes and sinks as a Graphviz DOT document. Edges into sinks are labeled with the pipeline's ErrorPolicy
+func (p *Pipeline) DOT() string {
+	return p.topology().dot()
+}
+
+//Mermaid renders the pipeline's channels, stages, routes and sinks as a Mermaid flowchart
+func (p *Pipeline) Mermaid() string {
+	return p.topology().mermaid()
+}
+
+func (c *Client) topology() *topology {
+	var policies []string
+	policies = append(policies, fmt.Sprintf("workers=%d", c.workers.size))
+	if c.config.MaxAge > 0 {
+		policies = append(policies, fmt.Sprintf("max_age=%s", c.config.MaxAge))
+	}
+	if c.config.DryRun {
+		policies = append(policies, "dry run")
+	}
+	if c.config.Standby {
+		policies = append(policies, "standby")
+	}
+	t := newTopology(fmt.Sprintf("%s (%s)", c.identity.String(), strings.Join(policies, " ")))
+	var from []topologyEdge
+	for _, ch := range c.Channels() {
+		from = append(from, topologyEdge{from: t.channel(ch)})
+	}
+	if c.handlers.StaleHandler != nil && c.config.MaxAge > 0 {
+		t.edge(relabel(from, "older than "+c.config.MaxAge.String()), t.node(nameOf(c.handlers.StaleHandler, "stale", 0), nodeHandler))
+	}
+	for _, phase := range []struct {
+		name     string
+		handlers []Handler
+	}{{"pre", c.handlers.PreHandlers}, {"main", c.mainHandlers()}, {"post", c.handlers.PostHandlers}} {
+		if len(phase.handlers) == 0 {
+			continue
+		}
+		var next []topologyEdge
+		for i, h := range phase.handlers {
+			id := t.node(nameOf(h, phase.name, i), nodeHandler)
+			t.edge(from, id)
+			next = append(next, topologyEdge{from: id})
+			if p, ok := h.(*Pipeline); ok {
+				t.addPipeline(p, []topologyEdge{{from: id}})
+			}
+		}
+		from = next
+	}
+	return t
+}
+
+func relabel(edges []topologyEdge, label string) []topologyEdge {
+	out := make([]topologyEdge, len(edges))
+	for i, e := range edges {
+		out[i] = topologyEdge{from: e.from, label: label}
+	}
+	return out
+}
+
+//DOT renders the client's channels and handler phases, with any Pipeline handlers expanded into their stages and sinks, as a Graphviz DOT document
+func (c *Client) DOT() string {
+	return c.topology().dot()
+}
+
+//Mermaid renders the client's channels and handler phases, with any Pipeline handlers expanded into their stages and sinks, as a Mermaid flowchart
+func (c *Client) Mermaid() string {
+	return c.topology().mermaid()
+}
+
+var dotShapes = map[nodeKind]string{
+	nodeChannel: "cds",
+	nodeHandler: "box, style=rounded",
+	nodeStage:   "box",
+	nodeRoute:   "diamond",
+	nodeSink:    "cylinder",
+}
+
+func (t *topology) dot() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph pqstream {\n\trankdir=LR;\n\tlabel=%s;\n", dotQuote(t.label))
+	for _, n := range t.nodes {
+		fmt.Fprintf(b, "\t%s [label=%s, shape=%s];\n", n.id, dotQuote(n.label), dotShapes[n.kind])
+	}
+	for _, e := range t.edges {
+		if e.label == "" {
+			fmt.Fprintf(b, "\t%s -> %s;\n", e.from, e.to)
+			continue
+		}
+		fmt.Fprintf(b, "\t%s -> %s [label=%s];\n", e.from, e.to, dotQuote(e.label))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+var mermaidShapes = map[nodeKind][2]string{
+	nodeChannel: {"[/", "/]"},
+	nodeHandler: {"(", ")"},
+	nodeStage:   {"[", "]"},
+	nodeRoute:   {"{", "}"},
+	nodeSink:    {"[(", ")]"},
+}
+
+func (t *topology) mermaid() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "---\ntitle: %s\n---\nflowchart LR\n", mermaidQuote(t.label))
+	for _, n := range t.nodes {
+		shape := mermaidShapes[n.kind]
+		fmt.Fprintf(b, "\t%s%s%s%s\n", n.id, shape[0], mermaidQuote(n.label), shape[1])
+	}
+	for _, e := range t.edges {
+		if e.label == "" {
+			fmt.Fprintf(b, "\t%s --> %s\n", e.from, e.to)
+			continue
+		}
+		fmt.Fprintf(b, "\t%s -->|%s| %s\n", e.from, mermaidQuote(e.label), e.to)
+	}
+	return b.String()
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+}
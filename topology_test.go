@@ -0,0 +1,88 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func topologyPipeline() *pqstream.Pipeline {
+	send := func(ctx context.Context, n *pq.Notification) error { return nil }
+	audit := pqstream.NewPipeline().FanOut(pqstream.NewSink("audit", send))
+	return pqstream.NewPipeline().
+		Source("users").
+		Filter(func(n *pq.Notification) bool { return true }).
+		Route(
+			pqstream.Route{Name: "admins", When: func(n *pq.Notification) bool { return true }, Branch: audit},
+			pqstream.Route{Name: "rest", Branch: pqstream.NewPipeline()},
+		).
+		FanOut(pqstream.NewSink("search", send)).
+		OnError(pqstream.ErrorPolicy{Retries: 3, Backoff: time.Second})
+}
+
+func TestPipelineDOT(t *testing.T) {
+	dot := topologyPipeline().DOT()
+	for _, want := range []string{
+		"digraph pqstream {",
+		`n0 [label="users", shape=cds];`,
+		`n1 [label="filter[0]", shape=box];`,
+		`n2 [label="route[1]", shape=diamond];`,
+		`n3 [label="audit", shape=cylinder];`,
+		`n4 [label="search", shape=cylinder];`,
+		"n0 -> n1;",
+		"n1 -> n2;",
+		`n2 -> n3 [label="admins"];`,
+		`n2 -> n4 [label="admins, retries=3 backoff=1s"];`,
+		`n2 -> n4 [label="default, retries=3 backoff=1s"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Fatalf("expected %q in:\n%s", want, dot)
+		}
+	}
+}
+
+func TestClientMermaid(t *testing.T) {
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{InstanceID: "orders-1", Workers: 2}, topologyPipeline())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mermaid := client.Mermaid()
+	for _, want := range []string{
+		"flowchart LR",
+		`title: "orders-1 (workers=2)"`,
+		`n0[/"users"/]`,
+		`n1("main[0](*pqstream.Pipeline)")`,
+		`n5[("search")]`,
+		"n0 --> n1",
+		`n3 -->|"admins, retries=3 backoff=1s"| n5`,
+	} {
+		if !strings.Contains(mermaid, want) {
+			t.Fatalf("expected %q in:\n%s", want, mermaid)
+		}
+	}
+
+	server := httptest.NewServer(pqstream.AdminHandler(client, pqstream.AdminOptions{Authorize: pqstream.AuthorizeAnyAdmin}))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/topology?format=mermaid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != mermaid {
+		t.Fatalf("unexpected topology response: %s", body)
+	}
+	resp, err = server.Client().Get(server.URL + "/topology?format=svg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected an unknown format to be rejected, got %d", resp.StatusCode)
+	}
+}
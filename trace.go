@@ -0,0 +1,186 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//TraceStage names a step a notification passes through in the trace log
+type TraceStage string
+
+const (
+	//TraceReceived is recorded when a notification arrives from a listener
+	TraceReceived TraceStage = "received"
+	//TraceHandlerStart is recorded before a handler runs
+	TraceHandlerStart TraceStage = "handler_start"
+	//TraceHandlerFinish is recorded after a handler returns, with its duration and error if any
+	TraceHandlerFinish TraceStage = "handler_finish"
+	//TraceFiltered is recorded when a pipeline stage drops a notification
+	TraceFiltered TraceStage = "filtered"
+	//TraceStale is recorded when a notification older than Config.MaxAge is skipped
+	TraceStale TraceStage = "stale"
+	//TraceExpired is recorded when a notification past its envelope's Deadline is skipped
+	TraceExpired TraceStage = "expired"
+	//TraceRetry is recorded before a failed sink send is retried
+	TraceRetry TraceStage = "retry"
+	//TraceSink is recorded with the result of each sink send
+	TraceSink TraceStage = "sink"
+	//TraceDone is recorded once every handler has finished with the notification
+	TraceDone TraceStage = "done"
+)
+
+//TraceEvent is a single JSON line in the trace log
+type TraceEvent struct {
+	Time     time.Time         `json:"time"`
+	TraceID  uint64            `json:"trace_id"`
+	Channel  string            `json:"channel"`
+	PID      int               `json:"pid"`
+	Stage    TraceStage        `json:"stage"`
+	Handler  string            `json:"handler,omitempty"`
+	Sink     string            `json:"sink,omitempty"`
+	Duration time.Duration     `json:"duration,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	//TraceParent is the W3C trace context of the notification's processing, so log backends correlate its trace log with the producer's and sinks' spans
+	TraceParent string `json:"traceparent,omitempty"`
+	//Fingerprint identifies the notification's payload when the client has a Config.Fingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+//tracer writes sampled notification traces as JSON lines
+type tracer struct {
+	clock    Clock
+	identity Identity
+	mu       sync.Mutex
+	enc      *json.Encoder
+	rate     float64
+	rand     *rand.Rand
+	seq      uint64
+}
+
+func newTracer(w io.Writer, rate float64, clock Clock, identity Identity) *tracer {
+	if w == nil {
+		return nil
+	}
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	return &tracer{
+		clock:    clock,
+		identity: identity,
+		enc:      json.NewEncoder(w),
+		rate:     rate,
+		rand:     rand.New(rand.NewSource(clock.Now().UnixNano())),
+	}
+}
+
+//start decides whether a notification is sampled, returning nil when it is not. The caller records TraceReceived once it has the trace's parent
+func (t *tracer) start(n *pq.Notification) *trace {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	sampled := t.rate >= 1 || t.rand.Float64() < t.rate
+	t.seq++
+	id := t.seq
+	t.mu.Unlock()
+	if !sampled {
+		return nil
+	}
+	return &trace{tracer: t, id: id, channel: n.Channel, pid: n.BePid}
+}
+
+//trace records the stages of a single sampled notification. A nil trace records nothing
+type trace struct {
+	tracer      *tracer
+	id          uint64
+	channel     string
+	pid         int
+	traceParent string
+	fingerprint string
+}
+
+//setParent records the trace context of the notification's processing in the trace's events
+func (tr *trace) setParent(t TraceContext) {
+	if tr != nil {
+		tr.traceParent = t.TraceParent()
+	}
+}
+
+//setFingerprint records the notification's fingerprint in the trace's events
+func (tr *trace) setFingerprint(fingerprint string) {
+	if tr != nil {
+		tr.fingerprint = fingerprint
+	}
+}
+
+func (tr *trace) record(e TraceEvent) {
+	if tr == nil {
+		return
+	}
+	e.Time = tr.tracer.clock.Now()
+	e.TraceID = tr.id
+	e.Channel = tr.channel
+	e.PID = tr.pid
+	e.Instance = tr.tracer.identity.InstanceID
+	e.TraceParent = tr.traceParent
+	e.Fingerprint = tr.fingerprint
+	if len(tr.tracer.identity.Labels) > 0 {
+		e.Labels = tr.tracer.identity.Labels
+	}
+	tr.tracer.mu.Lock()
+	defer tr.tracer.mu.Unlock()
+	_ = tr.tracer.enc.Encode(e)
+}
+
+//handler records the start and returns a func recording the finish of a handler
+func (tr *trace) handler(h interface{}, phase string, index int) func(err error) {
+	if tr == nil {
+		return func(error) {}
+	}
+	name := nameOf(h, phase, index)
+	tr.record(TraceEvent{Stage: TraceHandlerStart, Handler: name})
+	began := tr.tracer.clock.Now()
+	return func(err error) {
+		e := TraceEvent{Stage: TraceHandlerFinish, Handler: name, Duration: tr.tracer.clock.Now().Sub(began)}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		tr.record(e)
+	}
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, tr *trace) context.Context {
+	if tr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, tr)
+}
+
+//traceFrom returns the trace carried by a handler's context, or nil if the notification isn't sampled
+func traceFrom(ctx context.Context) *trace {
+	tr, _ := ctx.Value(traceKey{}).(*trace)
+	return tr
+}
+
+//Named is implemented by handlers and sinks that want a readable name in traces, stats and logs
+type Named interface {
+	Name() string
+}
+
+//nameOf returns a handler's name, falling back to its position and type
+func nameOf(v interface{}, phase string, index int) string {
+	if named, ok := v.(Named); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%s[%d](%T)", phase, index, v)
+}
@@ -0,0 +1,73 @@
+package pqstream_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+)
+
+type namedHandler struct{}
+
+func (namedHandler) Name() string { return "audit" }
+
+func (namedHandler) Process(notification *pq.Notification) error { return nil }
+
+func TestTraceLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	handlerSet := &pqstream.HandlerSet{
+		PreHandlers: []pqstream.Handler{namedHandler{}},
+		Handlers: []pqstream.Handler{
+			pqstream.HandlerFromHandlerFunc(func(notification *pq.Notification) error {
+				return nil
+			}),
+		},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{TraceWriter: buf}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users", BePid: 42, Extra: "{}"})
+
+	var stages []pqstream.TraceStage
+	handlers := map[string]bool{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var e pqstream.TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err.Error())
+		}
+		if e.Channel != "users" || e.PID != 42 {
+			t.Fatalf("unexpected trace event: %+v", e)
+		}
+		stages = append(stages, e.Stage)
+		if e.Handler != "" {
+			handlers[e.Handler] = true
+		}
+	}
+	if len(stages) != 6 || stages[0] != pqstream.TraceReceived || stages[5] != pqstream.TraceDone {
+		t.Fatalf("unexpected trace stages: %v", stages)
+	}
+	if !handlers["audit"] || len(handlers) != 2 {
+		t.Fatalf("unexpected traced handlers: %v", handlers)
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	handlerSet := &pqstream.HandlerSet{
+		Handlers: []pqstream.Handler{namedHandler{}},
+	}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{TraceWriter: buf, TraceSampleRate: 1e-9}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		client.Process(&pq.Notification{Channel: "users"})
+	}
+	if buf.Len() > 0 {
+		t.Fatalf("expected nearly every notification to be sampled out, got: %s", buf.String())
+	}
+}
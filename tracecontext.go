@@ -0,0 +1,179 @@
+package pqstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	//TraceParentHeader is the W3C trace context header carrying the trace and parent span
+	TraceParentHeader = "traceparent"
+	//BaggageHeader is the W3C baggage header carrying a trace's key value pairs
+	BaggageHeader = "baggage"
+	//TraceParentSetting is the transaction setting a trigger installed with TriggerSpec.Trace sends as its change events' traceparent, see SetTraceParent
+	TraceParentSetting = "pqstream.traceparent"
+	//BaggageSetting is the transaction setting a trigger installed with TriggerSpec.Trace sends as its change events' baggage
+	BaggageSetting = "pqstream.baggage"
+)
+
+//A TraceContext is a W3C trace context: the trace a notification belongs to, the span processing it and the trace's baggage.
+//Handlers find a notification's in their context with TraceContextFrom: it continues the trace from the envelope's or change event's traceparent,
+//or starts one for a notification sampled by Config.TraceWriter, and sinks propagate it downstream with InjectTrace
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	Baggage map[string]string
+}
+
+//NewTraceContext starts a sampled trace
+func NewTraceContext() TraceContext {
+	t := TraceContext{Sampled: true}
+	_, _ = rand.Read(t.TraceID[:])
+	_, _ = rand.Read(t.SpanID[:])
+	return t
+}
+
+//ParseTraceParent decodes a traceparent header, ie: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceParent(traceparent string) (TraceContext, error) {
+	t := TraceContext{}
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return t, fmt.Errorf("malformed traceparent: %q", traceparent)
+	}
+	var flags [1]byte
+	for _, part := range []struct {
+		dst []byte
+		src string
+	}{{t.TraceID[:], parts[1]}, {t.SpanID[:], parts[2]}, {flags[:], parts[3]}} {
+		if _, err := hex.Decode(part.dst, []byte(part.src)); err != nil || strings.ToLower(part.src) != part.src {
+			return t, fmt.Errorf("malformed traceparent: %q", traceparent)
+		}
+	}
+	if t.TraceID == [16]byte{} || t.SpanID == [8]byte{} {
+		return t, errors.New("traceparent has an invalid zero trace or span id")
+	}
+	t.Sampled = flags[0]&1 == 1
+	return t, nil
+}
+
+//TraceParent encodes the trace context as a traceparent header
+func (t TraceContext) TraceParent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(t.TraceID[:]) + "-" + hex.EncodeToString(t.SpanID[:]) + "-" + flags
+}
+
+//Child returns the trace context of a new span in the same trace, with the same baggage
+func (t TraceContext) Child() TraceContext {
+	_, _ = rand.Read(t.SpanID[:])
+	return t
+}
+
+//baggage encodes the trace's baggage as a baggage header, in key order
+func (t TraceContext) baggage() string {
+	keys := make([]string, 0, len(t.Baggage))
+	for k := range t.Baggage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	members := make([]string, len(keys))
+	for i, k := range keys {
+		members[i] = url.PathEscape(k) + "=" + url.PathEscape(t.Baggage[k])
+	}
+	return strings.Join(members, ",")
+}
+
+//ParseBaggage decodes a baggage header, ignoring members' properties and malformed members
+func ParseBaggage(header string) map[string]string {
+	baggage := map[string]string{}
+	for _, member := range strings.Split(header, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		k, v, ok := strings.Cut(member, "=")
+		if !ok {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSpace(k))
+		if err != nil || key == "" {
+			continue
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		baggage[key] = value
+	}
+	if len(baggage) == 0 {
+		return nil
+	}
+	return baggage
+}
+
+type traceContextKey struct{}
+
+//WithTraceContext returns a context carrying the trace context, ie: for NotifyWith to put it in the envelope it sends
+func WithTraceContext(ctx context.Context, t TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, t)
+}
+
+//TraceContextFrom returns the trace context carried by a context, ie: a handler's
+func TraceContextFrom(ctx context.Context) (TraceContext, bool) {
+	t, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return t, ok
+}
+
+//InjectTrace sets the context's traceparent and baggage, if it carries a trace context, with set, ie: as a Kafka record's headers or a Pub/Sub message's
+//attributes, so sinks let downstream consumers continue the trace started at the postgres change. WebhookSink sets them as request headers
+func InjectTrace(ctx context.Context, set func(key, value string)) {
+	t, ok := TraceContextFrom(ctx)
+	if !ok {
+		return
+	}
+	set(TraceParentHeader, t.TraceParent())
+	if baggage := t.baggage(); baggage != "" {
+		set(BaggageHeader, baggage)
+	}
+}
+
+//SetTraceParent sets the context's traceparent and baggage as the transaction's TraceParentSetting and BaggageSetting, so the change events its writes
+//send from triggers installed with TriggerSpec.Trace continue the trace. db must be the transaction
+func SetTraceParent(ctx context.Context, db Execer) error {
+	t, ok := TraceContextFrom(ctx)
+	if !ok {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "SELECT set_config($1, $2, true), set_config($3, $4, true)", TraceParentSetting, t.TraceParent(), BaggageSetting, t.baggage()); err != nil {
+		return fmt.Errorf("failed to set traceparent! %s", err.Error())
+	}
+	return nil
+}
+
+//withTraceContext sets the context's traceparent and baggage on an envelope, if it carries a trace context
+func (e *Envelope) withTraceContext(ctx context.Context) {
+	if t, ok := TraceContextFrom(ctx); ok {
+		e.TraceParent, e.Baggage = t.TraceParent(), t.baggage()
+	}
+}
+
+//receivedTrace returns the trace context of the span processing a notification: a child of the envelope's traceparent, or a new trace if the notification
+//is sampled by the client's tracer. It reports false for unsampled notifications without a traceparent
+func receivedTrace(envelope *Envelope, sampled bool) (TraceContext, bool) {
+	if envelope != nil && envelope.TraceParent != "" {
+		if parent, err := ParseTraceParent(envelope.TraceParent); err == nil {
+			parent.Baggage = ParseBaggage(envelope.Baggage)
+			return parent.Child(), true
+		}
+	}
+	if !sampled {
+		return TraceContext{}, false
+	}
+	return NewTraceContext(), true
+}
@@ -0,0 +1,81 @@
+package pqstream_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceContext(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := pqstream.ParseTraceParent(parent)
+	if err != nil || tc.TraceParent() != parent || !tc.Sampled {
+		t.Fatalf("expected the traceparent to round trip, got: %s %v", tc.TraceParent(), err)
+	}
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if _, err := pqstream.ParseTraceParent(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+	if b := pqstream.ParseBaggage("tenant=acme%20corp;prop=1, region = eu,broken"); len(b) != 2 || b["tenant"] != "acme corp" || b["region"] != "eu" {
+		t.Fatalf("unexpected baggage: %v", b)
+	}
+
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	}))
+	defer server.Close()
+	var span pqstream.TraceContext
+	pipeline := pqstream.NewPipeline().Source("orders").FanOut(
+		pqstream.NewSink("span", func(ctx context.Context, notification *pq.Notification) error {
+			span, _ = pqstream.TraceContextFrom(ctx)
+			return nil
+		}),
+		&pqstream.WebhookSink{URL: server.URL},
+	)
+	trace := &bytes.Buffer{}
+	client, err := pqstream.NewPipelineClient(&pqstream.Config{TraceWriter: trace}, pipeline)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{"traceparent": "` + parent + `", "baggage": "tenant=acme", "data": {}}`})
+	if span.TraceID != tc.TraceID || span.SpanID == tc.SpanID || span.Baggage["tenant"] != "acme" {
+		t.Fatalf("expected the handlers to run in a child span of the producer's trace, got: %+v", span)
+	}
+	if headers.Get("traceparent") != span.TraceParent() || headers.Get("baggage") != "tenant=acme" {
+		t.Fatalf("expected the webhook to carry the handler span, got: %v", headers)
+	}
+	if !strings.Contains(trace.String(), `"traceparent":"`+span.TraceParent()+`"`) {
+		t.Fatalf("expected the trace log to carry the span, got: %s", trace.String())
+	}
+	//a notification without a traceparent starts a trace when it is sampled
+	client.Process(&pq.Notification{Channel: "orders", Extra: `{}`})
+	if span.TraceID == tc.TraceID || span.TraceID == [16]byte{} {
+		t.Fatalf("expected a new trace, got: %+v", span)
+	}
+
+	db := &execRecorder{}
+	ctx := pqstream.WithTraceContext(context.Background(), span)
+	if err := pqstream.Notify(ctx, db, "orders", "", map[string]int{"id": 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	e := &pqstream.Envelope{}
+	if err := json.Unmarshal([]byte(db.args[0][1].(string)), e); err != nil || e.TraceParent != span.TraceParent() {
+		t.Fatalf("expected the envelope to continue the trace, got: %+v %v", e, err)
+	}
+	if err := pqstream.SetTraceParent(ctx, db); err != nil || db.args[1][1] != span.TraceParent() {
+		t.Fatalf("expected the transaction's traceparent to be set, got: %v %v", db.args, err)
+	}
+	up := pqstream.TriggerSpec{Table: "orders", Trace: true}.Up()
+	if strings.Count(up, `'traceparent', nullif(current_setting('pqstream.traceparent', true), '')`) != 2 {
+		t.Fatalf("expected both payloads to carry the transaction's traceparent, got: %s", up)
+	}
+}
@@ -0,0 +1,109 @@
+package pqstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+//defaultOutboundTimeout bounds each outbound request when Transport.Timeout is unset
+const defaultOutboundTimeout = 30 * time.Second
+
+//outboundClient sends the requests of HTTP based sinks given no client. Unlike http.DefaultClient, its requests time out
+var outboundClient = &http.Client{Timeout: defaultOutboundTimeout}
+
+//A Transport is the outbound connection configuration shared by HTTP based sinks: proxy, custom CA bundle, mTLS client certificate and timeouts.
+//Build it once and hand its HTTPClient to each sink, ie: WebhookSink.Client and ClientCredentials.Client, so every sink dials out the same way
+type Transport struct {
+	//ProxyURL routes requests through an HTTP proxy. Defaults to the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables
+	ProxyURL string
+	//CAFile is a PEM bundle of certificate authorities trusted in addition to the system pool
+	CAFile string
+	//CertFile and KeyFile are a PEM client certificate and key presented for mTLS
+	CertFile string
+	KeyFile  string
+	//ServerName overrides the name verified against server certificates
+	ServerName string
+	//Timeout bounds each request, including reading the response. Defaults to 30s
+	Timeout time.Duration
+	//DialTimeout bounds establishing connections. Defaults to 10s
+	DialTimeout time.Duration
+	//TLSHandshakeTimeout bounds TLS handshakes. Defaults to 10s
+	TLSHandshakeTimeout time.Duration
+	//IdleConnTimeout closes pooled connections idle this long. Defaults to 90s
+	IdleConnTimeout time.Duration
+	//MaxIdleConnsPerHost is the number of pooled connections kept per host. Defaults to 16
+	MaxIdleConnsPerHost int
+
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+//HTTPClient returns the client configured by the transport. It's built once, so every sink sharing the transport also shares its connection pool
+func (t *Transport) HTTPClient() (*http.Client, error) {
+	t.once.Do(func() {
+		t.client, t.err = t.build()
+	})
+	return t.client, t.err
+}
+
+func (t *Transport) build() (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if t.ProxyURL != "" {
+		u, err := url.Parse(t.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy url! %s", err.Error())
+		}
+		proxy = http.ProxyURL(u)
+	}
+	tlsConfig := &tls.Config{ServerName: t.ServerName, MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file! %s", err.Error())
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("failed to read ca file! no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate! %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         (&net.Dialer{Timeout: durationOr(t.DialTimeout, 10*time.Second), KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: durationOr(t.TLSHandshakeTimeout, 10*time.Second),
+		IdleConnTimeout:     durationOr(t.IdleConnTimeout, 90*time.Second),
+		MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:   true,
+	}
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = 16
+	}
+	return &http.Client{Transport: transport, Timeout: durationOr(t.Timeout, defaultOutboundTimeout)}, nil
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/pem"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	n := &pq.Notification{Channel: "orders", Extra: "{}"}
+	untrusted, err := (&pqstream.Transport{}).HTTPClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&pqstream.WebhookSink{URL: server.URL, Client: untrusted, Retries: -1}).Send(context.Background(), n); err == nil {
+		t.Fatal("expected an unknown certificate authority to be rejected")
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err.Error())
+	}
+	transport := &pqstream.Transport{CAFile: ca}
+	client, err := transport.HTTPClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again, _ := transport.HTTPClient(); again != client {
+		t.Fatal("expected the client to be shared")
+	}
+	if err := (&pqstream.WebhookSink{URL: server.URL, Client: client, Retries: -1}).Send(context.Background(), n); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	client, err = (&pqstream.Transport{ProxyURL: proxy.URL}).HTTPClient()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&pqstream.WebhookSink{URL: "http://events.internal/hook", Client: client, Retries: -1}).Send(context.Background(), n); err != nil {
+		t.Fatal(err.Error())
+	}
+	if proxied != "http://events.internal/hook" {
+		t.Fatalf("expected the request to go through the proxy, got %q", proxied)
+	}
+
+	if _, err := (&pqstream.Transport{CertFile: "missing.pem", KeyFile: "missing.key"}).HTTPClient(); err == nil {
+		t.Fatal("expected a missing client certificate to fail")
+	}
+}
@@ -0,0 +1,342 @@
+package pqstream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+//maxNotifyPayload is the largest payload, in bytes, postgres accepts in a NOTIFY
+const maxNotifyPayload = 7999
+
+//nonIdentifier matches what trigger names replace with underscores: letters of any script and digits are kept
+var nonIdentifier = regexp.MustCompile(`[^\p{L}\p{N}_]+`)
+
+//A TriggerSpec describes the row-level trigger notifying a channel with a ChangeEvent for each changed row of a table
+type TriggerSpec struct {
+	//Table is the optionally schema qualified table to watch
+	Table string `json:"table"`
+	//Channel is the channel notified. Defaults to the table's unqualified name
+	Channel string `json:"channel,omitempty"`
+	//Operations are the changes that notify. Defaults to inserts, updates and deletes
+	Operations []Op `json:"operations,omitempty"`
+	//PayloadColumns limits the rows in the payload to these columns, to keep it under the NOTIFY size limit. Defaults to every column
+	PayloadColumns []string `json:"payload_columns,omitempty"`
+	//Key are the columns sent instead of the row when a payload would exceed the NOTIFY size limit, marking the event Truncated so consumers fetch the row.
+	//Defaults to the table's primary key when installed with EnsureTriggers
+	Key []string `json:"key,omitempty"`
+	//Name names the trigger and its function. Defaults to pqstream_<table>_<channel>
+	Name string `json:"name,omitempty"`
+	//BinaryColumns are bytea columns sent as a BinaryRef to the row, by its Key, instead of their content, which a BinaryStage fetches when a handler needs it
+	BinaryColumns []string `json:"binary_columns,omitempty"`
+	//LargeObjectColumns are oid columns referencing large objects, sent as a BinaryRef a BinaryStage fetches the large object's content by
+	LargeObjectColumns []string `json:"large_object_columns,omitempty"`
+	//Types are the ColumnTypes of the payload's columns, sent in each ChangeEvent so a PGCodec decodes them faithfully, ie: numerics without losing precision.
+	//Defaults to the types introspected from information_schema when installed with EnsureTriggers or a Reconciler
+	Types map[string]ColumnType `json:"types,omitempty"`
+	//IDFunction is the SQL function, returning text or uuid, generating an ID for each ChangeEvent, ie: pqstream_uuidv7 from the library's migrations.
+	//Defaults to sending none
+	IDFunction string `json:"id_function,omitempty"`
+	//Trace sends the writing transaction's TraceParentSetting and BaggageSetting in each ChangeEvent, so the client continues the trace, see SetTraceParent
+	Trace bool `json:"trace,omitempty"`
+	//SequenceTable is the sequence table, ie: pqstream_sequences from the library's migrations, assigning each ChangeEvent the channel's next Seq so the client
+	//detects lost notifications. Defaults to sending none
+	SequenceTable string `json:"sequence_table,omitempty"`
+}
+
+func (s TriggerSpec) channel() string {
+	if s.Channel == "" {
+		return unqualified(s.Table)
+	}
+	return s.Channel
+}
+
+func (s TriggerSpec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	name := nonIdentifier.ReplaceAllString(strings.ToLower(unqualified(s.Table)+"_"+s.channel()), "_")
+	return "pqstream_" + truncateIdentifier(name, 50)
+}
+
+//function returns the trigger function's name, in the table's schema
+func (s TriggerSpec) function() string {
+	if schema := schemaOf(s.Table); schema != "" {
+		return schema + "." + s.name()
+	}
+	return s.name()
+}
+
+func (s TriggerSpec) validate() error {
+	if s.Table == "" {
+		return errors.New("trigger spec requires a table")
+	}
+	if !utf8.ValidString(s.Table) {
+		return fmt.Errorf("trigger table %q isn't valid UTF-8", s.Table)
+	}
+	if err := ValidateChannel(s.channel()); err != nil {
+		return err
+	}
+	for _, op := range s.Operations {
+		switch op {
+		case OpInsert, OpUpdate, OpDelete:
+		default:
+			return fmt.Errorf("unknown trigger operation: %s", op)
+		}
+	}
+	return nil
+}
+
+//rowJSON returns the SQL encoding a trigger row, OLD or NEW, limited to columns unless there are none
+func rowJSON(row string, columns []string) string {
+	if len(columns) == 0 {
+		return fmt.Sprintf("row_to_json(%s)", row)
+	}
+	pairs := make([]string, len(columns))
+	for i, col := range columns {
+		pairs[i] = fmt.Sprintf("%s, %s.%s", pq.QuoteLiteral(col), row, pq.QuoteIdentifier(col))
+	}
+	return fmt.Sprintf("json_build_object(%s)", strings.Join(pairs, ", "))
+}
+
+//payloadJSON returns the SQL encoding a trigger row's payload: its PayloadColumns, with binary and large object columns replaced by a BinaryRef
+func (s TriggerSpec) payloadJSON(row string) string {
+	if len(s.BinaryColumns) == 0 && len(s.LargeObjectColumns) == 0 {
+		return rowJSON(row, s.PayloadColumns)
+	}
+	key := "NULL"
+	if len(s.Key) > 0 {
+		key = rowJSON(row, s.Key)
+	}
+	var refs []string
+	ref := func(col, fields string) {
+		refs = append(refs, fmt.Sprintf("%[1]s, CASE WHEN %[2]s.%[3]s IS NOT NULL THEN jsonb_build_object('$binary', jsonb_build_object('schema', TG_TABLE_SCHEMA, 'table', TG_TABLE_NAME, 'column', %[1]s, %[4]s)) END",
+			pq.QuoteLiteral(col), row, pq.QuoteIdentifier(col), fields))
+	}
+	for _, col := range s.BinaryColumns {
+		ref(col, fmt.Sprintf("'key', %s, 'size', octet_length(%s.%s)", key, row, pq.QuoteIdentifier(col)))
+	}
+	for _, col := range s.LargeObjectColumns {
+		ref(col, fmt.Sprintf("'oid', %s.%s", row, pq.QuoteIdentifier(col)))
+	}
+	return fmt.Sprintf("(%s::jsonb || jsonb_build_object(%s))::json", rowJSON(row, s.PayloadColumns), strings.Join(refs, ", "))
+}
+
+//types returns the SQL of the event's types field, if the spec has types
+//fields returns the SQL of the payload's optional fields: its ID, trace context and Types
+func (s TriggerSpec) fields() string {
+	var fields string
+	if s.IDFunction != "" {
+		fields += fmt.Sprintf("\n\t\t'id', %s(),", quoteQualified(s.IDFunction))
+	}
+	if s.Trace {
+		fields += fmt.Sprintf("\n\t\t'traceparent', nullif(current_setting(%s, true), ''),\n\t\t'baggage', nullif(current_setting(%s, true), ''),",
+			pq.QuoteLiteral(TraceParentSetting), pq.QuoteLiteral(BaggageSetting))
+	}
+	if len(s.Types) > 0 {
+		encoded, _ := json.Marshal(s.Types)
+		fields += fmt.Sprintf("\n\t\t'types', %s::json,", pq.QuoteLiteral(string(encoded)))
+	}
+	if s.SequenceTable != "" {
+		fields += "\n\t\t'seq', assigned,"
+	}
+	return fields
+}
+
+//sequence returns the statement assigning the event's sequence number, if the spec has a SequenceTable
+func (s TriggerSpec) sequence() string {
+	if s.SequenceTable == "" {
+		return ""
+	}
+	return "\n\t" + sequenceUpsert(s.SequenceTable, pq.QuoteLiteral(s.channel())) + " INTO assigned;"
+}
+
+//withTypes returns the spec with its Types introspected, limited to the columns its payload carries, unless it declares them
+func (s TriggerSpec) withTypes(ctx context.Context, q queryer) (TriggerSpec, error) {
+	if s.Types != nil {
+		return s, nil
+	}
+	_, types, err := columnTypes(ctx, q, s.Table)
+	if err != nil {
+		return s, err
+	}
+	if len(s.PayloadColumns) > 0 {
+		sent := map[string]bool{}
+		for _, col := range append(append([]string{}, s.PayloadColumns...), s.Key...) {
+			sent[col] = true
+		}
+		for col := range types {
+			if !sent[col] {
+				delete(types, col)
+			}
+		}
+	}
+	s.Types = types
+	return s, nil
+}
+
+//Up returns the SQL installing the trigger and its function. It is idempotent, so it can be run on every deploy or written out as a Migration
+func (s TriggerSpec) Up() string {
+	ops := s.Operations
+	if len(ops) == 0 {
+		ops = []Op{OpInsert, OpUpdate, OpDelete}
+	}
+	events := make([]string, len(ops))
+	for i, op := range ops {
+		events[i] = string(op)
+	}
+	//rows too large to notify are sent as their key alone, or as neither row if there is no key
+	key := func(row string) string {
+		if len(s.Key) == 0 {
+			return "NULL"
+		}
+		return rowJSON(row, s.Key)
+	}
+	return fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[1]s() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+	payload text;
+	assigned bigint;
+BEGIN%[13]s
+	payload := json_build_object(
+		'schema', TG_TABLE_SCHEMA,
+		'table', TG_TABLE_NAME,
+		'op', TG_OP,%[11]s
+		'old', CASE WHEN TG_OP <> 'INSERT' THEN %[2]s END,
+		'new', CASE WHEN TG_OP <> 'DELETE' THEN %[3]s END
+	)::text;
+	IF octet_length(payload) > %[4]d THEN
+		payload := json_build_object(
+			'schema', TG_TABLE_SCHEMA,
+			'table', TG_TABLE_NAME,
+			'op', TG_OP,%[12]s
+			'old', CASE WHEN TG_OP <> 'INSERT' THEN %[5]s END,
+			'new', CASE WHEN TG_OP <> 'DELETE' THEN %[6]s END,
+			'truncated', true
+		)::text;
+	END IF;
+	PERFORM pg_notify(%[7]s, payload);
+	RETURN NULL;
+END
+$$;
+DROP TRIGGER IF EXISTS %[8]s ON %[9]s;
+CREATE TRIGGER %[8]s AFTER %[10]s ON %[9]s FOR EACH ROW EXECUTE PROCEDURE %[1]s()`,
+		quoteQualified(s.function()), s.payloadJSON("OLD"), s.payloadJSON("NEW"), maxNotifyPayload, key("OLD"), key("NEW"),
+		pq.QuoteLiteral(s.channel()), pq.QuoteIdentifier(s.name()), quoteQualified(s.Table), strings.Join(events, " OR "), s.fields(), strings.ReplaceAll(s.fields(), "\n\t\t", "\n\t\t\t"), s.sequence())
+}
+
+//Down returns the SQL removing the trigger and its function
+func (s TriggerSpec) Down() string {
+	return fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\nDROP FUNCTION IF EXISTS %s()", pq.QuoteIdentifier(s.name()), quoteQualified(s.Table), quoteQualified(s.function()))
+}
+
+//EnsureTriggers installs, or updates, the trigger of every spec in a single transaction. Specs without a Key fall back to their table's primary key,
+//and specs without Types to their columns' types
+func EnsureTriggers(ctx context.Context, db *sql.DB, specs ...TriggerSpec) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return err
+		}
+		if len(spec.Key) == 0 {
+			if spec.Key, err = primaryKey(ctx, tx, spec.Table); err != nil {
+				return err
+			}
+		}
+		if len(spec.BinaryColumns) > 0 && len(spec.Key) == 0 {
+			return fmt.Errorf("binary columns of %s require a key to fetch them by", spec.Table)
+		}
+		if spec, err = spec.withTypes(ctx, tx); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, spec.Up()); err != nil {
+			return fmt.Errorf("failed to install trigger on %s! %s", spec.Table, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+//DropTriggers removes the trigger of every spec and its function in a single transaction
+func DropTriggers(ctx context.Context, db *sql.DB, specs ...TriggerSpec) error {
+	if err := checkReadOnly(ctx, nil); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, spec.Down()); err != nil {
+			return fmt.Errorf("failed to drop trigger on %s! %s", spec.Table, err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+//primaryKey returns the primary key columns of a table, in key order
+func primaryKey(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT a.attname FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey, a.attnum)`, quoteQualified(table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read primary key of %s! %s", table, err.Error())
+	}
+	defer rows.Close()
+	var key []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		key = append(key, col)
+	}
+	return key, rows.Err()
+}
+
+//EnsureTriggers installs the triggers through the client's configured connection, see EnsureTriggers
+func (c *Client) EnsureTriggers(ctx context.Context, specs ...TriggerSpec) error {
+	return c.withDB(func(db *sql.DB) error {
+		return EnsureTriggers(ctx, db, specs...)
+	})
+}
+
+//DropTriggers removes the triggers through the client's configured connection, see DropTriggers
+func (c *Client) DropTriggers(ctx context.Context, specs ...TriggerSpec) error {
+	return c.withDB(func(db *sql.DB) error {
+		return DropTriggers(ctx, db, specs...)
+	})
+}
+
+//withDB runs fn on a short lived connection to the client's current host, as the role it writes as
+func (c *Client) withDB(fn func(db *sql.DB) error) error {
+	if c.config.ReadOnly {
+		return ErrReadOnly
+	}
+	host := c.Host()
+	if host == "" {
+		host = c.config.Host
+	}
+	db, err := c.config.openDB("triggers", c.config.forHost(host).WriteConnInfo())
+	if err != nil {
+		return fmt.Errorf("failed to open with connection info! %s", err.Error())
+	}
+	defer db.Close()
+	return fn(db)
+}
@@ -0,0 +1,60 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+)
+
+func TestTriggerSpecSQL(t *testing.T) {
+	spec := pqstream.TriggerSpec{
+		Table:          "app.users",
+		Operations:     []pqstream.Op{pqstream.OpInsert, pqstream.OpUpdate},
+		PayloadColumns: []string{"id", "email"},
+		Key:            []string{"id"},
+	}
+	up := spec.Up()
+	for _, want := range []string{
+		`CREATE OR REPLACE FUNCTION "app"."pqstream_users_users"() RETURNS trigger`,
+		`json_build_object('id', NEW."id", 'email', NEW."email")`,
+		`IF octet_length(payload) > 7999 THEN`,
+		`'new', CASE WHEN TG_OP <> 'DELETE' THEN json_build_object('id', NEW."id") END`,
+		`PERFORM pg_notify('users', payload)`,
+		`DROP TRIGGER IF EXISTS "pqstream_users_users" ON "app"."users"`,
+		`AFTER INSERT OR UPDATE ON "app"."users" FOR EACH ROW`,
+	} {
+		if !strings.Contains(up, want) {
+			t.Fatalf("expected trigger sql to contain %s, got:\n%s", want, up)
+		}
+	}
+	down := (pqstream.TriggerSpec{Table: "orders", Channel: "order-events"}).Down()
+	if down != "DROP TRIGGER IF EXISTS \"pqstream_orders_order_events\" ON \"orders\";\nDROP FUNCTION IF EXISTS \"pqstream_orders_order_events\"()" {
+		t.Fatalf("unexpected teardown sql: %s", down)
+	}
+	if up := (pqstream.TriggerSpec{Table: "orders"}).Up(); !strings.Contains(up, "row_to_json(OLD)") || !strings.Contains(up, "'old', CASE WHEN TG_OP <> 'INSERT' THEN NULL END") {
+		t.Fatalf("expected a spec without columns or key to send whole rows and drop them when too large, got:\n%s", up)
+	}
+}
+
+func TestEnsureTriggersReadOnly(t *testing.T) {
+	handlerSet := &pqstream.HandlerSet{Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })}}
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{ReadOnly: true}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := client.EnsureTriggers(context.Background(), pqstream.TriggerSpec{Table: "users"}); err != pqstream.ErrReadOnly {
+		t.Fatalf("expected a read-only client to refuse to install triggers, got: %v", err)
+	}
+}
+
+func TestTruncatedChange(t *testing.T) {
+	e, err := pqstream.ParseChange(&pq.Notification{Extra: `{"table": "users", "op": "UPDATE", "new": {"id": 1}, "truncated": true}`})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !e.Truncated || e.New["id"] == nil {
+		t.Fatalf("unexpected truncated event: %+v", e)
+	}
+}
@@ -0,0 +1,163 @@
+package pqstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//A Cache is a key value store a CacheWarmer pushes fresh values to. A ttl of zero means the value doesn't expire. MemoryCache is the in-process one;
+//anything else, ie: redis or memcached, is adapted from its own client in a few lines, so the module doesn't depend on one. With go-redis:
+//
+//	type redisCache struct{ client *redis.Client }
+//
+//	func (r redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+//		return r.client.Set(ctx, key, value, ttl).Err()
+//	}
+//
+//	func (r redisCache) Delete(ctx context.Context, key string) error {
+//		return r.client.Del(ctx, key).Err()
+//	}
+type Cache interface {
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+//A WarmFunc computes the value cached for a change event's row. Returning a nil value deletes the cached one
+type WarmFunc func(ctx context.Context, e *ChangeEvent) ([]byte, error)
+
+//A CacheWarmer is a Handler that keeps a read-heavy cache hot: rather than only invalidating entries when their rows change, it recomputes each changed row's value
+//and sets it, so readers never miss after a write. Deleted rows are removed from the cache
+type CacheWarmer struct {
+	Cache Cache
+	Keys  *KeyRegistry
+	//Tables limits the tables warmed, matched against schema qualified or bare table names. Empty warms every table with a registered key
+	Tables []string
+	//Prefix is prepended to each cache key, which is the table followed by a colon and the row's key
+	Prefix string
+	//TTL is how long values are cached. Zero caches them until they are replaced
+	TTL time.Duration
+	//Compute computes cached values. Defaults to the JSON encoded new row
+	Compute WarmFunc
+}
+
+//Name returns the handler's name
+func (w *CacheWarmer) Name() string {
+	return "cache_warmer"
+}
+
+//Process warms the cache from a change event
+func (w *CacheWarmer) Process(notification *pq.Notification) error {
+	return w.ProcessContext(context.Background(), notification)
+}
+
+//ProcessContext warms the cache from a change event. Payloads that aren't change events and tables that aren't warmed are ignored
+func (w *CacheWarmer) ProcessContext(ctx context.Context, notification *pq.Notification) error {
+	if w.Cache == nil || w.Keys == nil {
+		return errors.New("cache warmer requires a cache and key registry")
+	}
+	e, err := ParseChange(notification)
+	if err != nil || !w.warms(e) {
+		return nil
+	}
+	if _, ok := w.Keys.Columns(e); !ok {
+		return nil
+	}
+	key, err := w.Keys.Key(e)
+	if err != nil {
+		return err
+	}
+	key = w.Prefix + e.QualifiedTable() + ":" + key
+	var value []byte
+	if e.Op != OpDelete {
+		if value, err = w.compute(ctx, e); err != nil {
+			return fmt.Errorf("failed to compute cached value of %s! %s", key, err.Error())
+		}
+	}
+	if skipDryRun(ctx, w.Name(), notification) {
+		return nil
+	}
+	if value == nil {
+		if err := w.Cache.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete cached value of %s! %s", key, err.Error())
+		}
+		return nil
+	}
+	if err := w.Cache.Set(ctx, key, value, w.TTL); err != nil {
+		return fmt.Errorf("failed to cache value of %s! %s", key, err.Error())
+	}
+	return nil
+}
+
+func (w *CacheWarmer) warms(e *ChangeEvent) bool {
+	if len(w.Tables) == 0 {
+		return true
+	}
+	for _, table := range w.Tables {
+		if table == e.Table || table == e.QualifiedTable() {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *CacheWarmer) compute(ctx context.Context, e *ChangeEvent) ([]byte, error) {
+	if w.Compute != nil {
+		return w.Compute(ctx, e)
+	}
+	if e.New == nil {
+		return nil, nil
+	}
+	return json.Marshal(e.New)
+}
+
+//MemoryCache is an in-process Cache, safe for concurrent use
+type MemoryCache struct {
+	//Clock is the source of time for expiry. Defaults to SystemClock
+	Clock   Clock
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+//Set caches a value
+func (m *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	entry := memoryEntry{value: append([]byte{}, value...)}
+	if ttl > 0 {
+		entry.expires = clockOr(m.Clock).Now().Add(ttl)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		m.entries = map[string]memoryEntry{}
+	}
+	m.entries[key] = entry
+	return nil
+}
+
+//Delete removes a cached value
+func (m *MemoryCache) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+//Get returns a cached value, or false if there isn't an unexpired one
+func (m *MemoryCache) Get(key string) ([]byte, bool) {
+	m.mu.RLock()
+	entry, ok := m.entries[key]
+	m.mu.RUnlock()
+	if !ok || (!entry.expires.IsZero() && !clockOr(m.Clock).Now().Before(entry.expires)) {
+		return nil, false
+	}
+	return entry.value, true
+}
@@ -0,0 +1,47 @@
+package pqstream_test
+
+import (
+	"context"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestCacheWarmer(t *testing.T) {
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	cache := &pqstream.MemoryCache{Clock: clock}
+	warmer := &pqstream.CacheWarmer{
+		Cache:  cache,
+		Keys:   pqstream.NewKeyRegistry().Register("users", "id"),
+		Tables: []string{"users"},
+		Prefix: "app:",
+		TTL:    time.Minute,
+	}
+	if err := warmer.Process(&pq.Notification{Extra: `{"table": "users", "op": "INSERT", "new": {"id": 1, "name": "bob"}}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	value, ok := cache.Get("app:users:1")
+	if !ok || string(value) != `{"id":1,"name":"bob"}` {
+		t.Fatalf("unexpected cached value: %s", value)
+	}
+	clock.Advance(time.Minute)
+	if _, ok := cache.Get("app:users:1"); ok {
+		t.Fatal("expected the value to expire")
+	}
+
+	warmer.Compute = func(ctx context.Context, e *pqstream.ChangeEvent) ([]byte, error) {
+		return []byte(e.New["name"].(string)), nil
+	}
+	warmer.Process(&pq.Notification{Extra: `{"table": "users", "op": "UPDATE", "new": {"id": 1, "name": "alice"}}`})
+	if value, _ := cache.Get("app:users:1"); string(value) != "alice" {
+		t.Fatalf("unexpected computed value: %s", value)
+	}
+	warmer.Process(&pq.Notification{Extra: `{"table": "users", "op": "DELETE", "old": {"id": 1}}`})
+	if _, ok := cache.Get("app:users:1"); ok {
+		t.Fatal("expected the deleted row to be removed")
+	}
+	if err := warmer.Process(&pq.Notification{Extra: `{"table": "orders", "op": "INSERT", "new": {"id": 1}}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+package pqstream
+
+import (
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+//EventTime returns when an enveloped notification was emitted, for windowing events by when they happened rather than when they are processed
+func EventTime(notification *pq.Notification) (time.Time, bool) {
+	e := envelopeOf(notification)
+	if e == nil || e.EmittedAt.IsZero() {
+		return time.Time{}, false
+	}
+	return e.EmittedAt, true
+}
+
+//A Watermark tracks how far event time has progressed on a stream: the latest event time seen, less the lateness allowed for events arriving out
+//of order, ie: from producers whose transactions commit in a different order than they emitted. Events from before the watermark are late
+type Watermark struct {
+	//AllowedLateness is how far behind the latest event an event may be before it is late
+	AllowedLateness time.Duration
+
+	mu     sync.Mutex
+	latest time.Time
+	events uint64
+	late   uint64
+}
+
+//WatermarkStats are a Watermark's progress and counters
+type WatermarkStats struct {
+	Watermark time.Time `json:"watermark"`
+	//Latest is the latest event time seen
+	Latest time.Time `json:"latest"`
+	Events uint64    `json:"events"`
+	Late   uint64    `json:"late"`
+}
+
+//A WatermarkCollector is a Collector also measuring the progress of event time windows and the late events they drop
+type WatermarkCollector interface {
+	Collector
+	//ObserveWatermark is called as each event is windowed by an operator, ie: a RuleEngine, with the operator's watermark and whether the event was late
+	ObserveWatermark(operator string, watermark time.Time, late bool)
+}
+
+//Observe advances the watermark with an event's time, reporting whether the event is late
+func (w *Watermark) Observe(at time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events++
+	if !w.latest.IsZero() && at.Before(w.latest.Add(-w.AllowedLateness)) {
+		w.late++
+		return true
+	}
+	if at.After(w.latest) {
+		w.latest = at
+	}
+	return false
+}
+
+//Current returns the watermark, zero before any event is observed
+func (w *Watermark) Current() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current()
+}
+
+func (w *Watermark) current() time.Time {
+	if w.latest.IsZero() {
+		return time.Time{}
+	}
+	return w.latest.Add(-w.AllowedLateness)
+}
+
+//Stats returns the watermark's progress and counters
+func (w *Watermark) Stats() WatermarkStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WatermarkStats{Watermark: w.current(), Latest: w.latest, Events: w.events, Late: w.late}
+}
@@ -0,0 +1,39 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestWatermark(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := &pqstream.Watermark{AllowedLateness: 10 * time.Second}
+	if !w.Current().IsZero() {
+		t.Fatal("expected no watermark before any event")
+	}
+	for _, tc := range []struct {
+		after time.Duration
+		late  bool
+	}{{0, false}, {30 * time.Second, false}, {25 * time.Second, false}, {15 * time.Second, true}, {20 * time.Second, false}} {
+		if late := w.Observe(start.Add(tc.after)); late != tc.late {
+			t.Fatalf("expected an event at %s to be late: %v", tc.after, tc.late)
+		}
+	}
+	if stats := w.Stats(); !stats.Watermark.Equal(start.Add(20*time.Second)) || !stats.Latest.Equal(start.Add(30*time.Second)) || stats.Events != 5 || stats.Late != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	at, ok := pqstream.EventTime(&pq.Notification{Extra: `{"id": "1", "emitted_at": "2020-01-01T00:00:00Z", "data": {}}`})
+	if !ok || !at.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the envelope's emitted_at, got %s", at)
+	}
+	for _, payload := range []string{`{"id": 1}`, `plain`, `{"emitted_at": "soon"}`} {
+		if _, ok := pqstream.EventTime(&pq.Notification{Extra: payload}); ok {
+			t.Fatalf("expected %s to have no event time", payload)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package pqstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//IdempotencyKeyHeader is the header WebhookSink sends so receivers can dedupe redelivered notifications
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+//defaultWebhookTimeout bounds each webhook attempt when WebhookSink.Timeout is unset
+const defaultWebhookTimeout = 10 * time.Second
+
+//A WebhookSink POSTs each notification to an HTTP endpoint. Every request carries an Idempotency-Key: the notification's envelope ID, so redeliveries
+//can be deduped, or for a notification without one, a key unique to each Send, so only its own retries are. Two identical unenveloped payloads are two deliveries. Connection errors and 5xx responses are retried with exponential backoff,
+//and 429 or 503 responses wait for their Retry-After. Other 4xx responses fail immediately
+type WebhookSink struct {
+	URL string
+	//Client sends the requests. Defaults to a client timing out after 30s
+	Client *http.Client
+	//Timeout bounds each attempt, including reading the response, so a stalled endpoint is retried rather than holding up delivery. Defaults to 10s
+	Timeout time.Duration
+	//Marshaler encodes the request body. Defaults to RecordMarshaler
+	Marshaler Marshaler
+	//Accept is the encodings the endpoint accepts, negotiated by a Pipeline with Encodings, whose request bodies have the negotiated Content-Type
+	//and Content-Encoding. Defaults to the Marshaler's content type, uncompressed
+	Accept Accepts
+	//Headers are added to every request
+	Headers map[string]string
+	//Auth adds credentials to every request, ie: a BearerToken or ClientCredentials. A 401 response drops cached credentials and is retried
+	Auth Authenticator
+	//Retries is how many times a failed delivery is retried. Defaults to 3, negative disables retries
+	Retries int
+	//Backoff is the delay before the first retry, doubling after each attempt. Defaults to 1s
+	Backoff time.Duration
+	//MaxRetryAfter caps how long a Retry-After is honored for. Defaults to 1m
+	MaxRetryAfter time.Duration
+	//Clock is the source of time for retries and receive times. Defaults to SystemClock
+	Clock Clock
+}
+
+//Name returns the sink's name
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+//IdempotencyKey returns the key identifying a notification across deliveries: its envelope ID, or a hash of its channel, pid and payload. The hash
+//identifies content rather than a delivery: identical payloads from the same backend share it
+func IdempotencyKey(notification *pq.Notification) string {
+	if e := envelopeOf(notification); e != nil && e.ID != "" {
+		return e.ID
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", notification.Channel, notification.BePid, notification.Extra)))
+	return hex.EncodeToString(sum[:])
+}
+
+//deliveryKey returns the Idempotency-Key of one Send of a notification: its envelope ID, or its content hash followed by a random suffix
+func deliveryKey(notification *pq.Notification) (string, error) {
+	if e := envelopeOf(notification); e != nil && e.ID != "" {
+		return e.ID, nil
+	}
+	suffix, err := RandomIDs{}.NewID()
+	if err != nil {
+		return "", err
+	}
+	return IdempotencyKey(notification) + "-" + suffix, nil
+}
+
+//Send delivers a notification, retrying according to the sink's policy
+func (s *WebhookSink) Send(ctx context.Context, notification *pq.Notification) error {
+	if skipDryRun(ctx, s.Name(), notification) {
+		return nil
+	}
+	if s.URL == "" {
+		return errors.New("empty webhook url")
+	}
+	marshaler := s.marshaler()
+	body, err := marshaler.Marshal(notification, clockOr(s.Clock).Now())
+	if err != nil {
+		return err
+	}
+	key, err := deliveryKey(notification)
+	if err != nil {
+		return err
+	}
+	return s.deliver(ctx, key, body, marshaler.ContentType(), "")
+}
+
+func (s *WebhookSink) marshaler() Marshaler {
+	if s.Marshaler == nil {
+		return RecordMarshaler{}
+	}
+	return s.Marshaler
+}
+
+//Accepts returns the encodings the endpoint accepts
+func (s *WebhookSink) Accepts() Accepts {
+	if len(s.Accept.ContentTypes) == 0 && len(s.Accept.Encodings) == 0 {
+		return Accepts{ContentTypes: []string{s.marshaler().ContentType()}}
+	}
+	return s.Accept
+}
+
+//SendEncoded delivers a notification already encoded in the encoding negotiated with the endpoint, retrying according to the sink's policy
+func (s *WebhookSink) SendEncoded(ctx context.Context, notification *pq.Notification, payload []byte, encoding Encoding) error {
+	if skipDryRun(ctx, s.Name(), notification) {
+		return nil
+	}
+	if s.URL == "" {
+		return errors.New("empty webhook url")
+	}
+	key, err := deliveryKey(notification)
+	if err != nil {
+		return err
+	}
+	return s.deliver(ctx, key, payload, encoding.ContentType(), encoding.ContentEncoding())
+}
+
+//deliver posts an encoded request body, retrying according to the sink's policy
+func (s *WebhookSink) deliver(ctx context.Context, key string, body []byte, contentType, contentEncoding string) error {
+	clock := clockOr(s.Clock)
+	retries, backoff := s.Retries, s.Backoff
+	switch {
+	case retries == 0:
+		retries = 3
+	case retries < 0:
+		retries = 0
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		wait, err := s.post(ctx, body, contentType, contentEncoding, key)
+		if err == nil {
+			return nil
+		}
+		if wait < 0 || attempt >= retries {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(wait):
+		}
+	}
+}
+
+//post sends a single request. On failure it returns how long to wait before retrying: zero to use the backoff, or negative if the request shouldn't be retried
+func (s *WebhookSink) post(ctx context.Context, body []byte, contentType, contentEncoding, key string) (time.Duration, error) {
+	attempt, cancel := context.WithTimeout(ctx, durationOr(s.Timeout, defaultWebhookTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(attempt, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Set(IdempotencyKeyHeader, key)
+	InjectTrace(ctx, req.Header.Set)
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Auth != nil {
+		if err := s.Auth.Authorize(ctx, req); err != nil {
+			return 0, err
+		}
+	}
+	client := s.Client
+	if client == nil {
+		client = outboundClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, fmt.Errorf("failed to deliver webhook! %s", err.Error())
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	switch {
+	case resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return s.retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("webhook throttled: %s! %w", resp.Status, ErrThrottled)
+	case resp.StatusCode >= 500:
+		return 0, fmt.Errorf("webhook failed: %s", resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized:
+		if inv, ok := s.Auth.(invalidator); ok {
+			inv.Invalidate()
+			return 0, fmt.Errorf("webhook unauthorized: %s", resp.Status)
+		}
+	}
+	return -1, fmt.Errorf("webhook rejected: %s", resp.Status)
+}
+
+//retryAfter parses a Retry-After header given in seconds or as an HTTP date, capped at MaxRetryAfter. It returns zero if the header is missing or invalid
+func (s *WebhookSink) retryAfter(header string) time.Duration {
+	max := s.MaxRetryAfter
+	if max <= 0 {
+		max = time.Minute
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		wait = at.Sub(clockOr(s.Clock).Now())
+	}
+	if wait > max {
+		wait = max
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+//A WebhookBatchSink is a WebhookSink that is also a BatchSink, so a QuotaSink can batch to an endpoint accepting several notifications per request.
+//A batch is POSTed as a JSON array of Records, with an Idempotency-Key hashing its notifications' delivery keys
+type WebhookBatchSink struct {
+	*WebhookSink
+}
+
+//SendBatch delivers notifications in one request, retrying according to the sink's policy
+func (s *WebhookBatchSink) SendBatch(ctx context.Context, notifications []*pq.Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	if IsDryRun(ctx) {
+		for _, notification := range notifications {
+			skipDryRun(ctx, s.Name(), notification)
+		}
+		return nil
+	}
+	if s.URL == "" {
+		return errors.New("empty webhook url")
+	}
+	now := clockOr(s.Clock).Now()
+	records := make([]Record, len(notifications))
+	hash := sha256.New()
+	for i, notification := range notifications {
+		records[i] = NewRecord(notification, now)
+		key, err := deliveryKey(notification)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00", key)
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return s.deliver(ctx, hex.EncodeToString(hash.Sum(nil)), body, "application/json", "")
+}
@@ -0,0 +1,147 @@
+package pqstream_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		keys      []string
+		responses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(pqstream.IdempotencyKeyHeader))
+		status := responses[0]
+		responses = responses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	clock := pqstream.NewFakeClock(time.Unix(0, 0))
+	sink := &pqstream.WebhookSink{URL: server.URL, Clock: clock, Backoff: time.Second}
+	n := &pq.Notification{Channel: "orders", Extra: `{"id": "msg-1", "emitted_at": "2020-01-01T00:00:00Z"}`}
+	done := make(chan error)
+	go func() { done <- sink.Send(context.Background(), n) }()
+	for _, wait := range []time.Duration{7 * time.Second, time.Second} {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(wait - time.Millisecond)
+		if clock.Waiters() != 1 {
+			t.Fatalf("expected the sink to wait %s", wait)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 3 || keys[0] != "msg-1" || keys[1] != "msg-1" || keys[2] != "msg-1" {
+		t.Fatalf("expected every attempt to carry the envelope id as its idempotency key, got %v", keys)
+	}
+
+	responses = []int{http.StatusBadRequest}
+	if err := sink.Send(context.Background(), n); err == nil {
+		t.Fatal("expected a 4xx to fail without retrying")
+	}
+	raw := &pq.Notification{Channel: "orders", Extra: "plain"}
+	if key := pqstream.IdempotencyKey(raw); len(key) != 64 || key != pqstream.IdempotencyKey(&pq.Notification{Channel: "orders", Extra: "plain"}) {
+		t.Fatalf("expected a stable hash key, got %s", key)
+	}
+	keys, responses = nil, []int{http.StatusBadGateway, http.StatusOK, http.StatusOK}
+	go func() { done <- sink.Send(context.Background(), raw) }()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := sink.Send(context.Background(), raw); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(keys) != 3 || keys[0] != keys[1] || keys[1] == keys[2] {
+		t.Fatalf("expected retries to share a key and identical unenveloped payloads not to, got %v", keys)
+	}
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		stall := attempts == 1
+		mu.Unlock()
+		if stall {
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	sink := &pqstream.WebhookSink{URL: server.URL, Timeout: 50 * time.Millisecond, Backoff: time.Millisecond}
+	if err := sink.Send(context.Background(), &pq.Notification{Channel: "orders", Extra: `{"id": "msg-1"}`}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if attempts != 2 {
+		t.Fatalf("expected a stalled attempt to time out and be retried, got %d attempts", attempts)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sink.Send(ctx, &pq.Notification{Channel: "orders", Extra: `{"id": "msg-2"}`}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled context to stop delivery, got: %v", err)
+	}
+}
+
+func TestWebhookBatchSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		batches  [][]pqstream.Record
+		throttle = true
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if throttle {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		var records []pqstream.Record
+		if err := json.NewDecoder(r.Body).Decode(&records); err != nil || r.Header.Get(pqstream.IdempotencyKeyHeader) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, records)
+	}))
+	defer server.Close()
+	sink := &pqstream.WebhookBatchSink{WebhookSink: &pqstream.WebhookSink{URL: server.URL, Retries: -1}}
+	notifications := []*pq.Notification{{Channel: "orders", Extra: `{"id": 1}`}, {Channel: "orders", Extra: `{"id": 2}`}}
+	if err := sink.SendBatch(context.Background(), notifications); !errors.Is(err, pqstream.ErrThrottled) {
+		t.Fatalf("expected a 429 to be throttled, got %v", err)
+	}
+	throttle = false
+	if err := sink.SendBatch(context.Background(), notifications); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 || batches[0][1].Payload != `{"id": 2}` {
+		t.Fatalf("expected one request with both notifications, got %+v", batches)
+	}
+}
@@ -0,0 +1,134 @@
+package pqstream
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//WorkerStats describes the utilization of the client's handler worker pool
+type WorkerStats struct {
+	Size        int     `json:"size"`
+	Busy        int64   `json:"busy"`
+	Queued      int     `json:"queued"`
+	Utilization float64 `json:"utilization"`
+}
+
+//workerPool runs handler invocations on a fixed set of goroutines instead of one goroutine per handler per notification. The goroutines start with the
+//first invocation and stop when the pool is closed, after which invocations run on the caller's goroutine. Invocations run inline take one of the
+//pool's size slots too, so the pool bounds and counts every running handler
+type workerPool struct {
+	size    int
+	tasks   chan func()
+	running chan struct{}
+	busy    int64
+	slots   map[string]chan struct{}
+	start   sync.Once
+	mu      sync.RWMutex
+	closed  bool
+}
+
+//defaultWorkers sizes the pool from the number of CPUs available to the process. Handlers are usually I/O bound, so the pool is oversubscribed
+func defaultWorkers() int {
+	return 4 * runtime.GOMAXPROCS(0)
+}
+
+func newWorkerPool(size int, perChannel map[string]int) *workerPool {
+	if size <= 0 {
+		size = defaultWorkers()
+	}
+	p := &workerPool{
+		size:    size,
+		tasks:   make(chan func(), size),
+		running: make(chan struct{}, size),
+		slots:   map[string]chan struct{}{},
+	}
+	for channel, limit := range perChannel {
+		if limit > 0 {
+			p.slots[channel] = make(chan struct{}, limit)
+		}
+	}
+	return p
+}
+
+//close stops the pool's goroutines once the tasks already queued have run
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+}
+
+func (p *workerPool) work() {
+	for task := range p.tasks {
+		p.exec(task)
+	}
+}
+
+//exec runs a task once one of the pool's slots is free
+func (p *workerPool) exec(task func()) {
+	p.running <- struct{}{}
+	atomic.AddInt64(&p.busy, 1)
+	defer func() {
+		atomic.AddInt64(&p.busy, -1)
+		<-p.running
+	}()
+	task()
+}
+
+//run executes every task for a channel on the pool and waits for them all to finish. Channels with a worker override never have more than that many tasks running at once
+func (p *workerPool) run(channel string, tasks []func()) {
+	slot := p.slots[channel]
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		for _, task := range tasks {
+			task()
+		}
+		return
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(len(tasks))
+	p.start.Do(func() {
+		for i := 0; i < p.size; i++ {
+			go p.work()
+		}
+	})
+	for _, task := range tasks {
+		task := task
+		if slot != nil {
+			slot <- struct{}{}
+		}
+		p.tasks <- func() {
+			defer wg.Done()
+			if slot != nil {
+				defer func() { <-slot }()
+			}
+			task()
+		}
+	}
+	p.mu.RUnlock()
+	wg.Wait()
+}
+
+//inline reports whether a channel's single task may run on the caller's goroutine, which it may unless the channel has a worker override to enforce
+func (p *workerPool) inline(channel string) bool {
+	return p.slots[channel] == nil
+}
+
+//runInline runs a task on the caller's goroutine, counted against the pool's size
+func (p *workerPool) runInline(task func()) {
+	p.exec(task)
+}
+
+func (p *workerPool) stats() WorkerStats {
+	busy := atomic.LoadInt64(&p.busy)
+	return WorkerStats{
+		Size:        p.size,
+		Busy:        busy,
+		Queued:      len(p.tasks),
+		Utilization: float64(busy) / float64(p.size),
+	}
+}
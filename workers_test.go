@@ -0,0 +1,147 @@
+package pqstream_test
+
+import (
+	"github.com/autom8ter/pqstream"
+	"github.com/lib/pq"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func concurrencyProbe(running, peak *int64) pqstream.Handler {
+	return pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		now := atomic.AddInt64(running, 1)
+		for {
+			old := atomic.LoadInt64(peak)
+			if now <= old || atomic.CompareAndSwapInt64(peak, old, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(running, -1)
+		return nil
+	})
+}
+
+func TestWorkerPoolBounds(t *testing.T) {
+	var running, peak, serialRunning, serialPeak int64
+	handlerSet := &pqstream.HandlerSet{}
+	for i := 0; i < 6; i++ {
+		handlerSet.Handlers = append(handlerSet.Handlers, pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+			if n.Channel == "serial" {
+				return concurrencyProbe(&serialRunning, &serialPeak).Process(n)
+			}
+			return concurrencyProbe(&running, &peak).Process(n)
+		}))
+	}
+	client, err := pqstream.NewClient([]string{"users", "serial"}, &pqstream.Config{Workers: 3, ChannelWorkers: map[string]int{"serial": 1}}, handlerSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if size := client.Stats().Workers.Size; size != 3 {
+		t.Fatalf("expected 3 workers, got %d", size)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Process(&pq.Notification{Channel: "users"})
+		}()
+	}
+	wg.Wait()
+	client.Process(&pq.Notification{Channel: "serial"})
+	if peak > 3 || peak < 2 {
+		t.Fatalf("expected handler concurrency to be bounded by the pool, peaked at %d", peak)
+	}
+	if serialPeak != 1 {
+		t.Fatalf("expected the channel override to serialize handlers, peaked at %d", serialPeak)
+	}
+	if stats := client.Stats().Workers; stats.Busy != 0 || stats.Utilization != 0 {
+		t.Fatalf("expected an idle pool, got %+v", stats)
+	}
+}
+
+func TestWorkerPoolDefaultSize(t *testing.T) {
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, &pqstream.HandlerSet{Handlers: []pqstream.Handler{namedHandler{}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if size := client.Stats().Workers.Size; size != 4*runtime.GOMAXPROCS(0) {
+		t.Fatalf("expected the pool to default to GOMAXPROCS, got %d", size)
+	}
+}
+
+func TestInlineDispatch(t *testing.T) {
+	var client *pqstream.Client
+	var busy []int64
+	probe := pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error {
+		busy = append(busy, client.Stats().Workers.Busy)
+		return nil
+	})
+	client, err := pqstream.NewClient([]string{"users", "serial"}, &pqstream.Config{ChannelWorkers: map[string]int{"serial": 1}}, &pqstream.HandlerSet{Handlers: []pqstream.Handler{probe}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Process(&pq.Notification{Channel: "users"})
+	client.Process(&pq.Notification{Channel: "serial"})
+	client.Handle("users", namedHandler{})
+	client.Process(&pq.Notification{Channel: "users"})
+	if len(busy) != 3 || busy[0] != 1 || busy[1] != 1 || busy[2] != 1 {
+		t.Fatalf("expected inline and pooled handlers to be counted as busy workers, got %v", busy)
+	}
+}
+
+func TestInlineDispatchBounded(t *testing.T) {
+	var running, peak int64
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Workers: 1}, &pqstream.HandlerSet{Handlers: []pqstream.Handler{concurrencyProbe(&running, &peak)}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Process(&pq.Notification{Channel: "users"})
+		}()
+	}
+	wg.Wait()
+	if peak != 1 {
+		t.Fatalf("expected inline handlers to be bounded by Workers, peaked at %d", peak)
+	}
+}
+
+func BenchmarkProcessInline(b *testing.B) {
+	benchmarkProcess(b, &pqstream.HandlerSet{Handlers: []pqstream.Handler{namedHandler{}}})
+}
+
+func BenchmarkProcessPooled(b *testing.B) {
+	benchmarkProcess(b, &pqstream.HandlerSet{PreHandlers: []pqstream.Handler{namedHandler{}}, Handlers: []pqstream.Handler{namedHandler{}}})
+}
+
+func benchmarkProcess(b *testing.B, handlers *pqstream.HandlerSet) {
+	client, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{}, handlers)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	n := &pq.Notification{Channel: "users", Extra: `{"id": 1}`}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.Process(n)
+	}
+}
+
+func TestWorkerPoolStartsLazily(t *testing.T) {
+	before := runtime.NumGoroutine()
+	handlerSet := &pqstream.HandlerSet{Handlers: []pqstream.Handler{pqstream.HandlerFromHandlerFunc(func(n *pq.Notification) error { return nil })}}
+	if _, err := pqstream.NewClient([]string{"users"}, &pqstream.Config{Workers: 64}, handlerSet); err != nil {
+		t.Fatal(err.Error())
+	}
+	if started := runtime.NumGoroutine() - before; started >= 64 {
+		t.Fatalf("expected a client that never processed a notification to start no workers, got %d goroutines", started)
+	}
+}
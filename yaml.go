@@ -0,0 +1,350 @@
+package pqstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//yamlLine is a significant line of a YAML document, with its indentation and without its comment
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+//yamlParser parses the subset of YAML config files are written in: block mappings and sequences, flow sequences and mappings on a single line,
+//and plain, quoted, boolean, null and numeric scalars on a single line. Tabs, anchors, tags, multiple documents and multi-line scalars and flow collections
+//are rejected rather than misread
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+//yamlToJSON re-encodes a YAML document as JSON, passing a JSON object through unchanged, so config files can be written in either
+func yamlToJSON(data []byte) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return data, nil
+	}
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+//parseYAML decodes a YAML document into the maps, slices and scalars encoding/json decodes into, so it can be re-encoded as JSON and decoded into a struct
+func parseYAML(data []byte) (any, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs can't be used for indentation", i+1)
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" || (text == "---" && len(p.lines) == 0) {
+			continue
+		}
+		if text == "---" || text == "..." || strings.HasPrefix(text, "--- ") {
+			return nil, fmt.Errorf("yaml line %d: multiple documents are not supported", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if len(p.lines) == 0 {
+		return map[string]any{}, nil
+	}
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return v, nil
+}
+
+func (p *yamlParser) errorf(line yamlLine, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml line %d: %s", line.num, fmt.Sprintf(format, args...))
+}
+
+//block parses the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || (line.indent == indent && !isYAMLItem(line.text)) {
+			//the end of the sequence, which may be the value of a key at the same indentation
+			break
+		}
+		if line.indent > indent || !isYAMLItem(line.text) {
+			return nil, p.errorf(line, "unexpected indentation")
+		}
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			var item any
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				item = v
+			}
+			seq = append(seq, item)
+			continue
+		}
+		if _, _, ok := splitYAMLEntry(rest); ok || isYAMLItem(rest) {
+			//an item opening a nested block on its own line, ie: "- table: users", continues at the indentation of its content
+			nested := indent + len(line.text) - len(rest)
+			p.lines[p.pos] = yamlLine{num: line.num, indent: nested, text: rest}
+			v, err := p.block(nested)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		v, err := yamlScalar(rest)
+		if err != nil {
+			return nil, p.errorf(line, "%s", err.Error())
+		}
+		p.pos++
+		if err := p.singleLine(indent); err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+//singleLine rejects the continuation of a scalar on the lines after it, which would otherwise read as a misplaced block
+func (p *yamlParser) singleLine(indent int) error {
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return p.errorf(p.lines[p.pos], "multi-line scalars are not supported, write the value on one line")
+	}
+	return nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf(line, "unexpected indentation")
+		}
+		key, value, ok := splitYAMLEntry(line.text)
+		if !ok && strings.Contains(line.text, ":\t") {
+			return nil, p.errorf(line, "tabs can't separate a key from its value")
+		}
+		if !ok {
+			return nil, p.errorf(line, "expected key: value, got %q", line.text)
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(line, "duplicate key %q", key)
+		}
+		p.pos++
+		if value != "" {
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, p.errorf(line, "%s", err.Error())
+			}
+			if err := p.singleLine(indent); err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		m[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isYAMLItem(next.text)) {
+				v, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+			}
+		}
+	}
+	return m, nil
+}
+
+//stripYAMLComment removes a comment, a # at the start of the text or after whitespace, outside quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch ch := text[i]; {
+		case quote != 0:
+			if ch == '\\' && quote == '"' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+//splitYAMLEntry splits a "key: value" mapping entry, whose key may be quoted
+func splitYAMLEntry(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := quotedEnd(text)
+		if end < 0 || end+1 >= len(text) || text[end+1] != ':' || (end+2 < len(text) && text[end+2] != ' ') {
+			return "", "", false
+		}
+		key, err := yamlScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key.(string), strings.TrimSpace(text[end+2:]), true
+	}
+	if strings.HasSuffix(text, ":") {
+		return text[:len(text)-1], "", true
+	}
+	key, value, ok := strings.Cut(text, ": ")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimRight(key, " "), strings.TrimSpace(value), true
+}
+
+//quotedEnd returns the index of the quote closing the quoted string text starts with, or -1
+func quotedEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && quote == '"':
+			i++
+		case text[i] == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+//splitYAMLFlow splits the items of a flow sequence or mapping on the commas outside quotes and nested brackets
+func splitYAMLFlow(text string) []string {
+	var (
+		items []string
+		depth int
+		start int
+	)
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if end := quotedEnd(text[i:]); end > 0 {
+				i += end
+			}
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+func yamlScalar(text string) (any, error) {
+	switch {
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence %q, flow sequences must be on one line", text)
+		}
+		seq := []any{}
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			v, err := yamlScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("unterminated flow mapping %q, flow mappings must be on one line", text)
+		}
+		m := map[string]any{}
+		for _, item := range splitYAMLFlow(text[1 : len(text)-1]) {
+			key, value, ok := splitYAMLEntry(item)
+			if !ok {
+				return nil, fmt.Errorf("expected key: value, got %q", item)
+			}
+			v, err := yamlScalar(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case (strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'")) && quotedEnd(text) < 0:
+		return nil, fmt.Errorf("unterminated quoted string %s, quoted strings must be on one line", text)
+	case strings.HasPrefix(text, `"`):
+		if quotedEnd(text) != len(text)-1 {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		return s, nil
+	case strings.HasPrefix(text, "'"):
+		if quotedEnd(text) != len(text)-1 {
+			return nil, fmt.Errorf("invalid quoted string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return nil, fmt.Errorf("block scalars are not supported, write the value on one line")
+	case strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!"):
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+	switch text {
+	case "", "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if strings.Trim(text, "0123456789+-.eE") == "" {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,75 @@
+package pqstream
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	doc, err := parseYAML([]byte(`
+# streams managed from git
+triggers:
+- table: public.users   # the users table
+  operations: [INSERT, "UPDATE"]
+  key:
+    - id
+- table: 'orders'
+  name: 'it''s'
+empty:
+nested:
+  enabled: true
+  retries: 3
+  ratio: 0.5
+  flow: {a: 1, b: "x, y"}
+  none: ~
+  url: http://example.com/#anchor
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]any{
+		"triggers": []any{
+			map[string]any{"table": "public.users", "operations": []any{"INSERT", "UPDATE"}, "key": []any{"id"}},
+			map[string]any{"table": "orders", "name": "it's"},
+		},
+		"empty": nil,
+		"nested": map[string]any{
+			"enabled": true, "retries": int64(3), "ratio": 0.5, "flow": map[string]any{"a": int64(1), "b": "x, y"}, "none": nil, "url": "http://example.com/#anchor",
+		},
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("unexpected document: %#v", doc)
+	}
+
+	for _, invalid := range []string{"a: 1\n  b: 2", "a: 1\na: 2", "a: |\n  text", "a: [1, 2", "- a\nb: c", "a:\n\t- b"} {
+		if _, err := parseYAML([]byte(invalid)); err == nil {
+			t.Fatalf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestParseYAMLUnsupported(t *testing.T) {
+	for doc, want := range map[string]string{
+		"a:\n\tb: 1":           "yaml line 2: tabs can't be used for indentation",
+		"a:\n  \tb: 1":         "yaml line 2: tabs can't be used for indentation",
+		"a:\t1":                "yaml line 1: tabs can't separate a key from its value",
+		"a: {b: 1,\n  c: 2}":   "yaml line 1: unterminated flow mapping",
+		"a: [1,\n  2]":         "yaml line 1: unterminated flow sequence",
+		"base: &base 1":        "yaml line 1: anchors, aliases and tags are not supported",
+		"a: *base":             "yaml line 1: anchors, aliases and tags are not supported",
+		"a: !!str 1":           "yaml line 1: anchors, aliases and tags are not supported",
+		"- &item x":            "yaml line 1: anchors, aliases and tags are not supported",
+		"a: |\n  two\n  lines": "yaml line 1: block scalars are not supported",
+		"a: >-\n  folded":      "yaml line 1: block scalars are not supported",
+		"a: two\n  lines":      "yaml line 2: multi-line scalars are not supported",
+		"- two\n  lines":       "yaml line 2: multi-line scalars are not supported",
+		"a: \"two\n  lines\"":  "yaml line 1: unterminated quoted string",
+		"a: 1\n--- \nb: 2":     "yaml line 2: multiple documents are not supported",
+	} {
+		_, err := parseYAML([]byte(doc))
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("expected parsing %q to fail with %s, got: %v", doc, want, err)
+		}
+	}
+}